@@ -20,6 +20,39 @@ type Params interface {
 	zerolog.LogObjectMarshaler
 }
 
+// standardAnnounceParams are names of announce parameters defined
+// by BitTorrent specification and its extensions
+var standardAnnounceParams = map[string]struct{}{
+	"info_hash":     {},
+	"peer_id":       {},
+	"port":          {},
+	"uploaded":      {},
+	"downloaded":    {},
+	"left":          {},
+	"corrupt":       {},
+	"redundant":     {},
+	"event":         {},
+	"compact":       {},
+	"no_peer_id":    {},
+	"numwant":       {},
+	"ip":            {},
+	"ipv4":          {},
+	"ipv6":          {},
+	"key":           {},
+	"trackerid":     {},
+	"supportcrypto": {},
+	"requirecrypto": {},
+	"cryptoport":    {},
+}
+
+// IsStandardAnnounceParam reports if parameter with provided
+// (lower case) name is defined by BitTorrent specification,
+// such parameters are not placed into AnnounceRequest.ExtraParams.
+func IsStandardAnnounceParam(name string) bool {
+	_, found := standardAnnounceParams[name]
+	return found
+}
+
 type routeParamsKey struct{}
 
 // RouteParamsKey is a key for the context of a request that
@@ -60,13 +93,47 @@ func InjectRouteParamsToContext(ctx context.Context, rp RouteParams) context.Con
 	return context.WithValue(ctx, RouteParamsKey, rp)
 }
 
+type frontendKey struct{}
+
+// FrontendKey is a key for the context of a request that
+// contains the name of the frontend, which received request.
+var FrontendKey = frontendKey{}
+
+// InjectFrontendToContext returns new context with specified
+// frontend name placed in FrontendKey key
+func InjectFrontendToContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, FrontendKey, name)
+}
+
+// FrontendFromContext returns the name of the frontend, which received
+// request, or empty string if it is not set
+func FrontendFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(FrontendKey).(string)
+	return name
+}
+
+var bgContextKeys = []any{FrontendKey}
+
+// PreserveInBgContext registers context key, value of which should be copied
+// by RemapRouteParamsToBgContext along with RouteParams.
+// Should be called only from init functions.
+func PreserveInBgContext(key any) {
+	bgContextKeys = append(bgContextKeys, key)
+}
+
 // RemapRouteParamsToBgContext returns new context with context.Background parent
-// and copied RouteParams from inCtx
+// and copied RouteParams (and values registered with PreserveInBgContext) from inCtx
 func RemapRouteParamsToBgContext(inCtx context.Context) context.Context {
 	rp, isOk := inCtx.Value(RouteParamsKey).(RouteParams)
 	if !isOk {
 		logger.Warn().Msg("unable to fetch route parameters, probably jammed context")
 		rp = RouteParams{}
 	}
-	return context.WithValue(context.Background(), RouteParamsKey, rp)
+	outCtx := context.WithValue(context.Background(), RouteParamsKey, rp)
+	for _, k := range bgContextKeys {
+		if v := inCtx.Value(k); v != nil {
+			outCtx = context.WithValue(outCtx, k, v)
+		}
+	}
+	return outCtx
 }
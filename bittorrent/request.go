@@ -1,6 +1,7 @@
 package bittorrent
 
 import (
+	"math"
 	"net/netip"
 	"sort"
 	"time"
@@ -71,6 +72,8 @@ func (aa *RequestAddresses) Sanitize(ignorePrivate bool) bool {
 	}
 	uniqueAddresses := make(map[netip.Addr]bool, len(*aa))
 	for _, a := range *aa {
+		// zone is meaningless for other peers
+		a.Addr = a.WithZone("")
 		if a.IsValid() && (!ignorePrivate || a.IsGlobalUnicast() && !a.IsPrivate()) {
 			if provided, found := uniqueAddresses[a.Addr]; !found || !provided && a.Provided {
 				uniqueAddresses[a.Addr] = a.Provided
@@ -87,6 +90,17 @@ func (aa *RequestAddresses) Sanitize(ignorePrivate bool) bool {
 	return len(uniqueAddresses) > 0
 }
 
+// HasZone returns true if any of addresses is IPv6 with zone
+// (i.e. link-local fe80::1%eth0)
+func (aa *RequestAddresses) HasZone() bool {
+	for _, a := range *aa {
+		if len(a.Zone()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // GetFirst returns first address from array
 // or empty netip.Addr if array is empty
 func (aa *RequestAddresses) GetFirst() netip.Addr {
@@ -143,6 +157,41 @@ func (rp RequestPeer) MarshalZerologObject(e *zerolog.Event) {
 		Uint16("port", rp.Port)
 }
 
+// Crypto is the support of encrypted peer connections (MSE/PE)
+// declared by client in announce request.
+type Crypto uint8
+
+const (
+	// CryptoNone means that client did not declare encryption support.
+	CryptoNone Crypto = iota
+	// CryptoSupported means that client accepts encrypted connections
+	// (`supportcrypto` parameter of HTTP announce).
+	CryptoSupported
+	// CryptoRequired means that client accepts only encrypted connections
+	// (`requirecrypto` parameter of HTTP announce).
+	CryptoRequired
+)
+
+// String returns the name of encryption support level.
+func (c Crypto) String() (s string) {
+	switch c {
+	case CryptoNone:
+		s = "none"
+	case CryptoSupported:
+		s = "supported"
+	case CryptoRequired:
+		s = "required"
+	default:
+		s = "<unknown>"
+	}
+	return
+}
+
+// UnknownLeft is the value of `left` parameter sent by some clients,
+// which do not know size of torrent yet (i.e. downloading metadata).
+// Peer with unknown left is always treated as leecher.
+const UnknownLeft uint64 = math.MaxUint64
+
 // AnnounceRequest represents the parsed parameters from an announce request.
 type AnnounceRequest struct {
 	Event           Event
@@ -153,6 +202,12 @@ type AnnounceRequest struct {
 	Left            uint64
 	Downloaded      uint64
 	Uploaded        uint64
+	Crypto          Crypto
+	// ExtraParams holds parameters of request, which are not defined
+	// by BitTorrent specification (i.e. passkey or vendor flags),
+	// with lower case names. Unlike Params, it is available
+	// in post-hooks. Nil if there are no such parameters.
+	ExtraParams map[string]string
 
 	RequestPeer
 	Params
@@ -166,12 +221,20 @@ func (r AnnounceRequest) MarshalZerologObject(e *zerolog.Event) {
 		Bool("numWantProvided", r.NumWantProvided).
 		Uint32("numWant", r.NumWant).
 		Uint64("left", r.Left).
+		Bool("leftUnknown", r.LeftUnknown()).
 		Uint64("downloaded", r.Downloaded).
 		Uint64("uploaded", r.Uploaded).
+		Stringer("crypto", r.Crypto).
 		Object("source", r.RequestPeer).
 		Object("params", r.Params)
 }
 
+// LeftUnknown reports if client does not know how many bytes left
+// to download (see UnknownLeft)
+func (r AnnounceRequest) LeftUnknown() bool {
+	return r.Left == UnknownLeft
+}
+
 // AnnounceResponse represents the parameters used to create an announce
 // response.
 type AnnounceResponse struct {
@@ -181,6 +244,12 @@ type AnnounceResponse struct {
 	MinInterval time.Duration
 	IPv4Peers   Peers
 	IPv6Peers   Peers
+	// WarningMessage is the optional human-readable warning
+	// sent to client along with regular response (if supported by protocol)
+	WarningMessage string
+	// TrackerID is the optional identifier, which client should
+	// send back with next announces (if supported by protocol)
+	TrackerID string
 }
 
 // MarshalZerologObject writes fields into zerolog event
@@ -190,7 +259,9 @@ func (r AnnounceResponse) MarshalZerologObject(e *zerolog.Event) {
 		Dur("interval", r.Interval).
 		Dur("minInterval", r.MinInterval).
 		Array("ipv4Peers", r.IPv4Peers).
-		Array("ipv6Peers", r.IPv6Peers)
+		Array("ipv6Peers", r.IPv6Peers).
+		Str("warningMessage", r.WarningMessage).
+		Str("trackerID", r.TrackerID)
 }
 
 // InfoHashes wrapper of array of InfoHash-es
@@ -68,3 +68,14 @@ func TestRequestAddresses_SanitizeWOPrivate(t *testing.T) {
 	require.True(t, ra.Sanitize(true))
 	require.Equal(t, 2, len(ra))
 }
+
+func TestRequestAddresses_SanitizeZone(t *testing.T) {
+	ra := RequestAddresses{
+		{Addr: netip.MustParseAddr("fe80::1%eth0"), Provided: true},
+		{Addr: netip.MustParseAddr("fe80::1"), Provided: false},
+	}
+	require.True(t, ra.HasZone())
+	require.True(t, ra.Sanitize(false))
+	require.False(t, ra.HasZone())
+	require.Equal(t, RequestAddresses{{Addr: netip.MustParseAddr("fe80::1"), Provided: true}}, ra)
+}
@@ -9,6 +9,9 @@ var (
 	// ErrInvalidIP indicates an invalid IP for an Announce.
 	ErrInvalidIP = ClientError("invalid IP")
 
+	// ErrZonedIP indicates an IPv6 address with zone for an Announce.
+	ErrZonedIP = ClientError("zoned IP not allowed")
+
 	// ErrInvalidPort indicates an invalid Port for an Announce.
 	ErrInvalidPort = ClientError("invalid port")
 )
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"errors"
-	"os"
+	"context"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -11,9 +10,22 @@ import (
 	fu "github.com/sot-tech/mochi/frontend/udp"
 	"github.com/sot-tech/mochi/pkg/conf"
 
+	// Imports to register frontends.
+	_ "github.com/sot-tech/mochi/frontend/http3"
+	_ "github.com/sot-tech/mochi/frontend/websocket"
+
 	// Imports to register middleware hooks.
 	_ "github.com/sot-tech/mochi/middleware/clientapproval"
+	_ "github.com/sot-tech/mochi/middleware/cryptopeers"
+	_ "github.com/sot-tech/mochi/middleware/frontendpeers"
+	_ "github.com/sot-tech/mochi/middleware/ipblock"
 	_ "github.com/sot-tech/mochi/middleware/jwt"
+	_ "github.com/sot-tech/mochi/middleware/knownswarms"
+	_ "github.com/sot-tech/mochi/middleware/mininterval"
+	_ "github.com/sot-tech/mochi/middleware/peeridlimit"
+	_ "github.com/sot-tech/mochi/middleware/peerprivacy"
+	_ "github.com/sot-tech/mochi/middleware/seedergrace"
+	_ "github.com/sot-tech/mochi/middleware/snatchlog"
 	_ "github.com/sot-tech/mochi/middleware/torrentapproval"
 	_ "github.com/sot-tech/mochi/middleware/varinterval"
 
@@ -31,13 +43,53 @@ type Config struct {
 	// We can make Conf extensible enough that you can program a new response
 	// generator at the cost of making it possible for users to create config that
 	// won't compose a functional tracker.
-	AnnounceInterval    time.Duration         `yaml:"announce_interval"`
-	MinAnnounceInterval time.Duration         `yaml:"min_announce_interval"`
-	MetricsAddr         string                `yaml:"metrics_addr"`
-	Frontends           []conf.NamedMapConfig `yaml:"frontends"`
-	Storage             conf.NamedMapConfig   `yaml:"storage"`
-	PreHooks            []conf.NamedMapConfig `yaml:"prehooks"`
-	PostHooks           []conf.NamedMapConfig `yaml:"posthooks"`
+	AnnounceInterval         time.Duration         `yaml:"announce_interval"`
+	MinAnnounceInterval      time.Duration         `yaml:"min_announce_interval"`
+	DeterministicPeersWindow time.Duration         `yaml:"deterministic_peers_window"`
+	MaxPeersReturned         uint32                `yaml:"max_peers_returned"`
+	PeriodicNumWantFactor    float64               `yaml:"periodic_numwant_factor"`
+	PeerSampleScaling        string                `yaml:"peer_sample_scaling"`
+	PeerSampleMin            uint32                `yaml:"peer_sample_min"`
+	StickyPeersTTL           time.Duration         `yaml:"sticky_peers_ttl"`
+	RecentPeersTTL           time.Duration         `yaml:"recent_peers_ttl"`
+	ResponseCacheTTL         time.Duration         `yaml:"response_cache_ttl"`
+	ResponseCacheMaxScrapes  uint                  `yaml:"response_cache_max_scrapes"`
+	OmitEmptyScrapes         bool                  `yaml:"omit_empty_scrapes"`
+	RelatedInfoHashes        map[string][]string   `yaml:"related_info_hashes"`
+	RelatedPeersThreshold    uint32                `yaml:"related_peers_threshold"`
+	RelatedMaxInfoHashes     uint                  `yaml:"related_max_info_hashes"`
+	IntervalOverridesTTL     time.Duration         `yaml:"interval_overrides_ttl"`
+	StoppedAllFamilies       bool                  `yaml:"stopped_all_families"`
+	RefreshOnScrape          bool                  `yaml:"refresh_on_scrape"`
+	BreakerThreshold         uint                  `yaml:"storage_breaker_threshold"`
+	BreakerCooldown          time.Duration         `yaml:"storage_breaker_cooldown"`
+	BreakerInterval          time.Duration         `yaml:"storage_breaker_interval"`
+	StorageConcurrency       uint                  `yaml:"storage_max_concurrency"`
+	StorageConcurrencyWait   time.Duration         `yaml:"storage_concurrency_timeout"`
+	DegradedCheckInterval    time.Duration         `yaml:"storage_degraded_check_interval"`
+	DegradedInterval         time.Duration         `yaml:"storage_degraded_interval"`
+	AutoBanThreshold         uint                  `yaml:"auto_ban_threshold"`
+	AutoBanWindow            time.Duration         `yaml:"auto_ban_window"`
+	AutoBanDuration          time.Duration         `yaml:"auto_ban_duration"`
+	AutoBanAllowlist         []string              `yaml:"auto_ban_allowlist"`
+	AutoBanCacheSize         int                   `yaml:"auto_ban_cache_size"`
+	BackpressureGoroutines   int                   `yaml:"backpressure_max_goroutines"`
+	BackpressureLatency      time.Duration         `yaml:"backpressure_max_storage_latency"`
+	BackpressureFactor       float64               `yaml:"backpressure_factor"`
+	BackpressureMaxInterval  time.Duration         `yaml:"backpressure_max_interval"`
+	BackpressureCheck        time.Duration         `yaml:"backpressure_check_interval"`
+	MetricsAddr              string                `yaml:"metrics_addr"`
+	AdminAddr                string                `yaml:"admin_addr"`
+	AdminToken               string                `yaml:"admin_token"`
+	TracingEndpoint          string                `yaml:"tracing_endpoint"`
+	TracingSampleRatio       float64               `yaml:"tracing_sample_ratio"`
+	ShutdownTimeout          time.Duration         `yaml:"shutdown_timeout"`
+	Frontends                []conf.NamedMapConfig `yaml:"frontends"`
+	Storage                  conf.NamedMapConfig   `yaml:"storage"`
+	DataStorage              conf.NamedMapConfig   `yaml:"data_storage"`
+	PreHooks                 []conf.NamedMapConfig `yaml:"prehooks"`
+	PostHooks                []conf.NamedMapConfig `yaml:"posthooks"`
+	ResponseFilters          []conf.NamedMapConfig `yaml:"response_filters"`
 }
 
 // QuickConfig is the simple configuration for quick start without config file.
@@ -65,17 +117,24 @@ var QuickConfig = &Config{
 // configuration file.
 //
 // It supports relative and absolute paths and environment variables.
+// Path may also be the location of any registered conf.Source
+// (i.e. scheme://location).
 func ParseConfigFile(path string) (*Config, error) {
-	if path == "" {
-		return nil, errors.New("no config path specified")
+	src, err := conf.NewSource(path)
+	if err != nil {
+		return nil, err
 	}
+	return ReadConfig(context.Background(), src)
+}
 
-	f, err := os.Open(os.ExpandEnv(path))
+// ReadConfig returns a new Config read from provided source
+func ReadConfig(ctx context.Context, src conf.Source) (*Config, error) {
+	data, err := src.Read(ctx)
 	if err == nil {
-		defer f.Close()
-		cfgFile := new(Config)
-		err = yaml.NewDecoder(f).Decode(cfgFile)
-		return cfgFile, err
+		cfg := new(Config)
+		if err = yaml.Unmarshal(data, cfg); err == nil {
+			return cfg, nil
+		}
 	}
 	return nil, err
 }
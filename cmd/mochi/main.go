@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"runtime"
 	"syscall"
 
+	"github.com/sot-tech/mochi/pkg/conf"
 	l "github.com/sot-tech/mochi/pkg/log"
 )
 
@@ -29,7 +31,7 @@ func main() {
 	logPretty := flag.Bool(logPrettyArg, false, "enable log pretty print. used only if 'logOut' set to 'stdout' or 'stderr'. if not set, log outputs json")
 	//goland:noinspection GoBoolExpressions
 	logColored := flag.Bool(logColorsArg, runtime.GOOS == "windows", "enable log coloring. used only if set 'logPretty'")
-	configPath := flag.String(configArg, "/etc/mochi.yaml", "location of configuration file")
+	configPath := flag.String(configArg, "/etc/mochi.yaml", "location of configuration file or scheme://location of registered configuration source")
 	quickStart := flag.Bool(quickArg, false, "start tracker with default configuration (all frontends, in-memory store, no hooks)")
 	flag.Parse()
 
@@ -38,10 +40,13 @@ func main() {
 	}
 
 	var cfg *Config
+	var src conf.Source
 	if *quickStart {
 		cfg = QuickConfig
 	} else {
-		cfg, err = ParseConfigFile(*configPath)
+		if src, err = conf.NewSource(*configPath); err == nil {
+			cfg, err = ReadConfig(context.Background(), src)
+		}
 		if err != nil {
 			log.Fatal("unable to read config file: ", err)
 		}
@@ -52,6 +57,19 @@ func main() {
 		log.Fatal("unable to start server: ", err)
 	}
 	defer s.Shutdown()
+	if ws, isOk := src.(conf.WatchableSource); isOk {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if changes, err := ws.Watch(ctx); err == nil {
+			go func() {
+				for range changes {
+					l.Warn().Str("source", *configPath).Msg("configuration changed, restart required to apply it")
+				}
+			}()
+		} else {
+			l.Error().Err(err).Str("source", *configPath).Msg("unable to watch configuration source")
+		}
+	}
 	ch := make(chan os.Signal, 2)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	<-ch
@@ -4,49 +4,71 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"sync"
-
-	"github.com/rs/zerolog"
+	"net/netip"
+	"time"
 
 	"github.com/sot-tech/mochi/frontend"
 	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/stop"
+	"github.com/sot-tech/mochi/pkg/tracing"
 	"github.com/sot-tech/mochi/storage"
 )
 
 // Server represents the state of a running instance.
 type Server struct {
-	frontends []io.Closer
-	hooks     []io.Closer
-	storage   storage.PeerStorage
+	frontends       []io.Closer
+	logic           *middleware.Logic
+	storage         storage.PeerStorage
+	tracing         io.Closer
+	shutdownTimeout time.Duration
 }
 
 // Run begins an instance of Conf.
 // It is optional to provide an instance of the peer store to avoid the
 // creation of a new one.
 func (r *Server) Run(cfg *Config) (err error) {
+	r.shutdownTimeout = cfg.ShutdownTimeout
 	if len(cfg.MetricsAddr) > 0 {
 		log.Info().Str("addr", cfg.MetricsAddr).Msg("starting metrics server")
 		r.frontends = append(r.frontends, metrics.NewServer(cfg.MetricsAddr))
 	} else {
 		log.Info().Msg("metrics disabled because of empty address")
 	}
+	if len(cfg.AdminAddr) > 0 {
+		log.Info().Str("addr", cfg.AdminAddr).Msg("starting admin server")
+		var admin *metrics.Server
+		if admin, err = metrics.NewAdminServer(cfg.AdminAddr, cfg.AdminToken); err != nil {
+			return fmt.Errorf("failed to start admin server: %w", err)
+		}
+		r.frontends = append(r.frontends, admin)
+	}
 
 	r.storage, err = storage.NewStorage(cfg.Storage)
 	if err != nil {
 		return fmt.Errorf("failed to create storage: %w", err)
 	}
 
-	preHooks, err := middleware.NewHooks(cfg.PreHooks, r.storage)
-	if err != nil {
-		return fmt.Errorf("failed to configure pre-hooks: %w", err)
+	if len(cfg.DataStorage.Name) > 0 {
+		var ds storage.DataStorage
+		if ds, err = storage.NewDataStorage(cfg.DataStorage); err != nil {
+			return fmt.Errorf("failed to create data storage: %w", err)
+		}
+		r.storage = storage.NewSplitStorage(r.storage, ds)
 	}
 
-	for _, h := range preHooks {
-		if c, isOk := h.(io.Closer); isOk {
-			r.hooks = append(r.hooks, c)
+	if len(cfg.TracingEndpoint) > 0 {
+		log.Info().Str("endpoint", cfg.TracingEndpoint).Msg("starting tracing")
+		if r.tracing, err = tracing.Setup(cfg.TracingEndpoint, cfg.TracingSampleRatio); err != nil {
+			return err
 		}
+		r.storage = storage.NewTracingStorage(r.storage)
+	}
+
+	preHooks, err := middleware.NewHooks(cfg.PreHooks, r.storage)
+	if err != nil {
+		return fmt.Errorf("failed to configure pre-hooks: %w", err)
 	}
 
 	postHooks, err := middleware.NewHooks(cfg.PostHooks, r.storage)
@@ -54,16 +76,77 @@ func (r *Server) Run(cfg *Config) (err error) {
 		return fmt.Errorf("failed to configure post-hooks: %w", err)
 	}
 
-	for _, h := range postHooks {
-		if c, isOk := h.(io.Closer); isOk {
-			r.hooks = append(r.hooks, c)
+	if err = middleware.CheckIntervals(cfg.AnnounceInterval, append(preHooks, postHooks...)...); err != nil {
+		return err
+	}
+
+	filters, err := middleware.NewResponseFilters(cfg.ResponseFilters)
+	if err != nil {
+		return fmt.Errorf("failed to configure response filters: %w", err)
+	}
+
+	r.logic = middleware.NewLogic(cfg.AnnounceInterval, cfg.MinAnnounceInterval, r.storage, preHooks, postHooks, filters...)
+	r.logic.SetResponseConfig(middleware.ResponseConfig{
+		DeterministicPeersWindow: cfg.DeterministicPeersWindow,
+		MaxPeersReturned:         cfg.MaxPeersReturned,
+		PeriodicNumWantFactor:    cfg.PeriodicNumWantFactor,
+		PeerSampleScaling:        cfg.PeerSampleScaling,
+		PeerSampleMin:            cfg.PeerSampleMin,
+		StickyPeersTTL:           cfg.StickyPeersTTL,
+		RecentPeersTTL:           cfg.RecentPeersTTL,
+		ResponseCacheTTL:         cfg.ResponseCacheTTL,
+		ResponseCacheMaxScrapes:  cfg.ResponseCacheMaxScrapes,
+		OmitEmptyScrapes:         cfg.OmitEmptyScrapes,
+		RelatedInfoHashes:        cfg.RelatedInfoHashes,
+		RelatedPeersThreshold:    cfg.RelatedPeersThreshold,
+		RelatedMaxInfoHashes:     cfg.RelatedMaxInfoHashes,
+	})
+	r.logic.SetIntervalOverrides(cfg.IntervalOverridesTTL)
+	r.logic.SetSwarmConfig(middleware.SwarmConfig{
+		StoppedAllFamilies: cfg.StoppedAllFamilies,
+		RefreshOnScrape:    cfg.RefreshOnScrape,
+	})
+	r.logic.SetBreakerConfig(middleware.BreakerConfig{
+		Threshold: cfg.BreakerThreshold,
+		Cooldown:  cfg.BreakerCooldown,
+		Interval:  cfg.BreakerInterval,
+	})
+	r.logic.SetConcurrencyConfig(middleware.ConcurrencyConfig{
+		Limit:   cfg.StorageConcurrency,
+		Timeout: cfg.StorageConcurrencyWait,
+	})
+	r.logic.SetDegradedConfig(middleware.DegradedConfig{
+		CheckInterval: cfg.DegradedCheckInterval,
+		Interval:      cfg.DegradedInterval,
+	})
+	allowlist := make([]netip.Prefix, 0, len(cfg.AutoBanAllowlist))
+	for _, s := range cfg.AutoBanAllowlist {
+		var p netip.Prefix
+		if a, e := netip.ParseAddr(s); e == nil {
+			p = netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+		} else if p, err = netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("invalid auto ban allowlist prefix '%s': %w", s, err)
 		}
+		allowlist = append(allowlist, p.Masked())
 	}
+	r.logic.SetAutoBanConfig(middleware.AutoBanConfig{
+		Threshold: cfg.AutoBanThreshold,
+		Window:    cfg.AutoBanWindow,
+		Duration:  cfg.AutoBanDuration,
+		Allowlist: allowlist,
+		CacheSize: cfg.AutoBanCacheSize,
+	})
+	r.logic.SetBackpressureConfig(middleware.BackpressureConfig{
+		MaxGoroutines:     cfg.BackpressureGoroutines,
+		MaxStorageLatency: cfg.BackpressureLatency,
+		Factor:            cfg.BackpressureFactor,
+		MaxInterval:       cfg.BackpressureMaxInterval,
+		CheckInterval:     cfg.BackpressureCheck,
+	})
 
 	if len(cfg.Frontends) > 0 {
 		var fs []frontend.Frontend
-		logic := middleware.NewLogic(cfg.AnnounceInterval, cfg.MinAnnounceInterval, r.storage, preHooks, postHooks)
-		if fs, err = frontend.NewFrontends(cfg.Frontends, logic); err == nil {
+		if fs, err = frontend.NewFrontends(cfg.Frontends, r.logic); err == nil {
 			for _, f := range fs {
 				r.frontends = append(r.frontends, f)
 			}
@@ -78,49 +161,20 @@ func (r *Server) Run(cfg *Config) (err error) {
 }
 
 // Shutdown shuts down an instance of Server.
+// Components are stopped in order: frontends and metrics server
+// (with draining of in-flight requests), middleware (including
+// post hooks executed in background) and then peer store.
 func (r *Server) Shutdown() {
-	log.Debug().Msg("stopping frontends and metrics server")
-	closeGroup(r.frontends).Msg("frontends stopped")
-
-	log.Debug().Msg("stopping middleware")
-	closeGroup(r.hooks).Msg("hooks stopped")
-
-	log.Debug().Msg("stopping peer store")
-	var err error
+	var g stop.Group
+	g.Add("frontends", r.shutdownTimeout, r.frontends...)
+	if r.logic != nil {
+		g.Add("middleware", r.shutdownTimeout, r.logic)
+	}
 	if r.storage != nil {
-		err = r.storage.Close()
-	} else {
-		err = errors.New("peer store not configured")
+		g.Add("storage", r.shutdownTimeout, r.storage)
 	}
-	log.Err(err).Msg("peer store stopped")
+	// flush spans of all previous stages
+	g.Add("tracing", r.shutdownTimeout, r.tracing)
+	log.Err(g.Stop()).Msg("server stopped")
 	log.Close()
 }
-
-func closeGroup(cls []io.Closer) (e *zerolog.Event) {
-	l := len(cls)
-	errs := make([]error, l)
-	wg := sync.WaitGroup{}
-	wg.Add(l)
-	for i, cl := range cls {
-		go func(i int, cl io.Closer) {
-			defer wg.Done()
-			if e := cl.Close(); e != nil {
-				errs[i] = e
-			}
-		}(i, cl)
-	}
-	wg.Wait()
-	nnErrs := make([]error, 0, l)
-	for _, e := range errs {
-		if e != nil {
-			nnErrs = append(nnErrs, e)
-		}
-	}
-	var evt *zerolog.Event
-	if len(nnErrs) > 0 {
-		evt = log.Error().Errs("errors", nnErrs)
-	} else {
-		evt = log.Info()
-	}
-	return evt
-}
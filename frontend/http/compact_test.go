@@ -0,0 +1,60 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/bencode"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestCompactOnly(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	infoHash := strings.Repeat("a", bittorrent.InfoHashV1Len)
+	ih, _ := bittorrent.NewInfoHash([]byte(infoHash))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+
+	announce := func(compactOnly bool) any {
+		cfg, err := Config{CompactOnly: compactOnly}.Validate()
+		require.Nil(t, err)
+		lgc := middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil)
+		defer lgc.Close()
+		f := newHTTPFE(cfg, lgc)
+		var req fasthttp.Request
+		req.SetRequestURI(DefaultAnnounceRoute + "?" + url.Values{
+			"info_hash":  {infoHash},
+			"peer_id":    {strings.Repeat("2", bittorrent.PeerIDLen)},
+			"port":       {"6881"},
+			"left":       {"100"},
+			"downloaded": {"0"},
+			"uploaded":   {"0"},
+			"compact":    {"0"},
+		}.Encode())
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Init(&req, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("10.0.0.2:6881")), nil)
+		f.Server.Handler(ctx)
+		v, err := bencode.Decode(ctx.Response.Body())
+		require.Nil(t, err)
+		require.IsType(t, map[string]any{}, v)
+		return v.(map[string]any)["peers"]
+	}
+
+	require.IsType(t, []any{}, announce(false))
+	peers := announce(true)
+	require.IsType(t, "", peers)
+	require.Contains(t, peers, "\x0a\x00\x00\x01\x1a\xe1")
+}
@@ -0,0 +1,72 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// extraParamsHook sends extra parameters of every announce to channel
+type extraParamsHook chan map[string]string
+
+func (h extraParamsHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	h <- req.ExtraParams
+	return ctx, nil
+}
+
+func (extraParamsHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func TestExtraParamsInHooks(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	pre, post := make(extraParamsHook, 1), make(extraParamsHook, 1)
+	lgc := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{pre}, []middleware.Hook{post})
+	defer lgc.Close()
+	cfg, err := Config{}.Validate()
+	require.Nil(t, err)
+	f := newHTTPFE(cfg, lgc)
+
+	args := url.Values{
+		"info_hash":  {strings.Repeat("a", bittorrent.InfoHashV1Len)},
+		"peer_id":    {strings.Repeat("2", bittorrent.PeerIDLen)},
+		"port":       {"6881"},
+		"left":       {"100"},
+		"downloaded": {"0"},
+		"uploaded":   {"0"},
+		"trackerid":  {"1"},
+		"Passkey":    {"secret"},
+		"vendor":     {"flag"},
+	}
+	var req fasthttp.Request
+	req.SetRequestURI(DefaultAnnounceRoute + "?" + args.Encode())
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init(&req, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("10.0.0.2:6881")), nil)
+	f.Server.Handler(ctx)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	expected := map[string]string{"passkey": "secret", "vendor": "flag"}
+	require.Equal(t, expected, <-pre)
+	// query arguments are reused by next request, so post-hooks
+	// see parameters copied before
+	ctx.Request.Reset()
+	select {
+	case extra := <-post:
+		require.Equal(t, expected, extra)
+	case <-time.After(time.Second):
+		require.Fail(t, "post-hook was not called")
+	}
+}
@@ -3,9 +3,12 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/netip"
 	"path"
@@ -20,14 +23,18 @@ import (
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/pkg/tracing"
 )
 
 // Name - registered name of the frontend
 const Name = "http"
 
 var (
-	logger            = log.NewLogger("frontend/http")
-	errTLSNotProvided = errors.New("tls certificate/key not provided")
+	logger              = log.NewLogger("frontend/http")
+	errTLSNotProvided   = errors.New("tls certificate/key not provided")
+	errUnknownNATPolicy = errors.New("unknown nat policy")
+	errNoAdminToken     = errors.New("admin token not provided")
 )
 
 func init() {
@@ -47,13 +54,89 @@ type Config struct {
 	AnnounceRoutes  []string      `cfg:"announce_routes"`
 	ScrapeRoutes    []string      `cfg:"scrape_routes"`
 	PingRoutes      []string      `cfg:"ping_routes"`
+	// LiveRoutes are url paths of liveness check endpoint
+	// (see middleware.Logic.Live). Endpoint is disabled if not set.
+	LiveRoutes []string `cfg:"live_routes"`
+	// ReadyRoutes are url paths of readiness check endpoint
+	// (see middleware.Logic.Ready). Endpoint is disabled if not set.
+	ReadyRoutes []string `cfg:"ready_routes"`
+	// PurgeRoutes are url paths of administrative endpoint, which
+	// purges swarm of info hash (see middleware.Logic.PurgeSwarm).
+	// Endpoint is disabled if not set.
+	PurgeRoutes []string `cfg:"purge_routes"`
+	// ReloadRoutes are url paths of administrative endpoint, which
+	// forces reload of hooks' data sources (see middleware.Logic.Reload).
+	// Endpoint is disabled if not set.
+	ReloadRoutes []string `cfg:"reload_routes"`
+	// ClockSkewRoutes are url paths of administrative endpoint, which
+	// overrides maximal clock skew of connection IDs of other frontends
+	// (see middleware.Logic.SetMaxClockSkew).
+	// Endpoint is disabled if not set.
+	ClockSkewRoutes []string `cfg:"clock_skew_routes"`
+	// IntervalRoutes are url paths of administrative endpoint, which
+	// sets announce interval override of info hash
+	// (see middleware.Logic.SetIntervalOverride).
+	// Endpoint is disabled if not set.
+	IntervalRoutes []string `cfg:"interval_routes"`
+	// AdminToken is the bearer token required in `Authorization`
+	// header of administrative requests
+	AdminToken string `cfg:"admin_token"`
+	// ScrapeInterval if set, sent to client in scrape response
+	// as `flags.min_request_interval` to limit scrape rate
+	ScrapeInterval time.Duration `cfg:"scrape_interval"`
+	// CompactOnly makes announce responses always contain peers
+	// in compact form, `compact=0` parameter is ignored
+	CompactOnly bool `cfg:"compact_only"`
+	// HidePeerIDs makes announce responses always contain peers
+	// in compact form without peer IDs for all info hashes, otherwise
+	// only for info hashes flagged with middleware.HidePeerIDsKey
+	HidePeerIDs bool `cfg:"hide_peer_ids"`
+	// MaskPeerIDs makes announce responses in dictionary model contain
+	// HMAC of peer IDs keyed with PeerIDMaskKey instead of real ones.
+	// Masked ID is stable for the same peer. Ignored for responses,
+	// which peer IDs are hidden.
+	MaskPeerIDs bool `cfg:"mask_peer_ids"`
+	// PeerIDMaskKey is the key of peer IDs HMAC. Instances with the
+	// same key return the same masked IDs.
+	PeerIDMaskKey string `cfg:"peer_id_mask_key"`
+	// NATPolicy is the action applied to announces of clients, which
+	// are possibly behind NAT (announced port differs from the source
+	// port of connection or, if NATProbe set, client does not accept
+	// incoming TCP connections on announced port): NATPolicyLog,
+	// NATPolicyLimit or NATPolicyDeprioritize. Empty value disables detection.
+	NATPolicy string `cfg:"nat_policy"`
+	// NATNumWant is the maximal number of peers returned
+	// to clients behind NAT if NATPolicy is NATPolicyLimit
+	NATNumWant uint32 `cfg:"nat_numwant"`
+	// NATProbe enables connectability probes: tracker connects
+	// to announced port of client in background
+	NATProbe bool `cfg:"nat_probe"`
+	// NATProbeTimeout is the timeout of TCP connection to client
+	NATProbeTimeout time.Duration `cfg:"nat_probe_timeout"`
+	// NATProbeTTL is the duration for which result of probe is cached
+	NATProbeTTL time.Duration `cfg:"nat_probe_ttl"`
+	// NATMaxProbes is the maximal number of simultaneous probes
+	NATMaxProbes uint `cfg:"nat_max_probes"`
 	ParseOptions
 }
 
+// Possible values of Config.NATPolicy
+const (
+	// NATPolicyLog only logs announces of clients behind NAT
+	NATPolicyLog = "log"
+	// NATPolicyLimit limits number of peers returned
+	// to client to Config.NATNumWant
+	NATPolicyLimit = "limit"
+	// NATPolicyDeprioritize stores peer, but places it at the end
+	// of peer lists returned to other peers (see middleware.BehindNATKey)
+	NATPolicyDeprioritize = "deprioritize"
+)
+
 const (
 	defaultReadTimeout  = 2 * time.Second
 	defaultWriteTimeout = 2 * time.Second
 	defaultIdleTimeout  = 30 * time.Second
+	defaultNATNumWant   = 10
 	// DefaultAnnounceRoute is the default url path to listen announce
 	// requests if nothing else provided
 	DefaultAnnounceRoute = "/announce"
@@ -117,6 +200,51 @@ func (cfg Config) Validate() (validCfg Config, err error) {
 			Strs("default", validCfg.ScrapeRoutes).
 			Msg("falling back to default configuration")
 	}
+	if (len(cfg.PurgeRoutes) > 0 || len(cfg.ReloadRoutes) > 0 || len(cfg.ClockSkewRoutes) > 0 || len(cfg.IntervalRoutes) > 0) && len(cfg.AdminToken) == 0 {
+		err = errNoAdminToken
+		return
+	}
+	switch cfg.NATPolicy {
+	case "", NATPolicyLog, NATPolicyDeprioritize:
+	case NATPolicyLimit:
+		if cfg.NATNumWant == 0 {
+			validCfg.NATNumWant = defaultNATNumWant
+			logger.Warn().
+				Str("name", "NATNumWant").
+				Uint32("provided", cfg.NATNumWant).
+				Uint32("default", validCfg.NATNumWant).
+				Msg("falling back to default configuration")
+		}
+	default:
+		err = fmt.Errorf("%w: %s", errUnknownNATPolicy, cfg.NATPolicy)
+		return
+	}
+	if len(cfg.NATPolicy) > 0 && cfg.NATProbe {
+		if cfg.NATProbeTimeout <= 0 {
+			validCfg.NATProbeTimeout = defaultNATProbeTimeout
+			logger.Warn().
+				Str("name", "NATProbeTimeout").
+				Dur("provided", cfg.NATProbeTimeout).
+				Dur("default", validCfg.NATProbeTimeout).
+				Msg("falling back to default configuration")
+		}
+		if cfg.NATProbeTTL <= 0 {
+			validCfg.NATProbeTTL = defaultNATProbeTTL
+			logger.Warn().
+				Str("name", "NATProbeTTL").
+				Dur("provided", cfg.NATProbeTTL).
+				Dur("default", validCfg.NATProbeTTL).
+				Msg("falling back to default configuration")
+		}
+		if cfg.NATMaxProbes == 0 {
+			validCfg.NATMaxProbes = defaultNATMaxProbes
+			logger.Warn().
+				Str("name", "NATMaxProbes").
+				Uint("provided", cfg.NATMaxProbes).
+				Uint("default", validCfg.NATMaxProbes).
+				Msg("falling back to default configuration")
+		}
+	}
 	validCfg.ParseOptions.ParseOptions = cfg.ParseOptions.ParseOptions.Validate(logger)
 	return
 }
@@ -125,6 +253,14 @@ type httpFE struct {
 	*fasthttp.Server
 	logic          *middleware.Logic
 	collectTimings bool
+	scrapeInterval time.Duration
+	compactOnly    bool
+	hidePeerIDs    bool
+	peerIDMasker   *peerIDMasker
+	natPolicy      string
+	natNumWant     uint32
+	natProber      *natProber
+	adminToken     []byte
 	onceCloser     sync.Once
 
 	ParseOptions
@@ -141,9 +277,54 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 		return nil, err
 	}
 
+	f := newHTTPFE(cfg, logic)
+
+	// If TLS is enabled, create a key pair.
+	if cfg.UseTLS {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath); err != nil {
+			return nil, err
+		}
+		certs := []tls.Certificate{cert}
+		f.Server.TLSConfig = &tls.Config{
+			Certificates: certs,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	go runServer(f.Server, &cfg)
+
+	return f, nil
+}
+
+// NewHandler builds net/http compatible handler, which serves the same
+// routes as http frontend, from provided configuration without starting
+// listener. It may be used to serve requests by other servers
+// (i.e. HTTP/3 server), TLS and listen options are ignored.
+func NewHandler(c conf.MapConfig, logic *middleware.Logic) (http.Handler, error) {
+	var cfg Config
+	var err error
+	if err = c.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return newHTTPFE(cfg, logic), nil
+}
+
+// newHTTPFE creates frontend and sets its routes, but does not start server
+func newHTTPFE(cfg Config, logic *middleware.Logic) *httpFE {
 	f := &httpFE{
 		logic:          logic,
 		collectTimings: cfg.EnableRequestTiming,
+		scrapeInterval: cfg.ScrapeInterval,
+		compactOnly:    cfg.CompactOnly,
+		hidePeerIDs:    cfg.HidePeerIDs,
+		peerIDMasker:   newPeerIDMasker(cfg.MaskPeerIDs, cfg.PeerIDMaskKey),
+		natPolicy:      cfg.NATPolicy,
+		natNumWant:     cfg.NATNumWant,
+		adminToken:     []byte(cfg.AdminToken),
 		ParseOptions:   cfg.ParseOptions,
 		Server: &fasthttp.Server{
 			ReadTimeout:      cfg.ReadTimeout,
@@ -155,22 +336,12 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 			Logger:           logger,
 		},
 	}
-
-	// If TLS is enabled, create a key pair.
-	if cfg.UseTLS {
-		var cert tls.Certificate
-		if cert, err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath); err != nil {
-			return nil, err
-		}
-		certs := []tls.Certificate{cert}
-		f.Server.TLSConfig = &tls.Config{
-			Certificates: certs,
-			MinVersion:   tls.VersionTLS12,
-		}
+	if len(cfg.NATPolicy) > 0 && cfg.NATProbe {
+		f.natProber = newNATProber(cfg.NATProbeTimeout, cfg.NATProbeTTL, cfg.NATMaxProbes)
 	}
 
 	pathRouting := make(map[string]func(*fasthttp.RequestCtx),
-		len(cfg.AnnounceRoutes)+len(cfg.ScrapeRoutes)+len(cfg.PingRoutes))
+		len(cfg.AnnounceRoutes)+len(cfg.ScrapeRoutes)+len(cfg.PingRoutes)+len(cfg.LiveRoutes)+len(cfg.ReadyRoutes)+len(cfg.PurgeRoutes)+len(cfg.ReloadRoutes)+len(cfg.ClockSkewRoutes)+len(cfg.IntervalRoutes))
 
 	for _, route := range cfg.AnnounceRoutes {
 		route = path.Clean(route)
@@ -193,6 +364,48 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 		}
 		pathRouting[path.Clean(route)] = f.ping
 	}
+	for _, route := range cfg.LiveRoutes {
+		route = path.Clean(route)
+		if !path.IsAbs(route) {
+			route = "/" + route
+		}
+		pathRouting[route] = f.live
+	}
+	for _, route := range cfg.ReadyRoutes {
+		route = path.Clean(route)
+		if !path.IsAbs(route) {
+			route = "/" + route
+		}
+		pathRouting[route] = f.ready
+	}
+	for _, route := range cfg.PurgeRoutes {
+		route = path.Clean(route)
+		if !path.IsAbs(route) {
+			route = "/" + route
+		}
+		pathRouting[route] = f.purge
+	}
+	for _, route := range cfg.ReloadRoutes {
+		route = path.Clean(route)
+		if !path.IsAbs(route) {
+			route = "/" + route
+		}
+		pathRouting[route] = f.reload
+	}
+	for _, route := range cfg.ClockSkewRoutes {
+		route = path.Clean(route)
+		if !path.IsAbs(route) {
+			route = "/" + route
+		}
+		pathRouting[route] = f.clockSkew
+	}
+	for _, route := range cfg.IntervalRoutes {
+		route = path.Clean(route)
+		if !path.IsAbs(route) {
+			route = "/" + route
+		}
+		pathRouting[route] = f.interval
+	}
 
 	f.Server.Handler = func(ctx *fasthttp.RequestCtx) {
 		if route, exists := pathRouting[string(ctx.Path())]; exists {
@@ -201,9 +414,8 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 			ctx.NotFound()
 		}
 	}
-	go runServer(f.Server, &cfg)
 
-	return f, nil
+	return f
 }
 
 func runServer(s *fasthttp.Server, cfg *Config) {
@@ -230,6 +442,9 @@ func (f *httpFE) Close() (err error) {
 		if f.Server != nil {
 			err = f.Server.Shutdown()
 		}
+		if f.natProber != nil {
+			f.natProber.wait()
+		}
 	})
 
 	return
@@ -247,6 +462,8 @@ func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
 			recordResponseDuration("announce", addr, err, time.Since(start))
 		}()
 	}
+	spanCtx, span := tracing.Start(reqCtx, "announce", tracing.AttrFrontend.String(Name), tracing.AttrAction.String("announce"))
+	defer func() { tracing.End(span, err) }()
 
 	aReq, err = parseAnnounce(reqCtx, f.ParseOptions)
 	if err != nil {
@@ -255,7 +472,16 @@ func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
 	}
 	addr = aReq.GetFirst()
 
-	ctx := bittorrent.InjectRouteParamsToContext(reqCtx, nil)
+	ctx := bittorrent.InjectFrontendToContext(bittorrent.InjectRouteParamsToContext(spanCtx, nil), Name)
+	if len(f.natPolicy) > 0 {
+		if portMismatch(reqCtx, aReq.Port, f.ParseOptions) {
+			ctx = f.applyNATPolicy(ctx, "announced port differs from connection port", reqCtx.RemoteAddr(), aReq)
+		} else if f.natProber != nil {
+			if addrPort, ok := probeAddress(aReq); ok && f.natProber.unconnectable(addrPort, timecache.NowUnixNano()) {
+				ctx = f.applyNATPolicy(ctx, "client does not accept connections on announced port", addrPort, aReq)
+			}
+		}
+	}
 	ctx, aResp, err := f.logic.HandleAnnounce(ctx, aReq)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -271,14 +497,43 @@ func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
 		// binary (single concatenated string) mode instead of dictionary.
 		// `no_peer_id` means, that tracker may omit PeerID field in response dictionary.
 		// see https://wiki.theory.org/BitTorrentSpecification#Tracker_Request_Parameters
-		writeAnnounceResponse(reqCtx, aResp, qArgs.GetBool("compact"), !qArgs.GetBool("no_peer_id"))
+		// Compact form does not contain peer IDs, so it is forced
+		// if peer IDs should be hidden.
+		hide := f.hidePeerIDs || ctx.Value(middleware.HidePeerIDsKey) != nil
+		writeAnnounceResponse(reqCtx, aResp, hide || f.compactOnly || qArgs.GetBool("compact"), !hide && !qArgs.GetBool("no_peer_id"), f.peerIDMasker)
+
+		if tracing.Enabled() {
+			span.SetAttributes(tracing.InfoHash(aReq.InfoHash),
+				tracing.AttrPeerCount.Int(len(aResp.IPv4Peers)+len(aResp.IPv6Peers)))
+		}
 
 		// next actions are background and should not be canceled after http writer closed
-		ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
+		ctx = tracing.Remap(spanCtx, bittorrent.RemapRouteParamsToBgContext(ctx))
 		// params mapped from fasthttp.QueryArgs will be reused in the next request
 		aReq.Params = nil
-		go f.logic.AfterAnnounce(ctx, aReq, aResp)
+		f.logic.AfterAnnounceAsync(ctx, aReq, aResp)
+	}
+}
+
+// applyNATPolicy performs configured action for announce
+// from client, which is possibly behind NAT
+func (f *httpFE) applyNATPolicy(ctx context.Context, reason string, addr fmt.Stringer, req *bittorrent.AnnounceRequest) context.Context {
+	switch f.natPolicy {
+	case NATPolicyLog:
+		logger.Info().
+			Stringer("addr", addr).
+			Uint16("port", req.Port).
+			Stringer("peerID", req.ID).
+			Str("reason", reason).
+			Msg("client is possibly behind NAT")
+	case NATPolicyLimit:
+		if req.NumWant > f.natNumWant {
+			req.NumWant = f.natNumWant
+		}
+	case NATPolicyDeprioritize:
+		ctx = context.WithValue(ctx, middleware.BehindNATKey, true)
 	}
+	return ctx
 }
 
 // scrapeRoute parses and responds to a Scrape.
@@ -292,6 +547,8 @@ func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
 			recordResponseDuration("scrape", addr, err, time.Since(start))
 		}()
 	}
+	spanCtx, span := tracing.Start(reqCtx, "scrape", tracing.AttrFrontend.String(Name), tracing.AttrAction.String("scrape"))
+	defer func() { tracing.End(span, err) }()
 
 	req, err := parseScrape(reqCtx, f.ParseOptions)
 	if err != nil {
@@ -300,7 +557,7 @@ func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
 	}
 	addr = req.GetFirst()
 
-	ctx := bittorrent.InjectRouteParamsToContext(reqCtx, nil)
+	ctx := bittorrent.InjectFrontendToContext(bittorrent.InjectRouteParamsToContext(spanCtx, nil), Name)
 	ctx, resp, err := f.logic.HandleScrape(ctx, req)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -311,13 +568,13 @@ func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
 
 	if err = reqCtx.Err(); err == nil {
 		reqCtx.SetContentType("text/plain; charset=utf-8")
-		writeScrapeResponse(reqCtx, resp)
+		writeScrapeResponse(reqCtx, resp, f.scrapeInterval)
 
 		// next actions are background and should not be canceled after http writer closed
-		ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
+		ctx = tracing.Remap(spanCtx, bittorrent.RemapRouteParamsToBgContext(ctx))
 		// params mapped from fasthttp.QueryArgs will in the next request
 		req.Params = nil
-		go f.logic.AfterScrape(ctx, req, resp)
+		f.logic.AfterScrapeAsync(ctx, req, resp)
 	}
 }
 
@@ -335,3 +592,133 @@ func (f *httpFE) ping(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(status)
 	}
 }
+
+func (f *httpFE) live(ctx *fasthttp.RequestCtx) {
+	status := http.StatusOK
+	if !f.logic.Live() {
+		status = http.StatusServiceUnavailable
+	}
+	ctx.SetStatusCode(status)
+}
+
+func (f *httpFE) ready(ctx *fasthttp.RequestCtx) {
+	status := http.StatusOK
+	err := f.logic.Ready(ctx)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		logger.Warn().Err(err).Msg("readiness check failed")
+		status = http.StatusServiceUnavailable
+	}
+	if err = ctx.Err(); err == nil {
+		ctx.SetStatusCode(status)
+	}
+}
+
+// authorized checks bearer token of administrative request
+// and responds with 401 status if it is not valid
+func (f *httpFE) authorized(ctx *fasthttp.RequestCtx) bool {
+	token, found := bytes.CutPrefix(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization), []byte("Bearer "))
+	if !found || subtle.ConstantTimeCompare(token, f.adminToken) != 1 {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// purge deletes swarm of info hash provided in `info_hash` argument
+// (raw or HEX-encoded). If `deny` argument is set, info hash is also
+// denied to prevent re-population of swarm.
+func (f *httpFE) purge(ctx *fasthttp.RequestCtx) {
+	if !f.authorized(ctx) {
+		return
+	}
+	args := ctx.QueryArgs()
+	ih, err := bittorrent.NewInfoHash(args.Peek("info_hash"))
+	if err != nil {
+		ctx.Error(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = f.logic.PurgeSwarm(ctx, ih, args.GetBool("deny")); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		logger.Error().Err(err).Stringer("infoHash", ih).Msg("unable to purge swarm")
+		ctx.Error(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+// clockSkew overrides maximal clock skew of connection IDs
+// (see middleware.Logic.SetMaxClockSkew) with duration provided
+// in `skew` argument, zero duration resets override.
+// Responds with current override.
+func (f *httpFE) clockSkew(ctx *fasthttp.RequestCtx) {
+	if !f.authorized(ctx) {
+		return
+	}
+	if args := ctx.QueryArgs(); args.Has("skew") {
+		skew, err := time.ParseDuration(string(args.Peek("skew")))
+		if err == nil {
+			err = f.logic.SetMaxClockSkew(skew)
+		}
+		if err != nil {
+			ctx.Error(err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBodyString(f.logic.MaxClockSkew().String())
+}
+
+// interval sets announce interval override of info hash provided
+// in `info_hash` argument (raw or HEX-encoded) with duration provided
+// in `interval` argument, zero duration deletes override.
+func (f *httpFE) interval(ctx *fasthttp.RequestCtx) {
+	if !f.authorized(ctx) {
+		return
+	}
+	args := ctx.QueryArgs()
+	ih, err := bittorrent.NewInfoHash(args.Peek("info_hash"))
+	if err != nil {
+		ctx.Error(err.Error(), http.StatusBadRequest)
+		return
+	}
+	interval, err := time.ParseDuration(string(args.Peek("interval")))
+	if err != nil {
+		ctx.Error(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = f.logic.SetIntervalOverride(ctx, ih, interval); err != nil {
+		switch {
+		case errors.Is(err, context.Canceled):
+			return
+		case errors.Is(err, middleware.ErrNoIntervalOverrides):
+			ctx.Error(err.Error(), http.StatusNotImplemented)
+		default:
+			logger.Error().Err(err).Stringer("infoHash", ih).Msg("unable to set announce interval override")
+			ctx.Error(err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+// reload forces hooks to re-read their data sources
+// (i.e. list of approved torrents) immediately.
+func (f *httpFE) reload(ctx *fasthttp.RequestCtx) {
+	if !f.authorized(ctx) {
+		return
+	}
+	if err := f.logic.Reload(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		logger.Error().Err(err).Msg("unable to reload hooks")
+		ctx.Error(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.SetStatusCode(http.StatusOK)
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+type downStorage struct {
+	storage.PeerStorage
+}
+
+func (downStorage) Ping(context.Context) error {
+	return errors.New("storage is down")
+}
+
+func TestLiveReady(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	check := func(logic *middleware.Logic, live, ready int) {
+		f := &httpFE{logic: logic}
+		ctx := newScrapeCtx("")
+		f.live(ctx)
+		require.Equal(t, live, ctx.Response.StatusCode())
+		ctx = newScrapeCtx("")
+		f.ready(ctx)
+		require.Equal(t, ready, ctx.Response.StatusCode())
+	}
+
+	check(middleware.NewLogic(0, 0, ps, nil, nil), http.StatusOK, http.StatusOK)
+	check(middleware.NewLogic(0, 0, downStorage{ps}, nil, nil), http.StatusOK, http.StatusServiceUnavailable)
+}
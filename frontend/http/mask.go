@@ -0,0 +1,33 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// peerIDMasker replaces peer IDs written in dictionary model with
+// HMAC-SHA256 of real ID truncated to bittorrent.PeerIDLen, so masked
+// ID is stable for the same peer, but real one is not leaked.
+// Nil masker writes IDs as is.
+type peerIDMasker struct {
+	key []byte
+}
+
+func newPeerIDMasker(enabled bool, key string) *peerIDMasker {
+	if !enabled {
+		return nil
+	}
+	return &peerIDMasker{key: []byte(key)}
+}
+
+// mask returns masked representation of id
+func (m *peerIDMasker) mask(id bittorrent.PeerID) []byte {
+	if m == nil {
+		return id.Bytes()
+	}
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write(id.Bytes())
+	return mac.Sum(nil)[:bittorrent.PeerIDLen]
+}
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+const (
+	defaultNATProbeTimeout = 2 * time.Second
+	defaultNATProbeTTL     = time.Hour
+	defaultNATMaxProbes    = 64
+)
+
+type probeResult struct {
+	connectable bool
+	expires     int64
+}
+
+// natProber checks if client accepts incoming TCP connections
+// on announced port (connectability probe). Probes are made in background
+// and their results are cached for ttl, so the first announce
+// of client is treated as connectable.
+// Data is process-local and not shared between tracker instances.
+type natProber struct {
+	timeout   time.Duration
+	ttl       int64
+	slots     chan struct{}
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	nextClean int64
+	results   map[netip.AddrPort]probeResult
+	dial      func(addrPort netip.AddrPort, timeout time.Duration) bool
+}
+
+func newNATProber(timeout, ttl time.Duration, maxProbes uint) *natProber {
+	return &natProber{
+		timeout: timeout,
+		ttl:     int64(ttl),
+		slots:   make(chan struct{}, maxProbes),
+		results: make(map[netip.AddrPort]probeResult),
+		dial:    dialTCP,
+	}
+}
+
+func dialTCP(addrPort netip.AddrPort, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", addrPort.String(), timeout)
+	if err == nil {
+		_ = conn.Close()
+	}
+	return err == nil
+}
+
+// probeAddress returns address of client to probe: the first address,
+// which is not provided by client itself (connection address or address
+// from RealIPHeader), so tracker does not connect to arbitrary hosts
+func probeAddress(req *bittorrent.AnnounceRequest) (netip.AddrPort, bool) {
+	if req.Port == 0 {
+		return netip.AddrPort{}, false
+	}
+	for _, a := range req.RequestAddresses {
+		if !a.Provided && a.IsValid() {
+			return netip.AddrPortFrom(a.Unmap(), req.Port), true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// unconnectable returns true if the last probe of address failed.
+// If there is no result of probe, new probe is started in background
+// if there are free slots.
+func (p *natProber) unconnectable(addrPort netip.AddrPort, now int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now >= p.nextClean {
+		for ap, r := range p.results {
+			if r.expires <= now {
+				delete(p.results, ap)
+			}
+		}
+		p.nextClean = now + p.ttl
+	}
+	if r, found := p.results[addrPort]; found && r.expires > now {
+		return !r.connectable
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		// too many probes in progress, will be probed in the next announce
+		return false
+	}
+	// pending probe, client is treated as connectable
+	p.results[addrPort] = probeResult{connectable: true, expires: now + p.ttl}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		connectable := p.dial(addrPort, p.timeout)
+		<-p.slots
+		p.mu.Lock()
+		p.results[addrPort] = probeResult{connectable: connectable, expires: now + p.ttl}
+		p.mu.Unlock()
+	}()
+	return false
+}
+
+// wait waits for completion of probes in progress
+func (p *natProber) wait() {
+	p.wg.Wait()
+}
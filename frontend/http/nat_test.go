@@ -0,0 +1,81 @@
+package http
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+func TestProbeAddress(t *testing.T) {
+	req := &bittorrent.AnnounceRequest{RequestPeer: bittorrent.RequestPeer{
+		Port: 6881,
+		RequestAddresses: bittorrent.RequestAddresses{
+			{Addr: netip.MustParseAddr("192.0.2.1"), Provided: true},
+			{Addr: netip.MustParseAddr("::ffff:10.0.0.1")},
+		},
+	}}
+	addrPort, ok := probeAddress(req)
+	require.True(t, ok)
+	// address provided by client is not probed
+	require.Equal(t, netip.MustParseAddrPort("10.0.0.1:6881"), addrPort)
+
+	req.RequestAddresses = req.RequestAddresses[:1]
+	_, ok = probeAddress(req)
+	require.False(t, ok)
+
+	req.Port = 0
+	_, ok = probeAddress(req)
+	require.False(t, ok)
+}
+
+func TestNATProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	connectable := netip.MustParseAddrPort(ln.Addr().String())
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	unconnectable := netip.MustParseAddrPort(closed.Addr().String())
+	require.Nil(t, closed.Close())
+
+	p := newNATProber(time.Second, time.Hour, 2)
+	now := timecache.NowUnixNano()
+	// result is unknown until probe finished
+	require.False(t, p.unconnectable(connectable, now))
+	require.False(t, p.unconnectable(unconnectable, now))
+	p.wait()
+	require.False(t, p.unconnectable(connectable, now))
+	require.True(t, p.unconnectable(unconnectable, now))
+
+	// results expire
+	later := now + int64(time.Hour)
+	require.False(t, p.unconnectable(unconnectable, later))
+	p.wait()
+	require.True(t, p.unconnectable(unconnectable, later))
+}
+
+func TestNATProberSlots(t *testing.T) {
+	release := make(chan struct{})
+	p := newNATProber(time.Second, time.Hour, 1)
+	p.dial = func(netip.AddrPort, time.Duration) bool {
+		<-release
+		return false
+	}
+	now := timecache.NowUnixNano()
+	first, second := netip.MustParseAddrPort("10.0.0.1:6881"), netip.MustParseAddrPort("10.0.0.2:6881")
+	require.False(t, p.unconnectable(first, now))
+	// no free slots, probe is not started
+	require.False(t, p.unconnectable(second, now))
+	close(release)
+	p.wait()
+	require.True(t, p.unconnectable(first, now))
+	require.False(t, p.unconnectable(second, now))
+	p.wait()
+	require.True(t, p.unconnectable(second, now))
+}
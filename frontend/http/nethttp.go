@@ -0,0 +1,45 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ServeHTTP implements http.Handler. Request is converted to
+// fasthttp.RequestCtx and passed to the same routes as requests
+// accepted by fasthttp server, so responses are identical.
+func (f *httpFE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// fasthttp server is configured to accept only GET requests
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req fasthttp.Request
+	req.Header.SetMethod(r.Method)
+	req.SetRequestURI(r.URL.RequestURI())
+	req.Header.SetHost(r.Host)
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	var remoteAddr net.Addr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		remoteAddr = net.TCPAddrFromAddrPort(addrPort)
+	}
+	var reqCtx fasthttp.RequestCtx
+	reqCtx.Init(&req, remoteAddr, logger)
+	f.Server.Handler(&reqCtx)
+
+	h := w.Header()
+	reqCtx.Response.Header.VisitAll(func(k, v []byte) {
+		h.Add(string(k), string(v))
+	})
+	w.WriteHeader(reqCtx.Response.StatusCode())
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(reqCtx.Response.Body())
+	}
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/bencode"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestNetHTTPHandler(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := NewHandler(map[string]any{}, middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil))
+	require.Nil(t, err)
+	srv := httptest.NewTLSServer(h)
+	defer srv.Close()
+	client := srv.Client()
+
+	infoHash := strings.Repeat("a", bittorrent.InfoHashV1Len)
+	get := func(path string, query url.Values) map[string]any {
+		resp, err := client.Get(srv.URL + path + "?" + query.Encode())
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		v, err := bencode.Decode(body)
+		require.Nil(t, err)
+		require.IsType(t, map[string]any{}, v)
+		return v.(map[string]any)
+	}
+	announce := func(peerID, left string) map[string]any {
+		return get(DefaultAnnounceRoute, url.Values{
+			"info_hash":  {infoHash},
+			"peer_id":    {peerID},
+			"port":       {"6881"},
+			"left":       {left},
+			"downloaded": {"0"},
+			"uploaded":   {"0"},
+			"compact":    {"1"},
+			"event":      {bittorrent.StartedStr},
+		})
+	}
+
+	resp := announce(strings.Repeat("1", bittorrent.PeerIDLen), "0")
+	require.Equal(t, int64(60), resp["interval"])
+	require.Eventually(t, func() bool {
+		files := get(DefaultScrapeRoute, url.Values{"info_hash": {infoHash}})["files"].(map[string]any)
+		scrape, ok := files[infoHash].(map[string]any)
+		return ok && scrape["complete"] == int64(1)
+	}, time.Second, 10*time.Millisecond)
+
+	resp = announce(strings.Repeat("2", bittorrent.PeerIDLen), "100")
+	require.Equal(t, int64(1), resp["complete"])
+	// compact IPv4 peer: address and port
+	require.Equal(t, "\x7f\x00\x00\x01\x1a\xe1", resp["peers"])
+
+	r, err := client.Post(srv.URL+DefaultAnnounceRoute, "text/plain", nil)
+	require.Nil(t, err)
+	_ = r.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, r.StatusCode)
+
+	r, err = client.Get(srv.URL + "/unknown")
+	require.Nil(t, err)
+	_ = r.Body.Close()
+	require.Equal(t, http.StatusNotFound, r.StatusCode)
+}
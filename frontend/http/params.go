@@ -1,6 +1,9 @@
 package http
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/rs/zerolog"
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/pkg/str2bytes"
@@ -20,15 +23,46 @@ func (qp queryParams) GetString(key string) (string, bool) {
 	return str2bytes.BytesToString(v), v != nil
 }
 
-// InfoHashes returns a list of requested infohashes.
-func (qp queryParams) InfoHashes() bittorrent.InfoHashes {
-	var ihs bittorrent.InfoHashes
-	for _, bb := range qp.PeekMulti("info_hash") {
+// GetUint64 returns unsigned 64-bit integer parsed from a query.
+// Unlike fasthttp.Args GetUint, full uint64 range is accepted
+// (i.e. bittorrent.UnknownLeft).
+func (qp queryParams) GetUint64(key string) (uint64, error) {
+	return strconv.ParseUint(str2bytes.BytesToString(qp.Peek(key)), 10, 64)
+}
+
+// InfoHashes returns a list of unique requested infohashes in order of
+// appearance in query. Malformed hashes are skipped, and the count of them
+// returned as second value.
+func (qp queryParams) InfoHashes() (ihs bittorrent.InfoHashes, malformed int) {
+	values := qp.PeekMulti("info_hash")
+	seen := make(map[bittorrent.InfoHash]struct{}, len(values))
+	for _, bb := range values {
 		if ih, err := bittorrent.NewInfoHash(bb); err == nil {
-			ihs = append(ihs, ih)
+			if _, exists := seen[ih]; !exists {
+				seen[ih] = struct{}{}
+				ihs = append(ihs, ih)
+			}
+		} else {
+			malformed++
 		}
 	}
-	return ihs
+	return
+}
+
+// extraParams returns copy of query parameters, which are not
+// standard announce parameters (see bittorrent.IsStandardAnnounceParam),
+// with lower case names. If parameter repeated, the last value is kept.
+func (qp queryParams) extraParams() (extra map[string]string) {
+	qp.VisitAll(func(key, value []byte) {
+		name := strings.ToLower(string(key))
+		if !bittorrent.IsStandardAnnounceParam(name) {
+			if extra == nil {
+				extra = make(map[string]string)
+			}
+			extra[name] = string(value)
+		}
+	})
+	return
 }
 
 // MarshalZerologObject writes fields into zerolog event
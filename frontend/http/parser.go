@@ -17,14 +17,18 @@ import (
 // If AllowIPSpoofing is true, IPs provided via BitTorrent params will be used.
 // If RealIPHeader is not empty string, the value of the first HTTP Header with
 // that name will be used.
+// If StrictScrape is true, scrape request with at least one malformed
+// info hash will be rejected, otherwise malformed hashes are skipped.
 type ParseOptions struct {
 	frontend.ParseOptions
 	RealIPHeader string `cfg:"real_ip_header"`
+	StrictScrape bool   `cfg:"strict_scrape"`
 }
 
 var (
 	errNoInfoHash                 = bittorrent.ClientError("no info hash supplied")
 	errMultipleInfoHashes         = bittorrent.ClientError("multiple info hashes supplied")
+	errInvalidInfoHash            = bittorrent.ClientError("info hash invalid")
 	errInvalidPeerID              = bittorrent.ClientError("peer ID invalid or not provided")
 	errInvalidParameterLeft       = bittorrent.ClientError("parameter 'left' invalid or not provided")
 	errInvalidParameterDownloaded = bittorrent.ClientError("parameter 'downloaded' invalid or not provided")
@@ -36,7 +40,7 @@ var (
 func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.AnnounceRequest, error) {
 	qp := &queryParams{r.QueryArgs()}
 
-	request := &bittorrent.AnnounceRequest{Params: qp}
+	request := &bittorrent.AnnounceRequest{Params: qp, ExtraParams: qp.extraParams()}
 
 	// Attempt to parse the event from the request.
 	var eventStr string
@@ -51,7 +55,7 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 	}
 
 	// Parse the info hash from the request.
-	infoHashes := qp.InfoHashes()
+	infoHashes, _ := qp.InfoHashes()
 	if len(infoHashes) < 1 {
 		return nil, errNoInfoHash
 	}
@@ -59,6 +63,9 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 		return nil, errMultipleInfoHashes
 	}
 	request.InfoHash = infoHashes[0]
+	if err = opts.CheckInfoHash(request.InfoHash); err != nil {
+		return nil, err
+	}
 
 	// Parse the PeerID from the request.
 	request.ID, err = bittorrent.NewPeerID(qp.Peek("peer_id"))
@@ -66,28 +73,22 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 		return nil, errInvalidPeerID
 	}
 	// Determine the number of remaining bytes for the client.
-	n, err := qp.GetUint("left")
-	if err != nil {
+	if request.Left, err = qp.GetUint64("left"); err != nil {
 		return nil, errInvalidParameterLeft
 	}
-	request.Left = uint64(n)
 
 	// Determine the number of bytes downloaded by the client.
-	n, err = qp.GetUint("downloaded")
-	if err != nil {
+	if request.Downloaded, err = qp.GetUint64("downloaded"); err != nil {
 		return nil, errInvalidParameterDownloaded
 	}
-	request.Downloaded = uint64(n)
 
 	// Determine the number of bytes shared by the client.
-	n, err = qp.GetUint("uploaded")
-	if err != nil {
+	if request.Uploaded, err = qp.GetUint64("uploaded"); err != nil {
 		return nil, errInvalidParameterUploaded
 	}
-	request.Uploaded = uint64(n)
 
 	// Determine the number of peers the client wants in the response.
-	n, err = qp.GetUint("numwant")
+	n, err := qp.GetUint("numwant")
 	if err != nil && !errors.Is(err, fasthttp.ErrNoArgValue) {
 		return nil, errInvalidParameterNumWant
 	}
@@ -102,9 +103,21 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 	}
 	request.Port = uint16(n)
 
+	// Parse the encryption support declared by the client.
+	if qp.GetBool("requirecrypto") {
+		request.Crypto = bittorrent.CryptoRequired
+	} else if qp.GetBool("supportcrypto") {
+		request.Crypto = bittorrent.CryptoSupported
+	}
+
 	// Parse the IP address where the client is listening.
 	request.RequestAddresses = requestedIPs(r, qp, opts)
 
+	// zones are stripped while sanitizing, if not rejected here
+	if opts.RejectZonedIPs && request.HasZone() {
+		return nil, bittorrent.ErrZonedIP
+	}
+
 	if err = bittorrent.SanitizeAnnounce(request, opts.MaxNumWant, opts.DefaultNumWant, opts.FilterPrivateIPs); err != nil {
 		request = nil
 	}
@@ -116,7 +129,26 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 func parseScrape(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.ScrapeRequest, error) {
 	qp := &queryParams{r.QueryArgs()}
 
-	infoHashes := qp.InfoHashes()
+	infoHashes, malformed := qp.InfoHashes()
+	// hashes of not allowed length are treated as malformed
+	allowed := infoHashes[:0]
+	for _, ih := range infoHashes {
+		if opts.CheckInfoHash(ih) == nil {
+			allowed = append(allowed, ih)
+		} else {
+			malformed++
+		}
+	}
+	infoHashes = allowed
+	if malformed > 0 {
+		if opts.StrictScrape {
+			return nil, errInvalidInfoHash
+		}
+		logger.Warn().
+			Int("malformed", malformed).
+			Object("params", qp).
+			Msg("skipping malformed info hashes in scrape request")
+	}
 	if len(infoHashes) < 1 {
 		return nil, errNoInfoHash
 	}
@@ -136,9 +168,19 @@ func parseScrape(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.ScrapeR
 // requestedIPs determines the IP address for a BitTorrent client request.
 func requestedIPs(r *fasthttp.RequestCtx, p *queryParams, opts ParseOptions) (addresses bittorrent.RequestAddresses) {
 	if opts.AllowIPSpoofing {
-		for _, f := range []string{"ip", "ipv4", "ipv6"} {
-			if ipStr, ok := p.GetString(f); ok {
-				addresses.Add(parseRequestAddress(ipStr, true))
+		if ipStr, ok := p.GetString("ip"); ok {
+			addresses.Add(parseRequestAddress(ipStr, true))
+		}
+		// dual-stack clients may declare address of each family (BEP 7),
+		// addresses of mismatched family are ignored
+		if ipStr, ok := p.GetString("ipv4"); ok {
+			if ra := parseRequestAddress(ipStr, true); ra.Unmap().Is4() {
+				addresses.Add(ra)
+			}
+		}
+		if ipStr, ok := p.GetString("ipv6"); ok {
+			if ra := parseRequestAddress(ipStr, true); ra.Is6() && !ra.Is4In6() {
+				addresses.Add(ra)
 			}
 		}
 	}
@@ -161,9 +203,25 @@ func requestedIPs(r *fasthttp.RequestCtx, p *queryParams, opts ParseOptions) (ad
 	return
 }
 
+// portMismatch returns true if port announced by client differs from
+// the source port of connection. Connection port is meaningful only if
+// client connected directly, so mismatch is never reported for requests
+// with RealIPHeader (i.e. passed through reverse proxy).
+func portMismatch(r *fasthttp.RequestCtx, port uint16, opts ParseOptions) bool {
+	if len(opts.RealIPHeader) > 0 && len(r.Request.Header.Peek(opts.RealIPHeader)) > 0 {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr().String())
+	return err == nil && addrPort.Port() != port
+}
+
+// parseRequestAddress parses IP address, which may be
+// provided with port (`1.2.3.4:6881` or `[::1]:6881`), port is ignored.
 func parseRequestAddress(s string, provided bool) (ra bittorrent.RequestAddress) {
 	if addr, err := netip.ParseAddr(s); err == nil {
 		ra.Addr, ra.Provided = addr, provided
+	} else if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		ra.Addr, ra.Provided = addrPort.Addr(), provided
 	}
 	return
 }
@@ -0,0 +1,216 @@
+package http
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func newScrapeCtx(query string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI("/scrape?" + query)
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init(&req, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}, nil)
+	return ctx
+}
+
+func TestParseMultiScrape(t *testing.T) {
+	ih1 := "aaaaaaaaaaaaaaaaaaaa"
+	ih2 := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	query := "info_hash=" + url.QueryEscape(ih1) +
+		"&info_hash=" + ih2 +
+		"&info_hash=" + url.QueryEscape("malformed") +
+		"&info_hash=" + url.QueryEscape(ih1)
+
+	opts := ParseOptions{ParseOptions: frontend.ParseOptions{MaxScrapeInfoHashes: 10}}
+
+	req, err := parseScrape(newScrapeCtx(query), opts)
+	require.Nil(t, err)
+	expected1, _ := bittorrent.NewInfoHash([]byte(ih1))
+	expected2, _ := bittorrent.NewInfoHash([]byte(ih2))
+	require.Equal(t, bittorrent.InfoHashes{expected1, expected2}, req.InfoHashes)
+
+	opts.StrictScrape = true
+	_, err = parseScrape(newScrapeCtx(query), opts)
+	require.ErrorIs(t, err, errInvalidInfoHash)
+}
+
+func TestParseAnnounceZonedIP(t *testing.T) {
+	query := "info_hash=" + url.QueryEscape("aaaaaaaaaaaaaaaaaaaa") +
+		"&peer_id=" + url.QueryEscape("bbbbbbbbbbbbbbbbbbbb") +
+		"&left=0&downloaded=0&uploaded=0&port=1234" +
+		"&ip=" + url.QueryEscape("fe80::1%eth0")
+
+	opts := ParseOptions{ParseOptions: frontend.ParseOptions{
+		AllowIPSpoofing: true,
+		MaxNumWant:      10,
+		DefaultNumWant:  10,
+	}}
+
+	req, err := parseAnnounce(newScrapeCtx(query), opts)
+	require.Nil(t, err)
+	require.Contains(t, req.RequestAddresses, bittorrent.RequestAddress{
+		Addr:     netip.MustParseAddr("fe80::1"),
+		Provided: true,
+	})
+	for _, a := range req.RequestAddresses {
+		require.Empty(t, a.Zone())
+	}
+
+	opts.RejectZonedIPs = true
+	_, err = parseAnnounce(newScrapeCtx(query), opts)
+	require.ErrorIs(t, err, bittorrent.ErrZonedIP)
+}
+
+func TestParseAnnounceDualStack(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	lgc := middleware.NewLogic(0, 0, ps, nil, nil)
+
+	const ihStr = "aaaaaaaaaaaaaaaaaaaa"
+	announce := func(peerID, ips string) *bittorrent.AnnounceResponse {
+		query := "info_hash=" + url.QueryEscape(ihStr) +
+			"&peer_id=" + url.QueryEscape(peerID) +
+			"&left=1&downloaded=0&uploaded=0&port=1234" + ips
+		req, err := parseAnnounce(newScrapeCtx(query), ParseOptions{ParseOptions: frontend.ParseOptions{
+			AllowIPSpoofing: true,
+			MaxNumWant:      10,
+			DefaultNumWant:  10,
+		}})
+		require.Nil(t, err)
+		ctx, resp, err := lgc.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+		lgc.AfterAnnounce(bittorrent.RemapRouteParamsToBgContext(ctx), req, resp)
+		return resp
+	}
+
+	announce("bbbbbbbbbbbbbbbbbbbb", "&ipv4="+url.QueryEscape("192.0.2.1:1234")+
+		"&ipv6="+url.QueryEscape("[2001:db8::1]:1234"))
+	ih, _ := bittorrent.NewInfoHash([]byte(ihStr))
+	leechers, _, _, err := ps.ScrapeSwarm(context.Background(), ih)
+	require.Nil(t, err)
+	// connection address, declared IPv4 and declared IPv6
+	require.Equal(t, uint32(3), leechers)
+
+	resp := announce("cccccccccccccccccccc", "&ipv6=2001:db8::2")
+	require.Contains(t, resp.IPv4Peers, bittorrent.Peer{
+		ID:       bittorrent.PeerID([]byte("bbbbbbbbbbbbbbbbbbbb")),
+		AddrPort: netip.MustParseAddrPort("192.0.2.1:1234"),
+	})
+	require.Contains(t, resp.IPv6Peers, bittorrent.Peer{
+		ID:       bittorrent.PeerID([]byte("bbbbbbbbbbbbbbbbbbbb")),
+		AddrPort: netip.MustParseAddrPort("[2001:db8::1]:1234"),
+	})
+
+	// mismatched families are ignored
+	req, err := parseAnnounce(newScrapeCtx("info_hash="+url.QueryEscape(ihStr)+
+		"&peer_id=dddddddddddddddddddd&left=1&downloaded=0&uploaded=0&port=1234"+
+		"&ipv4=2001:db8::3&ipv6=192.0.2.3"), ParseOptions{ParseOptions: frontend.ParseOptions{AllowIPSpoofing: true}})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}}, req.RequestAddresses)
+}
+
+func TestPortMismatch(t *testing.T) {
+	// connection source port is 1234, see newScrapeCtx
+	opts := ParseOptions{RealIPHeader: "x-real-ip"}
+	require.False(t, portMismatch(newScrapeCtx(""), 1234, opts))
+	require.True(t, portMismatch(newScrapeCtx(""), 6881, opts))
+
+	// connection port of proxy is meaningless
+	ctx := newScrapeCtx("")
+	ctx.Request.Header.Set("x-real-ip", "10.0.0.2")
+	require.False(t, portMismatch(ctx, 6881, opts))
+}
+
+func TestParseInfoHashPolicy(t *testing.T) {
+	v1, v2 := "aaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	table := []struct {
+		policy       string
+		v1Ok, v2Ok   bool
+		scrapeHashes int
+	}{
+		{frontend.InfoHashPolicyAny, true, true, 2},
+		{frontend.InfoHashPolicyV1, true, false, 1},
+		{frontend.InfoHashPolicyV2, false, true, 1},
+	}
+	for _, tt := range table {
+		t.Run(tt.policy, func(t *testing.T) {
+			opts := ParseOptions{ParseOptions: frontend.ParseOptions{
+				MaxNumWant:          10,
+				DefaultNumWant:      10,
+				MaxScrapeInfoHashes: 10,
+				InfoHashPolicy:      tt.policy,
+			}}
+			for ih, ok := range map[string]bool{v1: tt.v1Ok, v2: tt.v2Ok} {
+				query := "info_hash=" + url.QueryEscape(ih) +
+					"&peer_id=" + url.QueryEscape("cccccccccccccccccccc") +
+					"&left=0&downloaded=0&uploaded=0&port=1234"
+				_, err := parseAnnounce(newScrapeCtx(query), opts)
+				if ok {
+					require.Nil(t, err)
+				} else {
+					require.ErrorIs(t, err, frontend.ErrInfoHashNotAllowed)
+				}
+			}
+
+			query := "info_hash=" + url.QueryEscape(v1) + "&info_hash=" + url.QueryEscape(v2)
+			req, err := parseScrape(newScrapeCtx(query), opts)
+			require.Nil(t, err)
+			require.Len(t, req.InfoHashes, tt.scrapeHashes)
+		})
+	}
+}
+
+func TestParseAnnounceCrypto(t *testing.T) {
+	query := "info_hash=" + url.QueryEscape("aaaaaaaaaaaaaaaaaaaa") +
+		"&peer_id=" + url.QueryEscape("bbbbbbbbbbbbbbbbbbbb") +
+		"&left=0&downloaded=0&uploaded=0&port=1234"
+	opts := ParseOptions{ParseOptions: frontend.ParseOptions{MaxNumWant: 10, DefaultNumWant: 10}}
+
+	for args, expected := range map[string]bittorrent.Crypto{
+		"":                                 bittorrent.CryptoNone,
+		"&supportcrypto=0":                 bittorrent.CryptoNone,
+		"&supportcrypto=1":                 bittorrent.CryptoSupported,
+		"&requirecrypto=1":                 bittorrent.CryptoRequired,
+		"&supportcrypto=1&requirecrypto=1": bittorrent.CryptoRequired,
+	} {
+		req, err := parseAnnounce(newScrapeCtx(query+args), opts)
+		require.Nil(t, err)
+		require.Equal(t, expected, req.Crypto, args)
+	}
+}
+
+func TestParseAnnounceLeft(t *testing.T) {
+	query := "info_hash=" + url.QueryEscape("aaaaaaaaaaaaaaaaaaaa") +
+		"&peer_id=" + url.QueryEscape("bbbbbbbbbbbbbbbbbbbb") +
+		"&downloaded=0&uploaded=18446744073709551615&port=1234"
+	opts := ParseOptions{ParseOptions: frontend.ParseOptions{MaxNumWant: 10, DefaultNumWant: 10}}
+
+	req, err := parseAnnounce(newScrapeCtx(query+"&left=18446744073709551615"), opts)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.UnknownLeft, req.Left)
+	require.True(t, req.LeftUnknown())
+	require.Equal(t, uint64(math.MaxUint64), req.Uploaded)
+
+	req, err = parseAnnounce(newScrapeCtx(query+"&left=9223372036854775808"), opts)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1)<<63, req.Left)
+	require.False(t, req.LeftUnknown())
+
+	for _, left := range []string{"", "&left=", "&left=-1", "&left=18446744073709551616"} {
+		_, err = parseAnnounce(newScrapeCtx(query+left), opts)
+		require.ErrorIs(t, err, errInvalidParameterLeft, left)
+	}
+}
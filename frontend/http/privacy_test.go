@@ -0,0 +1,131 @@
+package http
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	_ "github.com/sot-tech/mochi/middleware/peerprivacy"
+	"github.com/sot-tech/mochi/pkg/bencode"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestHidePeerIDs(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	privateHash := strings.Repeat("a", bittorrent.InfoHashV1Len)
+	publicHash := strings.Repeat("b", bittorrent.InfoHashV1Len)
+	for _, s := range []string{privateHash, publicHash} {
+		ih, _ := bittorrent.NewInfoHash([]byte(s))
+		peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+		require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+	}
+	hooks, err := middleware.NewHooks([]conf.NamedMapConfig{{
+		Name:   "peer privacy",
+		Config: conf.MapConfig{"hash_list": []string{hex.EncodeToString([]byte(privateHash))}},
+	}}, ps)
+	require.Nil(t, err)
+
+	announce := func(hideAll bool, infoHash string, args url.Values) any {
+		cfg, err := Config{HidePeerIDs: hideAll}.Validate()
+		require.Nil(t, err)
+		lgc := middleware.NewLogic(time.Minute, time.Minute, ps, hooks, nil)
+		defer lgc.Close()
+		f := newHTTPFE(cfg, lgc)
+		args.Set("info_hash", infoHash)
+		args.Set("peer_id", strings.Repeat("2", bittorrent.PeerIDLen))
+		args.Set("port", "6881")
+		args.Set("left", "100")
+		args.Set("downloaded", "0")
+		args.Set("uploaded", "0")
+		var req fasthttp.Request
+		req.SetRequestURI(DefaultAnnounceRoute + "?" + args.Encode())
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Init(&req, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("10.0.0.2:6881")), nil)
+		f.Server.Handler(ctx)
+		v, err := bencode.Decode(ctx.Response.Body())
+		require.Nil(t, err)
+		require.IsType(t, map[string]any{}, v)
+		return v.(map[string]any)["peers"]
+	}
+
+	dict := url.Values{"compact": {"0"}}
+	dictNoID := url.Values{"compact": {"0"}, "no_peer_id": {"1"}}
+	dictWithID := url.Values{"compact": {"0"}, "no_peer_id": {"0"}}
+
+	peers := announce(false, publicHash, dict)
+	require.IsType(t, []any{}, peers)
+	require.Contains(t, peers.([]any)[0], "peer id")
+
+	for _, args := range []url.Values{dict, dictNoID, dictWithID} {
+		require.IsType(t, "", announce(false, privateHash, args))
+		require.IsType(t, "", announce(true, publicHash, args))
+	}
+}
+
+func TestMaskPeerIDs(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	infoHash := strings.Repeat("a", bittorrent.InfoHashV1Len)
+	ih, _ := bittorrent.NewInfoHash([]byte(infoHash))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+	lgc := middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil)
+	defer lgc.Close()
+
+	announce := func(cfg Config, compact string) any {
+		cfg, err := cfg.Validate()
+		require.Nil(t, err)
+		f := newHTTPFE(cfg, lgc)
+		args := url.Values{
+			"info_hash":  {infoHash},
+			"peer_id":    {strings.Repeat("2", bittorrent.PeerIDLen)},
+			"port":       {"6881"},
+			"left":       {"100"},
+			"downloaded": {"0"},
+			"uploaded":   {"0"},
+			"compact":    {compact},
+		}
+		var req fasthttp.Request
+		req.SetRequestURI(DefaultAnnounceRoute + "?" + args.Encode())
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Init(&req, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("10.0.0.2:6881")), nil)
+		f.Server.Handler(ctx)
+		v, err := bencode.Decode(ctx.Response.Body())
+		require.Nil(t, err)
+		peers := v.(map[string]any)["peers"]
+		if l, isList := peers.([]any); isList {
+			require.Len(t, l, 1)
+			return l[0].(map[string]any)["peer id"]
+		}
+		return peers
+	}
+
+	require.Equal(t, string(peer.ID.Bytes()), announce(Config{}, "0"))
+
+	masked := Config{MaskPeerIDs: true, PeerIDMaskKey: "secret"}
+	id := announce(masked, "0")
+	require.IsType(t, "", id)
+	require.Len(t, id, bittorrent.PeerIDLen)
+	require.NotEqual(t, string(peer.ID.Bytes()), id)
+	// stable across announces
+	require.Equal(t, id, announce(masked, "0"))
+	require.NotEqual(t, id, announce(Config{MaskPeerIDs: true, PeerIDMaskKey: "other"}, "0"))
+	// compact form does not contain IDs at all
+	require.IsType(t, "", announce(masked, "1"))
+}
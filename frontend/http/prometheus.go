@@ -11,18 +11,14 @@ import (
 	"github.com/sot-tech/mochi/pkg/metrics"
 )
 
-func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
-}
-
-var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
+var promResponseDurationMilliseconds = metrics.Register(prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
 		Name:    "mochi_http_response_duration_milliseconds",
 		Help:    "The duration of time it takes to receive and write a response to an API request",
 		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
 	},
 	[]string{"action", "address_family", "error"},
-)
+))
 
 // recordResponseDuration records the duration of time to respond to a Request
 // in milliseconds.
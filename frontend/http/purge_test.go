@@ -0,0 +1,161 @@
+package http
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestPurge(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	_, err = Config{PurgeRoutes: []string{"/purge"}}.Validate()
+	require.ErrorIs(t, err, errNoAdminToken)
+	cfg, err := Config{PurgeRoutes: []string{"/purge"}, AdminToken: "secret"}.Validate()
+	require.Nil(t, err)
+	f := newHTTPFE(cfg, middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil))
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+
+	purge := func(token, query string) int {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/purge?" + query)
+		if len(token) > 0 {
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+token)
+		}
+		f.Server.Handler(ctx)
+		return ctx.Response.StatusCode()
+	}
+	query := "info_hash=" + hex.EncodeToString(ih.Bytes())
+	require.Equal(t, http.StatusUnauthorized, purge("", query))
+	require.Equal(t, http.StatusUnauthorized, purge("wrong", query))
+	require.Equal(t, http.StatusBadRequest, purge("secret", "info_hash=short"))
+	_, s, _, err := ps.ScrapeSwarm(context.Background(), ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), s)
+
+	require.Equal(t, http.StatusOK, purge("secret", query))
+	l, s, _, err := ps.ScrapeSwarm(context.Background(), ih)
+	require.Nil(t, err)
+	require.Zero(t, l+s)
+	// there are no hooks able to deny info hash
+	require.Equal(t, http.StatusInternalServerError, purge("secret", query+"&deny=1"))
+}
+
+func TestReload(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	_, err = Config{ReloadRoutes: []string{"/reload"}}.Validate()
+	require.ErrorIs(t, err, errNoAdminToken)
+	cfg, err := Config{ReloadRoutes: []string{"/reload"}, AdminToken: "secret"}.Validate()
+	require.Nil(t, err)
+	f := newHTTPFE(cfg, middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil))
+
+	reload := func(token string) int {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/reload")
+		if len(token) > 0 {
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+token)
+		}
+		f.Server.Handler(ctx)
+		return ctx.Response.StatusCode()
+	}
+	require.Equal(t, http.StatusUnauthorized, reload(""))
+	require.Equal(t, http.StatusUnauthorized, reload("wrong"))
+	// there are no hooks able to reload
+	require.Equal(t, http.StatusInternalServerError, reload("secret"))
+}
+
+func TestClockSkew(t *testing.T) {
+	_, err := Config{ClockSkewRoutes: []string{"/skew"}}.Validate()
+	require.ErrorIs(t, err, errNoAdminToken)
+	cfg, err := Config{ClockSkewRoutes: []string{"/skew"}, AdminToken: "secret"}.Validate()
+	require.Nil(t, err)
+	logic := middleware.NewLogic(time.Minute, time.Minute, nil, nil, nil)
+	f := newHTTPFE(cfg, logic)
+
+	skew := func(uri, token string) (int, string) {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI(uri)
+		if len(token) > 0 {
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+token)
+		}
+		f.Server.Handler(ctx)
+		return ctx.Response.StatusCode(), string(ctx.Response.Body())
+	}
+	code, _ := skew("/skew?skew=20s", "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Zero(t, logic.MaxClockSkew())
+
+	code, body := skew("/skew?skew=20s", "secret")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "20s", body)
+	require.Equal(t, 20*time.Second, logic.MaxClockSkew())
+
+	code, _ = skew("/skew?skew=1h", "secret")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, body = skew("/skew", "secret")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "20s", body)
+
+	code, body = skew("/skew?skew=0", "secret")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "0s", body)
+}
+
+func TestIntervalOverride(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	_, err = Config{IntervalRoutes: []string{"/interval"}}.Validate()
+	require.ErrorIs(t, err, errNoAdminToken)
+	cfg, err := Config{IntervalRoutes: []string{"/interval"}, AdminToken: "secret"}.Validate()
+	require.Nil(t, err)
+	logic := middleware.NewLogic(time.Hour, time.Minute, ps, nil, nil)
+	f := newHTTPFE(cfg, logic)
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	interval := func(uri, token string) int {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI(uri)
+		if len(token) > 0 {
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+token)
+		}
+		f.Server.Handler(ctx)
+		return ctx.Response.StatusCode()
+	}
+	uri := "/interval?info_hash=" + hex.EncodeToString(ih.Bytes())
+	// overrides are disabled
+	require.Equal(t, http.StatusNotImplemented, interval(uri+"&interval=10m", "secret"))
+
+	logic.SetIntervalOverrides(time.Minute)
+	require.Equal(t, http.StatusUnauthorized, interval(uri+"&interval=10m", "wrong"))
+	require.Equal(t, http.StatusBadRequest, interval("/interval?interval=10m", "secret"))
+	require.Equal(t, http.StatusBadRequest, interval(uri+"&interval=abc", "secret"))
+	require.Equal(t, http.StatusOK, interval(uri+"&interval=10m", "secret"))
+	v, err := ps.Load(context.Background(), middleware.IntervalStorageCtx, ih.RawString())
+	require.Nil(t, err)
+	require.Equal(t, "10m0s", string(v))
+
+	require.Equal(t, http.StatusOK, interval(uri+"&interval=0", "secret"))
+	v, err = ps.Load(context.Background(), middleware.IntervalStorageCtx, ih.RawString())
+	require.Nil(t, err)
+	require.Nil(t, v)
+}
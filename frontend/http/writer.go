@@ -6,12 +6,10 @@ import (
 	"io"
 	"net"
 	"sort"
-	"strconv"
 	"time"
 
-	"github.com/valyala/fasthttp"
-
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/bencode"
 	"github.com/sot-tech/mochi/pkg/bytepool"
 )
 
@@ -25,10 +23,19 @@ func writeErrorResponse(w io.StringWriter, err error) {
 	} else {
 		logger.Error().Err(err).Msg("internal error")
 	}
-	_, _ = w.WriteString("d14:failure reason" + strconv.Itoa(len(message)) + ":" + message + "e")
+	bb := respBufferPool.Get()
+	defer respBufferPool.Put(bb)
+	bw := bencode.NewWriter(bb)
+	bw.StartDict()
+	bw.String("failure reason")
+	bw.String(message)
+	bw.End()
+	_, _ = w.WriteString(bb.String())
 }
 
-func writeAnnounceResponse(w io.Writer, resp *bittorrent.AnnounceResponse, compact, includePeerID bool) {
+// writeAnnounceResponse encodes announce response. If peers are written
+// in dictionary model with IDs, IDs are masked by masker.
+func writeAnnounceResponse(w io.Writer, resp *bittorrent.AnnounceResponse, compact, includePeerID bool, masker *peerIDMasker) {
 	bb := respBufferPool.Get()
 	defer respBufferPool.Put(bb)
 
@@ -39,48 +46,59 @@ func writeAnnounceResponse(w io.Writer, resp *bittorrent.AnnounceResponse, compa
 		resp.MinInterval /= time.Second
 	}
 
-	bb.WriteString("d8:completei")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.Complete)))
-	bb.WriteString("e10:incompletei")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.Incomplete)))
-	bb.WriteString("e8:intervali")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.Interval)))
-	bb.WriteString("e12:min intervali")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.MinInterval)))
-	bb.WriteByte('e')
+	bw := bencode.NewWriter(bb)
+	bw.StartDict()
+	bw.String("complete")
+	bw.Uint(uint64(resp.Complete))
+	bw.String("incomplete")
+	bw.Uint(uint64(resp.Incomplete))
+	bw.String("interval")
+	bw.Int(int64(resp.Interval))
+	bw.String("min interval")
+	bw.Int(int64(resp.MinInterval))
 
 	// Add the peers to the dictionary in the compact format.
 	if compact {
 		// Add the IPv4 peers to the dictionary.
-		compactAddresses(bb, resp.IPv4Peers, false)
+		compactAddresses(bw, bb, resp.IPv4Peers, false)
 		// Add the IPv6 peers to the dictionary.
-		compactAddresses(bb, resp.IPv6Peers, true)
+		compactAddresses(bw, bb, resp.IPv6Peers, true)
 	} else {
 		// Add the peers to the dictionary.
-		bb.WriteString("5:peersl")
+		bw.String("peers")
+		bw.StartList()
 		for _, peer := range resp.IPv4Peers {
-			dictAddress(bb, peer, includePeerID)
+			dictAddress(bw, peer, includePeerID, masker)
 		}
 		for _, peer := range resp.IPv6Peers {
-			dictAddress(bb, peer, includePeerID)
+			dictAddress(bw, peer, includePeerID, masker)
 		}
-		bb.WriteByte('e')
+		bw.End()
+	}
+	if len(resp.TrackerID) > 0 {
+		bw.String("tracker id")
+		bw.String(resp.TrackerID)
+	}
+	if len(resp.WarningMessage) > 0 {
+		bw.String("warning message")
+		bw.String(resp.WarningMessage)
 	}
-	bb.WriteByte('e')
+	bw.End()
 
 	_, _ = bb.WriteTo(w)
 }
 
-func compactAddresses(bb *bytes.Buffer, peers bittorrent.Peers, v6 bool) {
+// compactAddresses writes peers as one string of addresses
+// and big-endian ports (BEP 23, BEP 7)
+func compactAddresses(bw bencode.Writer, bb *bytes.Buffer, peers bittorrent.Peers, v6 bool) {
 	l := len(peers)
 	if l > 0 {
-		key, al := "5:peers", net.IPv4len
+		key, al := "peers", net.IPv4len
 		if v6 {
-			key, al = "6:peers6", net.IPv6len
+			key, al = "peers6", net.IPv6len
 		}
-		bb.WriteString(key)
-		bb.Write(fasthttp.AppendUint(nil, (al+2)*l))
-		bb.WriteByte(':')
+		bw.String(key)
+		bw.StringPrefix((al + 2) * l)
 		for _, peer := range peers {
 			bb.Write(peer.Addr().AsSlice())
 			port := peer.Port()
@@ -89,45 +107,52 @@ func compactAddresses(bb *bytes.Buffer, peers bittorrent.Peers, v6 bool) {
 	}
 }
 
-func dictAddress(bb *bytes.Buffer, peer bittorrent.Peer, includePeerID bool) {
-	bb.WriteString("d2:ip")
-	addr := peer.Addr().String()
-	bb.Write(fasthttp.AppendUint(nil, len(addr)))
-	bb.WriteByte(':')
-	bb.WriteString(addr)
+func dictAddress(bw bencode.Writer, peer bittorrent.Peer, includePeerID bool, masker *peerIDMasker) {
+	bw.StartDict()
+	bw.String("ip")
+	bw.String(peer.Addr().String())
 	if includePeerID {
-		bb.WriteString("7:peer id20:")
-		bb.Write(peer.ID.Bytes())
+		bw.String("peer id")
+		bw.Bytes(masker.mask(peer.ID))
 	}
-	bb.WriteString("4:porti")
-	port := peer.Port()
-	bb.Write([]byte{byte(port >> 8), byte(port), 'e', 'e'})
+	bw.String("port")
+	bw.Uint(uint64(peer.Port()))
+	bw.End()
 }
 
-func writeScrapeResponse(w io.Writer, resp *bittorrent.ScrapeResponse) {
+// writeScrapeResponse encodes scrape response according to BEP 48.
+// If minInterval is greater than zero, it is sent as `flags.min_request_interval`.
+func writeScrapeResponse(w io.Writer, resp *bittorrent.ScrapeResponse, minInterval time.Duration) {
 	bb := respBufferPool.Get()
 	defer respBufferPool.Put(bb)
-	bb.WriteString("d5:filesd")
-	l := len(resp.Data)
-	if l > 0 {
-		if l > 1 {
-			sort.Slice(resp.Data, func(i, j int) bool {
-				return resp.Data[i].InfoHash < resp.Data[j].InfoHash
-			})
-		}
-		for _, scrape := range resp.Data {
-			bb.Write(fasthttp.AppendUint(nil, len(scrape.InfoHash)))
-			bb.WriteByte(':')
-			bb.Write([]byte(scrape.InfoHash))
-			bb.WriteString("d8:completei")
-			bb.Write(fasthttp.AppendUint(nil, int(scrape.Complete)))
-			bb.WriteString("e10:downloadedi")
-			bb.Write(fasthttp.AppendUint(nil, int(scrape.Snatches)))
-			bb.WriteString("e10:incompletei")
-			bb.Write(fasthttp.AppendUint(nil, int(scrape.Incomplete)))
-			bb.Write([]byte{'e', 'e'})
-		}
+	if len(resp.Data) > 1 {
+		sort.Slice(resp.Data, func(i, j int) bool {
+			return resp.Data[i].InfoHash < resp.Data[j].InfoHash
+		})
+	}
+	bw := bencode.NewWriter(bb)
+	bw.StartDict()
+	bw.String("files")
+	bw.StartDict()
+	for _, scrape := range resp.Data {
+		bw.String(scrape.InfoHash.RawString())
+		bw.StartDict()
+		bw.String("complete")
+		bw.Uint(uint64(scrape.Complete))
+		bw.String("downloaded")
+		bw.Uint(uint64(scrape.Snatches))
+		bw.String("incomplete")
+		bw.Uint(uint64(scrape.Incomplete))
+		bw.End()
+	}
+	bw.End()
+	if minInterval > 0 {
+		bw.String("flags")
+		bw.StartDict()
+		bw.String("min_request_interval")
+		bw.Int(int64(minInterval / time.Second))
+		bw.End()
 	}
-	bb.Write([]byte{'e', 'e'})
+	bw.End()
 	_, _ = bb.WriteTo(w)
 }
@@ -3,11 +3,14 @@ package http
 import (
 	"fmt"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/bencode"
 	"github.com/sot-tech/mochi/pkg/log"
 )
 
@@ -47,3 +50,107 @@ func TestWriteStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteWarning(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{
+		Interval:       time.Hour,
+		MinInterval:    time.Hour,
+		WarningMessage: "not allowed",
+	}, true, false, nil)
+	require.Equal(t,
+		"d8:completei0e10:incompletei0e8:intervali3600e12:min intervali3600e15:warning message11:not allowede",
+		r.Body.String())
+}
+
+func TestWriteTrackerID(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{
+		TrackerID:      "0123456789abcdef",
+		WarningMessage: "w",
+	}, true, false, nil)
+	require.Equal(t,
+		"d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e10:tracker id16:0123456789abcdef15:warning message1:we",
+		r.Body.String())
+}
+
+func TestWriteScrape(t *testing.T) {
+	ih1, _ := bittorrent.NewInfoHash([]byte("aaaaaaaaaaaaaaaaaaaa"))
+	ih2, _ := bittorrent.NewInfoHash([]byte("bbbbbbbbbbbbbbbbbbbb"))
+	resp := &bittorrent.ScrapeResponse{Data: []bittorrent.Scrape{
+		{InfoHash: ih2, Complete: 1, Snatches: 2, Incomplete: 3},
+		{InfoHash: ih1, Complete: 4, Snatches: 5, Incomplete: 6},
+	}}
+	files := "d5:filesd" +
+		"20:aaaaaaaaaaaaaaaaaaaad8:completei4e10:downloadedi5e10:incompletei6ee" +
+		"20:bbbbbbbbbbbbbbbbbbbbd8:completei1e10:downloadedi2e10:incompletei3ee" +
+		"e"
+
+	r := httptest.NewRecorder()
+	writeScrapeResponse(r, resp, 0)
+	require.Equal(t, files+"e", r.Body.String())
+
+	r = httptest.NewRecorder()
+	writeScrapeResponse(r, resp, 15*time.Minute)
+	require.Equal(t, files+"5:flagsd20:min_request_intervali900eee", r.Body.String())
+
+	r = httptest.NewRecorder()
+	writeScrapeResponse(r, &bittorrent.ScrapeResponse{}, 0)
+	require.Equal(t, "d5:filesdee", r.Body.String())
+}
+
+func FuzzWriteAnnounce(f *testing.F) {
+	f.Add(uint32(1), uint32(2), uint16(6881), "", true, false)
+	f.Add(uint32(0), uint32(0), uint16(0), "not allowed", false, true)
+	f.Fuzz(func(t *testing.T, complete, incomplete uint32, port uint16, warning string, compact, includeID bool) {
+		resp := &bittorrent.AnnounceResponse{
+			Complete:       complete,
+			Incomplete:     incomplete,
+			Interval:       30 * time.Minute,
+			MinInterval:    15 * time.Minute,
+			WarningMessage: warning,
+			IPv4Peers: bittorrent.Peers{{
+				AddrPort: netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port),
+			}},
+			IPv6Peers: bittorrent.Peers{{
+				AddrPort: netip.AddrPortFrom(netip.MustParseAddr("::1"), port),
+			}},
+		}
+		r := httptest.NewRecorder()
+		writeAnnounceResponse(r, resp, compact, includeID, nil)
+		v, err := bencode.Decode(r.Body.Bytes())
+		require.Nil(t, err, r.Body.String())
+		m := v.(map[string]any)
+		require.Equal(t, int64(complete), m["complete"])
+		require.Equal(t, int64(incomplete), m["incomplete"])
+		require.Equal(t, int64(1800), m["interval"])
+		if compact {
+			require.Len(t, m["peers"], 6)
+			require.Len(t, m["peers6"], 18)
+		} else {
+			require.Len(t, m["peers"], 2)
+		}
+	})
+}
+
+func FuzzWriteScrape(f *testing.F) {
+	f.Add([]byte("aaaaaaaaaaaaaaaaaaaa"), uint32(1), uint32(2), uint32(3))
+	f.Fuzz(func(t *testing.T, ih []byte, complete, snatches, incomplete uint32) {
+		infoHash, err := bittorrent.NewInfoHash(ih)
+		if err != nil {
+			return
+		}
+		r := httptest.NewRecorder()
+		writeScrapeResponse(r, &bittorrent.ScrapeResponse{Data: []bittorrent.Scrape{{
+			InfoHash: infoHash, Complete: complete, Snatches: snatches, Incomplete: incomplete,
+		}}}, time.Minute)
+		v, err := bencode.Decode(r.Body.Bytes())
+		require.Nil(t, err, r.Body.String())
+		files := v.(map[string]any)["files"].(map[string]any)
+		require.Equal(t, map[string]any{
+			"complete":   int64(complete),
+			"downloaded": int64(snatches),
+			"incomplete": int64(incomplete),
+		}, files[string(infoHash)])
+	})
+}
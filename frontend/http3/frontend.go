@@ -0,0 +1,130 @@
+// Package http3 implements a BitTorrent frontend via the HTTP/3 (QUIC)
+// protocol. Requests are processed by the same routes as in http frontend,
+// so announce and scrape responses are identical.
+package http3
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/sot-tech/mochi/frontend"
+	fh "github.com/sot-tech/mochi/frontend/http"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+// Name - registered name of the frontend
+const Name = "http3"
+
+var (
+	logger            = log.NewLogger("frontend/http3")
+	errTLSNotProvided = errors.New("tls certificate/key not provided")
+)
+
+func init() {
+	frontend.RegisterBuilder(Name, NewFrontend)
+}
+
+// Config represents options of HTTP/3 listener. Routes and the rest
+// of options are the same as in http frontend (see http.Config),
+// TLS is mandatory.
+type Config struct {
+	frontend.ListenOptions
+	TLSCertPath string `cfg:"tls_cert_path"`
+	TLSKeyPath  string `cfg:"tls_key_path"`
+	// IdleTimeout is the maximum duration of QUIC connection
+	// without activity
+	IdleTimeout time.Duration `cfg:"idle_timeout"`
+}
+
+const defaultIdleTimeout = 30 * time.Second
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	validCfg.ListenOptions = cfg.ListenOptions.Validate(logger)
+	if len(cfg.TLSCertPath) == 0 || len(cfg.TLSKeyPath) == 0 {
+		err = errTLSNotProvided
+		return
+	}
+	if cfg.IdleTimeout <= 0 {
+		validCfg.IdleTimeout = defaultIdleTimeout
+		logger.Warn().
+			Str("name", "IdleTimeout").
+			Dur("provided", cfg.IdleTimeout).
+			Dur("default", validCfg.IdleTimeout).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+type http3FE struct {
+	srv        *http3.Server
+	conn       net.PacketConn
+	onceCloser sync.Once
+}
+
+// NewFrontend builds and starts HTTP/3 bittorrent frontend from provided configuration
+func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend, error) {
+	var cfg Config
+	var err error
+	if err = c.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var h http.Handler
+	if h, err = fh.NewHandler(c, logic); err != nil {
+		return nil, err
+	}
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath); err != nil {
+		return nil, err
+	}
+
+	f := &http3FE{
+		srv: &http3.Server{
+			Handler: h,
+			TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS13,
+			}),
+			QUICConfig: &quic.Config{MaxIdleTimeout: cfg.IdleTimeout},
+		},
+	}
+
+	logger.Debug().Str("addr", cfg.Addr).Msg("starting listener")
+	if f.conn, err = cfg.ListenUDP(); err != nil {
+		return nil, err
+	}
+	go f.serve(cfg.Addr)
+
+	return f, nil
+}
+
+func (f *http3FE) serve(addr string) {
+	err := f.srv.Serve(f.conn)
+	if err == nil || errors.Is(err, http.ErrServerClosed) || errors.Is(err, quic.ErrServerClosed) {
+		logger.Info().Str("addr", addr).Msg("listener stopped")
+	} else {
+		logger.Fatal().Str("addr", addr).Err(err).Msg("listener failed")
+	}
+}
+
+// Close provides a thread-safe way to gracefully shut down a currently running Frontend.
+func (f *http3FE) Close() (err error) {
+	f.onceCloser.Do(func() {
+		err = errors.Join(f.srv.Close(), f.conn.Close())
+	})
+	return
+}
@@ -0,0 +1,126 @@
+package http3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
+	fh "github.com/sot-tech/mochi/frontend/http"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/bencode"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// writeCert generates self-signed certificate for localhost
+// and writes it with key into dir
+func writeCert(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.Nil(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return
+}
+
+func TestValidate(t *testing.T) {
+	_, err := Config{}.Validate()
+	require.ErrorIs(t, err, errTLSNotProvided)
+}
+
+func TestAnnounce(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	logic := middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil)
+
+	certPath, keyPath := writeCert(t, t.TempDir())
+	fs, err := frontend.NewFrontends([]conf.NamedMapConfig{{
+		Name: Name,
+		Config: conf.MapConfig{
+			"addr":          "127.0.0.1:0",
+			"tls_cert_path": certPath,
+			"tls_key_path":  keyPath,
+		},
+	}}, logic)
+	require.Nil(t, err)
+	require.Len(t, fs, 1)
+	f := fs[0].(*http3FE)
+	defer f.Close()
+
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}} //nolint:gosec
+	defer rt.Close()
+	client := &http.Client{Transport: rt, Timeout: 5 * time.Second}
+	base := "https://" + f.conn.LocalAddr().String()
+
+	infoHash := strings.Repeat("a", bittorrent.InfoHashV1Len)
+	get := func(path string, query url.Values) map[string]any {
+		resp, err := client.Get(base + path + "?" + query.Encode())
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, 3, resp.ProtoMajor)
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		v, err := bencode.Decode(body)
+		require.Nil(t, err)
+		require.IsType(t, map[string]any{}, v)
+		return v.(map[string]any)
+	}
+	announce := func(peerID, left string) map[string]any {
+		return get(fh.DefaultAnnounceRoute, url.Values{
+			"info_hash":  {infoHash},
+			"peer_id":    {peerID},
+			"port":       {"6881"},
+			"left":       {left},
+			"downloaded": {"0"},
+			"uploaded":   {"0"},
+			"compact":    {"1"},
+			"event":      {bittorrent.StartedStr},
+		})
+	}
+
+	resp := announce(strings.Repeat("1", bittorrent.PeerIDLen), "0")
+	require.Equal(t, int64(60), resp["interval"])
+	require.Eventually(t, func() bool {
+		files := get(fh.DefaultScrapeRoute, url.Values{"info_hash": {infoHash}})["files"].(map[string]any)
+		scrape, ok := files[infoHash].(map[string]any)
+		return ok && scrape["complete"] == int64(1)
+	}, time.Second, 10*time.Millisecond)
+
+	resp = announce(strings.Repeat("2", bittorrent.PeerIDLen), "100")
+	require.Equal(t, int64(1), resp["complete"])
+	// compact IPv4 peer: address of QUIC connection and announced port
+	require.Equal(t, "\x7f\x00\x00\x01\x1a\xe1", resp["peers"])
+
+	require.Nil(t, f.Close())
+}
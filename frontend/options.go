@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net"
 
+	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/pkg/log"
 
 	"github.com/libp2p/go-reuseport"
@@ -83,12 +84,47 @@ func (lo ListenOptions) ListenUDP() (conn *net.UDPConn, err error) {
 // ParseOptions is the configuration used to parse an Announce Request.
 //
 // If AllowIPSpoofing is true, IPs provided via params will be used.
+// InfoHashPolicy restricts accepted info hash lengths
+// (see InfoHashPolicyAny, InfoHashPolicyV1 and InfoHashPolicyV2).
 type ParseOptions struct {
 	AllowIPSpoofing     bool   `cfg:"allow_ip_spoofing"`
 	FilterPrivateIPs    bool   `cfg:"filter_private_ips"`
+	RejectZonedIPs      bool   `cfg:"reject_zoned_ips"`
 	MaxNumWant          uint32 `cfg:"max_numwant"`
 	DefaultNumWant      uint32 `cfg:"default_numwant"`
 	MaxScrapeInfoHashes uint32 `cfg:"max_scrape_infohashes"`
+	InfoHashPolicy      string `cfg:"info_hash_policy"`
+}
+
+// Possible values of ParseOptions.InfoHashPolicy
+const (
+	// InfoHashPolicyAny accepts both V1 (20 bytes) and V2 (32 bytes) info hashes
+	InfoHashPolicyAny = "any"
+	// InfoHashPolicyV1 accepts only V1 (20 bytes) info hashes
+	// (V2 hashes truncated by client according to BEP 52 are also accepted)
+	InfoHashPolicyV1 = "v1"
+	// InfoHashPolicyV2 accepts only V2 (32 bytes) info hashes
+	InfoHashPolicyV2 = "v2"
+)
+
+// ErrInfoHashNotAllowed returned if length of info hash
+// is not allowed by ParseOptions.InfoHashPolicy
+var ErrInfoHashNotAllowed = bittorrent.ClientError("info hash version not allowed")
+
+// CheckInfoHash returns ErrInfoHashNotAllowed if length of
+// provided info hash is not allowed by InfoHashPolicy
+func (op ParseOptions) CheckInfoHash(ih bittorrent.InfoHash) error {
+	switch op.InfoHashPolicy {
+	case InfoHashPolicyV1:
+		if len(ih) != bittorrent.InfoHashV1Len {
+			return ErrInfoHashNotAllowed
+		}
+	case InfoHashPolicyV2:
+		if len(ih) != bittorrent.InfoHashV2Len {
+			return ErrInfoHashNotAllowed
+		}
+	}
+	return nil
 }
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -121,6 +157,19 @@ func (op ParseOptions) Validate(logger *log.Logger) ParseOptions {
 			Uint32("default", valid.MaxScrapeInfoHashes).
 			Msg("falling back to default configuration")
 	}
+
+	switch op.InfoHashPolicy {
+	case InfoHashPolicyAny, InfoHashPolicyV1, InfoHashPolicyV2:
+	default:
+		valid.InfoHashPolicy = InfoHashPolicyAny
+		if len(op.InfoHashPolicy) > 0 {
+			logger.Warn().
+				Str("name", "InfoHashPolicy").
+				Str("provided", op.InfoHashPolicy).
+				Str("default", valid.InfoHashPolicy).
+				Msg("falling back to default configuration")
+		}
+	}
 	return valid
 }
 
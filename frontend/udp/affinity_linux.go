@@ -0,0 +1,42 @@
+//go:build linux
+
+package udp
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// affinitySupported is true if pinToCPU binds threads to CPUs
+const affinitySupported = true
+
+// pinToCPU locks calling goroutine to its OS thread and binds
+// the thread to n-th (modulo count) CPU available to the process.
+// Thread stays locked until goroutine exits.
+func pinToCPU(n int) (cpu int, err error) {
+	var available unix.CPUSet
+	if err = unix.SchedGetaffinity(0, &available); err != nil {
+		return
+	}
+	count := available.Count()
+	if count == 0 {
+		return
+	}
+	n %= count
+	for cpu = 0; ; cpu++ {
+		if available.IsSet(cpu) {
+			if n == 0 {
+				break
+			}
+			n--
+		}
+	}
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpu)
+	if err = unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+	}
+	return
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package udp
+
+// affinitySupported is true if pinToCPU binds threads to CPUs
+const affinitySupported = false
+
+// pinToCPU does nothing on this platform
+func pinToCPU(int) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,25 @@
+package udp
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinToCPU(t *testing.T) {
+	if !affinitySupported {
+		t.Skip("CPU affinity is not supported on " + runtime.GOOS)
+	}
+	var cpu int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// goroutine exits locked, so its thread is not reused
+		cpu, err = pinToCPU(runtime.NumCPU() + 1)
+	}()
+	<-done
+	require.Nil(t, err)
+	require.GreaterOrEqual(t, cpu, 0)
+}
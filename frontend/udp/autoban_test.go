@@ -0,0 +1,70 @@
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/ratelimit"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestConnectAutoBan(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer client.Close()
+
+	logic := middleware.NewLogic(0, 0, ps, nil, nil)
+	defer logic.Close()
+	logic.SetAutoBanConfig(middleware.AutoBanConfig{
+		Threshold: 2,
+		Window:    time.Minute,
+		Duration:  time.Minute,
+		Allowlist: []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")},
+	})
+	f := &udpFE{
+		logic:          logic,
+		connectLimiter: ratelimit.New[netip.Addr](1, time.Minute),
+		genPool: &sync.Pool{New: func() any {
+			return NewConnectionIDGenerator([]byte("key"), time.Minute, 0)
+		}},
+	}
+
+	w := ResponseWriter{socket: server, addrPort: client.LocalAddr().(*net.UDPAddr).AddrPort()}
+	packet := append([]byte(nil), initialConnectionID...)
+	packet = binary.BigEndian.AppendUint32(packet, connectActionID)
+	packet = append(packet, 0, 0, 0, 1)
+
+	for _, ip := range []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")} {
+		_, err = f.handleRequest(context.Background(), Request{Packet: packet, IP: ip}, w)
+		require.Nil(t, err)
+		for i := 0; i < 2; i++ {
+			_, err = f.handleRequest(context.Background(), Request{Packet: packet, IP: ip}, w)
+			require.ErrorIs(t, err, errConnectRateLimited)
+		}
+	}
+
+	// banned address is dropped before packet parsing,
+	// but after validation of packet length
+	_, err = f.handleRequest(context.Background(), Request{Packet: []byte{0}, IP: netip.MustParseAddr("127.0.0.1")}, w)
+	require.ErrorIs(t, err, errMalformedPacket)
+	_, err = f.handleRequest(context.Background(), Request{Packet: packet, IP: netip.MustParseAddr("127.0.0.1")}, w)
+	require.ErrorIs(t, err, errBanned)
+	// allowlisted address is not banned
+	_, err = f.handleRequest(context.Background(), Request{Packet: packet, IP: netip.MustParseAddr("127.0.0.2")}, w)
+	require.ErrorIs(t, err, errConnectRateLimited)
+}
@@ -14,8 +14,8 @@ import (
 	"github.com/sot-tech/mochi/pkg/xorshift"
 )
 
-// ttl is the duration a connection ID should be valid according to BEP 15.
-var ttl = int64(2 * time.Minute)
+// ttl is the duration (in seconds) a connection ID should be valid according to BEP 15.
+var ttl = int64(2 * time.Minute / time.Second)
 
 const (
 	// length of connection ID
@@ -40,6 +40,10 @@ type ConnectionIDGenerator struct {
 	// generations.
 	mac hash.Hash
 
+	// prevMACs are keyed HMACs of previous keys, which are used
+	// only to validate connection IDs generated before key rotation.
+	prevMACs []hash.Hash
+
 	// connID is an 8-byte slice that holds the generated connection ID after a
 	// call to Generate.
 	// It must not be referenced after the generator is returned to a pool.
@@ -53,26 +57,57 @@ type ConnectionIDGenerator struct {
 	// HMACs to increase hash performance.
 	scratch []byte
 
-	// the leeway for a timestamp on a connection ID.
+	// the leeway (in seconds) for a timestamp on a connection ID.
 	maxClockSkew int64
 
+	// width of time bucket (in seconds) placed in connection ID.
+	granularity int64
+
 	// PRNG footprint holder
 	s uint64
 }
 
 // NewConnectionIDGenerator creates a new connection ID generator.
-func NewConnectionIDGenerator(key []byte, maxClockSkew time.Duration) *ConnectionIDGenerator {
-	return &ConnectionIDGenerator{
-		mac: hmac.New(func() hash.Hash {
+// Granularity is the width of time bucket of generated IDs (truncated to seconds),
+// IDs generated within the same bucket contain the same timestamp and
+// stay valid for ttl since the end of bucket. Values less than one second
+// are treated as one second.
+func NewConnectionIDGenerator(key []byte, maxClockSkew, granularity time.Duration) *ConnectionIDGenerator {
+	return NewRotatingConnectionIDGenerator([][]byte{key}, maxClockSkew, granularity)
+}
+
+// NewRotatingConnectionIDGenerator creates a new connection ID generator
+// with several keys. The first key is used to generate connection IDs,
+// all keys are tried to validate them, so IDs generated with previous
+// keys stay valid while key is rotated. Keys must not be empty.
+// See NewConnectionIDGenerator for granularity description.
+func NewRotatingConnectionIDGenerator(keys [][]byte, maxClockSkew, granularity time.Duration) *ConnectionIDGenerator {
+	gran := int64(granularity / time.Second)
+	if gran < 1 {
+		gran = 1
+	}
+	macs := make([]hash.Hash, len(keys))
+	for i, key := range keys {
+		macs[i] = hmac.New(func() hash.Hash {
 			return xxhash.New()
-		}, key),
+		}, key)
+	}
+	return &ConnectionIDGenerator{
+		mac:          macs[0],
+		prevMACs:     macs[1:],
 		connID:       make([]byte, connIDLen),
 		buff:         make([]byte, buffLen),
 		scratch:      make([]byte, scratchLen),
-		maxClockSkew: int64(maxClockSkew),
+		maxClockSkew: int64(maxClockSkew / time.Second),
+		granularity:  gran,
 	}
 }
 
+// SetMaxClockSkew changes the leeway of connection ID timestamp
+func (g *ConnectionIDGenerator) SetMaxClockSkew(maxClockSkew time.Duration) {
+	g.maxClockSkew = int64(maxClockSkew / time.Second)
+}
+
 // reset resets the generator.
 // This is called by other methods of the generator, it's not necessary to call
 // it after getting a generator from a pool.
@@ -112,10 +147,25 @@ func (g *ConnectionIDGenerator) Generate(ip netip.Addr, now time.Time) (out []by
 	g.reset(true)
 	var r uint64
 	r, g.s = xorshift.XorShift64S(g.s)
-	g.buff[0] = byte(r)
-	binary.BigEndian.PutUint64(g.buff[1:], uint64(now.Unix()))
+	return g.generate(byte(r), ip, now, nil)
+}
+
+// GenerateWithNonce generates connection ID like Generate, but client
+// provided nonce is also written into HMAC input, so generated ID is bound
+// to the nonce and may be checked only with ValidateWithNonce.
+func (g *ConnectionIDGenerator) GenerateWithNonce(ip netip.Addr, now time.Time, nonce []byte) []byte {
+	g.reset(true)
+	var r uint64
+	r, g.s = xorshift.XorShift64S(g.s)
+	return g.generate(byte(r), ip, now, nonce)
+}
+
+func (g *ConnectionIDGenerator) generate(salt byte, ip netip.Addr, now time.Time, nonce []byte) []byte {
+	g.buff[0] = salt
+	binary.BigEndian.PutUint64(g.buff[1:], uint64(now.Unix()/g.granularity))
 	g.mac.Write(g.buff)
 	g.mac.Write(ip.AsSlice())
+	g.mac.Write(nonce)
 
 	g.scratch = g.mac.Sum(g.scratch)
 	g.connID[0], g.connID[1], g.connID[2] = g.buff[0], g.buff[7], g.buff[8]
@@ -128,27 +178,120 @@ func (g *ConnectionIDGenerator) Generate(ip netip.Addr, now time.Time) (out []by
 	return g.connID[:connIDLen]
 }
 
+// ConnIDStatus is the result of connection ID validation
+type ConnIDStatus uint8
+
+const (
+	// ConnIDValid - connection ID is valid
+	ConnIDValid ConnIDStatus = iota
+	// ConnIDBadHMAC - HMAC of connection ID does not match. ID is forged,
+	// generated with unknown key or for other IP address (IP is a part
+	// of HMAC, so such IDs can not be distinguished from forged ones).
+	ConnIDBadHMAC
+	// ConnIDExpired - connection ID is genuine, but its TTL passed
+	// (or timestamp is from the future more than allowed clock skew)
+	ConnIDExpired
+	// ConnIDBadNonce - connection ID was not generated with nonce
+	// provided in request
+	ConnIDBadNonce
+	// ConnIDClockSkew - connection ID is genuine, but expired or from the
+	// future within maxAllowedClockSkew, so it would be valid if allowed
+	// clock skew was increased
+	ConnIDClockSkew
+)
+
+// String returns name of status used in metrics labels
+func (s ConnIDStatus) String() string {
+	switch s {
+	case ConnIDValid:
+		return "valid"
+	case ConnIDBadHMAC:
+		return "bad_hmac"
+	case ConnIDExpired:
+		return "expired"
+	case ConnIDBadNonce:
+		return "bad_nonce"
+	case ConnIDClockSkew:
+		return "clock_skew"
+	default:
+		return "unknown"
+	}
+}
+
 // Validate validates the given connection ID for an IP and the current time.
 func (g *ConnectionIDGenerator) Validate(connectionID []byte, ip netip.Addr, now time.Time) bool {
+	return g.Check(connectionID, ip, now) == ConnIDValid
+}
+
+// Check validates the given connection ID for an IP and the current time
+// like Validate, but returns the reason of validation failure.
+// HMAC is checked before timestamp, so forged IDs with random
+// timestamp are reported as ConnIDBadHMAC, not ConnIDExpired.
+func (g *ConnectionIDGenerator) Check(connectionID []byte, ip netip.Addr, now time.Time) ConnIDStatus {
+	return g.check(connectionID, ip, now, nil)
+}
+
+func (g *ConnectionIDGenerator) check(connectionID []byte, ip netip.Addr, now time.Time, nonce []byte) (res ConnIDStatus) {
 	g.reset(false)
 	nowTS := now.Unix()
 	g.buff[0] = connectionID[0]
-	// connectionID contains only 2 bytes of timestamp, so we clean little 16 bits to place it and rehash.
-	// We will provide restored full timestamp respectively to current timestamp,
-	// 2 bytes should be enough to avoid collisions within ~18 hours from same IP.
-	ts := nowTS&((^int64(0)>>16)<<16) | int64(connectionID[1])<<8 | int64(connectionID[2])
-	binary.BigEndian.PutUint64(g.buff[1:], uint64(ts))
-	g.mac.Write(g.buff)
-	g.mac.Write(ip.AsSlice())
-	g.scratch = g.mac.Sum(g.scratch)
-	res := hmac.Equal(g.scratch[:hmacLen], connectionID[connIDLen-hmacLen:connIDLen])
-	// ts-skew < now < ts+ttl+skew
-	res = ts-g.maxClockSkew < nowTS && res
-	res = nowTS < ts+ttl+g.maxClockSkew && res
+	// connectionID contains only 2 bytes of timestamp (bucket), so we clean little 16 bits to place it and rehash.
+	// We will provide restored full bucket respectively to current bucket,
+	// 2 bytes should be enough to avoid collisions within ~18 hours (multiplied by granularity) from same IP.
+	bucket := (nowTS/g.granularity)&((^int64(0)>>16)<<16) | int64(connectionID[1])<<8 | int64(connectionID[2])
+	binary.BigEndian.PutUint64(g.buff[1:], uint64(bucket))
+	valid := g.validMAC(g.mac, connectionID, ip, nonce)
+	for i := 0; !valid && i < len(g.prevMACs); i++ {
+		valid = g.validMAC(g.prevMACs[i], connectionID, ip, nonce)
+	}
+	// bucket start and last second of bucket
+	ts, te := bucket*g.granularity, (bucket+1)*g.granularity-1
+	switch {
+	case !valid:
+		res = ConnIDBadHMAC
+	// ts-skew < now < te+ttl+skew
+	case ts-g.maxClockSkew >= nowTS || nowTS >= te+ttl+g.maxClockSkew:
+		if maxSkew := int64(maxAllowedClockSkew / time.Second); ts-maxSkew < nowTS && nowTS < te+ttl+maxSkew {
+			res = ConnIDClockSkew
+		} else {
+			res = ConnIDExpired
+		}
+	default:
+		res = ConnIDValid
+	}
 	log.Debug().
 		Stringer("ip", ip).
 		Hex("connID", connectionID).
-		Bool("result", res).
+		Stringer("result", res).
 		Msg("validating connection ID")
 	return res
 }
+
+// validMAC checks if connection ID contains HMAC of prepared buffer,
+// IP and nonce (if any), calculated with provided mac
+func (g *ConnectionIDGenerator) validMAC(mac hash.Hash, connectionID []byte, ip netip.Addr, nonce []byte) bool {
+	mac.Reset()
+	mac.Write(g.buff)
+	mac.Write(ip.AsSlice())
+	mac.Write(nonce)
+	g.scratch = mac.Sum(g.scratch[:0])
+	return hmac.Equal(g.scratch[:hmacLen], connectionID[connIDLen-hmacLen:connIDLen])
+}
+
+// ValidateWithNonce validates the given connection ID like Validate, but
+// ID must be generated by GenerateWithNonce with the same nonce.
+func (g *ConnectionIDGenerator) ValidateWithNonce(connectionID []byte, ip netip.Addr, now time.Time, nonce []byte) bool {
+	return g.CheckWithNonce(connectionID, ip, now, nonce) == ConnIDValid
+}
+
+// CheckWithNonce validates the given connection ID like ValidateWithNonce,
+// but returns the reason of validation failure.
+// Nonce is a part of HMAC, so IDs generated with other nonce are reported
+// as ConnIDBadHMAC, ConnIDBadNonce is returned only for genuine IDs
+// generated without nonce.
+func (g *ConnectionIDGenerator) CheckWithNonce(connectionID []byte, ip netip.Addr, now time.Time, nonce []byte) (res ConnIDStatus) {
+	if res = g.check(connectionID, ip, now, nonce); res == ConnIDBadHMAC && g.check(connectionID, ip, now, nil) != ConnIDBadHMAC {
+		res = ConnIDBadNonce
+	}
+	return
+}
@@ -6,13 +6,17 @@ import (
 	"fmt"
 	"hash"
 	"math/rand"
+	"net"
 	"net/netip"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
 	"github.com/stretchr/testify/require"
 )
 
@@ -33,14 +37,14 @@ var golden = []struct {
 // This is a wrapper around creating a new ConnectionIDGenerator and generating
 // an ID. It is recommended to use the generator for performance.
 func NewConnectionID(ip netip.Addr, now time.Time, key []byte) []byte {
-	return NewConnectionIDGenerator(key, 0).Generate(ip, now)
+	return NewConnectionIDGenerator(key, 0, 0).Generate(ip, now)
 }
 
 // ValidConnectionID determines whether a connection identifier is legitimate.
 // This is a wrapper around creating a new ConnectionIDGenerator and validating
 // the ID. It is recommended to use the generator for performance.
 func ValidConnectionID(connectionID []byte, ip netip.Addr, now time.Time, maxClockSkew time.Duration, key []byte) bool {
-	return NewConnectionIDGenerator(key, maxClockSkew).Validate(connectionID, ip, now)
+	return NewConnectionIDGenerator(key, maxClockSkew, 0).Validate(connectionID, ip, now)
 }
 
 // simpleNewConnectionID generates a new connection ID the explicit way.
@@ -97,7 +101,7 @@ func TestReuseGeneratorGenerate(t *testing.T) {
 			cid := NewConnectionID(netip.MustParseAddr(tt.ip), time.Unix(tt.createdAt, 0), tt.key)
 			require.Len(t, cid, 8)
 
-			gen := NewConnectionIDGenerator(tt.key, 0)
+			gen := NewConnectionIDGenerator(tt.key, 0, 0)
 
 			for i := 0; i < 3; i++ {
 				connID := gen.Generate(netip.MustParseAddr(tt.ip), time.Unix(tt.createdAt, 0))
@@ -110,7 +114,7 @@ func TestReuseGeneratorGenerate(t *testing.T) {
 func TestReuseGeneratorValidate(t *testing.T) {
 	for _, tt := range golden {
 		t.Run(fmt.Sprintf("%s created at %d verified at %d", tt.ip, tt.createdAt, tt.now), func(t *testing.T) {
-			gen := NewConnectionIDGenerator(tt.key, time.Minute)
+			gen := NewConnectionIDGenerator(tt.key, time.Minute, 0)
 			cid := gen.Generate(netip.MustParseAddr(tt.ip), time.Unix(tt.createdAt, 0))
 			for i := 0; i < 3; i++ {
 				got := gen.Validate(cid, netip.MustParseAddr(tt.ip), time.Unix(tt.now, 0))
@@ -163,7 +167,7 @@ func BenchmarkConnectionIDGenerator_Generate(b *testing.B) {
 
 	pool := &sync.Pool{
 		New: func() any {
-			return NewConnectionIDGenerator(key, 0)
+			return NewConnectionIDGenerator(key, 0, 0)
 		},
 	}
 
@@ -201,7 +205,7 @@ func BenchmarkConnectionIDGenerator_Validate(b *testing.B) {
 
 	pool := &sync.Pool{
 		New: func() any {
-			return NewConnectionIDGenerator(key, 10*time.Second)
+			return NewConnectionIDGenerator(key, 10*time.Second, 0)
 		},
 	}
 
@@ -215,3 +219,152 @@ func BenchmarkConnectionIDGenerator_Validate(b *testing.B) {
 		}
 	})
 }
+
+func TestNonceVerification(t *testing.T) {
+	ip, now := netip.MustParseAddr("127.0.0.1"), time.Now()
+	nonce := []byte{0xde, 0xad, 0xbe, 0xef}
+	gen := NewConnectionIDGenerator([]byte("key"), time.Minute, 0)
+	cid := append([]byte(nil), gen.GenerateWithNonce(ip, now, nonce)...)
+	require.True(t, gen.ValidateWithNonce(cid, ip, now, nonce))
+	require.False(t, gen.Validate(cid, ip, now))
+	// nonces with the same XOR-ed value must not be interchangeable
+	require.False(t, gen.ValidateWithNonce(cid, ip, now, []byte{0xad, 0xde, 0xef, 0xbe}))
+	require.False(t, gen.ValidateWithNonce(cid, ip, now, []byte{0xde, 0xad, 0xbe, 0xee}))
+	require.False(t, gen.ValidateWithNonce(cid, netip.MustParseAddr("127.0.0.2"), now, nonce))
+}
+
+func TestGranularity(t *testing.T) {
+	ip := netip.MustParseAddr("127.0.0.1")
+	const gran, skew = 30 * time.Second, 5 * time.Second
+	gen := NewConnectionIDGenerator([]byte("key"), skew, gran)
+	bucketStart := time.Unix(1_700_000_010, 0)
+
+	first := append([]byte(nil), gen.Generate(ip, bucketStart)...)
+	// IDs generated within the same bucket carry the same timestamp
+	last := gen.Generate(ip, bucketStart.Add(gran-time.Second))
+	require.Equal(t, first[1:3], last[1:3])
+	require.NotEqual(t, first[1:3], gen.Generate(ip, bucketStart.Add(gran))[1:3])
+
+	ttlDur := time.Duration(ttl) * time.Second
+	// valid since the start of the bucket till the end of the bucket + ttl
+	for _, d := range []time.Duration{-skew + time.Second, 0, gran, gran + ttlDur - time.Second, gran + ttlDur + skew - 2*time.Second} {
+		require.True(t, gen.Validate(first, ip, bucketStart.Add(d)), d)
+	}
+	for _, d := range []time.Duration{-skew, gran + ttlDur + skew} {
+		require.False(t, gen.Validate(first, ip, bucketStart.Add(d)), d)
+	}
+
+	// default granularity: valid only for ttl since generation
+	gen = NewConnectionIDGenerator([]byte("key"), skew, 0)
+	first = append([]byte(nil), gen.Generate(ip, bucketStart)...)
+	require.True(t, gen.Validate(first, ip, bucketStart.Add(ttlDur)))
+	require.False(t, gen.Validate(first, ip, bucketStart.Add(ttlDur+skew)))
+}
+
+func TestKeyRotation(t *testing.T) {
+	ip, now := netip.MustParseAddr("127.0.0.1"), time.Now()
+	oldKey, newKey := []byte("old key"), []byte("new key")
+	oldID := append([]byte(nil), NewConnectionIDGenerator(oldKey, time.Minute, 0).Generate(ip, now)...)
+
+	gen := NewRotatingConnectionIDGenerator([][]byte{newKey, oldKey}, time.Minute, 0)
+	require.True(t, gen.Validate(oldID, ip, now), "ID minted with listed older key must be valid")
+	newID := append([]byte(nil), gen.Generate(ip, now)...)
+	require.True(t, gen.Validate(newID, ip, now))
+	require.True(t, NewConnectionIDGenerator(newKey, time.Minute, 0).Validate(newID, ip, now),
+		"ID must be generated with the first key")
+	require.False(t, NewConnectionIDGenerator(oldKey, time.Minute, 0).Validate(newID, ip, now))
+	require.False(t, NewConnectionIDGenerator(newKey, time.Minute, 0).Validate(oldID, ip, now),
+		"ID minted with removed key must be invalid")
+}
+
+func TestCheckReasons(t *testing.T) {
+	ip, now := netip.MustParseAddr("127.0.0.1"), time.Unix(1_700_000_000, 0)
+	nonce := []byte{0xde, 0xad, 0xbe, 0xef}
+	gen := NewConnectionIDGenerator([]byte("key"), time.Second, 0)
+	cid := append([]byte(nil), gen.Generate(ip, now)...)
+	nonceCID := append([]byte(nil), gen.GenerateWithNonce(ip, now, nonce)...)
+	forged := append([]byte(nil), cid...)
+	forged[connIDLen-1] ^= 0xff
+	skewedAt := now.Add(time.Duration(ttl+2) * time.Second)
+	expiredAt := skewedAt.Add(maxAllowedClockSkew)
+
+	for _, tt := range []struct {
+		name     string
+		got      ConnIDStatus
+		expected ConnIDStatus
+	}{
+		{"valid", gen.Check(cid, ip, now), ConnIDValid},
+		{"valid nonce", gen.CheckWithNonce(nonceCID, ip, now, nonce), ConnIDValid},
+		{"forged", gen.Check(forged, ip, now), ConnIDBadHMAC},
+		{"other key", NewConnectionIDGenerator([]byte("other"), time.Second, 0).Check(cid, ip, now), ConnIDBadHMAC},
+		{"wrong ip", gen.Check(cid, netip.MustParseAddr("127.0.0.2"), now), ConnIDBadHMAC},
+		{"expired", gen.Check(cid, ip, expiredAt), ConnIDExpired},
+		{"future", gen.Check(cid, ip, now.Add(-maxAllowedClockSkew)), ConnIDExpired},
+		{"skewed", gen.Check(cid, ip, skewedAt), ConnIDClockSkew},
+		{"skewed future", gen.Check(cid, ip, now.Add(-2*time.Second)), ConnIDClockSkew},
+		{"forged expired", gen.Check(forged, ip, expiredAt), ConnIDBadHMAC},
+		{"no nonce", gen.CheckWithNonce(cid, ip, now, nonce), ConnIDBadNonce},
+		{"other nonce", gen.CheckWithNonce(nonceCID, ip, now, []byte{0xde, 0xad, 0xbe, 0xee}), ConnIDBadHMAC},
+		{"nonce without nonce", gen.Check(nonceCID, ip, now), ConnIDBadHMAC},
+		{"forged nonce", gen.CheckWithNonce(forged, ip, now, nonce), ConnIDBadHMAC},
+	} {
+		require.Equal(t, tt.expected, tt.got, tt.name)
+	}
+}
+
+func TestConnIDFailuresMetric(t *testing.T) {
+	ip := netip.MustParseAddr("127.0.0.1")
+	f := &udpFE{connectNonce: true}
+	gen := NewConnectionIDGenerator([]byte("key"), time.Second, 0)
+	newAnnounce := func(connID []byte, key []byte) Request {
+		packet := make([]byte, 84+net.IPv4len, 98)
+		copy(packet, connID)
+		return Request{Packet: append(packet, key...), IP: ip}
+	}
+	nonce := []byte{0xde, 0xad, 0xbe, 0xef}
+	cid := append([]byte(nil), gen.GenerateWithNonce(ip, timecache.Now(), nonce)...)
+	forged := append([]byte(nil), cid...)
+	forged[connIDLen-1] ^= 0xff
+	expired := append([]byte(nil), gen.GenerateWithNonce(ip, timecache.Now().Add(-time.Hour), nonce)...)
+	plain := append([]byte(nil), gen.Generate(ip, timecache.Now())...)
+
+	for _, tt := range []struct {
+		req      Request
+		expected ConnIDStatus
+	}{
+		{newAnnounce(forged, nonce), ConnIDBadHMAC},
+		{newAnnounce(expired, nonce), ConnIDExpired},
+		{newAnnounce(cid, []byte{0, 0, 0, 0}), ConnIDBadHMAC},
+		{newAnnounce(plain, nonce), ConnIDBadNonce},
+		{newAnnounce(cid, nil), ConnIDBadNonce},
+	} {
+		counter := promConnIDFailures.WithLabelValues(tt.expected.String())
+		before := testutil.ToFloat64(counter)
+		require.False(t, f.validateConnectionID(gen, tt.req, announceActionID, tt.req.Packet[:connIDLen]))
+		require.Equal(t, before+1, testutil.ToFloat64(counter), tt.expected.String())
+	}
+	require.True(t, f.validateConnectionID(gen, newAnnounce(cid, nonce), announceActionID, cid))
+}
+
+func TestClockSkewOverride(t *testing.T) {
+	ip, now := netip.MustParseAddr("127.0.0.1"), timecache.Now()
+	logic := middleware.NewLogic(0, 0, nil, nil, nil)
+	f := &udpFE{logic: logic, maxClockSkew: time.Second}
+	gen := NewConnectionIDGenerator([]byte("key"), time.Second, 0)
+	// generated by client with clock 20 seconds ahead
+	cid := append([]byte(nil), gen.Generate(ip, now.Add(20*time.Second))...)
+	req := Request{Packet: cid, IP: ip}
+
+	counter := promConnIDFailures.WithLabelValues(ConnIDClockSkew.String())
+	before := testutil.ToFloat64(counter)
+	require.False(t, f.validateConnectionID(gen, req, scrapeActionID, cid))
+	require.Equal(t, before+1, testutil.ToFloat64(counter))
+
+	require.ErrorIs(t, logic.SetMaxClockSkew(time.Minute), middleware.ErrInvalidClockSkew)
+	require.Nil(t, logic.SetMaxClockSkew(maxAllowedClockSkew))
+	require.True(t, f.validateConnectionID(gen, req, scrapeActionID, cid))
+
+	// reset to configured skew
+	require.Nil(t, logic.SetMaxClockSkew(0))
+	require.False(t, f.validateConnectionID(gen, req, scrapeActionID, cid))
+}
@@ -0,0 +1,72 @@
+package udp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// CompactPeerEncoderName is the name of default PeerEncoder,
+// which writes peers in compact format described in BEP 15
+const CompactPeerEncoderName = "compact"
+
+var (
+	peerEncodersMU sync.RWMutex
+	peerEncoders   = make(map[string]PeerEncoder)
+)
+
+func init() {
+	RegisterPeerEncoder(CompactPeerEncoderName, compactPeerEncoder{})
+}
+
+// PeerEncoder writes peers of announce response
+// right after its header
+type PeerEncoder interface {
+	// EncodePeers writes peers into w
+	EncodePeers(w io.Writer, peers []bittorrent.Peer)
+}
+
+// RegisterPeerEncoder makes a PeerEncoder available by the provided name.
+//
+// If called twice with the same name, the name is blank,
+// or if the provided PeerEncoder is nil, this function panics.
+func RegisterPeerEncoder(name string, e PeerEncoder) {
+	if name == "" {
+		panic("udp: could not register a PeerEncoder with an empty name")
+	}
+	if e == nil {
+		panic("udp: could not register a nil PeerEncoder")
+	}
+
+	peerEncodersMU.Lock()
+	defer peerEncodersMU.Unlock()
+
+	if _, dup := peerEncoders[name]; dup {
+		panic("udp: RegisterPeerEncoder called twice for " + name)
+	}
+
+	peerEncoders[name] = e
+}
+
+func getPeerEncoder(name string) (e PeerEncoder, err error) {
+	peerEncodersMU.RLock()
+	defer peerEncodersMU.RUnlock()
+	var ok bool
+	if e, ok = peerEncoders[name]; !ok {
+		err = fmt.Errorf("peer encoder with name '%s' does not exists", name)
+	}
+	return
+}
+
+// compactPeerEncoder writes peers as IP[4/16by]Port[2by]
+type compactPeerEncoder struct{}
+
+func (compactPeerEncoder) EncodePeers(w io.Writer, peers []bittorrent.Peer) {
+	for _, peer := range peers {
+		_, _ = w.Write(peer.Addr().AsSlice())
+		_ = binary.Write(w, binary.BigEndian, peer.Port())
+	}
+}
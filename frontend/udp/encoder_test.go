@@ -0,0 +1,47 @@
+package udp
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// flagsPeerEncoder writes peers as Flags[1by]IP[4/16by]Port[2by]
+type flagsPeerEncoder struct{}
+
+func (flagsPeerEncoder) EncodePeers(w io.Writer, peers []bittorrent.Peer) {
+	for _, peer := range peers {
+		_, _ = w.Write([]byte{0xFF})
+		compactPeerEncoder{}.EncodePeers(w, []bittorrent.Peer{peer})
+	}
+}
+
+func TestPeerEncoder(t *testing.T) {
+	RegisterPeerEncoder("flags", flagsPeerEncoder{})
+	require.Panics(t, func() { RegisterPeerEncoder("flags", flagsPeerEncoder{}) })
+	_, err := getPeerEncoder("unknown")
+	require.NotNil(t, err)
+
+	resp := &bittorrent.AnnounceResponse{
+		IPv4Peers: []bittorrent.Peer{{AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}},
+	}
+	header := []byte{0, 0, 0, 1, 1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	txID := []byte{1, 2, 3, 4}
+
+	enc, err := getPeerEncoder(CompactPeerEncoderName)
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	writeAnnounceResponse(&buf, txID, resp, false, false, enc, netip.Addr{})
+	require.Equal(t, append(header, 10, 0, 0, 1, 0x1A, 0xE1), buf.Bytes())
+
+	enc, err = getPeerEncoder("flags")
+	require.Nil(t, err)
+	buf.Reset()
+	writeAnnounceResponse(&buf, txID, resp, false, false, enc, netip.Addr{})
+	require.Equal(t, append(header, 0xFF, 10, 0, 0, 1, 0x1A, 0xE1), buf.Bytes())
+}
@@ -21,16 +21,34 @@ import (
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/ratelimit"
 	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/pkg/tracing"
 )
 
 const (
 	// Name - registered name of the frontend
 	Name                            = "udp"
 	defaultKeyLen                   = 32
-	maxAllowedClockSkew             = 30 * time.Second
+	maxAllowedClockSkew             = middleware.MaxAllowedClockSkew
 	defaultMaxClockSkew             = 10 * time.Second
+	defaultConnectionIDGranularity  = time.Second
 	allowedGeneratedPrivateKeyRunes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
+	// length of nonce, which should be sent by client in connect request
+	// and in `key` field of announce request if Config.ConnectNonce enabled
+	connectNonceLen = 4
+	// maxScrapeInfoHashes is the maximum number of info hashes in
+	// one scrape request/response, which fits into datagram (1500 MTU),
+	// see BEP 15
+	maxScrapeInfoHashes = 74
+	// ExternalIPMarker is the suffix of non-standard trailer
+	// of announce response, which contains client's IP address
+	// as seen by tracker
+	ExternalIPMarker = "mXIP"
+	// ScrapeIntervalMarker is the suffix of non-standard trailer
+	// of scrape response, which contains minimal interval
+	// between scrape requests in seconds
+	ScrapeIntervalMarker = "mSMI"
 )
 
 var logger = log.NewLogger("frontend/udp")
@@ -43,8 +61,40 @@ func init() {
 // Tracker.
 type Config struct {
 	frontend.ListenOptions
-	PrivateKey   string        `cfg:"private_key"`
+	PrivateKey string `cfg:"private_key"`
+	// PrivateKeys are additional keys for connection IDs, used for
+	// key rotation. The first key (PrivateKey if set, or the first of
+	// PrivateKeys) is used to generate IDs, all keys are used to validate them.
+	PrivateKeys  []string      `cfg:"private_keys"`
 	MaxClockSkew time.Duration `cfg:"max_clock_skew"`
+	// ConnectionIDGranularity is the width of time bucket placed in connection ID.
+	// Coarser bucket keeps IDs valid longer (fewer reconnects),
+	// but widens replay window.
+	ConnectionIDGranularity time.Duration `cfg:"connection_id_granularity"`
+	// ConnectNonce requires client to send 4 bytes nonce right after
+	// connect request header and the same value in `key` field of announce requests.
+	// Scrape requests do not contain nonce, so connection IDs for them
+	// should be requested by connect without nonce.
+	ConnectNonce bool `cfg:"connect_nonce"`
+	// ConnectRateLimit is the maximum number of connect requests per second
+	// from one IP address, which will be responded. Zero means no limit.
+	ConnectRateLimit uint `cfg:"connect_rate_limit"`
+	// ScrapeRateLimit is the maximum number of scrape requests per second
+	// from one IP address, which will be responded. Zero means no limit.
+	ScrapeRateLimit uint `cfg:"scrape_rate_limit"`
+	// PeerEncoder is the name of registered PeerEncoder used
+	// to write peers in announce responses
+	PeerEncoder string `cfg:"peer_encoder"`
+	// PinWorkers binds goroutine, which reads socket of each worker,
+	// to dedicated CPU (worker index modulo number of CPUs).
+	// Supported only on Linux.
+	PinWorkers bool `cfg:"pin_workers"`
+	// ExternalIP appends non-standard trailer with observed client's IP
+	// to announce responses (see ExternalIPMarker)
+	ExternalIP bool `cfg:"external_ip"`
+	// ScrapeInterval if set, appended to scrape responses as
+	// non-standard trailer (see ScrapeIntervalMarker) to limit scrape rate
+	ScrapeInterval time.Duration `cfg:"scrape_interval"`
 	frontend.ParseOptions
 }
 
@@ -62,8 +112,15 @@ func (cfg Config) Validate() (validCfg Config) {
 		logger.Warn().Msg("forcibly enabling ReusePort because Workers > 1")
 	}
 
+	validCfg.PrivateKeys = make([]string, 0, len(cfg.PrivateKeys))
+	for _, k := range cfg.PrivateKeys {
+		if len(k) > 0 {
+			validCfg.PrivateKeys = append(validCfg.PrivateKeys, k)
+		}
+	}
+
 	// Generate a private key if one isn't provided by the user.
-	if cfg.PrivateKey == "" {
+	if cfg.PrivateKey == "" && len(validCfg.PrivateKeys) == 0 {
 		pkeyRunes := make([]byte, defaultKeyLen)
 		if _, err := rand.Read(pkeyRunes); err != nil {
 			panic(err)
@@ -94,7 +151,38 @@ func (cfg Config) Validate() (validCfg Config) {
 			Msg("falling back to default configuration")
 	}
 
+	// granularity plus clock skew should not exceed connection ID TTL,
+	// so replay window is no more than twice TTL
+	maxGranularity := time.Duration(ttl)*time.Second - validCfg.MaxClockSkew
+	if cfg.ConnectionIDGranularity < time.Second || cfg.ConnectionIDGranularity > maxGranularity {
+		validCfg.ConnectionIDGranularity = defaultConnectionIDGranularity
+		logger.Warn().
+			Str("name", "ConnectionIDGranularity").
+			Dur("provided", cfg.ConnectionIDGranularity).
+			Dur("default", validCfg.ConnectionIDGranularity).
+			Msg("falling back to default configuration")
+	} else {
+		validCfg.ConnectionIDGranularity = cfg.ConnectionIDGranularity.Truncate(time.Second)
+	}
+
+	if len(cfg.PeerEncoder) == 0 {
+		validCfg.PeerEncoder = CompactPeerEncoderName
+		logger.Warn().
+			Str("name", "PeerEncoder").
+			Str("provided", cfg.PeerEncoder).
+			Str("default", validCfg.PeerEncoder).
+			Msg("falling back to default configuration")
+	}
+
 	validCfg.ParseOptions = cfg.ParseOptions.Validate(logger)
+	if validCfg.MaxScrapeInfoHashes > maxScrapeInfoHashes {
+		validCfg.MaxScrapeInfoHashes = maxScrapeInfoHashes
+		logger.Warn().
+			Str("name", "MaxScrapeInfoHashes").
+			Uint32("provided", cfg.MaxScrapeInfoHashes).
+			Uint32("default", validCfg.MaxScrapeInfoHashes).
+			Msg("falling back to default configuration")
+	}
 
 	return
 }
@@ -107,6 +195,13 @@ type udpFE struct {
 	genPool        *sync.Pool
 	logic          *middleware.Logic
 	collectTimings bool
+	connectNonce   bool
+	connectLimiter *ratelimit.Limiter[netip.Addr]
+	scrapeLimiter  *ratelimit.Limiter[netip.Addr]
+	peerEncoder    PeerEncoder
+	externalIP     bool
+	maxClockSkew   time.Duration
+	scrapeInterval time.Duration
 	ctxCancel      context.CancelFunc
 	onceCloser     sync.Once
 	frontend.ParseOptions
@@ -120,28 +215,60 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 		return nil, err
 	}
 	cfg = cfg.Validate()
-	pKey := []byte(cfg.PrivateKey)
+	var enc PeerEncoder
+	if enc, err = getPeerEncoder(cfg.PeerEncoder); err != nil {
+		return nil, err
+	}
+	pKeys := make([][]byte, 0, len(cfg.PrivateKeys)+1)
+	if len(cfg.PrivateKey) > 0 {
+		pKeys = append(pKeys, []byte(cfg.PrivateKey))
+	}
+	for _, k := range cfg.PrivateKeys {
+		pKeys = append(pKeys, []byte(k))
+	}
 
 	f := &udpFE{
 		sockets:        make([]*net.UDPConn, cfg.Workers),
 		closing:        make(chan any),
 		logic:          logic,
 		collectTimings: cfg.EnableRequestTiming,
+		connectNonce:   cfg.ConnectNonce,
+		peerEncoder:    enc,
+		externalIP:     cfg.ExternalIP,
+		maxClockSkew:   cfg.MaxClockSkew,
+		scrapeInterval: cfg.ScrapeInterval,
 		ParseOptions:   cfg.ParseOptions,
 		genPool: &sync.Pool{
 			New: func() any {
-				return NewConnectionIDGenerator(pKey, cfg.MaxClockSkew)
+				return NewRotatingConnectionIDGenerator(pKeys, cfg.MaxClockSkew, cfg.ConnectionIDGranularity)
 			},
 		},
 	}
 
+	if cfg.ConnectRateLimit > 0 {
+		f.connectLimiter = ratelimit.New[netip.Addr](cfg.ConnectRateLimit, time.Second)
+	}
+	if cfg.ScrapeRateLimit > 0 {
+		f.scrapeLimiter = ratelimit.New[netip.Addr](cfg.ScrapeRateLimit, time.Second)
+	}
+
 	var ctx context.Context
 	ctx, f.ctxCancel = context.WithCancel(context.Background())
+	if cfg.PinWorkers && !affinitySupported {
+		logger.Warn().Msg("CPU affinity is not supported on this platform, workers are not pinned")
+	}
 	logger.Debug().Str("addr", cfg.Addr).Msg("starting listener")
 	for i := range f.sockets {
 		if f.sockets[i], err = cfg.ListenUDP(); err == nil {
 			f.wg.Add(1)
 			go func(socket *net.UDPConn, ctx context.Context) {
+				if cfg.PinWorkers && affinitySupported {
+					if cpu, err := pinToCPU(i); err == nil {
+						logger.Debug().Int("worker", i).Int("cpu", cpu).Msg("worker pinned")
+					} else {
+						logger.Warn().Err(err).Int("worker", i).Msg("unable to pin worker to CPU")
+					}
+				}
 				if err := f.serve(ctx, socket); err != nil {
 					logger.Fatal().Str("addr", cfg.Addr).Err(err).Msg("listener failed")
 				} else {
@@ -251,6 +378,45 @@ func (w ResponseWriter) Write(b []byte) (int, error) {
 	return w.socket.WriteToUDPAddrPort(b, w.addrPort)
 }
 
+// validateConnectionID checks connection ID of non-connect request.
+// If connect nonce required, announce request must contain
+// the nonce in `key` field.
+func (f *udpFE) validateConnectionID(gen *ConnectionIDGenerator, r Request, actionID uint32, connID []byte) bool {
+	var res ConnIDStatus
+	skew := f.maxClockSkew
+	if f.logic != nil {
+		if override := f.logic.MaxClockSkew(); override > 0 {
+			skew = override
+		}
+	}
+	if skew > 0 {
+		gen.SetMaxClockSkew(skew)
+	}
+	if f.connectNonce && (actionID == announceActionID || actionID == announceV6ActionID) {
+		keyStart := 84 + net.IPv4len
+		if actionID == announceV6ActionID {
+			keyStart = 84 + net.IPv6len
+		}
+		if len(r.Packet) < keyStart+connectNonceLen {
+			res = ConnIDBadNonce
+		} else {
+			res = gen.CheckWithNonce(connID, r.IP, timecache.Now(), r.Packet[keyStart:keyStart+connectNonceLen])
+		}
+	} else {
+		res = gen.Check(connID, r.IP, timecache.Now())
+	}
+	if res != ConnIDValid {
+		recordConnIDFailure(res)
+		logger.Debug().
+			Stringer("ip", r.IP).
+			Hex("connID", connID).
+			Stringer("reason", res).
+			Msg("connection ID validation failed")
+		return false
+	}
+	return true
+}
+
 // handleRequest parses and responds to a UDP Request.
 func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter) (actionName string, err error) {
 	if len(r.Packet) < 16 {
@@ -260,6 +426,12 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 		return
 	}
 
+	// Requests of banned addresses are dropped without response
+	if f.logic.Banned(r.IP) {
+		err = errBanned
+		return
+	}
+
 	// Parse the headers of the UDP packet.
 	connID := r.Packet[0:8]
 	actionID := binary.BigEndian.Uint32(r.Packet[8:12])
@@ -271,7 +443,7 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 
 	// If this isn't requesting a new connection ID and the connection ID is
 	// invalid, then fail.
-	if actionID != connectActionID && !gen.Validate(connID, r.IP, timecache.Now()) {
+	if actionID != connectActionID && !f.validateConnectionID(gen, r, actionID, connID) {
 		err = errBadConnectionID
 		writeErrorResponse(w, txID, err)
 		return
@@ -287,10 +459,30 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 			return
 		}
 
-		writeConnectionID(w, txID, gen.Generate(r.IP, timecache.Now()))
+		// Connect responses are not sent to throttled clients to
+		// mitigate reflection attacks
+		if f.connectLimiter != nil && !f.connectLimiter.Allow(r.IP, timecache.Now()) {
+			err = errConnectRateLimited
+			f.logic.ReportRateLimited(ctx, r.IP)
+			return
+		}
+
+		// Standard connect request (without nonce) is answered with
+		// ID, which can not be used for announce, but valid for scrape.
+		if f.connectNonce && len(r.Packet) > 16 {
+			if len(r.Packet) < 16+connectNonceLen {
+				err = errMalformedPacket
+				return
+			}
+			writeConnectionID(w, txID, gen.GenerateWithNonce(r.IP, timecache.Now(), r.Packet[16:16+connectNonceLen]))
+		} else {
+			writeConnectionID(w, txID, gen.Generate(r.IP, timecache.Now()))
+		}
 
 	case announceActionID, announceV6ActionID:
 		actionName = "announce"
+		spanCtx, span := tracing.Start(ctx, actionName, tracing.AttrFrontend.String(Name), tracing.AttrAction.String(actionName))
+		defer func() { tracing.End(span, err) }()
 
 		var req *bittorrent.AnnounceRequest
 		req, err = parseAnnounce(r, actionID == announceV6ActionID, f.ParseOptions)
@@ -300,7 +492,7 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 		}
 
 		var resp *bittorrent.AnnounceResponse
-		ctx := bittorrent.InjectRouteParamsToContext(ctx, bittorrent.RouteParams{})
+		ctx := bittorrent.InjectFrontendToContext(bittorrent.InjectRouteParamsToContext(spanCtx, bittorrent.RouteParams{}), Name)
 		ctx, resp, err = f.logic.HandleAnnounce(ctx, req)
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
@@ -310,14 +502,33 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 		}
 
 		if err = ctx.Err(); err == nil {
-			writeAnnounceResponse(w, txID, resp, actionID == announceV6ActionID, r.IP.Is6())
+			var extIP netip.Addr
+			if f.externalIP {
+				extIP = r.IP
+			}
+			writeAnnounceResponse(w, txID, resp, actionID == announceV6ActionID, r.IP.Is6(), f.peerEncoder, extIP)
+			if tracing.Enabled() {
+				span.SetAttributes(tracing.InfoHash(req.InfoHash),
+					tracing.AttrPeerCount.Int(len(resp.IPv4Peers)+len(resp.IPv6Peers)))
+			}
 
-			ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
-			go f.logic.AfterAnnounce(ctx, req, resp)
+			ctx = tracing.Remap(spanCtx, bittorrent.RemapRouteParamsToBgContext(ctx))
+			f.logic.AfterAnnounceAsync(ctx, req, resp)
 		}
 
 	case scrapeActionID:
 		actionName = "scrape"
+		spanCtx, span := tracing.Start(ctx, actionName, tracing.AttrFrontend.String(Name), tracing.AttrAction.String(actionName))
+		defer func() { tracing.End(span, err) }()
+
+		// scrapes are throttled by source IP, because client
+		// may obtain new connection ID at any moment
+		if f.scrapeLimiter != nil && !f.scrapeLimiter.Allow(r.IP, timecache.Now()) {
+			err = errScrapeRateLimited
+			f.logic.ReportRateLimited(ctx, r.IP)
+			writeErrorResponse(w, txID, err)
+			return
+		}
 
 		var req *bittorrent.ScrapeRequest
 		req, err = parseScrape(r, f.ParseOptions)
@@ -327,7 +538,7 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 		}
 
 		var resp *bittorrent.ScrapeResponse
-		ctx := bittorrent.InjectRouteParamsToContext(ctx, bittorrent.RouteParams{})
+		ctx := bittorrent.InjectFrontendToContext(bittorrent.InjectRouteParamsToContext(spanCtx, bittorrent.RouteParams{}), Name)
 		ctx, resp, err = f.logic.HandleScrape(ctx, req)
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
@@ -337,10 +548,10 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 		}
 
 		if err = ctx.Err(); err == nil {
-			writeScrapeResponse(w, txID, resp)
+			writeScrapeResponse(w, txID, &bittorrent.ScrapeResponse{Data: alignScrapes(req.InfoHashes, resp.Data)}, f.scrapeInterval)
 
-			ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
-			go f.logic.AfterScrape(ctx, req, resp)
+			ctx = tracing.Remap(spanCtx, bittorrent.RemapRouteParamsToBgContext(ctx))
+			f.logic.AfterScrapeAsync(ctx, req, resp)
 		}
 
 	default:
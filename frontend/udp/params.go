@@ -91,6 +91,21 @@ func (qp queryParams) GetString(key string) (string, bool) {
 	return value, ok
 }
 
+// extraParams returns copy of parameters, which are not standard
+// announce parameters (see bittorrent.IsStandardAnnounceParam).
+// Parsed parameters may refer to pooled buffer, so they are cloned.
+func (qp queryParams) extraParams() (extra map[string]string) {
+	for k, v := range qp.params {
+		if !bittorrent.IsStandardAnnounceParam(k) {
+			if extra == nil {
+				extra = make(map[string]string)
+			}
+			extra[strings.Clone(k)] = strings.Clone(v)
+		}
+	}
+	return
+}
+
 // MarshalZerologObject writes fields into zerolog event
 func (qp queryParams) MarshalZerologObject(e *zerolog.Event) {
 	for k, v := range qp.params {
@@ -41,12 +41,15 @@ var (
 		bittorrent.Stopped,
 	}
 
-	errMalformedPacket   = bittorrent.ClientError("malformed packet")
-	errUnknownAction     = bittorrent.ClientError("unknown action ID")
-	errBadConnectionID   = bittorrent.ClientError("bad connection ID")
-	errUnknownOptionType = bittorrent.ClientError("unknown option type")
-	errInvalidInfoHash   = bittorrent.ClientError("invalid info hash")
-	errInvalidPeerID     = bittorrent.ClientError("invalid info hash")
+	errMalformedPacket    = bittorrent.ClientError("malformed packet")
+	errUnknownAction      = bittorrent.ClientError("unknown action ID")
+	errBadConnectionID    = bittorrent.ClientError("bad connection ID")
+	errConnectRateLimited = bittorrent.ClientError("connect rate limit exceeded")
+	errScrapeRateLimited  = bittorrent.ClientError("scrape rate limit exceeded")
+	errBanned             = bittorrent.ClientError("address banned")
+	errUnknownOptionType  = bittorrent.ClientError("unknown option type")
+	errInvalidInfoHash    = bittorrent.ClientError("invalid info hash")
+	errInvalidPeerID      = bittorrent.ClientError("invalid info hash")
 
 	reqRespBufferPool = bytepool.NewBufferPool()
 )
@@ -75,6 +78,9 @@ func parseAnnounce(r Request, v6Action bool, opts frontend.ParseOptions) (*bitto
 	if err != nil {
 		return nil, errInvalidInfoHash
 	}
+	if err = opts.CheckInfoHash(request.InfoHash); err != nil {
+		return nil, err
+	}
 
 	request.ID, err = bittorrent.NewPeerID(r.Packet[36:56])
 	if err != nil {
@@ -100,10 +106,16 @@ func parseAnnounce(r Request, v6Action bool, opts frontend.ParseOptions) (*bitto
 
 	request.NumWant, request.NumWantProvided = binary.BigEndian.Uint32(r.Packet[ipEnd+4:ipEnd+8]), true
 	request.Port = binary.BigEndian.Uint16(r.Packet[ipEnd+8 : ipEnd+10])
-	request.Params, err = handleOptionalParameters(r.Packet[ipEnd+10:])
+	qp, err := handleOptionalParameters(r.Packet[ipEnd+10:])
 	if err != nil {
 		return nil, err
 	}
+	request.Params, request.ExtraParams = qp, qp.extraParams()
+
+	// zones are stripped while sanitizing, if not rejected here
+	if opts.RejectZonedIPs && request.HasZone() {
+		return nil, bittorrent.ErrZonedIP
+	}
 
 	if err = bittorrent.SanitizeAnnounce(request, opts.MaxNumWant, opts.DefaultNumWant, opts.FilterPrivateIPs); err != nil {
 		request = nil
@@ -114,7 +126,7 @@ func parseAnnounce(r Request, v6Action bool, opts frontend.ParseOptions) (*bitto
 
 // handleOptionalParameters parses the optional parameters as described in BEP
 // 41 and updates an announce with the values parsed.
-func handleOptionalParameters(packet []byte) (bittorrent.Params, error) {
+func handleOptionalParameters(packet []byte) (*queryParams, error) {
 	if len(packet) == 0 {
 		return parseQuery(nil)
 	}
@@ -178,6 +190,9 @@ func parseScrape(r Request, opts frontend.ParseOptions) (*bittorrent.ScrapeReque
 	for len(r.Packet) >= bittorrent.InfoHashV1Len {
 		var ih bittorrent.InfoHash
 		if ih, err = bittorrent.NewInfoHash(r.Packet[:bittorrent.InfoHashV1Len]); err == nil {
+			if err = opts.CheckInfoHash(ih); err != nil {
+				break
+			}
 			infoHashes = append(infoHashes, ih)
 			r.Packet = r.Packet[bittorrent.InfoHashV1Len:]
 		} else {
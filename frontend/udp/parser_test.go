@@ -3,7 +3,13 @@ package udp
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/frontend"
 )
 
 var table = []struct {
@@ -75,3 +81,53 @@ func TestHandleOptionalParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestParseInfoHashPolicy(t *testing.T) {
+	ip := netip.MustParseAddr("127.0.0.1")
+	header := append(make([]byte, 12), 0, 0, 0, 1)[:16]
+	announce := append(append([]byte(nil), header...), "aaaaaaaaaaaaaaaaaaaa"...)
+	announce = append(announce, "bbbbbbbbbbbbbbbbbbbb"...)
+	announce = append(announce, make([]byte, 28+net.IPv4len+8)...)
+	// port
+	announce = append(announce, 0x1a, 0xe1)
+	scrape := append(append([]byte(nil), header...), "aaaaaaaaaaaaaaaaaaaa"...)
+
+	for policy, ok := range map[string]bool{
+		frontend.InfoHashPolicyAny: true,
+		frontend.InfoHashPolicyV1:  true,
+		frontend.InfoHashPolicyV2:  false,
+	} {
+		t.Run(policy, func(t *testing.T) {
+			opts := frontend.ParseOptions{
+				MaxNumWant:          10,
+				DefaultNumWant:      10,
+				MaxScrapeInfoHashes: 10,
+				InfoHashPolicy:      policy,
+			}
+			_, aErr := parseAnnounce(Request{Packet: announce, IP: ip}, false, opts)
+			_, sErr := parseScrape(Request{Packet: scrape, IP: ip}, opts)
+			if ok {
+				require.Nil(t, aErr)
+				require.Nil(t, sErr)
+			} else {
+				require.ErrorIs(t, aErr, frontend.ErrInfoHashNotAllowed)
+				require.ErrorIs(t, sErr, frontend.ErrInfoHashNotAllowed)
+			}
+		})
+	}
+}
+
+func TestParseExtraParams(t *testing.T) {
+	header := append(make([]byte, 12), 0, 0, 0, 1)[:16]
+	announce := append(append([]byte(nil), header...), "aaaaaaaaaaaaaaaaaaaa"...)
+	announce = append(announce, "bbbbbbbbbbbbbbbbbbbb"...)
+	announce = append(announce, make([]byte, 28+net.IPv4len+8)...)
+	announce = append(announce, 0x1a, 0xe1)
+	urlData := "/announce?Passkey=secret&trackerid=1&vendor_flag"
+	announce = append(append(announce, optionURLData, byte(len(urlData))), urlData...)
+
+	opts := frontend.ParseOptions{MaxNumWant: 10, DefaultNumWant: 10}
+	req, err := parseAnnounce(Request{Packet: announce, IP: netip.MustParseAddr("127.0.0.1")}, false, opts)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"passkey": "secret", "vendor_flag": ""}, req.ExtraParams)
+}
@@ -11,18 +11,14 @@ import (
 	"github.com/sot-tech/mochi/pkg/metrics"
 )
 
-func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
-}
-
-var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
+var promResponseDurationMilliseconds = metrics.Register(prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
 		Name:    "mochi_udp_response_duration_milliseconds",
 		Help:    "The duration of time it takes to receive and write a response to an API request",
 		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
 	},
 	[]string{"action", "address_family", "error"},
-)
+))
 
 // recordResponseDuration records the duration of time to respond to a UDP
 // Request in milliseconds.
@@ -41,3 +37,17 @@ func recordResponseDuration(action string, addr netip.Addr, err error, duration
 		WithLabelValues(action, metrics.AddressFamily(addr), errString).
 		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
 }
+
+var promConnIDFailures = metrics.Register(prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_udp_connid_failures_total",
+		Help: "The number of connection ID validation failures by reason",
+	},
+	[]string{"reason"},
+))
+
+// recordConnIDFailure increments connection ID failures counter
+// with reason label
+func recordConnIDFailure(res ConnIDStatus) {
+	promConnIDFailures.WithLabelValues(res.String()).Inc()
+}
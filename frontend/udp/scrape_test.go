@@ -0,0 +1,108 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/ratelimit"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestScrapeRateLimit(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer client.Close()
+
+	gen := NewConnectionIDGenerator([]byte("key"), time.Minute, 0)
+	f := &udpFE{
+		logic:         middleware.NewLogic(0, 0, ps, nil, nil),
+		scrapeLimiter: ratelimit.New[netip.Addr](2, time.Minute),
+		genPool: &sync.Pool{New: func() any {
+			return NewConnectionIDGenerator([]byte("key"), time.Minute, 0)
+		}},
+	}
+	f.MaxScrapeInfoHashes = 10
+
+	ip := netip.MustParseAddr("127.0.0.1")
+	w := ResponseWriter{socket: server, addrPort: client.LocalAddr().(*net.UDPAddr).AddrPort()}
+	newPacket := func(connID []byte) []byte {
+		packet := append([]byte(nil), connID...)
+		packet = binary.BigEndian.AppendUint32(packet, scrapeActionID)
+		packet = append(packet, 0, 0, 0, 1)
+		return append(packet, "aaaaaaaaaaaaaaaaaaaa"...)
+	}
+
+	connID := append([]byte(nil), gen.Generate(ip, timecache.Now())...)
+	for i := 0; i < 2; i++ {
+		_, err = f.handleRequest(context.Background(), Request{Packet: newPacket(connID), IP: ip}, w)
+		require.Nil(t, err)
+	}
+	_, err = f.handleRequest(context.Background(), Request{Packet: newPacket(connID), IP: ip}, w)
+	require.ErrorIs(t, err, errScrapeRateLimited)
+
+	// new connection ID of the same address is limited too
+	connID = append([]byte(nil), gen.Generate(ip, timecache.Now())...)
+	_, err = f.handleRequest(context.Background(), Request{Packet: newPacket(connID), IP: ip}, w)
+	require.ErrorIs(t, err, errScrapeRateLimited)
+
+	// other address is not affected
+	otherConnID := append([]byte(nil), gen.Generate(netip.MustParseAddr("127.0.0.2"), timecache.Now())...)
+	_, err = f.handleRequest(context.Background(), Request{Packet: newPacket(otherConnID), IP: netip.MustParseAddr("127.0.0.2")}, w)
+	require.Nil(t, err)
+}
+
+func TestScrapeInfoHashesLimit(t *testing.T) {
+	cfg := Config{ParseOptions: frontend.ParseOptions{MaxScrapeInfoHashes: 1000}}.Validate()
+	require.Equal(t, uint32(maxScrapeInfoHashes), cfg.MaxScrapeInfoHashes)
+
+	ip := netip.MustParseAddr("127.0.0.1")
+	newPacket := func(n int) []byte {
+		packet := make([]byte, 16, 16+n*bittorrent.InfoHashV1Len)
+		for i := 0; i < n; i++ {
+			ih := make([]byte, bittorrent.InfoHashV1Len)
+			binary.BigEndian.PutUint32(ih, uint32(i))
+			packet = append(packet, ih...)
+		}
+		return packet
+	}
+
+	for _, n := range []int{maxScrapeInfoHashes - 1, maxScrapeInfoHashes, maxScrapeInfoHashes + 1} {
+		req, err := parseScrape(Request{Packet: newPacket(n), IP: ip}, cfg.ParseOptions)
+		require.Nil(t, err)
+		require.Len(t, req.InfoHashes, min(n, maxScrapeInfoHashes))
+
+		var buf bytes.Buffer
+		writeScrapeResponse(&buf, []byte{0, 0, 0, 1}, &bittorrent.ScrapeResponse{
+			Data: make([]bittorrent.Scrape, n),
+		}, 0)
+		require.Equal(t, 8+12*min(n, maxScrapeInfoHashes), buf.Len())
+	}
+}
+
+func TestAlignScrapes(t *testing.T) {
+	ih1, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	ih2, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	data := []bittorrent.Scrape{{InfoHash: ih2, Complete: 1}}
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: ih1}, {InfoHash: ih2, Complete: 1}},
+		alignScrapes(bittorrent.InfoHashes{ih1, ih2}, data))
+	require.Equal(t, data, alignScrapes(bittorrent.InfoHashes{ih2}, data))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"net/netip"
 	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
@@ -32,7 +33,9 @@ func writeErrorResponse(w io.Writer, txID []byte, err error) {
 // whether v6Peers is set.
 // If v6Action is set, the action will be 4, according to
 // https://web.archive.org/web/20170503181830/http://opentracker.blog.h3q.com/2007/12/28/the-ipv6-situation/
-func writeAnnounceResponse(w io.Writer, txID []byte, resp *bittorrent.AnnounceResponse, v6Action, v6Peers bool) {
+// Peers are written by provided PeerEncoder.
+// If extIP is valid, it is appended to the response as external IP trailer.
+func writeAnnounceResponse(w io.Writer, txID []byte, resp *bittorrent.AnnounceResponse, v6Action, v6Peers bool, enc PeerEncoder, extIP netip.Addr) {
 	buf := reqRespBufferPool.Get()
 	defer reqRespBufferPool.Put(buf)
 
@@ -50,29 +53,80 @@ func writeAnnounceResponse(w io.Writer, txID []byte, resp *bittorrent.AnnounceRe
 		peers = resp.IPv6Peers
 	}
 
-	for _, peer := range peers {
-		buf.Write(peer.Addr().AsSlice())
-		_ = binary.Write(buf, binary.BigEndian, peer.Port())
+	enc.EncodePeers(buf, peers)
+
+	if extIP.IsValid() {
+		writeExternalIP(buf, extIP)
 	}
 
 	_, _ = buf.WriteTo(w)
 }
 
+// writeExternalIP writes non-standard external IP trailer:
+// IP[4/16by] IPLength[1by] ExternalIPMarker[4by].
+// Trailer should be parsed from the end of datagram.
+func writeExternalIP(w io.Writer, ip netip.Addr) {
+	ip = ip.Unmap()
+	b := ip.AsSlice()
+	_, _ = w.Write(b)
+	_, _ = w.Write([]byte{byte(len(b))})
+	_, _ = io.WriteString(w, ExternalIPMarker)
+}
+
 // writeScrapeResponse encodes a scrape response according to BEP 15.
-func writeScrapeResponse(w io.Writer, txID []byte, resp *bittorrent.ScrapeResponse) {
+// If minInterval is positive, it is appended to the response as
+// scrape interval trailer.
+func writeScrapeResponse(w io.Writer, txID []byte, resp *bittorrent.ScrapeResponse, minInterval time.Duration) {
 	buf := reqRespBufferPool.Get()
 	defer reqRespBufferPool.Put(buf)
 
 	writeHeader(buf, txID, scrapeActionID)
 
-	for _, scrape := range resp.Data {
+	data := resp.Data
+	// response must fit into datagram,
+	// parseScrape clamps request the same way
+	if len(data) > maxScrapeInfoHashes {
+		data = data[:maxScrapeInfoHashes]
+	}
+	for _, scrape := range data {
 		_ = binary.Write(buf, binary.BigEndian, scrape.Complete)
 		_ = binary.Write(buf, binary.BigEndian, scrape.Snatches)
 		_ = binary.Write(buf, binary.BigEndian, scrape.Incomplete)
 	}
+	if minInterval > 0 {
+		writeScrapeInterval(buf, minInterval)
+	}
 	_, _ = buf.WriteTo(w)
 }
 
+// writeScrapeInterval writes non-standard scrape interval trailer:
+// Interval[4by, seconds] ScrapeIntervalMarker[4by].
+// Trailer is shorter than one scrape record, so clients, which read
+// only requested number of records, ignore it.
+func writeScrapeInterval(w io.Writer, interval time.Duration) {
+	_ = binary.Write(w, binary.BigEndian, uint32(interval/time.Second))
+	_, _ = io.WriteString(w, ScrapeIntervalMarker)
+}
+
+// alignScrapes returns scrapes in order of requested info hashes
+// and zeroes for info hashes omitted by middleware,
+// because UDP scrape response is positional.
+func alignScrapes(infoHashes bittorrent.InfoHashes, data []bittorrent.Scrape) []bittorrent.Scrape {
+	if len(data) == len(infoHashes) {
+		return data
+	}
+	scrapes := make(map[bittorrent.InfoHash]bittorrent.Scrape, len(data))
+	for _, s := range data {
+		scrapes[s.InfoHash] = s
+	}
+	aligned := make([]bittorrent.Scrape, len(infoHashes))
+	for i, ih := range infoHashes {
+		aligned[i] = scrapes[ih]
+		aligned[i].InfoHash = ih
+	}
+	return aligned
+}
+
 // writeConnectionID encodes a new connection response according to BEP 15.
 func writeConnectionID(w io.Writer, txID, connID []byte) {
 	buf := reqRespBufferPool.Get()
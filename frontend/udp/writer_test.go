@@ -0,0 +1,87 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// parseExternalIP parses external IP trailer from the end of announce response
+func parseExternalIP(b []byte) (ip netip.Addr, ok bool) {
+	if !bytes.HasSuffix(b, []byte(ExternalIPMarker)) {
+		return
+	}
+	b = b[:len(b)-len(ExternalIPMarker)]
+	if len(b) == 0 {
+		return
+	}
+	l := int(b[len(b)-1])
+	b = b[:len(b)-1]
+	if l > len(b) {
+		return
+	}
+	return netip.AddrFromSlice(b[len(b)-l:])
+}
+
+func TestExternalIPTrailer(t *testing.T) {
+	resp := &bittorrent.AnnounceResponse{
+		IPv4Peers: []bittorrent.Peer{{AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}},
+	}
+	txID := []byte{1, 2, 3, 4}
+	// header + one peer
+	const respLen = 20 + 6
+
+	var buf bytes.Buffer
+	writeAnnounceResponse(&buf, txID, resp, false, false, compactPeerEncoder{}, netip.Addr{})
+	require.Len(t, buf.Bytes(), respLen)
+	_, ok := parseExternalIP(buf.Bytes())
+	require.False(t, ok)
+
+	for _, s := range []string{"192.168.1.1", "::ffff:192.168.1.1", "2001:db8::1"} {
+		buf.Reset()
+		ip := netip.MustParseAddr(s)
+		writeAnnounceResponse(&buf, txID, resp, false, false, compactPeerEncoder{}, ip)
+		require.Equal(t, []byte{10, 0, 0, 1, 0x1A, 0xE1}, buf.Bytes()[20:respLen])
+		parsed, ok := parseExternalIP(buf.Bytes())
+		require.True(t, ok, s)
+		require.Equal(t, ip.Unmap(), parsed)
+		require.Len(t, buf.Bytes(), respLen+parsed.BitLen()/8+1+len(ExternalIPMarker))
+	}
+}
+
+// parseScrapeInterval parses scrape interval trailer from the end of scrape response
+func parseScrapeInterval(b []byte) (interval time.Duration, ok bool) {
+	if !bytes.HasSuffix(b, []byte(ScrapeIntervalMarker)) || len(b) < 8+len(ScrapeIntervalMarker)+4 {
+		return
+	}
+	b = b[:len(b)-len(ScrapeIntervalMarker)]
+	return time.Duration(binary.BigEndian.Uint32(b[len(b)-4:])) * time.Second, true
+}
+
+func TestScrapeIntervalTrailer(t *testing.T) {
+	resp := &bittorrent.ScrapeResponse{Data: []bittorrent.Scrape{{Complete: 1, Snatches: 2, Incomplete: 3}}}
+	txID := []byte{1, 2, 3, 4}
+	// header + one scrape
+	const respLen = 8 + 12
+
+	var buf bytes.Buffer
+	writeScrapeResponse(&buf, txID, resp, 0)
+	require.Len(t, buf.Bytes(), respLen)
+	_, ok := parseScrapeInterval(buf.Bytes())
+	require.False(t, ok)
+
+	buf.Reset()
+	writeScrapeResponse(&buf, txID, resp, 15*time.Minute+time.Millisecond)
+	require.Len(t, buf.Bytes(), respLen+4+len(ScrapeIntervalMarker))
+	// records are not affected
+	require.Equal(t, []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}, buf.Bytes()[8:respLen])
+	interval, ok := parseScrapeInterval(buf.Bytes())
+	require.True(t, ok)
+	require.Equal(t, 15*time.Minute, interval)
+}
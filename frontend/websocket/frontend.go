@@ -0,0 +1,710 @@
+// Package websocket implements a WebTorrent tracker frontend via the
+// WebSocket protocol. Swarm membership is maintained by middleware.Logic
+// like for other frontends, but in separate swarm namespace
+// (see middleware.SwarmNamespaceKey), so WebRTC peers are never returned
+// to BitTorrent clients. WebRTC offers and answers are relayed
+// between peers connected to this frontend.
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"path"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/pkg/tracing"
+)
+
+// Name - registered name of the frontend
+const Name = "websocket"
+
+var (
+	logger            = log.NewLogger("frontend/websocket")
+	errTLSNotProvided = errors.New("tls certificate/key not provided")
+	errTooManySwarms  = bittorrent.ClientError("too many swarms announced via connection")
+	errQueueFull      = errors.New("send queue is full")
+	errClientClosed   = errors.New("connection closed")
+)
+
+func init() {
+	frontend.RegisterBuilder(Name, NewFrontend)
+	middleware.RegisterSwarmNamespace(Name)
+}
+
+// Config represents all configurable options for a WebSocket (WebTorrent) Frontend
+type Config struct {
+	frontend.ListenOptions
+	UseTLS      bool   `cfg:"tls"`
+	TLSCertPath string `cfg:"tls_cert_path"`
+	TLSKeyPath  string `cfg:"tls_key_path"`
+	// ReadTimeout is the maximum duration of opening handshake
+	ReadTimeout time.Duration `cfg:"read_timeout"`
+	// WriteTimeout is the maximum duration of sending one message
+	WriteTimeout time.Duration `cfg:"write_timeout"`
+	// IdleTimeout is the maximum duration between two messages
+	// from client, connection is closed if exceeded
+	IdleTimeout time.Duration `cfg:"idle_timeout"`
+	// Routes are url paths to accept WebSocket connections
+	Routes []string `cfg:"routes"`
+	// MaxMessageSize is the maximum size of message received from client
+	MaxMessageSize int64 `cfg:"max_message_size"`
+	// MaxOffers is the maximum number of offers relayed per one announce
+	MaxOffers uint32 `cfg:"max_offers"`
+	// OfferTTL is the duration during which offer can be answered
+	OfferTTL time.Duration `cfg:"offer_ttl"`
+	// MaxSwarms is the maximum number of swarms, in which
+	// client may announce via one connection
+	MaxSwarms uint32 `cfg:"max_swarms"`
+	// SendQueueSize is the maximum number of messages waiting
+	// to be sent to client, new messages are dropped if exceeded
+	SendQueueSize uint32 `cfg:"send_queue_size"`
+	frontend.ParseOptions
+}
+
+const (
+	defaultReadTimeout    = 2 * time.Second
+	defaultWriteTimeout   = 2 * time.Second
+	defaultIdleTimeout    = 5 * time.Minute
+	defaultMaxMessageSize = 64 << 10
+	defaultMaxOffers      = 10
+	defaultOfferTTL       = 50 * time.Second
+	defaultMaxSwarms      = 100
+	defaultSendQueueSize  = 64
+)
+
+// DefaultRoutes are the default url paths to accept
+// WebSocket connections if nothing else provided
+var DefaultRoutes = []string{"/", "/announce"}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	validCfg.ListenOptions = cfg.ListenOptions.Validate(logger)
+	if cfg.UseTLS && (len(cfg.TLSCertPath) == 0 || len(cfg.TLSKeyPath) == 0) {
+		err = errTLSNotProvided
+		return
+	}
+
+	if cfg.ReadTimeout <= 0 {
+		validCfg.ReadTimeout = defaultReadTimeout
+		logger.Warn().
+			Str("name", "ReadTimeout").
+			Dur("provided", cfg.ReadTimeout).
+			Dur("default", validCfg.ReadTimeout).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.WriteTimeout <= 0 {
+		validCfg.WriteTimeout = defaultWriteTimeout
+		logger.Warn().
+			Str("name", "WriteTimeout").
+			Dur("provided", cfg.WriteTimeout).
+			Dur("default", validCfg.WriteTimeout).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		validCfg.IdleTimeout = defaultIdleTimeout
+		logger.Warn().
+			Str("name", "IdleTimeout").
+			Dur("provided", cfg.IdleTimeout).
+			Dur("default", validCfg.IdleTimeout).
+			Msg("falling back to default configuration")
+	}
+
+	if len(cfg.Routes) == 0 {
+		validCfg.Routes = DefaultRoutes
+		logger.Warn().
+			Str("name", "Routes").
+			Strs("provided", cfg.Routes).
+			Strs("default", validCfg.Routes).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.MaxMessageSize <= 0 {
+		validCfg.MaxMessageSize = defaultMaxMessageSize
+		logger.Warn().
+			Str("name", "MaxMessageSize").
+			Int64("provided", cfg.MaxMessageSize).
+			Int64("default", validCfg.MaxMessageSize).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.MaxOffers == 0 {
+		validCfg.MaxOffers = defaultMaxOffers
+		logger.Warn().
+			Str("name", "MaxOffers").
+			Uint32("provided", cfg.MaxOffers).
+			Uint32("default", validCfg.MaxOffers).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.OfferTTL <= 0 {
+		validCfg.OfferTTL = defaultOfferTTL
+		logger.Warn().
+			Str("name", "OfferTTL").
+			Dur("provided", cfg.OfferTTL).
+			Dur("default", validCfg.OfferTTL).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.MaxSwarms == 0 {
+		validCfg.MaxSwarms = defaultMaxSwarms
+		logger.Warn().
+			Str("name", "MaxSwarms").
+			Uint32("provided", cfg.MaxSwarms).
+			Uint32("default", validCfg.MaxSwarms).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.SendQueueSize == 0 {
+		validCfg.SendQueueSize = defaultSendQueueSize
+		logger.Warn().
+			Str("name", "SendQueueSize").
+			Uint32("provided", cfg.SendQueueSize).
+			Uint32("default", validCfg.SendQueueSize).
+			Msg("falling back to default configuration")
+	}
+
+	validCfg.ParseOptions = cfg.ParseOptions.Validate(logger)
+	return
+}
+
+// client is the connection of WebTorrent client
+type client struct {
+	conn         *ws.Conn
+	addr         netip.AddrPort
+	writeTimeout time.Duration
+	// messages are queued from reading goroutines of other
+	// clients too and written by writer goroutine, so slow
+	// client does not block others
+	queue   chan []byte
+	closed  chan struct{}
+	written chan struct{}
+	// peer IDs announced by client in swarms,
+	// accessed only from connection reading goroutine
+	swarms map[bittorrent.InfoHash]bittorrent.PeerID
+}
+
+func newClient(conn *ws.Conn, addr netip.AddrPort, writeTimeout time.Duration, queueSize int) *client {
+	return &client{
+		conn:         conn,
+		addr:         addr,
+		writeTimeout: writeTimeout,
+		queue:        make(chan []byte, queueSize),
+		closed:       make(chan struct{}),
+		written:      make(chan struct{}),
+		swarms:       make(map[bittorrent.InfoHash]bittorrent.PeerID),
+	}
+}
+
+// send queues message to client without blocking.
+// Message is dropped if queue is full.
+func (c *client) send(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.closed:
+		return errClientClosed
+	default:
+	}
+	select {
+	case c.queue <- b:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// writeLoop writes queued messages until client closed.
+// Connection is closed if write fails, so reading goroutine
+// stops too.
+func (c *client) writeLoop() {
+	defer close(c.written)
+	for {
+		select {
+		case <-c.closed:
+			return
+		case b := <-c.queue:
+			err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if err == nil {
+				err = c.conn.WriteMessage(ws.TextMessage, b)
+			}
+			if err != nil {
+				logger.Debug().Err(err).Stringer("remoteAddr", c.addr).Msg("unable to send message")
+				_ = c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// close stops writer goroutine and closes connection
+func (c *client) close() {
+	close(c.closed)
+	<-c.written
+	_ = c.conn.Close()
+}
+
+type wsFE struct {
+	srv            *http.Server
+	upgrader       ws.Upgrader
+	logic          *middleware.Logic
+	relay          *relay
+	routes         map[string]struct{}
+	collectTimings bool
+	idleTimeout    time.Duration
+	writeTimeout   time.Duration
+	maxMessageSize int64
+	maxOffers      int
+	maxSwarms      int
+	sendQueueSize  int
+	clientsMu      sync.Mutex
+	clients        map[*client]struct{}
+	closed         bool
+	wg             sync.WaitGroup
+	onceCloser     sync.Once
+	frontend.ParseOptions
+}
+
+// NewFrontend builds and starts websocket bittorrent frontend from provided configuration
+func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend, error) {
+	var cfg Config
+	var err error
+	if err = c.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	f := newWSFE(cfg, logic)
+
+	if cfg.UseTLS {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath); err != nil {
+			return nil, err
+		}
+		f.srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	go runServer(f.srv, &cfg)
+
+	return f, nil
+}
+
+// newWSFE creates frontend, but does not start server
+func newWSFE(cfg Config, logic *middleware.Logic) *wsFE {
+	f := &wsFE{
+		logic:          logic,
+		relay:          newRelay(int64(cfg.OfferTTL)),
+		routes:         make(map[string]struct{}, len(cfg.Routes)),
+		collectTimings: cfg.EnableRequestTiming,
+		idleTimeout:    cfg.IdleTimeout,
+		writeTimeout:   cfg.WriteTimeout,
+		maxMessageSize: cfg.MaxMessageSize,
+		maxOffers:      int(cfg.MaxOffers),
+		maxSwarms:      int(cfg.MaxSwarms),
+		sendQueueSize:  int(cfg.SendQueueSize),
+		clients:        make(map[*client]struct{}),
+		ParseOptions:   cfg.ParseOptions,
+	}
+	for _, route := range cfg.Routes {
+		route = path.Clean(route)
+		if !path.IsAbs(route) {
+			route = "/" + route
+		}
+		f.routes[route] = struct{}{}
+	}
+	f.upgrader = ws.Upgrader{
+		HandshakeTimeout: cfg.ReadTimeout,
+		// WebTorrent clients are web pages of any origin
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	f.srv = &http.Server{
+		Handler:           f,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+	}
+	return f
+}
+
+func runServer(s *http.Server, cfg *Config) {
+	logger.Debug().Str("addr", cfg.Addr).Msg("starting listener")
+	ln, err := cfg.ListenTCP()
+	if err == nil {
+		if s.TLSConfig == nil {
+			err = s.Serve(ln)
+		} else {
+			err = s.ServeTLS(ln, "", "")
+		}
+	}
+	if err == nil || errors.Is(err, http.ErrServerClosed) {
+		logger.Info().Str("addr", cfg.Addr).Msg("listener stopped")
+	} else {
+		logger.Fatal().Str("addr", cfg.Addr).Err(err).Msg("listener failed")
+	}
+}
+
+// Close provides a thread-safe way to shut down a currently running Frontend.
+// All WebSocket connections are closed.
+func (f *wsFE) Close() (err error) {
+	f.onceCloser.Do(func() {
+		err = f.srv.Close()
+		f.clientsMu.Lock()
+		f.closed = true
+		for c := range f.clients {
+			_ = c.conn.Close()
+		}
+		f.clientsMu.Unlock()
+		f.wg.Wait()
+	})
+	return
+}
+
+func (f *wsFE) register(c *client) bool {
+	f.clientsMu.Lock()
+	defer f.clientsMu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.clients[c] = struct{}{}
+	f.wg.Add(1)
+	return true
+}
+
+// unregister closes connection and removes client from all swarms,
+// in which it announced, as if client sent stopped event
+func (f *wsFE) unregister(c *client) {
+	defer f.wg.Done()
+	f.clientsMu.Lock()
+	delete(f.clients, c)
+	f.clientsMu.Unlock()
+	c.close()
+	for ih, id := range c.swarms {
+		f.relay.leave(ih, id, c)
+		req := &bittorrent.AnnounceRequest{
+			Event:         bittorrent.Stopped,
+			EventProvided: true,
+			InfoHash:      ih,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               id,
+				Port:             c.addr.Port(),
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: c.addr.Addr()}},
+			},
+		}
+		f.logic.AfterAnnounceAsync(requestContext(context.Background()), req, &bittorrent.AnnounceResponse{})
+	}
+}
+
+// ServeHTTP upgrades HTTP connection to WebSocket
+// and handles messages until connection closed
+func (f *wsFE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, found := f.routes[path.Clean(r.URL.Path)]; !found {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Debug().Err(err).Str("remoteAddr", r.RemoteAddr).Msg("unable to upgrade connection")
+		return
+	}
+	conn.SetReadLimit(f.maxMessageSize)
+	addrPort, _ := netip.ParseAddrPort(r.RemoteAddr)
+	c := newClient(conn, netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), f.writeTimeout, f.sendQueueSize)
+	if !f.register(c) {
+		_ = conn.Close()
+		return
+	}
+	go c.writeLoop()
+	defer f.unregister(c)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(f.idleTimeout))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			logger.Debug().Err(err).Stringer("remoteAddr", c.addr).Msg("connection closed")
+			return
+		}
+		f.handleMessage(c, data)
+	}
+}
+
+// requestContext returns context for middleware.Logic, peers
+// of this frontend are stored in separate swarm namespace
+func requestContext(ctx context.Context) context.Context {
+	ctx = bittorrent.InjectFrontendToContext(bittorrent.InjectRouteParamsToContext(ctx, bittorrent.RouteParams{}), Name)
+	return context.WithValue(ctx, middleware.SwarmNamespaceKey, Name)
+}
+
+func (f *wsFE) handleMessage(c *client, data []byte) {
+	var req request
+	var err error
+	var start time.Time
+	if f.collectTimings && metrics.Enabled() {
+		start = time.Now()
+		defer func() {
+			recordResponseDuration(req.Action, c.addr.Addr(), err, time.Since(start))
+		}()
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		logger.Debug().Err(err).Stringer("remoteAddr", c.addr).Msg("unable to decode message")
+		err = errUnknownAction
+		f.sendError(c, "", "", err)
+		return
+	}
+	switch req.Action {
+	case actionAnnounce:
+		err = f.handleAnnounce(c, &req)
+	case actionScrape:
+		err = f.handleScrape(c, &req)
+	default:
+		err = errUnknownAction
+		f.sendError(c, "", "", err)
+	}
+}
+
+func (f *wsFE) sendError(c *client, action string, infoHash binaryString, err error) {
+	message := "mochi internal error"
+	var clientErr bittorrent.ClientError
+	if errors.As(err, &clientErr) {
+		message = clientErr.Error()
+	} else {
+		logger.Error().Err(err).Msg("internal error")
+	}
+	if err := c.send(failureResponse{Action: action, InfoHash: infoHash, FailureReason: message}); err != nil {
+		logger.Debug().Err(err).Stringer("remoteAddr", c.addr).Msg("unable to send message")
+	}
+}
+
+// parseAnnounce converts announce message into bittorrent.AnnounceRequest.
+// Address and port of connection are used as address and port of peer.
+// Peers are not returned to WebTorrent clients, so NumWant is always 0.
+func (f *wsFE) parseAnnounce(c *client, msg *request) (req *bittorrent.AnnounceRequest, ihStr binaryString, err error) {
+	infoHashes, err := msg.infoHashes()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(infoHashes) != 1 {
+		return nil, "", errNoInfoHash
+	}
+	ihStr = infoHashes[0]
+	req = &bittorrent.AnnounceRequest{
+		Uploaded:        toUint(msg.Uploaded),
+		Downloaded:      toUint(msg.Downloaded),
+		NumWantProvided: true,
+		// size of torrent may be unknown
+		Left: bittorrent.UnknownLeft,
+		RequestPeer: bittorrent.RequestPeer{
+			Port: c.addr.Port(),
+		},
+	}
+	if msg.Left != nil {
+		req.Left = toUint(*msg.Left)
+	}
+	if req.InfoHash, err = bittorrent.NewInfoHash([]byte(ihStr)); err != nil {
+		return nil, ihStr, errInvalidInfoHash
+	}
+	if err = f.CheckInfoHash(req.InfoHash); err != nil {
+		return nil, ihStr, err
+	}
+	if req.ID, err = bittorrent.NewPeerID([]byte(msg.PeerID)); err != nil {
+		return nil, ihStr, errInvalidPeerID
+	}
+	// WebTorrent clients send `update` event for regular announces
+	if req.EventProvided = len(msg.Event) > 0 && msg.Event != "update"; req.EventProvided {
+		if req.Event, err = bittorrent.NewEvent(msg.Event); err != nil {
+			return nil, ihStr, err
+		}
+	}
+	req.RequestAddresses.Add(bittorrent.RequestAddress{Addr: c.addr.Addr()})
+	if f.RejectZonedIPs && req.HasZone() {
+		return nil, ihStr, bittorrent.ErrZonedIP
+	}
+	if err = bittorrent.SanitizeAnnounce(req, f.MaxNumWant, f.DefaultNumWant, f.FilterPrivateIPs); err != nil {
+		return nil, ihStr, err
+	}
+	return req, ihStr, nil
+}
+
+// handleAnnounce processes announce message. Messages with answer are
+// only relayed to peer, which sent offer. Other messages are processed
+// by middleware.Logic and offers, if any, are relayed to other peers
+// of swarm connected to this frontend.
+func (f *wsFE) handleAnnounce(c *client, msg *request) (err error) {
+	const actionName = actionAnnounce
+	spanCtx, span := tracing.Start(context.Background(), actionName, tracing.AttrFrontend.String(Name), tracing.AttrAction.String(actionName))
+	defer func() { tracing.End(span, err) }()
+
+	req, ihStr, err := f.parseAnnounce(c, msg)
+	if err != nil {
+		f.sendError(c, actionName, ihStr, err)
+		return
+	}
+
+	if len(msg.Answer) > 0 {
+		return f.relayAnswer(c, req, ihStr, msg)
+	}
+
+	if _, found := c.swarms[req.InfoHash]; !found && req.Event != bittorrent.Stopped && len(c.swarms) >= f.maxSwarms {
+		err = errTooManySwarms
+		f.sendError(c, actionName, ihStr, err)
+		return
+	}
+
+	ctx, resp, err := f.logic.HandleAnnounce(requestContext(spanCtx), req)
+	if err != nil {
+		f.sendError(c, actionName, ihStr, err)
+		return
+	}
+
+	if err = c.send(announceResponse{
+		Action:         actionName,
+		InfoHash:       ihStr,
+		Interval:       int64(resp.Interval / time.Second),
+		MinInterval:    int64(resp.MinInterval / time.Second),
+		Complete:       resp.Complete,
+		Incomplete:     resp.Incomplete,
+		WarningMessage: resp.WarningMessage,
+	}); err != nil {
+		return
+	}
+	if tracing.Enabled() {
+		span.SetAttributes(tracing.InfoHash(req.InfoHash))
+	}
+	ctx = tracing.Remap(spanCtx, bittorrent.RemapRouteParamsToBgContext(ctx))
+	f.logic.AfterAnnounceAsync(ctx, req, resp)
+
+	if req.Event == bittorrent.Stopped {
+		f.relay.leave(req.InfoHash, req.ID, c)
+		delete(c.swarms, req.InfoHash)
+		return
+	}
+	if prevID, found := c.swarms[req.InfoHash]; found && prevID != req.ID {
+		f.relay.leave(req.InfoHash, prevID, c)
+	}
+	c.swarms[req.InfoHash] = req.ID
+	f.relay.join(req.InfoHash, req.ID, c)
+
+	f.relayOffers(c, req, ihStr, msg.Offers)
+	return
+}
+
+// relayOffers sends offers to random peers of swarm
+func (f *wsFE) relayOffers(c *client, req *bittorrent.AnnounceRequest, ihStr binaryString, offers []offer) {
+	n := min(len(offers), f.maxOffers)
+	now := timecache.NowUnixNano()
+	for i, target := range f.relay.targets(req.InfoHash, req.ID, n) {
+		o := offers[i]
+		if len(o.OfferID) == 0 || len(o.Offer) == 0 {
+			continue
+		}
+		f.relay.addOffer(req.InfoHash, o.OfferID, req.ID, target.id, c, now)
+		if err := target.c.send(relayMessage{
+			Action:   actionAnnounce,
+			InfoHash: ihStr,
+			PeerID:   binaryString(req.ID.RawString()),
+			OfferID:  o.OfferID,
+			Offer:    o.Offer,
+		}); err != nil {
+			logger.Debug().Err(err).Stringer("remoteAddr", target.c.addr).Msg("unable to relay offer")
+		}
+	}
+}
+
+// relayAnswer sends answer to peer, which sent the offer
+func (f *wsFE) relayAnswer(c *client, req *bittorrent.AnnounceRequest, ihStr binaryString, msg *request) error {
+	toID, err := bittorrent.NewPeerID([]byte(msg.ToPeerID))
+	if err != nil {
+		f.sendError(c, actionAnnounce, ihStr, errInvalidPeerID)
+		return errInvalidPeerID
+	}
+	// answer may be sent only by peer, which received the offer
+	if id, found := c.swarms[req.InfoHash]; !found || id != req.ID {
+		f.sendError(c, actionAnnounce, ihStr, errUnknownOffer)
+		return errUnknownOffer
+	}
+	target, found := f.relay.takeOffer(req.InfoHash, msg.OfferID, toID, req.ID, timecache.NowUnixNano())
+	if !found {
+		f.sendError(c, actionAnnounce, ihStr, errUnknownOffer)
+		return errUnknownOffer
+	}
+	if err = target.send(relayMessage{
+		Action:   actionAnnounce,
+		InfoHash: ihStr,
+		PeerID:   binaryString(req.ID.RawString()),
+		OfferID:  msg.OfferID,
+		Answer:   msg.Answer,
+	}); err != nil {
+		logger.Debug().Err(err).Stringer("remoteAddr", target.addr).Msg("unable to relay answer")
+	}
+	return nil
+}
+
+func (f *wsFE) handleScrape(c *client, msg *request) (err error) {
+	const actionName = actionScrape
+	spanCtx, span := tracing.Start(context.Background(), actionName, tracing.AttrFrontend.String(Name), tracing.AttrAction.String(actionName))
+	defer func() { tracing.End(span, err) }()
+
+	infoHashes, err := msg.infoHashes()
+	if err != nil {
+		f.sendError(c, actionName, "", err)
+		return
+	}
+	req := &bittorrent.ScrapeRequest{InfoHashes: make(bittorrent.InfoHashes, 0, len(infoHashes))}
+	for _, ihStr := range infoHashes {
+		ih, err := bittorrent.NewInfoHash([]byte(ihStr))
+		if err == nil {
+			err = f.CheckInfoHash(ih)
+		}
+		if err != nil {
+			f.sendError(c, actionName, ihStr, errInvalidInfoHash)
+			return errInvalidInfoHash
+		}
+		req.InfoHashes = append(req.InfoHashes, ih)
+	}
+	req.RequestAddresses.Add(bittorrent.RequestAddress{Addr: c.addr.Addr()})
+	if err = bittorrent.SanitizeScrape(req, f.MaxScrapeInfoHashes, f.FilterPrivateIPs); err != nil {
+		f.sendError(c, actionName, "", err)
+		return
+	}
+
+	ctx, resp, err := f.logic.HandleScrape(requestContext(spanCtx), req)
+	if err != nil {
+		f.sendError(c, actionName, "", err)
+		return
+	}
+	files := make(map[string]scrapeFile, len(resp.Data))
+	for _, s := range resp.Data {
+		files[binaryString(s.InfoHash.RawString()).String()] = scrapeFile{
+			Complete:   s.Complete,
+			Incomplete: s.Incomplete,
+			Downloaded: s.Snatches,
+		}
+	}
+	if err = c.send(scrapeResponse{Action: actionName, Files: files}); err == nil {
+		ctx = tracing.Remap(spanCtx, bittorrent.RemapRouteParamsToBgContext(ctx))
+		f.logic.AfterScrapeAsync(ctx, req, resp)
+	}
+	return
+}
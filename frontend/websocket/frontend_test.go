@@ -0,0 +1,211 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func newTestFrontend(t *testing.T, c conf.MapConfig) (string, *middleware.Logic) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+
+	var cfg Config
+	require.Nil(t, c.Unmarshal(&cfg))
+	cfg, err = cfg.Validate()
+	require.Nil(t, err)
+	logic := middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil)
+	f := newWSFE(cfg, logic)
+	srv := httptest.NewServer(f)
+	t.Cleanup(func() {
+		srv.Close()
+		_ = f.Close()
+		_ = logic.Close()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/announce", logic
+}
+
+func dial(t *testing.T, u string) *ws.Conn {
+	c, resp, err := ws.DefaultDialer.Dial(u, nil)
+	require.Nil(t, err)
+	_ = resp.Body.Close()
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func send(t *testing.T, c *ws.Conn, msg map[string]any) {
+	b, err := json.Marshal(msg)
+	require.Nil(t, err)
+	require.Nil(t, c.WriteMessage(ws.TextMessage, b))
+}
+
+func receive(t *testing.T, c *ws.Conn) map[string]any {
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	mt, b, err := c.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, ws.TextMessage, mt)
+	var msg map[string]any
+	require.Nil(t, json.Unmarshal(b, &msg))
+	return msg
+}
+
+func TestAnnounceRelay(t *testing.T) {
+	u, logic := newTestFrontend(t, conf.MapConfig{})
+	infoHash := string([]byte{0xff, 0xfe, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17})
+	ihStr := binaryString(infoHash).String()
+	peer1, peer2 := strings.Repeat("1", bittorrent.PeerIDLen), strings.Repeat("2", bittorrent.PeerIDLen)
+
+	c1, c2 := dial(t, u), dial(t, u)
+	send(t, c1, map[string]any{
+		"action":     actionAnnounce,
+		"info_hash":  ihStr,
+		"peer_id":    peer1,
+		"event":      bittorrent.StartedStr,
+		"numwant":    5,
+		"uploaded":   0,
+		"downloaded": 0,
+		"left":       0,
+		"offers":     []any{},
+	})
+	resp := receive(t, c1)
+	require.Equal(t, actionAnnounce, resp["action"])
+	require.Equal(t, ihStr, resp["info_hash"])
+	require.Equal(t, float64(60), resp["interval"])
+
+	offer := map[string]any{"type": "offer", "sdp": "offer-sdp"}
+	send(t, c2, map[string]any{
+		"action":     actionAnnounce,
+		"info_hash":  ihStr,
+		"peer_id":    peer2,
+		"event":      bittorrent.StartedStr,
+		"numwant":    5,
+		"uploaded":   0,
+		"downloaded": 0,
+		"left":       nil,
+		"offers":     []any{map[string]any{"offer_id": "offer1", "offer": offer}},
+	})
+	resp = receive(t, c2)
+	require.Equal(t, actionAnnounce, resp["action"])
+	require.Nil(t, resp["failure reason"])
+
+	// offer relayed to first peer
+	resp = receive(t, c1)
+	require.Equal(t, ihStr, resp["info_hash"])
+	require.Equal(t, peer2, resp["peer_id"])
+	require.Equal(t, "offer1", resp["offer_id"])
+	require.Equal(t, offer, resp["offer"])
+
+	answer := map[string]any{"type": "answer", "sdp": "answer-sdp"}
+	answerMsg := map[string]any{
+		"action":     actionAnnounce,
+		"info_hash":  ihStr,
+		"peer_id":    peer1,
+		"to_peer_id": peer2,
+		"offer_id":   "offer1",
+		"answer":     answer,
+	}
+	send(t, c1, answerMsg)
+	resp = receive(t, c2)
+	require.Equal(t, peer1, resp["peer_id"])
+	require.Equal(t, "offer1", resp["offer_id"])
+	require.Equal(t, answer, resp["answer"])
+
+	// offer can be answered only once
+	send(t, c1, answerMsg)
+	resp = receive(t, c1)
+	require.Equal(t, errUnknownOffer.Error(), resp["failure reason"])
+
+	// peers are stored in background
+	expected := map[string]any{
+		ihStr: map[string]any{"complete": float64(1), "incomplete": float64(1), "downloaded": float64(0)},
+	}
+	require.Eventually(t, func() bool {
+		send(t, c1, map[string]any{"action": actionScrape, "info_hash": []string{ihStr}})
+		resp = receive(t, c1)
+		return resp["action"] == actionScrape && reflect.DeepEqual(expected, resp["files"])
+	}, time.Second, 10*time.Millisecond)
+
+	// WebRTC peers are not returned to BitTorrent clients
+	ih, err := bittorrent.NewInfoHash([]byte(infoHash))
+	require.Nil(t, err)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		NumWant:  10,
+		Left:     1,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{3},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+		},
+	}
+	ctx := bittorrent.InjectRouteParamsToContext(context.Background(), bittorrent.RouteParams{})
+	_, announceResp, err := logic.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Zero(t, announceResp.Complete)
+	require.Equal(t, req.Peers(), announceResp.IPv4Peers)
+}
+
+func TestMaxSwarms(t *testing.T) {
+	u, _ := newTestFrontend(t, conf.MapConfig{"max_swarms": 1})
+	c := dial(t, u)
+	announce := func(infoHash string, event string) map[string]any {
+		send(t, c, map[string]any{
+			"action":    actionAnnounce,
+			"info_hash": infoHash,
+			"peer_id":   strings.Repeat("1", bittorrent.PeerIDLen),
+			"event":     event,
+			"left":      0,
+		})
+		return receive(t, c)
+	}
+	ih1, ih2 := strings.Repeat("a", bittorrent.InfoHashV1Len), strings.Repeat("b", bittorrent.InfoHashV1Len)
+	require.Nil(t, announce(ih1, bittorrent.StartedStr)["failure reason"])
+	// announce in the same swarm is allowed
+	require.Nil(t, announce(ih1, "update")["failure reason"])
+	require.Equal(t, errTooManySwarms.Error(), announce(ih2, bittorrent.StartedStr)["failure reason"])
+	require.Nil(t, announce(ih1, bittorrent.StoppedStr)["failure reason"])
+	require.Nil(t, announce(ih2, bittorrent.StartedStr)["failure reason"])
+}
+
+func TestInvalidMessages(t *testing.T) {
+	u, _ := newTestFrontend(t, conf.MapConfig{})
+	c := dial(t, u)
+	for _, tt := range []struct {
+		msg    string
+		reason string
+	}{
+		{`not json`, errUnknownAction.Error()},
+		{`{"action":"unknown"}`, errUnknownAction.Error()},
+		{`{"action":"announce","peer_id":"` + strings.Repeat("1", bittorrent.PeerIDLen) + `"}`, errNoInfoHash.Error()},
+		{`{"action":"announce","info_hash":"short"}`, errInvalidInfoHash.Error()},
+		{`{"action":"announce","info_hash":"` + strings.Repeat("a", bittorrent.InfoHashV1Len) + `","peer_id":"short"}`, errInvalidPeerID.Error()},
+		{`{"action":"scrape","info_hash":"Ā"}`, errInvalidInfoHash.Error()},
+	} {
+		require.Nil(t, c.WriteMessage(ws.TextMessage, []byte(tt.msg)))
+		resp := receive(t, c)
+		require.Equal(t, tt.reason, resp["failure reason"], tt.msg)
+	}
+}
+
+func TestClientSendQueue(t *testing.T) {
+	c := newClient(nil, netip.AddrPort{}, time.Second, 1)
+	require.Nil(t, c.send(announceResponse{Action: actionAnnounce}))
+	// slow client does not block sender, message is dropped
+	require.ErrorIs(t, c.send(announceResponse{Action: actionAnnounce}), errQueueFull)
+	close(c.closed)
+	require.ErrorIs(t, c.send(announceResponse{Action: actionAnnounce}), errClientClosed)
+}
@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// Possible values of message action
+const (
+	actionAnnounce = "announce"
+	actionScrape   = "scrape"
+)
+
+var (
+	errInvalidBinaryString = errors.New("invalid binary string")
+	errUnknownAction       = bittorrent.ClientError("unknown action")
+	errNoInfoHash          = bittorrent.ClientError("no info hash supplied")
+	errInvalidInfoHash     = bittorrent.ClientError("info hash invalid")
+	errInvalidPeerID       = bittorrent.ClientError("peer ID invalid or not provided")
+	errUnknownOffer        = bittorrent.ClientError("unknown offer")
+)
+
+// binaryString is the string, every character of which represents
+// one byte (JavaScript "binary string"). WebTorrent clients
+// send raw info hashes and peer IDs in such form.
+type binaryString string
+
+// MarshalJSON encodes bytes as characters with the same code points
+func (s binaryString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// String returns UTF-8 representation of binary string
+func (s binaryString) String() string {
+	rs := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		rs[i] = rune(s[i])
+	}
+	return string(rs)
+}
+
+// UnmarshalJSON decodes characters as bytes, code points must not exceed 0xFF
+func (s *binaryString) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	b := make([]byte, 0, len(str))
+	for _, r := range str {
+		if r > math.MaxUint8 {
+			return errInvalidBinaryString
+		}
+		b = append(b, byte(r))
+	}
+	*s = binaryString(b)
+	return nil
+}
+
+// offer is the WebRTC offer, which should be relayed to other peer
+type offer struct {
+	Offer   json.RawMessage `json:"offer"`
+	OfferID binaryString    `json:"offer_id"`
+}
+
+// request is the message sent by WebTorrent client.
+// Announce may contain offers for other peers or answer to
+// the offer of other peer, scrape may contain single info hash
+// or array of info hashes.
+type request struct {
+	Action     string          `json:"action"`
+	InfoHash   json.RawMessage `json:"info_hash"`
+	PeerID     binaryString    `json:"peer_id"`
+	Event      string          `json:"event"`
+	NumWant    *float64        `json:"numwant"`
+	Uploaded   float64         `json:"uploaded"`
+	Downloaded float64         `json:"downloaded"`
+	// Left may be null if client does not know torrent size yet
+	Left     *float64        `json:"left"`
+	Offers   []offer         `json:"offers"`
+	Answer   json.RawMessage `json:"answer"`
+	OfferID  binaryString    `json:"offer_id"`
+	ToPeerID binaryString    `json:"to_peer_id"`
+}
+
+// infoHashes decodes info_hash field, which may be string or array of strings
+func (r request) infoHashes() (infoHashes []binaryString, err error) {
+	if len(r.InfoHash) == 0 || string(r.InfoHash) == "null" {
+		return nil, errNoInfoHash
+	}
+	if r.InfoHash[0] == '[' {
+		err = json.Unmarshal(r.InfoHash, &infoHashes)
+	} else {
+		var ih binaryString
+		if err = json.Unmarshal(r.InfoHash, &ih); err == nil {
+			infoHashes = []binaryString{ih}
+		}
+	}
+	if err != nil {
+		err = errInvalidInfoHash
+	}
+	return
+}
+
+// toUint converts JavaScript number to unsigned integer
+func toUint(f float64) uint64 {
+	switch {
+	case f <= 0 || math.IsNaN(f):
+		return 0
+	case f >= math.MaxUint64:
+		return math.MaxUint64
+	default:
+		return uint64(f)
+	}
+}
+
+type announceResponse struct {
+	Action         string       `json:"action"`
+	InfoHash       binaryString `json:"info_hash"`
+	Interval       int64        `json:"interval"`
+	MinInterval    int64        `json:"min interval,omitempty"`
+	Complete       uint32       `json:"complete"`
+	Incomplete     uint32       `json:"incomplete"`
+	WarningMessage string       `json:"warning message,omitempty"`
+}
+
+// relayMessage is the offer or answer relayed to other peer,
+// PeerID is the ID of peer, which sent offer or answer
+type relayMessage struct {
+	Action   string          `json:"action"`
+	InfoHash binaryString    `json:"info_hash"`
+	PeerID   binaryString    `json:"peer_id"`
+	OfferID  binaryString    `json:"offer_id"`
+	Offer    json.RawMessage `json:"offer,omitempty"`
+	Answer   json.RawMessage `json:"answer,omitempty"`
+}
+
+type scrapeFile struct {
+	Complete   uint32 `json:"complete"`
+	Incomplete uint32 `json:"incomplete"`
+	Downloaded uint32 `json:"downloaded"`
+}
+
+type scrapeResponse struct {
+	Action string `json:"action"`
+	// keys are binary strings converted with binaryString.String
+	Files map[string]scrapeFile `json:"files"`
+}
+
+type failureResponse struct {
+	Action        string       `json:"action,omitempty"`
+	InfoHash      binaryString `json:"info_hash,omitempty"`
+	FailureReason string       `json:"failure reason"`
+}
@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"sync"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// swarmPeer is the peer connected to this frontend
+type swarmPeer struct {
+	id bittorrent.PeerID
+	c  *client
+}
+
+// pendingOffer is the offer relayed to peer, which
+// is waiting for answer until expiration time
+type pendingOffer struct {
+	infoHash bittorrent.InfoHash
+	from     bittorrent.PeerID
+	c        *client
+	expires  int64
+}
+
+// relay holds short-lived state required to exchange WebRTC signaling
+// messages: peers currently connected to this frontend and offers
+// waiting for answers.
+// Data is process-local and not shared between tracker instances.
+type relay struct {
+	sync.Mutex
+	swarms    map[bittorrent.InfoHash]map[bittorrent.PeerID]*client
+	offers    map[string]pendingOffer
+	offerTTL  int64
+	nextClean int64
+}
+
+func newRelay(offerTTL int64) *relay {
+	return &relay{
+		swarms:   make(map[bittorrent.InfoHash]map[bittorrent.PeerID]*client),
+		offers:   make(map[string]pendingOffer),
+		offerTTL: offerTTL,
+	}
+}
+
+// join registers connection of peer in swarm.
+// If peer with the same ID connected via other socket,
+// it is replaced.
+func (r *relay) join(ih bittorrent.InfoHash, id bittorrent.PeerID, c *client) {
+	r.Lock()
+	defer r.Unlock()
+	swarm := r.swarms[ih]
+	if swarm == nil {
+		swarm = make(map[bittorrent.PeerID]*client)
+		r.swarms[ih] = swarm
+	}
+	swarm[id] = c
+}
+
+// leave removes peer from swarm if it is registered with provided connection
+func (r *relay) leave(ih bittorrent.InfoHash, id bittorrent.PeerID, c *client) {
+	r.Lock()
+	defer r.Unlock()
+	if swarm := r.swarms[ih]; swarm != nil && swarm[id] == c {
+		delete(swarm, id)
+		if len(swarm) == 0 {
+			delete(r.swarms, ih)
+		}
+	}
+}
+
+// targets returns up to n peers of swarm except the peer with provided ID.
+// Peers are selected in map iteration order, which is not specified.
+func (r *relay) targets(ih bittorrent.InfoHash, except bittorrent.PeerID, n int) []swarmPeer {
+	r.Lock()
+	defer r.Unlock()
+	swarm := r.swarms[ih]
+	if n <= 0 || len(swarm) == 0 {
+		return nil
+	}
+	peers := make([]swarmPeer, 0, min(n, len(swarm)))
+	for id, c := range swarm {
+		if id != except {
+			peers = append(peers, swarmPeer{id, c})
+			if len(peers) == n {
+				break
+			}
+		}
+	}
+	return peers
+}
+
+func offerKey(offerID binaryString, to bittorrent.PeerID) string {
+	return string(offerID) + to.RawString()
+}
+
+// addOffer registers offer sent to peer `to` by peer `from`,
+// which is connected via c, and removes expired offers
+// not more often than once per TTL
+func (r *relay) addOffer(ih bittorrent.InfoHash, offerID binaryString, from, to bittorrent.PeerID, c *client, now int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.offers[offerKey(offerID, to)] = pendingOffer{
+		infoHash: ih,
+		from:     from,
+		c:        c,
+		expires:  now + r.offerTTL,
+	}
+	if now >= r.nextClean {
+		for k, o := range r.offers {
+			if o.expires <= now {
+				delete(r.offers, k)
+			}
+		}
+		r.nextClean = now + r.offerTTL
+	}
+}
+
+// takeOffer returns connection of the peer, which sent
+// offer with provided ID to peer `to`, if offer is not
+// expired and matches to info hash and sender ID. Offer can be
+// answered only once.
+func (r *relay) takeOffer(ih bittorrent.InfoHash, offerID binaryString, from, to bittorrent.PeerID, now int64) (*client, bool) {
+	r.Lock()
+	defer r.Unlock()
+	k := offerKey(offerID, to)
+	o, found := r.offers[k]
+	if !found || o.expires <= now || o.infoHash != ih || o.from != from {
+		return nil, false
+	}
+	delete(r.offers, k)
+	return o.c, true
+}
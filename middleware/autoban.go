@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/pkg/ratelimit"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// AutoBanStorageCtx is the name of storage context where automatically
+// banned addresses are placed. Key is raw (unmapped) address and value
+// is ban expiration time (unix nanoseconds, big endian).
+const AutoBanStorageCtx = "MW_AUTOBAN"
+
+const (
+	autoBanValueLen         = 8
+	autoBanLookupQueueLen   = 1024
+	defaultAutoBanWindow    = time.Minute
+	defaultAutoBanDuration  = time.Hour
+	defaultAutoBanCacheSize = 1 << 16
+)
+
+// AutoBanConfig holds options of automatic ban of addresses,
+// which repeatedly exceed frontend rate limits.
+type AutoBanConfig struct {
+	// Threshold is the number of rate limit violations from one
+	// address within Window, after which address is banned.
+	// Auto-ban is disabled if Threshold is 0.
+	Threshold uint
+	// Window is the duration, within which violations are counted.
+	Window time.Duration
+	// Duration is the time, for which address is banned.
+	Duration time.Duration
+	// Allowlist is the list of prefixes, addresses of which are never banned.
+	Allowlist []netip.Prefix
+	// CacheSize is the maximal number of addresses, which ban state
+	// is cached locally.
+	CacheSize int
+}
+
+type cachedBan struct {
+	banned bool
+	// ban expiration if banned, time of next storage check otherwise
+	until int64
+}
+
+// autoBan counts rate limit violations of addresses and places
+// violators into AutoBanStorageCtx context of storage.
+// Bans (and their absence) are cached, requests are checked only
+// against the cache, and addresses missing in it are looked up
+// in storage in background, so the check never waits for storage.
+// Bans made by other tracker instances, which share the same storage,
+// are noticed not later than Window (if lookup queue is not full).
+type autoBan struct {
+	store      storage.DataStorage
+	violations *ratelimit.Limiter[netip.Addr]
+	allowlist  []netip.Prefix
+	window     int64
+	duration   int64
+	cacheSize  int
+	mu         sync.Mutex
+	lastSweep  int64
+	cache      map[netip.Addr]cachedBan
+	lookups    chan netip.Addr
+	closed     chan struct{}
+	onceCloser sync.Once
+	wg         sync.WaitGroup
+}
+
+func newAutoBan(store storage.DataStorage, cfg AutoBanConfig) *autoBan {
+	if cfg.Threshold == 0 {
+		return nil
+	}
+	if cfg.Window <= 0 {
+		logger.Warn().
+			Str("name", "AutoBanWindow").
+			Dur("provided", cfg.Window).
+			Dur("default", defaultAutoBanWindow).
+			Msg("falling back to default configuration")
+		cfg.Window = defaultAutoBanWindow
+	}
+	if cfg.Duration <= 0 {
+		logger.Warn().
+			Str("name", "AutoBanDuration").
+			Dur("provided", cfg.Duration).
+			Dur("default", defaultAutoBanDuration).
+			Msg("falling back to default configuration")
+		cfg.Duration = defaultAutoBanDuration
+	}
+	if cfg.CacheSize <= 0 {
+		logger.Warn().
+			Str("name", "AutoBanCacheSize").
+			Int("provided", cfg.CacheSize).
+			Int("default", defaultAutoBanCacheSize).
+			Msg("falling back to default configuration")
+		cfg.CacheSize = defaultAutoBanCacheSize
+	}
+	b := &autoBan{
+		store:      store,
+		violations: ratelimit.New[netip.Addr](cfg.Threshold-1, cfg.Window),
+		allowlist:  cfg.Allowlist,
+		window:     int64(cfg.Window),
+		duration:   int64(cfg.Duration),
+		cacheSize:  cfg.CacheSize,
+		cache:      make(map[netip.Addr]cachedBan),
+		lookups:    make(chan netip.Addr, autoBanLookupQueueLen),
+		closed:     make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			select {
+			case <-b.closed:
+				return
+			case addr := <-b.lookups:
+				if err := b.load(context.Background(), addr, timecache.NowUnixNano()); err != nil {
+					logger.Warn().Err(err).Stringer("addr", addr).Msg("unable to load address ban")
+				}
+			}
+		}
+	}()
+	return b
+}
+
+func autoBanKey(addr netip.Addr) string {
+	return string(addr.AsSlice())
+}
+
+func (b *autoBan) allowed(addr netip.Addr) bool {
+	for _, p := range b.allowlist {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *autoBan) cached(addr netip.Addr, now int64) (cachedBan, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, found := b.cache[addr]
+	return c, found && now < c.until
+}
+
+// setCached places ban state of address into cache. If cache is full,
+// expired entries are evicted, and if there are no such entries,
+// arbitrary one is evicted.
+func (b *autoBan) setCached(addr netip.Addr, c cachedBan, now int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setCachedLocked(addr, c, now)
+}
+
+func (b *autoBan) setCachedLocked(addr netip.Addr, c cachedBan, now int64) {
+	if _, exists := b.cache[addr]; !exists && len(b.cache) >= b.cacheSize {
+		if now-b.lastSweep >= b.window {
+			for a, cb := range b.cache {
+				if now >= cb.until {
+					delete(b.cache, a)
+				}
+			}
+			b.lastSweep = now
+		}
+		for a := range b.cache {
+			if len(b.cache) < b.cacheSize {
+				break
+			}
+			delete(b.cache, a)
+		}
+	}
+	b.cache[addr] = c
+}
+
+// violation registers rate limit violation from address and bans it
+// if number of violations within window reached threshold.
+func (b *autoBan) violation(ctx context.Context, addr netip.Addr, now int64) (banned bool, err error) {
+	addr = addr.Unmap()
+	if b.allowed(addr) || b.violations.Allow(addr, time.Unix(0, now)) {
+		return
+	}
+	if c, found := b.cached(addr, now); found && c.banned {
+		return
+	}
+	until := now + b.duration
+	v := make([]byte, autoBanValueLen)
+	binary.BigEndian.PutUint64(v, uint64(until))
+	key := autoBanKey(addr)
+	// some storages do not overwrite existing values
+	if err = b.store.Delete(ctx, AutoBanStorageCtx, key); err == nil {
+		err = b.store.Put(ctx, AutoBanStorageCtx, storage.Entry{Key: key, Value: v})
+	}
+	if err == nil {
+		b.setCached(addr, cachedBan{banned: true, until: until}, now)
+		promAutoBanned.Inc()
+		logger.Info().
+			Stringer("addr", addr).
+			Time("until", time.Unix(0, until)).
+			Msg("address banned")
+		banned = true
+	}
+	return
+}
+
+// banned checks if address is banned. Only cached state is checked,
+// if address is not cached, it is considered not banned until
+// its ban is loaded from storage in background.
+func (b *autoBan) banned(addr netip.Addr, now int64) bool {
+	addr = addr.Unmap()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, found := b.cache[addr]; found && now < c.until {
+		return c.banned
+	}
+	// prevent repeated lookups of the same address while one is queued
+	b.setCachedLocked(addr, cachedBan{until: now + b.window}, now)
+	select {
+	case b.lookups <- addr:
+	default:
+	}
+	return false
+}
+
+// load synchronizes cached ban state of address with storage.
+// Expired bans are deleted from storage.
+func (b *autoBan) load(ctx context.Context, addr netip.Addr, now int64) (err error) {
+	var until int64
+	if until, err = LoadAutoBan(ctx, b.store, addr); err != nil {
+		return
+	}
+	c := cachedBan{until: now + b.window}
+	if until > now {
+		c = cachedBan{banned: true, until: until}
+	} else if until > 0 {
+		err = b.store.Delete(ctx, AutoBanStorageCtx, autoBanKey(addr))
+	}
+	b.setCached(addr, c, now)
+	return
+}
+
+// Close stops background lookups of bans
+func (b *autoBan) Close() {
+	if b == nil {
+		return
+	}
+	b.onceCloser.Do(func() {
+		close(b.closed)
+		b.wg.Wait()
+	})
+}
+
+// LoadAutoBan returns expiration time (unix nanoseconds) of automatic ban
+// of address placed in AutoBanStorageCtx context of storage,
+// or zero if address was not banned.
+// Returned time may be in the past if ban is already expired.
+func LoadAutoBan(ctx context.Context, store storage.DataStorage, addr netip.Addr) (int64, error) {
+	v, err := store.Load(ctx, AutoBanStorageCtx, autoBanKey(addr.Unmap()))
+	if err != nil || len(v) < autoBanValueLen {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// newTestAutoBan creates autoBan without background lookups,
+// bans are loaded from storage explicitly with load
+func newTestAutoBan(ds storage.DataStorage, cfg AutoBanConfig) *autoBan {
+	b := newAutoBan(ds, cfg)
+	b.Close()
+	return b
+}
+
+func TestAutoBanTrigger(t *testing.T) {
+	ctx := context.Background()
+	ds := memory.NewDataStorage()
+	defer ds.Close()
+	b := newTestAutoBan(ds, AutoBanConfig{
+		Threshold: 3,
+		Window:    time.Minute,
+		Duration:  time.Hour,
+		Allowlist: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	now := time.Now().UnixNano()
+	addr := netip.MustParseAddr("192.0.2.1")
+	bannedBefore := testutil.ToFloat64(promAutoBanned)
+
+	for i := 0; i < 2; i++ {
+		banned, err := b.violation(ctx, addr, now)
+		require.Nil(t, err)
+		require.False(t, banned)
+	}
+	require.False(t, b.banned(addr, now))
+
+	banned, err := b.violation(ctx, addr, now)
+	require.Nil(t, err)
+	require.True(t, banned)
+	require.Equal(t, bannedBefore+1, testutil.ToFloat64(promAutoBanned))
+	require.True(t, b.banned(netip.MustParseAddr("::ffff:192.0.2.1"), now))
+
+	// ban is visible to other instances after it is loaded from storage
+	other := newTestAutoBan(ds, AutoBanConfig{Threshold: 1, Window: time.Minute, Duration: time.Hour})
+	require.False(t, other.banned(addr, now))
+	require.Nil(t, other.load(ctx, addr, now))
+	require.True(t, other.banned(addr, now))
+	until, err := LoadAutoBan(ctx, ds, addr)
+	require.Nil(t, err)
+	require.Equal(t, now+int64(time.Hour), until)
+
+	// allowlisted addresses are never banned
+	allowed := netip.MustParseAddr("10.1.2.3")
+	for i := 0; i < 5; i++ {
+		banned, err = b.violation(ctx, allowed, now)
+		require.Nil(t, err)
+		require.False(t, banned)
+	}
+	require.False(t, b.banned(allowed, now))
+
+	// violations are counted within window
+	slow := netip.MustParseAddr("192.0.2.2")
+	for i := 0; i < 6; i++ {
+		banned, err = b.violation(ctx, slow, now+int64(i)*int64(30*time.Second))
+		require.Nil(t, err)
+		require.False(t, banned)
+	}
+}
+
+func TestAutoBanExpiry(t *testing.T) {
+	ctx := context.Background()
+	ds := memory.NewDataStorage()
+	defer ds.Close()
+	b := newTestAutoBan(ds, AutoBanConfig{Threshold: 1, Window: time.Second, Duration: time.Minute})
+	now := time.Now().UnixNano()
+	addr := netip.MustParseAddr("2001:db8::1")
+
+	banned, err := b.violation(ctx, addr, now)
+	require.Nil(t, err)
+	require.True(t, banned)
+	require.True(t, b.banned(addr, now+int64(time.Minute)-1))
+
+	require.False(t, b.banned(addr, now+int64(time.Minute)))
+	// expired ban is deleted from storage
+	require.Nil(t, b.load(ctx, addr, now+int64(time.Minute)))
+	until, err := LoadAutoBan(ctx, ds, addr)
+	require.Nil(t, err)
+	require.Zero(t, until)
+
+	// absence of ban is cached within window
+	later := now + int64(time.Minute) + int64(time.Second)/2
+	other := newTestAutoBan(ds, AutoBanConfig{Threshold: 1, Window: time.Second, Duration: time.Minute})
+	banned, err = other.violation(ctx, addr, later)
+	require.Nil(t, err)
+	require.True(t, banned)
+	require.False(t, b.banned(addr, later))
+	require.False(t, b.banned(addr, now+int64(time.Minute)+int64(time.Second)))
+	require.Nil(t, b.load(ctx, addr, now+int64(time.Minute)+int64(time.Second)))
+	require.True(t, b.banned(addr, now+int64(time.Minute)+int64(time.Second)))
+	require.False(t, b.banned(addr, later+int64(time.Minute)))
+}
+
+func TestAutoBanBackgroundLoad(t *testing.T) {
+	ctx := context.Background()
+	ds := memory.NewDataStorage()
+	defer ds.Close()
+	addr := netip.MustParseAddr("192.0.2.1")
+	other := newTestAutoBan(ds, AutoBanConfig{Threshold: 1, Window: time.Minute, Duration: time.Hour})
+	banned, err := other.violation(ctx, addr, time.Now().UnixNano())
+	require.Nil(t, err)
+	require.True(t, banned)
+
+	b := newAutoBan(ds, AutoBanConfig{Threshold: 1, Window: time.Minute, Duration: time.Hour})
+	defer b.Close()
+	// ban is not known until loaded in background
+	require.False(t, b.banned(addr, time.Now().UnixNano()))
+	require.Eventually(t, func() bool {
+		return b.banned(addr, time.Now().UnixNano())
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAutoBanCacheSize(t *testing.T) {
+	ds := memory.NewDataStorage()
+	defer ds.Close()
+	b := newTestAutoBan(ds, AutoBanConfig{Threshold: 1, CacheSize: 2})
+	now := time.Now().UnixNano()
+	for i := byte(1); i <= 5; i++ {
+		require.False(t, b.banned(netip.AddrFrom4([4]byte{192, 0, 2, i}), now))
+		require.LessOrEqual(t, len(b.cache), 2)
+	}
+}
@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBackpressureFactor        = 2
+	defaultBackpressureCheckInterval = 10 * time.Second
+	defaultBackpressureMaxMultiplier = 4
+	// weight of the last storage latency sample in its moving average
+	latencyEWMAShift = 3
+)
+
+// BackpressureConfig holds options of adaptive announce interval,
+// which is increased while tracker is under load and relaxed
+// as load drops, so clients back off during spikes.
+type BackpressureConfig struct {
+	// MaxGoroutines is the number of goroutines, above which
+	// tracker is considered loaded. Zero disables this signal.
+	MaxGoroutines int
+	// MaxStorageLatency is the average duration of storage calls
+	// made by announce processing, above which tracker is
+	// considered loaded. Zero disables this signal.
+	MaxStorageLatency time.Duration
+	// Factor is the multiplier of announce interval applied every
+	// CheckInterval while tracker is loaded. Interval is divided
+	// by Factor while tracker is not loaded until it reaches
+	// configured value.
+	Factor float64
+	// MaxInterval is the upper limit of increased announce interval.
+	MaxInterval time.Duration
+	// CheckInterval is the period of load evaluation.
+	CheckInterval time.Duration
+}
+
+// backpressure evaluates load signals periodically and holds
+// multiplier of announce intervals.
+// Nil backpressure does not change intervals.
+type backpressure struct {
+	factor        float64
+	maxGoroutines int
+	maxLatency    int64
+	base          time.Duration
+	maxInterval   time.Duration
+	// math.Float64bits of current multiplier
+	multiplier atomic.Uint64
+	// moving average of storage latency (nanoseconds)
+	latency    atomic.Int64
+	goroutines func() int
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func newBackpressure(cfg BackpressureConfig, announceInterval time.Duration) *backpressure {
+	if cfg.MaxGoroutines <= 0 && cfg.MaxStorageLatency <= 0 {
+		return nil
+	}
+	if announceInterval <= 0 {
+		logger.Warn().Msg("announce interval is not set, backpressure disabled")
+		return nil
+	}
+	if cfg.Factor <= 1 {
+		logger.Warn().
+			Str("name", "BackpressureFactor").
+			Float64("provided", cfg.Factor).
+			Float64("default", defaultBackpressureFactor).
+			Msg("falling back to default configuration")
+		cfg.Factor = defaultBackpressureFactor
+	}
+	if cfg.MaxInterval <= announceInterval {
+		maxInterval := defaultBackpressureMaxMultiplier * announceInterval
+		logger.Warn().
+			Str("name", "BackpressureMaxInterval").
+			Dur("provided", cfg.MaxInterval).
+			Dur("default", maxInterval).
+			Msg("falling back to default configuration")
+		cfg.MaxInterval = maxInterval
+	}
+	if cfg.CheckInterval <= 0 {
+		logger.Warn().
+			Str("name", "BackpressureCheckInterval").
+			Dur("provided", cfg.CheckInterval).
+			Dur("default", defaultBackpressureCheckInterval).
+			Msg("falling back to default configuration")
+		cfg.CheckInterval = defaultBackpressureCheckInterval
+	}
+	b := &backpressure{
+		factor:        cfg.Factor,
+		maxGoroutines: cfg.MaxGoroutines,
+		maxLatency:    int64(cfg.MaxStorageLatency),
+		base:          announceInterval,
+		maxInterval:   cfg.MaxInterval,
+		goroutines:    runtime.NumGoroutine,
+		closed:        make(chan any),
+	}
+	b.setMultiplier(1)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		t := time.NewTicker(cfg.CheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-b.closed:
+				return
+			case <-t.C:
+				b.check()
+			}
+		}
+	}()
+	return b
+}
+
+func (b *backpressure) setMultiplier(m float64) {
+	b.multiplier.Store(math.Float64bits(m))
+	promEffectiveInterval.Set(time.Duration(float64(b.base) * m).Seconds())
+}
+
+func (b *backpressure) getMultiplier() float64 {
+	return math.Float64frombits(b.multiplier.Load())
+}
+
+// observe registers duration of storage calls
+func (b *backpressure) observe(d time.Duration) {
+	if b == nil {
+		return
+	}
+	for {
+		prev := b.latency.Load()
+		if b.latency.CompareAndSwap(prev, prev+(int64(d)-prev)>>latencyEWMAShift) {
+			return
+		}
+	}
+}
+
+// overloaded reports if any of load signals exceeded threshold
+func (b *backpressure) overloaded() bool {
+	return (b.maxGoroutines > 0 && b.goroutines() > b.maxGoroutines) ||
+		(b.maxLatency > 0 && b.latency.Load() > b.maxLatency)
+}
+
+// check evaluates load and increases or decreases multiplier
+func (b *backpressure) check() {
+	prev := b.getMultiplier()
+	next := prev / b.factor
+	if b.overloaded() {
+		next = prev * b.factor
+	}
+	next = min(max(next, 1), float64(b.maxInterval)/float64(b.base))
+	if next != prev {
+		b.setMultiplier(next)
+		logger.Info().
+			Dur("interval", time.Duration(float64(b.base)*next)).
+			Msg("announce interval changed by load")
+	}
+}
+
+// apply multiplies intervals of response by current multiplier,
+// increased intervals do not exceed maximal one
+func (b *backpressure) apply(interval, minInterval time.Duration) (time.Duration, time.Duration) {
+	if b == nil {
+		return interval, minInterval
+	}
+	if m := b.getMultiplier(); m > 1 {
+		scale := func(d time.Duration) time.Duration {
+			return max(d, min(time.Duration(float64(d)*m), b.maxInterval))
+		}
+		interval, minInterval = scale(interval), scale(minInterval)
+	}
+	return interval, minInterval
+}
+
+func (b *backpressure) Close() {
+	if b == nil {
+		return
+	}
+	b.onceCloser.Do(func() {
+		close(b.closed)
+		b.wg.Wait()
+	})
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestBackpressure(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	l := NewLogic(30*time.Minute, 10*time.Minute, ps, nil, nil)
+	defer l.Close()
+	l.SetBackpressureConfig(BackpressureConfig{
+		MaxGoroutines: 1000,
+		MaxInterval:   time.Hour,
+		CheckInterval: time.Hour,
+	})
+	goroutines := 10
+	l.backpressure.goroutines = func() int { return goroutines }
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	announce := func() *bittorrent.AnnounceResponse {
+		_, resp, err := l.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{1},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+			},
+		})
+		require.Nil(t, err)
+		return resp
+	}
+
+	l.backpressure.check()
+	resp := announce()
+	require.Equal(t, 30*time.Minute, resp.Interval)
+	require.Equal(t, 10*time.Minute, resp.MinInterval)
+
+	// high load
+	goroutines = 2000
+	l.backpressure.check()
+	resp = announce()
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 20*time.Minute, resp.MinInterval)
+	require.Equal(t, time.Hour.Seconds(), testutil.ToFloat64(promEffectiveInterval))
+	l.backpressure.check()
+	require.Equal(t, time.Hour, announce().Interval, "interval must not exceed maximal")
+
+	// storage latency is also a signal
+	goroutines = 10
+	l.backpressure.maxLatency = int64(time.Second)
+	for i := 0; i < 100; i++ {
+		l.backpressure.observe(2 * time.Second)
+	}
+	l.backpressure.check()
+	require.Equal(t, time.Hour, announce().Interval)
+
+	// load dropped
+	l.backpressure.latency.Store(0)
+	l.backpressure.check()
+	require.Equal(t, 30*time.Minute, announce().Interval)
+	require.Equal(t, (30 * time.Minute).Seconds(), testutil.ToFloat64(promEffectiveInterval))
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// states of circuit breaker, values of mochi_storage_circuit_state gauge
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// defaultBreakerCooldown is the duration of open state of circuit
+// breaker if it is not set
+const defaultBreakerCooldown = 30 * time.Second
+
+// BreakerConfig holds options of circuit breaker around storage calls
+// made by response and swarm interaction hooks.
+type BreakerConfig struct {
+	// Threshold is the number of consecutive storage errors, after which
+	// circuit is opened and storage is not called for Cooldown.
+	// Breaker is disabled if Threshold is 0.
+	Threshold uint
+	// Cooldown is the duration of open state, after which one request
+	// is passed to storage to test recovery (half-open state).
+	// Default is 30 seconds.
+	Cooldown time.Duration
+	// Interval is the announce interval sent to clients while
+	// circuit is open.
+	Interval time.Duration
+}
+
+// circuitBreaker counts consecutive storage errors and stops
+// passing requests to failing storage for cooldown.
+// Nil breaker always passes requests.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold uint
+	cooldown  time.Duration
+	failures  uint
+	state     int
+	openedAt  time.Time
+	// half-open probe is in progress
+	probing bool
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg BreakerConfig) Validate() BreakerConfig {
+	validCfg := cfg
+	if cfg.Threshold > 0 && cfg.Cooldown <= 0 {
+		validCfg.Cooldown = defaultBreakerCooldown
+		logger.Warn().
+			Str("name", "BreakerCooldown").
+			Dur("provided", cfg.Cooldown).
+			Dur("default", validCfg.Cooldown).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func newCircuitBreaker(cfg BreakerConfig) *circuitBreaker {
+	if cfg.Threshold == 0 {
+		return nil
+	}
+	cfg = cfg.Validate()
+	promCircuitState.Set(circuitClosed)
+	return &circuitBreaker{threshold: cfg.Threshold, cooldown: cfg.Cooldown}
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	promCircuitState.Set(float64(state))
+}
+
+// allow reports if request may be passed to storage and if request
+// is the half-open probe. In half-open state only one request is allowed
+// until its result is reported with done.
+func (b *circuitBreaker) allow(now time.Time) (allowed, probe bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		logger.Info().Msg("storage circuit half-open")
+		b.setState(circuitHalfOpen)
+		b.probing = true
+		return true, true
+	case circuitHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// closed reports if circuit is closed, without
+// claiming half-open probe
+func (b *circuitBreaker) closed() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == circuitClosed
+}
+
+// done reports result of storage request passed by allow (or
+// passed while circuit is closed), probe is the value returned by allow.
+// Only result of probe finishes half-open state, results of other requests,
+// which started before circuit opened, are ignored if circuit is not closed.
+// Client errors are not treated as storage failures.
+func (b *circuitBreaker) done(probe bool, err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	var clientErr bittorrent.ClientError
+	if errors.As(err, &clientErr) {
+		err = nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	} else if b.state != circuitClosed {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != circuitClosed {
+			logger.Info().Msg("storage circuit closed")
+			b.setState(circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.threshold) {
+		logger.Warn().Err(err).
+			Uint("failures", b.failures).
+			Dur("cooldown", b.cooldown).
+			Msg("storage circuit open")
+		b.openedAt = now
+		b.setState(circuitOpen)
+	}
+}
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func requireCircuitState(t *testing.T, state int) {
+	t.Helper()
+	require.Equal(t, float64(state), testutil.ToFloat64(promCircuitState))
+}
+
+// requireAllowed checks that request is allowed by breaker
+// and returns if it is the half-open probe
+func requireAllowed(t *testing.T, b *circuitBreaker, now time.Time) bool {
+	t.Helper()
+	ok, probe := b.allow(now)
+	require.True(t, ok)
+	return probe
+}
+
+func allowed(b *circuitBreaker, now time.Time) bool {
+	ok, _ := b.allow(now)
+	return ok
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	var probe bool
+	errFail := errors.New("failure")
+	now := time.Now()
+	b := newCircuitBreaker(BreakerConfig{Threshold: 3, Cooldown: time.Minute})
+	requireCircuitState(t, circuitClosed)
+
+	// success resets failures counter
+	for i := 0; i < 2; i++ {
+		probe = requireAllowed(t, b, now)
+		b.done(probe, errFail, now)
+	}
+	probe = requireAllowed(t, b, now)
+	b.done(probe, nil, now)
+	// client errors are not failures
+	for i := 0; i < 5; i++ {
+		probe = requireAllowed(t, b, now)
+		b.done(probe, storage.ErrResourceDoesNotExist, now)
+	}
+	requireCircuitState(t, circuitClosed)
+
+	for i := 0; i < 3; i++ {
+		probe = requireAllowed(t, b, now)
+		b.done(probe, errFail, now)
+	}
+	requireCircuitState(t, circuitOpen)
+	require.False(t, allowed(b, now.Add(time.Second)))
+	require.False(t, b.closed())
+
+	// half-open passes only one request, failure opens circuit again
+	now = now.Add(time.Minute)
+	probe = requireAllowed(t, b, now)
+	require.True(t, probe)
+	requireCircuitState(t, circuitHalfOpen)
+	require.False(t, allowed(b, now))
+	// result of request started before circuit opened must not finish half-open state
+	b.done(false, nil, now)
+	requireCircuitState(t, circuitHalfOpen)
+	require.False(t, allowed(b, now))
+	b.done(probe, errFail, now)
+	requireCircuitState(t, circuitOpen)
+	require.False(t, allowed(b, now.Add(time.Second)))
+
+	// successful probe closes circuit
+	now = now.Add(time.Minute)
+	probe = requireAllowed(t, b, now)
+	b.done(probe, nil, now)
+	requireCircuitState(t, circuitClosed)
+	requireAllowed(t, b, now)
+	require.True(t, b.closed())
+
+	// disabled breaker
+	b = newCircuitBreaker(BreakerConfig{})
+	require.Nil(t, b)
+	requireAllowed(t, b, now)
+	require.True(t, b.closed())
+}
+
+type failingStorage struct {
+	storage.PeerStorage
+	calls int
+}
+
+func (s *failingStorage) ScrapeSwarm(context.Context, bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	s.calls++
+	return 0, 0, 0, errStorageDown
+}
+
+func TestCircuitBreakerDefaultCooldown(t *testing.T) {
+	require.Equal(t, defaultBreakerCooldown, BreakerConfig{Threshold: 1}.Validate().Cooldown)
+	require.Zero(t, BreakerConfig{}.Validate().Cooldown)
+
+	var probe bool
+	now := time.Now()
+	b := newCircuitBreaker(BreakerConfig{Threshold: 1})
+	probe = requireAllowed(t, b, now)
+	b.done(probe, errors.New("failure"), now)
+	// zero cooldown must not turn circuit half-open immediately
+	require.False(t, allowed(b, now))
+	probe = requireAllowed(t, b, now.Add(defaultBreakerCooldown))
+	b.done(probe, nil, now)
+}
+
+func TestCircuitBreakerResponse(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	fs := &failingStorage{PeerStorage: ps}
+	l := NewLogic(time.Minute, time.Minute, fs, nil, nil)
+	l.SetBreakerConfig(BreakerConfig{Threshold: 2, Cooldown: time.Hour, Interval: time.Hour})
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 1, RequestPeer: bittorrent.RequestPeer{
+		Port:             6881,
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+	}}
+	for i := 0; i < 2; i++ {
+		_, _, err = l.HandleAnnounce(context.Background(), req)
+		require.ErrorIs(t, err, errStorageDown)
+	}
+	require.Equal(t, 2, fs.calls)
+	requireCircuitState(t, circuitOpen)
+
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, 2, fs.calls)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Equal(t, req.Peers(), resp.IPv4Peers)
+
+	_, scr, err := l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih}}, scr.Data)
+	require.Equal(t, 2, fs.calls)
+
+	// stopped peer is deleted even if circuit is open
+	require.Nil(t, ps.PutLeecher(context.Background(), ih, req.Peers()[0]))
+	req.Event = bittorrent.Stopped
+	ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	l.AfterAnnounce(ctx, req, resp)
+	ok, err := storage.PeerExists(context.Background(), ps, ih, req.Peers()[0], false)
+	require.Nil(t, err)
+	require.False(t, ok)
+}
@@ -1,5 +1,5 @@
 // Package clientapproval implements a Hook that fails an Announce based on a
-// whitelist or blacklist of BitTorrent client IDs.
+// whitelist or blacklist of BitTorrent client IDs and denylist of peer IDs.
 package clientapproval
 
 import (
@@ -30,11 +30,21 @@ type Config struct {
 	ClientIDList []string `cfg:"client_id_list"`
 	// If Invert set to true, all client IDs stored in ClientIDList should be blacklisted.
 	Invert bool
+	// PeerIDDenylist is the list of denied peer IDs patterns.
+	// Pattern is the prefix of peer ID or, if it starts with RegexPrefix,
+	// regular expression matched against peer ID.
+	// Denylist is checked regardless of Invert.
+	PeerIDDenylist []string `cfg:"peer_id_denylist"`
+	// NoBuiltinDenylist disables built-in denylist of peer IDs
+	// generated by test or default clients: IDs with all bytes
+	// equal (i.e. zeroes) and IDs with sequential bytes.
+	NoBuiltinDenylist bool `cfg:"no_builtin_denylist"`
 }
 
 type hook struct {
 	clientIDs map[ClientID]any
 	invert    bool
+	denylist  *peerIDDenylist
 }
 
 func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
@@ -49,6 +59,11 @@ func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error
 		invert:    cfg.Invert,
 	}
 
+	var err error
+	if h.denylist, err = newPeerIDDenylist(cfg.PeerIDDenylist, !cfg.NoBuiltinDenylist); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+
 	for _, cidString := range cfg.ClientIDList {
 		cidBytes := []byte(cidString)
 		if len(cidBytes) != 6 {
@@ -63,10 +78,16 @@ func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error
 // HandleAnnounce checks if specified ClientID is approved or not.
 // If Config.Invert set to true and hash found in provided list, function will return ErrClientUnapproved,
 // that means that ClientID is blacklisted.
+// ClientID is not checked if list is empty.
+// If PeerID matches denylist, ErrClientUnapproved is returned regardless of ClientID.
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
 	var err error
-	if _, contains := h.clientIDs[NewClientID(req.ID)]; contains == h.invert {
+	if h.denylist.denied(req.ID) {
 		err = ErrClientUnapproved
+	} else if len(h.clientIDs) > 0 {
+		if _, contains := h.clientIDs[NewClientID(req.ID)]; contains == h.invert {
+			err = ErrClientUnapproved
+		}
 	}
 
 	return ctx, err
@@ -77,3 +77,48 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerIDDenylist(t *testing.T) {
+	sequential := make([]byte, bittorrent.PeerIDLen)
+	for i := range sequential {
+		sequential[i] = byte(i)
+	}
+	denyCases := []struct {
+		name     string
+		cfg      conf.MapConfig
+		peerID   []byte
+		approved bool
+	}{
+		{"zero", conf.MapConfig{}, make([]byte, bittorrent.PeerIDLen), false},
+		{"repeated", conf.MapConfig{}, []byte("AAAAAAAAAAAAAAAAAAAA"), false},
+		{"sequential bytes", conf.MapConfig{}, sequential, false},
+		{"sequential letters", conf.MapConfig{}, []byte("ABCDEFGHIJKLMNOPQRST"), false},
+		{"sequential digits", conf.MapConfig{}, []byte("01234567890123456789"), false},
+		{"regular", conf.MapConfig{}, []byte("-qB4600-0123456789ab"), true},
+		{"builtin disabled", conf.MapConfig{"no_builtin_denylist": true}, make([]byte, bittorrent.PeerIDLen), true},
+		{"prefix", conf.MapConfig{"peer_id_denylist": []string{"-XX0000-"}}, []byte("-XX0000-0123456789ab"), false},
+		{"regex", conf.MapConfig{"peer_id_denylist": []string{"regex:^-[A-Z]{2}0{4}-"}}, []byte("-YY0000-0123456789ab"), false},
+		{"regex not matched", conf.MapConfig{"peer_id_denylist": []string{"regex:^-[A-Z]{2}0{4}-"}}, []byte("-YY0001-0123456789ab"), true},
+		{"whitelisted", conf.MapConfig{"client_id_list": []string{"000000"}}, make([]byte, bittorrent.PeerIDLen), false},
+	}
+	for _, tt := range denyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := build(tt.cfg, nil)
+			require.Nil(t, err)
+
+			peerID, err := bittorrent.NewPeerID(tt.peerID)
+			require.Nil(t, err)
+			req := &bittorrent.AnnounceRequest{}
+			req.ID = peerID
+			_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+			if tt.approved {
+				require.Nil(t, err)
+			} else {
+				require.Equal(t, ErrClientUnapproved, err)
+			}
+		})
+	}
+
+	_, err := build(conf.MapConfig{"peer_id_denylist": []string{"regex:("}}, nil)
+	require.NotNil(t, err)
+}
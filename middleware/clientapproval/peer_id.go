@@ -0,0 +1,84 @@
+package clientapproval
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// RegexPrefix marks pattern of peer ID denylist as regular expression
+const RegexPrefix = "regex:"
+
+// peerIDDenylist holds patterns of peer IDs, which are generated by
+// test or default clients, and should not be accepted.
+// Nil denylist denies nothing.
+type peerIDDenylist struct {
+	prefixes [][]byte
+	patterns []*regexp.Regexp
+	builtin  bool
+}
+
+func newPeerIDDenylist(patterns []string, builtin bool) (*peerIDDenylist, error) {
+	if len(patterns) == 0 && !builtin {
+		return nil, nil
+	}
+	d := &peerIDDenylist{builtin: builtin}
+	for _, p := range patterns {
+		if expr, isRegex := strings.CutPrefix(p, RegexPrefix); isRegex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer ID pattern '%s': %w", expr, err)
+			}
+			d.patterns = append(d.patterns, re)
+		} else if len(p) > 0 {
+			d.prefixes = append(d.prefixes, []byte(p))
+		}
+	}
+	return d, nil
+}
+
+// denied checks if peer ID matches any of patterns
+func (d *peerIDDenylist) denied(id bittorrent.PeerID) bool {
+	if d == nil {
+		return false
+	}
+	if d.builtin && (repeatedPeerID(id) || sequentialPeerID(id)) {
+		return true
+	}
+	for _, p := range d.prefixes {
+		if bytes.HasPrefix(id[:], p) {
+			return true
+		}
+	}
+	for _, re := range d.patterns {
+		if re.Match(id[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatedPeerID checks if all bytes of peer ID are the same (i.e. zeroes)
+func repeatedPeerID(id bittorrent.PeerID) bool {
+	for _, b := range id[1:] {
+		if b != id[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// sequentialPeerID checks if every byte of peer ID is greater than
+// previous by one (i.e. 0x00, 0x01, 0x02... or ABCDE...).
+// ASCII digits may wrap from '9' to '0' (01234567890123456789).
+func sequentialPeerID(id bittorrent.PeerID) bool {
+	for i := 1; i < len(id); i++ {
+		if id[i] != id[i-1]+1 && (id[i-1] != '9' || id[i] != '0') {
+			return false
+		}
+	}
+	return true
+}
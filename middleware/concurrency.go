@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"time"
+)
+
+// defaultConcurrencyTimeout is the time request waits for
+// free storage slot if timeout is not set
+const defaultConcurrencyTimeout = 100 * time.Millisecond
+
+// ConcurrencyConfig holds options of limit of concurrent storage calls
+// made by response and swarm interaction hooks.
+type ConcurrencyConfig struct {
+	// Limit is the maximum number of in-flight storage operations.
+	// Limit is disabled if 0.
+	Limit uint
+	// Timeout is the maximum duration, which request waits for
+	// free slot. If it is exceeded, announce is answered with
+	// the requester itself as the only peer, scrape - with zeroes.
+	Timeout time.Duration
+}
+
+// storageLimiter is the semaphore, which limits number of
+// concurrent storage operations.
+// Nil limiter always acquires slot.
+type storageLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newStorageLimiter(cfg ConcurrencyConfig) *storageLimiter {
+	if cfg.Limit == 0 {
+		return nil
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultConcurrencyTimeout
+	}
+	promStorageInFlight.Set(0)
+	return &storageLimiter{slots: make(chan struct{}, cfg.Limit), timeout: cfg.Timeout}
+}
+
+// acquire occupies slot for storage operation, waiting for
+// free slot no more than timeout. Returns false if slot is not
+// acquired, otherwise release must be called after operation.
+func (l *storageLimiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-t.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	promStorageInFlight.Inc()
+	return true
+}
+
+// release frees slot occupied by acquire
+func (l *storageLimiter) release() {
+	if l == nil {
+		return
+	}
+	promStorageInFlight.Dec()
+	<-l.slots
+}
+
+// inFlight returns number of occupied slots
+func (l *storageLimiter) inFlight() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
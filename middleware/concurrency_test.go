@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// slowStorage counts concurrent ScrapeSwarm calls
+type slowStorage struct {
+	storage.PeerStorage
+	current, max atomic.Int32
+}
+
+func (s *slowStorage) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	n := s.current.Add(1)
+	defer s.current.Add(-1)
+	for m := s.max.Load(); n > m && !s.max.CompareAndSwap(m, n); m = s.max.Load() {
+	}
+	time.Sleep(10 * time.Millisecond)
+	return s.PeerStorage.ScrapeSwarm(ctx, ih)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ss := &slowStorage{PeerStorage: ps}
+	l := NewLogic(time.Minute, time.Minute, ss, nil, nil)
+	l.SetConcurrencyConfig(ConcurrencyConfig{Limit: 3, Timeout: time.Minute})
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	var wg sync.WaitGroup
+	for i := byte(1); i <= 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := l.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{
+				InfoHash: ih,
+				Left:     1,
+				NumWant:  10,
+				RequestPeer: bittorrent.RequestPeer{
+					ID:               bittorrent.PeerID{i},
+					Port:             6881,
+					RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{10, 0, 0, i})}},
+				},
+			})
+			require.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, ss.max.Load(), int32(3))
+	require.Equal(t, 0, l.respHook.limiter.inFlight())
+	require.Equal(t, float64(0), testutil.ToFloat64(promStorageInFlight))
+}
+
+func TestConcurrencyTimeout(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ss := &slowStorage{PeerStorage: ps}
+	l := NewLogic(time.Minute, time.Minute, ss, nil, nil)
+	l.SetConcurrencyConfig(ConcurrencyConfig{Limit: 1, Timeout: 10 * time.Millisecond})
+
+	lim := l.respHook.limiter
+	require.True(t, lim.acquire(context.Background()))
+	require.Equal(t, float64(1), testutil.ToFloat64(promStorageInFlight))
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 1, RequestPeer: bittorrent.RequestPeer{
+		Port:             6881,
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+	}}
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Equal(t, req.Peers(), resp.IPv4Peers)
+
+	_, scr, err := l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih}}, scr.Data)
+	require.Zero(t, ss.max.Load())
+
+	lim.release()
+	_, _, err = l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, int32(1), ss.max.Load())
+
+	// disabled limiter
+	lim = newStorageLimiter(ConcurrencyConfig{})
+	require.Nil(t, lim)
+	require.True(t, lim.acquire(context.Background()))
+	lim.release()
+}
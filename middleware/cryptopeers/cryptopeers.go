@@ -0,0 +1,131 @@
+// Package cryptopeers implements a ResponseFilter, which remembers peers
+// declared support of encrypted connections and returns them first
+// to clients, which require encryption.
+package cryptopeers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+// Name is the name by which this filter is registered with Conf.
+const Name = "prefer crypto"
+
+const defaultTTL = time.Hour
+
+var logger = log.NewLogger("middleware/prefer crypto")
+
+func init() {
+	middleware.RegisterFilterBuilder(Name, build)
+}
+
+// Config represents the configuration for the cryptopeers filter.
+type Config struct {
+	// TTL is the duration for which peer is remembered as
+	// crypto-capable after the last announce.
+	TTL time.Duration `cfg:"ttl"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.TTL <= 0 {
+		validCfg.TTL = defaultTTL
+		logger.Warn().
+			Str("name", "TTL").
+			Dur("provided", cfg.TTL).
+			Dur("default", validCfg.TTL).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+// filter holds peers announced with bittorrent.CryptoSupported or
+// bittorrent.CryptoRequired and time, until which they are treated
+// as crypto-capable.
+// Data is process-local and not shared between tracker instances.
+type filter struct {
+	sync.RWMutex
+	ttl       int64
+	nextClean int64
+	peers     map[bittorrent.Peer]int64
+}
+
+func build(config conf.MapConfig) (middleware.ResponseFilter, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("filter %s: %w", Name, err)
+	}
+	return newFilter(cfg.Validate().TTL), nil
+}
+
+func newFilter(ttl time.Duration) *filter {
+	return &filter{ttl: int64(ttl), peers: make(map[bittorrent.Peer]int64)}
+}
+
+func (f *filter) FilterAnnounce(_ context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	now := timecache.NowUnixNano()
+	f.update(req, now)
+	if req.Crypto == bittorrent.CryptoRequired {
+		f.sortFirst(resp.IPv4Peers, now)
+		f.sortFirst(resp.IPv6Peers, now)
+	}
+	return nil
+}
+
+// update remembers requester as crypto-capable or forgets it
+// if encryption is not declared or client stopped, and removes
+// outdated records not more often than once per ttl
+func (f *filter) update(req *bittorrent.AnnounceRequest, now int64) {
+	capable := req.Crypto != bittorrent.CryptoNone && req.Event != bittorrent.Stopped
+	peers := req.Peers()
+	f.Lock()
+	defer f.Unlock()
+	for _, p := range peers {
+		if capable {
+			f.peers[p] = now + f.ttl
+		} else {
+			delete(f.peers, p)
+		}
+	}
+	if now >= f.nextClean {
+		for p, until := range f.peers {
+			if until <= now {
+				delete(f.peers, p)
+			}
+		}
+		f.nextClean = now + f.ttl
+	}
+}
+
+// sortFirst moves crypto-capable peers to the beginning of
+// provided slice, preserving order of other peers
+func (f *filter) sortFirst(peers bittorrent.Peers, now int64) {
+	f.RLock()
+	defer f.RUnlock()
+	if len(f.peers) == 0 || len(peers) < 2 {
+		return
+	}
+	plain := make(bittorrent.Peers, 0, len(peers))
+	i := 0
+	for _, p := range peers {
+		if until, found := f.peers[p]; found && until > now {
+			peers[i] = p
+			i++
+		} else {
+			plain = append(plain, p)
+		}
+	}
+	copy(peers[i:], plain)
+}
@@ -0,0 +1,56 @@
+package cryptopeers
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func announce(id byte, crypto bittorrent.Crypto) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		Crypto: crypto,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             1234,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{10, 0, 0, id})}},
+		},
+	}
+}
+
+func TestPreferCrypto(t *testing.T) {
+	f := newFilter(time.Hour)
+	ctx := context.Background()
+	var peers bittorrent.Peers
+	for i, c := range []bittorrent.Crypto{bittorrent.CryptoNone, bittorrent.CryptoSupported, bittorrent.CryptoNone, bittorrent.CryptoRequired} {
+		req := announce(byte(i+1), c)
+		require.Nil(t, f.FilterAnnounce(ctx, req, &bittorrent.AnnounceResponse{}))
+		peers = append(peers, req.Peers()...)
+	}
+
+	respPeers := func() bittorrent.Peers { return append(bittorrent.Peers{}, peers...) }
+
+	// client does not require encryption, response is not modified
+	resp := &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	require.Nil(t, f.FilterAnnounce(ctx, announce(0xFF, bittorrent.CryptoSupported), resp))
+	require.Equal(t, peers, resp.IPv4Peers)
+
+	resp = &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	require.Nil(t, f.FilterAnnounce(ctx, announce(0xFF, bittorrent.CryptoRequired), resp))
+	require.Equal(t, bittorrent.Peers{peers[1], peers[3], peers[0], peers[2]}, resp.IPv4Peers)
+
+	// peer re-announced without encryption
+	require.Nil(t, f.FilterAnnounce(ctx, announce(2, bittorrent.CryptoNone), &bittorrent.AnnounceResponse{}))
+	resp = &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	require.Nil(t, f.FilterAnnounce(ctx, announce(0xFF, bittorrent.CryptoRequired), resp))
+	require.Equal(t, bittorrent.Peers{peers[3], peers[0], peers[1], peers[2]}, resp.IPv4Peers)
+
+	// expired
+	resp = &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	f.sortFirst(resp.IPv4Peers, time.Now().Add(2*time.Hour).UnixNano())
+	require.Equal(t, peers, resp.IPv4Peers)
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/storage"
+)
+
+// defaultDegradedInterval is the announce interval sent to
+// clients in degraded mode if interval is not set
+const defaultDegradedInterval = 30 * time.Minute
+
+// DegradedConfig holds options of degraded mode, in which
+// announces and scrapes are answered without storage interaction
+// while storage is not available (i.e. reconnecting or warming up).
+type DegradedConfig struct {
+	// CheckInterval is the period of storage availability checks.
+	// Degraded mode is disabled if 0.
+	CheckInterval time.Duration
+	// Interval is the announce interval sent to clients
+	// in degraded mode.
+	Interval time.Duration
+}
+
+// storageWatcher periodically checks if storage is available.
+// Storage is treated as unavailable until the first successful check.
+// Nil watcher always reports storage as available.
+type storageWatcher struct {
+	store     storage.PeerStorage
+	timeout   time.Duration
+	available atomic.Bool
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func newStorageWatcher(store storage.PeerStorage, cfg DegradedConfig) *storageWatcher {
+	if cfg.CheckInterval <= 0 || store == nil {
+		return nil
+	}
+	w := &storageWatcher{
+		store:   store,
+		timeout: cfg.CheckInterval,
+		closed:  make(chan any),
+	}
+	promStorageDegraded.Set(1)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		t := time.NewTicker(cfg.CheckInterval)
+		defer t.Stop()
+		for {
+			w.check()
+			select {
+			case <-w.closed:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return w
+}
+
+// check pings storage and switches degraded mode
+// if storage availability changed
+func (w *storageWatcher) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	err := w.store.Ping(ctx)
+	cancel()
+	available := err == nil
+	if w.available.Swap(available) == available {
+		if !available {
+			logger.Debug().Err(err).Msg("storage is still unavailable")
+		}
+		return
+	}
+	if available {
+		promStorageDegraded.Set(0)
+		logger.Info().Msg("storage available, degraded mode disabled")
+	} else {
+		promStorageDegraded.Set(1)
+		logger.Warn().Err(err).Msg("storage unavailable, degraded mode enabled")
+	}
+}
+
+// degraded reports if storage is not available
+func (w *storageWatcher) degraded() bool {
+	return w != nil && !w.available.Load()
+}
+
+func (w *storageWatcher) Close() {
+	if w == nil {
+		return
+	}
+	w.onceCloser.Do(func() {
+		close(w.closed)
+		w.wg.Wait()
+	})
+}
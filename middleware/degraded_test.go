@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// unavailableStorage fails Ping and counts swarm reads while down
+type unavailableStorage struct {
+	storage.PeerStorage
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+func (s *unavailableStorage) Ping(ctx context.Context) error {
+	if s.down.Load() {
+		return errStorageDown
+	}
+	return s.PeerStorage.Ping(ctx)
+}
+
+func (s *unavailableStorage) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	s.calls.Add(1)
+	if s.down.Load() {
+		return 0, 0, 0, errStorageDown
+	}
+	return s.PeerStorage.ScrapeSwarm(ctx, ih)
+}
+
+func TestDegradedMode(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	us := &unavailableStorage{PeerStorage: ps}
+	us.down.Store(true)
+	l := NewLogic(time.Minute, time.Minute, us, nil, nil)
+	defer l.Close()
+	l.SetDegradedConfig(DegradedConfig{CheckInterval: 10 * time.Millisecond, Interval: time.Hour})
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 1, RequestPeer: bittorrent.RequestPeer{
+		ID:               bittorrent.PeerID{1},
+		Port:             6881,
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+	}}
+	ctx := context.Background()
+
+	// storage is unavailable since start
+	_, resp, err := l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, time.Hour, resp.MinInterval)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Equal(t, req.Peers(), resp.IPv4Peers)
+	l.AfterAnnounce(ctx, req, resp)
+
+	_, scr, err := l.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih}}, scr.Data)
+	require.Zero(t, us.calls.Load())
+	require.Equal(t, float64(1), testutil.ToFloat64(promStorageDegraded))
+	// nothing is written while degraded
+	exists, err := storage.PeerExists(ctx, ps, ih, req.Peers()[0], false)
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// storage recovered
+	us.down.Store(false)
+	require.Eventually(t, func() bool { return !l.watcher.degraded() }, time.Second, 5*time.Millisecond)
+	require.Equal(t, float64(0), testutil.ToFloat64(promStorageDegraded))
+	_, resp, err = l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, resp.Interval)
+	require.NotZero(t, us.calls.Load())
+	l.AfterAnnounce(ctx, req, resp)
+	exists, err = storage.PeerExists(ctx, ps, ih, req.Peers()[0], false)
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	// storage went down again
+	us.down.Store(true)
+	require.Eventually(t, l.watcher.degraded, time.Second, 5*time.Millisecond)
+	_, resp, err = l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, resp.Interval)
+	// stopped peer is deleted anyway
+	req.Event = bittorrent.Stopped
+	_, resp, err = l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	l.AfterAnnounce(ctx, req, resp)
+	exists, err = storage.PeerExists(ctx, ps, ih, req.Peers()[0], false)
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// disabled mode
+	l.SetDegradedConfig(DegradedConfig{})
+	require.Nil(t, l.watcher)
+	require.False(t, l.watcher.degraded())
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+var (
+	filterBuildersMU sync.RWMutex
+	filterBuilders   = make(map[string]FilterBuilder)
+)
+
+// ResponseFilter is the final step of announce processing.
+// It receives fully assembled response (after all pre-hooks) and may
+// modify it, i.e. drop some peers or adjust interval.
+type ResponseFilter interface {
+	FilterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error
+}
+
+// ResponseFilterFunc is an adapter to allow the use of ordinary functions
+// as ResponseFilter
+type ResponseFilterFunc func(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error
+
+// FilterAnnounce calls f(ctx, req, resp)
+func (f ResponseFilterFunc) FilterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	return f(ctx, req, resp)
+}
+
+// FilterBuilder is the function used to initialize a new ResponseFilter
+// with provided configuration.
+type FilterBuilder func(conf.MapConfig) (ResponseFilter, error)
+
+// RegisterFilterBuilder makes a FilterBuilder available by the provided name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// FilterBuilder is nil, this function panics.
+func RegisterFilterBuilder(name string, b FilterBuilder) {
+	if name == "" {
+		panic("middleware: could not register FilterBuilder with an empty name")
+	}
+	if b == nil {
+		panic("middleware: could not register a nil FilterBuilder")
+	}
+
+	filterBuildersMU.Lock()
+	defer filterBuildersMU.Unlock()
+
+	if _, dup := filterBuilders[name]; dup {
+		panic("middleware: RegisterFilterBuilder called twice for " + name)
+	}
+
+	filterBuilders[name] = b
+}
+
+// NewResponseFilters is a utility function for initializing ResponseFilter-s in bulk.
+func NewResponseFilters(configs []conf.NamedMapConfig) (filters []ResponseFilter, err error) {
+	filterBuildersMU.RLock()
+	defer filterBuildersMU.RUnlock()
+	for _, c := range configs {
+		logger.Debug().Str("name", c.Name).Object("filter", c).Msg("starting response filter")
+		newFilter, ok := filterBuilders[c.Name]
+		if !ok {
+			err = fmt.Errorf("response filter with name '%s' does not exists", c.Name)
+			break
+		}
+		var f ResponseFilter
+		if f, err = newFilter(c.Config); err != nil {
+			break
+		}
+		filters = append(filters, f)
+		logger.Info().Str("name", c.Name).Msg("response filter started")
+	}
+
+	return
+}
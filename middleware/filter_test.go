@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestResponseFilter(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	for i := byte(1); i <= 5; i++ {
+		require.Nil(t, ps.PutSeeder(ctx, ih, bittorrent.Peer{
+			ID:       bittorrent.PeerID{i},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, i}), 1234),
+		}))
+	}
+
+	truncate := ResponseFilterFunc(func(_ context.Context, _ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+		if len(resp.IPv4Peers) > 2 {
+			resp.IPv4Peers = resp.IPv4Peers[:2]
+		}
+		return nil
+	})
+
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		NumWant:  50,
+		Left:     1,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{0xFF},
+			Port:             4321,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.1.1")}},
+		},
+	}
+
+	_, resp, err := NewLogic(0, 0, ps, nil, nil).HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Len(t, resp.IPv4Peers, 5)
+
+	_, resp, err = NewLogic(0, 0, ps, nil, nil, truncate).HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Len(t, resp.IPv4Peers, 2)
+}
@@ -0,0 +1,188 @@
+// Package frontendpeers implements a ResponseFilter, which remembers
+// frontend, via which peers announced, and returns peers of the same
+// frontend to clients (i.e. only WebSocket-signaled peers to WebTorrent clients).
+package frontendpeers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+// Name is the name by which this filter is registered with Conf.
+const Name = "same frontend"
+
+const defaultTTL = time.Hour
+
+// defaultExclusive is the list of frontends, clients of which
+// can connect only to peers of the same frontend
+var defaultExclusive = []string{"websocket"}
+
+var logger = log.NewLogger("middleware/same frontend")
+
+func init() {
+	middleware.RegisterFilterBuilder(Name, build)
+}
+
+// Config represents the configuration for the frontendpeers filter.
+type Config struct {
+	// TTL is the duration for which frontend of peer is
+	// remembered after the last announce.
+	TTL time.Duration `cfg:"ttl"`
+	// Exclusive is the list of frontends names, clients of which
+	// get only peers announced via the same frontend.
+	// Clients of other frontends get peers of the same frontend first.
+	Exclusive []string `cfg:"exclusive"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.TTL <= 0 {
+		validCfg.TTL = defaultTTL
+		logger.Warn().
+			Str("name", "TTL").
+			Dur("provided", cfg.TTL).
+			Dur("default", validCfg.TTL).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.Exclusive) == 0 {
+		validCfg.Exclusive = defaultExclusive
+		logger.Warn().
+			Str("name", "Exclusive").
+			Strs("provided", cfg.Exclusive).
+			Strs("default", validCfg.Exclusive).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+// tag is the frontend of peer and time, until which it is valid
+type tag struct {
+	frontend string
+	until    int64
+}
+
+// filter holds frontends of announced peers.
+// Data is process-local and not shared between tracker instances.
+type filter struct {
+	sync.RWMutex
+	ttl       int64
+	nextClean int64
+	exclusive map[string]bool
+	peers     map[bittorrent.Peer]tag
+}
+
+func build(config conf.MapConfig) (middleware.ResponseFilter, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("filter %s: %w", Name, err)
+	}
+	cfg = cfg.Validate()
+	return newFilter(cfg.TTL, cfg.Exclusive), nil
+}
+
+func newFilter(ttl time.Duration, exclusive []string) *filter {
+	f := &filter{
+		ttl:       int64(ttl),
+		exclusive: make(map[string]bool, len(exclusive)),
+		peers:     make(map[bittorrent.Peer]tag),
+	}
+	for _, fe := range exclusive {
+		f.exclusive[fe] = true
+	}
+	return f
+}
+
+func (f *filter) FilterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	fe := bittorrent.FrontendFromContext(ctx)
+	if len(fe) == 0 {
+		return nil
+	}
+	now := timecache.NowUnixNano()
+	f.update(req, fe, now)
+	if f.exclusive[fe] {
+		resp.IPv4Peers = f.retain(resp.IPv4Peers, fe, now)
+		resp.IPv6Peers = f.retain(resp.IPv6Peers, fe, now)
+	} else {
+		f.sortFirst(resp.IPv4Peers, fe, now)
+		f.sortFirst(resp.IPv6Peers, fe, now)
+	}
+	return nil
+}
+
+// update remembers frontend of requester or forgets it
+// if client stopped, and removes outdated records
+// not more often than once per ttl
+func (f *filter) update(req *bittorrent.AnnounceRequest, fe string, now int64) {
+	peers := req.Peers()
+	f.Lock()
+	defer f.Unlock()
+	for _, p := range peers {
+		if req.Event == bittorrent.Stopped {
+			delete(f.peers, p)
+		} else {
+			f.peers[p] = tag{frontend: fe, until: now + f.ttl}
+		}
+	}
+	if now >= f.nextClean {
+		for p, t := range f.peers {
+			if t.until <= now {
+				delete(f.peers, p)
+			}
+		}
+		f.nextClean = now + f.ttl
+	}
+}
+
+// same checks if peer is remembered as announced via frontend,
+// must be called with locked mutex
+func (f *filter) same(p bittorrent.Peer, fe string, now int64) bool {
+	t, found := f.peers[p]
+	return found && t.until > now && t.frontend == fe
+}
+
+// retain removes peers, which are not announced via frontend,
+// from provided slice
+func (f *filter) retain(peers bittorrent.Peers, fe string, now int64) bittorrent.Peers {
+	f.RLock()
+	defer f.RUnlock()
+	res := peers[:0]
+	for _, p := range peers {
+		if f.same(p, fe, now) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// sortFirst moves peers announced via frontend to the beginning of
+// provided slice, preserving order of other peers
+func (f *filter) sortFirst(peers bittorrent.Peers, fe string, now int64) {
+	f.RLock()
+	defer f.RUnlock()
+	if len(f.peers) == 0 || len(peers) < 2 {
+		return
+	}
+	other := make(bittorrent.Peers, 0, len(peers))
+	i := 0
+	for _, p := range peers {
+		if f.same(p, fe, now) {
+			peers[i] = p
+			i++
+		} else {
+			other = append(other, p)
+		}
+	}
+	copy(peers[i:], other)
+}
@@ -0,0 +1,59 @@
+package frontendpeers
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func announce(id byte) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             1234,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{10, 0, 0, id})}},
+		},
+	}
+}
+
+func TestSameFrontend(t *testing.T) {
+	f := newFilter(time.Hour, defaultExclusive)
+	var peers bittorrent.Peers
+	for i, fe := range []string{"udp", "websocket", "http", "websocket"} {
+		req := announce(byte(i + 1))
+		ctx := bittorrent.InjectFrontendToContext(context.Background(), fe)
+		require.Nil(t, f.FilterAnnounce(ctx, req, &bittorrent.AnnounceResponse{}))
+		peers = append(peers, req.Peers()...)
+	}
+
+	respPeers := func() bittorrent.Peers { return append(bittorrent.Peers{}, peers...) }
+
+	// WebSocket client gets only WebSocket peers
+	wsCtx := bittorrent.InjectFrontendToContext(context.Background(), "websocket")
+	resp := &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	require.Nil(t, f.FilterAnnounce(wsCtx, announce(0xFF), resp))
+	require.Equal(t, bittorrent.Peers{peers[1], peers[3]}, resp.IPv4Peers)
+
+	// HTTP client gets HTTP peers first
+	resp = &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	require.Nil(t, f.FilterAnnounce(bittorrent.InjectFrontendToContext(context.Background(), "http"), announce(0xFE), resp))
+	require.Equal(t, bittorrent.Peers{peers[2], peers[0], peers[1], peers[3]}, resp.IPv4Peers)
+
+	// request without frontend is not modified
+	resp = &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	require.Nil(t, f.FilterAnnounce(context.Background(), announce(0xFD), resp))
+	require.Equal(t, peers, resp.IPv4Peers)
+
+	// stopped peer is forgotten
+	req := announce(2)
+	req.Event = bittorrent.Stopped
+	require.Nil(t, f.FilterAnnounce(wsCtx, req, &bittorrent.AnnounceResponse{}))
+	resp = &bittorrent.AnnounceResponse{IPv4Peers: respPeers()}
+	require.Nil(t, f.FilterAnnounce(wsCtx, announce(0xFF), resp))
+	require.Equal(t, bittorrent.Peers{peers[3]}, resp.IPv4Peers)
+}
@@ -2,9 +2,19 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/timecache"
 	"github.com/sot-tech/mochi/storage"
 )
 
@@ -28,6 +38,51 @@ type Pinger interface {
 	Ping(ctx context.Context) error
 }
 
+// Denier is an optional interface that may be implemented by a pre Hook
+// which is able to forbid announces of info hash at runtime
+// (i.e. by adding it into blacklist). Used in frontend.Logic to prevent
+// re-population of purged swarms.
+type Denier interface {
+	Deny(ctx context.Context, ih bittorrent.InfoHash) error
+}
+
+// Reloader is an optional interface that may be implemented by a pre Hook
+// which is able to re-read its data source out-of-band (i.e. list of
+// approved torrents). Used in frontend.Logic to force reload.
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
+// IntervalChecker is an optional interface that may be implemented by a Hook
+// which keeps state of peers between their announces, so its configuration
+// depends on announce interval. Used in CheckIntervals.
+type IntervalChecker interface {
+	// CheckInterval returns error if Hook is not able to work
+	// with provided announce interval
+	CheckInterval(announceInterval time.Duration) error
+}
+
+// CheckIntervals checks if configuration of all hooks, which implement
+// IntervalChecker, is compatible with provided announce interval.
+func CheckIntervals(announceInterval time.Duration, hooks ...Hook) error {
+	for _, h := range hooks {
+		if c, isOk := h.(IntervalChecker); isOk {
+			if err := c.CheckInterval(announceInterval); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Warmer is an optional interface that may be implemented by a pre Hook
+// which requires some warmup (i.e. initial data loading) before it can
+// serve requests. Used in frontend.Logic to check readiness.
+type Warmer interface {
+	// WarmedUp returns true if Hook has finished warmup
+	WarmedUp() bool
+}
+
 type skipSwarmInteraction struct{}
 
 // SkipSwarmInteractionKey is a key for the context of an Announce to control
@@ -36,8 +91,117 @@ type skipSwarmInteraction struct{}
 // middleware to skip.
 var SkipSwarmInteractionKey = skipSwarmInteraction{}
 
+type seedingGrace struct{}
+
+// SeedingGraceKey is a key for the context of an Announce to control
+// how the swarm interaction middleware should store peer, which
+// announced with `left=0`.
+// If value is true, peer is in grace period and will be stored as a leecher,
+// if value is false, grace period is finished and peer will be moved
+// from leechers to seeders.
+var SeedingGraceKey = seedingGrace{}
+
+type hidePeerIDs struct{}
+
+// HidePeerIDsKey is a key for the context of an Announce to protect
+// privacy of peers. Any non-nil value set for this key will cause
+// frontends to never emit peer IDs in announce response (i.e. HTTP
+// frontend always uses compact form, regardless of request parameters).
+var HidePeerIDsKey = hidePeerIDs{}
+
+type emptyScrape struct{}
+
+// EmptyScrapeKey is a key for the context of a Scrape to hide statistics
+// of some info hashes. Value should be map[bittorrent.InfoHash]struct{},
+// contained info hashes are answered by the response middleware with zeroes
+// without storage lookup.
+var EmptyScrapeKey = emptyScrape{}
+
+type swarmNamespace struct{}
+
+// SwarmNamespaceKey is a key for the context of an Announce or Scrape to
+// store and count peers in a separate swarm. Value should be non-empty string,
+// the swarm interaction and the response middlewares use info hash derived
+// from the requested one and the namespace, so peers of different namespaces
+// are never returned to each other (i.e. WebRTC peers to BitTorrent clients).
+// Other middlewares see the requested info hash.
+// Namespace should be registered with RegisterSwarmNamespace.
+var SwarmNamespaceKey = swarmNamespace{}
+
+var (
+	swarmNamespacesMu sync.RWMutex
+	swarmNamespaces   []string
+)
+
+// RegisterSwarmNamespace registers namespace, which is set with
+// SwarmNamespaceKey (i.e. by frontend), so Logic.PurgeSwarm
+// purges swarms of info hash in this namespace too.
+func RegisterSwarmNamespace(ns string) {
+	swarmNamespacesMu.Lock()
+	defer swarmNamespacesMu.Unlock()
+	if len(ns) > 0 && !slices.Contains(swarmNamespaces, ns) {
+		swarmNamespaces = append(swarmNamespaces, ns)
+	}
+}
+
+// swarmHashes returns all swarm hashes of ih: ih itself and its
+// hashes in registered namespaces, and their truncated v1 forms if
+// ih is v2
+func swarmHashes(ctx context.Context, ih bittorrent.InfoHash) []bittorrent.InfoHash {
+	hashes := []bittorrent.InfoHash{ih}
+	swarmNamespacesMu.RLock()
+	for _, ns := range swarmNamespaces {
+		nsCtx := context.WithValue(ctx, SwarmNamespaceKey, ns)
+		hashes = append(hashes, swarmHash(nsCtx, ih))
+		if len(ih) == bittorrent.InfoHashV2Len {
+			hashes = append(hashes, swarmHash(nsCtx, ih.TruncateV1()))
+		}
+	}
+	swarmNamespacesMu.RUnlock()
+	if len(ih) == bittorrent.InfoHashV2Len {
+		for _, h := range hashes {
+			if len(h) == bittorrent.InfoHashV2Len {
+				hashes = append(hashes, h.TruncateV1())
+			}
+		}
+	}
+	slices.Sort(hashes)
+	return slices.Compact(hashes)
+}
+
+func init() {
+	// flags set by pre-hooks should reach post-hooks
+	bittorrent.PreserveInBgContext(SkipSwarmInteractionKey)
+	bittorrent.PreserveInBgContext(SkipResponseHookKey)
+	bittorrent.PreserveInBgContext(SeedingGraceKey)
+	bittorrent.PreserveInBgContext(SwarmNamespaceKey)
+}
+
+// swarmHash returns info hash of swarm, in which peers of ih are stored:
+// ih itself or, if SwarmNamespaceKey set, the first len(ih) bytes
+// of SHA-256 of namespace and ih
+func swarmHash(ctx context.Context, ih bittorrent.InfoHash) bittorrent.InfoHash {
+	ns, _ := ctx.Value(SwarmNamespaceKey).(string)
+	if len(ns) == 0 {
+		return ih
+	}
+	h := sha256.New()
+	_, _ = h.Write([]byte(ns))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(ih.Bytes())
+	return bittorrent.InfoHash(h.Sum(nil)[:len(ih)])
+}
+
 type swarmInteractionHook struct {
 	store storage.PeerStorage
+	// if not nil, stopped peer is also deleted by PeerID
+	// from swarm of another address family
+	idDeleter storage.PeerIDDeleter
+	// if true, identifiable scraping peer is refreshed
+	refreshOnScrape bool
+	breaker         *circuitBreaker
+	limiter         *storageLimiter
+	watcher         *storageWatcher
 }
 
 func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (outCtx context.Context, err error) {
@@ -45,25 +209,59 @@ func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorre
 	if ctx.Value(SkipSwarmInteractionKey) != nil {
 		return
 	}
+	// storage is failing, peer will be stored with next announce.
+	// Stopped peer will not announce again, so its deletion is attempted
+	// anyway, otherwise it would stay in swarm until garbage collection.
+	stopped := req.Event == bittorrent.Stopped
+	if !stopped && (h.watcher.degraded() || !h.breaker.closed()) {
+		return
+	}
+	// storage is overloaded
+	if !h.limiter.acquire(ctx) {
+		return
+	}
+	defer func() {
+		h.limiter.release()
+		h.breaker.done(false, err, timecache.Now())
+	}()
+
+	if stopped {
+		return outCtx, h.stop(ctx, req)
+	}
 
 	var storeFn func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error
 
 	switch {
-	case req.Event == bittorrent.Stopped:
-		storeFn = func(ctx context.Context, hash bittorrent.InfoHash, peer bittorrent.Peer) error {
-			err = h.store.DeleteSeeder(ctx, hash, peer)
-			if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
-				return err
+	case req.LeftUnknown():
+		// client is not able to claim completion without
+		// knowing torrent size, so it is never a seeder
+		logger.Debug().Object("request", req).Msg("announce with unknown left, storing as leecher")
+		storeFn = h.store.PutLeecher
+	case req.Event == bittorrent.Completed:
+		storeFn = h.store.GraduateLeecher
+	case req.Left == 0 && ctx.Value(SeedingGraceKey) != nil:
+		if inGrace, _ := ctx.Value(SeedingGraceKey).(bool); inGrace {
+			storeFn = func(ctx context.Context, hash bittorrent.InfoHash, peer bittorrent.Peer) error {
+				// grace state of known seeder may be lost (i.e. after restart),
+				// such peer is refreshed as seeder, not counted as leecher again
+				seeder, err := storage.PeerExists(ctx, h.store, hash, peer, true)
+				if err != nil && !errors.Is(err, storage.ErrPeerCheckNotSupported) {
+					return err
+				}
+				if seeder {
+					return h.store.PutSeeder(ctx, hash, peer)
+				}
+				return h.store.PutLeecher(ctx, hash, peer)
 			}
-
-			err = h.store.DeleteLeecher(ctx, hash, peer)
-			if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
-				return err
+		} else {
+			storeFn = func(ctx context.Context, hash bittorrent.InfoHash, peer bittorrent.Peer) error {
+				err = h.store.DeleteLeecher(ctx, hash, peer)
+				if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+					return err
+				}
+				return h.store.PutSeeder(ctx, hash, peer)
 			}
-			return nil
 		}
-	case req.Event == bittorrent.Completed:
-		storeFn = h.store.GraduateLeecher
 	case req.Left == 0:
 		// Completed events will also have Left == 0, but by making this
 		// an extra case we can treat "old" seeders differently from
@@ -73,9 +271,15 @@ func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorre
 	default:
 		storeFn = h.store.PutLeecher
 	}
+	ctx = storage.WithPeerStats(ctx, storage.PeerStats{
+		Uploaded:   req.Uploaded,
+		Downloaded: req.Downloaded,
+		Left:       req.Left,
+	})
+	ih := swarmHash(ctx, req.InfoHash)
 	for _, p := range req.Peers() {
-		if err = storeFn(ctx, req.InfoHash, p); err == nil && len(req.InfoHash) == bittorrent.InfoHashV2Len {
-			err = storeFn(ctx, req.InfoHash.TruncateV1(), p)
+		if err = storeFn(ctx, ih, p); err == nil && len(ih) == bittorrent.InfoHashV2Len {
+			err = storeFn(ctx, ih.TruncateV1(), p)
 		}
 		if err != nil {
 			break
@@ -85,11 +289,104 @@ func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorre
 	return
 }
 
-func (h *swarmInteractionHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
-	// Scrapes have no effect on the swarm.
+// stop deletes all peers of stopped request from swarm
+// with one storage call
+func (h *swarmInteractionHook) stop(ctx context.Context, req *bittorrent.AnnounceRequest) error {
+	peers, ih := req.Peers(), swarmHash(ctx, req.InfoHash)
+	hashes := []bittorrent.InfoHash{ih}
+	if len(ih) == bittorrent.InfoHashV2Len {
+		hashes = append(hashes, ih.TruncateV1())
+	}
+	for _, ih := range hashes {
+		err := storage.DeletePeers(ctx, h.store, ih, peers...)
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			return err
+		}
+		if h.idDeleter == nil {
+			continue
+		}
+		for _, p := range peers {
+			err = h.idDeleter.DeletePeerID(ctx, ih, p.ID, !p.Addr().Is6())
+			if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *swarmInteractionHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (_ context.Context, err error) {
+	// Scrapes have no effect on the swarm, except refreshing
+	// of already stored scraping peer, if it is identifiable
+	if !h.refreshOnScrape || h.watcher.degraded() || !h.breaker.closed() {
+		return ctx, nil
+	}
+	peers := scrapePeers(req)
+	if len(peers) == 0 || !h.limiter.acquire(ctx) {
+		return ctx, nil
+	}
+	defer func() {
+		h.limiter.release()
+		h.breaker.done(false, err, timecache.Now())
+	}()
+	for _, ih := range req.InfoHashes {
+		ih = swarmHash(ctx, ih)
+		for _, p := range peers {
+			if err = h.refresh(ctx, ih, p); err != nil {
+				return ctx, err
+			}
+		}
+	}
 	return ctx, nil
 }
 
+// scrapePeers returns peers of scrape request if it contains
+// `peer_id` and `port` parameters (some HTTP clients send them)
+func scrapePeers(req *bittorrent.ScrapeRequest) bittorrent.Peers {
+	if req.Params == nil {
+		return nil
+	}
+	idStr, ok := req.Params.GetString("peer_id")
+	if !ok {
+		return nil
+	}
+	portStr, ok := req.Params.GetString("port")
+	if !ok {
+		return nil
+	}
+	id, err := bittorrent.NewPeerID([]byte(idStr))
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil
+	}
+	return bittorrent.RequestPeer{
+		ID:               id,
+		Port:             uint16(port),
+		RequestAddresses: req.RequestAddresses,
+	}.Peers()
+}
+
+// refresh updates modification time of peer if it is already stored.
+// Unknown peers are not stored.
+func (h *swarmInteractionHook) refresh(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	for _, seeder := range []bool{true, false} {
+		exists, err := storage.PeerExists(ctx, h.store, ih, p, seeder)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if seeder {
+				return h.store.PutSeeder(ctx, ih, p)
+			}
+			return h.store.PutLeecher(ctx, ih, p)
+		}
+	}
+	return nil
+}
+
 type skipResponseHook struct{}
 
 // SkipResponseHookKey is a key for the context of an Announce or Scrape to
@@ -99,7 +396,39 @@ type skipResponseHook struct{}
 var SkipResponseHookKey = skipResponseHook{}
 
 type responseHook struct {
-	store storage.PeerStorage
+	store   storage.PeerStorage
+	cfg     ResponseConfig
+	breaker *circuitBreaker
+	limiter *storageLimiter
+	// announce interval sent while breaker is open
+	breakerInterval time.Duration
+	watcher         *storageWatcher
+	// announce interval sent while storage is unavailable
+	degradedInterval time.Duration
+	// peers announced with BehindNATKey
+	nat *natPeers
+	// if not nil, peers subsets are preserved for sessions
+	sticky *stickyPeers
+	// if not nil, recently returned peers are not preferred
+	recent *recentPeers
+	// if not nil, peers samples and counts are shared between announces
+	cache *responseCache
+	// if not nil, peers of related swarms top up thin swarms
+	related *relatedSwarms
+	// if not nil, storage latency is reported to it
+	backpressure *backpressure
+}
+
+// selectionSeed returns seed of deterministic peers selection
+// for provided request within time bucket
+func selectionSeed(req *bittorrent.AnnounceRequest, bucket int64) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(req.InfoHash.Bytes())
+	_, _ = h.Write(req.ID[:])
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(bucket))
+	_, _ = h.Write(b[:])
+	return h.Sum64()
 }
 
 func (h *responseHook) scrape(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
@@ -123,8 +452,42 @@ func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.Annou
 		return ctx, nil
 	}
 
+	if ctx.Value(BehindNATKey) != nil {
+		h.nat.add(req.Peers(), timecache.NowUnixNano())
+	}
+
+	if h.watcher.degraded() {
+		h.minimalResponse(req, resp, h.degradedInterval)
+		return ctx, nil
+	}
+
+	if !h.limiter.acquire(ctx) {
+		h.minimalResponse(req, resp, h.breakerInterval)
+		return ctx, nil
+	}
+	defer h.limiter.release()
+
+	allowed, probe := h.breaker.allow(timecache.Now())
+	if !allowed {
+		h.minimalResponse(req, resp, h.breakerInterval)
+		return ctx, nil
+	}
+	start := time.Now()
+	defer func() {
+		h.breaker.done(probe, err, timecache.Now())
+		h.backpressure.observe(time.Since(start))
+	}()
+
 	// Add the Scrape data to the response.
-	resp.Incomplete, resp.Complete, _, err = h.scrape(ctx, req.InfoHash)
+	ih := swarmHash(ctx, req.InfoHash)
+	if h.cache != nil {
+		resp.Incomplete, resp.Complete, err = h.cache.scrape(ih, timecache.NowUnixNano(), func() (l, s uint32, err error) {
+			l, s, _, err = h.scrape(ctx, ih)
+			return
+		})
+	} else {
+		resp.Incomplete, resp.Complete, _, err = h.scrape(ctx, ih)
+	}
 	if err != nil {
 		return
 	}
@@ -133,22 +496,76 @@ func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.Annou
 	return ctx, err
 }
 
+// minimalResponse fills response without storage interaction:
+// the only peer is the requester itself.
+// Intervals of response are set to interval if it is positive.
+func (*responseHook) minimalResponse(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, interval time.Duration) {
+	if interval > 0 {
+		resp.Interval, resp.MinInterval = interval, interval
+	}
+	if req.Left == 0 {
+		resp.Complete = 1
+	} else {
+		resp.Incomplete = 1
+	}
+	for _, p := range req.Peers() {
+		if p.Addr().Is6() {
+			resp.IPv6Peers = append(resp.IPv6Peers, p)
+		} else {
+			resp.IPv4Peers = append(resp.IPv4Peers, p)
+		}
+	}
+}
+
 type fetchArgs struct {
 	ih bittorrent.InfoHash
 	v6 bool
 }
 
+// scaledSample returns the maximal number of peers returned from swarm
+// of provided size according to PeerSampleScaling function,
+// but not less than PeerSampleMin and 1
+func (h *responseHook) scaledSample(swarmSize uint32) int {
+	var scaled float64
+	switch h.cfg.PeerSampleScaling {
+	case SampleScalingSqrt:
+		scaled = math.Sqrt(float64(swarmSize))
+	case SampleScalingLog2:
+		scaled = math.Log2(float64(swarmSize))
+	default:
+		return math.MaxInt
+	}
+	return max(int(math.Ceil(scaled)), int(h.cfg.PeerSampleMin), 1)
+}
+
 func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (err error) {
 	seeding := req.Left == 0
 	maxPeers := int(req.NumWant)
+	if f := h.cfg.PeriodicNumWantFactor; f > 0 && req.Event == bittorrent.None {
+		// requested numwant is already clamped by frontend,
+		// scaled one is not less than 1 peer
+		maxPeers = max(int(float64(maxPeers)*f), min(maxPeers, 1))
+	}
+	maxPeers = min(maxPeers, h.scaledSample(resp.Complete+resp.Incomplete))
+	if m := h.cfg.MaxPeersReturned; m > 0 && maxPeers > int(m) {
+		maxPeers = int(m)
+	}
+	if w := h.cfg.DeterministicPeersWindow; w > 0 {
+		ctx = storage.WithSelectionSeed(ctx, selectionSeed(req, timecache.NowUnixNano()/int64(w)))
+	}
 	peers := make([]bittorrent.Peer, 0, len(resp.IPv4Peers)+len(resp.IPv6Peers))
 	primaryIP := req.GetFirst()
 	v6First := primaryIP.Is6()
-	args := []fetchArgs{{req.InfoHash, v6First}, {req.InfoHash, !v6First}}
+	ih := swarmHash(ctx, req.InfoHash)
+	args := []fetchArgs{{ih, v6First}, {ih, !v6First}}
 
-	if len(req.InfoHash) == bittorrent.InfoHashV2Len {
-		ih := req.InfoHash.TruncateV1()
-		args = append(args, fetchArgs{ih, v6First}, fetchArgs{ih, !v6First})
+	if len(ih) == bittorrent.InfoHashV2Len {
+		v1 := ih.TruncateV1()
+		args = append(args, fetchArgs{v1, v6First}, fetchArgs{v1, !v6First})
+	}
+	if ih == req.InfoHash {
+		// related swarms are not namespaced
+		args = append(args, h.related.fetchArgs(ih, resp.Complete+resp.Incomplete, v6First)...)
 	}
 
 	if v6First {
@@ -158,29 +575,65 @@ func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.Announce
 		peers = append(peers, resp.IPv4Peers...)
 		peers = append(peers, resp.IPv6Peers...)
 	}
+	var session stickySession
+	if h.sticky != nil {
+		if req.Event == bittorrent.Stopped {
+			err = h.sticky.drop(ctx, req)
+		} else {
+			session, err = h.sticky.session(ctx, req, resp, timecache.NowUnixNano())
+		}
+		if err != nil {
+			return err
+		}
+		peers = append(peers, session.peers...)
+	}
+	var recent map[bittorrent.Peer]struct{}
+	if h.recent != nil {
+		if req.Event == bittorrent.Stopped {
+			err = h.recent.drop(ctx, req)
+		} else {
+			recent, err = h.recent.load(ctx, req, timecache.NowUnixNano())
+		}
+		if err != nil {
+			return err
+		}
+	}
 	if l := len(peers); l > maxPeers {
 		peers, maxPeers = peers[:maxPeers], 0
 	} else {
 		maxPeers -= l
 	}
 
+	now := timecache.NowUnixNano()
 	for _, a := range args {
 		if maxPeers <= 0 {
 			break
 		}
 		var storePeers []bittorrent.Peer
-		storePeers, err = h.store.AnnouncePeers(ctx, a.ih, seeding, maxPeers, a.v6)
-		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+		// fetch more peers to be able to skip sticky and recently
+		// returned ones and ones behind NAT
+		numWant := maxPeers + len(session.peers) + len(recent) + h.nat.extra(maxPeers)
+		if h.cache != nil {
+			storePeers, err = h.cache.announcePeers(ctx, h.store, a.ih, seeding, numWant, a.v6, now)
+		} else {
+			storePeers, err = h.store.AnnouncePeers(ctx, a.ih, seeding, numWant, a.v6)
+		}
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) && !errors.Is(err, storage.ErrSwarmEmpty) {
 			return err
 		}
 		err = nil
+		storePeers = session.exclude(storePeers)
+		// peers behind NAT are returned only if there are not enough other peers
+		h.nat.sortLast(storePeers, now)
+		storePeers = preferNotRecent(storePeers, recent, maxPeers)
 		peers = append(peers, storePeers...)
 		maxPeers -= len(storePeers)
 	}
 
 	// Some clients expect a minimum of their own peer representation returned to
 	// them if they are the only peer in a swarm.
-	if len(peers) == 0 {
+	empty := len(peers) == 0
+	if empty {
 		if seeding {
 			resp.Complete++
 		} else {
@@ -208,21 +661,75 @@ func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.Announce
 			}
 		}
 	}
+	if metrics.Enabled() {
+		recordReturnedPeers(seeding, empty, resp)
+	}
 
+	if (h.sticky != nil || h.recent != nil) && req.Event != bittorrent.Stopped {
+		selected := make([]bittorrent.Peer, 0, len(resp.IPv4Peers)+len(resp.IPv6Peers))
+		for _, pp := range []bittorrent.Peers{resp.IPv4Peers, resp.IPv6Peers} {
+			for _, p := range pp {
+				if p.ID != req.ID {
+					selected = append(selected, p)
+				}
+			}
+		}
+		if h.sticky != nil && (session.expires <= now || !samePeers(selected, session.peers)) {
+			if err = h.sticky.save(ctx, session, selected, now); err != nil {
+				return
+			}
+		}
+		if h.recent != nil {
+			if err = h.recent.save(ctx, req, selected, now); err != nil {
+				return
+			}
+		}
+	}
 	return
 }
 
+// emptyScrapes fills scrape response with zeroes
+// without storage interaction
+func emptyScrapes(req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	for _, infoHash := range req.InfoHashes {
+		resp.Data = append(resp.Data, bittorrent.Scrape{InfoHash: infoHash})
+	}
+}
+
 func (h *responseHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (_ context.Context, err error) {
 	if ctx.Value(SkipResponseHookKey) != nil {
 		return ctx, nil
 	}
 
+	if h.watcher.degraded() || !h.limiter.acquire(ctx) {
+		emptyScrapes(req, resp)
+		return ctx, nil
+	}
+	defer h.limiter.release()
+
+	allowed, probe := h.breaker.allow(timecache.Now())
+	if !allowed {
+		emptyScrapes(req, resp)
+		return ctx, nil
+	}
+	defer func() {
+		h.breaker.done(probe, err, timecache.Now())
+	}()
+
+	hidden, _ := ctx.Value(EmptyScrapeKey).(map[bittorrent.InfoHash]struct{})
 	for _, infoHash := range req.InfoHashes {
 		scr := bittorrent.Scrape{InfoHash: infoHash}
-		scr.Incomplete, scr.Complete, scr.Snatches, err = h.scrape(ctx, infoHash)
+		if _, found := hidden[infoHash]; found {
+			resp.Data = append(resp.Data, scr)
+			continue
+		}
+		scr.Incomplete, scr.Complete, scr.Snatches, err = h.scrape(ctx, swarmHash(ctx, infoHash))
 		if err != nil {
 			return
 		}
+		if h.cfg.OmitEmptyScrapes && scr.Incomplete == 0 && scr.Complete == 0 {
+			continue
+		}
 		resp.Data = append(resp.Data, scr)
 	}
 
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/str2bytes"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// IntervalStorageCtx is the name of storage context where
+// announce interval overrides are placed. Key is raw info hash
+// and value is textual duration (i.e. `45m`).
+const IntervalStorageCtx = "MW_INTERVAL"
+
+// intervalErrorTTL is the maximal duration for which failed lookup
+// is cached as absence of override, so announces do not hit (and warn about)
+// failing storage every time.
+const intervalErrorTTL = 5 * time.Second
+
+type cachedInterval struct {
+	// zero if there is no override
+	interval time.Duration
+	expires  int64
+}
+
+// intervalOverrides loads per info hash announce intervals from
+// storage and caches them (as well as their absence) for ttl.
+// Failed lookups are cached as absence for intervalErrorTTL
+// (or ttl if it is shorter).
+type intervalOverrides struct {
+	store     storage.DataStorage
+	ttl       int64
+	mu        sync.Mutex
+	lastSweep int64
+	cache     map[string]cachedInterval
+}
+
+func newIntervalOverrides(store storage.DataStorage, ttl time.Duration) *intervalOverrides {
+	return &intervalOverrides{
+		store: store,
+		ttl:   int64(ttl),
+		cache: make(map[string]cachedInterval),
+	}
+}
+
+func (o *intervalOverrides) cached(key string, now int64) (cachedInterval, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if now-o.lastSweep >= o.ttl {
+		for k, c := range o.cache {
+			if now >= c.expires {
+				delete(o.cache, k)
+			}
+		}
+		o.lastSweep = now
+	}
+	c, found := o.cache[key]
+	return c, found && now < c.expires
+}
+
+func (o *intervalOverrides) load(ctx context.Context, ih bittorrent.InfoHash) (interval time.Duration, err error) {
+	now := timecache.NowUnixNano()
+	key := ih.RawString()
+	if c, found := o.cached(key, now); found {
+		return c.interval, nil
+	}
+	var v []byte
+	if v, err = o.store.Load(ctx, IntervalStorageCtx, key); err != nil {
+		o.mu.Lock()
+		o.cache[key] = cachedInterval{expires: now + min(o.ttl, int64(intervalErrorTTL))}
+		o.mu.Unlock()
+		return
+	}
+	if len(v) > 0 {
+		if interval, err = time.ParseDuration(str2bytes.BytesToString(v)); err != nil || interval < 0 {
+			logger.Warn().Err(err).
+				Stringer("infoHash", ih).
+				Bytes("value", v).
+				Msg("invalid announce interval override")
+			interval, err = 0, nil
+		}
+	}
+	o.mu.Lock()
+	o.cache[key] = cachedInterval{interval: interval, expires: now + o.ttl}
+	o.mu.Unlock()
+	return
+}
+
+// get returns announce interval override for info hash.
+// Hybrid info hash uses override of its v1 form if there is
+// no override for v2 one.
+// Returns zero if there is no override.
+func (o *intervalOverrides) get(ctx context.Context, ih bittorrent.InfoHash) (interval time.Duration, err error) {
+	if interval, err = o.load(ctx, ih); err == nil && interval == 0 && len(ih) == bittorrent.InfoHashV2Len {
+		interval, err = o.load(ctx, ih.TruncateV1())
+	}
+	return
+}
+
+// set stores (or deletes if interval is not positive)
+// override of info hash and drops its cached value
+func (o *intervalOverrides) set(ctx context.Context, ih bittorrent.InfoHash, interval time.Duration) (err error) {
+	key := ih.RawString()
+	if interval > 0 {
+		err = o.store.Put(ctx, IntervalStorageCtx, storage.Entry{Key: key, Value: []byte(interval.String())})
+	} else {
+		err = o.store.Delete(ctx, IntervalStorageCtx, key)
+	}
+	if err == nil {
+		o.mu.Lock()
+		delete(o.cache, key)
+		o.mu.Unlock()
+	}
+	return
+}
@@ -0,0 +1,239 @@
+package ipblock
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Supported blocklist file formats
+const (
+	// FormatAuto detects format of each line separately
+	FormatAuto = "auto"
+	// FormatDAT is eMule/uTorrent ipfilter.dat format:
+	// `start - end , access , description`
+	FormatDAT = "dat"
+	// FormatP2P is PeerGuardian text format:
+	// `description:start-end`
+	FormatP2P = "p2p"
+)
+
+// maxBlockedAccessLevel is the maximal access level of ipfilter.dat
+// record, which means that range should be blocked.
+// Records with level greater than this value are allowed.
+const maxBlockedAccessLevel = 127
+
+var (
+	errInvalidRange  = errors.New("invalid address range")
+	errInvalidAccess = errors.New("invalid access level")
+	errUnknownFormat = errors.New("unknown blocklist format")
+)
+
+// ipRange is the closed range of addresses of the same family
+type ipRange struct {
+	from, to netip.Addr
+}
+
+func newIPRange(from, to netip.Addr) (r ipRange, err error) {
+	from, to = from.Unmap(), to.Unmap()
+	if !from.IsValid() || !to.IsValid() || from.Is4() != to.Is4() {
+		err = errInvalidRange
+	} else {
+		if from.Compare(to) > 0 {
+			from, to = to, from
+		}
+		r = ipRange{from, to}
+	}
+	return
+}
+
+func prefixRange(p netip.Prefix) (ipRange, error) {
+	if !p.IsValid() {
+		return ipRange{}, errInvalidRange
+	}
+	p = p.Masked()
+	from := p.Addr()
+	b, bits := from.AsSlice(), p.Bits()
+	for i := range b {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			b[i] |= 0xff >> bits
+			bits = 0
+		default:
+			b[i] = 0xff
+		}
+	}
+	to, _ := netip.AddrFromSlice(b)
+	return newIPRange(from, to)
+}
+
+// rangeSet is sorted list of non-overlapping address ranges
+type rangeSet []ipRange
+
+// newRangeSet sorts provided ranges and merges overlapping
+// and adjacent ones
+func newRangeSet(rr []ipRange) rangeSet {
+	if len(rr) == 0 {
+		return nil
+	}
+	slices.SortFunc(rr, func(a, b ipRange) int {
+		return a.from.Compare(b.from)
+	})
+	s := make(rangeSet, 0, len(rr))
+	cur := rr[0]
+	for _, r := range rr[1:] {
+		if next := cur.to.Next(); r.from.Is4() == cur.to.Is4() &&
+			(r.from.Compare(cur.to) <= 0 || next.IsValid() && r.from == next) {
+			if r.to.Compare(cur.to) > 0 {
+				cur.to = r.to
+			}
+		} else {
+			s = append(s, cur)
+			cur = r
+		}
+	}
+	return append(s, cur)
+}
+
+// contains checks if address is in any of ranges
+func (s rangeSet) contains(a netip.Addr) bool {
+	a = a.Unmap().WithZone("")
+	i, _ := slices.BinarySearchFunc(s, a, func(r ipRange, a netip.Addr) int {
+		return r.to.Compare(a)
+	})
+	return i < len(s) && s[i].from.Compare(a) <= 0
+}
+
+// parseAddr parses IP address, additionally accepting IPv4
+// octets with leading zeros (`001.002.003.004`), which
+// are common in ipfilter.dat files
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, ':') < 0 && strings.IndexByte(s, '.') >= 0 {
+		octets := strings.Split(s, ".")
+		for i, o := range octets {
+			if o = strings.TrimLeft(o, "0"); len(o) == 0 {
+				o = "0"
+			}
+			octets[i] = o
+		}
+		s = strings.Join(octets, ".")
+	}
+	return netip.ParseAddr(s)
+}
+
+func parseRange(from, to string) (r ipRange, err error) {
+	var f, t netip.Addr
+	if f, err = parseAddr(from); err == nil {
+		if t, err = parseAddr(to); err == nil {
+			r, err = newIPRange(f, t)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %s-%s: %w", errInvalidRange, from, to, err)
+	}
+	return
+}
+
+// parseDATLine parses line of ipfilter.dat file:
+// `001.002.003.004 - 001.002.003.255 , 000 , Some organization`.
+// Access level and description are optional.
+// If access level is greater than maxBlockedAccessLevel,
+// function returns block == false.
+func parseDATLine(line string) (r ipRange, block bool, err error) {
+	fields := strings.SplitN(line, ",", 3)
+	from, to, found := strings.Cut(fields[0], "-")
+	if !found {
+		return r, false, fmt.Errorf("%w: %s", errInvalidRange, fields[0])
+	}
+	block = true
+	if len(fields) > 1 {
+		var level int
+		if level, err = strconv.Atoi(strings.TrimSpace(fields[1])); err != nil {
+			return r, false, fmt.Errorf("%w: %s", errInvalidAccess, fields[1])
+		}
+		block = level <= maxBlockedAccessLevel
+	}
+	if block {
+		r, err = parseRange(from, to)
+	}
+	return
+}
+
+// parseP2PLine parses line of PeerGuardian text file:
+// `Some organization:1.2.3.0-1.2.3.255`.
+// Description may contain colons, so the first position, after which
+// the rest of line is valid range, is used as delimiter.
+func parseP2PLine(line string) (r ipRange, err error) {
+	dash := strings.LastIndexByte(line, '-')
+	if dash < 0 {
+		return r, fmt.Errorf("%w: %s", errInvalidRange, line)
+	}
+	to := line[dash+1:]
+	err = fmt.Errorf("%w: %s", errInvalidRange, line)
+	for i := strings.IndexByte(line, ':'); i >= 0 && i < dash; {
+		if rr, e := parseRange(line[i+1:dash], to); e == nil {
+			r, err = rr, nil
+			break
+		}
+		next := strings.IndexByte(line[i+1:dash], ':')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return
+}
+
+// parseBlocklist reads blocklist in provided format
+// (FormatDAT, FormatP2P or FormatAuto), skipping empty lines and comments
+// (started with `#` or `//`). Invalid lines are skipped,
+// the number of such lines returned as skipped.
+func parseBlocklist(rd io.Reader, format string) (rr []ipRange, skipped int, err error) {
+	switch format {
+	case FormatAuto, FormatDAT, FormatP2P:
+	default:
+		return nil, 0, fmt.Errorf("%w: %s", errUnknownFormat, format)
+	}
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		f := format
+		if f == FormatAuto {
+			// ipfilter.dat range is followed by access level,
+			// p2p range is preceded by description
+			if strings.IndexByte(line, ',') >= 0 {
+				f = FormatDAT
+			} else {
+				f = FormatP2P
+			}
+		}
+		var r ipRange
+		var block bool
+		var e error
+		if f == FormatDAT {
+			r, block, e = parseDATLine(line)
+		} else {
+			r, e = parseP2PLine(line)
+			block = e == nil
+		}
+		if e != nil {
+			skipped++
+			logger.Debug().Err(e).Str("line", line).Msg("unable to parse blocklist line")
+		} else if block {
+			rr = append(rr, r)
+		}
+	}
+	err = sc.Err()
+	return
+}
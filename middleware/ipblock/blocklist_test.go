@@ -0,0 +1,204 @@
+package ipblock
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+const datSample = `# ipfilter.dat sample
+001.002.003.000 - 001.002.003.255 , 000 , Some organization
+010.000.000.000 - 010.000.000.015 , 127 , Border level
+010.000.001.000 - 010.000.001.255 , 128 , Allowed range
+192.168.000.001 - 192.168.000.001 , 100 , Single address
+2001:db8::     - 2001:db8::ffff   , 050 , IPv6 range
+not an address - 1.1.1.1 , 000 , Broken
+`
+
+const p2pSample = `// PeerGuardian sample
+Some organization:1.2.3.0-1.2.3.255
+Bad:Name-With:Colons:10.0.0.0-10.0.0.15
+Single:192.168.0.1-192.168.0.1
+IPv6 range:2001:db8::-2001:db8::ffff
+Broken line without range
+`
+
+var (
+	blockedAddrs = []string{"1.2.3.0", "1.2.3.128", "1.2.3.255", "10.0.0.15", "192.168.0.1", "2001:db8::1", "::ffff:1.2.3.4"}
+	allowedAddrs = []string{"1.2.4.0", "10.0.0.16", "10.0.1.1", "192.168.0.2", "2001:db8::1:0", "8.8.8.8"}
+)
+
+func checkSet(t *testing.T, s rangeSet) {
+	for _, a := range blockedAddrs {
+		require.True(t, s.contains(netip.MustParseAddr(a)), a)
+	}
+	for _, a := range allowedAddrs {
+		require.False(t, s.contains(netip.MustParseAddr(a)), a)
+	}
+}
+
+func TestParseDAT(t *testing.T) {
+	rr, skipped, err := parseBlocklist(strings.NewReader(datSample), FormatDAT)
+	require.Nil(t, err)
+	require.Equal(t, 1, skipped)
+	require.Len(t, rr, 4)
+	checkSet(t, newRangeSet(rr))
+
+	r, block, err := parseDATLine("1.1.1.1-1.1.1.2")
+	require.Nil(t, err)
+	require.True(t, block)
+	require.Equal(t, ipRange{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("1.1.1.2")}, r)
+
+	_, _, err = parseDATLine("1.1.1.1 - 1.1.1.2 , high , desc")
+	require.ErrorIs(t, err, errInvalidAccess)
+	_, _, err = parseDATLine("1.1.1.1 - ::1 , 0 , mixed")
+	require.ErrorIs(t, err, errInvalidRange)
+}
+
+func TestParseP2P(t *testing.T) {
+	rr, skipped, err := parseBlocklist(strings.NewReader(p2pSample), FormatP2P)
+	require.Nil(t, err)
+	require.Equal(t, 1, skipped)
+	require.Len(t, rr, 4)
+	checkSet(t, newRangeSet(rr))
+}
+
+func TestParseAuto(t *testing.T) {
+	rr, skipped, err := parseBlocklist(strings.NewReader(datSample+p2pSample), FormatAuto)
+	require.Nil(t, err)
+	require.Equal(t, 2, skipped)
+	s := newRangeSet(rr)
+	require.Len(t, s, 4)
+	checkSet(t, s)
+
+	_, _, err = parseBlocklist(strings.NewReader(datSample), "csv")
+	require.ErrorIs(t, err, errUnknownFormat)
+}
+
+func TestRangeSetMerge(t *testing.T) {
+	var rr []ipRange
+	for _, p := range []string{"10.0.0.0/25", "10.0.0.128/25", "10.0.0.64/26", "10.0.2.0/24", "::/0"} {
+		r, err := prefixRange(netip.MustParsePrefix(p))
+		require.Nil(t, err)
+		rr = append(rr, r)
+	}
+	s := newRangeSet(rr)
+	require.Equal(t, rangeSet{
+		{netip.MustParseAddr("10.0.0.0"), netip.MustParseAddr("10.0.0.255")},
+		{netip.MustParseAddr("10.0.2.0"), netip.MustParseAddr("10.0.2.255")},
+		{netip.MustParseAddr("::"), netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+	}, s)
+	require.False(t, s.contains(netip.MustParseAddr("10.0.1.0")))
+	require.True(t, s.contains(netip.MustParseAddr("fe80::1%eth0")))
+}
+
+func TestHookReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipfilter.dat")
+	require.Nil(t, os.WriteFile(path, []byte(datSample), 0o600))
+
+	h, err := newHook(Config{
+		Prefixes:       []string{"8.8.4.4", "172.16.0.0/12"},
+		File:           path,
+		ReloadInterval: time.Hour,
+	}.Validate())
+	require.Nil(t, err)
+	defer h.Close()
+
+	announce := func(addr string) error {
+		req := &bittorrent.AnnounceRequest{}
+		req.Add(bittorrent.RequestAddress{Addr: netip.MustParseAddr(addr)})
+		_, err := h.HandleAnnounce(context.Background(), req, nil)
+		return err
+	}
+	require.ErrorIs(t, announce("1.2.3.4"), ErrBlocked)
+	require.ErrorIs(t, announce("172.20.0.1"), ErrBlocked)
+	require.ErrorIs(t, announce("8.8.4.4"), ErrBlocked)
+	require.Nil(t, announce("8.8.8.8"))
+
+	reloaded, err := h.reload()
+	require.Nil(t, err)
+	require.False(t, reloaded)
+
+	require.Nil(t, os.WriteFile(path, []byte("Google:8.8.8.0-8.8.8.255\n"), 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	reloaded, err = h.reload()
+	require.Nil(t, err)
+	require.True(t, reloaded)
+	require.Nil(t, announce("1.2.3.4"))
+	require.ErrorIs(t, announce("8.8.8.8"), ErrBlocked)
+
+	// previous list is kept if file is missing
+	require.Nil(t, os.Remove(path))
+	_, err = h.reload()
+	require.NotNil(t, err)
+	require.ErrorIs(t, announce("8.8.8.8"), ErrBlocked)
+}
+
+func TestHookAutoBanned(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	h, err := build(conf.MapConfig{"auto_banned": true}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	logic := middleware.NewLogic(0, 0, ps, nil, nil)
+	defer logic.Close()
+	logic.SetAutoBanConfig(middleware.AutoBanConfig{Threshold: 1, Window: time.Minute, Duration: time.Minute})
+	logic.ReportRateLimited(context.Background(), netip.MustParseAddr("192.0.2.1"))
+
+	announce := func(addr string) error {
+		req := &bittorrent.AnnounceRequest{}
+		req.Add(bittorrent.RequestAddress{Addr: netip.MustParseAddr(addr)})
+		_, err := h.HandleAnnounce(context.Background(), req, nil)
+		return err
+	}
+	require.ErrorIs(t, announce("192.0.2.1"), ErrBlocked)
+	require.Nil(t, announce("192.0.2.2"))
+}
+
+func TestHookBogons(t *testing.T) {
+	_, err := newHook(Config{Bogons: []string{"unknown"}}.Validate())
+	require.NotNil(t, err)
+
+	h, err := newHook(Config{Bogons: []string{BogonLoopback, BogonMulticast, BogonReserved}}.Validate())
+	require.Nil(t, err)
+	defer h.Close()
+
+	announce := func(addrs ...string) (*bittorrent.AnnounceRequest, error) {
+		req := &bittorrent.AnnounceRequest{}
+		for _, a := range addrs {
+			req.RequestAddresses = append(req.RequestAddresses, bittorrent.RequestAddress{Addr: netip.MustParseAddr(a)})
+		}
+		_, err := h.HandleAnnounce(context.Background(), req, nil)
+		return req, err
+	}
+	for _, a := range []string{"127.0.0.1", "::1", "224.0.0.1", "ff02::1", "100.64.0.1", "2001:db8::1", "::ffff:127.0.0.1"} {
+		_, err = announce(a)
+		require.ErrorIs(t, err, ErrBlocked, a)
+	}
+	for _, a := range []string{"8.8.8.8", "10.0.0.1", "2606:4700::1"} {
+		_, err = announce(a)
+		require.Nil(t, err, a)
+	}
+	_, err = announce("8.8.8.8", "127.0.0.1")
+	require.ErrorIs(t, err, ErrBlocked)
+
+	h.cfg.DropBogons = true
+	req, err := announce("127.0.0.1", "8.8.8.8", "224.0.0.1")
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("8.8.8.8")}}, req.RequestAddresses)
+	_, err = announce("127.0.0.1", "224.0.0.1")
+	require.ErrorIs(t, err, ErrBlocked)
+}
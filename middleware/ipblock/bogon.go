@@ -0,0 +1,82 @@
+package ipblock
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Names of built-in bogon address classes
+const (
+	// BogonPrivate is RFC 1918 IPv4 and RFC 4193 IPv6 private addresses
+	BogonPrivate = "private"
+	// BogonLoopback is 127.0.0.0/8 and ::1
+	BogonLoopback = "loopback"
+	// BogonLinkLocal is 169.254.0.0/16 and fe80::/10
+	BogonLinkLocal = "link_local"
+	// BogonMulticast is 224.0.0.0/4 and ff00::/8
+	BogonMulticast = "multicast"
+	// BogonUnspecified is 0.0.0.0 and ::
+	BogonUnspecified = "unspecified"
+	// BogonReserved is shared (CGN), documentation, benchmarking
+	// and other special-purpose ranges, which are not globally routable
+	BogonReserved = "reserved"
+)
+
+var reservedRanges = func() rangeSet {
+	var rr []ipRange
+	for _, s := range []string{
+		"0.0.0.0/8",
+		"100.64.0.0/10",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"240.0.0.0/4",
+		"100::/64",
+		"2001:db8::/32",
+	} {
+		r, err := prefixRange(netip.MustParsePrefix(s))
+		if err != nil {
+			panic(err)
+		}
+		rr = append(rr, r)
+	}
+	return newRangeSet(rr)
+}()
+
+var bogonClasses = map[string]func(netip.Addr) bool{
+	BogonPrivate:     netip.Addr.IsPrivate,
+	BogonLoopback:    netip.Addr.IsLoopback,
+	BogonLinkLocal:   func(a netip.Addr) bool { return a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast() },
+	BogonMulticast:   netip.Addr.IsMulticast,
+	BogonUnspecified: netip.Addr.IsUnspecified,
+	BogonReserved:    reservedRanges.contains,
+}
+
+// bogonSet holds checks of configured bogon classes.
+// Empty set contains nothing.
+type bogonSet []func(netip.Addr) bool
+
+func newBogonSet(classes []string) (bogonSet, error) {
+	s := make(bogonSet, 0, len(classes))
+	for _, c := range classes {
+		fn, found := bogonClasses[c]
+		if !found {
+			return nil, fmt.Errorf("unknown bogon class '%s'", c)
+		}
+		s = append(s, fn)
+	}
+	return s, nil
+}
+
+// contains checks if address belongs to any of bogon classes
+func (s bogonSet) contains(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, fn := range s {
+		if fn(a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+// Package ipblock implements a Hook that fails an Announce if any
+// of peer's addresses is in configured blocklist.
+// Blocklist may be specified statically as list of addresses/prefixes
+// and/or loaded from file in eMule ipfilter.dat or PeerGuardian p2p format.
+// Addresses automatically banned by frontends for exceeding rate limits
+// and bogon (private, loopback, multicast etc.) addresses may be blocked as well.
+package ipblock
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "ip block"
+
+const defaultReloadInterval = time.Minute
+
+var logger = log.NewLogger("middleware/ip block")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// ErrBlocked is the error returned when peer's address is in blocklist.
+var ErrBlocked = bittorrent.ClientError("address blocked by mochi")
+
+// Config represents the configuration for the ipblock middleware.
+type Config struct {
+	// Static list of blocked addresses or prefixes (CIDR).
+	Prefixes []string `cfg:"prefixes"`
+	// File is the path to blocklist file
+	File string `cfg:"file"`
+	// Format of File: `dat`, `p2p` or `auto`
+	Format string `cfg:"format"`
+	// ReloadInterval is the frequency of File modification checks
+	ReloadInterval time.Duration `cfg:"reload_interval"`
+	// AutoBanned enables blocking of addresses, which are
+	// automatically banned for exceeding frontend rate limits
+	AutoBanned bool `cfg:"auto_banned"`
+	// Bogons is the list of blocked classes of addresses, which are
+	// useless to other peers: BogonPrivate, BogonLoopback, BogonLinkLocal,
+	// BogonMulticast, BogonUnspecified and BogonReserved
+	Bogons []string `cfg:"bogons"`
+	// DropBogons if true, bogon addresses are removed from request
+	// instead of rejection. Announce is rejected only if there
+	// are no other addresses.
+	DropBogons bool `cfg:"drop_bogons"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if len(cfg.Format) == 0 {
+		validCfg.Format = FormatAuto
+		logger.Warn().
+			Str("name", "Format").
+			Str("provided", cfg.Format).
+			Str("default", validCfg.Format).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.File) > 0 && cfg.ReloadInterval <= 0 {
+		validCfg.ReloadInterval = defaultReloadInterval
+		logger.Warn().
+			Str("name", "ReloadInterval").
+			Dur("provided", cfg.ReloadInterval).
+			Dur("default", validCfg.ReloadInterval).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+type hook struct {
+	cfg    Config
+	static rangeSet
+	bogons bogonSet
+	loaded atomic.Pointer[rangeSet]
+	store  storage.DataStorage
+
+	modTime time.Time
+	size    int64
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	h, err := newHook(cfg.Validate())
+	if err == nil && cfg.AutoBanned {
+		h.store = st
+	}
+	return h, err
+}
+
+func newHook(cfg Config) (*hook, error) {
+	rr := make([]ipRange, 0, len(cfg.Prefixes))
+	for _, s := range cfg.Prefixes {
+		var p netip.Prefix
+		var err error
+		if a, e := parseAddr(s); e == nil {
+			p = netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+		} else if p, err = netip.ParsePrefix(s); err != nil {
+			return nil, fmt.Errorf("middleware %s: invalid prefix '%s': %w", Name, s, err)
+		}
+		r, err := prefixRange(p)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: invalid prefix '%s': %w", Name, s, err)
+		}
+		rr = append(rr, r)
+	}
+	bogons, err := newBogonSet(cfg.Bogons)
+	if err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:    cfg,
+		static: newRangeSet(rr),
+		bogons: bogons,
+		closed: make(chan any),
+	}
+	if len(cfg.File) > 0 {
+		if _, err := h.reload(); err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", Name, err)
+		}
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			t := time.NewTicker(cfg.ReloadInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-h.closed:
+					return
+				case <-t.C:
+					if _, err := h.reload(); err != nil {
+						logger.Error().Err(err).Str("file", cfg.File).Msg("unable to reload blocklist")
+					}
+				}
+			}
+		}()
+	}
+	return h, nil
+}
+
+// reload loads blocklist file if it was modified since last load.
+// Previously loaded blocklist is kept if file could not be read.
+func (h *hook) reload() (reloaded bool, err error) {
+	var fi os.FileInfo
+	if fi, err = os.Stat(h.cfg.File); err != nil {
+		return
+	}
+	if h.loaded.Load() != nil && fi.ModTime().Equal(h.modTime) && fi.Size() == h.size {
+		return
+	}
+	var f *os.File
+	if f, err = os.Open(h.cfg.File); err != nil {
+		return
+	}
+	defer f.Close()
+	var rr []ipRange
+	var skipped int
+	if rr, skipped, err = parseBlocklist(f, h.cfg.Format); err != nil {
+		return
+	}
+	s := newRangeSet(rr)
+	h.loaded.Store(&s)
+	h.modTime, h.size, reloaded = fi.ModTime(), fi.Size(), true
+	logger.Info().
+		Str("file", h.cfg.File).
+		Int("ranges", len(s)).
+		Int("skipped", skipped).
+		Msg("blocklist loaded")
+	return
+}
+
+// blocked checks if address is in static or loaded blocklist
+func (h *hook) blocked(a netip.Addr) bool {
+	if h.static.contains(a) {
+		return true
+	}
+	if s := h.loaded.Load(); s != nil {
+		return s.contains(a)
+	}
+	return false
+}
+
+// autoBanned checks if address is automatically banned
+func (h *hook) autoBanned(ctx context.Context, a netip.Addr) (bool, error) {
+	if h.store == nil {
+		return false, nil
+	}
+	until, err := middleware.LoadAutoBan(ctx, h.store, a)
+	return until > timecache.NowUnixNano(), err
+}
+
+// dropBogons removes bogon addresses from request,
+// returns false if there are no other addresses
+func (h *hook) dropBogons(req *bittorrent.AnnounceRequest) bool {
+	aa := req.RequestAddresses[:0]
+	for _, a := range req.RequestAddresses {
+		if !h.bogons.contains(a.Addr) {
+			aa = append(aa, a)
+		}
+	}
+	req.RequestAddresses = aa
+	return len(aa) > 0
+}
+
+// HandleAnnounce checks if any of peer's addresses is blocked
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.cfg.DropBogons && !h.dropBogons(req) {
+		return ctx, ErrBlocked
+	}
+	for _, a := range req.RequestAddresses {
+		if h.bogons.contains(a.Addr) {
+			return ctx, ErrBlocked
+		}
+		if h.blocked(a.Addr) {
+			return ctx, ErrBlocked
+		}
+		if banned, err := h.autoBanned(ctx, a.Addr); err != nil {
+			return ctx, err
+		} else if banned {
+			return ctx, ErrBlocked
+		}
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't reveal peers, so they are not blocked.
+	return ctx, nil
+}
+
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+	})
+	return nil
+}
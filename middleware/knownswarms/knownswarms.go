@@ -0,0 +1,142 @@
+// Package knownswarms implements a Hook that responds to announces
+// of unknown info hashes (which are neither tracked nor pre-declared)
+// with empty response instead of creating new swarm.
+package knownswarms
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "known swarms"
+
+const defaultEmptyInterval = 24 * time.Hour
+
+var logger = log.NewLogger("middleware/known swarms")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// ErrUnknownTorrent is the warning message sent in response
+// to announce of unknown info hash.
+var ErrUnknownTorrent = bittorrent.ClientError("torrent is not known by mochi")
+
+// Config represents the configuration for the knownswarms middleware.
+type Config struct {
+	// HashList static list of HEX-encoded pre-declared InfoHashes.
+	HashList []string `cfg:"hash_list"`
+	// StorageCtx is the name of storage context where pre-declared
+	// InfoHashes may be placed by external tool. Not checked if empty.
+	StorageCtx string `cfg:"storage_ctx"`
+	// EmptyInterval is the announce interval sent to requesters
+	// of unknown info hash.
+	EmptyInterval time.Duration `cfg:"empty_interval"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.EmptyInterval <= 0 {
+		validCfg.EmptyInterval = defaultEmptyInterval
+		logger.Warn().
+			Str("name", "EmptyInterval").
+			Dur("provided", cfg.EmptyInterval).
+			Dur("default", validCfg.EmptyInterval).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+type hook struct {
+	store         storage.PeerStorage
+	declared      map[string]struct{}
+	storageCtx    string
+	emptyInterval time.Duration
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	cfg = cfg.Validate()
+	h := &hook{
+		store:         st,
+		declared:      make(map[string]struct{}, len(cfg.HashList)),
+		storageCtx:    cfg.StorageCtx,
+		emptyInterval: cfg.EmptyInterval,
+	}
+	for _, s := range cfg.HashList {
+		ih, err := bittorrent.NewInfoHashString(s)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %s: %w", Name, s, err)
+		}
+		h.declared[ih.RawString()] = struct{}{}
+		if len(ih) == bittorrent.InfoHashV2Len {
+			h.declared[ih.TruncateV1().RawString()] = struct{}{}
+		}
+	}
+	return h, nil
+}
+
+// declaredHash checks if info hash is in static list or in storage context
+func (h *hook) declaredHash(ctx context.Context, ih bittorrent.InfoHash) (bool, error) {
+	if _, found := h.declared[ih.RawString()]; found {
+		return true, nil
+	}
+	if len(h.storageCtx) > 0 {
+		return h.store.Contains(ctx, h.storageCtx, ih.RawString())
+	}
+	return false, nil
+}
+
+// known checks if info hash is pre-declared or swarm is already tracked
+func (h *hook) known(ctx context.Context, ih bittorrent.InfoHash) (bool, error) {
+	hashes := []bittorrent.InfoHash{ih}
+	if len(ih) == bittorrent.InfoHashV2Len {
+		hashes = append(hashes, ih.TruncateV1())
+	}
+	for _, ih := range hashes {
+		if found, err := h.declaredHash(ctx, ih); found || err != nil {
+			return found, err
+		}
+		l, s, n, err := h.store.ScrapeSwarm(ctx, ih)
+		if err != nil || l+s+n > 0 {
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	known, err := h.known(ctx, req.InfoHash)
+	if err != nil {
+		return ctx, err
+	}
+	if !known {
+		logger.Debug().Stringer("infoHash", req.InfoHash).Msg("announce of unknown info hash")
+		// respond without peers and do not create swarm
+		ctx = context.WithValue(ctx, middleware.SkipResponseHookKey, true)
+		ctx = context.WithValue(ctx, middleware.SkipSwarmInteractionKey, true)
+		resp.Interval, resp.MinInterval = h.emptyInterval, h.emptyInterval
+		resp.WarningMessage = ErrUnknownTorrent.Error()
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes do not create swarms.
+	return ctx, nil
+}
@@ -0,0 +1,88 @@
+package knownswarms
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+func TestKnownSwarms(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	const declared = "0123456789abcdef0123456789abcdef01234567"
+	h, err := build(conf.MapConfig{
+		"hash_list":      []string{declared},
+		"storage_ctx":    "KNOWN",
+		"empty_interval": time.Hour,
+	}, ps)
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	lgc := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{h}, nil)
+	announce := func(hash string) *bittorrent.AnnounceResponse {
+		ih, err := bittorrent.NewInfoHashString(hash)
+		require.Nil(t, err)
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			NumWant:  10,
+			Left:     1,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{1},
+				Port:             1234,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+			},
+		}
+		outCtx, resp, err := lgc.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		lgc.AfterAnnounce(bittorrent.RemapRouteParamsToBgContext(outCtx), req, resp)
+		return resp
+	}
+	leechers := func(hash string) uint32 {
+		ih, _ := bittorrent.NewInfoHashString(hash)
+		l, _, _, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		return l
+	}
+
+	// fresh info hash is not stored
+	const fresh = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	resp := announce(fresh)
+	require.Equal(t, ErrUnknownTorrent.Error(), resp.WarningMessage)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Empty(t, resp.IPv4Peers)
+	require.Zero(t, leechers(fresh))
+
+	// pre-declared in config
+	resp = announce(declared)
+	require.Empty(t, resp.WarningMessage)
+	require.Equal(t, time.Minute, resp.Interval)
+	require.Equal(t, uint32(1), leechers(declared))
+
+	// pre-declared in storage
+	ih, _ := bittorrent.NewInfoHashString(fresh)
+	require.Nil(t, ps.Put(ctx, "KNOWN", storage.Entry{Key: ih.RawString(), Value: []byte("_")}))
+	resp = announce(fresh)
+	require.Empty(t, resp.WarningMessage)
+	require.Equal(t, uint32(1), leechers(fresh))
+
+	// already tracked swarm stays known
+	require.Nil(t, ps.Delete(ctx, "KNOWN", ih.RawString()))
+	resp = announce(fresh)
+	require.Empty(t, resp.WarningMessage)
+}
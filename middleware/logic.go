@@ -2,12 +2,54 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/pkg/tracing"
 	"github.com/sot-tech/mochi/storage"
 )
 
+// ErrNotWarmedUp is returned from Logic.Ready if some of hooks
+// did not finish warmup.
+var ErrNotWarmedUp = errors.New("hooks warmup not complete")
+
+// ErrClosing is returned from Logic.Ready if Logic is shutting down.
+var ErrClosing = errors.New("shutting down")
+
+// ErrNoDenier is returned from Logic.PurgeSwarm if info hash should be
+// denied, but there are no hooks, which implement Denier.
+var ErrNoDenier = errors.New("no hooks able to deny info hash")
+
+// ErrNoIntervalOverrides is returned from Logic.SetIntervalOverride
+// if lookup of interval overrides is disabled.
+var ErrNoIntervalOverrides = errors.New("announce interval overrides disabled")
+
+// ErrNoReloader is returned from Logic.Reload if there are no hooks,
+// which implement Reloader.
+var ErrNoReloader = errors.New("no hooks able to reload")
+
+// MaxAllowedClockSkew is the ceiling of clock skew of connection IDs
+// (see Logic.SetMaxClockSkew), which keeps replay window of IDs bounded.
+const MaxAllowedClockSkew = 30 * time.Second
+
+// StalledTimeout is the duration, during which at least one of
+// post hooks executed in background should complete while there
+// are pending ones, otherwise Logic is not alive (see Logic.Live).
+const StalledTimeout = 2 * time.Minute
+
+// ErrInvalidClockSkew is returned from Logic.SetMaxClockSkew if
+// provided skew is negative or greater than MaxAllowedClockSkew.
+var ErrInvalidClockSkew = fmt.Errorf("clock skew must be in range [0, %s]", MaxAllowedClockSkew)
+
 // Logic used by a frontend in order to: (1) generate a
 // response from a parsed request, and (2) asynchronously observe anything
 // after the response has been delivered to the client.
@@ -16,39 +58,372 @@ type Logic struct {
 	minAnnounceInterval time.Duration
 	preHooks            []Hook
 	postHooks           []Hook
+	filters             []ResponseFilter
 	pingers             []Pinger
+	warmers             []Warmer
+	deniers             []Denier
+	reloaders           []Reloader
+	store               storage.PeerStorage
+	respHook            *responseHook
+	swarmHook           *swarmInteractionHook
+	intervals           *intervalOverrides
+	autoBan             *autoBan
+	backpressure        *backpressure
+	watcher             *storageWatcher
+	// clockSkew overrides configured clock skew of connection IDs
+	clockSkew atomic.Int64
+	// closed is set when Close called
+	closed atomic.Bool
+	// shutdown is set when Close completed
+	shutdown atomic.Bool
+	// asyncMu guards start of post hooks executed in background
+	// against concurrent Close
+	asyncMu sync.Mutex
+	// post hooks executed in background
+	inFlight sync.WaitGroup
+	// number of pending post hooks executed in background
+	pending atomic.Int64
+	// time (unix nano) of the last progress of post hooks
+	// executed in background
+	progress atomic.Int64
+}
+
+// Names of functions of swarm size, which limit
+// the number of peers returned in announce response
+const (
+	// SampleScalingNone returns requested number of peers (numwant)
+	SampleScalingNone = "none"
+	// SampleScalingSqrt returns not more than square root of swarm size
+	SampleScalingSqrt = "sqrt"
+	// SampleScalingLog2 returns not more than binary logarithm of swarm size
+	SampleScalingLog2 = "log2"
+)
+
+// ResponseConfig holds options of peers selection for announce responses.
+type ResponseConfig struct {
+	// DeterministicPeersWindow if greater than zero, peers sample
+	// returned to the same peer (by ID) for the same info hash
+	// is stable within time window of this duration.
+	// Supported only by storages, which respect storage.SelectionSeed.
+	DeterministicPeersWindow time.Duration
+	// MaxPeersReturned if greater than zero, limits the number of peers
+	// in announce response regardless of requested (numwant) count.
+	MaxPeersReturned uint32
+	// PeriodicNumWantFactor if in range (0, 1), requested count of
+	// peers (numwant) of announces without event is multiplied by it,
+	// so clients get the full numwant only to bootstrap (`started`
+	// or `completed`) and fewer peers with periodic announces.
+	PeriodicNumWantFactor float64
+	// PeerSampleScaling is the name of function of swarm size (number of
+	// seeders and leechers), which limits the number of returned peers:
+	// SampleScalingNone (default), SampleScalingSqrt or SampleScalingLog2.
+	PeerSampleScaling string
+	// PeerSampleMin is the minimal number of returned peers if
+	// PeerSampleScaling is set (but not greater than numwant).
+	PeerSampleMin uint32
+	// StickyPeersTTL if greater than zero, the same peers subset
+	// is returned to the client (identified by peer ID) within
+	// this duration, peers, which left swarm, are replaced with new ones.
+	// Tracker id of session is returned in announce response.
+	// Subsets are placed in StickyPeersStorageCtx context of storage
+	// and deleted after expiration by instance, which saved them.
+	// Requires storage.PeerChecker support of storage.
+	StickyPeersTTL time.Duration
+	// RecentPeersTTL if greater than zero, peers returned to the client
+	// are remembered for this duration and other peers of the swarm
+	// are preferred in the next announce response of the same client.
+	// Recent peers are placed in RecentPeersStorageCtx context of storage.
+	// Ignored if StickyPeersTTL is set.
+	RecentPeersTTL time.Duration
+	// ResponseCacheTTL if greater than zero, peers sample and peers
+	// counts of swarm are fetched from storage once within this duration
+	// and shared between announces to the same swarm. Every response
+	// gets different part of sample. Sample size is MaxPeersReturned
+	// if set, 100 otherwise.
+	// Ignored if DeterministicPeersWindow is set.
+	ResponseCacheTTL time.Duration
+	// ResponseCacheMaxScrapes is the maximal number of swarms, which
+	// peers counts are held in response cache. The least recently
+	// scraped swarm is evicted if it is exceeded. Default is 100000.
+	ResponseCacheMaxScrapes uint
+	// OmitEmptyScrapes if true, info hashes without seeders and leechers
+	// are not included in scrape responses instead of zero counts.
+	// Frontends with positional scrape responses (UDP) report
+	// omitted info hashes as zeroes.
+	OmitEmptyScrapes bool
+	// RelatedInfoHashes maps HEX encoded info hash to info hashes of
+	// torrents with the same content (i.e. cross-seeded torrents).
+	// Peers of related swarms are appended to announce response of
+	// swarm, which has fewer than RelatedPeersThreshold seeders and
+	// leechers. Relations are one-way.
+	RelatedInfoHashes map[string][]string
+	// RelatedPeersThreshold is the swarm size (seeders and leechers),
+	// below which peers of related swarms are returned.
+	// Related swarms are disabled if 0.
+	RelatedPeersThreshold uint32
+	// RelatedMaxInfoHashes limits number of related swarms of each
+	// info hash, default is 4.
+	RelatedMaxInfoHashes uint
+}
+
+// SwarmConfig holds options of swarm updates.
+type SwarmConfig struct {
+	// StoppedAllFamilies if true, peer sent stopped event is
+	// deleted by PeerID from swarms of both IPv4 and IPv6
+	// address families, not only the family of request address,
+	// so dual-stack peer is removed without waiting for GC.
+	// Supported only by storages, which implement storage.PeerIDDeleter
+	// (i.e. memory and redis with peer ID index).
+	StoppedAllFamilies bool
+	// RefreshOnScrape if true, modification time of already stored
+	// peer is refreshed by scrape request, which contains `peer_id`
+	// and `port` parameters, so peers, which scrape frequently, but
+	// announce rarely, are not deleted by GC.
+	RefreshOnScrape bool
 }
 
 // NewLogic creates a new instance of a Logic that executes the provided
-// middleware hooks.
-func NewLogic(annInterval, minAnnInterval time.Duration, peerStore storage.PeerStorage, preHooks, postHooks []Hook) *Logic {
+// middleware hooks and response filters.
+func NewLogic(annInterval, minAnnInterval time.Duration, peerStore storage.PeerStorage, preHooks, postHooks []Hook, filters ...ResponseFilter) *Logic {
+	respHook := &responseHook{store: peerStore, nat: newNATPeers(2 * annInterval)}
+	swarmHook := &swarmInteractionHook{store: peerStore}
 	l := &Logic{
 		announceInterval:    annInterval,
 		minAnnounceInterval: minAnnInterval,
-		preHooks:            append(preHooks, &responseHook{store: peerStore}),
-		postHooks:           append(postHooks, &swarmInteractionHook{store: peerStore}),
+		preHooks:            append(preHooks, respHook),
+		postHooks:           append(postHooks, swarmHook),
+		filters:             filters,
 		pingers:             make([]Pinger, 0, 1),
+		store:               peerStore,
+		respHook:            respHook,
+		swarmHook:           swarmHook,
 	}
 	for _, h := range l.preHooks {
 		if ph, isOk := h.(Pinger); isOk {
 			l.pingers = append(l.pingers, ph)
 		}
+		if wh, isOk := h.(Warmer); isOk {
+			l.warmers = append(l.warmers, wh)
+		}
+		if dh, isOk := h.(Denier); isOk {
+			l.deniers = append(l.deniers, dh)
+		}
+		if rh, isOk := h.(Reloader); isOk {
+			l.reloaders = append(l.reloaders, rh)
+		}
 	}
 	return l
 }
 
+// SetResponseConfig sets options of announce responses assembly.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetResponseConfig(cfg ResponseConfig) {
+	if cfg.PeriodicNumWantFactor < 0 || cfg.PeriodicNumWantFactor > 1 {
+		logger.Warn().
+			Str("name", "PeriodicNumWantFactor").
+			Float64("provided", cfg.PeriodicNumWantFactor).
+			Float64("default", 0).
+			Msg("falling back to default configuration")
+		cfg.PeriodicNumWantFactor = 0
+	}
+	switch cfg.PeerSampleScaling {
+	case SampleScalingNone, SampleScalingSqrt, SampleScalingLog2:
+	case "":
+		cfg.PeerSampleScaling = SampleScalingNone
+	default:
+		logger.Warn().
+			Str("name", "PeerSampleScaling").
+			Str("provided", cfg.PeerSampleScaling).
+			Str("default", SampleScalingNone).
+			Msg("falling back to default configuration")
+		cfg.PeerSampleScaling = SampleScalingNone
+	}
+	l.respHook.cfg = cfg
+	l.respHook.sticky = nil
+	if cfg.StickyPeersTTL > 0 {
+		if _, isOk := l.store.(storage.PeerChecker); isOk {
+			l.respHook.sticky = newStickyPeers(l.store, cfg.StickyPeersTTL)
+		} else {
+			logger.Warn().Msg("storage does not support peer existence check, sticky peers are disabled")
+		}
+	}
+	l.respHook.cache = nil
+	if cfg.ResponseCacheTTL > 0 {
+		if cfg.DeterministicPeersWindow <= 0 {
+			l.respHook.cache = newResponseCache(cfg.ResponseCacheTTL, int(cfg.MaxPeersReturned), int(cfg.ResponseCacheMaxScrapes))
+		} else {
+			logger.Warn().Msg("announce response cache is disabled because deterministic peers enabled")
+		}
+	}
+	l.respHook.related = newRelatedSwarms(cfg.RelatedInfoHashes, cfg.RelatedPeersThreshold, cfg.RelatedMaxInfoHashes)
+	l.respHook.recent = nil
+	if cfg.RecentPeersTTL > 0 {
+		if l.respHook.sticky == nil {
+			l.respHook.recent = newRecentPeers(l.store, cfg.RecentPeersTTL)
+		} else {
+			logger.Warn().Msg("recent peers exclusion is disabled because sticky peers enabled")
+		}
+	}
+}
+
+// SetSwarmConfig sets options of swarm updates.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetSwarmConfig(cfg SwarmConfig) {
+	l.swarmHook.refreshOnScrape = cfg.RefreshOnScrape
+	if _, isOk := l.store.(storage.PeerChecker); cfg.RefreshOnScrape && !isOk {
+		l.swarmHook.refreshOnScrape = false
+		logger.Warn().Msg("storage does not support peer existence check, peers are not refreshed on scrape")
+	}
+	l.swarmHook.idDeleter = nil
+	if cfg.StoppedAllFamilies {
+		if d, isOk := l.store.(storage.PeerIDDeleter); isOk {
+			l.swarmHook.idDeleter = d
+		} else {
+			logger.Warn().Msg("storage does not support deletion by peer ID, stopped peers are deleted only from request address family")
+		}
+	}
+}
+
+// SetBreakerConfig sets options of circuit breaker around storage calls
+// of response and swarm interaction hooks.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetBreakerConfig(cfg BreakerConfig) {
+	b := newCircuitBreaker(cfg)
+	l.respHook.breaker, l.respHook.breakerInterval = b, cfg.Interval
+	l.swarmHook.breaker = b
+}
+
+// SetConcurrencyConfig sets limit of concurrent storage calls
+// of response and swarm interaction hooks.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetConcurrencyConfig(cfg ConcurrencyConfig) {
+	lim := newStorageLimiter(cfg)
+	l.respHook.limiter, l.swarmHook.limiter = lim, lim
+}
+
+// SetDegradedConfig sets options of degraded mode: storage availability
+// is checked periodically and, while it is not available, announces are
+// answered with the requester itself as the only peer and scrapes with
+// zeroes without storage interaction.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetDegradedConfig(cfg DegradedConfig) {
+	l.watcher.Close()
+	if cfg.CheckInterval > 0 && cfg.Interval <= 0 {
+		logger.Warn().
+			Str("name", "DegradedInterval").
+			Dur("provided", cfg.Interval).
+			Dur("default", defaultDegradedInterval).
+			Msg("falling back to default configuration")
+		cfg.Interval = defaultDegradedInterval
+	}
+	l.watcher = newStorageWatcher(l.store, cfg)
+	l.respHook.watcher, l.respHook.degradedInterval = l.watcher, cfg.Interval
+	l.swarmHook.watcher = l.watcher
+}
+
+// SetIntervalOverrides enables lookup of per info hash announce interval
+// overrides in IntervalStorageCtx context of storage. Found values
+// (and their absence) are cached for ttl. Lookup is disabled if ttl
+// is not positive.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetIntervalOverrides(ttl time.Duration) {
+	if ttl > 0 {
+		l.intervals = newIntervalOverrides(l.store, ttl)
+	} else {
+		l.intervals = nil
+	}
+}
+
+// SetIntervalOverride stores announce interval override of info hash
+// in IntervalStorageCtx context of storage, zero interval deletes
+// override. Cached value of info hash is dropped, so override is
+// applied immediately by this Logic and after cache TTL by others,
+// which share the same storage.
+// Returns ErrNoIntervalOverrides if lookup of overrides is disabled.
+func (l *Logic) SetIntervalOverride(ctx context.Context, ih bittorrent.InfoHash, interval time.Duration) error {
+	if l.intervals == nil {
+		return ErrNoIntervalOverrides
+	}
+	return l.intervals.set(ctx, ih, interval)
+}
+
+// SetAutoBanConfig sets options of automatic ban of addresses,
+// which repeatedly exceed frontend rate limits.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetAutoBanConfig(cfg AutoBanConfig) {
+	l.autoBan.Close()
+	l.autoBan = newAutoBan(l.store, cfg)
+}
+
+// SetBackpressureConfig sets options of adaptive announce interval,
+// which is increased while tracker is under load.
+// Should be called before Logic is used by frontends.
+func (l *Logic) SetBackpressureConfig(cfg BackpressureConfig) {
+	l.backpressure.Close()
+	l.backpressure = newBackpressure(cfg, l.announceInterval)
+	l.respHook.backpressure = l.backpressure
+}
+
+// ReportRateLimited registers rate limit violation made by address.
+// If number of violations reached configured threshold, address is
+// banned and Banned returns true for it until ban expires.
+// Does nothing if auto-ban is not configured.
+func (l *Logic) ReportRateLimited(ctx context.Context, addr netip.Addr) {
+	if l.autoBan == nil {
+		return
+	}
+	if _, err := l.autoBan.violation(ctx, addr, timecache.NowUnixNano()); err != nil {
+		logger.Error().Err(err).Stringer("addr", addr).Msg("unable to ban address")
+	}
+}
+
+// Banned checks if address is automatically banned.
+// Frontends should drop requests of banned addresses before parsing.
+// Only locally cached bans are checked, bans of addresses, which are
+// not cached yet, are loaded from storage in background,
+// so first requests of such addresses are not dropped.
+func (l *Logic) Banned(addr netip.Addr) bool {
+	if l.autoBan == nil {
+		return false
+	}
+	return l.autoBan.banned(addr, timecache.NowUnixNano())
+}
+
 // HandleAnnounce generates a response for an Announce.
 //
 // Returns the updated context, the generated AnnounceResponse and no error
 // on success; nil and error on failure.
 func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (_ context.Context, resp *bittorrent.AnnounceResponse, err error) {
 	logger.Debug().Object("request", req).Msg("new announce request")
+	recordAnnounceEvent(req.Event)
 	resp = &bittorrent.AnnounceResponse{
 		Interval:    l.announceInterval,
 		MinInterval: l.minAnnounceInterval,
 	}
+	if l.intervals != nil && !l.watcher.degraded() {
+		// storage failure should not fail announce,
+		// configured interval is used instead of override
+		if interval, err := l.intervals.get(ctx, req.InfoHash); err != nil {
+			logger.Warn().Err(err).
+				Stringer("infoHash", req.InfoHash).
+				Msg("unable to load announce interval override")
+		} else if interval > 0 {
+			resp.Interval = interval
+			if resp.MinInterval > interval {
+				resp.MinInterval = interval
+			}
+		}
+	}
+	resp.Interval, resp.MinInterval = l.backpressure.apply(resp.Interval, resp.MinInterval)
 	for _, h := range l.preHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
+		hCtx, hs := startHookSpan(ctx, h, "announce")
+		ctx, err = h.HandleAnnounce(hCtx, req, resp)
+		if ctx = hs.end(ctx, err); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, f := range l.filters {
+		if err = f.FilterAnnounce(ctx, req, resp); err != nil {
 			return nil, nil, err
 		}
 	}
@@ -61,8 +436,12 @@ func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequ
 // has been completed.
 func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
 	var err error
+	ctx, span := tracing.Start(ctx, "after announce", tracing.AttrAction.String("announce"), tracing.InfoHash(req.InfoHash))
+	defer func() { tracing.End(span, err) }()
 	for _, h := range l.postHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
+		hCtx, hs := startHookSpan(ctx, h, "announce")
+		ctx, err = h.HandleAnnounce(hCtx, req, resp)
+		if ctx = hs.end(ctx, err); err != nil {
 			logger.Error().Err(err).
 				Object("request", req).
 				Object("response", resp).
@@ -72,6 +451,19 @@ func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 	}
 }
 
+// AfterAnnounceAsync calls AfterAnnounce in background.
+// Close waits for all such calls to complete,
+// calls made after Close are ignored.
+func (l *Logic) AfterAnnounceAsync(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if !l.startAsync() {
+		return
+	}
+	go func() {
+		defer l.doneAsync()
+		l.AfterAnnounce(ctx, req, resp)
+	}()
+}
+
 // HandleScrape generates a response for a Scrape.
 //
 // Returns the updated context, the generated AnnounceResponse and no error
@@ -82,7 +474,9 @@ func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest)
 		Data: make([]bittorrent.Scrape, 0, len(req.InfoHashes)),
 	}
 	for _, h := range l.preHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
+		hCtx, hs := startHookSpan(ctx, h, "scrape")
+		ctx, err = h.HandleScrape(hCtx, req, resp)
+		if ctx = hs.end(ctx, err); err != nil {
 			return nil, nil, err
 		}
 	}
@@ -94,8 +488,12 @@ func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest)
 // AfterScrape does something with the results of a Scrape after it has been completed.
 func (l *Logic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
 	var err error
+	ctx, span := tracing.Start(ctx, "after scrape", tracing.AttrAction.String("scrape"))
+	defer func() { tracing.End(span, err) }()
 	for _, h := range l.postHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
+		hCtx, hs := startHookSpan(ctx, h, "scrape")
+		ctx, err = h.HandleScrape(hCtx, req, resp)
+		if ctx = hs.end(ctx, err); err != nil {
 			logger.Error().
 				Err(err).
 				Object("request", req).
@@ -106,6 +504,41 @@ func (l *Logic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest,
 	}
 }
 
+// AfterScrapeAsync calls AfterScrape in background.
+// Close waits for all such calls to complete,
+// calls made after Close are ignored.
+func (l *Logic) AfterScrapeAsync(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	if !l.startAsync() {
+		return
+	}
+	go func() {
+		defer l.doneAsync()
+		l.AfterScrape(ctx, req, resp)
+	}()
+}
+
+// startAsync registers post hook executed in background,
+// returns false if Logic is closed
+func (l *Logic) startAsync() bool {
+	l.asyncMu.Lock()
+	defer l.asyncMu.Unlock()
+	if l.closed.Load() {
+		return false
+	}
+	l.inFlight.Add(1)
+	if l.pending.Add(1) == 1 {
+		l.progress.Store(timecache.NowUnixNano())
+	}
+	return true
+}
+
+// doneAsync marks completion of post hook executed in background
+func (l *Logic) doneAsync() {
+	l.progress.Store(timecache.NowUnixNano())
+	l.pending.Add(-1)
+	l.inFlight.Done()
+}
+
 // Ping executes checks if all Hook-s are operational
 func (l *Logic) Ping(ctx context.Context) (err error) {
 	for _, p := range l.pingers {
@@ -115,3 +548,161 @@ func (l *Logic) Ping(ctx context.Context) (err error) {
 	}
 	return
 }
+
+// Live reports if Logic is alive: its shutdown is not completed and post
+// hooks executed in background are not stalled (none of pending ones
+// completed during StalledTimeout, i.e. because of hung storage or
+// deadlock). This is the liveness indicator of process itself
+// ("restart me" if failed), so Logic stays alive while Close drains
+// background post hooks.
+func (l *Logic) Live() bool {
+	if l.shutdown.Load() {
+		return false
+	}
+	return l.pending.Load() == 0 ||
+		time.Duration(timecache.NowUnixNano()-l.progress.Load()) < StalledTimeout
+}
+
+// Ready checks if Logic is ready to serve requests:
+// storage is reachable, all Warmer hooks finished warmup
+// and all Pinger hooks are operational ("don't send traffic yet" if failed).
+// Logic is not ready since Close is called.
+func (l *Logic) Ready(ctx context.Context) (err error) {
+	if l.closed.Load() {
+		return ErrClosing
+	}
+	if l.store != nil {
+		if err = l.store.Ping(ctx); err != nil {
+			return
+		}
+	}
+	for _, w := range l.warmers {
+		if !w.WarmedUp() {
+			return ErrNotWarmedUp
+		}
+	}
+	return l.Ping(ctx)
+}
+
+// PurgeSwarm deletes all peers and download count of info hash from
+// storage. If info hash is v2, swarm of its truncated v1 form (hybrid
+// torrent) is also purged. Swarms of info hash in registered namespaces
+// (see RegisterSwarmNamespace) are purged too.
+// If deny is set, info hash is denied by all hooks, which implement Denier,
+// before purge, so swarm is not re-populated by subsequent announces.
+func (l *Logic) PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash, deny bool) (err error) {
+	ctx, span := tracing.Start(ctx, "purge swarm", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	if deny {
+		if len(l.deniers) == 0 {
+			return ErrNoDenier
+		}
+		for _, d := range l.deniers {
+			if err = d.Deny(ctx, ih); err != nil {
+				return
+			}
+		}
+	}
+	for _, h := range swarmHashes(ctx, ih) {
+		if err = storage.PurgeSwarm(ctx, l.store, h); err != nil {
+			return
+		}
+	}
+	if err == nil {
+		logger.Info().Stringer("infoHash", ih).Bool("deny", deny).Msg("swarm purged")
+	}
+	return
+}
+
+// SetMaxClockSkew overrides maximal clock skew of connection IDs
+// configured in frontends, which support it (i.e. UDP), without restart,
+// so clients with large clock skew (i.e. in mobile networks) may be
+// accepted temporarily. Zero resets override to configured values.
+func (l *Logic) SetMaxClockSkew(skew time.Duration) error {
+	if skew < 0 || skew > MaxAllowedClockSkew {
+		return ErrInvalidClockSkew
+	}
+	if prev := time.Duration(l.clockSkew.Swap(int64(skew))); prev != skew {
+		logger.Info().Dur("provided", skew).Dur("previous", prev).Msg("clock skew override changed")
+	}
+	return nil
+}
+
+// MaxClockSkew returns clock skew override set with SetMaxClockSkew
+// or zero if it is not set
+func (l *Logic) MaxClockSkew() time.Duration {
+	return time.Duration(l.clockSkew.Load())
+}
+
+// Reload forces all hooks, which implement Reloader, to re-read
+// their data sources immediately. All hooks are reloaded even if
+// some of them failed.
+func (l *Logic) Reload(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "reload")
+	defer func() { tracing.End(span, err) }()
+	if len(l.reloaders) == 0 {
+		return ErrNoReloader
+	}
+	errs := make([]error, 0, len(l.reloaders))
+	for _, r := range l.reloaders {
+		errs = append(errs, r.Reload(ctx))
+	}
+	if err = errors.Join(errs...); err == nil {
+		logger.Info().Int("hooks", len(l.reloaders)).Msg("hooks reloaded")
+	}
+	return
+}
+
+// Close waits for completion of post hooks executed in background
+// and closes all hooks, which implement io.Closer.
+// Should be called after frontends are stopped, but before storage.
+func (l *Logic) Close() error {
+	l.asyncMu.Lock()
+	l.closed.Store(true)
+	l.asyncMu.Unlock()
+	defer l.shutdown.Store(true)
+	l.inFlight.Wait()
+	l.backpressure.Close()
+	l.autoBan.Close()
+	l.watcher.Close()
+	var errs []error
+	for _, hooks := range [][]Hook{l.preHooks, l.postHooks} {
+		for _, h := range hooks {
+			if cl, isOk := h.(io.Closer); isOk {
+				if err := cl.Close(); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hookSpan holds tracing span of hook execution
+// and span of the caller
+type hookSpan struct {
+	parent, span trace.Span
+}
+
+// startHookSpan starts tracing span of hook execution if tracing is enabled
+func startHookSpan(ctx context.Context, h any, action string) (context.Context, hookSpan) {
+	if !tracing.Enabled() {
+		return ctx, hookSpan{}
+	}
+	parent := trace.SpanFromContext(ctx)
+	ctx, span := tracing.Start(ctx, fmt.Sprintf("hook %T", h), tracing.AttrAction.String(action))
+	return ctx, hookSpan{parent: parent, span: span}
+}
+
+// end ends hook span and restores caller span in context returned by hook,
+// so next hook span is the sibling of this one, not the child
+func (hs hookSpan) end(ctx context.Context, err error) context.Context {
+	if hs.span == nil {
+		return ctx
+	}
+	tracing.End(hs.span, err)
+	if ctx == nil {
+		return nil
+	}
+	return trace.ContextWithSpan(ctx, hs.parent)
+}
@@ -2,14 +2,21 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/netip"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
 )
 
 func init() {
@@ -89,3 +96,857 @@ func BenchmarkHookOverhead(b *testing.B) {
 		})
 	}
 }
+
+var errStorageDown = errors.New("storage is down")
+
+type downStorage struct {
+	storage.PeerStorage
+}
+
+func (downStorage) Ping(context.Context) error {
+	return errStorageDown
+}
+
+type coldHook struct {
+	nopHook
+	warm bool
+}
+
+func (h *coldHook) WarmedUp() bool { return h.warm }
+
+func TestLiveReady(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	require.True(t, l.Live())
+	require.Nil(t, l.Ready(ctx))
+
+	l = NewLogic(0, 0, downStorage{ps}, nil, nil)
+	require.True(t, l.Live())
+	require.ErrorIs(t, l.Ready(ctx), errStorageDown)
+
+	h := &coldHook{}
+	l = NewLogic(0, 0, ps, []Hook{h}, nil)
+	require.ErrorIs(t, l.Ready(ctx), ErrNotWarmedUp)
+	h.warm = true
+	require.Nil(t, l.Ready(ctx))
+
+	// post hooks are pending, but not stalled
+	l.startAsync()
+	require.True(t, l.Live())
+	l.progress.Add(-int64(StalledTimeout))
+	require.False(t, l.Live())
+	l.doneAsync()
+	require.True(t, l.Live())
+
+	// alive, but not ready while background post hooks are drained
+	l.startAsync()
+	closed := make(chan error)
+	go func() { closed <- l.Close() }()
+	require.Eventually(t, func() bool { return errors.Is(l.Ready(ctx), ErrClosing) }, time.Second, time.Millisecond)
+	require.True(t, l.Live())
+	l.doneAsync()
+	require.Nil(t, <-closed)
+	require.False(t, l.Live())
+	require.ErrorIs(t, l.Ready(ctx), ErrClosing)
+}
+
+func TestDeterministicPeers(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	for i := 0; i < 100; i++ {
+		p := bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i), 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881),
+		}
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	l.SetResponseConfig(ResponseConfig{DeterministicPeersWindow: time.Hour})
+	announce := func(id byte) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Left:     1,
+			NumWant:  10,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{id, 2},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+			},
+		}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		require.Len(t, resp.IPv4Peers, 10)
+		return resp.IPv4Peers
+	}
+
+	first := announce(1)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, first, announce(1), "peers sample must be stable within window")
+	}
+	require.NotEqual(t, first, announce(2), "peers sample must depend on requester")
+}
+
+func TestMaxPeersReturned(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	for i := 0; i < 100; i++ {
+		p := bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i), 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881),
+		}
+		require.Nil(t, ps.PutLeecher(ctx, ih, p))
+	}
+
+	announce := func(l *Logic, numWant uint32) int {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Left:     1,
+			NumWant:  numWant,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{1, 2},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+			},
+		}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		return len(resp.IPv4Peers) + len(resp.IPv6Peers)
+	}
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	require.Equal(t, 50, announce(l, 50))
+	l.SetResponseConfig(ResponseConfig{MaxPeersReturned: 30})
+	require.Equal(t, 30, announce(l, 50))
+	require.Equal(t, 20, announce(l, 20))
+}
+
+func TestPeriodicNumWantFactor(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	for i := 0; i < 100; i++ {
+		p := bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i), 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881),
+		}
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+
+	announce := func(l *Logic, e bittorrent.Event, numWant uint32) int {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    e,
+			Left:     1,
+			NumWant:  numWant,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{1, 2},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+			},
+		}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		return len(resp.IPv4Peers) + len(resp.IPv6Peers)
+	}
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	l.SetResponseConfig(ResponseConfig{PeriodicNumWantFactor: 0.5})
+	require.Equal(t, 50, announce(l, bittorrent.Started, 50))
+	require.Equal(t, 25, announce(l, bittorrent.None, 50))
+	require.Equal(t, 1, announce(l, bittorrent.None, 1))
+
+	l.SetResponseConfig(ResponseConfig{PeriodicNumWantFactor: 0.5, MaxPeersReturned: 30})
+	require.Equal(t, 30, announce(l, bittorrent.Started, 50))
+	require.Equal(t, 25, announce(l, bittorrent.None, 50))
+
+	// invalid factor disables scaling
+	l.SetResponseConfig(ResponseConfig{PeriodicNumWantFactor: 2})
+	require.Equal(t, 50, announce(l, bittorrent.None, 50))
+}
+
+func TestPeerSampleScaling(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	for i := 0; i < 400; i++ {
+		p := bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i), byte(i >> 8), 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881),
+		}
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+
+	announce := func(l *Logic, numWant uint32) int {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Left:     1,
+			NumWant:  numWant,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{1, 2},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+			},
+		}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		return len(resp.IPv4Peers) + len(resp.IPv6Peers)
+	}
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	l.SetResponseConfig(ResponseConfig{})
+	require.Equal(t, 50, announce(l, 50))
+
+	l.SetResponseConfig(ResponseConfig{PeerSampleScaling: SampleScalingSqrt})
+	require.Equal(t, 20, announce(l, 50))
+	require.Equal(t, 10, announce(l, 10))
+
+	l.SetResponseConfig(ResponseConfig{PeerSampleScaling: SampleScalingLog2})
+	require.Equal(t, 9, announce(l, 50))
+
+	l.SetResponseConfig(ResponseConfig{PeerSampleScaling: SampleScalingLog2, PeerSampleMin: 15})
+	require.Equal(t, 15, announce(l, 50))
+	require.Equal(t, 10, announce(l, 10))
+
+	// unknown function disables scaling
+	l.SetResponseConfig(ResponseConfig{PeerSampleScaling: "cube"})
+	require.Equal(t, 50, announce(l, 50))
+}
+
+func TestRelatedSwarms(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	thin, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	related, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	newPeer := func(i byte) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:       bittorrent.PeerID{i, 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, i}), 6881),
+		}
+	}
+	require.Nil(t, ps.PutSeeder(ctx, thin, newPeer(1)))
+	for i := byte(2); i < 12; i++ {
+		require.Nil(t, ps.PutSeeder(ctx, related, newPeer(i)))
+	}
+
+	announce := func(l *Logic) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: thin,
+			Left:     1,
+			NumWant:  5,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{1, 2},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+			},
+		}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		require.Equal(t, uint32(1), resp.Complete)
+		return resp.IPv4Peers
+	}
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	l.SetResponseConfig(ResponseConfig{})
+	require.Equal(t, []bittorrent.Peer{newPeer(1)}, announce(l))
+
+	mapping := map[string][]string{thin.String(): {related.String(), "invalid"}}
+	l.SetResponseConfig(ResponseConfig{RelatedInfoHashes: mapping, RelatedPeersThreshold: 2})
+	peers := announce(l)
+	require.Len(t, peers, 5)
+	// peers of own swarm go first
+	require.Equal(t, newPeer(1), peers[0])
+
+	// swarm is not thin
+	l.SetResponseConfig(ResponseConfig{RelatedInfoHashes: mapping, RelatedPeersThreshold: 1})
+	require.Len(t, announce(l), 1)
+}
+
+func TestStickyPeers(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	for i := 0; i < 100; i++ {
+		p := bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i), 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881),
+		}
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	l.SetResponseConfig(ResponseConfig{StickyPeersTTL: time.Hour})
+	announce := func(id bittorrent.PeerID, event bittorrent.Event, params bittorrent.Params) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			Params:   params,
+			InfoHash: ih,
+			Event:    event,
+			Left:     1,
+			NumWant:  10,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               id,
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+			},
+		}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		return resp
+	}
+	client := bittorrent.PeerID{1, 2}
+
+	// tracker id is not echoed (i.e. UDP announce)
+	first := announce(client, bittorrent.Started, nil)
+	require.Len(t, first.IPv4Peers, 10)
+	require.NotEmpty(t, first.TrackerID)
+	sessionKey := ih.RawString() + first.TrackerID
+	second := announce(client, bittorrent.None, nil)
+	require.Equal(t, first.TrackerID, second.TrackerID)
+	require.ElementsMatch(t, first.IPv4Peers, second.IPv4Peers, "peers subset must be stable within session")
+	other := announce(bittorrent.PeerID{3, 4}, bittorrent.Started, nil)
+	require.NotEqual(t, first.TrackerID, other.TrackerID)
+	require.Len(t, l.respHook.sticky.expires, 2)
+
+	// echoed tracker id identifies session even if peer ID changed
+	echoed := announce(bittorrent.PeerID{5, 6}, bittorrent.None, mapParams{"trackerid": first.TrackerID})
+	require.Equal(t, first.TrackerID, echoed.TrackerID)
+	require.ElementsMatch(t, first.IPv4Peers, echoed.IPv4Peers)
+	require.Len(t, l.respHook.sticky.expires, 2)
+
+	// peer left swarm, it is replaced with another one
+	gone := first.IPv4Peers[0]
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, gone))
+	third := announce(client, bittorrent.None, mapParams{"trackerid": first.TrackerID})
+	require.Len(t, third.IPv4Peers, 10)
+	require.NotContains(t, third.IPv4Peers, gone)
+	require.Subset(t, third.IPv4Peers, first.IPv4Peers[1:])
+
+	// stopped client drops session
+	announce(client, bittorrent.Stopped, mapParams{"trackerid": first.TrackerID})
+	v, err := ps.Load(ctx, StickyPeersStorageCtx, sessionKey)
+	require.Nil(t, err)
+	require.Nil(t, v)
+	require.Len(t, l.respHook.sticky.expires, 1)
+
+	// expired session is deleted from storage
+	announce(client, bittorrent.Started, nil)
+	l.respHook.sticky.expires[sessionKey] = 0
+	l.respHook.sticky.lastSweep = 0
+	l.respHook.sticky.sweep(ctx, timecache.NowUnixNano())
+	v, err = ps.Load(ctx, StickyPeersStorageCtx, sessionKey)
+	require.Nil(t, err)
+	require.Nil(t, v)
+	require.Len(t, l.respHook.sticky.expires, 1)
+}
+
+func TestRecentPeers(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	small, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	for i := 0; i < 100; i++ {
+		p := bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i), 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881),
+		}
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+		if i < 5 {
+			require.Nil(t, ps.PutSeeder(ctx, small, p))
+		}
+	}
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	l.SetResponseConfig(ResponseConfig{RecentPeersTTL: time.Hour})
+	announce := func(ih bittorrent.InfoHash, event bittorrent.Event) bittorrent.Peers {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    event,
+			Left:     1,
+			NumWant:  10,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{1, 2},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+			},
+		}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		return resp.IPv4Peers
+	}
+
+	first := announce(ih, bittorrent.Started)
+	require.Len(t, first, 10)
+	second := announce(ih, bittorrent.None)
+	require.Len(t, second, 10)
+	for _, p := range second {
+		require.NotContains(t, first, p, "recently returned peer must not be returned again")
+	}
+
+	// all peers of small swarm are returned every time
+	require.Len(t, announce(small, bittorrent.Started), 5)
+	require.Len(t, announce(small, bittorrent.None), 5)
+
+	// recent peers are forgotten when client stopped
+	announce(ih, bittorrent.Stopped)
+	key := bittorrent.PeerID{1, 2}.RawString() + ih.RawString()
+	recent, err := ps.Load(ctx, RecentPeersStorageCtx, key)
+	require.Nil(t, err)
+	require.Empty(t, recent)
+	require.NotContains(t, l.respHook.recent.expires, key)
+
+	// expired recent peers are deleted from storage
+	announce(ih, bittorrent.Started)
+	l.respHook.recent.expires[key] = 0
+	l.respHook.recent.lastSweep = 0
+	l.respHook.recent.sweepExpired(ctx, ps, timecache.NowUnixNano(), l.respHook.recent.ttl)
+	recent, err = ps.Load(ctx, RecentPeersStorageCtx, key)
+	require.Nil(t, err)
+	require.Empty(t, recent)
+	require.Len(t, l.respHook.recent.expires, 1)
+
+	// recent peers of namespaced swarm are separated
+	nsCtx := context.WithValue(ctx, SwarmNamespaceKey, "websocket")
+	nsRecent, err := l.respHook.recent.load(nsCtx, &bittorrent.AnnounceRequest{
+		InfoHash:    small,
+		RequestPeer: bittorrent.RequestPeer{ID: bittorrent.PeerID{1, 2}},
+	}, timecache.NowUnixNano())
+	require.Nil(t, err)
+	require.Empty(t, nsRecent)
+}
+
+func TestOmitEmptyScrapes(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih1, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	ih2, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+	require.Nil(t, ps.PutSeeder(ctx, ih1, p))
+	// zeroed swarm
+	require.Nil(t, ps.PutLeecher(ctx, ih2, p))
+	require.Nil(t, ps.DeleteLeecher(ctx, ih2, p))
+
+	l := NewLogic(0, 0, ps, nil, nil)
+	req := &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih1, ih2}}
+	_, resp, err := l.HandleScrape(ctx, req)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih1, Complete: 1}, {InfoHash: ih2}}, resp.Data)
+
+	l.SetResponseConfig(ResponseConfig{OmitEmptyScrapes: true})
+	_, resp, err = l.HandleScrape(ctx, req)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih1, Complete: 1}}, resp.Data)
+}
+
+type slowHook struct {
+	nopHook
+	done   chan struct{}
+	closed bool
+}
+
+func (h *slowHook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	time.Sleep(50 * time.Millisecond)
+	close(h.done)
+	return ctx, nil
+}
+
+func (h *slowHook) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestCloseWaitsPostHooks(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h := &slowHook{done: make(chan struct{})}
+	l := NewLogic(0, 0, ps, nil, []Hook{h})
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, RequestPeer: bittorrent.RequestPeer{
+		Port:             6881,
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+	}}
+	l.AfterAnnounceAsync(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, l.Close())
+	select {
+	case <-h.done:
+	default:
+		require.Fail(t, "post hook not completed before Close returned")
+	}
+	require.True(t, h.closed)
+}
+
+type countingStorage struct {
+	storage.PeerStorage
+	loads   int
+	loadErr error
+}
+
+func (s *countingStorage) Load(ctx context.Context, storeCtx string, key string) ([]byte, error) {
+	if storeCtx == IntervalStorageCtx {
+		s.loads++
+		if s.loadErr != nil {
+			return nil, s.loadErr
+		}
+	}
+	return s.PeerStorage.Load(ctx, storeCtx, key)
+}
+
+func TestIntervalOverrides(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+	cs := &countingStorage{PeerStorage: ps}
+
+	l := NewLogic(time.Hour, 30*time.Minute, cs, nil, nil)
+	l.SetIntervalOverrides(time.Minute)
+	ih1, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	ih2, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	require.Nil(t, ps.Put(ctx, IntervalStorageCtx, storage.Entry{Key: ih1.RawString(), Value: []byte("10m")}))
+
+	announce := func(ih bittorrent.InfoHash) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 1, RequestPeer: bittorrent.RequestPeer{
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+		}}
+		_, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	// miss, override applied
+	resp := announce(ih1)
+	require.Equal(t, 10*time.Minute, resp.Interval)
+	require.Equal(t, 10*time.Minute, resp.MinInterval)
+	require.Equal(t, 1, cs.loads)
+
+	// hit, storage is not queried, value is not changed till expiration
+	require.Nil(t, ps.Put(ctx, IntervalStorageCtx, storage.Entry{Key: ih1.RawString(), Value: []byte("45m")}))
+	resp = announce(ih1)
+	require.Equal(t, 10*time.Minute, resp.Interval)
+	require.Equal(t, 1, cs.loads)
+
+	// expired entry is reloaded
+	l.intervals.cache[ih1.RawString()] = cachedInterval{}
+	resp = announce(ih1)
+	require.Equal(t, 45*time.Minute, resp.Interval)
+	require.Equal(t, 30*time.Minute, resp.MinInterval)
+	require.Equal(t, 2, cs.loads)
+
+	// missing override uses default, absence is cached too
+	for i := 0; i < 2; i++ {
+		resp = announce(ih2)
+		require.Equal(t, time.Hour, resp.Interval)
+		require.Equal(t, 30*time.Minute, resp.MinInterval)
+	}
+	require.Equal(t, 3, cs.loads)
+
+	// stored override replaces cached value immediately
+	require.Nil(t, l.SetIntervalOverride(ctx, ih2, 20*time.Minute))
+	resp = announce(ih2)
+	require.Equal(t, 20*time.Minute, resp.Interval)
+	require.Equal(t, 20*time.Minute, resp.MinInterval)
+	require.Equal(t, 4, cs.loads)
+	require.Nil(t, l.SetIntervalOverride(ctx, ih2, 0))
+	resp = announce(ih2)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 5, cs.loads)
+
+	// storage failure does not fail announce
+	cs.loadErr = errors.New("storage failure")
+	l.intervals.cache[ih1.RawString()] = cachedInterval{}
+	resp = announce(ih1)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 30*time.Minute, resp.MinInterval)
+	require.Equal(t, 6, cs.loads)
+	// failure is cached briefly
+	resp = announce(ih1)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 6, cs.loads)
+	c := l.intervals.cache[ih1.RawString()]
+	require.LessOrEqual(t, c.expires, timecache.NowUnixNano()+int64(intervalErrorTTL))
+	cs.loadErr = nil
+	l.intervals.cache[ih1.RawString()] = cachedInterval{}
+	resp = announce(ih1)
+	require.Equal(t, 45*time.Minute, resp.Interval)
+	require.Equal(t, 7, cs.loads)
+
+	// disabled lookup
+	l.SetIntervalOverrides(0)
+	resp = announce(ih1)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 7, cs.loads)
+	require.ErrorIs(t, l.SetIntervalOverride(ctx, ih1, time.Minute), ErrNoIntervalOverrides)
+}
+
+func TestStoppedAllFamilies(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	id := bittorrent.PeerID([]byte("bbbbbbbbbbbbbbbbbbbb"))
+	announce := func(l *Logic, addr string, event bittorrent.Event) {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: event, Left: 1, RequestPeer: bittorrent.RequestPeer{
+			ID:               id,
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		}}
+		ctx, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		ps, err := memory.NewPeerStorage(memory.Config{})
+		require.Nil(t, err)
+		l := NewLogic(0, 0, ps, nil, nil)
+		l.SetSwarmConfig(SwarmConfig{StoppedAllFamilies: enabled})
+
+		announce(l, "10.0.0.1", bittorrent.Started)
+		announce(l, "fc00::1", bittorrent.Stopped)
+		leechers, _, _, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		if enabled {
+			require.Equal(t, uint32(0), leechers)
+		} else {
+			require.Equal(t, uint32(1), leechers)
+		}
+		require.Nil(t, ps.Close())
+	}
+}
+
+func TestUnknownLeft(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	l := NewLogic(0, 0, ps, nil, nil)
+
+	for i, event := range []bittorrent.Event{bittorrent.Started, bittorrent.Completed} {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: event, Left: bittorrent.UnknownLeft, RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{byte(i + 1)},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+		}}
+		ctx, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+	}
+	leechers, seeders, snatches, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), leechers)
+	require.Zero(t, seeders)
+	require.Zero(t, snatches)
+}
+
+type mapParams map[string]string
+
+func (p mapParams) GetString(key string) (v string, ok bool) {
+	v, ok = p[key]
+	return
+}
+
+func (mapParams) MarshalZerologObject(*zerolog.Event) {}
+
+type putsCountingStorage struct {
+	storage.PeerStorage
+	puts atomic.Int32
+}
+
+func (s *putsCountingStorage) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	s.puts.Add(1)
+	return s.PeerStorage.PutLeecher(ctx, ih, p)
+}
+
+func (s *putsCountingStorage) PeerExists(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer, seeder bool) (bool, error) {
+	return storage.PeerExists(ctx, s.PeerStorage, ih, p, seeder)
+}
+
+func TestRefreshOnScrape(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	id := "bbbbbbbbbbbbbbbbbbbb"
+	addr := bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}}
+	scrape := func(l *Logic, params bittorrent.Params) {
+		req := &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}, RequestAddresses: addr, Params: params}
+		ctx, resp, err := l.HandleScrape(ctx, req)
+		require.Nil(t, err)
+		l.AfterScrape(ctx, req, resp)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		ps, err := memory.NewPeerStorage(memory.Config{})
+		require.Nil(t, err)
+		cs := &putsCountingStorage{PeerStorage: ps}
+		l := NewLogic(0, 0, cs, nil, nil)
+		l.SetSwarmConfig(SwarmConfig{RefreshOnScrape: enabled})
+		require.Nil(t, ps.PutLeecher(ctx, ih, bittorrent.Peer{
+			ID:       bittorrent.PeerID([]byte(id)),
+			AddrPort: netip.AddrPortFrom(addr[0].Addr, 6881),
+		}))
+
+		// peer can not be identified
+		scrape(l, nil)
+		scrape(l, mapParams{"peer_id": id})
+		// unknown peer is not stored
+		scrape(l, mapParams{"peer_id": id, "port": "6882"})
+		require.Zero(t, cs.puts.Load())
+
+		scrape(l, mapParams{"peer_id": id, "port": "6881"})
+		if enabled {
+			require.Equal(t, int32(1), cs.puts.Load())
+		} else {
+			require.Zero(t, cs.puts.Load())
+		}
+		leechers, _, _, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		require.Equal(t, uint32(1), leechers)
+		require.Nil(t, ps.Close())
+	}
+}
+
+func TestNATPeersSortLast(t *testing.T) {
+	p1 := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.1.1.1:1")}
+	p2 := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("2.2.2.2:2")}
+	p3 := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("3.3.3.3:3")}
+	n := newNATPeers(time.Minute)
+	now := time.Now().UnixNano()
+	n.add(bittorrent.Peers{p1}, now)
+
+	peers := bittorrent.Peers{p1, p2, p3}
+	n.sortLast(peers, now)
+	require.Equal(t, bittorrent.Peers{p2, p3, p1}, peers)
+
+	// record is outdated
+	peers = bittorrent.Peers{p1, p2, p3}
+	n.sortLast(peers, now+int64(time.Minute))
+	require.Equal(t, bittorrent.Peers{p1, p2, p3}, peers)
+}
+
+func TestNATPeersSkippedBeforeSampling(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	l := NewLogic(0, 0, ps, nil, nil)
+	announce := func(ctx context.Context, i byte, numWant uint32) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			NumWant:  numWant,
+			Left:     1,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{i},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{10, 0, 0, i})}},
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+		return resp
+	}
+	natCtx := context.WithValue(ctx, BehindNATKey, true)
+	announce(natCtx, 1, 0)
+	for i := byte(2); i <= 5; i++ {
+		announce(ctx, i, 0)
+	}
+	natPeer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+
+	// other peers fit into numwant
+	for i := 0; i < 10; i++ {
+		require.NotContains(t, announce(ctx, 5, 3).IPv4Peers, natPeer)
+	}
+	// there are not enough other peers
+	require.Contains(t, announce(ctx, 5, 5).IPv4Peers, natPeer)
+}
+
+func TestSwarmNamespace(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+	nsCtx := context.WithValue(ctx, SwarmNamespaceKey, "websocket")
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	l := NewLogic(0, 0, ps, nil, nil)
+	announce := func(ctx context.Context, i byte, event bittorrent.Event) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			NumWant:  10,
+			Left:     1,
+			Event:    event,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{i},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{10, 0, 0, i})}},
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+		return resp
+	}
+	announce(nsCtx, 1, bittorrent.Started)
+	resp := announce(ctx, 2, bittorrent.Started)
+	// the only peer is the requester itself
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, bittorrent.PeerID{2}, resp.IPv4Peers[0].ID)
+
+	resp = announce(nsCtx, 3, bittorrent.Started)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, bittorrent.PeerID{1}, resp.IPv4Peers[0].ID)
+
+	leechers, _, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), leechers)
+
+	announce(nsCtx, 1, bittorrent.Stopped)
+	announce(nsCtx, 3, bittorrent.Stopped)
+	leechers, _, _, err = ps.ScrapeSwarm(ctx, swarmHash(nsCtx, ih))
+	require.Nil(t, err)
+	require.Zero(t, leechers)
+
+	// purge deletes swarms of registered namespaces
+	RegisterSwarmNamespace("websocket")
+	announce(nsCtx, 1, bittorrent.Started)
+	require.Nil(t, l.PurgeSwarm(ctx, ih, false))
+	for _, h := range []bittorrent.InfoHash{ih, swarmHash(nsCtx, ih)} {
+		leechers, _, _, err = ps.ScrapeSwarm(ctx, h)
+		require.Nil(t, err)
+		require.Zero(t, leechers)
+	}
+}
@@ -0,0 +1,210 @@
+// Package mininterval implements a Hook that ensures `min interval`
+// is set in announce responses and increases it for clients,
+// which re-announce faster than allowed, instead of rejecting them.
+package mininterval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "min interval"
+
+const (
+	defaultFactor        = 2
+	defaultStateLifetime = time.Hour
+)
+
+var logger = log.NewLogger("middleware/min interval")
+
+// ErrInvalidMaxMinInterval is returned for a config with negative MaxMinInterval.
+var ErrInvalidMaxMinInterval = errors.New("invalid max_min_interval")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents the configuration for the mininterval middleware.
+type Config struct {
+	// Factor is the multiplier of min interval of client, which
+	// announced faster than its previous min interval. Min interval of
+	// client, which announces in time, is divided by Factor
+	// until it reaches min interval of response.
+	Factor float64 `cfg:"factor"`
+	// MaxMinInterval is the upper limit of increased min interval.
+	// If zero, announce interval of response is used.
+	MaxMinInterval time.Duration `cfg:"max_min_interval"`
+	// StateLifetime is the duration after which state of peer,
+	// which did not announce, is dropped
+	StateLifetime time.Duration `cfg:"state_lifetime"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.Factor <= 1 {
+		validCfg.Factor = defaultFactor
+		logger.Warn().
+			Str("name", "Factor").
+			Float64("provided", cfg.Factor).
+			Float64("default", validCfg.Factor).
+			Msg("falling back to default configuration")
+	}
+	if cfg.StateLifetime <= 0 {
+		validCfg.StateLifetime = defaultStateLifetime
+		logger.Warn().
+			Str("name", "StateLifetime").
+			Dur("provided", cfg.StateLifetime).
+			Dur("default", validCfg.StateLifetime).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg.MaxMinInterval < 0 {
+		return nil, fmt.Errorf("middleware %s: %w", Name, ErrInvalidMaxMinInterval)
+	}
+	return newHook(cfg.Validate()), nil
+}
+
+type peerKey struct {
+	ih bittorrent.InfoHash
+	id bittorrent.PeerID
+}
+
+// peerState holds time of the last announce of peer
+// and min interval returned to it
+type peerState struct {
+	last        int64
+	minInterval time.Duration
+}
+
+type hook struct {
+	cfg    Config
+	mu     sync.Mutex
+	states map[peerKey]*peerState
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func newHook(cfg Config) *hook {
+	h := &hook{
+		cfg:    cfg,
+		states: make(map[peerKey]*peerState),
+		closed: make(chan any),
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.StateLifetime)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closed:
+				return
+			case <-t.C:
+				h.gc(timecache.Now().Add(-cfg.StateLifetime))
+			}
+		}
+	}()
+	return h
+}
+
+// pace registers announce of peer and returns min interval for it.
+// If periodic announce is made earlier than min interval returned
+// previously, it is increased up to limit, otherwise it is decreased
+// down to base.
+func (h *hook) pace(k peerKey, base, limit time.Duration, periodic bool, now time.Time) time.Duration {
+	ts := now.UnixNano()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, exists := h.states[k]
+	if !exists {
+		st = &peerState{minInterval: base}
+		h.states[k] = st
+	}
+	minInterval := base
+	if exists && periodic {
+		if time.Duration(ts-st.last) < st.minInterval {
+			minInterval = time.Duration(float64(st.minInterval) * h.cfg.Factor)
+		} else {
+			minInterval = time.Duration(float64(st.minInterval) / h.cfg.Factor)
+		}
+		minInterval = min(max(minInterval, base), limit)
+	}
+	st.last, st.minInterval = ts, minInterval
+	return minInterval
+}
+
+func (h *hook) forget(k peerKey) {
+	h.mu.Lock()
+	delete(h.states, k)
+	h.mu.Unlock()
+}
+
+func (h *hook) gc(cutoff time.Time) {
+	cutoffUnix := cutoff.UnixNano()
+	h.mu.Lock()
+	for k, st := range h.states {
+		if st.last <= cutoffUnix {
+			delete(h.states, k)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if resp.MinInterval <= 0 {
+		resp.MinInterval = resp.Interval
+	}
+	k := peerKey{req.InfoHash, req.ID}
+	if req.Event == bittorrent.Stopped {
+		h.forget(k)
+		return ctx, nil
+	}
+	limit := h.cfg.MaxMinInterval
+	if limit <= 0 {
+		limit = resp.Interval
+	}
+	limit = max(limit, resp.MinInterval)
+	// announces with events are not expected to be in time
+	resp.MinInterval = h.pace(k, resp.MinInterval, limit, req.Event == bittorrent.None, timecache.Now())
+	if resp.Interval < resp.MinInterval {
+		resp.Interval = resp.MinInterval
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not altered.
+	return ctx, nil
+}
+
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+	})
+	return nil
+}
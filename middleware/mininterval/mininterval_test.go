@@ -0,0 +1,98 @@
+package mininterval
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+func TestFastClient(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"factor": 2}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	lgc := middleware.NewLogic(30*time.Minute, 0, ps, []middleware.Hook{h}, nil)
+	announce := func(id byte, e bittorrent.Event) *bittorrent.AnnounceResponse {
+		_, resp, err := lgc.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    e,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{id},
+				Port:             1234,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+			},
+		})
+		require.Nil(t, err)
+		return resp
+	}
+
+	// min interval is always set
+	resp := announce(1, bittorrent.Started)
+	require.Equal(t, 30*time.Minute, resp.MinInterval)
+
+	lgc = middleware.NewLogic(30*time.Minute, 5*time.Minute, ps, []middleware.Hook{h}, nil)
+	resp = announce(2, bittorrent.Started)
+	require.Equal(t, 5*time.Minute, resp.MinInterval)
+	// fast re-announces are not rejected, but min interval is increased
+	resp = announce(2, bittorrent.None)
+	require.Equal(t, 10*time.Minute, resp.MinInterval)
+	resp = announce(2, bittorrent.None)
+	require.Equal(t, 20*time.Minute, resp.MinInterval)
+	resp = announce(2, bittorrent.None)
+	require.Equal(t, 30*time.Minute, resp.MinInterval, "min interval must not exceed interval")
+	require.Equal(t, 30*time.Minute, resp.Interval)
+
+	// events are not counted as fast announces
+	resp = announce(3, bittorrent.Started)
+	require.Equal(t, 5*time.Minute, resp.MinInterval)
+	resp = announce(3, bittorrent.Completed)
+	require.Equal(t, 5*time.Minute, resp.MinInterval)
+
+	// state is reset by stopped event
+	announce(2, bittorrent.Stopped)
+	resp = announce(2, bittorrent.None)
+	require.Equal(t, 5*time.Minute, resp.MinInterval)
+}
+
+func TestPaceDecrease(t *testing.T) {
+	h := newHook(Config{Factor: 2, StateLifetime: time.Hour})
+	defer h.Close()
+	k := peerKey{id: bittorrent.PeerID{1}}
+	base, limit := time.Minute, time.Hour
+	now := time.Now()
+
+	require.Equal(t, base, h.pace(k, base, limit, true, now))
+	now = now.Add(time.Second)
+	require.Equal(t, 2*base, h.pace(k, base, limit, true, now))
+	now = now.Add(time.Second)
+	require.Equal(t, 4*base, h.pace(k, base, limit, true, now))
+	// client which announces in time is slowly trusted again
+	now = now.Add(4 * base)
+	require.Equal(t, 2*base, h.pace(k, base, limit, true, now))
+	now = now.Add(2 * base)
+	require.Equal(t, base, h.pace(k, base, limit, true, now))
+	now = now.Add(base)
+	require.Equal(t, base, h.pace(k, base, limit, true, now))
+
+	h.gc(now)
+	require.Empty(t, h.states)
+}
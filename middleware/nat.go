@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+type behindNAT struct{}
+
+// BehindNATKey is a key for the context of an Announce to mark
+// requester as behind NAT (i.e. frontend failed to connect to announced
+// port of requester), such peers are unconnectable.
+// Any non-nil value set for this key will cause the response middleware
+// to return addresses of requester to other peers only if there are
+// not enough other peers in swarm for some time.
+var BehindNATKey = behindNAT{}
+
+// defaultNATPeersTTL is the duration for which peer is remembered as
+// behind NAT if announce interval is not set
+const defaultNATPeersTTL = time.Hour
+
+// natPeers holds peers announced with BehindNATKey and time,
+// until which they should be deprioritized.
+// Data is process-local and not shared between tracker instances.
+type natPeers struct {
+	sync.RWMutex
+	ttl       int64
+	nextClean int64
+	peers     map[bittorrent.Peer]int64
+}
+
+func newNATPeers(ttl time.Duration) *natPeers {
+	if ttl <= 0 {
+		ttl = defaultNATPeersTTL
+	}
+	return &natPeers{ttl: int64(ttl), peers: make(map[bittorrent.Peer]int64)}
+}
+
+// add marks peers as behind NAT and removes outdated records
+// not more often than once per ttl
+func (n *natPeers) add(peers bittorrent.Peers, now int64) {
+	n.Lock()
+	defer n.Unlock()
+	for _, p := range peers {
+		n.peers[p] = now + n.ttl
+	}
+	if now >= n.nextClean {
+		for p, until := range n.peers {
+			if until <= now {
+				delete(n.peers, p)
+			}
+		}
+		n.nextClean = now + n.ttl
+	}
+}
+
+// extra returns number of additional peers, which should be fetched
+// from storage to be able to skip peers behind NAT, but not more than limit
+func (n *natPeers) extra(limit int) int {
+	n.RLock()
+	defer n.RUnlock()
+	return min(len(n.peers), limit)
+}
+
+// sortLast moves peers marked as behind NAT to the end of
+// provided slice, preserving order of other peers
+func (n *natPeers) sortLast(peers []bittorrent.Peer, now int64) {
+	n.RLock()
+	defer n.RUnlock()
+	if len(n.peers) == 0 || len(peers) < 2 {
+		return
+	}
+	deprioritized := make(bittorrent.Peers, 0, len(peers))
+	i := 0
+	for _, p := range peers {
+		if until, found := n.peers[p]; found && until > now {
+			deprioritized = append(deprioritized, p)
+		} else {
+			peers[i] = p
+			i++
+		}
+	}
+	copy(peers[i:], deprioritized)
+}
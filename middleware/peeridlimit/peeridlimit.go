@@ -0,0 +1,291 @@
+// Package peeridlimit implements a Hook that limits the number of
+// distinct peer IDs announced from one address for one info hash,
+// so swarms can not be inflated with fake peers from single host.
+package peeridlimit
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/str2bytes"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "peer id limit"
+
+// StorageCtx is the name of storage context where peer IDs
+// announced from address are placed. Key is raw (unmapped) address
+// followed by raw info hash, value is the sequence of raw peer IDs,
+// each followed by its expiration time (unix nanoseconds, big endian).
+// Keys, which expired, are deleted by the tracker instance,
+// which updated them last.
+const StorageCtx = "MW_PEER_ID_LIMIT"
+
+const (
+	defaultMaxPeerIDs = 4
+	defaultWindow     = time.Hour
+	entryLen          = bittorrent.PeerIDLen + 8
+	// number of locks, which serialize updates of keys
+	lockStripes = 256
+)
+
+var logger = log.NewLogger("middleware/peer id limit")
+
+// ErrTooManyPeerIDs is returned in response to announce of new
+// peer ID from address, which already announced maximal number
+// of peer IDs for the info hash.
+var ErrTooManyPeerIDs = bittorrent.ClientError("too many peer IDs from address")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents the configuration for the peeridlimit middleware.
+type Config struct {
+	// MaxPeerIDs is the number of distinct peer IDs allowed
+	// to announce the same info hash from one address.
+	MaxPeerIDs uint `cfg:"max_peer_ids"`
+	// Window is the duration after which peer ID, which did not
+	// announce, is not counted anymore.
+	Window time.Duration `cfg:"window"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.MaxPeerIDs == 0 {
+		validCfg.MaxPeerIDs = defaultMaxPeerIDs
+		logger.Warn().
+			Str("name", "MaxPeerIDs").
+			Uint("provided", cfg.MaxPeerIDs).
+			Uint("default", validCfg.MaxPeerIDs).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Window <= 0 {
+		validCfg.Window = defaultWindow
+		logger.Warn().
+			Str("name", "Window").
+			Dur("provided", cfg.Window).
+			Dur("default", validCfg.Window).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	return newHook(cfg.Validate(), st), nil
+}
+
+type entry struct {
+	id      bittorrent.PeerID
+	expires int64
+}
+
+// unpackEntries decodes stored entries, expired ones are skipped
+func unpackEntries(v []byte, now int64) []entry {
+	entries := make([]entry, 0, len(v)/entryLen)
+	for ; len(v) >= entryLen; v = v[entryLen:] {
+		e := entry{expires: int64(binary.BigEndian.Uint64(v[bittorrent.PeerIDLen:entryLen]))}
+		if e.expires > now {
+			copy(e.id[:], v[:bittorrent.PeerIDLen])
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func packEntries(entries []entry) []byte {
+	v := make([]byte, 0, len(entries)*entryLen)
+	for _, e := range entries {
+		v = append(v, e.id[:]...)
+		v = binary.BigEndian.AppendUint64(v, uint64(e.expires))
+	}
+	return v
+}
+
+func limitKey(addr netip.Addr, ih bittorrent.InfoHash) string {
+	return string(addr.Unmap().AsSlice()) + ih.RawString()
+}
+
+type hook struct {
+	store  storage.DataStorage
+	max    int
+	window int64
+
+	locks [lockStripes]sync.Mutex
+
+	mu sync.Mutex
+	// expiration time of keys updated by this instance
+	expires map[string]int64
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func newHook(cfg Config, st storage.DataStorage) *hook {
+	h := &hook{
+		store:   st,
+		max:     int(cfg.MaxPeerIDs),
+		window:  int64(cfg.Window),
+		expires: make(map[string]int64),
+		closed:  make(chan any),
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.Window)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closed:
+				return
+			case <-t.C:
+				h.sweep(context.Background(), timecache.NowUnixNano())
+			}
+		}
+	}()
+	return h
+}
+
+// lock returns mutex, which serializes updates of key
+func (h *hook) lock(key string) *sync.Mutex {
+	f := fnv.New32a()
+	_, _ = f.Write(str2bytes.StringToBytes(key))
+	return &h.locks[f.Sum32()%lockStripes]
+}
+
+// check registers announce of peer ID from address and returns
+// ErrTooManyPeerIDs if address already has maximal number of
+// other peer IDs. Stopped peer ID is forgotten.
+// Load and update of key are serialized within tracker instance,
+// but not between instances sharing storage, because DataStorage
+// does not provide atomic update, so concurrent announces of new
+// peer IDs to different instances may slightly exceed the limit.
+func (h *hook) check(ctx context.Context, key string, id bittorrent.PeerID, stopped bool, now int64) error {
+	mu := h.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := h.store.Load(ctx, StorageCtx, key)
+	if err != nil {
+		return err
+	}
+	entries := unpackEntries(v, now)
+	i := slices.IndexFunc(entries, func(e entry) bool { return e.id == id })
+	switch {
+	case stopped:
+		if i < 0 {
+			return nil
+		}
+		entries = slices.Delete(entries, i, i+1)
+	case i >= 0:
+		entries[i].expires = now + h.window
+	case len(entries) >= h.max:
+		return ErrTooManyPeerIDs
+	default:
+		entries = append(entries, entry{id: id, expires: now + h.window})
+	}
+	// some storages do not overwrite existing values
+	if err = h.store.Delete(ctx, StorageCtx, key); err == nil && len(entries) > 0 {
+		err = h.store.Put(ctx, StorageCtx, storage.Entry{Key: key, Value: packEntries(entries)})
+	}
+	if err == nil {
+		h.mu.Lock()
+		if len(entries) > 0 {
+			h.expires[key] = slices.MaxFunc(entries, func(a, b entry) int { return cmp.Compare(a.expires, b.expires) }).expires
+		} else {
+			delete(h.expires, key)
+		}
+		h.mu.Unlock()
+	}
+	return err
+}
+
+// sweep deletes keys updated by this instance, which entries
+// are all expired, from storage
+func (h *hook) sweep(ctx context.Context, now int64) {
+	var expired []string
+	h.mu.Lock()
+	for k, exp := range h.expires {
+		if exp <= now {
+			expired = append(expired, k)
+			delete(h.expires, k)
+		}
+	}
+	h.mu.Unlock()
+	var failed int
+	var lastErr error
+	for _, k := range expired {
+		// key may be updated by another instance
+		mu := h.lock(k)
+		mu.Lock()
+		v, err := h.store.Load(ctx, StorageCtx, k)
+		if err == nil && len(v) > 0 && len(unpackEntries(v, now)) == 0 {
+			err = h.store.Delete(ctx, StorageCtx, k)
+		}
+		mu.Unlock()
+		if err != nil {
+			failed, lastErr = failed+1, err
+		}
+	}
+	if failed > 0 {
+		logger.Warn().Err(lastErr).Int("count", failed).Msg("unable to delete expired peer IDs")
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	now := timecache.NowUnixNano()
+	for _, a := range req.RequestAddresses {
+		// address provided by client (i.e. `ip` parameter) may be
+		// spoofed, so only address of connection is counted
+		if a.Provided {
+			continue
+		}
+		err := h.check(ctx, limitKey(a.Addr, req.InfoHash), req.ID, req.Event == bittorrent.Stopped, now)
+		if errors.Is(err, ErrTooManyPeerIDs) {
+			logger.Warn().
+				Stringer("addr", a.Addr).
+				Stringer("infoHash", req.InfoHash).
+				Stringer("peerID", req.ID).
+				Msg("peer ID rejected: limit of address exceeded")
+		}
+		if err != nil {
+			return ctx, err
+		}
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not limited.
+	return ctx, nil
+}
+
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+	})
+	return nil
+}
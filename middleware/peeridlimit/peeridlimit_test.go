@@ -0,0 +1,95 @@
+package peeridlimit
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+func TestPeerIDLimit(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"max_peer_ids": 2}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	lgc := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{h}, nil)
+	announce := func(id byte, addr string, e bittorrent.Event, provided ...string) error {
+		addrs := bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}}
+		for _, a := range provided {
+			addrs = append(addrs, bittorrent.RequestAddress{Addr: netip.MustParseAddr(a), Provided: true})
+		}
+		_, _, err := lgc.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    e,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{id},
+				Port:             1234,
+				RequestAddresses: addrs,
+			},
+		})
+		return err
+	}
+
+	require.Nil(t, announce(1, "10.0.0.1", bittorrent.Started))
+	require.Nil(t, announce(2, "10.0.0.1", bittorrent.Started))
+	require.ErrorIs(t, announce(3, "10.0.0.1", bittorrent.Started), ErrTooManyPeerIDs)
+	// known peer IDs and other addresses are not affected
+	require.Nil(t, announce(1, "10.0.0.1", bittorrent.None))
+	require.Nil(t, announce(3, "10.0.0.2", bittorrent.Started))
+	// stopped peer ID frees the slot
+	require.Nil(t, announce(2, "10.0.0.1", bittorrent.Stopped))
+	require.Nil(t, announce(3, "10.0.0.1", bittorrent.Started))
+	// address provided by client is not counted
+	require.Nil(t, announce(4, "10.0.0.3", bittorrent.Started, "10.0.0.1"))
+}
+
+func TestPeerIDExpiry(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h := newHook(Config{MaxPeerIDs: 1, Window: time.Minute}, ps)
+	defer h.Close()
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	key := limitKey(netip.MustParseAddr("::ffff:10.0.0.1"), ih)
+	require.Equal(t, limitKey(netip.MustParseAddr("10.0.0.1"), ih), key)
+	now := time.Now()
+
+	require.Nil(t, h.check(ctx, key, bittorrent.PeerID{1}, false, now.UnixNano()))
+	now = now.Add(30 * time.Second)
+	require.ErrorIs(t, h.check(ctx, key, bittorrent.PeerID{2}, false, now.UnixNano()), ErrTooManyPeerIDs)
+	// re-announce prolongs peer ID
+	require.Nil(t, h.check(ctx, key, bittorrent.PeerID{1}, false, now.UnixNano()))
+	now = now.Add(time.Minute - time.Second)
+	require.ErrorIs(t, h.check(ctx, key, bittorrent.PeerID{2}, false, now.UnixNano()), ErrTooManyPeerIDs)
+	now = now.Add(time.Second)
+	require.Nil(t, h.check(ctx, key, bittorrent.PeerID{2}, false, now.UnixNano()))
+
+	// expired key is deleted by sweep
+	require.Contains(t, h.expires, key)
+	now = now.Add(time.Minute)
+	h.sweep(ctx, now.UnixNano())
+	require.Empty(t, h.expires)
+	v, err := ps.Load(ctx, StorageCtx, key)
+	require.Nil(t, err)
+	require.Empty(t, v)
+}
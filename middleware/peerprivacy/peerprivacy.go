@@ -0,0 +1,91 @@
+// Package peerprivacy implements a Hook that marks announces of
+// flagged info hashes, so frontends never emit peer IDs in responses.
+package peerprivacy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "peer privacy"
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents the configuration for the peerprivacy middleware.
+type Config struct {
+	// HashList static list of HEX-encoded flagged InfoHashes.
+	HashList []string `cfg:"hash_list"`
+	// StorageCtx is the name of storage context where flagged
+	// InfoHashes may be placed by external tool. Not checked if empty.
+	StorageCtx string `cfg:"storage_ctx"`
+}
+
+type hook struct {
+	store      storage.DataStorage
+	flagged    map[string]struct{}
+	storageCtx string
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		store:      st,
+		flagged:    make(map[string]struct{}, len(cfg.HashList)),
+		storageCtx: cfg.StorageCtx,
+	}
+	for _, s := range cfg.HashList {
+		ih, err := bittorrent.NewInfoHashString(s)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %s: %w", Name, s, err)
+		}
+		h.flagged[ih.RawString()] = struct{}{}
+		if len(ih) == bittorrent.InfoHashV2Len {
+			h.flagged[ih.TruncateV1().RawString()] = struct{}{}
+		}
+	}
+	return h, nil
+}
+
+// private checks if info hash (or its truncated v1 form)
+// is in static list or in storage context
+func (h *hook) private(ctx context.Context, ih bittorrent.InfoHash) (bool, error) {
+	hashes := []bittorrent.InfoHash{ih}
+	if len(ih) == bittorrent.InfoHashV2Len {
+		hashes = append(hashes, ih.TruncateV1())
+	}
+	for _, ih := range hashes {
+		if _, found := h.flagged[ih.RawString()]; found {
+			return true, nil
+		}
+		if len(h.storageCtx) > 0 {
+			if found, err := h.store.Contains(ctx, h.storageCtx, ih.RawString()); found || err != nil {
+				return found, err
+			}
+		}
+	}
+	return false, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	private, err := h.private(ctx, req.InfoHash)
+	if err == nil && private {
+		ctx = context.WithValue(ctx, middleware.HidePeerIDsKey, true)
+	}
+	return ctx, err
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrape responses do not contain peers.
+	return ctx, nil
+}
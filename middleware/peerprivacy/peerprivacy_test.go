@@ -0,0 +1,42 @@
+package peerprivacy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestPeerPrivacy(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	listed, _ := bittorrent.NewInfoHashString("3532cf2d327fad8448c075b4cb42c8136964a435")
+	stored, _ := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	hybrid, _ := bittorrent.NewInfoHashString("5532cf2d327fad8448c075b4cb42c8136964a4355532cf2d327fad8448c075b4")
+	public, _ := bittorrent.NewInfoHashString("6532cf2d327fad8448c075b4cb42c8136964a435")
+	require.Nil(t, ps.Put(context.Background(), "PRIVATE", storage.Entry{Key: stored.RawString(), Value: []byte{1}},
+		storage.Entry{Key: hybrid.TruncateV1().RawString(), Value: []byte{1}}))
+
+	_, err = build(conf.MapConfig{"hash_list": []string{"not a hash"}}, ps)
+	require.NotNil(t, err)
+
+	h, err := build(conf.MapConfig{
+		"hash_list":   []string{listed.String()},
+		"storage_ctx": "PRIVATE",
+	}, ps)
+	require.Nil(t, err)
+
+	for ih, private := range map[bittorrent.InfoHash]bool{listed: true, stored: true, hybrid: true, public: false} {
+		ctx, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		require.Equal(t, private, ctx.Value(middleware.HidePeerIDsKey) != nil, ih.String())
+	}
+}
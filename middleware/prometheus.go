@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+// periodicEventLabel is the label value for announces without event
+const periodicEventLabel = "periodic"
+
+var promAnnouncesByEvent = metrics.Register(prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_announces_by_event_total",
+		Help: "The number of announce requests by provided event",
+	},
+	[]string{"event"},
+))
+
+var promCircuitState = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "mochi_storage_circuit_state",
+	Help: "The state of storage circuit breaker: 0 - closed, 1 - open, 2 - half-open",
+}))
+
+var promStorageDegraded = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "mochi_storage_degraded",
+	Help: "Whether tracker works in degraded mode because storage is unavailable (1) or not (0)",
+}))
+
+var promStorageInFlight = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "mochi_storage_inflight_operations",
+	Help: "The number of storage operations in progress, if concurrency limit is set",
+}))
+
+var promScrapeCacheRequests = metrics.Register(prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_scrape_cache_requests_total",
+		Help: "The number of swarm peers counts requests to response cache by result (hit or miss)",
+	},
+	[]string{"result"},
+))
+
+var promAutoBanned = metrics.Register(prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mochi_auto_banned_total",
+	Help: "The number of addresses banned for exceeding rate limits",
+}))
+
+var promEffectiveInterval = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "mochi_effective_announce_interval_seconds",
+	Help: "The announce interval increased by backpressure while tracker is under load",
+}))
+
+var promPeersReturned = metrics.Register(prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mochi_announce_peers_returned",
+		Help:    "The number of peers returned in announce response by address family and requester kind",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 200},
+	},
+	[]string{"address_family", "requester"},
+))
+
+var promEmptyResponses = metrics.Register(prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_announce_empty_responses_total",
+		Help: "The number of announce responses without peers except requester itself by requester kind",
+	},
+	[]string{"requester"},
+))
+
+// recordReturnedPeers observes number of returned peers of each
+// address family. If empty is set, response contains only requester itself,
+// so zeroes are observed.
+func recordReturnedPeers(seeding, empty bool, resp *bittorrent.AnnounceResponse) {
+	requester := "leecher"
+	if seeding {
+		requester = "seeder"
+	}
+	v4, v6 := len(resp.IPv4Peers), len(resp.IPv6Peers)
+	if empty {
+		v4, v6 = 0, 0
+		promEmptyResponses.WithLabelValues(requester).Inc()
+	}
+	promPeersReturned.WithLabelValues("IPv4", requester).Observe(float64(v4))
+	promPeersReturned.WithLabelValues("IPv6", requester).Observe(float64(v6))
+}
+
+// recordAnnounceEvent increments announces counter with event label
+func recordAnnounceEvent(e bittorrent.Event) {
+	label := periodicEventLabel
+	if e != bittorrent.None {
+		label = e.String()
+	}
+	promAnnouncesByEvent.WithLabelValues(label).Inc()
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestAnnouncesByEvent(t *testing.T) {
+	l := &Logic{}
+	for e, label := range map[bittorrent.Event]string{
+		bittorrent.None:      periodicEventLabel,
+		bittorrent.Started:   bittorrent.StartedStr,
+		bittorrent.Stopped:   bittorrent.StoppedStr,
+		bittorrent.Completed: bittorrent.CompletedStr,
+	} {
+		before := testutil.ToFloat64(promAnnouncesByEvent.WithLabelValues(label))
+		_, _, err := l.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{
+			Event: e,
+			RequestPeer: bittorrent.RequestPeer{
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+			},
+		})
+		require.Nil(t, err)
+		require.Equal(t, before+1, testutil.ToFloat64(promAnnouncesByEvent.WithLabelValues(label)), label)
+	}
+}
+
+// histogramStats returns count and sum of samples of histogram
+// with provided name and labels from default registry
+func histogramStats(t *testing.T, name string, labels map[string]string) (count uint64, sum float64) {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.Nil(t, err)
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if labels[lp.GetName()] != lp.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+		}
+	}
+	return
+}
+
+func TestReturnedPeers(t *testing.T) {
+	srv := metrics.NewServer("127.0.0.1:0")
+	defer srv.Close()
+	require.Eventually(t, metrics.Enabled, time.Second, time.Millisecond)
+
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	for i := byte(1); i <= 3; i++ {
+		require.Nil(t, ps.PutSeeder(ctx, ih, bittorrent.Peer{
+			ID:       bittorrent.PeerID{i},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, i}), 6881),
+		}))
+	}
+	require.Nil(t, ps.PutSeeder(ctx, ih, bittorrent.Peer{
+		ID:       bittorrent.PeerID{4},
+		AddrPort: netip.MustParseAddrPort("[2001:db8::1]:6881"),
+	}))
+
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil)
+	v4Labels := map[string]string{"address_family": "IPv4", "requester": "leecher"}
+	v6Labels := map[string]string{"address_family": "IPv6", "requester": "leecher"}
+	v4Count, v4Sum := histogramStats(t, "mochi_announce_peers_returned", v4Labels)
+	v6Count, v6Sum := histogramStats(t, "mochi_announce_peers_returned", v6Labels)
+	empty := testutil.ToFloat64(promEmptyResponses.WithLabelValues("leecher"))
+
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 1, NumWant: 50, RequestPeer: bittorrent.RequestPeer{
+		ID:               bittorrent.PeerID{0xFF},
+		Port:             6881,
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.1.1")}},
+	}}
+	_, _, err = l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	count, sum := histogramStats(t, "mochi_announce_peers_returned", v4Labels)
+	require.Equal(t, v4Count+1, count)
+	require.Equal(t, v4Sum+3, sum)
+	count, sum = histogramStats(t, "mochi_announce_peers_returned", v6Labels)
+	require.Equal(t, v6Count+1, count)
+	require.Equal(t, v6Sum+1, sum)
+	require.Equal(t, empty, testutil.ToFloat64(promEmptyResponses.WithLabelValues("leecher")))
+
+	// requester itself is not counted
+	req.InfoHash, _ = bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	_, resp, err := l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Len(t, resp.IPv4Peers, 1)
+	count, sum = histogramStats(t, "mochi_announce_peers_returned", v4Labels)
+	require.Equal(t, v4Count+2, count)
+	require.Equal(t, v4Sum+3, sum)
+	require.Equal(t, empty+1, testutil.ToFloat64(promEmptyResponses.WithLabelValues("leecher")))
+}
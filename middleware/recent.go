@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// RecentPeersStorageCtx is the name of storage context where
+// peers recently returned to clients are placed. Key is raw peer ID
+// followed by raw swarm hash, value has the same format as
+// in StickyPeersStorageCtx context.
+const RecentPeersStorageCtx = "MW_RECENT"
+
+// recentPeers remembers peers returned to client for info hash,
+// so they are not preferred in the next announce response
+// and client sees more of the swarm over several announces.
+// Expired entries saved by this instance are deleted by sweep.
+type recentPeers struct {
+	expiringKeys
+	store storage.DataStorage
+	ttl   int64
+}
+
+func newRecentPeers(store storage.DataStorage, ttl time.Duration) *recentPeers {
+	return &recentPeers{
+		expiringKeys: newExpiringKeys(RecentPeersStorageCtx),
+		store:        store,
+		ttl:          int64(ttl),
+	}
+}
+
+// peerSessionKey returns key of client session in swarm:
+// raw peer ID followed by raw swarm hash (see SwarmNamespaceKey)
+func peerSessionKey(ctx context.Context, req *bittorrent.AnnounceRequest) string {
+	return req.ID.RawString() + swarmHash(ctx, req.InfoHash).RawString()
+}
+
+// load returns set of peers returned to the client in previous
+// response if it is not expired
+func (r *recentPeers) load(ctx context.Context, req *bittorrent.AnnounceRequest, now int64) (map[bittorrent.Peer]struct{}, error) {
+	v, err := r.store.Load(ctx, RecentPeersStorageCtx, peerSessionKey(ctx, req))
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	expires, peers, err := unpackStickyPeers(v)
+	if err != nil {
+		logger.Warn().Err(err).Stringer("peerID", req.ID).Msg("unable to decode recent peers")
+		return nil, nil
+	}
+	if expires <= now {
+		return nil, nil
+	}
+	recent := make(map[bittorrent.Peer]struct{}, len(peers))
+	for _, p := range peers {
+		recent[p] = struct{}{}
+	}
+	return recent, nil
+}
+
+// save stores peers returned to the client, they expire after ttl
+func (r *recentPeers) save(ctx context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer, now int64) error {
+	key, expires := peerSessionKey(ctx, req), now+r.ttl
+	r.sweepExpired(ctx, r.store, now, r.ttl)
+	// some storages do not overwrite existing values
+	if err := r.store.Delete(ctx, RecentPeersStorageCtx, key); err != nil {
+		return err
+	}
+	err := r.store.Put(ctx, RecentPeersStorageCtx, storage.Entry{
+		Key:   key,
+		Value: packStickyPeers(expires, peers),
+	})
+	if err == nil {
+		r.saved(key, expires)
+	}
+	return err
+}
+
+// drop deletes recent peers of the client (i.e. when client stopped)
+func (r *recentPeers) drop(ctx context.Context, req *bittorrent.AnnounceRequest) error {
+	key := peerSessionKey(ctx, req)
+	r.dropped(key)
+	return r.store.Delete(ctx, RecentPeersStorageCtx, key)
+}
+
+// preferNotRecent moves peers, which are not in recent set,
+// to the beginning of peers (keeping order) and returns
+// at most n peers. Recent peers are returned only if
+// there are not enough other peers.
+func preferNotRecent(peers []bittorrent.Peer, recent map[bittorrent.Peer]struct{}, n int) []bittorrent.Peer {
+	if len(recent) == 0 || len(peers) == 0 {
+		return peers[:min(n, len(peers))]
+	}
+	res := make([]bittorrent.Peer, 0, len(peers))
+	for _, p := range peers {
+		if _, found := recent[p]; !found {
+			res = append(res, p)
+		}
+	}
+	for _, p := range peers {
+		if len(res) >= n {
+			break
+		}
+		if _, found := recent[p]; found {
+			res = append(res, p)
+		}
+	}
+	return res[:min(n, len(res))]
+}
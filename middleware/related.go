@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// defaultRelatedMaxInfoHashes is the number of related swarms
+// consulted by one announce if limit is not set
+const defaultRelatedMaxInfoHashes = 4
+
+// relatedSwarms holds info hashes of torrents with the same content
+// (i.e. cross-seeded torrents), peers of which are returned to clients
+// of thin swarms.
+// Nil relatedSwarms has no relations.
+type relatedSwarms struct {
+	related   map[bittorrent.InfoHash][]bittorrent.InfoHash
+	threshold uint32
+}
+
+// newRelatedSwarms parses HEX encoded info hashes of mapping.
+// Invalid hashes are skipped with warning, every list is limited
+// to maxRelated hashes. Returns nil if there are no relations
+// or threshold is 0.
+func newRelatedSwarms(mapping map[string][]string, threshold uint32, maxRelated uint) *relatedSwarms {
+	if threshold == 0 || len(mapping) == 0 {
+		return nil
+	}
+	if maxRelated == 0 {
+		maxRelated = defaultRelatedMaxInfoHashes
+	}
+	r := &relatedSwarms{
+		related:   make(map[bittorrent.InfoHash][]bittorrent.InfoHash, len(mapping)),
+		threshold: threshold,
+	}
+	for k, vv := range mapping {
+		ih, err := bittorrent.NewInfoHashString(k)
+		if err != nil {
+			logger.Warn().Err(err).Str("infoHash", k).Msg("invalid info hash of related swarms, skipping")
+			continue
+		}
+		for _, v := range vv {
+			if uint(len(r.related[ih])) >= maxRelated {
+				logger.Warn().Stringer("infoHash", ih).Uint("limit", maxRelated).Msg("too many related swarms, rest skipped")
+				break
+			}
+			rih, err := bittorrent.NewInfoHashString(v)
+			if err != nil {
+				logger.Warn().Err(err).Str("infoHash", v).Msg("invalid related info hash, skipping")
+				continue
+			}
+			if rih != ih {
+				r.related[ih] = append(r.related[ih], rih)
+			}
+		}
+	}
+	if len(r.related) == 0 {
+		return nil
+	}
+	return r
+}
+
+// fetchArgs returns arguments to fetch peers of swarms related to
+// provided info hash if swarm size is less than threshold
+func (r *relatedSwarms) fetchArgs(ih bittorrent.InfoHash, swarmSize uint32, v6First bool) []fetchArgs {
+	if r == nil || swarmSize >= r.threshold {
+		return nil
+	}
+	related := r.related[ih]
+	if len(related) == 0 {
+		return nil
+	}
+	args := make([]fetchArgs, 0, len(related)*2)
+	for _, rih := range related {
+		args = append(args, fetchArgs{rih, v6First}, fetchArgs{rih, !v6First})
+	}
+	return args
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// defaultCachedPeers is the number of peers fetched into cache
+// if maximal number of returned peers is not limited
+const defaultCachedPeers = 100
+
+// defaultCachedCounts is the maximal number of swarms, which peers
+// counts are cached, if maximal number is not set
+const defaultCachedCounts = 100_000
+
+type peersCacheKey struct {
+	ih        bittorrent.InfoHash
+	forSeeder bool
+	v6        bool
+}
+
+// cachedPeers is the peers sample of swarm (one generation)
+type cachedPeers struct {
+	once    sync.Once
+	expires int64
+	peers   []bittorrent.Peer
+	err     error
+}
+
+// cachedCounts is the numbers of swarm peers (one generation)
+type cachedCounts struct {
+	once     sync.Once
+	expires  int64
+	leechers uint32
+	seeders  uint32
+	err      error
+	// elem is the position of info hash in LRU list
+	elem *list.Element
+}
+
+// responseCache holds peers samples and peers counts of swarms
+// for short time, so concurrent announces to the same swarm share
+// storage reads. Each generation of cache is fetched from storage anew,
+// and every response gets sample window from random offset,
+// so clients do not receive the same peers all the time.
+// Number of swarms with cached peers counts is limited, the least
+// recently scraped swarm is evicted if limit is exceeded.
+type responseCache struct {
+	ttl       int64
+	size      int
+	maxCounts int
+	mu        sync.Mutex
+	lastSweep int64
+	peers     map[peersCacheKey]*cachedPeers
+	counts    map[bittorrent.InfoHash]*cachedCounts
+	// countsLRU holds info hashes of counts, the most recently
+	// scraped in front
+	countsLRU    *list.List
+	hits, misses uint64
+}
+
+func newResponseCache(ttl time.Duration, size, maxCounts int) *responseCache {
+	if size <= 0 {
+		size = defaultCachedPeers
+	}
+	if maxCounts <= 0 {
+		maxCounts = defaultCachedCounts
+	}
+	return &responseCache{
+		ttl:       int64(ttl),
+		size:      size,
+		maxCounts: maxCounts,
+		peers:     make(map[peersCacheKey]*cachedPeers),
+		counts:    make(map[bittorrent.InfoHash]*cachedCounts),
+		countsLRU: list.New(),
+	}
+}
+
+// sweep removes expired generations, must be called with locked mu
+func (c *responseCache) sweep(now int64) {
+	if now-c.lastSweep < c.ttl {
+		return
+	}
+	for k, e := range c.peers {
+		if now >= e.expires {
+			delete(c.peers, k)
+		}
+	}
+	for k, e := range c.counts {
+		if now >= e.expires {
+			c.removeCounts(k, e)
+		}
+	}
+	c.lastSweep = now
+}
+
+// removeCounts deletes cached counts of info hash,
+// must be called with locked mu
+func (c *responseCache) removeCounts(ih bittorrent.InfoHash, e *cachedCounts) {
+	delete(c.counts, ih)
+	c.countsLRU.Remove(e.elem)
+}
+
+// isCacheable checks if result of storage call may be shared
+// between announces: absence of swarm is cached, other errors are not
+func isCacheable(err error) bool {
+	return err == nil || errors.Is(err, storage.ErrResourceDoesNotExist) || errors.Is(err, storage.ErrSwarmEmpty)
+}
+
+// announcePeers returns up to numWant peers from cached sample of swarm.
+// If there is no sample or it is expired, it is fetched from storage
+// once for all concurrent callers.
+func (c *responseCache) announcePeers(ctx context.Context, store storage.PeerStorage, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, now int64) ([]bittorrent.Peer, error) {
+	k := peersCacheKey{ih: ih, forSeeder: forSeeder, v6: v6}
+	c.mu.Lock()
+	c.sweep(now)
+	e := c.peers[k]
+	if e == nil || now >= e.expires {
+		e = &cachedPeers{expires: now + c.ttl}
+		c.peers[k] = e
+	}
+	c.mu.Unlock()
+
+	e.once.Do(func() {
+		e.peers, e.err = store.AnnouncePeers(ctx, ih, forSeeder, c.size, v6)
+	})
+	if !isCacheable(e.err) {
+		c.mu.Lock()
+		if c.peers[k] == e {
+			delete(c.peers, k)
+		}
+		c.mu.Unlock()
+	}
+	l := len(e.peers)
+	if e.err != nil || numWant <= 0 || l == 0 {
+		return nil, e.err
+	}
+	res := make([]bittorrent.Peer, 0, min(numWant, l))
+	for i, off := 0, rand.IntN(l); i < l && len(res) < numWant; i++ {
+		res = append(res, e.peers[(off+i)%l])
+	}
+	return res, nil
+}
+
+// scrape returns cached numbers of swarm peers. If there are no numbers
+// or they are expired, they are loaded with provided function once
+// for all concurrent callers.
+func (c *responseCache) scrape(ih bittorrent.InfoHash, now int64, load func() (uint32, uint32, error)) (leechers, seeders uint32, err error) {
+	c.mu.Lock()
+	c.sweep(now)
+	e := c.counts[ih]
+	if e == nil || now >= e.expires {
+		if e != nil {
+			c.removeCounts(ih, e)
+		}
+		e = &cachedCounts{expires: now + c.ttl, elem: c.countsLRU.PushFront(ih)}
+		c.counts[ih] = e
+		for c.countsLRU.Len() > c.maxCounts {
+			lru := c.countsLRU.Back().Value.(bittorrent.InfoHash)
+			c.removeCounts(lru, c.counts[lru])
+		}
+		c.misses++
+		promScrapeCacheRequests.WithLabelValues("miss").Inc()
+	} else {
+		c.countsLRU.MoveToFront(e.elem)
+		c.hits++
+		promScrapeCacheRequests.WithLabelValues("hit").Inc()
+	}
+	c.mu.Unlock()
+
+	e.once.Do(func() {
+		e.leechers, e.seeders, e.err = load()
+	})
+	if e.err != nil {
+		c.mu.Lock()
+		if c.counts[ih] == e {
+			c.removeCounts(ih, e)
+		}
+		c.mu.Unlock()
+	}
+	return e.leechers, e.seeders, e.err
+}
+
+// scrapeHitRate returns the ratio of peers counts requests
+// served from cache to all requests
+func (c *responseCache) scrapeHitRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if total := c.hits + c.misses; total > 0 {
+		return float64(c.hits) / float64(total)
+	}
+	return 0
+}
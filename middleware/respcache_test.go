@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+type readsCountingStorage struct {
+	storage.PeerStorage
+	announces, scrapes atomic.Int32
+}
+
+func (s *readsCountingStorage) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) ([]bittorrent.Peer, error) {
+	s.announces.Add(1)
+	return s.PeerStorage.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+}
+
+func (s *readsCountingStorage) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	s.scrapes.Add(1)
+	return s.PeerStorage.ScrapeSwarm(ctx, ih)
+}
+
+func TestResponseCache(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+	cs := &readsCountingStorage{PeerStorage: ps}
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	for i := 0; i < 100; i++ {
+		p := bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i), 1},
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881),
+		}
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+
+	l := NewLogic(0, 0, cs, nil, nil)
+	l.SetResponseConfig(ResponseConfig{ResponseCacheTTL: time.Minute})
+	const clients = 20
+	responses := make([]*bittorrent.AnnounceResponse, clients)
+	errs := make([]error, clients)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &bittorrent.AnnounceRequest{
+				InfoHash: ih,
+				Left:     1,
+				NumWant:  10,
+				RequestPeer: bittorrent.RequestPeer{
+					ID:               bittorrent.PeerID{byte(i), 2},
+					Port:             6881,
+					RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+				},
+			}
+			_, responses[i], errs[i] = l.HandleAnnounce(ctx, req)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.Nil(t, err)
+	}
+	require.Equal(t, int32(1), cs.announces.Load(), "hot swarm announces must share storage read")
+	require.Equal(t, int32(1), cs.scrapes.Load())
+
+	distinct := false
+	for _, resp := range responses {
+		require.Len(t, resp.IPv4Peers, 10)
+		require.Equal(t, uint32(100), resp.Complete)
+		distinct = distinct || resp.IPv4Peers[0] != responses[0].IPv4Peers[0]
+	}
+	require.True(t, distinct, "responses must get different parts of cached sample")
+}
+
+func TestResponseCacheGenerations(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+	cs := &readsCountingStorage{PeerStorage: ps}
+	c := newResponseCache(time.Second, 0, 0)
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	now := time.Now().UnixNano()
+
+	// absence of swarm is cached
+	_, err = c.announcePeers(ctx, cs, ih, false, 10, false, now)
+	require.ErrorIs(t, err, storage.ErrResourceDoesNotExist)
+	_, err = c.announcePeers(ctx, cs, ih, false, 10, false, now+int64(time.Second)-1)
+	require.ErrorIs(t, err, storage.ErrResourceDoesNotExist)
+	require.Equal(t, int32(1), cs.announces.Load())
+
+	// other family and peer kind are cached separately
+	_, _ = c.announcePeers(ctx, cs, ih, false, 10, true, now)
+	_, _ = c.announcePeers(ctx, cs, ih, true, 10, false, now)
+	require.Equal(t, int32(3), cs.announces.Load())
+
+	// new generation is fetched from storage after ttl
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+	require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	peers, err := c.announcePeers(ctx, cs, ih, false, 10, false, now+int64(time.Second))
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{p}, peers)
+	require.Equal(t, int32(4), cs.announces.Load())
+	require.Len(t, c.peers, 1, "expired generations must be swept")
+}
+
+func TestResponseCacheScrapeEviction(t *testing.T) {
+	c := newResponseCache(time.Minute, 0, 2)
+	now := time.Now().UnixNano()
+	var loads int
+	load := func() (uint32, uint32, error) {
+		loads++
+		return 1, 2, nil
+	}
+	ih1, _ := bittorrent.NewInfoHash([]byte("01234567890123456781"))
+	ih2, _ := bittorrent.NewInfoHash([]byte("01234567890123456782"))
+	ih3, _ := bittorrent.NewInfoHash([]byte("01234567890123456783"))
+
+	for _, ih := range []bittorrent.InfoHash{ih1, ih2, ih1, ih3} {
+		l, s, err := c.scrape(ih, now, load)
+		require.Nil(t, err)
+		require.Equal(t, uint32(1), l)
+		require.Equal(t, uint32(2), s)
+	}
+	require.Equal(t, 3, loads)
+	require.Len(t, c.counts, 2)
+	require.Equal(t, 2, c.countsLRU.Len())
+	require.NotContains(t, c.counts, ih2, "least recently scraped swarm must be evicted")
+	require.InDelta(t, 0.25, c.scrapeHitRate(), 1e-9)
+
+	_, _, _ = c.scrape(ih1, now, load)
+	_, _, _ = c.scrape(ih2, now, load)
+	require.Equal(t, 4, loads)
+	require.NotContains(t, c.counts, ih3)
+	require.InDelta(t, 2.0/6, c.scrapeHitRate(), 1e-9)
+}
@@ -0,0 +1,235 @@
+// Package seedergrace implements a Hook that defers counting of peers,
+// which announce with `left=0`, as seeders until they are seen
+// as finished several times (or for some duration).
+package seedergrace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "seeder grace"
+
+const (
+	defaultAnnounces     = 2
+	defaultStateLifetime = time.Hour
+)
+
+var logger = log.NewLogger("middleware/seeder grace")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents the configuration for the seedergrace middleware.
+type Config struct {
+	// Announces is the number of announces with `left=0`
+	// after which peer is counted as seeder
+	Announces uint `cfg:"announces"`
+	// Period is the minimal duration between the first announce
+	// with `left=0` and the moment, when peer is counted as seeder
+	Period time.Duration `cfg:"period"`
+	// StateLifetime is the duration after which state of peer,
+	// which did not announce, is dropped. Must not be shorter
+	// than announce interval.
+	StateLifetime time.Duration `cfg:"state_lifetime"`
+	// FirstNoEventOnly restricts grace period to peers, which are first
+	// seen with `left=0` and without event (client may send real `started`
+	// later). Peers, which start with `started` event, are counted as
+	// seeders instantly.
+	FirstNoEventOnly bool `cfg:"first_no_event_only"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.Announces == 0 {
+		validCfg.Announces = defaultAnnounces
+		logger.Warn().
+			Str("name", "Announces").
+			Uint("provided", cfg.Announces).
+			Uint("default", validCfg.Announces).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Period < 0 {
+		validCfg.Period = 0
+		logger.Warn().
+			Str("name", "Period").
+			Dur("provided", cfg.Period).
+			Dur("default", validCfg.Period).
+			Msg("falling back to default configuration")
+	}
+	if cfg.StateLifetime <= 0 {
+		validCfg.StateLifetime = defaultStateLifetime
+		logger.Warn().
+			Str("name", "StateLifetime").
+			Dur("provided", cfg.StateLifetime).
+			Dur("default", validCfg.StateLifetime).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	return newHook(cfg.Validate()), nil
+}
+
+type peerKey struct {
+	ih   bittorrent.InfoHash
+	peer bittorrent.Peer
+}
+
+// peerState holds information about announces of peer with `left=0`
+type peerState struct {
+	first, last int64
+	count       uint
+	// confirmed is set if peer is already counted as seeder
+	confirmed bool
+}
+
+type hook struct {
+	cfg    Config
+	mu     sync.Mutex
+	states map[peerKey]*peerState
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func newHook(cfg Config) *hook {
+	h := &hook{
+		cfg:    cfg,
+		states: make(map[peerKey]*peerState),
+		closed: make(chan any),
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(cfg.StateLifetime)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.closed:
+				return
+			case <-t.C:
+				h.gc(timecache.Now().Add(-cfg.StateLifetime))
+			}
+		}
+	}()
+	return h
+}
+
+// check registers announce of finished peer and reports
+// if peer is still in grace period or if grace period
+// finished with this announce (peer should be promoted to seeders)
+func (h *hook) check(k peerKey, e bittorrent.Event, now time.Time) (inGrace, promote bool) {
+	ts := now.UnixNano()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, exists := h.states[k]
+	if !exists {
+		// peer, which explicitly started as seeder, is trusted
+		st = &peerState{first: ts, confirmed: h.cfg.FirstNoEventOnly && e != bittorrent.None}
+		h.states[k] = st
+	}
+	st.last = ts
+	if !st.confirmed {
+		st.count++
+		if st.count >= h.cfg.Announces && time.Duration(ts-st.first) >= h.cfg.Period {
+			st.confirmed, promote = true, true
+		} else {
+			inGrace = true
+		}
+	}
+	return
+}
+
+// graduate marks peer as seeder, i.e. after `completed` event
+func (h *hook) graduate(k peerKey, now time.Time) {
+	ts := now.UnixNano()
+	h.mu.Lock()
+	h.states[k] = &peerState{first: ts, last: ts, confirmed: true}
+	h.mu.Unlock()
+}
+
+func (h *hook) forget(k peerKey) {
+	h.mu.Lock()
+	delete(h.states, k)
+	h.mu.Unlock()
+}
+
+func (h *hook) gc(cutoff time.Time) {
+	cutoffUnix := cutoff.UnixNano()
+	h.mu.Lock()
+	for k, st := range h.states {
+		if st.last <= cutoffUnix {
+			delete(h.states, k)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	now := timecache.Now()
+	var inGrace, promote bool
+	for _, p := range req.Peers() {
+		k := peerKey{req.InfoHash, p}
+		switch {
+		case req.Event == bittorrent.Stopped || req.Left > 0:
+			h.forget(k)
+		case req.Event == bittorrent.Completed:
+			// graduation is explicitly requested by client
+			h.graduate(k, now)
+		default:
+			g, pr := h.check(k, req.Event, now)
+			inGrace, promote = inGrace || g, promote || pr
+		}
+	}
+	if inGrace {
+		ctx = context.WithValue(ctx, middleware.SeedingGraceKey, true)
+	} else if promote {
+		ctx = context.WithValue(ctx, middleware.SeedingGraceKey, false)
+	}
+	return ctx, nil
+}
+
+// CheckInterval returns error if state of peer may be dropped
+// between its announces
+func (h *hook) CheckInterval(announceInterval time.Duration) error {
+	if h.cfg.StateLifetime < announceInterval {
+		return fmt.Errorf("middleware %s: state lifetime (%s) is shorter than announce interval (%s)",
+			Name, h.cfg.StateLifetime, announceInterval)
+	}
+	return nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not altered.
+	return ctx, nil
+}
+
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,117 @@
+package seedergrace
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+func TestSeederGrace(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"announces": 2}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             1234,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+		},
+	}
+	lgc := middleware.NewLogic(0, 0, ps, []middleware.Hook{h}, nil)
+	announce := func() {
+		outCtx, resp, err := lgc.HandleAnnounce(ctx, req)
+		require.Nil(t, err)
+		lgc.AfterAnnounce(bittorrent.RemapRouteParamsToBgContext(outCtx), req, resp)
+	}
+	scrape := func() (leechers, seeders uint32) {
+		leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		return leechers, seeders
+	}
+
+	// single announce with left=0 does not graduate
+	announce()
+	leechers, seeders := scrape()
+	require.Equal(t, uint32(1), leechers)
+	require.Zero(t, seeders)
+
+	// second announce moves peer to seeders
+	announce()
+	leechers, seeders = scrape()
+	require.Zero(t, leechers)
+	require.Equal(t, uint32(1), seeders)
+
+	// and it stays seeder
+	announce()
+	leechers, seeders = scrape()
+	require.Zero(t, leechers)
+	require.Equal(t, uint32(1), seeders)
+
+	// even if its grace state is lost
+	h.(*hook).gc(time.Now().Add(time.Hour))
+	announce()
+	leechers, seeders = scrape()
+	require.Zero(t, leechers)
+	require.Equal(t, uint32(1), seeders)
+
+	// flip-flop resets grace
+	req.Left = 1
+	announce()
+	req.Left = 0
+	announce()
+	leechers, _ = scrape()
+	require.Equal(t, uint32(1), leechers)
+}
+
+func TestFirstNoEventOnly(t *testing.T) {
+	h := newHook(Config{Announces: 2, StateLifetime: time.Hour, FirstNoEventOnly: true})
+	defer h.Close()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	now := time.Now()
+	noEvent := peerKey{ih, bittorrent.Peer{ID: bittorrent.PeerID{1}}}
+	started := peerKey{ih, bittorrent.Peer{ID: bittorrent.PeerID{2}}}
+
+	// first announce without event is held as leecher
+	inGrace, promote := h.check(noEvent, bittorrent.None, now)
+	require.True(t, inGrace)
+	require.False(t, promote)
+	// late `started` does not skip grace period
+	inGrace, promote = h.check(noEvent, bittorrent.Started, now)
+	require.False(t, inGrace)
+	require.True(t, promote)
+
+	// peer, which started as seeder, is not held
+	inGrace, promote = h.check(started, bittorrent.Started, now)
+	require.False(t, inGrace)
+	require.False(t, promote)
+	inGrace, _ = h.check(started, bittorrent.None, now)
+	require.False(t, inGrace)
+}
+
+func TestCheckInterval(t *testing.T) {
+	h := newHook(Config{Announces: 2, StateLifetime: time.Hour})
+	defer h.Close()
+	require.Nil(t, middleware.CheckIntervals(time.Hour, h))
+	require.NotNil(t, middleware.CheckIntervals(2*time.Hour, h))
+}
@@ -0,0 +1,212 @@
+// Package snatchlog implements a Hook that appends completion events
+// (info hash, time and peer ID of the peer, which sent `completed` event)
+// to the log file, so downloads reports may be produced over time.
+// Log file is rotated when it reaches configured size.
+package snatchlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "snatch log"
+
+const (
+	defaultMaxSize    = 100 << 20
+	defaultMaxBackups = 3
+	filePerm          = 0o640
+)
+
+var (
+	logger = log.NewLogger("middleware/snatch log")
+
+	errNoFile = errors.New("snatch log file not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents the configuration for the snatchlog middleware.
+type Config struct {
+	// File is the path to log file
+	File string `cfg:"file"`
+	// MaxSize is the size of file in bytes, after which it is rotated
+	MaxSize int64 `cfg:"max_size"`
+	// MaxBackups is the number of rotated files to keep
+	// (File.1 is the newest)
+	MaxBackups uint `cfg:"max_backups"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.MaxSize <= 0 {
+		validCfg.MaxSize = defaultMaxSize
+		logger.Warn().
+			Str("name", "MaxSize").
+			Int64("provided", cfg.MaxSize).
+			Int64("default", validCfg.MaxSize).
+			Msg("falling back to default configuration")
+	}
+	if cfg.MaxBackups == 0 {
+		validCfg.MaxBackups = defaultMaxBackups
+		logger.Warn().
+			Str("name", "MaxBackups").
+			Uint("provided", cfg.MaxBackups).
+			Uint("default", validCfg.MaxBackups).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	h, err := newHook(cfg.Validate())
+	if err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	return h, nil
+}
+
+type hook struct {
+	cfg  Config
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newHook(cfg Config) (*hook, error) {
+	if len(cfg.File) == 0 {
+		return nil, errNoFile
+	}
+	h := &hook{cfg: cfg}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// open opens (or creates) log file for appending
+func (h *hook) open() (err error) {
+	if h.f, err = os.OpenFile(h.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm); err != nil {
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = h.f.Stat(); err != nil {
+		_ = h.f.Close()
+		h.f = nil
+		return
+	}
+	h.size = fi.Size()
+	return
+}
+
+func backupName(file string, n uint) string {
+	return file + "." + strconv.FormatUint(uint64(n), 10)
+}
+
+// rotate shifts backups (File.N-1 -> File.N, ..., File -> File.1)
+// dropping the oldest one and opens new log file
+func (h *hook) rotate() error {
+	if err := h.f.Close(); err != nil {
+		logger.Warn().Err(err).Str("file", h.cfg.File).Msg("unable to close snatch log")
+	}
+	h.f = nil
+	var err error
+	for n := h.cfg.MaxBackups - 1; n > 0 && err == nil; n-- {
+		if err = os.Rename(backupName(h.cfg.File, n), backupName(h.cfg.File, n+1)); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(h.cfg.File, backupName(h.cfg.File, 1))
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info().Str("file", h.cfg.File).Msg("snatch log rotated")
+	return h.open()
+}
+
+// formatRecord formats completion event as tab separated
+// time (RFC 3339), hex info hash and hex peer ID
+func formatRecord(ts time.Time, ih bittorrent.InfoHash, id bittorrent.PeerID) []byte {
+	b := make([]byte, 0, len(time.RFC3339)+2*len(ih)+2*bittorrent.PeerIDLen+3)
+	b = ts.UTC().AppendFormat(b, time.RFC3339)
+	b = append(b, '\t')
+	b = append(b, ih.String()...)
+	b = append(b, '\t')
+	b = append(b, id.String()...)
+	return append(b, '\n')
+}
+
+// write appends record to log file rotating it if needed
+func (h *hook) write(rec []byte) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		// previous rotation failed
+		if err = h.open(); err != nil {
+			return
+		}
+	}
+	if h.size > 0 && h.size+int64(len(rec)) > h.cfg.MaxSize {
+		if err = h.rotate(); err != nil {
+			return
+		}
+	}
+	var n int
+	n, err = h.f.Write(rec)
+	h.size += int64(n)
+	return
+}
+
+// HandleAnnounce logs `completed` events. It should be used as post hook,
+// so only events, which are answered, are logged.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Event == bittorrent.Completed {
+		if err := h.write(formatRecord(timecache.Now(), req.InfoHash, req.ID)); err != nil {
+			// snatch log should not break announce processing
+			logger.Error().Err(err).
+				Str("file", h.cfg.File).
+				Stringer("infoHash", req.InfoHash).
+				Msg("unable to write snatch log")
+		}
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not logged.
+	return ctx, nil
+}
+
+func (h *hook) Close() (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f != nil {
+		err = h.f.Close()
+		h.f = nil
+	}
+	return
+}
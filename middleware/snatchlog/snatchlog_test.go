@@ -0,0 +1,73 @@
+package snatchlog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestCompletedLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snatch.log")
+	h, err := newHook(Config{File: path}.Validate())
+	require.Nil(t, err)
+	defer h.Close()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	id := bittorrent.PeerID{1, 2, 3}
+	for _, e := range []bittorrent.Event{bittorrent.Started, bittorrent.None, bittorrent.Completed, bittorrent.Stopped} {
+		_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{
+			InfoHash:    ih,
+			Event:       e,
+			RequestPeer: bittorrent.RequestPeer{ID: id},
+		}, nil)
+		require.Nil(t, err)
+	}
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	require.Len(t, lines, 1)
+	fields := strings.Split(lines[0], "\t")
+	require.Len(t, fields, 3)
+	require.Equal(t, ih.String(), fields[1])
+	require.Equal(t, id.String(), fields[2])
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snatch.log")
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	rec := formatRecord(time.Now(), ih, bittorrent.PeerID{})
+	// two records per file
+	h, err := newHook(Config{File: path, MaxSize: int64(2 * len(rec)), MaxBackups: 2})
+	require.Nil(t, err)
+	defer h.Close()
+
+	for i := 0; i < 7; i++ {
+		require.Nil(t, h.write(rec))
+	}
+	for name, records := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		b, err := os.ReadFile(name)
+		require.Nil(t, err)
+		require.Equal(t, strings.Repeat(string(rec), records), string(b), name)
+	}
+	_, err = os.Stat(path + ".3")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// size of existing file is respected after reopen
+	require.Nil(t, h.Close())
+	h, err = newHook(Config{File: path, MaxSize: int64(2 * len(rec)), MaxBackups: 2})
+	require.Nil(t, err)
+	defer h.Close()
+	require.Nil(t, h.write(rec))
+	require.Nil(t, h.write(rec))
+	b, err := os.ReadFile(path + ".1")
+	require.Nil(t, err)
+	require.Equal(t, strings.Repeat(string(rec), 2), string(b))
+}
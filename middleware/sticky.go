@@ -0,0 +1,302 @@
+package middleware
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/str2bytes"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const (
+	// StickyPeersStorageCtx is the name of storage context where
+	// peers subsets of sessions are placed. Key is raw swarm hash
+	// followed by tracker id, value is expiration time and packed peers.
+	StickyPeersStorageCtx = "MW_STICKY"
+
+	// expiration time
+	stickyHeaderLen = 8
+	// PeerID + port + address length
+	stickyPeerHeaderLen = bittorrent.PeerIDLen + 2 + 1
+	// maxTrackerIDLen is the maximal length of tracker id echoed by
+	// client, longer ones are ignored
+	maxTrackerIDLen = 64
+)
+
+var errMalformedStickyPeers = errors.New("malformed sticky peers data")
+
+// stickyPeers returns the same peers subset to the same session
+// (tracker id and info hash) until subset expires, so established
+// connections of client are not churned by random peers selection.
+// Session is identified by tracker id echoed by client. If client does
+// not echo it (UDP clients and many HTTP clients), tracker id is
+// derived from peer ID, so such client gets the same session too.
+type stickyPeers struct {
+	expiringKeys
+	store storage.PeerStorage
+	ttl   int64
+}
+
+// stickySession is the peers subset of particular session
+type stickySession struct {
+	key     string
+	peers   []bittorrent.Peer
+	expires int64
+}
+
+func newStickyPeers(store storage.PeerStorage, ttl time.Duration) *stickyPeers {
+	return &stickyPeers{
+		expiringKeys: newExpiringKeys(StickyPeersStorageCtx),
+		store:        store,
+		ttl:          int64(ttl),
+	}
+}
+
+// expiringKeys tracks expiration time of keys saved by this instance
+// into storage context, so expired ones may be deleted by sweep,
+// because DataStorage does not expire entries itself
+type expiringKeys struct {
+	storeCtx string
+
+	mu        sync.Mutex
+	lastSweep int64
+	expires   map[string]int64
+}
+
+func newExpiringKeys(storeCtx string) expiringKeys {
+	return expiringKeys{storeCtx: storeCtx, expires: make(map[string]int64)}
+}
+
+// saved records expiration time of key
+func (e *expiringKeys) saved(key string, expires int64) {
+	e.mu.Lock()
+	e.expires[key] = expires
+	e.mu.Unlock()
+}
+
+// dropped forgets key deleted from storage
+func (e *expiringKeys) dropped(key string) {
+	e.mu.Lock()
+	delete(e.expires, key)
+	e.mu.Unlock()
+}
+
+// sweepExpired deletes expired keys from storage
+// not more often than once per interval
+func (e *expiringKeys) sweepExpired(ctx context.Context, store storage.DataStorage, now, interval int64) {
+	var expired []string
+	e.mu.Lock()
+	if now-e.lastSweep >= interval {
+		for k, exp := range e.expires {
+			if exp <= now {
+				expired = append(expired, k)
+				delete(e.expires, k)
+			}
+		}
+		e.lastSweep = now
+	}
+	e.mu.Unlock()
+	if len(expired) > 0 {
+		if err := store.Delete(ctx, e.storeCtx, expired...); err != nil {
+			logger.Warn().Err(err).Str("context", e.storeCtx).Int("count", len(expired)).
+				Msg("unable to delete expired entries")
+		}
+	}
+}
+
+// trackerID generates tracker id of session, which is the same
+// for all announces of the session
+func trackerID(key string) string {
+	h := fnv.New64a()
+	_, _ = h.Write(str2bytes.StringToBytes(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sessionKey returns storage key and tracker id of request session.
+// Tracker id is the one echoed by client or, if it is not provided,
+// generated from peer ID and info hash.
+func sessionKey(ctx context.Context, req *bittorrent.AnnounceRequest) (key, id string) {
+	if req.Params != nil {
+		id, _ = req.Params.GetString("trackerid")
+	}
+	if len(id) == 0 || len(id) > maxTrackerIDLen {
+		id = trackerID(peerSessionKey(ctx, req))
+	}
+	return swarmHash(ctx, req.InfoHash).RawString() + id, id
+}
+
+// session loads peers subset of session identified by tracker id
+// and info hash of request and sets tracker id of session into response.
+// Peers, which are not in swarm anymore, are excluded from subset.
+// Returned session is empty if it is new or expired.
+func (s *stickyPeers) session(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, now int64) (ss stickySession, err error) {
+	ss.key, resp.TrackerID = sessionKey(ctx, req)
+	var v []byte
+	if v, err = s.store.Load(ctx, StickyPeersStorageCtx, ss.key); err != nil || len(v) == 0 {
+		return
+	}
+	if ss.expires, ss.peers, err = unpackStickyPeers(v); err != nil {
+		logger.Warn().Err(err).Stringer("peerID", req.ID).Msg("unable to decode sticky peers")
+		return stickySession{key: ss.key}, nil
+	}
+	if ss.expires <= now {
+		ss.expires, ss.peers = 0, nil
+		return
+	}
+	ss.peers, err = s.inSwarm(ctx, swarmHash(ctx, req.InfoHash), ss.peers)
+	return
+}
+
+// exclude returns peers, which are not in session
+func (ss stickySession) exclude(peers []bittorrent.Peer) []bittorrent.Peer {
+	if len(ss.peers) == 0 || len(peers) == 0 {
+		return peers
+	}
+	res := make([]bittorrent.Peer, 0, len(peers))
+	for _, p := range peers {
+		if !slices.Contains(ss.peers, p) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// inSwarm returns peers, which are stored as seeders or leechers
+// in swarm of info hash or of its truncated v1 form. Peers are checked
+// in batches, so storage is called at most 4 times for any number of peers.
+func (s *stickyPeers) inSwarm(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer) ([]bittorrent.Peer, error) {
+	ihs := []bittorrent.InfoHash{ih}
+	if len(ih) == bittorrent.InfoHashV2Len {
+		ihs = append(ihs, ih.TruncateV1())
+	}
+	found := make([]bool, len(peers))
+	for _, ih := range ihs {
+		for _, seeder := range []bool{true, false} {
+			var idx []int
+			var check []bittorrent.Peer
+			for i, p := range peers {
+				if !found[i] {
+					idx, check = append(idx, i), append(check, p)
+				}
+			}
+			if len(check) == 0 {
+				break
+			}
+			exists, err := storage.PeersExist(ctx, s.store, ih, check, seeder)
+			if err != nil {
+				return nil, err
+			}
+			for i, e := range exists {
+				found[idx[i]] = e
+			}
+		}
+	}
+	alive := peers[:0]
+	for i, p := range peers {
+		if found[i] {
+			alive = append(alive, p)
+		}
+	}
+	return alive, nil
+}
+
+// save stores peers subset of session. New or expired session
+// gets expiration time now + ttl.
+func (s *stickyPeers) save(ctx context.Context, ss stickySession, peers []bittorrent.Peer, now int64) error {
+	if ss.expires <= now {
+		ss.expires = now + s.ttl
+	}
+	s.sweep(ctx, now)
+	// some storages do not overwrite existing values
+	if err := s.store.Delete(ctx, StickyPeersStorageCtx, ss.key); err != nil {
+		return err
+	}
+	err := s.store.Put(ctx, StickyPeersStorageCtx, storage.Entry{
+		Key:   ss.key,
+		Value: packStickyPeers(ss.expires, peers),
+	})
+	if err == nil {
+		s.saved(ss.key, ss.expires)
+	}
+	return err
+}
+
+// sweep deletes sessions saved by this instance, which expired,
+// from storage not more often than once per ttl
+func (s *stickyPeers) sweep(ctx context.Context, now int64) {
+	s.sweepExpired(ctx, s.store, now, s.ttl)
+}
+
+// drop deletes peers subset of session (i.e. when client stopped)
+func (s *stickyPeers) drop(ctx context.Context, req *bittorrent.AnnounceRequest) error {
+	key, _ := sessionKey(ctx, req)
+	s.dropped(key)
+	return s.store.Delete(ctx, StickyPeersStorageCtx, key)
+}
+
+func packStickyPeers(expires int64, peers []bittorrent.Peer) []byte {
+	b := make([]byte, stickyHeaderLen, stickyHeaderLen+len(peers)*(stickyPeerHeaderLen+16))
+	binary.BigEndian.PutUint64(b, uint64(expires))
+	for _, p := range peers {
+		addr := p.Addr().AsSlice()
+		b = append(b, p.ID.Bytes()...)
+		b = binary.BigEndian.AppendUint16(b, p.Port())
+		b = append(b, byte(len(addr)))
+		b = append(b, addr...)
+	}
+	return b
+}
+
+func unpackStickyPeers(b []byte) (expires int64, peers []bittorrent.Peer, err error) {
+	if len(b) < stickyHeaderLen {
+		return 0, nil, errMalformedStickyPeers
+	}
+	expires, b = int64(binary.BigEndian.Uint64(b)), b[stickyHeaderLen:]
+	for len(b) > 0 {
+		if len(b) < stickyPeerHeaderLen {
+			return 0, nil, errMalformedStickyPeers
+		}
+		var p bittorrent.Peer
+		if p.ID, err = bittorrent.NewPeerID(b[:bittorrent.PeerIDLen]); err != nil {
+			return 0, nil, err
+		}
+		port := binary.BigEndian.Uint16(b[bittorrent.PeerIDLen:])
+		l := int(b[stickyPeerHeaderLen-1])
+		b = b[stickyPeerHeaderLen:]
+		if len(b) < l {
+			return 0, nil, errMalformedStickyPeers
+		}
+		addr, ok := netip.AddrFromSlice(b[:l])
+		if !ok {
+			return 0, nil, bittorrent.ErrInvalidIP
+		}
+		p.AddrPort, b = netip.AddrPortFrom(addr, port), b[l:]
+		peers = append(peers, p)
+	}
+	return
+}
+
+// samePeers checks if peers are the same ignoring order
+func samePeers(a, b []bittorrent.Peer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[bittorrent.Peer]struct{}, len(a))
+	for _, p := range a {
+		m[p] = struct{}{}
+	}
+	for _, p := range b {
+		if _, found := m[p]; !found {
+			return false
+		}
+	}
+	return true
+}
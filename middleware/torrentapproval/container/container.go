@@ -45,6 +45,26 @@ type Container interface {
 	Approved(context.Context, bittorrent.InfoHash) bool
 }
 
+// Denier is an optional interface that may be implemented
+// by Container to forbid info hash at runtime
+type Denier interface {
+	Deny(context.Context, bittorrent.InfoHash) error
+}
+
+// Reloadable is an optional interface that may be implemented
+// by Container to re-read its source immediately, regardless
+// of source watching
+type Reloadable interface {
+	Reload(context.Context) error
+}
+
+// Warmer is an optional interface that may be implemented
+// by Container, which loads its source in background
+type Warmer interface {
+	// WarmedUp returns true if initial loading of source finished
+	WarmedUp() bool
+}
+
 // GetContainer creates Container by its name and provided confBytes
 func GetContainer(name string, config conf.MapConfig, storage storage.DataStorage) (Container, error) {
 	buildersMU.Lock()
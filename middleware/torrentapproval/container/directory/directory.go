@@ -6,7 +6,12 @@ package directory
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/util/dirwatch"
@@ -46,6 +51,8 @@ func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, er
 			Storage:    st,
 			StorageCtx: c.StorageCtx,
 		},
+		path:    c.Path,
+		loaded:  make(map[metainfo.Hash][]string),
 		watcher: nil,
 	}
 	if len(d.StorageCtx) == 0 {
@@ -61,57 +68,46 @@ func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, er
 		return nil, fmt.Errorf("unable to initialize directory watch: %w", err)
 	}
 	d.watcher = w
+	go func() {
+		// watcher sends events of existing files without notice
+		// of completion, so initial state is read separately
+		if err := d.Reload(context.Background()); err != nil {
+			logger.Error().Err(err).Str("path", d.path).Msg("unable to load approval torrent directory")
+		}
+		d.warm.Store(true)
+	}()
 	go func() {
 		for event := range d.watcher.Events {
-			var mi *metainfo.MetaInfo
-			if mi, err = metainfo.LoadFromFile(event.TorrentFilePath); err == nil {
-				s256 := sha256.New()
-				s256.Write(mi.InfoBytes)
-				v2hash, _ := bittorrent.NewInfoHash(s256.Sum(nil))
-				switch event.Change {
-				case dirwatch.Added:
-					var name string
-					if info, err := mi.UnmarshalInfo(); err == nil {
-						name = info.Name
-					} else {
-						logger.Error().
-							Err(err).
-							Str("file", event.TorrentFilePath).
-							Stringer("infoHash", event.InfoHash).
-							Stringer("infoHashV2", v2hash).
-							Msg("unable to unmarshal torrent info")
-					}
-					if len(name) == 0 {
-						name = list.DUMMY
-					}
-					bName := []byte(name)
-					logger.Err(d.Storage.Put(context.Background(), d.StorageCtx, storage.Entry{
-						Key:   event.InfoHash.AsString(),
-						Value: bName,
-					}, storage.Entry{
-						Key:   v2hash.RawString(),
-						Value: bName,
-					}, storage.Entry{
-						Key:   v2hash.TruncateV1().RawString(),
-						Value: bName,
-					})).
+			var err error
+			switch event.Change {
+			case dirwatch.Added:
+				if len(event.TorrentFilePath) == 0 {
+					// magnet links are not supported
+					continue
+				}
+				var mi *metainfo.MetaInfo
+				if mi, err = metainfo.LoadFromFile(event.TorrentFilePath); err == nil {
+					d.mu.Lock()
+					err = d.add(context.Background(), event.TorrentFilePath, mi)
+					d.mu.Unlock()
+					logger.Err(err).
 						Str("action", "add").
 						Str("file", event.TorrentFilePath).
 						Stringer("infoHash", event.InfoHash).
-						Stringer("infoHashV2", v2hash).
 						Msg("approval torrent watcher event")
-				case dirwatch.Removed:
-					logger.Err(d.Storage.Delete(context.Background(), c.StorageCtx, event.InfoHash.AsString(), v2hash.RawString(), v2hash.TruncateV1().RawString())).
-						Str("action", "delete").
+				} else {
+					logger.Error().Err(err).
 						Str("file", event.TorrentFilePath).
-						Stringer("infoHash", event.InfoHash).
-						Stringer("infoHashV2", v2hash).
-						Msg("approval torrent watcher event")
+						Msg("unable to load torrent file")
 				}
-			} else {
-				logger.Error().Err(err).
-					Str("file", event.TorrentFilePath).
-					Msg("unable to load torrent file")
+			case dirwatch.Removed:
+				d.mu.Lock()
+				err = d.remove(context.Background(), event.InfoHash)
+				d.mu.Unlock()
+				logger.Err(err).
+					Str("action", "delete").
+					Stringer("infoHash", event.InfoHash).
+					Msg("approval torrent watcher event")
 			}
 		}
 	}()
@@ -120,7 +116,102 @@ func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, er
 
 type directory struct {
 	list.List
+	path string
+	// mu guards loaded and storage updates
+	mu sync.Mutex
+	// loaded holds storage keys of each loaded torrent
+	loaded  map[metainfo.Hash][]string
 	watcher *dirwatch.Instance
+	// warm is set when initial loading of directory finished
+	warm atomic.Bool
+}
+
+// add stores v1, v2 and truncated v2 hashes of torrent with its name as value.
+// Must be called with mu locked.
+func (d *directory) add(ctx context.Context, file string, mi *metainfo.MetaInfo) error {
+	s256 := sha256.New()
+	s256.Write(mi.InfoBytes)
+	v2hash, _ := bittorrent.NewInfoHash(s256.Sum(nil))
+	var name string
+	if info, err := mi.UnmarshalInfo(); err == nil {
+		name = info.Name
+	} else {
+		logger.Error().
+			Err(err).
+			Str("file", file).
+			Stringer("infoHashV2", v2hash).
+			Msg("unable to unmarshal torrent info")
+	}
+	if len(name) == 0 {
+		name = list.DUMMY
+	}
+	ih := mi.HashInfoBytes()
+	keys := []string{ih.AsString(), v2hash.RawString(), v2hash.TruncateV1().RawString()}
+	entries := make([]storage.Entry, len(keys))
+	for i, k := range keys {
+		entries[i] = storage.Entry{Key: k, Value: []byte(name)}
+	}
+	err := d.Storage.Put(ctx, d.StorageCtx, entries...)
+	if err == nil {
+		d.loaded[ih] = keys
+	}
+	return err
+}
+
+// remove deletes all stored hashes of torrent.
+// Must be called with mu locked.
+func (d *directory) remove(ctx context.Context, ih metainfo.Hash) error {
+	keys, found := d.loaded[ih]
+	if !found {
+		keys = []string{ih.AsString()}
+	}
+	err := d.Storage.Delete(ctx, d.StorageCtx, keys...)
+	if err == nil {
+		delete(d.loaded, ih)
+	}
+	return err
+}
+
+// Reload re-reads all torrent files from directory immediately:
+// hashes of new files are stored, hashes of removed files are deleted.
+func (d *directory) Reload(ctx context.Context) error {
+	// directory is read under lock, so torrent added by
+	// watcher meanwhile is not treated as removed
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names, err := filepath.Glob(filepath.Join(d.path, "*.torrent"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	found := make(map[metainfo.Hash]bool, len(names))
+	for _, file := range names {
+		var mi *metainfo.MetaInfo
+		if mi, err = metainfo.LoadFromFile(file); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("unable to load torrent file '%s': %w", file, err))
+			}
+			continue
+		}
+		found[mi.HashInfoBytes()] = true
+		errs = append(errs, d.add(ctx, file, mi))
+	}
+	for ih := range d.loaded {
+		if !found[ih] {
+			errs = append(errs, d.remove(ctx, ih))
+		}
+	}
+	err = errors.Join(errs...)
+	logger.Err(err).
+		Str("path", d.path).
+		Int("count", len(d.loaded)).
+		Msg("approval torrent directory reloaded")
+	return err
+}
+
+// WarmedUp returns true if initial loading of directory finished
+func (d *directory) WarmedUp() bool {
+	return d.warm.Load()
 }
 
 // Close closes watching of torrent directory
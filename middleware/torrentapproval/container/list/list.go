@@ -101,3 +101,21 @@ func (l *List) Approved(ctx context.Context, hash bittorrent.InfoHash) (contains
 	}
 	return contains != l.Invert
 }
+
+// Deny makes hash not approved: if List.Invert set to true, hash
+// is added into storage (blacklisted), otherwise it is deleted from storage.
+// If hash is v2, its truncated v1 form is processed too.
+func (l *List) Deny(ctx context.Context, hash bittorrent.InfoHash) error {
+	keys := []string{hash.RawString()}
+	if len(hash) == bittorrent.InfoHashV2Len {
+		keys = append(keys, hash.TruncateV1().RawString())
+	}
+	if !l.Invert {
+		return l.Storage.Delete(ctx, l.StorageCtx, keys...)
+	}
+	entries := make([]storage.Entry, len(keys))
+	for i, k := range keys {
+		entries[i] = storage.Entry{Key: k, Value: []byte(DUMMY)}
+	}
+	return l.Storage.Put(ctx, l.StorageCtx, entries...)
+}
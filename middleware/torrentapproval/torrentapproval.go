@@ -4,13 +4,16 @@ package torrentapproval
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/middleware/torrentapproval/container"
 	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/storage/memory"
 
 	// import directory watcher to enable appropriate support
@@ -21,21 +24,126 @@ import (
 	"github.com/sot-tech/mochi/storage"
 )
 
-// Name is the name by which this middleware is registered with Conf.
-const Name = "torrent approval"
+const (
+	// Name is the name by which this middleware is registered with Conf.
+	Name = "torrent approval"
+	// ModeReject - unapproved announces are responded with ErrTorrentUnapproved
+	ModeReject = "reject"
+	// ModeEmpty - unapproved announces are responded with valid peerless
+	// response with long interval and warning message
+	ModeEmpty = "empty"
+	// ScrapeModeAllow - scrapes of unapproved info hashes are not restricted
+	ScrapeModeAllow = "allow"
+	// CombineUnion - info hash is approved if any of sources approves it
+	CombineUnion = "union"
+	// CombineIntersection - info hash is approved if all sources approve it
+	CombineIntersection = "intersection"
+	// FailClosed - middleware is not started if any source failed to load
+	FailClosed = "fail_closed"
+	// FailOpen - source, which failed to load, approves any info hash
+	FailOpen = "fail_open"
+
+	defaultEmptyInterval = 24 * time.Hour
+)
+
+var logger = log.NewLogger("middleware/torrent approval")
 
 func init() {
 	middleware.RegisterBuilder(Name, build)
 }
 
+type sourceConfig struct {
+	// Source - name of container
+	Source string `cfg:"source"`
+	// Configuration depends on used container
+	Configuration conf.MapConfig
+}
+
 type baseConfig struct {
 	// Source - name of container for initial values
 	Source string `cfg:"initial_source"`
+	// Configuration depends on used container
+	Configuration conf.MapConfig
+	// Sources - additional containers, results of which are combined
+	// with the container of Source (if set)
+	Sources []sourceConfig
+	// Combine - how results of several containers are combined:
+	// CombineUnion or CombineIntersection
+	Combine string
+	// LoadFailure - what to do if source failed to load: FailClosed or FailOpen
+	LoadFailure string `cfg:"load_failure"`
 	// Preserve - if true, container will receive real registered storage if it is NOT `memory`
 	// if false - temporary in-memory storage will be used or created
 	Preserve bool
-	// Configuration depends on used container
-	Configuration conf.MapConfig
+	// Mode - how to respond to unapproved announce: ModeReject or ModeEmpty
+	Mode string
+	// EmptyInterval - announce interval sent in ModeEmpty
+	EmptyInterval time.Duration `cfg:"empty_interval"`
+	// ScrapeMode - how to respond to scrape of unapproved info hash:
+	// ScrapeModeAllow, ModeReject (whole request fails with ErrTorrentUnapproved)
+	// or ModeEmpty (unapproved info hashes are answered with zeroes)
+	ScrapeMode string `cfg:"scrape_mode"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg baseConfig) Validate() baseConfig {
+	validCfg := cfg
+	switch cfg.Mode {
+	case ModeReject, ModeEmpty:
+	default:
+		validCfg.Mode = ModeReject
+		logger.Warn().
+			Str("name", "Mode").
+			Str("provided", cfg.Mode).
+			Str("default", validCfg.Mode).
+			Msg("falling back to default configuration")
+	}
+	if validCfg.Mode == ModeEmpty && cfg.EmptyInterval <= 0 {
+		validCfg.EmptyInterval = defaultEmptyInterval
+		logger.Warn().
+			Str("name", "EmptyInterval").
+			Dur("provided", cfg.EmptyInterval).
+			Dur("default", validCfg.EmptyInterval).
+			Msg("falling back to default configuration")
+	}
+	switch cfg.ScrapeMode {
+	case ScrapeModeAllow, ModeReject, ModeEmpty:
+	default:
+		validCfg.ScrapeMode = ScrapeModeAllow
+		if len(cfg.ScrapeMode) > 0 {
+			logger.Warn().
+				Str("name", "ScrapeMode").
+				Str("provided", cfg.ScrapeMode).
+				Str("default", validCfg.ScrapeMode).
+				Msg("falling back to default configuration")
+		}
+	}
+	switch cfg.LoadFailure {
+	case FailClosed, FailOpen:
+	default:
+		validCfg.LoadFailure = FailClosed
+		logger.Warn().
+			Str("name", "LoadFailure").
+			Str("provided", cfg.LoadFailure).
+			Str("default", validCfg.LoadFailure).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.Sources) > 0 {
+		switch cfg.Combine {
+		case CombineUnion, CombineIntersection:
+		default:
+			validCfg.Combine = CombineUnion
+			logger.Warn().
+				Str("name", "Combine").
+				Str("provided", cfg.Combine).
+				Str("default", validCfg.Combine).
+				Msg("falling back to default configuration")
+		}
+	}
+	return validCfg
 }
 
 func build(config conf.MapConfig, st storage.PeerStorage) (h middleware.Hook, err error) {
@@ -44,48 +152,215 @@ func build(config conf.MapConfig, st storage.PeerStorage) (h middleware.Hook, er
 		return nil, fmt.Errorf("middleware %s: %w", Name, err)
 	}
 
-	if len(cfg.Source) == 0 {
-		return nil, fmt.Errorf("invalid config for middleware %s: source not provided", Name)
+	sources := cfg.Sources
+	if len(cfg.Source) > 0 || len(sources) == 0 {
+		sources = append([]sourceConfig{{Source: cfg.Source, Configuration: cfg.Configuration}}, sources...)
 	}
-
-	if cfg.Configuration == nil {
-		return nil, fmt.Errorf("invalid config for middleware %s: config not provided", Name)
+	for _, sc := range sources {
+		if len(sc.Source) == 0 {
+			return nil, fmt.Errorf("invalid config for middleware %s: source not provided", Name)
+		}
+		if sc.Configuration == nil {
+			return nil, fmt.Errorf("invalid config for middleware %s: config not provided", Name)
+		}
 	}
 
+	cfg = cfg.Validate()
+
 	var ds storage.DataStorage = st
 	if !cfg.Preserve && ds.Preservable() {
 		ds = memory.NewDataStorage()
 	}
 
-	var c container.Container
-	if c, err = container.GetContainer(cfg.Source, cfg.Configuration, ds); err == nil {
-		h = &hook{c}
+	cs := make([]container.Container, 0, len(sources))
+	for _, sc := range sources {
+		var c container.Container
+		if c, err = container.GetContainer(sc.Source, sc.Configuration, ds); err != nil {
+			if cfg.LoadFailure != FailOpen {
+				_ = multiContainer{containers: cs}.Close()
+				return nil, err
+			}
+			logger.Error().Err(err).
+				Str("source", sc.Source).
+				Msg("unable to load approval source, ALL info hashes are approved by it")
+			c, err = approveAll{}, nil
+		}
+		cs = append(cs, c)
+	}
+
+	var c container.Container = multiContainer{containers: cs, intersection: cfg.Combine == CombineIntersection}
+	if len(cs) == 1 {
+		c = cs[0]
+	}
+	h = &hook{
+		hashContainer: c,
+		emptyMode:     cfg.Mode == ModeEmpty,
+		emptyInterval: cfg.EmptyInterval,
+		scrapeMode:    cfg.ScrapeMode,
 	}
-	return h, err
+	return h, nil
 }
 
 // ErrTorrentUnapproved is the error returned when a torrent hash is invalid.
 var ErrTorrentUnapproved = bittorrent.ClientError("torrent not allowed by mochi")
 
+var (
+	errDenyNotSupported   = errors.New("container does not support denial of info hash")
+	errReloadNotSupported = errors.New("container does not support reload")
+)
+
+// approveAll is the container used instead of source,
+// which failed to load in FailOpen mode
+type approveAll struct{}
+
+func (approveAll) Approved(context.Context, bittorrent.InfoHash) bool {
+	return true
+}
+
+// multiContainer combines results of several containers
+type multiContainer struct {
+	containers   []container.Container
+	intersection bool
+}
+
+func (m multiContainer) Approved(ctx context.Context, ih bittorrent.InfoHash) bool {
+	for _, c := range m.containers {
+		if c.Approved(ctx, ih) != m.intersection {
+			return !m.intersection
+		}
+	}
+	return m.intersection
+}
+
+// Deny denies info hash in all containers, which support it.
+// In union mode all containers must support denial, otherwise
+// info hash may stay approved by one of them.
+func (m multiContainer) Deny(ctx context.Context, ih bittorrent.InfoHash) error {
+	var errs []error
+	supported := 0
+	for _, c := range m.containers {
+		if d, isOk := c.(container.Denier); isOk {
+			supported++
+			errs = append(errs, d.Deny(ctx, ih))
+		}
+	}
+	if supported == 0 || (!m.intersection && supported < len(m.containers)) {
+		errs = append(errs, errDenyNotSupported)
+	}
+	return errors.Join(errs...)
+}
+
+// Reload reloads all containers, which support it
+func (m multiContainer) Reload(ctx context.Context) error {
+	var errs []error
+	supported := 0
+	for _, c := range m.containers {
+		if r, isOk := c.(container.Reloadable); isOk {
+			supported++
+			errs = append(errs, r.Reload(ctx))
+		}
+	}
+	if supported == 0 {
+		errs = append(errs, errReloadNotSupported)
+	}
+	return errors.Join(errs...)
+}
+
+// WarmedUp returns true if all containers, which load
+// their sources in background, finished loading
+func (m multiContainer) WarmedUp() bool {
+	for _, c := range m.containers {
+		if w, isOk := c.(container.Warmer); isOk && !w.WarmedUp() {
+			return false
+		}
+	}
+	return true
+}
+
+func (m multiContainer) Close() error {
+	var errs []error
+	for _, c := range m.containers {
+		if cl, isOk := c.(io.Closer); isOk {
+			errs = append(errs, cl.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
 type hook struct {
 	hashContainer container.Container
+	emptyMode     bool
+	emptyInterval time.Duration
+	scrapeMode    string
 }
 
-func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
 	var err error
 
 	if !h.hashContainer.Approved(ctx, req.InfoHash) {
-		err = ErrTorrentUnapproved
+		if h.emptyMode {
+			// respond without peers and do not store requester
+			ctx = context.WithValue(ctx, middleware.SkipResponseHookKey, true)
+			ctx = context.WithValue(ctx, middleware.SkipSwarmInteractionKey, true)
+			resp.Interval, resp.MinInterval = h.emptyInterval, h.emptyInterval
+			resp.WarningMessage = ErrTorrentUnapproved.Error()
+		} else {
+			err = ErrTorrentUnapproved
+		}
 	}
 
 	return ctx, err
 }
 
-func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
-	// Scrapes don't require any protection.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.scrapeMode == ScrapeModeAllow {
+		return ctx, nil
+	}
+	var unapproved map[bittorrent.InfoHash]struct{}
+	for _, ih := range req.InfoHashes {
+		if h.hashContainer.Approved(ctx, ih) {
+			continue
+		}
+		if h.scrapeMode == ModeReject {
+			return ctx, ErrTorrentUnapproved
+		}
+		if unapproved == nil {
+			unapproved = make(map[bittorrent.InfoHash]struct{})
+		}
+		unapproved[ih] = struct{}{}
+	}
+	if unapproved != nil {
+		// do not leak statistics of unapproved swarms
+		ctx = context.WithValue(ctx, middleware.EmptyScrapeKey, unapproved)
+	}
 	return ctx, nil
 }
 
+// Deny makes info hash not approved if container supports it
+func (h *hook) Deny(ctx context.Context, ih bittorrent.InfoHash) error {
+	if d, isOk := h.hashContainer.(container.Denier); isOk {
+		return d.Deny(ctx, ih)
+	}
+	return errDenyNotSupported
+}
+
+// Reload re-reads source of hashes if container supports it
+func (h *hook) Reload(ctx context.Context) error {
+	if r, isOk := h.hashContainer.(container.Reloadable); isOk {
+		return r.Reload(ctx)
+	}
+	return errReloadNotSupported
+}
+
+// WarmedUp returns true if container finished loading
+// of its source or does not require it
+func (h *hook) WarmedUp() bool {
+	if w, isOk := h.hashContainer.(container.Warmer); isOk {
+		return w.WarmedUp()
+	}
+	return true
+}
+
 func (h *hook) Close() (err error) {
 	if cl, isOk := h.hashContainer.(io.Closer); isOk {
 		err = cl.Close()
@@ -3,11 +3,18 @@ package torrentapproval
 import (
 	"context"
 	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/stretchr/testify/require"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/storage/memory"
@@ -99,3 +106,266 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestEmptyMode(t *testing.T) {
+	storage, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer storage.Close()
+
+	h, err := build(conf.MapConfig{
+		"initial_source": "list",
+		"mode":           ModeEmpty,
+		"empty_interval": "1h",
+		"configuration": map[string]any{
+			"hash_list": []string{"3532cf2d327fad8448c075b4cb42c8136964a435"},
+		},
+	}, storage)
+	require.Nil(t, err)
+
+	ih, _ := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	req := &bittorrent.AnnounceRequest{InfoHash: ih}
+	resp := &bittorrent.AnnounceResponse{Interval: time.Minute}
+
+	ctx, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipResponseHookKey))
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+	require.Empty(t, resp.IPv4Peers)
+	require.Empty(t, resp.IPv6Peers)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, ErrTorrentUnapproved.Error(), resp.WarningMessage)
+}
+
+func TestScrapeMode(t *testing.T) {
+	ctx := context.Background()
+	approved, _ := bittorrent.NewInfoHashString("3532cf2d327fad8448c075b4cb42c8136964a435")
+	unapproved, _ := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+	req := &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{approved, unapproved}}
+
+	for mode, expected := range map[string]bittorrent.Scrapes{
+		"":              {{InfoHash: approved, Complete: 1}, {InfoHash: unapproved, Complete: 1}},
+		ScrapeModeAllow: {{InfoHash: approved, Complete: 1}, {InfoHash: unapproved, Complete: 1}},
+		ModeEmpty:       {{InfoHash: approved, Complete: 1}, {InfoHash: unapproved}},
+		ModeReject:      nil,
+	} {
+		t.Run(mode, func(t *testing.T) {
+			storage, err := memory.NewPeerStorage(memory.Config{})
+			require.Nil(t, err)
+			defer storage.Close()
+			for _, ih := range req.InfoHashes {
+				require.Nil(t, storage.PutSeeder(ctx, ih, peer))
+			}
+			h, err := build(conf.MapConfig{
+				"initial_source": "list",
+				"scrape_mode":    mode,
+				"configuration": map[string]any{
+					"hash_list": []string{approved.String()},
+				},
+			}, storage)
+			require.Nil(t, err)
+			l := middleware.NewLogic(time.Minute, time.Minute, storage, []middleware.Hook{h}, nil)
+
+			_, resp, err := l.HandleScrape(ctx, req)
+			if mode == ModeReject {
+				require.ErrorIs(t, err, ErrTorrentUnapproved)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, expected, resp.Data)
+
+			// only approved info hashes are not restricted
+			_, resp, err = l.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{approved}})
+			require.Nil(t, err)
+			require.Equal(t, expected[:1], resp.Data)
+		})
+	}
+}
+
+func TestPurgeDeny(t *testing.T) {
+	for _, invert := range []bool{false, true} {
+		t.Run(fmt.Sprintf("invert %t", invert), func(t *testing.T) {
+			ps, err := memory.NewPeerStorage(memory.Config{})
+			require.Nil(t, err)
+			defer ps.Close()
+
+			ihStr := "3532cf2d327fad8448c075b4cb42c8136964a435"
+			var hashList []string
+			if !invert {
+				hashList = []string{ihStr}
+			}
+			h, err := build(conf.MapConfig{
+				"initial_source": "list",
+				"configuration":  map[string]any{"hash_list": hashList, "invert": invert},
+			}, ps)
+			require.Nil(t, err)
+			l := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{h}, nil)
+			l.SetResponseConfig(middleware.ResponseConfig{OmitEmptyScrapes: true})
+
+			ih, _ := bittorrent.NewInfoHashString(ihStr)
+			peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+			require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+			req := &bittorrent.AnnounceRequest{InfoHash: ih, RequestPeer: bittorrent.RequestPeer{
+				ID:               peer.ID,
+				Port:             peer.Port(),
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: peer.Addr()}},
+			}}
+			_, _, err = l.HandleAnnounce(context.Background(), req)
+			require.Nil(t, err)
+
+			require.Nil(t, l.PurgeSwarm(context.Background(), ih, true))
+			_, resp, err := l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}})
+			require.Nil(t, err)
+			require.Empty(t, resp.Data)
+			_, _, err = l.HandleAnnounce(context.Background(), req)
+			require.ErrorIs(t, err, ErrTorrentUnapproved)
+		})
+	}
+
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ih, _ := bittorrent.NewInfoHashString("3532cf2d327fad8448c075b4cb42c8136964a435")
+	l := middleware.NewLogic(time.Minute, time.Minute, ps, nil, nil)
+	require.ErrorIs(t, l.PurgeSwarm(context.Background(), ih, true), middleware.ErrNoDenier)
+	require.Nil(t, l.PurgeSwarm(context.Background(), ih, false))
+}
+
+func TestMultipleSources(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	info := metainfo.Info{Name: "test", PieceLength: 16384, Pieces: make([]byte, 20), Length: 1}
+	mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "test.torrent"))
+	require.Nil(t, err)
+	require.Nil(t, mi.Write(f))
+	require.Nil(t, f.Close())
+
+	listIH := "3532cf2d327fad8448c075b4cb42c8136964a435"
+	fileIH := mi.HashInfoBytes().HexString()
+	otherIH := "4532cf2d327fad8448c075b4cb42c8136964a435"
+
+	for _, tt := range []struct {
+		combine  string
+		approved map[string]bool
+	}{
+		{CombineUnion, map[string]bool{listIH: true, fileIH: true, otherIH: false}},
+		{CombineIntersection, map[string]bool{listIH: false, fileIH: false, otherIH: false}},
+	} {
+		t.Run(tt.combine, func(t *testing.T) {
+			h, err := build(conf.MapConfig{
+				"combine": tt.combine,
+				"sources": []map[string]any{
+					{
+						"source": "list",
+						"configuration": map[string]any{
+							"hash_list":   []string{listIH},
+							"storage_ctx": "LIST_" + tt.combine,
+						},
+					},
+					{
+						"source": "directory",
+						"configuration": map[string]any{
+							"path":        dir,
+							"storage_ctx": "DIR_" + tt.combine,
+						},
+					},
+				},
+			}, ps)
+			require.Nil(t, err)
+			defer h.(*hook).Close()
+
+			// directory is scanned asynchronously
+			fih, _ := bittorrent.NewInfoHashString(fileIH)
+			require.Eventually(t, func() bool {
+				ok, _ := ps.Contains(context.Background(), "DIR_"+tt.combine, fih.RawString())
+				return ok
+			}, 5*time.Second, 10*time.Millisecond)
+
+			for ihStr, approved := range tt.approved {
+				ih, _ := bittorrent.NewInfoHashString(ihStr)
+				_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, &bittorrent.AnnounceResponse{})
+				if approved {
+					require.Nil(t, err, ihStr)
+				} else {
+					require.ErrorIs(t, err, ErrTorrentUnapproved, ihStr)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFailure(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	cfg := conf.MapConfig{
+		"initial_source": "list",
+		"configuration":  map[string]any{"hash_list": []string{"not a hash"}},
+	}
+
+	_, err = build(cfg, ps)
+	require.NotNil(t, err, "fail closed is default")
+
+	cfg["load_failure"] = FailOpen
+	h, err := build(cfg, ps)
+	require.Nil(t, err)
+	ih, _ := bittorrent.NewInfoHashString("3532cf2d327fad8448c075b4cb42c8136964a435")
+	_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
+
+func TestReload(t *testing.T) {
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	dir := t.TempDir()
+	writeTorrent := func(name string) bittorrent.InfoHash {
+		info := metainfo.Info{Name: name, PieceLength: 16384, Pieces: make([]byte, 20), Length: 1}
+		mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+		f, err := os.Create(filepath.Join(dir, name+".torrent"))
+		require.Nil(t, err)
+		require.Nil(t, mi.Write(f))
+		require.Nil(t, f.Close())
+		ih, _ := bittorrent.NewInfoHash(mi.HashInfoBytes().Bytes())
+		return ih
+	}
+	oldIH := writeTorrent("old")
+
+	h, err := build(conf.MapConfig{
+		"initial_source": "directory",
+		"configuration":  map[string]any{"path": dir},
+	}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	l := middleware.NewLogic(0, 0, ps, []middleware.Hook{h}, nil)
+
+	approved := func(ih bittorrent.InfoHash) bool {
+		_, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, &bittorrent.AnnounceResponse{})
+		return err == nil
+	}
+	// directory is scanned asynchronously, hook is ready after initial loading
+	require.Eventually(t, func() bool { return l.Ready(context.Background()) == nil }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, approved(oldIH))
+
+	newIH := writeTorrent("new")
+	require.Nil(t, os.Remove(filepath.Join(dir, "old.torrent")))
+	require.Nil(t, l.Reload(context.Background()))
+	require.True(t, approved(newIH))
+	require.False(t, approved(oldIH))
+
+	// list does not support reload
+	h, err = build(conf.MapConfig{
+		"initial_source": "list",
+		"configuration":  map[string]any{"hash_list": []string{newIH.String()}},
+	}, ps)
+	require.Nil(t, err)
+	l = middleware.NewLogic(0, 0, ps, []middleware.Hook{h}, nil)
+	require.ErrorIs(t, l.Reload(context.Background()), errReloadNotSupported)
+	// list is loaded synchronously
+	require.Nil(t, l.Ready(context.Background()))
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/tracing"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestTracingSpans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tracing.Use(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer tracing.Use(nil)
+
+	ps, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	defer ps.Close()
+	l := NewLogic(0, 0, storage.NewTracingStorage(ps), []Hook{&nopHook{}}, nil)
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 1, NumWant: 10, RequestPeer: bittorrent.RequestPeer{
+		Port:             6881,
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+	}}
+	rootCtx, root := tracing.Start(context.Background(), "request")
+	ctx, resp, err := l.HandleAnnounce(bittorrent.InjectRouteParamsToContext(rootCtx, nil), req)
+	require.Nil(t, err)
+	root.End()
+	l.AfterAnnounce(tracing.Remap(rootCtx, bittorrent.RemapRouteParamsToBgContext(ctx)), req, resp)
+
+	// span name -> parent span name
+	spans := rec.Ended()
+	names := make(map[[8]byte]string, len(spans))
+	for _, s := range spans {
+		names[s.SpanContext().SpanID()] = s.Name()
+	}
+	tree := make(map[string]string, len(spans))
+	for _, s := range spans {
+		require.Equal(t, root.SpanContext().TraceID(), s.SpanContext().TraceID(), s.Name())
+		tree[s.Name()] = names[s.Parent().SpanID()]
+	}
+	require.Equal(t, map[string]string{
+		"request":                               "",
+		"hook *middleware.nopHook":              "request",
+		"hook *middleware.responseHook":         "request",
+		"storage.ScrapeSwarm":                   "hook *middleware.responseHook",
+		"storage.AnnouncePeers":                 "hook *middleware.responseHook",
+		"after announce":                        "request",
+		"hook *middleware.swarmInteractionHook": "after announce",
+		"storage.PutLeecher":                    "hook *middleware.swarmInteractionHook",
+	}, tree)
+}
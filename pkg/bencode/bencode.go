@@ -0,0 +1,244 @@
+// Package bencode implements minimal encoder and decoder of
+// bencoded data (BEP 3) used by HTTP frontend responses
+// (see Writer).
+// Decoded values are represented as int64, string, []any
+// and map[string]any.
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// MaxDepth is the maximum nesting level of lists and dictionaries
+// accepted by Decode.
+const MaxDepth = 64
+
+var (
+	// ErrUnexpectedEOF returned if data ends before value is complete.
+	ErrUnexpectedEOF = errors.New("bencode: unexpected end of data")
+	// ErrTrailingData returned if data contains bytes after the top-level value.
+	ErrTrailingData = errors.New("bencode: trailing data")
+	// ErrTooDeep returned if nesting level exceeds MaxDepth.
+	ErrTooDeep = errors.New("bencode: nesting too deep")
+	// ErrInvalidInteger returned if integer value is malformed.
+	ErrInvalidInteger = errors.New("bencode: invalid integer")
+	// ErrInvalidString returned if string length is malformed.
+	ErrInvalidString = errors.New("bencode: invalid string length")
+	// ErrInvalidKey returned if dictionary keys are not strings
+	// or not sorted in ascending order.
+	ErrInvalidKey = errors.New("bencode: invalid dictionary key")
+)
+
+// Encode writes bencoded representation of v into w.
+// Supported types are signed and unsigned integers, string, []byte,
+// []any, []string and map[string]any. Dictionary keys are written sorted.
+func Encode(w io.Writer, v any) error {
+	var bb bytes.Buffer
+	if err := encode(&bb, v); err != nil {
+		return err
+	}
+	_, err := bb.WriteTo(w)
+	return err
+}
+
+// Marshal returns bencoded representation of v.
+// See Encode for supported types.
+func Marshal(v any) ([]byte, error) {
+	var bb bytes.Buffer
+	if err := encode(&bb, v); err != nil {
+		return nil, err
+	}
+	return bb.Bytes(), nil
+}
+
+func encode(bb *bytes.Buffer, v any) error {
+	w := NewWriter(bb)
+	switch t := v.(type) {
+	case string:
+		w.String(t)
+	case []byte:
+		w.Bytes(t)
+	case int:
+		w.Int(int64(t))
+	case int8:
+		w.Int(int64(t))
+	case int16:
+		w.Int(int64(t))
+	case int32:
+		w.Int(int64(t))
+	case int64:
+		w.Int(t)
+	case uint:
+		w.Uint(uint64(t))
+	case uint8:
+		w.Uint(uint64(t))
+	case uint16:
+		w.Uint(uint64(t))
+	case uint32:
+		w.Uint(uint64(t))
+	case uint64:
+		w.Uint(t)
+	case []string:
+		w.StartList()
+		for _, s := range t {
+			w.String(s)
+		}
+		w.End()
+	case []any:
+		w.StartList()
+		for _, e := range t {
+			if err := encode(bb, e); err != nil {
+				return err
+			}
+		}
+		w.End()
+	case map[string]any:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.StartDict()
+		for _, k := range keys {
+			w.String(k)
+			if err := encode(bb, t[k]); err != nil {
+				return err
+			}
+		}
+		w.End()
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil
+}
+
+// Decode parses single bencoded value from data.
+// Data must contain exactly one value without any trailing bytes,
+// dictionary keys must be unique and sorted.
+func Decode(data []byte) (any, error) {
+	d := decoder{data: data}
+	v, err := d.value(0)
+	if err == nil && d.pos != len(d.data) {
+		err = ErrTrailingData
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) value(depth int) (any, error) {
+	if d.pos >= len(d.data) {
+		return nil, ErrUnexpectedEOF
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.integer()
+	case c >= '0' && c <= '9':
+		return d.string()
+	case c == 'l':
+		if depth >= MaxDepth {
+			return nil, ErrTooDeep
+		}
+		d.pos++
+		l := make([]any, 0)
+		for {
+			if d.pos >= len(d.data) {
+				return nil, ErrUnexpectedEOF
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return l, nil
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+	case c == 'd':
+		if depth >= MaxDepth {
+			return nil, ErrTooDeep
+		}
+		d.pos++
+		m, prev := make(map[string]any), ""
+		for first := true; ; first = false {
+			if d.pos >= len(d.data) {
+				return nil, ErrUnexpectedEOF
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return m, nil
+			}
+			if c := d.data[d.pos]; c < '0' || c > '9' {
+				return nil, ErrInvalidKey
+			}
+			k, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			if !first && k <= prev {
+				return nil, ErrInvalidKey
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k], prev = v, k
+		}
+	default:
+		return nil, fmt.Errorf("bencode: unexpected character %q at %d", c, d.pos)
+	}
+}
+
+func (d *decoder) integer() (int64, error) {
+	end := bytes.IndexByte(d.data[d.pos:], 'e')
+	if end < 0 {
+		return 0, ErrUnexpectedEOF
+	}
+	s := d.data[d.pos : d.pos+end]
+	// BEP 3: leading zeros and negative zero are not allowed
+	if l := len(s); l == 0 || s[0] == '+' ||
+		(s[0] == '0' && l > 1) ||
+		(s[0] == '-' && (l == 1 || s[1] == '0')) {
+		return 0, ErrInvalidInteger
+	}
+	i, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidInteger
+	}
+	d.pos += end + 1
+	return i, nil
+}
+
+func (d *decoder) string() (string, error) {
+	sep := bytes.IndexByte(d.data[d.pos:], ':')
+	if sep < 0 {
+		return "", ErrUnexpectedEOF
+	}
+	s := d.data[d.pos : d.pos+sep]
+	if len(s) == 0 || (s[0] == '0' && len(s) > 1) {
+		return "", ErrInvalidString
+	}
+	l, err := strconv.ParseUint(string(s), 10, 31)
+	if err != nil {
+		return "", ErrInvalidString
+	}
+	start := d.pos + sep + 1
+	if uint64(len(d.data)-start) < l {
+		return "", ErrUnexpectedEOF
+	}
+	d.pos = start + int(l)
+	return string(d.data[start:d.pos]), nil
+}
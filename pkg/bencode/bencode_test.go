@@ -0,0 +1,129 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	v, err := Decode([]byte("d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei4e10:downloadedi5e10:incompletei6eeee"))
+	require.Nil(t, err)
+	require.Equal(t, map[string]any{
+		"files": map[string]any{
+			"aaaaaaaaaaaaaaaaaaaa": map[string]any{
+				"complete":   int64(4),
+				"downloaded": int64(5),
+				"incomplete": int64(6),
+			},
+		},
+	}, v)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	table := []struct {
+		data string
+		err  error
+	}{
+		{"", ErrUnexpectedEOF},
+		{"i1", ErrUnexpectedEOF},
+		{"ie", ErrInvalidInteger},
+		{"i-0e", ErrInvalidInteger},
+		{"i01e", ErrInvalidInteger},
+		{"i+1e", ErrInvalidInteger},
+		{"i99999999999999999999e", ErrInvalidInteger},
+		{"01:a", ErrInvalidString},
+		{"5:abc", ErrUnexpectedEOF},
+		{"l", ErrUnexpectedEOF},
+		{"di1ei1ee", ErrInvalidKey},
+		{"d1:bi1e1:ai1ee", ErrInvalidKey},
+		{"d1:ai1e1:ai1ee", ErrInvalidKey},
+		{"i1ei2e", ErrTrailingData},
+		{strings.Repeat("l", MaxDepth+1) + strings.Repeat("e", MaxDepth+1), ErrTooDeep},
+	}
+	for _, tt := range table {
+		t.Run(tt.data, func(t *testing.T) {
+			_, err := Decode([]byte(tt.data))
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	var bb bytes.Buffer
+	err := Encode(&bb, map[string]any{
+		"interval": 1800,
+		"complete": uint32(1),
+		"peers":    []byte{1, 2, 3, 4, 5, 6},
+		"list":     []any{int64(-1), "a", []string{"b"}},
+	})
+	require.Nil(t, err)
+	require.Equal(t, "d8:completei1e8:intervali1800e4:listli-1e1:al1:bee5:peers6:\x01\x02\x03\x04\x05\x06e", bb.String())
+
+	require.NotNil(t, Encode(&bb, 1.5))
+}
+
+func TestWriter(t *testing.T) {
+	var bb bytes.Buffer
+	w := NewWriter(&bb)
+	w.StartDict()
+	w.String("a")
+	w.StartList()
+	w.Int(-1)
+	w.Uint(2)
+	w.Bytes([]byte{0})
+	w.End()
+	w.String("b")
+	w.StringPrefix(2)
+	bb.WriteString("xy")
+	w.End()
+	require.Equal(t, "d1:ali-1ei2e1:\x00e1:b2:xye", bb.String())
+	v, err := Decode(bb.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, map[string]any{"a": []any{int64(-1), int64(2), "\x00"}, "b": "xy"}, v)
+}
+
+// seed corpus of real HTTP frontend responses is in testdata/fuzz/FuzzDecode
+func FuzzDecode(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := Decode(data)
+		if err != nil {
+			return
+		}
+		// any accepted input is canonical, so it must be encoded back as is
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("unable to encode decoded value: %v", err)
+		}
+		if !bytes.Equal(data, out) {
+			t.Fatalf("round trip mismatch: %q != %q", data, out)
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("failure reason", "hello world", int64(1800), []byte{127, 0, 0, 1, 0x1a, 0xe1})
+	f.Add("", "", int64(-1), []byte{})
+	f.Fuzz(func(t *testing.T, key, str string, i int64, b []byte) {
+		in := map[string]any{
+			key:  str,
+			"i":  i,
+			"l":  []any{str, i, map[string]any{}},
+			"\n": string(b),
+		}
+		data, err := Marshal(in)
+		if err != nil {
+			t.Fatalf("unable to encode value: %v", err)
+		}
+		out, err := Decode(data)
+		if err != nil {
+			t.Fatalf("unable to decode %q: %v", data, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("round trip mismatch: %v != %v", in, out)
+		}
+	})
+}
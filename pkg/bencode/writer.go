@@ -0,0 +1,69 @@
+package bencode
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Writer writes bencoded values into buffer one by one without
+// intermediate representation (i.e. to encode responses into pooled
+// buffers). Caller is responsible for structure of written data:
+// every list and dictionary must be closed with End, dictionary keys
+// must be written with String in ascending order.
+type Writer struct {
+	bb *bytes.Buffer
+}
+
+// NewWriter creates Writer, which appends values to bb
+func NewWriter(bb *bytes.Buffer) Writer {
+	return Writer{bb: bb}
+}
+
+// String writes string value or dictionary key
+func (w Writer) String(s string) {
+	w.StringPrefix(len(s))
+	w.bb.WriteString(s)
+}
+
+// Bytes writes b as string value
+func (w Writer) Bytes(b []byte) {
+	w.StringPrefix(len(b))
+	w.bb.Write(b)
+}
+
+// StringPrefix writes length prefix of string value,
+// exactly n bytes of value must be written by caller
+// directly into buffer after this call.
+func (w Writer) StringPrefix(n int) {
+	w.bb.Write(strconv.AppendInt(w.bb.AvailableBuffer(), int64(n), 10))
+	w.bb.WriteByte(':')
+}
+
+// Int writes signed integer value
+func (w Writer) Int(i int64) {
+	w.bb.WriteByte('i')
+	w.bb.Write(strconv.AppendInt(w.bb.AvailableBuffer(), i, 10))
+	w.bb.WriteByte('e')
+}
+
+// Uint writes unsigned integer value
+func (w Writer) Uint(i uint64) {
+	w.bb.WriteByte('i')
+	w.bb.Write(strconv.AppendUint(w.bb.AvailableBuffer(), i, 10))
+	w.bb.WriteByte('e')
+}
+
+// StartList opens list, which elements are written next
+func (w Writer) StartList() {
+	w.bb.WriteByte('l')
+}
+
+// StartDict opens dictionary, which keys and values are written next
+func (w Writer) StartDict() {
+	w.bb.WriteByte('d')
+}
+
+// End closes the last opened list or dictionary
+func (w Writer) End() {
+	w.bb.WriteByte('e')
+}
@@ -0,0 +1,97 @@
+package conf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// schemeSeparator separates source scheme from source location
+const schemeSeparator = "://"
+
+var (
+	sourcesMU sync.RWMutex
+	sources   = make(map[string]SourceBuilder)
+
+	// ErrEmptySourceLocation returned from NewSource if location is empty
+	ErrEmptySourceLocation = errors.New("no config location specified")
+)
+
+// Source provides raw configuration data (i.e. YAML encoded)
+type Source interface {
+	// Read returns current configuration data
+	Read(ctx context.Context) ([]byte, error)
+}
+
+// WatchableSource is the Source, which can notify about configuration changes
+// (i.e. remote key-value storages like etcd or consul).
+type WatchableSource interface {
+	Source
+	// Watch returns channel, which receives notification every time
+	// configuration changed. Implementation must close channel
+	// when ctx is done.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+// SourceBuilder is the function used to initialize a new Source
+// with provided location (part after scheme://)
+type SourceBuilder func(location string) (Source, error)
+
+// RegisterSource makes a SourceBuilder available by the provided scheme.
+//
+// If called twice with the same scheme, the scheme is blank, or if the provided
+// SourceBuilder is nil, this function panics.
+func RegisterSource(scheme string, b SourceBuilder) {
+	if scheme == "" {
+		panic("conf: could not register a SourceBuilder with an empty scheme")
+	}
+	if b == nil {
+		panic("conf: could not register a nil SourceBuilder")
+	}
+
+	sourcesMU.Lock()
+	defer sourcesMU.Unlock()
+
+	if _, dup := sources[scheme]; dup {
+		panic("conf: RegisterSource called twice for " + scheme)
+	}
+
+	sources[scheme] = b
+}
+
+// NewSource creates Source for provided location.
+// If location starts with registered scheme (i.e. etcd://),
+// appropriate SourceBuilder is called with the rest of location,
+// otherwise (or if scheme is file://) FileSource returned.
+func NewSource(location string) (Source, error) {
+	if len(location) == 0 {
+		return nil, ErrEmptySourceLocation
+	}
+	if scheme, rest, found := strings.Cut(location, schemeSeparator); found && scheme != FileScheme {
+		sourcesMU.RLock()
+		defer sourcesMU.RUnlock()
+		b, ok := sources[scheme]
+		if !ok {
+			return nil, fmt.Errorf("config source with scheme '%s' does not exists", scheme)
+		}
+		return b(rest)
+	} else if found {
+		location = rest
+	}
+	return FileSource(location), nil
+}
+
+// FileScheme is the scheme of FileSource
+const FileScheme = "file"
+
+// FileSource is the Source, which reads configuration from local file.
+// Path may contain environment variables.
+type FileSource string
+
+// Read returns contents of the file
+func (fs FileSource) Read(context.Context) ([]byte, error) {
+	return os.ReadFile(os.ExpandEnv(string(fs)))
+}
@@ -0,0 +1,95 @@
+package conf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memSource struct {
+	sync.Mutex
+	data     []byte
+	watchers []chan struct{}
+}
+
+func (ms *memSource) Read(context.Context) ([]byte, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	return ms.data, nil
+}
+
+func (ms *memSource) Watch(ctx context.Context) (<-chan struct{}, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ch := make(chan struct{}, 1)
+	ms.watchers = append(ms.watchers, ch)
+	go func() {
+		<-ctx.Done()
+		ms.Lock()
+		defer ms.Unlock()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (ms *memSource) set(data []byte) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.data = data
+	for _, w := range ms.watchers {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func TestMemSource(t *testing.T) {
+	ms := &memSource{data: []byte("a: 1")}
+	RegisterSource("mem", func(string) (Source, error) { return ms, nil })
+
+	src, err := NewSource("mem://config")
+	require.Nil(t, err)
+	ws, isOk := src.(WatchableSource)
+	require.True(t, isOk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := ws.Watch(ctx)
+	require.Nil(t, err)
+
+	data, err := src.Read(ctx)
+	require.Nil(t, err)
+	require.Equal(t, "a: 1", string(data))
+
+	ms.set([]byte("a: 2"))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("change notification not received")
+	}
+	data, err = src.Read(ctx)
+	require.Nil(t, err)
+	require.Equal(t, "a: 2", string(data))
+
+	_, err = NewSource("unknown://config")
+	require.NotNil(t, err)
+}
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("a: 1"), 0o600))
+	for _, l := range []string{path, FileScheme + schemeSeparator + path} {
+		src, err := NewSource(l)
+		require.Nil(t, err)
+		require.IsType(t, FileSource(""), src)
+		data, err := src.Read(context.Background())
+		require.Nil(t, err)
+		require.Equal(t, "a: 1", string(data))
+	}
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// ErrNoAdminToken returned from NewAdminServer if token is not provided
+var ErrNoAdminToken = errors.New("admin token not provided")
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("gomaxprocs", expvar.Func(func() any {
+		return runtime.GOMAXPROCS(0)
+	}))
+}
+
+// NewAdminServer creates a new instance of HTTP server, which asynchronously
+// serves pprof profiles (/debug/pprof/) and expvar variables (/debug/vars).
+// All requests must contain `Authorization: Bearer <token>` header.
+func NewAdminServer(addr, token string) (*Server, error) {
+	if len(token) == 0 {
+		return nil, ErrNoAdminToken
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	s := &Server{
+		srv: &http.Server{
+			Addr:              addr,
+			Handler:           authorized(mux, []byte(token)),
+			ReadTimeout:       readTimeout,
+			ReadHeaderTimeout: readTimeout,
+			// profiles and traces may take long
+			WriteTimeout: 0,
+		},
+		ln: ln,
+	}
+
+	go func() {
+		if err := s.srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("failed while serving admin")
+		}
+	}()
+
+	return s, nil
+}
+
+// authorized passes requests with valid bearer token to h
+func authorized(h http.Handler, token []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), token) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
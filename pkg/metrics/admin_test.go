@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminServer(t *testing.T) {
+	_, err := NewAdminServer("127.0.0.1:0", "")
+	require.ErrorIs(t, err, ErrNoAdminToken)
+
+	s, err := NewAdminServer("127.0.0.1:0", "secret")
+	require.Nil(t, err)
+	defer s.Close()
+
+	get := func(path, token string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+s.ln.Addr().String()+path, nil)
+		require.Nil(t, err)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/"} {
+		require.Equal(t, http.StatusUnauthorized, get(path, ""), path)
+		require.Equal(t, http.StatusUnauthorized, get(path, "wrong"), path)
+		require.Equal(t, http.StatusOK, get(path, "secret"), path)
+	}
+	require.Equal(t, http.StatusNotFound, get("/metrics", "secret"))
+}
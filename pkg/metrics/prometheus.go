@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Register registers provided collector in default prometheus registry.
+// If collector with the same descriptor is already registered
+// (i.e. after re-creation of component), existing collector is returned
+// instead of panic as in prometheus.MustRegister.
+// If registration fails for any other reason, error is logged
+// and provided (unregistered) collector is returned.
+func Register[T prometheus.Collector](c T) T {
+	err := prometheus.Register(c)
+	if err == nil {
+		return c
+	}
+	var regErr prometheus.AlreadyRegisteredError
+	if errors.As(err, &regErr) {
+		if existing, isOk := regErr.ExistingCollector.(T); isOk {
+			logger.Warn().Err(err).Msg("collector already registered, reusing existing one")
+			return existing
+		}
+	}
+	logger.Error().Err(err).Msg("unable to register collector")
+	return c
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDuplicate(t *testing.T) {
+	opts := prometheus.CounterOpts{Name: "mochi_test_register_total", Help: "test"}
+	first := prometheus.NewCounter(opts)
+	require.Same(t, first, Register(first))
+	defer prometheus.Unregister(first)
+
+	var second prometheus.Counter
+	require.NotPanics(t, func() { second = Register(prometheus.NewCounter(opts)) })
+	require.Same(t, first, second)
+
+	// same name, but different labels: not reusable, not registered
+	vec := prometheus.NewCounterVec(opts, []string{"label"})
+	require.NotPanics(t, func() { require.Same(t, vec, Register(vec)) })
+}
@@ -1,10 +1,12 @@
 // Package metrics implements a standalone HTTP server for serving pprof
-// profiles and Prometheus metrics.
+// profiles and Prometheus metrics, and token-guarded admin server
+// for serving pprof profiles and expvar variables.
 package metrics
 
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/netip"
@@ -35,6 +37,8 @@ func Enabled() bool {
 // endpoint.
 type Server struct {
 	srv *http.Server
+	// listener of admin server
+	ln net.Listener
 }
 
 // AddressFamily returns the label value for reporting the address family of an IP address.
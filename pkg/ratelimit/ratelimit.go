@@ -0,0 +1,56 @@
+// Package ratelimit implements simple fixed window limiter
+// of events count per some key (i.e. client IP address).
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type counter struct {
+	start int64
+	count uint
+}
+
+// Limiter counts events for each key within fixed time window
+// and reports if limit is exceeded. It is safe for concurrent use.
+type Limiter[K comparable] struct {
+	mu        sync.Mutex
+	limit     uint
+	window    int64
+	lastSweep int64
+	counters  map[K]*counter
+}
+
+// New creates Limiter which allows up to limit events
+// for each key within window duration
+func New[K comparable](limit uint, window time.Duration) *Limiter[K] {
+	return &Limiter[K]{
+		limit:    limit,
+		window:   int64(window),
+		counters: make(map[K]*counter),
+	}
+}
+
+// Allow registers event for key and returns false
+// if limit of events for this key within current window exceeded
+func (l *Limiter[K]) Allow(key K, now time.Time) bool {
+	ts := now.UnixNano()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ts-l.lastSweep >= l.window {
+		for k, c := range l.counters {
+			if ts-c.start >= l.window {
+				delete(l.counters, k)
+			}
+		}
+		l.lastSweep = ts
+	}
+	c, exists := l.counters[key]
+	if !exists || ts-c.start >= l.window {
+		c = &counter{start: ts}
+		l.counters[key] = c
+	}
+	c.count++
+	return c.count <= l.limit
+}
@@ -0,0 +1,18 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New[string](2, time.Second)
+	now := time.Now()
+	require.True(t, l.Allow("a", now))
+	require.True(t, l.Allow("a", now))
+	require.False(t, l.Allow("a", now))
+	require.True(t, l.Allow("b", now))
+	require.True(t, l.Allow("a", now.Add(time.Second)))
+}
@@ -0,0 +1,106 @@
+// Package stop implements ordered shutdown of components:
+// components are grouped by stages, stages are stopped sequentially
+// in order of addition, components within one stage - concurrently.
+package stop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+// DefaultTimeout is the default time given to stage to stop
+const DefaultTimeout = 30 * time.Second
+
+// ErrTimeout is returned if stage did not stop within timeout
+var ErrTimeout = errors.New("stop timeout exceeded")
+
+var logger = log.NewLogger("stop")
+
+type stage struct {
+	name    string
+	timeout time.Duration
+	closers []io.Closer
+}
+
+// Group holds stages of components, which should be stopped in order.
+// I.e. frontends should be stopped before middleware and middleware
+// before storage, so storage is not closed while requests are
+// processed.
+type Group struct {
+	stages []stage
+}
+
+// Add appends stage with provided name and closers to the Group.
+// Nil closers are ignored. If timeout is not positive,
+// DefaultTimeout is used.
+func (g *Group) Add(name string, timeout time.Duration, closers ...io.Closer) *Group {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	s := stage{name: name, timeout: timeout, closers: make([]io.Closer, 0, len(closers))}
+	for _, cl := range closers {
+		if cl != nil {
+			s.closers = append(s.closers, cl)
+		}
+	}
+	g.stages = append(g.stages, s)
+	return g
+}
+
+// Stop closes stages sequentially. The next stage is started only when
+// all closers of previous stage returned. If stage did not stop within
+// timeout, the next stages are not stopped, because their components
+// may still be used by the stuck one (i.e. storage by frontend).
+// Returns joined errors of all stopped stages.
+func (g *Group) Stop() error {
+	errs := make([]error, 0, len(g.stages))
+	for i, s := range g.stages {
+		logger.Debug().Str("stage", s.name).Msg("stopping")
+		err := s.stop()
+		logger.Err(err).Str("stage", s.name).Msg("stopped")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+		if errors.Is(err, ErrTimeout) {
+			for _, skipped := range g.stages[i+1:] {
+				logger.Warn().Str("stage", skipped.name).Msg("not stopped because of previous stage timeout")
+			}
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s stage) stop() error {
+	l := len(s.closers)
+	if l == 0 {
+		return nil
+	}
+	errs := make([]error, l)
+	var wg sync.WaitGroup
+	wg.Add(l)
+	for i, cl := range s.closers {
+		go func(i int, cl io.Closer) {
+			defer wg.Done()
+			errs[i] = cl.Close()
+		}(i, cl)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(s.timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return errors.Join(errs...)
+	case <-t.C:
+		return ErrTimeout
+	}
+}
@@ -0,0 +1,66 @@
+package stop
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(e string) {
+	r.Lock()
+	r.events = append(r.events, e)
+	r.Unlock()
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func TestGroupOrder(t *testing.T) {
+	rec := new(recorder)
+	drain := func(name string, d time.Duration) closerFunc {
+		return func() error {
+			time.Sleep(d)
+			rec.add(name)
+			return nil
+		}
+	}
+	errStorage := errors.New("storage error")
+	err := new(Group).
+		Add("frontends", time.Second, drain("frontend1", 20*time.Millisecond), drain("frontend2", 10*time.Millisecond)).
+		Add("middleware", time.Second, drain("logic", 0)).
+		Add("storage", time.Second, nil, closerFunc(func() error {
+			rec.add("storage")
+			return errStorage
+		})).
+		Stop()
+	require.ErrorIs(t, err, errStorage)
+	require.Equal(t, []string{"frontend2", "frontend1", "logic", "storage"}, rec.events)
+}
+
+func TestGroupTimeout(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	var storageStopped bool
+	err := new(Group).
+		Add("frontends", 10*time.Millisecond, closerFunc(func() error {
+			<-stuck
+			return nil
+		})).
+		Add("storage", time.Second, closerFunc(func() error {
+			storageStopped = true
+			return nil
+		})).
+		Stop()
+	require.ErrorIs(t, err, ErrTimeout)
+	// storage may still be used by stuck frontend
+	require.False(t, storageStopped)
+}
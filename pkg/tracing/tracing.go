@@ -0,0 +1,122 @@
+// Package tracing provides optional OpenTelemetry tracing of requests
+// processing. Until Setup (or Use) is called, all spans are no-op
+// and Start does not allocate.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+const (
+	serviceName = "mochi"
+	tracerName  = "github.com/sot-tech/mochi"
+)
+
+// Attribute keys set to spans
+const (
+	AttrAction    = attribute.Key("mochi.action")
+	AttrFrontend  = attribute.Key("mochi.frontend")
+	AttrInfoHash  = attribute.Key("mochi.info_hash")
+	AttrPeerCount = attribute.Key("mochi.peer_count")
+)
+
+var (
+	enabled atomic.Bool
+	tracer  trace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+	noSpan               = trace.SpanFromContext(context.Background())
+)
+
+// Enabled reports if spans are recorded
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Use sets tracer provider to create spans and enables tracing.
+// Nil provider disables tracing.
+// Should be called before frontends start.
+func Use(tp trace.TracerProvider) {
+	if tp == nil {
+		enabled.Store(false)
+		tp = noop.NewTracerProvider()
+	} else {
+		enabled.Store(true)
+	}
+	tracer = tp.Tracer(tracerName)
+}
+
+// Setup creates tracer provider, which exports spans to zipkin-compatible
+// endpoint (i.e. OpenTelemetry collector, Jaeger, Grafana Tempo) and
+// samples sampleRatio of root spans (all spans if ratio is not within (0, 1]).
+// Returned io.Closer flushes pending spans and stops exporter.
+func Setup(endpoint string, sampleRatio float64) (io.Closer, error) {
+	if sampleRatio <= 0 || sampleRatio > 1 {
+		sampleRatio = 1
+	}
+	exp, err := zipkin.New(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create trace exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	Use(tp)
+	return closer{tp}, nil
+}
+
+type closer struct {
+	tp *sdktrace.TracerProvider
+}
+
+func (c closer) Close() error {
+	return c.tp.Shutdown(context.Background())
+}
+
+// Start creates span and context containing it, if tracing is enabled.
+// Otherwise, it returns provided context and no-op span.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !enabled.Load() {
+		return ctx, noSpan
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records error (if any) and ends span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InfoHash returns span attribute of info hash
+func InfoHash(ih bittorrent.InfoHash) attribute.KeyValue {
+	return AttrInfoHash.String(ih.String())
+}
+
+// Remap returns context with span from source context,
+// used to link background processing with request span
+func Remap(src, dst context.Context) context.Context {
+	if !enabled.Load() {
+		return dst
+	}
+	return trace.ContextWithSpanContext(dst, trace.SpanContextFromContext(src))
+}
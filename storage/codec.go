@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+const (
+	// GobCodecName is the name of gob encoded StorageCodec
+	GobCodecName = "gob"
+	// JSONCodecName is the name of JSON encoded StorageCodec
+	JSONCodecName = "json"
+	// BinaryCodecName is the name of compact binary StorageCodec
+	BinaryCodecName = "binary"
+
+	codecMagic = "MOCHIPEERS"
+)
+
+var (
+	codecsMU sync.RWMutex
+	codecs   = make(map[string]StorageCodec)
+
+	// ErrInvalidCodecHeader returned from Decode if provided data
+	// does not start with valid header
+	ErrInvalidCodecHeader = errors.New("invalid peer records header")
+)
+
+func init() {
+	RegisterCodec(GobCodecName, gobCodec{})
+	RegisterCodec(JSONCodecName, jsonCodec{})
+	RegisterCodec(BinaryCodecName, binaryCodec{})
+}
+
+// PeerRecord is the single peer of swarm
+// used for exporting and importing storage data
+type PeerRecord struct {
+	InfoHash bittorrent.InfoHash
+	Peer     bittorrent.Peer
+	Seeder   bool
+}
+
+// StorageCodec encodes and decodes PeerRecord-s
+// into (from) specific format
+type StorageCodec interface {
+	// Encode writes records into w
+	Encode(w io.Writer, records []PeerRecord) error
+	// Decode reads all records from r
+	Decode(r io.Reader) ([]PeerRecord, error)
+}
+
+// RegisterCodec makes a StorageCodec available by the provided name.
+//
+// If called twice with the same name, the name is blank or longer than 255 bytes,
+// or if the provided StorageCodec is nil, this function panics.
+func RegisterCodec(name string, c StorageCodec) {
+	if name == "" || len(name) > 0xFF {
+		panic("storage: could not register a StorageCodec with an empty or too long name")
+	}
+	if c == nil {
+		panic("storage: could not register a nil StorageCodec")
+	}
+
+	codecsMU.Lock()
+	defer codecsMU.Unlock()
+
+	if _, dup := codecs[name]; dup {
+		panic("storage: RegisterCodec called twice for " + name)
+	}
+
+	codecs[name] = c
+}
+
+func getCodec(name string) (c StorageCodec, err error) {
+	codecsMU.RLock()
+	defer codecsMU.RUnlock()
+	var ok bool
+	if c, ok = codecs[name]; !ok {
+		err = fmt.Errorf("storage codec with name '%s' does not exists", name)
+	}
+	return
+}
+
+// EncodeRecords writes header with codec name and records
+// encoded by StorageCodec registered with provided name into w
+func EncodeRecords(w io.Writer, codecName string, records []PeerRecord) (err error) {
+	var c StorageCodec
+	if c, err = getCodec(codecName); err == nil {
+		header := make([]byte, 0, len(codecMagic)+1+len(codecName))
+		header = append(header, codecMagic...)
+		header = append(header, byte(len(codecName)))
+		header = append(header, codecName...)
+		if _, err = w.Write(header); err == nil {
+			err = c.Encode(w, records)
+		}
+	}
+	return
+}
+
+// DecodeRecords reads header from r, detects format and
+// decodes records with appropriate StorageCodec
+func DecodeRecords(r io.Reader) (records []PeerRecord, err error) {
+	header := make([]byte, len(codecMagic)+1)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	if string(header[:len(codecMagic)]) != codecMagic {
+		return nil, ErrInvalidCodecHeader
+	}
+	name := make([]byte, header[len(codecMagic)])
+	if _, err = io.ReadFull(r, name); err != nil {
+		return
+	}
+	var c StorageCodec
+	if c, err = getCodec(string(name)); err == nil {
+		records, err = c.Decode(r)
+	}
+	return
+}
+
+// gobRecord is the gob representation of PeerRecord.
+// Note: bittorrent.Peer can not be encoded directly because
+// it inherits netip.AddrPort's MarshalBinary, which drops PeerID
+type gobRecord struct {
+	InfoHash string
+	PeerID   bittorrent.PeerID
+	Address  netip.AddrPort
+	Seeder   bool
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(w io.Writer, records []PeerRecord) error {
+	out := make([]gobRecord, len(records))
+	for i, r := range records {
+		out[i] = gobRecord{
+			InfoHash: string(r.InfoHash),
+			PeerID:   r.Peer.ID,
+			Address:  r.Peer.AddrPort,
+			Seeder:   r.Seeder,
+		}
+	}
+	return gob.NewEncoder(w).Encode(out)
+}
+
+func (gobCodec) Decode(r io.Reader) (records []PeerRecord, err error) {
+	var in []gobRecord
+	if err = gob.NewDecoder(r).Decode(&in); err == nil {
+		records = make([]PeerRecord, 0, len(in))
+		for _, gr := range in {
+			var ih bittorrent.InfoHash
+			if ih, err = bittorrent.NewInfoHashString(gr.InfoHash); err != nil {
+				break
+			}
+			records = append(records, PeerRecord{
+				InfoHash: ih,
+				Peer:     bittorrent.Peer{ID: gr.PeerID, AddrPort: gr.Address},
+				Seeder:   gr.Seeder,
+			})
+		}
+	}
+	return
+}
+
+// jsonRecord is the JSON representation of PeerRecord
+// with hex encoded binary fields
+type jsonRecord struct {
+	InfoHash string         `json:"info_hash"`
+	PeerID   string         `json:"peer_id"`
+	Address  netip.AddrPort `json:"address"`
+	Seeder   bool           `json:"seeder"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, records []PeerRecord) error {
+	out := make([]jsonRecord, len(records))
+	for i, r := range records {
+		out[i] = jsonRecord{
+			InfoHash: hex.EncodeToString([]byte(r.InfoHash)),
+			PeerID:   hex.EncodeToString(r.Peer.ID.Bytes()),
+			Address:  r.Peer.AddrPort,
+			Seeder:   r.Seeder,
+		}
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+func (jsonCodec) Decode(r io.Reader) (records []PeerRecord, err error) {
+	var in []jsonRecord
+	if err = json.NewDecoder(r).Decode(&in); err != nil {
+		return
+	}
+	records = make([]PeerRecord, 0, len(in))
+	for _, jr := range in {
+		var b []byte
+		var rec PeerRecord
+		if b, err = hex.DecodeString(jr.InfoHash); err != nil {
+			break
+		}
+		if rec.InfoHash, err = bittorrent.NewInfoHash(b); err != nil {
+			break
+		}
+		if b, err = hex.DecodeString(jr.PeerID); err != nil {
+			break
+		}
+		if rec.Peer.ID, err = bittorrent.NewPeerID(b); err != nil {
+			break
+		}
+		rec.Peer.AddrPort, rec.Seeder = jr.Address, jr.Seeder
+		records = append(records, rec)
+	}
+	return
+}
+
+const (
+	binSeederFlag = 0b01
+	binV6Flag     = 0b10
+)
+
+// binaryCodec writes records as
+// Flags[1by]InfoHashLen[1by]InfoHash[20/32by]PeerID[20by]Port[2by]IP[4/16by]
+type binaryCodec struct{}
+
+func (binaryCodec) Encode(w io.Writer, records []PeerRecord) (err error) {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 0, 2+bittorrent.InfoHashV2Len+bittorrent.PeerIDLen+2+16)
+	for _, r := range records {
+		var flags byte
+		if r.Seeder {
+			flags |= binSeederFlag
+		}
+		addr := r.Peer.Addr().Unmap()
+		if addr.Is6() {
+			flags |= binV6Flag
+		}
+		buf = append(buf[:0], flags, byte(len(r.InfoHash)))
+		buf = append(buf, r.InfoHash...)
+		buf = append(buf, r.Peer.ID.Bytes()...)
+		buf = binary.BigEndian.AppendUint16(buf, r.Peer.Port())
+		buf = append(buf, addr.AsSlice()...)
+		if _, err = bw.Write(buf); err != nil {
+			return
+		}
+	}
+	return bw.Flush()
+}
+
+func (binaryCodec) Decode(r io.Reader) (records []PeerRecord, err error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, 2)
+	for {
+		if _, err = io.ReadFull(br, head); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			break
+		}
+		ipLen := 4
+		if head[0]&binV6Flag != 0 {
+			ipLen = 16
+		}
+		data := make([]byte, int(head[1])+bittorrent.PeerIDLen+2+ipLen)
+		if _, err = io.ReadFull(br, data); err != nil {
+			break
+		}
+		var rec PeerRecord
+		ihLen := int(head[1])
+		if rec.InfoHash, err = bittorrent.NewInfoHash(data[:ihLen]); err != nil {
+			break
+		}
+		data = data[ihLen:]
+		if rec.Peer.ID, err = bittorrent.NewPeerID(data[:bittorrent.PeerIDLen]); err != nil {
+			break
+		}
+		data = data[bittorrent.PeerIDLen:]
+		addr, _ := netip.AddrFromSlice(data[2:])
+		rec.Peer.AddrPort = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(data[:2]))
+		rec.Seeder = head[0]&binSeederFlag != 0
+		records = append(records, rec)
+	}
+	return
+}
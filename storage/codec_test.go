@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	ih1, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	ih2, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	records := []PeerRecord{
+		{
+			InfoHash: ih1,
+			Peer:     bittorrent.Peer{ID: bittorrent.PeerID{1, 2, 3}, AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")},
+			Seeder:   true,
+		},
+		{
+			InfoHash: ih2,
+			Peer:     bittorrent.Peer{ID: bittorrent.PeerID{4, 5, 6}, AddrPort: netip.MustParseAddrPort("[2001:db8::1]:51413")},
+		},
+	}
+	for _, name := range []string{GobCodecName, JSONCodecName, BinaryCodecName} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.Nil(t, EncodeRecords(&buf, name, records))
+			decoded, err := DecodeRecords(&buf)
+			require.Nil(t, err)
+			require.Equal(t, records, decoded)
+		})
+	}
+}
+
+func TestCodecInvalidHeader(t *testing.T) {
+	_, err := DecodeRecords(bytes.NewReader([]byte("NOT A VALID HEADER")))
+	require.ErrorIs(t, err, ErrInvalidCodecHeader)
+}
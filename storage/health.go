@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// GCHealthGate checks if storage is available before GC cycle,
+// so GC skips cycles while storage is unhealthy (i.e. reconnecting)
+// instead of flooding log with errors of each command.
+// Not safe for concurrent use, should be owned by GC routine.
+type GCHealthGate struct {
+	// Pinger checks storage availability, usually it is storage itself
+	Pinger interface {
+		Ping(ctx context.Context) error
+	}
+	// Timeout of availability check
+	Timeout time.Duration
+	down    bool
+}
+
+// Allow pings storage and reports if GC cycle should run.
+// Transitions between healthy and unhealthy states are logged once.
+func (g *GCHealthGate) Allow() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), g.Timeout)
+	err := g.Pinger.Ping(ctx)
+	cancel()
+	switch {
+	case err != nil && !g.down:
+		g.down = true
+		logger.Warn().Err(err).Msg("storage unavailable, skipping GC until it recovers")
+	case err != nil:
+		logger.Debug().Err(err).Msg("storage is still unavailable, GC skipped")
+	case g.down:
+		g.down = false
+		logger.Info().Msg("storage available, resuming GC")
+	}
+	if err != nil {
+		PromGCSkippedTotal.Inc()
+	}
+	return err == nil
+}
@@ -12,6 +12,8 @@ package keydb
 import (
 	"context"
 	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/redis/go-redis/v9"
 
@@ -77,7 +79,11 @@ func newStore(cfg r.Config) (*store, error) {
 
 	var st *store
 	if err == nil {
-		st = &store{Connection: rs, peerTTL: uint(cfg.PeerLifetime.Seconds())}
+		st = &store{
+			Connection:    rs,
+			peerTTL:       uint(cfg.PeerLifetime.Seconds()),
+			purgeResetsDL: cfg.PurgeResetsDownloads,
+		}
 	}
 
 	return st, err
@@ -85,7 +91,8 @@ func newStore(cfg r.Config) (*store, error) {
 
 type store struct {
 	r.Connection
-	peerTTL uint
+	peerTTL       uint
+	purgeResetsDL bool
 }
 
 func (s *store) addPeer(ctx context.Context, infoHashKey, peerID string) (err error) {
@@ -114,19 +121,19 @@ func (s *store) delPeer(ctx context.Context, infoHashKey, peerID string) error {
 }
 
 func (s *store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return s.addPeer(ctx, r.InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), r.PackPeer(peer))
+	return s.addPeer(ctx, s.InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), r.PackPeer(peer))
 }
 
 func (s *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return s.delPeer(ctx, r.InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), r.PackPeer(peer))
+	return s.delPeer(ctx, s.InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), r.PackPeer(peer))
 }
 
 func (s *store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return s.addPeer(ctx, r.InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), r.PackPeer(peer))
+	return s.addPeer(ctx, s.InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), r.PackPeer(peer))
 }
 
 func (s *store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return s.delPeer(ctx, r.InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), r.PackPeer(peer))
+	return s.delPeer(ctx, s.InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), r.PackPeer(peer))
 }
 
 func (s *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
@@ -135,8 +142,8 @@ func (s *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pee
 		Object("peer", peer).
 		Msg("graduate leecher")
 	infoHash, peerID := ih.RawString(), r.PackPeer(peer)
-	ihSeederKey := r.InfoHashKey(infoHash, true, peer.Addr().Is6())
-	ihLeecherKey := r.InfoHashKey(infoHash, false, peer.Addr().Is6())
+	ihSeederKey := s.InfoHashKey(infoHash, true, peer.Addr().Is6())
+	ihLeecherKey := s.InfoHashKey(infoHash, false, peer.Addr().Is6())
 	var moved bool
 	if moved, err = s.SMove(ctx, ihLeecherKey, ihSeederKey, peerID).Result(); err == nil {
 		if !moved {
@@ -144,7 +151,7 @@ func (s *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pee
 		}
 		if err != nil {
 			if err = s.Process(ctx, redis.NewCmd(ctx, expireMemberCmd, ihSeederKey, peerID, s.peerTTL)); err == nil {
-				err = s.HIncrBy(ctx, r.CountDownloadsKey, infoHash, 1).Err()
+				err = s.HIncrBy(ctx, s.CountDownloadsKey, infoHash, 1).Err()
 			}
 		}
 	}
@@ -172,3 +179,83 @@ func (s *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32
 		Msg("scrape swarm")
 	return s.ScrapeIH(ctx, ih, s.SCard)
 }
+
+// PeerExists is the same function as redis.PeerExists except `SIsMember` call instead of `HExists`
+func (s *store) PeerExists(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (bool, error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Object("peer", peer).
+		Bool("seeder", seeder).
+		Msg("peer exists")
+	exists, err := s.SIsMember(ctx, s.InfoHashKey(ih.RawString(), seeder, peer.Addr().Is6()), r.PackPeer(peer)).Result()
+	return exists, r.NoResultErr(err)
+}
+
+// PurgeSwarm deletes seeders and leechers sets of info hash
+// and download count (if redis.Config.PurgeResetsDownloads set)
+// in one transaction
+func (s *store) PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash) error {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Msg("purge swarm")
+	infoHash := ih.RawString()
+	_, err := s.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		for _, seeder := range []bool{true, false} {
+			tx.Del(ctx, s.InfoHashKey(infoHash, seeder, false))
+			tx.Del(ctx, s.InfoHashKey(infoHash, seeder, true))
+		}
+		if s.purgeResetsDL {
+			tx.HDel(ctx, s.CountDownloadsKey, infoHash)
+		}
+		return nil
+	})
+	return r.NoResultErr(err)
+}
+
+// globEscaper escapes special characters of SCAN MATCH pattern
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// infoHashKeysPattern returns pattern, which matches seeders
+// and leechers keys of all info hashes
+func (s *store) infoHashKeysPattern() string {
+	return globEscaper.Replace(s.PrefixKey) + "[SL][46]_*"
+}
+
+// InfoHashes is the same function as redis.InfoHashes, but because KeyDB
+// storage does not hold info hashes sets, keys are iterated with SCAN.
+// Cursor is the SCAN cursor. Note, that in cluster mode only keys of
+// one node are iterated.
+func (s *store) InfoHashes(ctx context.Context, cursor string, limit int) (infoHashes []bittorrent.InfoHash, nextCursor string, err error) {
+	logger.Trace().
+		Str("cursor", cursor).
+		Int("limit", limit).
+		Msg("info hashes")
+	var scanCursor uint64
+	if len(cursor) > 0 {
+		if scanCursor, err = strconv.ParseUint(cursor, 10, 64); err != nil || scanCursor == 0 {
+			return nil, "", storage.ErrInvalidCursor
+		}
+	}
+	if limit <= 0 {
+		limit = storage.DefaultInfoHashesLimit
+	}
+	for len(infoHashes) < limit {
+		var infoHashKeys []string
+		var page []bittorrent.InfoHash
+		infoHashKeys, scanCursor, err = s.Scan(ctx, scanCursor, s.infoHashKeysPattern(), int64(limit-len(infoHashes))).Result()
+		if err = r.NoResultErr(err); err != nil {
+			return nil, "", err
+		}
+		if page, err = s.UniqueInfoHashes(ctx, infoHashKeys); err != nil {
+			return nil, "", err
+		}
+		infoHashes = append(infoHashes, page...)
+		if scanCursor == 0 {
+			break
+		}
+	}
+	if scanCursor > 0 {
+		nextCursor = strconv.FormatUint(scanCursor, 10)
+	}
+	return
+}
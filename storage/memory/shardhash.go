@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// Names of shard hash functions provided by the package
+const (
+	// PrefixShardHash takes the first 4 bytes of info hash,
+	// which are already uniformly distributed for real torrents
+	PrefixShardHash = "prefix"
+	// FNVShardHash is FNV-1a 64-bit hash of the whole info hash
+	FNVShardHash = "fnv"
+	// XXHashShardHash is xxHash64 of the whole info hash
+	XXHashShardHash = "xxhash"
+)
+
+// ShardHash calculates value, by which shard of info hash is selected
+type ShardHash func(ih bittorrent.InfoHash) uint64
+
+var (
+	shardHashesMU sync.RWMutex
+	shardHashes   = make(map[string]ShardHash)
+)
+
+func init() {
+	RegisterShardHash(PrefixShardHash, prefixShardHash)
+	RegisterShardHash(FNVShardHash, fnvShardHash)
+	RegisterShardHash(XXHashShardHash, xxShardHash)
+}
+
+// RegisterShardHash makes a ShardHash available by the provided name.
+//
+// If called twice with the same name, the name is blank,
+// or if the provided ShardHash is nil, this function panics.
+func RegisterShardHash(name string, h ShardHash) {
+	if name == "" {
+		panic("memory: could not register a ShardHash with an empty name")
+	}
+	if h == nil {
+		panic("memory: could not register a nil ShardHash")
+	}
+
+	shardHashesMU.Lock()
+	defer shardHashesMU.Unlock()
+
+	if _, dup := shardHashes[name]; dup {
+		panic("memory: RegisterShardHash called twice for " + name)
+	}
+
+	shardHashes[name] = h
+}
+
+func getShardHash(name string) (h ShardHash, err error) {
+	shardHashesMU.RLock()
+	defer shardHashesMU.RUnlock()
+	var ok bool
+	if h, ok = shardHashes[name]; !ok {
+		err = fmt.Errorf("shard hash with name '%s' does not exists", name)
+	}
+	return
+}
+
+func prefixShardHash(ih bittorrent.InfoHash) uint64 {
+	return uint64(binary.BigEndian.Uint32(ih.Bytes()[:4]))
+}
+
+func fnvShardHash(ih bittorrent.InfoHash) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(ih.Bytes())
+	return h.Sum64()
+}
+
+func xxShardHash(ih bittorrent.InfoHash) uint64 {
+	return xxhash.Sum64String(ih.RawString())
+}
@@ -0,0 +1,117 @@
+package memory
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+const (
+	testShardCount = 1024
+	testHashCount  = 100_000
+)
+
+// realisticInfoHashes returns set of v1, v2 and truncated v2 hashes
+// of pseudo-random payloads, like real torrents' info hashes.
+func realisticInfoHashes() (ihs []bittorrent.InfoHash) {
+	var data [8]byte
+	for i := range testHashCount {
+		binary.BigEndian.PutUint64(data[:], uint64(i))
+		var ih bittorrent.InfoHash
+		switch i % 3 {
+		case 0:
+			h := sha1.Sum(data[:])
+			ih, _ = bittorrent.NewInfoHash(h[:])
+		case 1:
+			h := sha256.Sum256(data[:])
+			ih, _ = bittorrent.NewInfoHash(h[:])
+		default:
+			h := sha256.Sum256(data[:])
+			ih, _ = bittorrent.NewInfoHash(h[:])
+			ih = ih.TruncateV1()
+		}
+		ihs = append(ihs, ih)
+	}
+	return
+}
+
+// clusteredInfoHashes returns set of hashes, which differ only
+// in the tail bytes (i.e. generated by a test client or crafted).
+func clusteredInfoHashes() (ihs []bittorrent.InfoHash) {
+	var data [bittorrent.InfoHashV1Len]byte
+	copy(data[:], "mochi")
+	for i := range testHashCount {
+		binary.BigEndian.PutUint64(data[len(data)-8:], uint64(i))
+		ih, _ := bittorrent.NewInfoHash(data[:])
+		ihs = append(ihs, ih)
+	}
+	return
+}
+
+// chiSquare returns normalized chi-squared statistic of info hashes
+// distribution over shards. Value close to 1 means uniform distribution.
+func chiSquare(h ShardHash, ihs []bittorrent.InfoHash) float64 {
+	buckets := make([]int, testShardCount)
+	for _, ih := range ihs {
+		buckets[h(ih)%testShardCount]++
+	}
+	expected := float64(len(ihs)) / testShardCount
+	var chi float64
+	for _, n := range buckets {
+		d := float64(n) - expected
+		chi += d * d / expected
+	}
+	return chi / (testShardCount - 1)
+}
+
+func TestShardHashDistribution(t *testing.T) {
+	realistic, clustered := realisticInfoHashes(), clusteredInfoHashes()
+	for _, name := range []string{PrefixShardHash, FNVShardHash, XXHashShardHash} {
+		h, err := getShardHash(name)
+		require.Nil(t, err)
+		chi := chiSquare(h, realistic)
+		t.Logf("%s: realistic: %.3f", name, chi)
+		require.Less(t, chi, 1.3, name)
+
+		chi = chiSquare(h, clustered)
+		t.Logf("%s: clustered: %.3f", name, chi)
+		if name == PrefixShardHash {
+			// all hashes have the same prefix, so got into the single shard
+			require.Greater(t, chi, 1.3, name)
+		} else {
+			require.Less(t, chi, 1.3, name)
+		}
+	}
+}
+
+func TestShardHashConfig(t *testing.T) {
+	require.Equal(t, PrefixShardHash, Config{}.Validate().ShardHash)
+
+	_, err := NewPeerStorage(Config{ShardHash: "unknown"})
+	require.NotNil(t, err)
+
+	ps, err := NewPeerStorage(Config{ShardHash: XXHashShardHash})
+	require.Nil(t, err)
+	require.Nil(t, ps.Close())
+
+	require.Panics(t, func() { RegisterShardHash(FNVShardHash, fnvShardHash) })
+	require.Panics(t, func() { RegisterShardHash("", fnvShardHash) })
+	require.Panics(t, func() { RegisterShardHash("nil", nil) })
+}
+
+func BenchmarkShardHash(b *testing.B) {
+	ihs := realisticInfoHashes()
+	for _, name := range []string{PrefixShardHash, FNVShardHash, XXHashShardHash} {
+		h, _ := getShardHash(name)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = h(ihs[i%len(ihs)])
+			}
+		})
+	}
+}
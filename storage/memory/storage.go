@@ -3,10 +3,13 @@
 package memory
 
 import (
+	"cmp"
+	"container/heap"
 	"context"
-	"encoding/binary"
 	"math"
+	"net/netip"
 	"runtime"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -46,6 +49,19 @@ func builder(icfg conf.MapConfig) (storage.PeerStorage, error) {
 // Config holds the configuration of a memory PeerStorage.
 type Config struct {
 	ShardCount int `cfg:"shard_count"`
+	// DedupePeerID makes storage treat announces with the same PeerID
+	// but different address of the same family (i.e. changed IP or port
+	// of client) as the same peer: previous address is replaced with
+	// the new one. Addresses of different families (IPv4 and IPv6
+	// of dual-stack client) are stored independently
+	DedupePeerID bool `cfg:"dedupe_peer_id"`
+	// PreferActivePeers makes storage remember which peers re-announced
+	// after the first announce and return them before peers, which
+	// announced only once (i.e. sent `started` and likely gone)
+	PreferActivePeers bool `cfg:"prefer_active_peers"`
+	// ShardHash is the name of registered hash function,
+	// which selects shard for info hash (see RegisterShardHash)
+	ShardHash string `cfg:"shard_hash"`
 }
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -64,20 +80,40 @@ func (cfg Config) Validate() Config {
 			Msg("falling back to default configuration")
 	}
 
+	if len(cfg.ShardHash) == 0 {
+		validcfg.ShardHash = PrefixShardHash
+		logger.Warn().
+			Str("name", "ShardHash").
+			Str("provided", cfg.ShardHash).
+			Str("default", validcfg.ShardHash).
+			Msg("falling back to default configuration")
+	}
+
 	return validcfg
 }
 
 // NewPeerStorage creates a new PeerStorage backed by memory.
 func NewPeerStorage(provided Config) (storage.PeerStorage, error) {
 	cfg := provided.Validate()
+	shardHash, err := getShardHash(cfg.ShardHash)
+	if err != nil {
+		return nil, err
+	}
 	ps := &peerStore{
 		shards:      make([]*peerShard, cfg.ShardCount*2),
+		shardHash:   shardHash,
 		DataStorage: NewDataStorage(),
 		closed:      make(chan any),
 	}
 
 	for i := 0; i < cfg.ShardCount*2; i++ {
-		ps.shards[i] = &peerShard{swarms: &ihSwarm{m: make(map[bittorrent.InfoHash]swarm)}}
+		ps.shards[i] = &peerShard{swarms: &ihSwarm{
+			m:           make(map[bittorrent.InfoHash]swarm),
+			trackActive: cfg.PreferActivePeers,
+		}}
+		if cfg.DedupePeerID {
+			ps.shards[i].ids = &peerIDIndex{m: make(map[peerIDKey]bittorrent.Peer)}
+		}
 	}
 
 	return ps, nil
@@ -85,12 +121,15 @@ func NewPeerStorage(provided Config) (storage.PeerStorage, error) {
 
 type peerShard struct {
 	swarms      *ihSwarm
+	ids         *peerIDIndex
 	numSeeders  atomic.Uint64
 	numLeechers atomic.Uint64
 }
 
 type ihSwarm struct {
 	m map[bittorrent.InfoHash]swarm
+	// trackActive enables tracking of active peers in created swarms
+	trackActive bool
 	sync.RWMutex
 }
 
@@ -107,8 +146,8 @@ func (p *ihSwarm) getOrCreate(k bittorrent.InfoHash) (v swarm) {
 		p.Lock()
 		if v, ok = p.m[k]; !ok {
 			v = swarm{
-				seeders:  &peers{m: make(map[bittorrent.Peer]int64)},
-				leechers: &peers{m: make(map[bittorrent.Peer]int64)},
+				seeders:  newPeers(p.trackActive),
+				leechers: newPeers(p.trackActive),
 			}
 			p.m[k] = v
 		}
@@ -126,6 +165,16 @@ func (p *ihSwarm) del(k bittorrent.InfoHash) (ok bool) {
 	return
 }
 
+// pop deletes swarm and returns it
+func (p *ihSwarm) pop(k bittorrent.InfoHash) (v swarm, ok bool) {
+	p.Lock()
+	if v, ok = p.m[k]; ok {
+		delete(p.m, k)
+	}
+	p.Unlock()
+	return
+}
+
 func (p *ihSwarm) len() int {
 	return len(p.m)
 }
@@ -140,6 +189,38 @@ func (p *ihSwarm) keys(fn func(k bittorrent.InfoHash) bool) {
 	p.RUnlock()
 }
 
+type peerIDKey struct {
+	ih bittorrent.InfoHash
+	id bittorrent.PeerID
+}
+
+// peerIDIndex holds the last known address of PeerID in swarm
+type peerIDIndex struct {
+	m map[peerIDKey]bittorrent.Peer
+	sync.Mutex
+}
+
+// swap stores p as the last known peer and returns previous
+// one if it has different address
+func (p *peerIDIndex) swap(ih bittorrent.InfoHash, peer bittorrent.Peer) (prev bittorrent.Peer, replaced bool) {
+	k := peerIDKey{ih, peer.ID}
+	p.Lock()
+	prev, replaced = p.m[k]
+	p.m[k] = peer
+	p.Unlock()
+	return prev, replaced && prev != peer
+}
+
+// forget deletes peer from index if it is the last known one
+func (p *peerIDIndex) forget(ih bittorrent.InfoHash, peer bittorrent.Peer) {
+	k := peerIDKey{ih, peer.ID}
+	p.Lock()
+	if prev, ok := p.m[k]; ok && prev == peer {
+		delete(p.m, k)
+	}
+	p.Unlock()
+}
+
 type swarm struct {
 	// map serialized peer to mtime
 	seeders  *peers
@@ -148,9 +229,22 @@ type swarm struct {
 
 type peers struct {
 	m map[bittorrent.Peer]int64
+	// active holds peers, which were set more than once,
+	// nil if not tracked
+	active map[bittorrent.Peer]struct{}
+	// byIP holds number of peers with the same IP address
+	byIP map[netip.Addr]uint32
 	sync.RWMutex
 }
 
+func newPeers(trackActive bool) *peers {
+	p := &peers{m: make(map[bittorrent.Peer]int64), byIP: make(map[netip.Addr]uint32)}
+	if trackActive {
+		p.active = make(map[bittorrent.Peer]struct{})
+	}
+	return p
+}
+
 func (p *peers) get(k bittorrent.Peer) (v int64, ok bool) {
 	p.RLock()
 	v, ok = p.m[k]
@@ -159,35 +253,139 @@ func (p *peers) get(k bittorrent.Peer) (v int64, ok bool) {
 }
 
 func (p *peers) set(k bittorrent.Peer, v int64) {
+	p.setActive(k, v, false)
+}
+
+// setActive sets mtime of peer and marks it as active if it
+// already exists or active is true
+func (p *peers) setActive(k bittorrent.Peer, v int64, active bool) {
 	p.Lock()
+	_, exists := p.m[k]
+	if p.active != nil && (exists || active) {
+		p.active[k] = struct{}{}
+	}
+	if !exists {
+		p.byIP[k.Addr()]++
+	}
 	p.m[k] = v
 	p.Unlock()
 }
 
+// remove deletes peer from all maps, must be called with lock held
+func (p *peers) remove(k bittorrent.Peer) {
+	delete(p.m, k)
+	delete(p.active, k)
+	ip := k.Addr()
+	if n := p.byIP[ip]; n > 1 {
+		p.byIP[ip] = n - 1
+	} else {
+		delete(p.byIP, ip)
+	}
+}
+
 func (p *peers) del(k bittorrent.Peer) (ok bool) {
 	p.Lock()
 	if _, ok = p.m[k]; ok {
-		delete(p.m, k)
+		p.remove(k)
+	}
+	p.Unlock()
+	return
+}
+
+// delID deletes all peers with provided PeerID and returns them
+func (p *peers) delID(id bittorrent.PeerID) (deleted []bittorrent.Peer) {
+	p.Lock()
+	for k := range p.m {
+		if k.ID == id {
+			p.remove(k)
+			deleted = append(deleted, k)
+		}
 	}
 	p.Unlock()
 	return
 }
 
+// clear deletes all peers and returns them
+func (p *peers) clear() (deleted []bittorrent.Peer) {
+	p.Lock()
+	deleted = make([]bittorrent.Peer, 0, len(p.m))
+	for k := range p.m {
+		deleted = append(deleted, k)
+	}
+	clear(p.m)
+	clear(p.active)
+	clear(p.byIP)
+	p.Unlock()
+	return
+}
+
+// countIP returns number of peers with provided IP address
+func (p *peers) countIP(ip netip.Addr) uint32 {
+	p.RLock()
+	defer p.RUnlock()
+	return p.byIP[ip]
+}
+
 func (p *peers) len() int {
 	return len(p.m)
 }
 
+// keys calls fn for each peer until it returns false.
+// If active peers are tracked, they are iterated first.
 func (p *peers) keys(fn func(k bittorrent.Peer) bool) bool {
 	p.RLock()
 	defer p.RUnlock()
-	for k := range p.m {
+	if p.active == nil {
+		for k := range p.m {
+			if !fn(k) {
+				return false
+			}
+		}
+		return true
+	}
+	for k := range p.active {
 		if !fn(k) {
 			return false
 		}
 	}
+	for k := range p.m {
+		if _, active := p.active[k]; !active && !fn(k) {
+			return false
+		}
+	}
 	return true
 }
 
+// ranked appends to out up to n peers with the lowest storage.PeerRank
+// for provided seed. If active peers are tracked, they are ranked first.
+func (p *peers) ranked(seed uint64, n int, out []bittorrent.Peer) []bittorrent.Peer {
+	type rankedPeer struct {
+		inactive bool
+		rank     uint64
+		peer     bittorrent.Peer
+	}
+	p.RLock()
+	rr := make([]rankedPeer, 0, len(p.m))
+	for k := range p.m {
+		_, active := p.active[k]
+		rr = append(rr, rankedPeer{p.active != nil && !active, storage.PeerRank(seed, k), k})
+	}
+	p.RUnlock()
+	slices.SortFunc(rr, func(a, b rankedPeer) int {
+		if a.inactive != b.inactive {
+			if a.inactive {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.rank, b.rank)
+	})
+	for _, r := range rr[:min(n, len(rr))] {
+		out = append(out, r.peer)
+	}
+	return out
+}
+
 func (p *peers) forEach(fn func(k bittorrent.Peer, v int64) bool) {
 	p.RLock()
 	for k, v := range p.m {
@@ -200,7 +398,8 @@ func (p *peers) forEach(fn func(k bittorrent.Peer, v int64) bool) {
 
 type peerStore struct {
 	storage.DataStorage
-	shards []*peerShard
+	shards    []*peerShard
+	shardHash ShardHash
 
 	closed     chan any
 	wg         sync.WaitGroup
@@ -227,6 +426,8 @@ func (ps *peerStore) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 				duration := time.Since(start)
 				logger.Debug().Dur("timeTaken", duration).Msg("gc complete")
 				storage.PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
+				storage.PromLastGCTimestamp.SetToCurrentTime()
+				t.Reset(gcInterval)
 			}
 		}
 	}()
@@ -258,6 +459,7 @@ func (ps *peerStore) ScheduleStatisticsCollection(reportInterval time.Duration)
 					storage.PromInfoHashesCount.Set(float64(numInfoHashes))
 					storage.PromSeedersCount.Set(float64(numSeeders))
 					storage.PromLeechersCount.Set(float64(numLeechers))
+					storage.PromLastStatsTimestamp.SetToCurrentTime()
 					logger.Debug().TimeDiff("timeTaken", time.Now(), before).Msg("populate prom complete")
 				}
 			}
@@ -269,13 +471,52 @@ func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, v6 bool) uint32 {
 	// There are twice the amount of shards specified by the user, the first
 	// half is dedicated to IPv4 swarms and the second half is dedicated to
 	// IPv6 swarms.
-	idx := binary.BigEndian.Uint32(infoHash.Bytes()[:4]) % (uint32(len(ps.shards)) / 2)
+	idx := uint32(ps.shardHash(infoHash) % uint64(len(ps.shards)/2))
 	if v6 {
 		idx += uint32(len(ps.shards) / 2)
 	}
 	return idx
 }
 
+// idIndex returns PeerID index for provided info hash and peer
+// address family or nil if deduplication is disabled
+func (ps *peerStore) idIndex(ih bittorrent.InfoHash, v6 bool) *peerIDIndex {
+	return ps.shards[ps.shardIndex(ih, v6)].ids
+}
+
+// dedupe removes previous peer with the same PeerID, but different
+// address of the same family, if deduplication is enabled
+func (ps *peerStore) dedupe(ih bittorrent.InfoHash, p bittorrent.Peer) {
+	v6 := p.Addr().Is6()
+	idx := ps.idIndex(ih, v6)
+	if idx == nil {
+		return
+	}
+	if prev, replaced := idx.swap(ih, p); replaced {
+		logger.Trace().
+			Stringer("infoHash", ih).
+			Object("previous", prev).
+			Object("peer", p).
+			Msg("replacing peer address")
+		sh := ps.shards[ps.shardIndex(ih, v6)]
+		if sw, ok := sh.swarms.get(ih); ok {
+			if sw.seeders.del(prev) {
+				sh.numSeeders.Add(decrUint64)
+			}
+			if sw.leechers.del(prev) {
+				sh.numLeechers.Add(decrUint64)
+			}
+		}
+	}
+}
+
+// forget removes peer from PeerID index if deduplication is enabled
+func (ps *peerStore) forget(ih bittorrent.InfoHash, p bittorrent.Peer) {
+	if idx := ps.idIndex(ih, p.Addr().Is6()); idx != nil {
+		idx.forget(ih, p)
+	}
+}
+
 func (ps *peerStore) PutSeeder(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
@@ -287,6 +528,7 @@ func (ps *peerStore) PutSeeder(_ context.Context, ih bittorrent.InfoHash, p bitt
 		Object("peer", p).
 		Msg("put seeder")
 
+	ps.dedupe(ih, p)
 	sh := ps.shards[ps.shardIndex(ih, p.Addr().Is6())]
 	sw := sh.swarms.getOrCreate(ih)
 
@@ -314,6 +556,9 @@ func (ps *peerStore) DeleteSeeder(_ context.Context, ih bittorrent.InfoHash, p b
 	if sw, ok := sh.swarms.get(ih); ok {
 		if sw.seeders.del(p) {
 			sh.numSeeders.Add(decrUint64)
+			ps.forget(ih, p)
+		} else {
+			err = storage.ErrResourceDoesNotExist
 		}
 	} else {
 		err = storage.ErrResourceDoesNotExist
@@ -333,6 +578,7 @@ func (ps *peerStore) PutLeecher(_ context.Context, ih bittorrent.InfoHash, p bit
 		Object("peer", p).
 		Msg("put leecher")
 
+	ps.dedupe(ih, p)
 	sh := ps.shards[ps.shardIndex(ih, p.Addr().Is6())]
 	sw := sh.swarms.getOrCreate(ih)
 
@@ -360,6 +606,9 @@ func (ps *peerStore) DeleteLeecher(_ context.Context, ih bittorrent.InfoHash, p
 	if sw, ok := sh.swarms.get(ih); ok {
 		if sw.leechers.del(p) {
 			sh.numLeechers.Add(decrUint64)
+			ps.forget(ih, p)
+		} else {
+			err = storage.ErrResourceDoesNotExist
 		}
 	} else {
 		err = storage.ErrResourceDoesNotExist
@@ -368,6 +617,74 @@ func (ps *peerStore) DeleteLeecher(_ context.Context, ih bittorrent.InfoHash, p
 	return
 }
 
+func (ps *peerStore) DeletePeers(_ context.Context, ih bittorrent.InfoHash, peers ...bittorrent.Peer) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Int("count", len(peers)).
+		Msg("delete peers")
+
+	deleted := false
+	for _, p := range peers {
+		sh := ps.shards[ps.shardIndex(ih, p.Addr().Is6())]
+		sw, ok := sh.swarms.get(ih)
+		if !ok {
+			continue
+		}
+		seeder, leecher := sw.seeders.del(p), sw.leechers.del(p)
+		if seeder {
+			sh.numSeeders.Add(decrUint64)
+		}
+		if leecher {
+			sh.numLeechers.Add(decrUint64)
+		}
+		if seeder || leecher {
+			ps.forget(ih, p)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return storage.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+func (ps *peerStore) DeletePeerID(_ context.Context, ih bittorrent.InfoHash, id bittorrent.PeerID, v6 bool) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Stringer("peerID", id).
+		Bool("v6", v6).
+		Msg("delete peer ID")
+
+	sh := ps.shards[ps.shardIndex(ih, v6)]
+	sw, ok := sh.swarms.get(ih)
+	if !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+	seeders, leechers := sw.seeders.delID(id), sw.leechers.delID(id)
+	for _, p := range seeders {
+		sh.numSeeders.Add(decrUint64)
+		ps.forget(ih, p)
+	}
+	for _, p := range leechers {
+		sh.numLeechers.Add(decrUint64)
+		ps.forget(ih, p)
+	}
+	if len(seeders)+len(leechers) == 0 {
+		return storage.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
 func (ps *peerStore) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
@@ -379,10 +696,13 @@ func (ps *peerStore) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash,
 		Object("peer", p).
 		Msg("graduate leecher")
 
+	ps.dedupe(ih, p)
 	sh := ps.shards[ps.shardIndex(ih, p.Addr().Is6())]
 	sw := sh.swarms.getOrCreate(ih)
 
-	if sw.leechers.del(p) {
+	// leecher, which graduates, has already announced at least once
+	deleted := sw.leechers.del(p)
+	if deleted {
 		sh.numLeechers.Add(decrUint64)
 	}
 
@@ -390,12 +710,12 @@ func (ps *peerStore) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash,
 		sh.numSeeders.Add(1)
 	}
 
-	sw.seeders.set(p, timecache.NowUnixNano())
+	sw.seeders.setActive(p, timecache.NowUnixNano(), deleted)
 
 	return nil
 }
 
-func (ps *peerStore) AnnouncePeers(_ context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+func (ps *peerStore) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -410,18 +730,32 @@ func (ps *peerStore) AnnouncePeers(_ context.Context, ih bittorrent.InfoHash, fo
 
 	if sw, ok := ps.shards[ps.shardIndex(ih, v6)].swarms.get(ih); ok {
 		peers = make([]bittorrent.Peer, 0, numWant/2)
-		rangeFn := func(p bittorrent.Peer) bool {
-			peers = append(peers, p)
-			numWant--
-			return numWant > 0
-		}
-		if forSeeder {
-			sw.leechers.keys(rangeFn)
+		if seed, ok := storage.SelectionSeed(ctx); ok {
+			if !forSeeder {
+				peers = sw.seeders.ranked(seed, numWant, peers)
+			}
+			if l := len(peers); l < numWant {
+				peers = sw.leechers.ranked(seed, numWant-l, peers)
+			}
 		} else {
-			if sw.seeders.keys(rangeFn) {
+			rangeFn := func(p bittorrent.Peer) bool {
+				peers = append(peers, p)
+				numWant--
+				return numWant > 0
+			}
+			if forSeeder {
 				sw.leechers.keys(rangeFn)
+			} else {
+				if sw.seeders.keys(rangeFn) {
+					sw.leechers.keys(rangeFn)
+				}
 			}
 		}
+		if len(peers) == 0 {
+			err = storage.ErrSwarmEmpty
+		}
+	} else {
+		err = storage.ErrResourceDoesNotExist
 	}
 
 	return
@@ -453,6 +787,150 @@ func (ps *peerStore) ScrapeSwarm(_ context.Context, ih bittorrent.InfoHash) (lee
 	return
 }
 
+func (ps *peerStore) PeerExists(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer, seeder bool) (exists bool, _ error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Object("peer", p).
+		Bool("seeder", seeder).
+		Msg("peer exists")
+
+	if sw, ok := ps.shards[ps.shardIndex(ih, p.Addr().Is6())].swarms.get(ih); ok {
+		if seeder {
+			_, exists = sw.seeders.get(p)
+		} else {
+			_, exists = sw.leechers.get(p)
+		}
+	}
+	return
+}
+
+func (ps *peerStore) CountPeersByIP(_ context.Context, ih bittorrent.InfoHash, ip netip.Addr) (n uint32, _ error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Stringer("ip", ip).
+		Msg("count peers by IP")
+
+	ip = ip.Unmap()
+	if sw, ok := ps.shards[ps.shardIndex(ih, ip.Is6())].swarms.get(ih); ok {
+		n = sw.seeders.countIP(ip) + sw.leechers.countIP(ip)
+	}
+	return
+}
+
+func (ps *peerStore) PurgeSwarm(_ context.Context, ih bittorrent.InfoHash) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Msg("purge swarm")
+
+	for _, v6 := range []bool{false, true} {
+		sh := ps.shards[ps.shardIndex(ih, v6)]
+		sw, ok := sh.swarms.pop(ih)
+		if !ok {
+			continue
+		}
+		for _, p := range sw.seeders.clear() {
+			sh.numSeeders.Add(decrUint64)
+			ps.forget(ih, p)
+		}
+		for _, p := range sw.leechers.clear() {
+			sh.numLeechers.Add(decrUint64)
+			ps.forget(ih, p)
+		}
+	}
+	return nil
+}
+
+// InfoHashes returns info hashes in ascending order of their raw bytes.
+// Cursor is the HEX-encoded last info hash of the previous page,
+// so pagination is not affected by swarms added to or deleted
+// from other shards while iterating.
+func (ps *peerStore) InfoHashes(_ context.Context, cursor string, limit int) (infoHashes []bittorrent.InfoHash, nextCursor string, err error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+	logger.Trace().
+		Str("cursor", cursor).
+		Int("limit", limit).
+		Msg("info hashes")
+	var after bittorrent.InfoHash
+	if len(cursor) > 0 {
+		if after, err = bittorrent.NewInfoHashString(cursor); err != nil || len(cursor) != len(after)*2 {
+			return nil, "", storage.ErrInvalidCursor
+		}
+	}
+	if limit <= 0 {
+		limit = storage.DefaultInfoHashesLimit
+	}
+	// limit of the least info hashes greater than cursor are selected
+	// with max-heap, so page costs O(N*log(limit)) without copying
+	// and sorting all keys. The same info hash may be stored
+	// in both IPv4 and IPv6 shards.
+	page := make(ihMaxHeap, 0, limit)
+	selected := make(map[bittorrent.InfoHash]struct{}, limit)
+	more := false
+	for _, shard := range ps.shards {
+		shard.swarms.keys(func(ih bittorrent.InfoHash) bool {
+			if _, dup := selected[ih]; dup || ih <= after {
+				return true
+			}
+			switch {
+			case len(page) < limit:
+				heap.Push(&page, ih)
+				selected[ih] = struct{}{}
+			case ih < page[0]:
+				delete(selected, page[0])
+				page[0] = ih
+				selected[ih] = struct{}{}
+				heap.Fix(&page, 0)
+				more = true
+			default:
+				more = true
+			}
+			return true
+		})
+	}
+	infoHashes = []bittorrent.InfoHash(page)
+	slices.Sort(infoHashes)
+	if more {
+		nextCursor = infoHashes[len(infoHashes)-1].String()
+	}
+	return
+}
+
+// ihMaxHeap is the heap.Interface of info hashes,
+// which holds the greatest info hash on top
+type ihMaxHeap []bittorrent.InfoHash
+
+func (h ihMaxHeap) Len() int           { return len(h) }
+func (h ihMaxHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h ihMaxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *ihMaxHeap) Push(x any) { *h = append(*h, x.(bittorrent.InfoHash)) }
+
+func (h *ihMaxHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
 // NewDataStorage creates new in-memory data store
 func NewDataStorage() storage.DataStorage {
 	return new(dataStore)
@@ -537,45 +1015,71 @@ func (ps *peerStore) gc(cutoff time.Time) {
 				continue
 			}
 
-			sw.leechers.forEach(func(p bittorrent.Peer, mtime int64) bool {
-				if mtime <= cutoffUnix {
-					toDel = append(toDel, p)
-				}
-				return true
-			})
+			_, toDel = ps.expire(shard, ih, sw, cutoffUnix, toDel)
 
-			for _, p := range toDel {
-				if sw.leechers.del(p) {
-					shard.numLeechers.Add(decrUint64)
-				}
-			}
-
-			toDel = toDel[:0]
+			runtime.Gosched()
+		}
 
-			sw.seeders.forEach(func(p bittorrent.Peer, mtime int64) bool {
-				if mtime <= cutoffUnix {
-					toDel = append(toDel, p)
-				}
-				return true
-			})
+		runtime.Gosched()
+	}
+}
 
-			for _, p := range toDel {
-				if sw.seeders.del(p) {
-					shard.numSeeders.Add(decrUint64)
-				}
+// expire deletes peers of swarm, which were updated not after cutoffUnix,
+// and swarm itself if it becomes empty. Returns the number of deleted
+// peers and toDel buffer to be reused.
+func (ps *peerStore) expire(sh *peerShard, ih bittorrent.InfoHash, sw swarm, cutoffUnix int64, toDel []bittorrent.Peer) (removed uint32, _ []bittorrent.Peer) {
+	for _, pl := range []struct {
+		peers *peers
+		num   *atomic.Uint64
+	}{{sw.leechers, &sh.numLeechers}, {sw.seeders, &sh.numSeeders}} {
+		toDel = toDel[:0]
+		pl.peers.forEach(func(p bittorrent.Peer, mtime int64) bool {
+			if mtime <= cutoffUnix {
+				toDel = append(toDel, p)
 			}
+			return true
+		})
 
-			toDel = toDel[:0]
-
-			if sw.leechers.len()|sw.seeders.len() == 0 {
-				shard.swarms.del(ih)
+		for _, p := range toDel {
+			if pl.peers.del(p) {
+				pl.num.Add(decrUint64)
+				ps.forget(ih, p)
+				removed++
 			}
-
-			runtime.Gosched()
 		}
+	}
 
-		runtime.Gosched()
+	if removed > 0 {
+		storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonExpired).Add(float64(removed))
+	}
+	if sw.leechers.len()|sw.seeders.len() == 0 {
+		sh.swarms.del(ih)
+		storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonEmptySwarm).Inc()
+	}
+	return removed, toDel[:0]
+}
+
+func (ps *peerStore) ExpireSwarm(_ context.Context, ih bittorrent.InfoHash, cutoff time.Time) (removed uint32, _ error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Time("cutoff", cutoff).
+		Msg("expire swarm")
+
+	var toDel []bittorrent.Peer
+	for _, v6 := range []bool{false, true} {
+		sh := ps.shards[ps.shardIndex(ih, v6)]
+		if sw, ok := sh.swarms.get(ih); ok {
+			var n uint32
+			n, toDel = ps.expire(sh, ih, sw, cutoff.UnixNano(), toDel)
+			removed += n
+		}
 	}
+	return removed, nil
 }
 
 func (*peerStore) Ping(context.Context) error {
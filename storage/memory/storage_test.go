@@ -1,8 +1,15 @@
 package memory
 
 import (
+	"context"
+	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -17,4 +24,258 @@ func createNew() storage.PeerStorage {
 
 func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
 
+func TestPeerStorage(t *testing.T) { test.RunPeerStorageTests(t, createNew) }
+
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
+
+func TestEmptyAndMissingSwarm(t *testing.T) {
+	ps := createNew()
+	defer ps.Close()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+
+	_, err := ps.AnnouncePeers(context.Background(), ih, true, 10, false)
+	require.ErrorIs(t, err, storage.ErrResourceDoesNotExist)
+
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+	// seeder should not see other seeders
+	_, err = ps.AnnouncePeers(context.Background(), ih, true, 10, false)
+	require.ErrorIs(t, err, storage.ErrSwarmEmpty)
+
+	require.Nil(t, ps.DeleteSeeder(context.Background(), ih, peer))
+	_, err = ps.AnnouncePeers(context.Background(), ih, false, 10, false)
+	require.ErrorIs(t, err, storage.ErrSwarmEmpty)
+}
+
+func TestDedupePeerID(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	v4Moved := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("[fc00::1]:1234")}
+
+	for _, dedupe := range []bool{false, true} {
+		ps, err := NewPeerStorage(Config{ShardCount: 16, DedupePeerID: dedupe})
+		require.Nil(t, err)
+
+		// addresses of different families are kept independently
+		require.Nil(t, ps.PutLeecher(ctx, ih, v4))
+		require.Nil(t, ps.PutLeecher(ctx, ih, v6))
+
+		leechers, _, _, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		require.Equal(t, uint32(2), leechers)
+		peers, err := ps.AnnouncePeers(ctx, ih, true, 10, false)
+		require.Nil(t, err)
+		require.Equal(t, []bittorrent.Peer{v4}, peers)
+		peers, err = ps.AnnouncePeers(ctx, ih, true, 10, true)
+		require.Nil(t, err)
+		require.Equal(t, []bittorrent.Peer{v6}, peers)
+
+		// address of the same family is replaced
+		require.Nil(t, ps.GraduateLeecher(ctx, ih, v4Moved))
+		leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		require.Equal(t, uint32(1), seeders)
+		peers, err = ps.AnnouncePeers(ctx, ih, true, 10, false)
+		if dedupe {
+			require.Equal(t, uint32(1), leechers)
+			require.ErrorIs(t, err, storage.ErrSwarmEmpty)
+		} else {
+			require.Equal(t, uint32(2), leechers)
+			require.Nil(t, err)
+			require.Equal(t, []bittorrent.Peer{v4}, peers)
+		}
+		peers, err = ps.AnnouncePeers(ctx, ih, false, 10, false)
+		require.Nil(t, err)
+		require.Contains(t, peers, v4Moved)
+		peers, err = ps.AnnouncePeers(ctx, ih, true, 10, true)
+		require.Nil(t, err)
+		require.Equal(t, []bittorrent.Peer{v6}, peers)
+		require.Nil(t, ps.Close())
+	}
+}
+
+func TestLastGCTimestamp(t *testing.T) {
+	ps := createNew()
+	defer ps.Close()
+	storage.PromLastGCTimestamp.Set(0)
+
+	ps.(storage.GarbageCollector).ScheduleGC(10*time.Millisecond, time.Minute)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(storage.PromLastGCTimestamp) > 0
+	}, time.Second, 5*time.Millisecond)
+
+	// GC is periodic, so gauge must keep advancing
+	last := testutil.ToFloat64(storage.PromLastGCTimestamp)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(storage.PromLastGCTimestamp) > last
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPreferActivePeers(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	ps, err := NewPeerStorage(Config{ShardCount: 1, PreferActivePeers: true})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	var active bittorrent.Peer
+	for i := 0; i < 10; i++ {
+		p := bittorrent.Peer{ID: bittorrent.PeerID{byte(i)}, AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 1234)}
+		require.Nil(t, ps.PutLeecher(ctx, ih, p))
+		if i == 7 {
+			active = p
+		}
+	}
+	// re-announce
+	require.Nil(t, ps.PutLeecher(ctx, ih, active))
+
+	peers, err := ps.AnnouncePeers(ctx, ih, false, 1, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{active}, peers)
+
+	for seed := uint64(0); seed < 10; seed++ {
+		peers, err = ps.AnnouncePeers(storage.WithSelectionSeed(ctx, seed), ih, false, 1, false)
+		require.Nil(t, err)
+		require.Equal(t, []bittorrent.Peer{active}, peers)
+	}
+
+	// active state is kept after graduation
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, active))
+	peers, err = ps.AnnouncePeers(ctx, ih, true, 1, false)
+	require.Nil(t, err)
+	require.NotEqual(t, active, peers[0])
+	peers, err = ps.AnnouncePeers(ctx, ih, false, 1, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{active}, peers)
+}
+
+func TestDeletePeers(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("[fc00::1]:1234")}
+	kept := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+
+	ps, err := NewPeerStorage(Config{ShardCount: 16})
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Nil(t, ps.PutSeeder(ctx, ih, v4))
+	require.Nil(t, ps.PutLeecher(ctx, ih, v6))
+	require.Nil(t, ps.PutLeecher(ctx, ih, kept))
+
+	require.Nil(t, storage.DeletePeers(ctx, ps, ih, v4, v6))
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Zero(t, seeders)
+	require.Equal(t, uint32(1), leechers)
+	var numSeeders, numLeechers uint64
+	for _, sh := range ps.(*peerStore).shards {
+		numSeeders += sh.numSeeders.Load()
+		numLeechers += sh.numLeechers.Load()
+	}
+	require.Zero(t, numSeeders)
+	require.Equal(t, uint64(1), numLeechers)
+
+	require.ErrorIs(t, storage.DeletePeers(ctx, ps, ih, v4, v6), storage.ErrResourceDoesNotExist)
+}
+
+func TestExpireSwarm(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	other, _ := bittorrent.NewInfoHashString("76543210fedcba9876543210fedcba9876543210")
+	stale := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	stale6 := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("[fc00::2]:1234")}
+	alive := bittorrent.Peer{ID: bittorrent.PeerID{3}, AddrPort: netip.MustParseAddrPort("10.0.0.3:1234")}
+
+	ps, err := NewPeerStorage(Config{ShardCount: 16})
+	require.Nil(t, err)
+	defer ps.Close()
+	store := ps.(*peerStore)
+	old := time.Now().Add(-time.Hour).UnixNano()
+	for _, hash := range []bittorrent.InfoHash{ih, other} {
+		require.Nil(t, ps.PutSeeder(ctx, hash, stale))
+		require.Nil(t, ps.PutLeecher(ctx, hash, stale6))
+		require.Nil(t, ps.PutLeecher(ctx, hash, alive))
+		sw, _ := store.shards[store.shardIndex(hash, false)].swarms.get(hash)
+		sw.seeders.set(stale, old)
+		sw, _ = store.shards[store.shardIndex(hash, true)].swarms.get(hash)
+		sw.leechers.set(stale6, old)
+	}
+
+	removed, err := store.ExpireSwarm(ctx, ih, time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), removed)
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Zero(t, seeders)
+	require.Equal(t, uint32(1), leechers)
+	// other swarm is not affected
+	leechers, seeders, _, err = ps.ScrapeSwarm(ctx, other)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+	require.Equal(t, uint32(2), leechers)
+	// emptied IPv6 swarm is deleted
+	_, exists := store.shards[store.shardIndex(ih, true)].swarms.get(ih)
+	require.False(t, exists)
+}
+
+func TestCountPeersByIP(t *testing.T) {
+	ctx := context.Background()
+	ps := createNew()
+	defer ps.Close()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	ip, other := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	peer := func(id byte, addr netip.Addr, port uint16) bittorrent.Peer {
+		return bittorrent.Peer{ID: bittorrent.PeerID{id}, AddrPort: netip.AddrPortFrom(addr, port)}
+	}
+
+	n, err := storage.CountPeersByIP(ctx, ps, ih, ip)
+	require.Nil(t, err)
+	require.Zero(t, n)
+
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer(1, ip, 1000)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(2, ip, 1001)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(3, ip, 1002)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(4, other, 1000)))
+	// re-announce is not counted twice
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(3, ip, 1002)))
+	// IPv4-mapped IPv6 address is the same IP
+	n, err = storage.CountPeersByIP(ctx, ps, ih, netip.AddrFrom16(ip.As16()))
+	require.Nil(t, err)
+	require.Equal(t, uint32(3), n)
+
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer(2, ip, 1001)))
+	require.Nil(t, ps.DeleteLeecher(ctx, ih, peer(3, ip, 1002)))
+	n, err = storage.CountPeersByIP(ctx, ps, ih, ip)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), n)
+	n, err = storage.CountPeersByIP(ctx, ps, ih, other)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), n)
+
+	require.Nil(t, storage.PurgeSwarm(ctx, ps, ih))
+	n, err = storage.CountPeersByIP(ctx, ps, ih, ip)
+	require.Nil(t, err)
+	require.Zero(t, n)
+}
+
+func TestGCReapedByReason(t *testing.T) {
+	ctx := context.Background()
+	ps := createNew()
+	defer ps.Close()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	other, _ := bittorrent.NewInfoHashString("76543210fedcba9876543210fedcba9876543210")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+	require.Nil(t, ps.PutLeecher(ctx, ih, bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: peer.AddrPort}))
+
+	expired := testutil.ToFloat64(storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonExpired))
+	empty := testutil.ToFloat64(storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonEmptySwarm))
+	ps.(*peerStore).gc(time.Now().Add(time.Hour))
+	require.Nil(t, ps.PutSeeder(ctx, other, peer))
+	ps.(*peerStore).gc(time.Now().Add(-time.Hour))
+	require.Equal(t, expired+2, testutil.ToFloat64(storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonExpired)))
+	require.Equal(t, empty+1, testutil.ToFloat64(storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonEmptySwarm)))
+}
@@ -5,6 +5,7 @@ package pg
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -47,6 +48,9 @@ const (
 var (
 	logger                         = log.NewLogger("storage/pg")
 	errConnectionStringNotProvided = errors.New("database connection string not provided")
+	errInfoHashesQueryNotProvided  = errors.New("info hashes query not provided")
+	errExistsQueryNotProvided      = errors.New("peer exists query not provided")
+	errPurgeQueryNotProvided       = errors.New("swarm purge query not provided")
 )
 
 func init() {
@@ -101,6 +105,8 @@ type peerQueryConf struct {
 	CountSeedersColumn  string `cfg:"count_seeders_column"`
 	CountLeechersColumn string `cfg:"count_leechers_column"`
 	ByInfoHashClause    string `cfg:"by_info_hash_clause"`
+	ExistsQuery         string `cfg:"exists_query"`
+	PurgeQuery          string `cfg:"purge_query"`
 }
 
 type announceQueryConf struct {
@@ -119,6 +125,7 @@ type dataQueryConf struct {
 type downloadQueryConf struct {
 	GetQuery       string `cfg:"get_query"`
 	IncrementQuery string `cfg:"inc_query"`
+	PurgeQuery     string `cfg:"purge_query"`
 }
 
 // Config holds the configuration of a redis PeerStorage.
@@ -131,6 +138,7 @@ type Config struct {
 	Data               dataQueryConf
 	GCQuery            string `cfg:"gc_query"`
 	InfoHashCountQuery string `cfg:"info_hash_count_query"`
+	InfoHashesQuery    string `cfg:"info_hashes_query"`
 }
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -301,6 +309,7 @@ func (s *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
+		gate := &storage.GCHealthGate{Pinger: s, Timeout: gcInterval}
 		t := time.NewTimer(gcInterval)
 		defer t.Stop()
 		for {
@@ -308,6 +317,10 @@ func (s *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 			case <-s.closed:
 				return
 			case <-t.C:
+				if !gate.Allow() {
+					t.Reset(gcInterval)
+					continue
+				}
 				start := time.Now()
 				_, err := s.Exec(context.Background(), s.GCQuery, pgx.NamedArgs{pCreated: time.Now().Add(-peerLifeTime)})
 				duration := time.Since(start)
@@ -315,6 +328,7 @@ func (s *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 					logger.Error().Err(err).Msg("error occurred while GC")
 				} else {
 					logger.Debug().Dur("timeTaken", duration).Msg("GC complete")
+					storage.PromLastGCTimestamp.SetToCurrentTime()
 				}
 				storage.PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
 				t.Reset(gcInterval)
@@ -340,18 +354,24 @@ func (s *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
 				if metrics.Enabled() {
 					before := time.Now()
 					sc, lc, err := s.countPeers(context.Background(), nil)
+					failed := false
 					if err = noResultErr(err); err != nil {
 						logger.Error().Err(err).Msg("error occurred while get peers count count")
+						failed = true
 					}
 					var hc int
 					err = s.QueryRow(context.Background(), s.InfoHashCountQuery).Scan(&hc)
 					if err = noResultErr(err); err != nil {
 						logger.Error().Err(err).Msg("error occurred while get info hash count")
+						failed = true
 					}
 
 					storage.PromInfoHashesCount.Set(float64(hc))
 					storage.PromSeedersCount.Set(float64(sc))
 					storage.PromLeechersCount.Set(float64(lc))
+					if !failed {
+						storage.PromLastStatsTimestamp.SetToCurrentTime()
+					}
 					logger.Debug().TimeDiff("timeTaken", time.Now(), before).Msg("populate prom complete")
 				}
 			}
@@ -480,6 +500,9 @@ func (s *store) getPeers(ctx context.Context, ih []byte, seeders bool, maxCount
 						err = bittorrent.ErrInvalidIP
 					}
 				}
+				if err != nil {
+					storage.PromMalformedPeersTotal.Inc()
+				}
 			}
 			if err == nil {
 				peers = append(peers, peer)
@@ -516,7 +539,14 @@ func (s *store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSe
 
 	if l := len(peers); err == nil {
 		if l == 0 {
-			err = storage.ErrResourceDoesNotExist
+			var seeders, leechers uint32
+			if seeders, leechers, err = s.countPeers(ctx, ihb); err == nil {
+				if seeders+leechers > 0 {
+					err = storage.ErrSwarmEmpty
+				} else {
+					err = storage.ErrResourceDoesNotExist
+				}
+			}
 		}
 	} else if l > 0 {
 		err = nil
@@ -580,6 +610,102 @@ func (s *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (leeche
 	return
 }
 
+func (s *store) PeerExists(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (exists bool, err error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Object("peer", peer).
+		Bool("seeder", seeder).
+		Msg("peer exists")
+	if len(s.Peer.ExistsQuery) == 0 {
+		return false, errExistsQueryNotProvided
+	}
+	var rows pgx.Rows
+	if rows, err = s.Query(ctx, s.Peer.ExistsQuery, pgx.NamedArgs{
+		pInfoHash: ih.Bytes(),
+		pPeerID:   peer.ID.Bytes(),
+		pAddress:  net.IP(peer.Addr().AsSlice()),
+		pPort:     peer.Port(),
+		pSeeder:   seeder,
+	}); err == nil {
+		defer rows.Close()
+		exists = rows.Next()
+		err = rows.Err()
+	}
+	return
+}
+
+// PurgeSwarm executes peer PurgeQuery and downloads PurgeQuery
+// (if provided) in one transaction
+func (s *store) PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash) error {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Msg("purge swarm")
+	if len(s.Peer.PurgeQuery) == 0 {
+		return errPurgeQueryNotProvided
+	}
+	var batch pgx.Batch
+	ihb := ih.Bytes()
+	batch.Queue(s.Peer.PurgeQuery, pgx.NamedArgs{pInfoHash: ihb})
+	if len(s.Downloads.PurgeQuery) > 0 {
+		batch.Queue(s.Downloads.PurgeQuery, pgx.NamedArgs{pInfoHash: ihb})
+	}
+	return s.txBatch(ctx, &batch)
+}
+
+// InfoHashes returns info hashes selected with InfoHashesQuery.
+// Cursor is the HEX-encoded last info hash of the previous page,
+// query should return distinct info hashes, which are greater than
+// provided @info_hash, ordered ascending and limited with @count.
+func (s *store) InfoHashes(ctx context.Context, cursor string, limit int) (infoHashes []bittorrent.InfoHash, nextCursor string, err error) {
+	logger.Trace().
+		Str("cursor", cursor).
+		Int("limit", limit).
+		Msg("info hashes")
+	if len(s.InfoHashesQuery) == 0 {
+		return nil, "", errInfoHashesQueryNotProvided
+	}
+	after := make([]byte, 0)
+	if len(cursor) > 0 {
+		var ih bittorrent.InfoHash
+		if ih, err = bittorrent.NewInfoHashString(cursor); err != nil || len(cursor) != len(ih)*2 {
+			return nil, "", storage.ErrInvalidCursor
+		}
+		after = ih.Bytes()
+	}
+	if limit <= 0 {
+		limit = storage.DefaultInfoHashesLimit
+	}
+	var rows pgx.Rows
+	// one more row requested to check if there is next page
+	if rows, err = s.Query(ctx, s.InfoHashesQuery, pgx.NamedArgs{pInfoHash: after, pCount: limit + 1}); err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	infoHashes = make([]bittorrent.InfoHash, 0, limit)
+	var last []byte
+	for n := 0; rows.Next(); n++ {
+		if n == limit {
+			nextCursor = hex.EncodeToString(last)
+			break
+		}
+		if err = rows.Scan(&last); err != nil {
+			return nil, "", err
+		}
+		var ih bittorrent.InfoHash
+		if ih, err = bittorrent.NewInfoHash(last); err != nil {
+			logger.Warn().Err(err).Hex("infoHash", last).Msg("unable to construct info hash")
+			err = nil
+			continue
+		}
+		// copy, because scanned bytes may be reused
+		infoHashes = append(infoHashes, bittorrent.InfoHash(string(ih)))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return
+}
+
 func (s *store) Ping(ctx context.Context) error {
 	_, err := s.Exec(ctx, s.PingQuery)
 	return err
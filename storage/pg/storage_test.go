@@ -53,6 +53,8 @@ var cfg = Config{
 		CountSeedersColumn:  "seeders",
 		CountLeechersColumn: "leechers",
 		ByInfoHashClause:    "WHERE info_hash = @info_hash",
+		ExistsQuery:         "SELECT 1 FROM mo_peers WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND is_seeder=@is_seeder",
+		PurgeQuery:          "DELETE FROM mo_peers WHERE info_hash=@info_hash",
 	},
 	Announce: announceQueryConf{
 		Query:         "SELECT peer_id, address, port FROM mo_peers WHERE info_hash=@info_hash AND is_seeder=@is_seeder AND is_v6=@is_v6 LIMIT @count",
@@ -63,6 +65,7 @@ var cfg = Config{
 	Downloads: downloadQueryConf{
 		GetQuery:       "SELECT downloads FROM mo_downloads where info_hash=@info_hash",
 		IncrementQuery: "INSERT INTO mo_downloads VALUES(@info_hash) ON CONFLICT(info_hash) DO UPDATE SET downloads = mo_downloads.downloads + 1",
+		PurgeQuery:     "DELETE FROM mo_downloads WHERE info_hash=@info_hash",
 	},
 	Data: dataQueryConf{
 		AddQuery: "INSERT INTO mo_kv VALUES(@context, @key, @value) ON CONFLICT (context, name) DO NOTHING",
@@ -71,6 +74,7 @@ var cfg = Config{
 	},
 	GCQuery:            "DELETE FROM mo_peers WHERE created <= @created",
 	InfoHashCountQuery: "SELECT COUNT(DISTINCT info_hash) as info_hashes FROM mo_peers",
+	InfoHashesQuery:    "SELECT DISTINCT info_hash FROM mo_peers WHERE info_hash > @info_hash ORDER BY info_hash LIMIT @count",
 }
 
 func createNew() s.PeerStorage {
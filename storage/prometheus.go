@@ -1,45 +1,88 @@
 // Package storage contains prometheus specific globals, used by storages
 package storage
 
-import "github.com/prometheus/client_golang/prometheus"
-
-func init() {
-	// Register the metrics.
-	prometheus.MustRegister(
-		PromGCDurationMilliseconds,
-		PromInfoHashesCount,
-		PromSeedersCount,
-		PromLeechersCount,
-	)
-}
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+// Reasons of records removal by garbage collection (see PromGCReapedTotal)
+const (
+	// GCReasonExpired is the reason of peers removal, which were not announced within peer lifetime
+	GCReasonExpired = "expired"
+	// GCReasonEmptySwarm is the reason of swarms removal, which have no peers anymore
+	GCReasonEmptySwarm = "empty_swarm"
+	// GCReasonMalformed is the reason of peers removal, which records could not be decoded
+	GCReasonMalformed = "malformed"
+)
 
 var (
 	// PromGCDurationMilliseconds is a histogram used by storage to record the
 	// durations of execution time required for removing expired peers.
-	PromGCDurationMilliseconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	PromGCDurationMilliseconds = metrics.Register(prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "mochi_storage_gc_duration_milliseconds",
 		Help:    "The time it takes to perform storage garbage collection",
 		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
-	})
+	}))
 
 	// PromInfoHashesCount is a gauge used to hold the current total amount of
 	// unique swarms being tracked by a storage.
-	PromInfoHashesCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	PromInfoHashesCount = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "mochi_storage_infohashes_count",
 		Help: "The number of Infohashes tracked",
-	})
+	}))
 
 	// PromSeedersCount is a gauge used to hold the current total amount of
 	// unique seeders per swarm.
-	PromSeedersCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	PromSeedersCount = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "mochi_storage_seeders_count",
 		Help: "The number of seeders tracked",
-	})
+	}))
 
 	// PromLeechersCount is a gauge used to hold the current total amount of
 	// unique leechers per swarm.
-	PromLeechersCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	PromLeechersCount = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "mochi_storage_leechers_count",
 		Help: "The number of leechers tracked",
-	})
+	}))
+
+	// PromLastGCTimestamp is a gauge used to hold the time of the end of
+	// the last successful garbage collection.
+	PromLastGCTimestamp = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mochi_storage_last_gc_timestamp_seconds",
+		Help: "Unix time of the last successful storage garbage collection",
+	}))
+
+	// PromLastStatsTimestamp is a gauge used to hold the time of the end of
+	// the last successful statistics collection.
+	PromLastStatsTimestamp = metrics.Register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mochi_storage_last_stats_timestamp_seconds",
+		Help: "Unix time of the last successful storage statistics collection",
+	}))
+
+	// PromGCSkippedTotal is a counter of garbage collection cycles skipped
+	// because storage was not available.
+	PromGCSkippedTotal = metrics.Register(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mochi_storage_gc_skipped_total",
+		Help: "The number of storage garbage collections skipped because storage was unavailable",
+	}))
+
+	// PromMalformedPeersTotal is a counter of peer records found in storage,
+	// which could not be decoded (i.e. because of data corruption).
+	PromMalformedPeersTotal = metrics.Register(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mochi_storage_malformed_peers_total",
+		Help: "The number of malformed peer records found in storage",
+	}))
+
+	// PromGCReapedTotal is a counter of peers and swarms removed by
+	// garbage collection labeled by reason (GCReasonExpired,
+	// GCReasonEmptySwarm or GCReasonMalformed).
+	PromGCReapedTotal = metrics.Register(prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mochi_gc_reaped_total",
+			Help: "The number of peers (expired, malformed) and swarms (empty_swarm) removed by garbage collection by reason",
+		},
+		[]string{"reason"},
+	))
 )
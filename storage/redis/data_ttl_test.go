@@ -0,0 +1,52 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestDataTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ps, err := newStore(Config{
+		Addresses:      []string{mr.Addr()},
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		ConnectTimeout: time.Second,
+		DataTTL:        map[string]time.Duration{"ephemeral": time.Minute, "invalid": -time.Minute},
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+	require.NotContains(t, ps.dataTTL, "invalid")
+	ctx := context.Background()
+
+	for _, storeCtx := range []string{"ephemeral", "persistent", "invalid"} {
+		require.Nil(t, ps.Put(ctx, storeCtx, storage.Entry{Key: "k1", Value: []byte("v")}))
+	}
+	require.Equal(t, time.Minute, mr.TTL(ps.PrefixKey+"ephemeral"))
+	require.Zero(t, mr.TTL(ps.PrefixKey+"persistent"))
+
+	// write refreshes TTL of the whole hash
+	mr.FastForward(30 * time.Second)
+	require.Nil(t, ps.Put(ctx, "ephemeral",
+		storage.Entry{Key: "k2", Value: []byte("v")}, storage.Entry{Key: "k3", Value: []byte("v")}))
+	require.Equal(t, time.Minute, mr.TTL(ps.PrefixKey+"ephemeral"))
+	mr.FastForward(45 * time.Second)
+	contains, err := ps.Contains(ctx, "ephemeral", "k1")
+	require.Nil(t, err)
+	require.True(t, contains)
+
+	mr.FastForward(30 * time.Second)
+	v, err := ps.Load(ctx, "ephemeral", "k2")
+	require.Nil(t, err)
+	require.Nil(t, v)
+	require.False(t, mr.Exists(ps.PrefixKey+"ephemeral"))
+	contains, err = ps.Contains(ctx, "persistent", "k1")
+	require.Nil(t, err)
+	require.True(t, contains)
+}
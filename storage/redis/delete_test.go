@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestDeletePeers(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	seeder4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	seeder6 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("[fd00::1]:1234")}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+	kept := bittorrent.Peer{ID: bittorrent.PeerID{3}, AddrPort: netip.MustParseAddrPort("10.0.0.3:1234")}
+	unknown := bittorrent.Peer{ID: bittorrent.PeerID{4}, AddrPort: netip.MustParseAddrPort("10.0.0.4:1234")}
+
+	ps := newMiniStore(t, 1)
+	ps.peerTimeIndex = true
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder4))
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder6))
+	require.Nil(t, ps.PutLeecher(ctx, ih, leecher))
+	require.Nil(t, ps.PutLeecher(ctx, ih, kept))
+
+	// counters are decremented only for peers, which were stored
+	require.Nil(t, ps.DeletePeers(ctx, ih, seeder4, seeder6, leecher, unknown))
+	require.Zero(t, ps.count(CountSeederKey, false))
+	require.Equal(t, uint64(1), ps.count(CountLeecherKey, false))
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Zero(t, seeders)
+	require.Equal(t, uint32(1), leechers)
+	n, err := ps.ZCard(ctx, PeerTimeKey(InfoHashKey(ih.RawString(), false, false))).Result()
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	require.ErrorIs(t, ps.DeletePeers(ctx, ih, seeder4, unknown), storage.ErrResourceDoesNotExist)
+	require.Zero(t, ps.count(CountSeederKey, false))
+	require.Equal(t, uint64(1), ps.count(CountLeecherKey, false))
+}
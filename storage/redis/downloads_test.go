@@ -0,0 +1,39 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestTrackedDownloadsOnly(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	leecher := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	completed := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+
+	for _, trackedOnly := range []bool{false, true} {
+		ps := newMiniStore(t, 1)
+		ps.trackedDLOnly = trackedOnly
+
+		require.Nil(t, ps.PutLeecher(ctx, ih, leecher))
+		require.Nil(t, ps.GraduateLeecher(ctx, ih, leecher))
+		// peer, which was never leecher, sent `completed`
+		require.Nil(t, ps.GraduateLeecher(ctx, ih, completed))
+
+		leechers, seeders, snatched, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		require.Zero(t, leechers)
+		require.Equal(t, uint32(2), seeders)
+		require.Zero(t, ps.count(CountLeecherKey, false))
+		if trackedOnly {
+			require.Equal(t, uint32(1), snatched)
+		} else {
+			require.Equal(t, uint32(2), snatched)
+		}
+	}
+}
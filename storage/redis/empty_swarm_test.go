@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestEmptySwarmPurge(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ps.emptySwarmTTL = time.Hour
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer))
+	_, _, downloads, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), downloads)
+
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, peer))
+	ps.gc(time.Now())
+	score, err := ps.ZScore(ctx, EmptySwarmKey, ih.RawString()).Result()
+	require.Nil(t, err)
+	require.NotZero(t, score)
+
+	// TTL not expired yet
+	ps.purgeEmptySwarms(time.Now().Add(-ps.emptySwarmTTL))
+	_, _, downloads, err = ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), downloads)
+
+	ps.purgeEmptySwarms(time.Now().Add(ps.emptySwarmTTL))
+	_, _, downloads, err = ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Zero(t, downloads)
+	require.Zero(t, ps.ZCard(ctx, EmptySwarmKey).Val())
+}
+
+func TestEmptySwarmRevived(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ps.emptySwarmTTL = time.Hour
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer))
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, peer))
+	ps.gc(time.Now())
+	require.Equal(t, int64(1), ps.ZCard(ctx, EmptySwarmKey).Val())
+
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer))
+	require.Zero(t, ps.ZCard(ctx, EmptySwarmKey).Val())
+
+	ps.purgeEmptySwarms(time.Now().Add(ps.emptySwarmTTL))
+	_, _, downloads, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), downloads)
+}
+
+func TestEmptyAndMissingSwarm(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+
+	_, err := ps.AnnouncePeers(ctx, ih, true, 10, false)
+	require.ErrorIs(t, err, storage.ErrResourceDoesNotExist)
+
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+	_, err = ps.AnnouncePeers(ctx, ih, true, 10, false)
+	require.ErrorIs(t, err, storage.ErrSwarmEmpty)
+}
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestExpireSwarm(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	other, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	peers := timeIndexPeers(3)
+	old := time.Now().Add(-time.Hour).UnixNano()
+	for _, hash := range []bittorrent.InfoHash{ih, other} {
+		require.Nil(t, ps.PutSeeder(ctx, hash, peers[0]))
+		require.Nil(t, ps.PutLeecher(ctx, hash, peers[1]))
+		require.Nil(t, ps.PutLeecher(ctx, hash, peers[2]))
+		require.Nil(t, ps.HSet(ctx, InfoHashKey(hash.RawString(), true, false), PackPeer(peers[0]), old).Err())
+		require.Nil(t, ps.HSet(ctx, InfoHashKey(hash.RawString(), false, false), PackPeer(peers[1]), old).Err())
+	}
+
+	removed, err := ps.ExpireSwarm(ctx, ih, time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), removed)
+
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Zero(t, seeders)
+	require.Equal(t, uint32(1), leechers)
+	// other swarm is not affected
+	leechers, seeders, _, err = ps.ScrapeSwarm(ctx, other)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+	require.Equal(t, uint32(2), leechers)
+	require.Equal(t, uint64(1), ps.count(CountSeederKey, false))
+	require.Equal(t, uint64(3), ps.count(CountLeecherKey, false))
+	// emptied swarm is removed from info hashes set
+	require.False(t, ps.SIsMember(ctx, IHKey, InfoHashKey(ih.RawString(), true, false)).Val())
+}
@@ -0,0 +1,61 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestFieldTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ps, err := newStore(Config{
+		Addresses:      []string{mr.Addr()},
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		ConnectTimeout: time.Second,
+		PeerLifetime:   10 * time.Second,
+		PeerIPIndex:    true,
+		UseFieldTTL:    true,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+	require.Equal(t, int64(10), ps.fieldTTL)
+	require.True(t, ps.peerTimeIndex)
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	seeder := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder))
+	require.Nil(t, ps.PutLeecher(ctx, ih, leecher))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, leecher))
+	seederKey := ps.InfoHashKey(ih.RawString(), true, false)
+	require.Equal(t, 10*time.Second, mr.HTTL(seederKey, PackPeer(leecher)))
+
+	mr.FastForward(5 * time.Second)
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder))
+	mr.FastForward(6 * time.Second)
+	_, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+	// counter is not decremented by field expiration
+	require.Equal(t, uint64(3), ps.count(ps.CountSeederKey, false))
+
+	ps.gc(time.Now().Add(-time.Hour))
+	require.Equal(t, uint64(1), ps.count(ps.CountSeederKey, false))
+	require.Zero(t, ps.count(ps.CountLeecherKey, false))
+	require.True(t, mr.Exists(seederKey))
+
+	mr.FastForward(11 * time.Second)
+	ps.gc(time.Now().Add(time.Hour))
+	require.Zero(t, ps.count(ps.CountSeederKey, false))
+	require.Zero(t, ps.count(IHKey, true))
+	require.False(t, mr.Exists(ps.PeerTimeKey(seederKey)))
+	require.False(t, mr.Exists(ps.PeerIPKey(seederKey)))
+}
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestGCSkippedWhileDown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ps, err := newStore(Config{
+		Addresses:      []string{mr.Addr()},
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		ConnectTimeout: time.Second,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+
+	gate := &storage.GCHealthGate{Pinger: ps, Timeout: time.Second}
+	mr.SetError("LOADING server is loading")
+	require.False(t, ps.gcCycle(gate, -time.Hour))
+	require.False(t, ps.gcCycle(gate, -time.Hour))
+
+	mr.SetError("")
+	_, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+
+	require.True(t, ps.gcCycle(gate, -time.Hour))
+	_, seeders, _, err = ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Zero(t, seeders)
+}
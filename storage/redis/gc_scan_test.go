@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGCScanPages checks that GC collects stale peers of every info hash
+// when set is iterated by many SSCAN pages.
+// Unlike redis, miniredis SSCAN cursor is an offset in sorted set members,
+// so removing members while scanning skips some of them. To keep pages
+// stable, every info hash has fresh peer and is not removed from set.
+func TestGCScanPages(t *testing.T) {
+	const swarms = 20000
+	mr := miniredis.RunT(t)
+	ps, err := newStore(Config{
+		Addresses:      []string{mr.Addr()},
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		ConnectTimeout: time.Second,
+		GCScanCount:    100,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+	require.Equal(t, int64(100), ps.gcScanCount)
+	ctx := context.Background()
+
+	now := time.Now().UnixNano()
+	pipe := ps.Pipeline()
+	for i := 0; i < swarms; i++ {
+		ih := make([]byte, 20)
+		binary.BigEndian.PutUint32(ih, uint32(i))
+		key := ps.InfoHashKey(string(ih), true, false)
+		pipe.HSet(ctx, key, "stale", 0, "fresh", now)
+		pipe.SAdd(ctx, ps.IHKey, key)
+	}
+	pipe.IncrBy(ctx, ps.CountSeederKey, 2*swarms)
+	_, err = pipe.Exec(ctx)
+	require.Nil(t, err)
+
+	ps.gc(time.Now().Add(-time.Hour))
+	require.Equal(t, uint64(swarms), ps.count(ps.CountSeederKey, false))
+	require.Equal(t, uint64(swarms), ps.count(ps.IHKey, true))
+	members, err := ps.SMembers(ctx, ps.IHKey).Result()
+	require.Nil(t, err)
+	for _, key := range members {
+		fields, err := mr.HKeys(key)
+		require.Nil(t, err)
+		require.Equal(t, []string{"fresh"}, fields)
+	}
+}
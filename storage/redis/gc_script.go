@@ -0,0 +1,123 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/sot-tech/mochi/storage"
+)
+
+// gcScript deletes peers announced not after cutoff from every provided
+// info hash key, decrements seeders or leechers counter and removes
+// empty keys from info hashes set.
+//
+// KEYS[1] - info hashes set, KEYS[2] - seeders counter, KEYS[3] - leechers
+// counter, KEYS[4..] - info hash keys.
+// ARGV[1] - cutoff (unix nanoseconds), ARGV[2] and ARGV[3] - prefixes
+// of IPv4 and IPv6 seeders keys.
+//
+// Returns the number of deleted peers and list of emptied keys.
+var gcScript = redis.NewScript(`
+local cutoff = tonumber(ARGV[1])
+local removed = 0
+local emptied = {}
+for i = 4, #KEYS do
+	local key = KEYS[i]
+	local fields = redis.call('HGETALL', key)
+	local stale = {}
+	for j = 1, #fields, 2 do
+		local mtime = tonumber(fields[j + 1])
+		if mtime ~= nil and mtime <= cutoff then
+			stale[#stale + 1] = fields[j]
+		end
+	end
+	if #stale > 0 then
+		local n = 0
+		-- limit number of unpacked arguments
+		for j = 1, #stale, 1000 do
+			n = n + redis.call('HDEL', key, unpack(stale, j, math.min(j + 999, #stale)))
+		end
+		local counter = KEYS[3]
+		if string.sub(key, 1, #ARGV[2]) == ARGV[2] or string.sub(key, 1, #ARGV[3]) == ARGV[3] then
+			counter = KEYS[2]
+		end
+		redis.call('DECRBY', counter, n)
+		removed = removed + n
+	end
+	if redis.call('HLEN', key) == 0 then
+		redis.call('SREM', KEYS[1], key)
+		emptied[#emptied + 1] = key
+	end
+end
+return {removed, emptied}
+`)
+
+// loadGCScript checks if script GC can be used and loads script
+// into server. Returns batch size or 0 if script GC is not used.
+func (ps *store) loadGCScript(batch int) int {
+	if ps.peerTimeIndex || ps.peerIPIndex || ps.peerIDIndex || ps.peerStats || ps.gcMalformed || ps.fieldTTL > 0 {
+		logger.Warn().Msg("script GC does not support peer indexes and statistics, field TTL and malformed peers deletion, " +
+			"every info hash is collected separately")
+		return 0
+	}
+	if err := gcScript.Load(context.Background(), ps.UniversalClient).Err(); err != nil {
+		logger.Warn().Err(err).Msg("unable to load GC script, every info hash is collected separately")
+		return 0
+	}
+	return batch
+}
+
+// gcInfoHashes deletes stale peers of infoHashKeys with GC script
+// in batches of gcBatch keys. If script GC is disabled or script
+// call fails, every info hash of batch is processed separately.
+func (ps *store) gcInfoHashes(ihSetKey string, infoHashKeys []string, cutoffNanos int64) {
+	for len(infoHashKeys) > 0 {
+		batch := infoHashKeys
+		if ps.gcBatch > 0 && len(batch) > ps.gcBatch {
+			batch = batch[:ps.gcBatch]
+		}
+		infoHashKeys = infoHashKeys[len(batch):]
+		if ps.gcBatch > 0 {
+			err := ps.gcScriptBatch(ihSetKey, batch, cutoffNanos)
+			if err == nil {
+				continue
+			}
+			logger.Warn().Err(err).
+				Str("hashSet", ihSetKey).
+				Msg("GC script failed, collecting info hashes separately")
+		}
+		for _, infoHashKey := range batch {
+			ps.gcInfoHash(ihSetKey, infoHashKey, cutoffNanos)
+		}
+	}
+}
+
+// gcScriptBatch runs gcScript for infoHashKeys of ihSetKey set
+func (ps *store) gcScriptBatch(ihSetKey string, infoHashKeys []string, cutoffNanos int64) error {
+	keys := make([]string, 0, len(infoHashKeys)+3)
+	keys = append(keys, ihSetKey, ps.CountSeederKey, ps.CountLeecherKey)
+	keys = append(keys, infoHashKeys...)
+	res, err := gcScript.Run(context.Background(), ps.UniversalClient, keys,
+		strconv.FormatInt(cutoffNanos, 10), ps.IH4SeederKey, ps.IH6SeederKey).Slice()
+	if err != nil {
+		return err
+	}
+	if len(res) != 2 {
+		return fmt.Errorf("unexpected GC script result: %v", res)
+	}
+	removed, _ := res[0].(int64)
+	emptied, _ := res[1].([]any)
+	storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonExpired).Add(float64(removed))
+	storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonEmptySwarm).Add(float64(len(emptied)))
+	if ps.emptySwarmTTL > 0 {
+		for _, k := range emptied {
+			if infoHashKey, ok := k.(string); ok && len(infoHashKey) > len(ps.IH4SeederKey) {
+				ps.markEmptySwarm(infoHashKey[len(ps.IH4SeederKey):])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func newScriptStore(tb testing.TB, batch int) *store {
+	mr := miniredis.RunT(tb)
+	ps, err := newStore(Config{
+		Addresses:         []string{mr.Addr()},
+		ReadTimeout:       time.Second,
+		WriteTimeout:      time.Second,
+		ConnectTimeout:    time.Second,
+		GCScriptBatchSize: batch,
+	})
+	require.Nil(tb, err)
+	tb.Cleanup(func() { _ = ps.Close() })
+	return ps
+}
+
+// fillSwarms stores seeders and leechers into swarms info hashes,
+// peers of every second swarm are stale
+func fillSwarms(tb testing.TB, ps *store, swarms, peers int) {
+	ctx := context.Background()
+	for i := 0; i < swarms; i++ {
+		ih, _ := bittorrent.NewInfoHash([]byte{19: byte(i), 18: byte(i >> 8), 0: 1})
+		for j := 0; j < peers; j++ {
+			p := bittorrent.Peer{
+				ID:       bittorrent.PeerID{byte(j), byte(j >> 8)},
+				AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(j >> 8), byte(j)}), 1234),
+			}
+			require.Nil(tb, ps.PutSeeder(ctx, ih, p))
+			require.Nil(tb, ps.PutLeecher(ctx, ih, p))
+			if i%2 == 0 {
+				for _, seeder := range []bool{true, false} {
+					require.Nil(tb, ps.HSet(ctx, ps.InfoHashKey(ih.RawString(), seeder, false), PackPeer(p), 0).Err())
+				}
+			}
+		}
+	}
+}
+
+func TestGCScript(t *testing.T) {
+	const swarms, peers = 5, 3
+	ps := newScriptStore(t, 2)
+	require.Equal(t, 2, ps.gcBatch)
+	fillSwarms(t, ps, swarms, peers)
+
+	ps.gc(time.Now().Add(-time.Hour))
+	require.Equal(t, uint64(2*peers), ps.count(CountSeederKey, false))
+	require.Equal(t, uint64(2*peers), ps.count(CountLeecherKey, false))
+	require.Equal(t, uint64(2*2), ps.count(IHKey, true))
+
+	ps.gc(time.Now().Add(time.Hour))
+	require.Zero(t, ps.count(CountSeederKey, false))
+	require.Zero(t, ps.count(CountLeecherKey, false))
+	require.Zero(t, ps.count(IHKey, true))
+}
+
+func TestGCScriptDisabledWithIndex(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ps, err := newStore(Config{
+		Addresses:         []string{mr.Addr()},
+		ReadTimeout:       time.Second,
+		WriteTimeout:      time.Second,
+		ConnectTimeout:    time.Second,
+		GCScriptBatchSize: 10,
+		PeerTimeIndex:     true,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+	require.Zero(t, ps.gcBatch)
+}
+
+// roundTrips counts requests sent to redis server,
+// pipeline is counted as one request
+type roundTrips struct{ n int }
+
+func (*roundTrips) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (rt *roundTrips) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		rt.n++
+		return next(ctx, cmd)
+	}
+}
+
+func (rt *roundTrips) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		rt.n++
+		return next(ctx, cmds)
+	}
+}
+
+// BenchmarkGC reports the number of round trips to redis
+// made by one GC pass (round-trips/op)
+func BenchmarkGC(b *testing.B) {
+	const swarms, peers = 200, 10
+	for _, bc := range []struct {
+		name  string
+		batch int
+	}{{"per_key", 0}, {"script", 100}} {
+		b.Run(bc.name, func(b *testing.B) {
+			ps := newScriptStore(b, bc.batch)
+			rt := new(roundTrips)
+			ps.AddHook(rt)
+			var total int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				fillSwarms(b, ps, swarms, peers)
+				rt.n = 0
+				b.StartTimer()
+				ps.gc(time.Now().Add(-time.Hour))
+				total += rt.n
+			}
+			b.ReportMetric(float64(total)/float64(b.N), "round-trips/op")
+		})
+	}
+}
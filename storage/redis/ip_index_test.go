@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestCountPeersByIP(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	ip, other := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	peer := func(id byte, addr netip.Addr, port uint16) bittorrent.Peer {
+		return bittorrent.Peer{ID: bittorrent.PeerID{id}, AddrPort: netip.AddrPortFrom(addr, port)}
+	}
+	requireCount := func(ps *store, addr netip.Addr, expected uint32) {
+		t.Helper()
+		n, err := ps.CountPeersByIP(ctx, ih, addr)
+		require.Nil(t, err)
+		require.Equal(t, expected, n)
+	}
+
+	for _, indexed := range []bool{false, true} {
+		ps := newMiniStore(t, 1)
+		ps.peerIPIndex = indexed
+		requireCount(ps, ip, 0)
+
+		require.Nil(t, ps.PutSeeder(ctx, ih, peer(1, ip, 1000)))
+		require.Nil(t, ps.PutLeecher(ctx, ih, peer(2, ip, 1001)))
+		require.Nil(t, ps.PutLeecher(ctx, ih, peer(3, ip, 1002)))
+		require.Nil(t, ps.PutLeecher(ctx, ih, peer(4, other, 1000)))
+		// re-announce is not counted twice
+		require.Nil(t, ps.PutLeecher(ctx, ih, peer(3, ip, 1002)))
+		requireCount(ps, ip, 3)
+		requireCount(ps, netip.AddrFrom16(ip.As16()), 3)
+		requireCount(ps, other, 1)
+		requireCount(ps, netip.MustParseAddr("fc00::1"), 0)
+
+		require.Nil(t, ps.GraduateLeecher(ctx, ih, peer(2, ip, 1001)))
+		require.Nil(t, ps.DeleteLeecher(ctx, ih, peer(3, ip, 1002)))
+		requireCount(ps, ip, 2)
+		if indexed {
+			key := PeerIPKey(InfoHashKey(ih.RawString(), true, false))
+			require.Equal(t, "CHI_AS4_01234567890123456789", key)
+			require.Equal(t, int64(2), ps.ZCard(ctx, key).Val())
+		}
+
+		ps.gc(time.Now().Add(time.Minute))
+		requireCount(ps, ip, 0)
+		requireCount(ps, other, 0)
+
+		require.Nil(t, ps.PutSeeder(ctx, ih, peer(1, ip, 1000)))
+		require.Nil(t, ps.PurgeSwarm(ctx, ih))
+		requireCount(ps, ip, 0)
+	}
+}
+
+func TestPeerIPIndexMigration(t *testing.T) {
+	ctx := context.Background()
+	ps := newMiniStore(t, 1)
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	ip := netip.MustParseAddr("10.0.0.1")
+
+	// peer stored before index was enabled
+	require.Nil(t, ps.PutLeecher(ctx, ih, bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.AddrPortFrom(ip, 1000)}))
+	ps.peerIPIndex = true
+	require.Nil(t, ps.PutLeecher(ctx, ih, bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.AddrPortFrom(ip, 1001)}))
+
+	n, err := ps.CountPeersByIP(ctx, ih, ip)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), n)
+}
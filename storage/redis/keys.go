@@ -0,0 +1,149 @@
+package redis
+
+import (
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// KeySet holds redis keys and key prefixes built from
+// configured key prefix (see Config.KeyPrefix), so several
+// trackers may share one redis database without collisions.
+// Fields have the same meaning as package constants with the same name.
+type KeySet struct {
+	PrefixKey          string
+	IHKey              string
+	IHShardKeyPrefix   string
+	IH4SeederKey       string
+	IH6SeederKey       string
+	IH4LeecherKey      string
+	IH6LeecherKey      string
+	CountSeederKey     string
+	CountLeecherKey    string
+	CountDownloadsKey  string
+	EmptySwarmKey      string
+	PeerTimeKeyPrefix  string
+	PeerIPKeyPrefix    string
+	PeerStatsKeyPrefix string
+	PeerIDKeyPrefix    string
+}
+
+// defaultKeySet contains keys with default PrefixKey
+var defaultKeySet = NewKeySet(PrefixKey)
+
+// NewKeySet builds keys with provided prefix.
+// If prefix is empty, PrefixKey used.
+func NewKeySet(prefix string) KeySet {
+	if len(prefix) == 0 {
+		prefix = PrefixKey
+	}
+	ihKey := prefix + "I"
+	return KeySet{
+		PrefixKey:          prefix,
+		IHKey:              ihKey,
+		IHShardKeyPrefix:   ihKey + "_",
+		IH4SeederKey:       prefix + "S4_",
+		IH6SeederKey:       prefix + "S6_",
+		IH4LeecherKey:      prefix + "L4_",
+		IH6LeecherKey:      prefix + "L6_",
+		CountSeederKey:     prefix + "C_S",
+		CountLeecherKey:    prefix + "C_L",
+		CountDownloadsKey:  prefix + "D",
+		EmptySwarmKey:      prefix + "E",
+		PeerTimeKeyPrefix:  prefix + "T",
+		PeerIPKeyPrefix:    prefix + "A",
+		PeerStatsKeyPrefix: prefix + "U",
+		PeerIDKeyPrefix:    prefix + "P",
+	}
+}
+
+// IHSetKey returns redis key of info hashes set (or set shard
+// if shards greater than 1), which should contain provided infoHashKey
+func (ks KeySet) IHSetKey(infoHashKey string, shards int) string {
+	if shards <= 1 {
+		return ks.IHKey
+	}
+	return ks.IHShardKeyPrefix + strconv.FormatUint(xxhash.Sum64String(infoHashKey)%uint64(shards), 10)
+}
+
+// InfoHashKey generates redis key for provided hash and flags
+func (ks KeySet) InfoHashKey(infoHash string, seeder, v6 bool) (infoHashKey string) {
+	var bm int
+	if seeder {
+		bm = 0b01
+	}
+	if v6 {
+		bm |= 0b10
+	}
+	switch bm {
+	case 0b11:
+		infoHashKey = ks.IH6SeederKey
+	case 0b10:
+		infoHashKey = ks.IH6LeecherKey
+	case 0b01:
+		infoHashKey = ks.IH4SeederKey
+	case 0b00:
+		infoHashKey = ks.IH4LeecherKey
+	}
+	infoHashKey += infoHash
+	return
+}
+
+// PeerTimeKey returns redis key of sorted set, which indexes peers
+// stored in infoHashKey hash by last announce time
+func (ks KeySet) PeerTimeKey(infoHashKey string) string {
+	return ks.PeerTimeKeyPrefix + infoHashKey[len(ks.PrefixKey):]
+}
+
+// PeerIPKey returns redis key of sorted set, which indexes peers
+// stored in infoHashKey hash by IP address
+func (ks KeySet) PeerIPKey(infoHashKey string) string {
+	return ks.PeerIPKeyPrefix + infoHashKey[len(ks.PrefixKey):]
+}
+
+// PeerStatsKey returns redis key of hash, which holds statistics
+// of peers stored in infoHashKey hash
+func (ks KeySet) PeerStatsKey(infoHashKey string) string {
+	return ks.PeerStatsKeyPrefix + infoHashKey[len(ks.PrefixKey):]
+}
+
+// PeerIDKey returns redis key of hash, which indexes peers
+// stored in infoHashKey hash by peer ID
+func (ks KeySet) PeerIDKey(infoHashKey string) string {
+	return ks.PeerIDKeyPrefix + infoHashKey[len(ks.PrefixKey):]
+}
+
+// swarmKeys returns keys of seeders and leechers hashes of provided info hash
+func (ks KeySet) swarmKeys(infoHash string) []string {
+	return []string{
+		ks.InfoHashKey(infoHash, true, false),
+		ks.InfoHashKey(infoHash, true, true),
+		ks.InfoHashKey(infoHash, false, false),
+		ks.InfoHashKey(infoHash, false, true),
+	}
+}
+
+// IHSetKey is KeySet.IHSetKey with default PrefixKey
+func IHSetKey(infoHashKey string, shards int) string {
+	return defaultKeySet.IHSetKey(infoHashKey, shards)
+}
+
+// InfoHashKey is KeySet.InfoHashKey with default PrefixKey
+func InfoHashKey(infoHash string, seeder, v6 bool) string {
+	return defaultKeySet.InfoHashKey(infoHash, seeder, v6)
+}
+
+// PeerTimeKey is KeySet.PeerTimeKey with default PrefixKey
+func PeerTimeKey(infoHashKey string) string {
+	return defaultKeySet.PeerTimeKey(infoHashKey)
+}
+
+// PeerIPKey is KeySet.PeerIPKey with default PrefixKey
+func PeerIPKey(infoHashKey string) string {
+	return defaultKeySet.PeerIPKey(infoHashKey)
+}
+
+// PeerStatsKey is KeySet.PeerStatsKey with default PrefixKey
+func PeerStatsKey(infoHashKey string) string {
+	return defaultKeySet.PeerStatsKey(infoHashKey)
+}
@@ -0,0 +1,51 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestMalformedPeers(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+	key := InfoHashKey(ih.RawString(), true, false)
+	const malformed = "not a peer"
+	require.Nil(t, ps.HSet(ctx, key, malformed, time.Now().UnixNano()).Err())
+	require.Nil(t, ps.Incr(ctx, CountSeederKey).Err())
+
+	before := testutil.ToFloat64(storage.PromMalformedPeersTotal)
+	peers, err := ps.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{peer}, peers)
+	require.Equal(t, before+1, testutil.ToFloat64(storage.PromMalformedPeersTotal))
+
+	// GC without cleanup keeps fresh malformed peer
+	ps.gc(time.Now().Add(-time.Hour))
+	exists, err := ps.HExists(ctx, key, malformed).Result()
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	ps.gcMalformed = true
+	ps.gc(time.Now().Add(-time.Hour))
+	exists, err = ps.HExists(ctx, key, malformed).Result()
+	require.Nil(t, err)
+	require.False(t, exists)
+	require.Equal(t, before+2, testutil.ToFloat64(storage.PromMalformedPeersTotal))
+	require.Equal(t, uint64(1), ps.count(CountSeederKey, false))
+
+	peers, err = ps.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{peer}, peers)
+}
@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// delPeerIDScript deletes peer, which key is stored in peer ID index
+// under provided peer ID, from swarm hash and index and decrements
+// seeders or leechers counter if peer existed.
+//
+// KEYS[1] - info hash key, KEYS[2] - peer ID index key, KEYS[3] - counter.
+// ARGV[1] - peer ID.
+//
+// Returns deleted peer key or nil if peer does not exist.
+var delPeerIDScript = redis.NewScript(`
+local peer = redis.call('HGET', KEYS[2], ARGV[1])
+if not peer then
+	return nil
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+if redis.call('HDEL', KEYS[1], peer) == 0 then
+	return nil
+end
+redis.call('DECR', KEYS[3])
+return peer
+`)
+
+// delPeerIDsScript deletes fields of peer ID index, which point
+// to provided peers, fields of the same peer IDs, which point to peers
+// with other address (i.e. re-announced), are kept.
+//
+// KEYS[1] - peer ID index key.
+// ARGV[1] - length of peer ID, ARGV[2..] - peer keys.
+//
+// Returns the number of deleted fields.
+var delPeerIDsScript = redis.NewScript(`
+local idLen = tonumber(ARGV[1])
+local n = 0
+for i = 2, #ARGV do
+	local id = string.sub(ARGV[i], 1, idLen)
+	if redis.call('HGET', KEYS[1], id) == ARGV[i] then
+		n = n + redis.call('HDEL', KEYS[1], id)
+	end
+end
+return n
+`)
+
+// putPeerID stores peerID of infoHashKey into peer ID index
+// if peerIDIndex enabled. Index field expires with peer
+// if field TTL is enabled.
+func (ps *store) putPeerID(ctx context.Context, tx redis.Pipeliner, infoHashKey, peerID string) error {
+	if !ps.peerIDIndex {
+		return nil
+	}
+	idKey, id := ps.PeerIDKey(infoHashKey), peerID[:bittorrent.PeerIDLen]
+	if err := tx.HSet(ctx, idKey, id, peerID).Err(); err != nil {
+		return err
+	}
+	return ps.expirePeer(ctx, tx, idKey, id)
+}
+
+// delPeerIDs deletes peer IDs of peerIDs of infoHashKey from
+// peer ID index if peerIDIndex enabled and index still points
+// to the same peers
+func (ps *store) delPeerIDs(ctx context.Context, cmd redis.Cmdable, infoHashKey string, peerIDs ...string) error {
+	if !ps.peerIDIndex || len(peerIDs) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(peerIDs)+1)
+	args = append(args, bittorrent.PeerIDLen)
+	for _, peerID := range peerIDs {
+		args = append(args, peerID)
+	}
+	run := delPeerIDsScript.Run
+	if _, isPipe := cmd.(redis.Pipeliner); isPipe {
+		// script existence can not be checked within pipeline
+		run = delPeerIDsScript.Eval
+	}
+	return NoResultErr(run(ctx, cmd, []string{ps.PeerIDKey(infoHashKey)}, args...).Err())
+}
+
+// peerIDStore is the store, which supports storage.PeerIDDeleter
+// with peer ID index
+type peerIDStore struct {
+	*store
+}
+
+// DeletePeerID looks up peer by ID in peer ID index, deletes it
+// and decrements counter with one script call. Peer, which stored
+// with several addresses in the same swarm, is indexed only with the last
+// announced address, others are deleted by garbage collection.
+func (ps peerIDStore) DeletePeerID(ctx context.Context, ih bittorrent.InfoHash, id bittorrent.PeerID, v6 bool) error {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Stringer("peerID", id).
+		Bool("v6", v6).
+		Msg("delete peer ID")
+	infoHash, found := ih.RawString(), false
+	for _, seeder := range []bool{true, false} {
+		countKey := ps.CountLeecherKey
+		if seeder {
+			countKey = ps.CountSeederKey
+		}
+		deleted, err := ps.delPeerID(ctx, ps.InfoHashKey(infoHash, seeder, v6), countKey, id.RawString())
+		if err != nil {
+			return err
+		}
+		found = found || deleted
+	}
+	if !found {
+		return storage.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+func (ps peerIDStore) delPeerID(ctx context.Context, infoHashKey, peerCountKey, id string) (bool, error) {
+	peerID, err := delPeerIDScript.Run(ctx, ps.UniversalClient,
+		[]string{infoHashKey, ps.PeerIDKey(infoHashKey), peerCountKey}, id).Text()
+	if err = NoResultErr(err); err != nil || len(peerID) == 0 {
+		if err != nil {
+			err = fmt.Errorf("unable to delete peer by ID: %w", err)
+		}
+		return false, err
+	}
+	_, err = ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		if ps.peerTimeIndex {
+			p.ZRem(ctx, ps.PeerTimeKey(infoHashKey), peerID)
+		}
+		if ps.peerIPIndex {
+			p.ZRem(ctx, ps.PeerIPKey(infoHashKey), ipIndexMember(peerID))
+		}
+		return ps.delPeerStats(ctx, p, infoHashKey, peerID)
+	})
+	return true, NoResultErr(err)
+}
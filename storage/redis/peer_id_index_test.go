@@ -0,0 +1,40 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestPeerIDIndexKeepsReannounced(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	key := InfoHashKey(ih.RawString(), true, false)
+	old := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	moved := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+
+	for name, del := range map[string]func(ps *store) error{
+		"DeleteSeeder": func(ps *store) error { return ps.DeleteSeeder(ctx, ih, old) },
+		"DeletePeers":  func(ps *store) error { return ps.DeletePeers(ctx, ih, old) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ps := newMiniStore(t, 1)
+			ps.peerIDIndex = true
+			require.Nil(t, ps.PutSeeder(ctx, ih, old))
+			require.Nil(t, ps.PutSeeder(ctx, ih, moved))
+			require.Equal(t, PackPeer(moved), ps.HGet(ctx, ps.PeerIDKey(key), old.ID.RawString()).Val())
+
+			// index points to re-announced peer, it is not deleted with old one
+			require.Nil(t, del(ps))
+			require.Equal(t, PackPeer(moved), ps.HGet(ctx, ps.PeerIDKey(key), old.ID.RawString()).Val())
+			require.Nil(t, peerIDStore{ps}.DeletePeerID(ctx, ih, moved.ID, false))
+			exists, err := ps.HExists(ctx, key, PackPeer(moved)).Result()
+			require.Nil(t, err)
+			require.False(t, exists)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/str2bytes"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// peerStatsLen is the length of packed storage.PeerStats
+const peerStatsLen = 3 * 8
+
+// packPeerStats generates concatenation of uploaded, downloaded
+// and left counters (big endian)
+func packPeerStats(stats storage.PeerStats) string {
+	b := make([]byte, peerStatsLen)
+	binary.BigEndian.PutUint64(b[0:8], stats.Uploaded)
+	binary.BigEndian.PutUint64(b[8:16], stats.Downloaded)
+	binary.BigEndian.PutUint64(b[16:24], stats.Left)
+	return str2bytes.BytesToString(b)
+}
+
+// unpackPeerStats is the reverse of packPeerStats,
+// data with invalid length is treated as zero statistics
+func unpackPeerStats(data string) (stats storage.PeerStats) {
+	if len(data) == peerStatsLen {
+		b := str2bytes.StringToBytes(data)
+		stats.Uploaded = binary.BigEndian.Uint64(b[0:8])
+		stats.Downloaded = binary.BigEndian.Uint64(b[8:16])
+		stats.Left = binary.BigEndian.Uint64(b[16:24])
+	}
+	return
+}
+
+// putPeerStats stores statistics from ctx (see storage.WithPeerStats)
+// of peerID into statistics hash of infoHashKey if peerStats enabled.
+// If there are no statistics in ctx, fallback is stored if not empty.
+func (ps *store) putPeerStats(ctx context.Context, tx redis.Pipeliner, infoHashKey, peerID, fallback string) error {
+	if !ps.peerStats {
+		return nil
+	}
+	packed := fallback
+	if stats, found := storage.PeerStatsFromContext(ctx); found {
+		packed = packPeerStats(stats)
+	}
+	if len(packed) == 0 {
+		return nil
+	}
+	statsKey := ps.PeerStatsKey(infoHashKey)
+	if err := tx.HSet(ctx, statsKey, peerID, packed).Err(); err != nil {
+		return err
+	}
+	return ps.expirePeer(ctx, tx, statsKey, peerID)
+}
+
+// delPeerStats deletes statistics of peerIDs of infoHashKey
+// if peerStats enabled
+func (ps *store) delPeerStats(ctx context.Context, cmd redis.Cmdable, infoHashKey string, peerIDs ...string) error {
+	if !ps.peerStats || len(peerIDs) == 0 {
+		return nil
+	}
+	return NoResultErr(cmd.HDel(ctx, ps.PeerStatsKey(infoHashKey), peerIDs...).Err())
+}
+
+// PeerStats - storage.PeerStatsStorage implementation.
+// Statistics of peers stored before Config.PeerStats enabled are zero.
+func (ps *store) PeerStats(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (storage.PeerStats, error) {
+	infoHash, peerID, v6 := ih.RawString(), PackPeer(peer), peer.Addr().Is6()
+	cmds := make([]*redis.StringCmd, 0, 2)
+	_, err := ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, seeder := range []bool{true, false} {
+			cmds = append(cmds, p.HGet(ctx, ps.PeerStatsKey(ps.InfoHashKey(infoHash, seeder, v6)), peerID))
+		}
+		return nil
+	})
+	if err = NoResultErr(err); err != nil {
+		return storage.PeerStats{}, err
+	}
+	for _, cmd := range cmds {
+		if data := cmd.Val(); len(data) > 0 {
+			return unpackPeerStats(data), nil
+		}
+	}
+	return storage.PeerStats{}, nil
+}
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestPeerStats(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ps, err := newStore(Config{
+		Addresses:      []string{mr.Addr()},
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		ConnectTimeout: time.Second,
+		PeerStats:      true,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	legacy := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+	leecherStats := storage.PeerStats{Uploaded: 1, Downloaded: 2, Left: 3}
+	require.Nil(t, ps.PutLeecher(storage.WithPeerStats(ctx, leecherStats), ih, peer))
+	// peer stored without statistics (i.e. before option enabled)
+	require.Nil(t, ps.PutLeecher(ctx, ih, legacy))
+
+	stats, err := storage.LoadPeerStats(ctx, ps, ih, peer)
+	require.Nil(t, err)
+	require.Equal(t, leecherStats, stats)
+	stats, err = ps.PeerStats(ctx, ih, legacy)
+	require.Nil(t, err)
+	require.Zero(t, stats)
+
+	// statistics are preserved if announce does not carry them
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer))
+	require.False(t, mr.Exists(ps.PeerStatsKey(ps.InfoHashKey(ih.RawString(), false, false))))
+	stats, err = ps.PeerStats(ctx, ih, peer)
+	require.Nil(t, err)
+	require.Equal(t, leecherStats, stats)
+
+	seederStats := storage.PeerStats{Uploaded: 4, Downloaded: 5}
+	require.Nil(t, ps.PutSeeder(storage.WithPeerStats(ctx, seederStats), ih, peer))
+	stats, err = ps.PeerStats(ctx, ih, peer)
+	require.Nil(t, err)
+	require.Equal(t, seederStats, stats)
+
+	ps.gc(time.Now().Add(time.Hour))
+	require.False(t, mr.Exists(ps.PeerStatsKey(ps.InfoHashKey(ih.RawString(), true, false))))
+	stats, err = ps.PeerStats(ctx, ih, peer)
+	require.Nil(t, err)
+	require.Zero(t, stats)
+}
@@ -0,0 +1,36 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestPeersExist(t *testing.T) {
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	seeder4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	seeder6 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("[fd00::1]:1234")}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+	unknown := bittorrent.Peer{ID: bittorrent.PeerID{3}, AddrPort: netip.MustParseAddrPort("10.0.0.3:1234")}
+
+	ps := newMiniStore(t, 1)
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder4))
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder6))
+	require.Nil(t, ps.PutLeecher(ctx, ih, leecher))
+
+	peers := []bittorrent.Peer{seeder4, leecher, seeder6, unknown}
+	exists, err := ps.PeersExist(ctx, ih, peers, true)
+	require.Nil(t, err)
+	require.Equal(t, []bool{true, false, true, false}, exists)
+	exists, err = ps.PeersExist(ctx, ih, peers, false)
+	require.Nil(t, err)
+	require.Equal(t, []bool{false, true, false, false}, exists)
+	exists, err = ps.PeersExist(ctx, ih, nil, false)
+	require.Nil(t, err)
+	require.Empty(t, exists)
+}
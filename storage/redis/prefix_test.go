@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestKeyPrefixIsolation(t *testing.T) {
+	mr := miniredis.RunT(t)
+	newPrefixedStore := func(prefix string) *store {
+		ps, err := newStore(Config{
+			Addresses:      []string{mr.Addr()},
+			ReadTimeout:    time.Second,
+			WriteTimeout:   time.Second,
+			ConnectTimeout: time.Second,
+			KeyPrefix:      prefix,
+		})
+		require.Nil(t, err)
+		t.Cleanup(func() { _ = ps.Close() })
+		return ps
+	}
+	def, other := newPrefixedStore(""), newPrefixedStore("MOCHI2_")
+	require.Equal(t, PrefixKey, def.PrefixKey)
+	require.Equal(t, "MOCHI2_S4_ih", other.InfoHashKey("ih", true, false))
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, def.PutSeeder(ctx, ih, peer))
+	require.Nil(t, other.PutLeecher(ctx, ih, peer))
+	require.True(t, mr.Exists(InfoHashKey(ih.RawString(), true, false)))
+	require.True(t, mr.Exists(other.InfoHashKey(ih.RawString(), false, false)))
+
+	leechers, seeders, _, err := def.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, [2]uint32{0, 1}, [2]uint32{leechers, seeders})
+	leechers, seeders, _, err = other.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, [2]uint32{1, 0}, [2]uint32{leechers, seeders})
+
+	require.Nil(t, def.Put(ctx, "ctx", storage.Entry{Key: "k", Value: []byte("v")}))
+	contains, err := other.Contains(ctx, "ctx", "k")
+	require.Nil(t, err)
+	require.False(t, contains)
+	contains, err = def.Contains(ctx, "ctx", "k")
+	require.Nil(t, err)
+	require.True(t, contains)
+
+	// GC of one store must not touch peers of another
+	other.gc(time.Now().Add(time.Hour))
+	_, seeders, _, err = def.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+	leechers, _, _, err = other.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Zero(t, leechers)
+	require.Equal(t, uint64(1), def.count(def.CountSeederKey, false))
+}
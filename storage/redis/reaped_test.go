@@ -0,0 +1,50 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestGCReapedByReason(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ps.gcMalformed = true
+	ctx := context.Background()
+
+	reaped := func() (expired, empty, malformed float64) {
+		return testutil.ToFloat64(storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonExpired)),
+			testutil.ToFloat64(storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonEmptySwarm)),
+			testutil.ToFloat64(storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonMalformed))
+	}
+
+	stale, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	fresh, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, ps.PutSeeder(ctx, stale, peer))
+	require.Nil(t, ps.PutLeecher(ctx, stale, peer))
+	require.Nil(t, ps.PutSeeder(ctx, fresh, peer))
+	freshKey := InfoHashKey(fresh.RawString(), true, false)
+	require.Nil(t, ps.HSet(ctx, freshKey, "not a peer", time.Now().Add(time.Hour).UnixNano()).Err())
+	require.Nil(t, ps.Incr(ctx, CountSeederKey).Err())
+	// make peers of stale swarm outdated
+	for _, seeder := range []bool{true, false} {
+		require.Nil(t, ps.HSet(ctx, InfoHashKey(stale.RawString(), seeder, false), PackPeer(peer), 0).Err())
+	}
+
+	expired, empty, malformed := reaped()
+	ps.gc(time.Now().Add(-time.Hour))
+	e, em, m := reaped()
+	require.Equal(t, expired+2, e)
+	require.Equal(t, empty+2, em)
+	require.Equal(t, malformed+1, m)
+	_, seeders, _, err := ps.ScrapeSwarm(ctx, fresh)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+}
@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func newMiniStore(t *testing.T, shards int) *store {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	ps, err := newStore(Config{
+		Addresses:      []string{mr.Addr()},
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		ConnectTimeout: time.Second,
+		InfoHashShards: shards,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ps.Close() })
+	return ps
+}
+
+func TestIHSetKey(t *testing.T) {
+	key := InfoHashKey("01234567890123456789", true, false)
+	require.Equal(t, IHKey, IHSetKey(key, 0))
+	require.Equal(t, IHKey, IHSetKey(key, 1))
+	shardKey := IHSetKey(key, 8)
+	require.Equal(t, shardKey, IHSetKey(key, 8))
+	require.Contains(t, (&store{Connection: Connection{KeySet: defaultKeySet}, ihShards: 8}).ihSetKeys(), shardKey)
+}
+
+func TestShardedGC(t *testing.T) {
+	const shards = 4
+	ps := newMiniStore(t, shards)
+	ctx := context.Background()
+
+	used := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		ih, _ := bittorrent.NewInfoHash([]byte{
+			byte(i), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+		})
+		peer := bittorrent.Peer{ID: bittorrent.PeerID{byte(i)}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+		require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+		key := InfoHashKey(ih.RawString(), true, false)
+		setKey := ps.ihSetKey(key)
+		used[setKey] = true
+		isMember, err := ps.SIsMember(ctx, setKey, key).Result()
+		require.Nil(t, err)
+		require.True(t, isMember)
+	}
+	require.Greater(t, len(used), 1)
+
+	var total uint64
+	for _, k := range ps.ihSetKeys() {
+		total += ps.count(k, true)
+	}
+	require.Equal(t, uint64(32), total)
+
+	ps.gc(time.Now().Add(time.Hour))
+
+	for _, k := range ps.ihSetKeys() {
+		require.Zero(t, ps.count(k, true), k)
+	}
+	require.Zero(t, ps.count(CountSeederKey, false))
+}
+
+func TestChunkedGC(t *testing.T) {
+	ps := newMiniStore(t, 2)
+	ps.gcMaxPerPass = 5
+	ctx := context.Background()
+
+	const total = 20
+	for i := 0; i < total; i++ {
+		ih, _ := bittorrent.NewInfoHash([]byte{
+			byte(i), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+		})
+		peer := bittorrent.Peer{ID: bittorrent.PeerID{byte(i)}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+		require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+	}
+
+	remaining := func() (n uint64) {
+		for _, k := range ps.ihSetKeys() {
+			n += ps.count(k, true)
+		}
+		return
+	}
+
+	prev, passes := remaining(), 0
+	require.Equal(t, uint64(total), prev)
+	for prev > 0 {
+		ps.gc(time.Now().Add(time.Hour))
+		passes++
+		cur := remaining()
+		require.Less(t, cur, prev, "gc must advance through keyspace")
+		require.GreaterOrEqual(t, prev-cur, uint64(1))
+		require.LessOrEqual(t, prev-cur, uint64(ps.gcMaxPerPass)*2, "gc must process bounded chunk")
+		prev = cur
+		require.Less(t, passes, total, "gc must finish keyspace")
+	}
+	require.Greater(t, passes, 1)
+	require.Zero(t, ps.count(CountSeederKey, false))
+}
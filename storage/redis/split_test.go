@@ -0,0 +1,50 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestMemoryPeersRedisData(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ds, err := storage.NewDataStorage(conf.NamedMapConfig{
+		Name:   "redis",
+		Config: conf.MapConfig{"addresses": []string{mr.Addr()}},
+	})
+	require.Nil(t, err)
+	peers, err := memory.NewPeerStorage(memory.Config{})
+	require.Nil(t, err)
+	ps := storage.NewSplitStorage(peers, ds)
+	defer ps.Close()
+	ctx := context.Background()
+
+	require.True(t, ps.Preservable())
+	_, isOk := ps.(storage.PeerIDDeleter)
+	require.True(t, isOk)
+	_, isOk = ps.(storage.PeerChecker)
+	require.True(t, isOk)
+	require.Nil(t, ps.Ping(ctx))
+
+	require.Nil(t, ps.Put(ctx, "TEST", storage.Entry{Key: "k", Value: []byte("v")}))
+	require.Equal(t, "v", mr.HGet(PrefixKey+"TEST", "k"))
+	v, err := ps.Load(ctx, "TEST", "k")
+	require.Nil(t, err)
+	require.Equal(t, []byte("v"), v)
+
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+	_, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+	require.False(t, mr.Exists(InfoHashKey(ih.RawString(), true, false)))
+}
@@ -6,13 +6,29 @@
 //     To save peers that hold the infohash, used for fast searching,
 //     deleting, and timeout handling
 //
-//   - CHI_I (set type)
+//   - CHI_I or CHI_I_<N> (set type)
 //     To save all the infohashes, used for garbage collection,
-//     metrics aggregation and leecher graduation
+//     metrics aggregation and leecher graduation.
+//     If info_hash_shards is greater than 1, set split into
+//     several shards CHI_I_0 .. CHI_I_{N-1}
+//
+//   - CHI_T{L,S}{4,6}_<HASH> (sorted set type)
+//     To index peers of the infohash by last announce time (if
+//     peer_time_index is set), used for garbage collection and
+//     eviction of the oldest peers.
+//
+//   - CHI_A{L,S}{4,6}_<HASH> (sorted set type)
+//     To index peers of the infohash by IP address (if
+//     peer_ip_index is set), used for counting peers with the same IP.
 //
 //   - CHI_D (hash type)
 //     To record the number of torrent downloads.
 //
+//   - CHI_E (sorted set type)
+//     To record infohashes of empty swarms with the time they became empty,
+//     used to purge download counts of swarms which are empty longer
+//     than empty_swarm_ttl (if set).
+//
 // Two keys are used to record the count of seeders and leechers.
 //
 //   - CHI_C_S (key type)
@@ -24,11 +40,16 @@ package redis
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/netip"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -51,10 +72,15 @@ const (
 	defaultReadTimeout    = time.Second * 15
 	defaultWriteTimeout   = time.Second * 15
 	defaultConnectTimeout = time.Second * 15
-	// PrefixKey prefix which will be prepended to ctx argument in storage.DataStorage calls
+	defaultInfoHashShards = 1
+	defaultGCScanCount    = 1000
+	// PrefixKey default prefix of all keys (see Config.KeyPrefix),
+	// which will be prepended to ctx argument in storage.DataStorage calls
 	PrefixKey = "CHI_"
 	// IHKey redis hash key for all info hashes
 	IHKey = "CHI_I"
+	// IHShardKeyPrefix redis key prefix of info hashes set shard
+	IHShardKeyPrefix = IHKey + "_"
 	// IH4SeederKey redis hash key prefix for IPv4 seeders
 	IH4SeederKey = "CHI_S4_"
 	// IH6SeederKey redis hash key prefix for IPv6 seeders
@@ -69,12 +95,32 @@ const (
 	CountLeecherKey = "CHI_C_L"
 	// CountDownloadsKey redis key for snatches (downloads) count
 	CountDownloadsKey = "CHI_D"
+	// EmptySwarmKey redis sorted set key for empty swarms
+	EmptySwarmKey = "CHI_E"
+	// PeerTimeKeyPrefix redis sorted set key prefix for peers
+	// indexed by last announce time, followed by info hash key
+	// without PrefixKey (i.e. CHI_TS4_<HASH>)
+	PeerTimeKeyPrefix = "CHI_T"
+	// PeerIPKeyPrefix redis sorted set key prefix for peers
+	// indexed by IP address, followed by info hash key
+	// without PrefixKey (i.e. CHI_AS4_<HASH>)
+	PeerIPKeyPrefix = "CHI_A"
+	// PeerStatsKeyPrefix redis hash key prefix for uploaded, downloaded
+	// and left counters of peers, followed by info hash key
+	// without PrefixKey (i.e. CHI_US4_<HASH>)
+	PeerStatsKeyPrefix = "CHI_U"
+	// PeerIDKeyPrefix redis hash key prefix for peers indexed
+	// by peer ID, followed by info hash key without PrefixKey
+	// (i.e. CHI_PS4_<HASH>)
+	PeerIDKeyPrefix = "CHI_P"
 )
 
 var (
 	logger = log.NewLogger("storage/redis")
 	// errSentinelAndClusterChecked returned from initializer if both Config.Sentinel and Config.Cluster provided
 	errSentinelAndClusterChecked = errors.New("unable to use both cluster and sentinel mode")
+	// errTLSCertKeyMismatch returned from initializer if only one of TLS client certificate or key provided
+	errTLSCertKeyMismatch = errors.New("both TLS client certificate and key must be provided")
 )
 
 func init() {
@@ -90,7 +136,11 @@ func builder(icfg conf.MapConfig) (storage.PeerStorage, error) {
 		return nil, err
 	}
 
-	return newStore(cfg)
+	ps, err := newStore(cfg)
+	if err != nil || !ps.peerIDIndex {
+		return ps, err
+	}
+	return peerIDStore{ps}, nil
 }
 
 func newStore(cfg Config) (*store, error) {
@@ -104,7 +154,37 @@ func newStore(cfg Config) (*store, error) {
 		return nil, err
 	}
 
-	return &store{Connection: rs, closed: make(chan any)}, nil
+	var fieldTTL int64
+	if cfg.UseFieldTTL {
+		if err = probeFieldTTL(rs); err == nil {
+			fieldTTL = int64(math.Ceil(cfg.PeerLifetime.Seconds()))
+		} else {
+			logger.Warn().Err(err).Msg("redis does not support hash fields TTL, peers are expired by GC scan")
+		}
+	}
+
+	ps := &store{
+		Connection:    rs,
+		fieldTTL:      fieldTTL,
+		ihShards:      cfg.InfoHashShards,
+		emptySwarmTTL: cfg.EmptySwarmTTL,
+		gcMaxPerPass:  cfg.GCMaxInfoHashesPerPass,
+		gcMalformed:   cfg.GCMalformedPeers,
+		gcScanCount:   int64(cfg.GCScanCount),
+		peerTimeIndex: cfg.PeerTimeIndex,
+		peerIPIndex:   cfg.PeerIPIndex,
+		peerStats:     cfg.PeerStats,
+		peerIDIndex:   cfg.PeerIDIndex,
+		maxPeers:      int64(cfg.MaxPeersPerSwarm),
+		trackedDLOnly: cfg.TrackedDownloadsOnly,
+		purgeResetsDL: cfg.PurgeResetsDownloads,
+		closed:        make(chan any),
+	}
+	if cfg.GCScriptBatchSize > 0 {
+		ps.gcBatch = ps.loadGCScript(cfg.GCScriptBatchSize)
+	}
+
+	return ps, nil
 }
 
 // Config holds the configuration of a redis PeerStorage.
@@ -121,6 +201,122 @@ type Config struct {
 	ReadTimeout    time.Duration `cfg:"read_timeout"`
 	WriteTimeout   time.Duration `cfg:"write_timeout"`
 	ConnectTimeout time.Duration `cfg:"connect_timeout"`
+	InfoHashShards int           `cfg:"info_hash_shards"`
+	EmptySwarmTTL  time.Duration `cfg:"empty_swarm_ttl"`
+	// GCMaxInfoHashesPerPass limits number of info hashes processed
+	// by one GC pass, next pass continues from the position where
+	// previous one stopped. Zero means no limit.
+	GCMaxInfoHashesPerPass int `cfg:"gc_max_info_hashes_per_pass"`
+	// GCScanCount is the COUNT hint of SSCAN used by GC to iterate
+	// info hashes sets page by page. Default is 1000.
+	GCScanCount int `cfg:"gc_scan_count"`
+	// GCMalformedPeers enables deletion of peer records,
+	// which could not be decoded, while GC
+	GCMalformedPeers bool `cfg:"gc_malformed_peers"`
+	// PeerTimeIndex enables sorted sets of peers scored by
+	// last announce time, so GC does not need to fetch whole swarms
+	PeerTimeIndex bool `cfg:"peer_time_index"`
+	// PeerIPIndex enables sorted sets of peers ordered by
+	// IP address, so peers with the same IP are counted without
+	// fetching whole swarms
+	PeerIPIndex bool `cfg:"peer_ip_index"`
+	// PeerStats enables hashes of uploaded, downloaded and left
+	// counters of peers reported in announces (see storage.PeerStats)
+	PeerStats bool `cfg:"peer_stats"`
+	// PeerIDIndex enables hashes of peers keyed by peer ID,
+	// so storage supports storage.PeerIDDeleter
+	PeerIDIndex bool `cfg:"peer_id_index"`
+	// MaxPeersPerSwarm limits number of peers in each swarm hash,
+	// peers with the oldest announce are evicted. Zero means no limit.
+	MaxPeersPerSwarm int `cfg:"max_peers_per_swarm"`
+	// TrackedDownloadsOnly makes GraduateLeecher count download only
+	// if peer was stored as leecher (i.e. not for peers, which
+	// first announced with `completed` event)
+	TrackedDownloadsOnly bool `cfg:"tracked_downloads_only"`
+	// PurgeResetsDownloads makes PurgeSwarm delete download count
+	// of info hash, so swarm, which re-appears after purge,
+	// starts counting downloads from zero
+	PurgeResetsDownloads bool `cfg:"purge_resets_downloads"`
+	// TLS holds options of encrypted connection to redis
+	TLS TLSConfig `cfg:"tls"`
+	// UseFieldTTL makes peers expire by TTL of hash fields
+	// (HEXPIRE, Redis 7.4+) equal to PeerLifetime, so GC does not
+	// scan peers announce times, but only reconciles seeders and
+	// leechers counters and removes empty swarms.
+	// Falls back to announce times scan if server does not support it.
+	UseFieldTTL bool `cfg:"use_field_ttl"`
+	// GCScriptBatchSize if greater than zero, GC deletes stale peers
+	// with server-side Lua script, which processes this number of
+	// info hashes in one call. Not used if peer indexes, field TTL or
+	// malformed peers deletion are enabled. Falls back to GC of
+	// every info hash separately if server rejects scripting.
+	GCScriptBatchSize int `cfg:"gc_script_batch_size"`
+	// KeyPrefix is prepended to all keys created by storage,
+	// allows several trackers to use the same redis database.
+	// Default is PrefixKey.
+	KeyPrefix string `cfg:"key_prefix"`
+	// DataTTL holds TTL of storage.DataStorage contexts (i.e. MW_AUTOBAN).
+	// Hash of context expires if it was not written within TTL.
+	// Contexts without TTL are kept forever.
+	DataTTL map[string]time.Duration `cfg:"data_ttl"`
+
+	// tlsConfig is built from TLS by Validate
+	tlsConfig *tls.Config
+}
+
+// TLSConfig holds options of TLS connection to redis
+// (or TLS proxy in front of it, i.e. stunnel).
+type TLSConfig struct {
+	// Enabled turns on TLS
+	Enabled bool `cfg:"enabled"`
+	// CAFile is the path to PEM file with certificates of
+	// authorities, which verify server certificate.
+	// System pool is used if empty.
+	CAFile string `cfg:"ca_file"`
+	// CertFile and KeyFile are paths to PEM client certificate
+	// and its key, used if server requires client authentication
+	CertFile string `cfg:"cert_file"`
+	KeyFile  string `cfg:"key_file"`
+	// InsecureSkipVerify disables verification of server certificate
+	InsecureSkipVerify bool `cfg:"insecure_skip_verify"`
+	// ServerName overrides host name, which is used to verify
+	// server certificate (i.e. if redis is addressed by IP)
+	ServerName string `cfg:"server_name"`
+}
+
+// build creates tls.Config from provided options and loads
+// certificates, returns nil if TLS is not enabled
+func (cfg TLSConfig) build() (*tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	// nolint:gosec
+	tc := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if len(cfg.CAFile) > 0 {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read TLS CA file: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file '%s'", cfg.CAFile)
+		}
+	}
+	if len(cfg.CertFile) > 0 || len(cfg.KeyFile) > 0 {
+		if len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0 {
+			return nil, errTLSCertKeyMismatch
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
 }
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -134,6 +330,11 @@ func (cfg Config) Validate() (Config, error) {
 
 	validCfg := cfg
 
+	var err error
+	if validCfg.tlsConfig, err = cfg.TLS.build(); err != nil {
+		return cfg, err
+	}
+
 	addresses := make([]string, 0)
 	if n := len(cfg.Addresses); n > 0 {
 		for _, a := range cfg.Addresses {
@@ -179,6 +380,111 @@ func (cfg Config) Validate() (Config, error) {
 			Msg("falling back to default configuration")
 	}
 
+	if cfg.InfoHashShards < 0 {
+		validCfg.InfoHashShards = defaultInfoHashShards
+		logger.Warn().
+			Str("name", "infoHashShards").
+			Int("provided", cfg.InfoHashShards).
+			Int("default", validCfg.InfoHashShards).
+			Msg("falling back to default configuration")
+	} else if cfg.InfoHashShards == 0 {
+		validCfg.InfoHashShards = defaultInfoHashShards
+	}
+
+	if len(cfg.KeyPrefix) == 0 {
+		validCfg.KeyPrefix = PrefixKey
+	}
+
+	if len(cfg.DataTTL) > 0 {
+		validCfg.DataTTL = make(map[string]time.Duration, len(cfg.DataTTL))
+		for storeCtx, ttl := range cfg.DataTTL {
+			if ttl < 0 {
+				logger.Warn().
+					Str("name", "dataTTL."+storeCtx).
+					Dur("provided", ttl).
+					Dur("default", 0).
+					Msg("falling back to default configuration")
+				continue
+			}
+			if ttl > 0 {
+				validCfg.DataTTL[storeCtx] = ttl
+			}
+		}
+	}
+
+	if cfg.EmptySwarmTTL < 0 {
+		validCfg.EmptySwarmTTL = 0
+		logger.Warn().
+			Str("name", "emptySwarmTTL").
+			Dur("provided", cfg.EmptySwarmTTL).
+			Dur("default", validCfg.EmptySwarmTTL).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.GCMaxInfoHashesPerPass < 0 {
+		validCfg.GCMaxInfoHashesPerPass = 0
+		logger.Warn().
+			Str("name", "gcMaxInfoHashesPerPass").
+			Int("provided", cfg.GCMaxInfoHashesPerPass).
+			Int("default", validCfg.GCMaxInfoHashesPerPass).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.MaxPeersPerSwarm < 0 {
+		validCfg.MaxPeersPerSwarm = 0
+		logger.Warn().
+			Str("name", "maxPeersPerSwarm").
+			Int("provided", cfg.MaxPeersPerSwarm).
+			Int("default", validCfg.MaxPeersPerSwarm).
+			Msg("falling back to default configuration")
+	} else if cfg.MaxPeersPerSwarm > 0 && !cfg.PeerTimeIndex {
+		validCfg.PeerTimeIndex = true
+		logger.Warn().
+			Str("name", "peerTimeIndex").
+			Bool("provided", cfg.PeerTimeIndex).
+			Bool("default", validCfg.PeerTimeIndex).
+			Msg("peer time index is required to limit swarm size, enabling it")
+	}
+
+	if cfg.GCScanCount < 0 {
+		validCfg.GCScanCount = defaultGCScanCount
+		logger.Warn().
+			Str("name", "gcScanCount").
+			Int("provided", cfg.GCScanCount).
+			Int("default", validCfg.GCScanCount).
+			Msg("falling back to default configuration")
+	} else if cfg.GCScanCount == 0 {
+		validCfg.GCScanCount = defaultGCScanCount
+	}
+
+	if cfg.GCScriptBatchSize < 0 {
+		validCfg.GCScriptBatchSize = 0
+		logger.Warn().
+			Str("name", "gcScriptBatchSize").
+			Int("provided", cfg.GCScriptBatchSize).
+			Int("default", validCfg.GCScriptBatchSize).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.UseFieldTTL {
+		if cfg.PeerLifetime <= 0 {
+			validCfg.PeerLifetime = storage.DefaultPeerLifetime
+			logger.Warn().
+				Str("name", "peerLifetime").
+				Dur("provided", cfg.PeerLifetime).
+				Dur("default", validCfg.PeerLifetime).
+				Msg("falling back to default configuration")
+		}
+		if cfg.PeerIPIndex && !validCfg.PeerTimeIndex {
+			validCfg.PeerTimeIndex = true
+			logger.Warn().
+				Str("name", "peerTimeIndex").
+				Bool("provided", cfg.PeerTimeIndex).
+				Bool("default", validCfg.PeerTimeIndex).
+				Msg("peer time index is required to clean IP index of expired peers, enabling it")
+		}
+	}
+
 	return validCfg, nil
 }
 
@@ -195,6 +501,7 @@ func (cfg Config) Connect() (con Connection, err error) {
 			ReadTimeout:  cfg.ReadTimeout,
 			WriteTimeout: cfg.WriteTimeout,
 			PoolSize:     cfg.PoolSize,
+			TLSConfig:    cfg.tlsConfig,
 		})
 	case cfg.Sentinel:
 		rs = redis.NewFailoverClient(&redis.FailoverOptions{
@@ -207,6 +514,7 @@ func (cfg Config) Connect() (con Connection, err error) {
 			WriteTimeout:     cfg.WriteTimeout,
 			PoolSize:         cfg.PoolSize,
 			DB:               cfg.DB,
+			TLSConfig:        cfg.tlsConfig,
 		})
 	default:
 		rs = redis.NewClient(&redis.Options{
@@ -218,6 +526,7 @@ func (cfg Config) Connect() (con Connection, err error) {
 			WriteTimeout: cfg.WriteTimeout,
 			PoolSize:     cfg.PoolSize,
 			DB:           cfg.DB,
+			TLSConfig:    cfg.tlsConfig,
 		})
 	}
 	if err = rs.Ping(context.Background()).Err(); err == nil && !errors.Is(err, redis.Nil) {
@@ -226,13 +535,14 @@ func (cfg Config) Connect() (con Connection, err error) {
 		_ = rs.Close()
 		rs = nil
 	}
-	return Connection{rs}, err
+	return Connection{UniversalClient: rs, KeySet: NewKeySet(cfg.KeyPrefix), dataTTL: cfg.DataTTL}, err
 }
 
 func (ps *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 	ps.wg.Add(1)
 	go func() {
 		defer ps.wg.Done()
+		gate := &storage.GCHealthGate{Pinger: ps, Timeout: gcInterval}
 		t := time.NewTimer(gcInterval)
 		defer t.Stop()
 		for {
@@ -240,17 +550,31 @@ func (ps *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 			case <-ps.closed:
 				return
 			case <-t.C:
-				start := time.Now()
-				ps.gc(time.Now().Add(-peerLifeTime))
-				duration := time.Since(start)
-				logger.Debug().Dur("timeTaken", duration).Msg("gc complete")
-				storage.PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
+				ps.gcCycle(gate, peerLifeTime)
 				t.Reset(gcInterval)
 			}
 		}
 	}()
 }
 
+// gcCycle runs GC and purges empty swarms if storage is available.
+// Returns false if cycle is skipped.
+func (ps *store) gcCycle(gate *storage.GCHealthGate, peerLifeTime time.Duration) bool {
+	if !gate.Allow() {
+		return false
+	}
+	start := time.Now()
+	ps.gc(time.Now().Add(-peerLifeTime))
+	if ps.emptySwarmTTL > 0 {
+		ps.purgeEmptySwarms(time.Now().Add(-ps.emptySwarmTTL))
+	}
+	duration := time.Since(start)
+	logger.Debug().Dur("timeTaken", duration).Msg("gc complete")
+	storage.PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
+	storage.PromLastGCTimestamp.SetToCurrentTime()
+	return true
+}
+
 func (ps *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
 	ps.wg.Add(1)
 	go func() {
@@ -266,13 +590,25 @@ func (ps *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
 					before := time.Now()
 					// populateProm aggregates metrics over all groups and then posts them to
 					// prometheus.
-					numInfoHashes := ps.count(IHKey, true)
-					numSeeders := ps.count(CountSeederKey, false)
-					numLeechers := ps.count(CountLeecherKey, false)
+					failed := false
+					count := func(key string, getLength bool) uint64 {
+						n, err := ps.tryCount(key, getLength)
+						failed = failed || err != nil
+						return n
+					}
+					var numInfoHashes uint64
+					for _, ihSetKey := range ps.ihSetKeys() {
+						numInfoHashes += count(ihSetKey, true)
+					}
+					numSeeders := count(ps.CountSeederKey, false)
+					numLeechers := count(ps.CountLeecherKey, false)
 
 					storage.PromInfoHashesCount.Set(float64(numInfoHashes))
 					storage.PromSeedersCount.Set(float64(numSeeders))
 					storage.PromLeechersCount.Set(float64(numLeechers))
+					if !failed {
+						storage.PromLastStatsTimestamp.SetToCurrentTime()
+					}
 					logger.Debug().TimeDiff("timeTaken", time.Now(), before).Msg("populate prom complete")
 				}
 			}
@@ -281,19 +617,54 @@ func (ps *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
 }
 
 // Connection is wrapper for redis.UniversalClient
+// with keys built from configured prefix
 type Connection struct {
 	redis.UniversalClient
+	KeySet
+	// TTL of storage.DataStorage contexts
+	dataTTL map[string]time.Duration
 }
 
 type store struct {
 	Connection
+	ihShards      int
+	emptySwarmTTL time.Duration
+	// GC chunking state, accessed only from GC routine
+	gcMaxPerPass int
+	gcShard      int
+	gcCursor     uint64
+	gcMalformed  bool
+	gcScanCount  int64
+	// peers time index and swarm size limit
+	peerTimeIndex bool
+	maxPeers      int64
+	// peers IP index
+	peerIPIndex bool
+	// peers statistics hashes
+	peerStats bool
+	// peers ID index
+	peerIDIndex bool
+	// count downloads only for tracked leechers
+	trackedDLOnly bool
+	// delete download count on purge
+	purgeResetsDL bool
+	// TTL of peers hash fields in seconds, disabled if 0
+	fieldTTL int64
+	// number of info hashes processed by one GC script call,
+	// script GC is disabled if 0
+	gcBatch    int
 	closed     chan any
 	wg         sync.WaitGroup
 	onceCloser sync.Once
 }
 
-func (ps *store) count(key string, getLength bool) (n uint64) {
-	var err error
+func (ps *store) count(key string, getLength bool) uint64 {
+	n, _ := ps.tryCount(key, getLength)
+	return n
+}
+
+// tryCount is the same as count, but also returns error of request
+func (ps *store) tryCount(key string, getLength bool) (n uint64, err error) {
 	if getLength {
 		n, err = ps.SCard(context.Background(), key).Uint64()
 	} else {
@@ -306,6 +677,22 @@ func (ps *store) count(key string, getLength bool) (n uint64) {
 	return
 }
 
+func (ps *store) ihSetKey(infoHashKey string) string {
+	return ps.IHSetKey(infoHashKey, ps.ihShards)
+}
+
+// ihSetKeys returns keys of all info hashes set shards
+func (ps *store) ihSetKeys() []string {
+	if ps.ihShards <= 1 {
+		return []string{ps.IHKey}
+	}
+	keys := make([]string, ps.ihShards)
+	for i := range keys {
+		keys[i] = ps.IHShardKeyPrefix + strconv.Itoa(i)
+	}
+	return keys
+}
+
 func (ps *store) getClock() int64 {
 	return timecache.NowUnixNano()
 }
@@ -336,44 +723,181 @@ func NoResultErr(err error) error {
 	return err
 }
 
-// InfoHashKey generates redis key for provided hash and flags
-func InfoHashKey(infoHash string, seeder, v6 bool) (infoHashKey string) {
-	var bm int
-	if seeder {
-		bm = 0b01
+// ipIndexMember converts packed peer (see PackPeer) to member
+// of IP index: IP address is moved to the beginning, so members
+// with the same IP are adjacent in lexicographical order
+func ipIndexMember(peerID string) string {
+	if len(peerID) < peerMinimumLen {
+		// malformed peer, stored as is
+		return peerID
 	}
-	if v6 {
-		bm |= 0b10
+	return peerID[bittorrent.PeerIDLen+2:] + peerID[:bittorrent.PeerIDLen+2]
+}
+
+// toIPMembers converts peer IDs to IP index members
+func toIPMembers(peerIDs []string) []any {
+	members := make([]any, len(peerIDs))
+	for i, peerID := range peerIDs {
+		members[i] = ipIndexMember(peerID)
 	}
-	switch bm {
-	case 0b11:
-		infoHashKey = IH6SeederKey
-	case 0b10:
-		infoHashKey = IH6LeecherKey
-	case 0b01:
-		infoHashKey = IH4SeederKey
-	case 0b00:
-		infoHashKey = IH4LeecherKey
+	return members
+}
+
+// toMembers converts peer IDs to sorted set members
+func toMembers(peerIDs []string) []any {
+	members := make([]any, len(peerIDs))
+	for i, peerID := range peerIDs {
+		members[i] = peerID
 	}
-	infoHashKey += infoHash
-	return
+	return members
+}
+
+// hexpireCmd sets TTL of hash fields (Redis 7.4+)
+const hexpireCmd = "HEXPIRE"
+
+// probeFieldTTL checks if server supports hash fields TTL
+// by setting TTL of field of not existing key
+func probeFieldTTL(con Connection) error {
+	return con.Do(context.Background(), hexpireCmd, con.PrefixKey+"PROBE", 1, "FIELDS", 1, "probe").Err()
 }
 
-func (ps *store) putPeer(ctx context.Context, infoHashKey, peerCountKey, peerID string) error {
+// expirePeer sets TTL of peerID field in infoHashKey hash
+// if field TTL is enabled. Announce time is still stored as value,
+// so data remains valid if field TTL is disabled later.
+func (ps *store) expirePeer(ctx context.Context, tx redis.Pipeliner, infoHashKey, peerID string) error {
+	if ps.fieldTTL <= 0 {
+		return nil
+	}
+	return tx.Do(ctx, hexpireCmd, infoHashKey, ps.fieldTTL, "FIELDS", 1, peerID).Err()
+}
+
+func (ps *store) putPeer(ctx context.Context, infoHash, infoHashKey, peerCountKey, peerID string) error {
 	logger.Trace().
 		Str("infoHashKey", infoHashKey).
 		Str("peerID", peerID).
 		Msg("put peer")
-	return ps.tx(ctx, func(tx redis.Pipeliner) (err error) {
-		if err = tx.HSet(ctx, infoHashKey, peerID, ps.getClock()).Err(); err != nil {
+	now := ps.getClock()
+	err := ps.tx(ctx, func(tx redis.Pipeliner) (err error) {
+		if err = tx.HSet(ctx, infoHashKey, peerID, now).Err(); err != nil {
 			return
 		}
+		if err = ps.expirePeer(ctx, tx, infoHashKey, peerID); err != nil {
+			return
+		}
+		if err = ps.putPeerStats(ctx, tx, infoHashKey, peerID, ""); err != nil {
+			return
+		}
+		if err = ps.putPeerID(ctx, tx, infoHashKey, peerID); err != nil {
+			return
+		}
+		if ps.peerTimeIndex {
+			if err = tx.ZAdd(ctx, ps.PeerTimeKey(infoHashKey), redis.Z{Score: float64(now), Member: peerID}).Err(); err != nil {
+				return
+			}
+		}
+		if ps.peerIPIndex {
+			if err = tx.ZAdd(ctx, ps.PeerIPKey(infoHashKey), redis.Z{Member: ipIndexMember(peerID)}).Err(); err != nil {
+				return
+			}
+		}
 		if err = tx.Incr(ctx, peerCountKey).Err(); err != nil {
 			return
 		}
-		err = tx.SAdd(ctx, IHKey, infoHashKey).Err()
+		if err = tx.SAdd(ctx, ps.ihSetKey(infoHashKey), infoHashKey).Err(); err != nil {
+			return
+		}
+		if ps.emptySwarmTTL > 0 {
+			err = tx.ZRem(ctx, ps.EmptySwarmKey, infoHash).Err()
+		}
 		return
 	})
+	if err == nil {
+		err = ps.evictPeers(ctx, infoHashKey, peerCountKey)
+	}
+	return err
+}
+
+// evictMaxAttempts is the maximal number of evictPeers transaction
+// attempts if swarm is modified concurrently
+const evictMaxAttempts = 3
+
+// purgeMaxAttempts is the maximal number of PurgeSwarm transaction
+// attempts if swarm is modified concurrently
+const purgeMaxAttempts = 5
+
+// errPurgeConflict is returned by PurgeSwarm if swarm is modified
+// concurrently during all purge attempts
+var errPurgeConflict = errors.New("swarm modified concurrently during purge")
+
+// evictPeers deletes peers of infoHashKey with the oldest
+// announce time if swarm size exceeds maxPeers.
+// Swarm and its time index are watched, so peers are evicted and
+// counter is decremented atomically with swarm size check.
+// If swarm is modified concurrently, eviction is retried up to
+// evictMaxAttempts times and then skipped, because it is repeated
+// by the next put. Eviction is also skipped while time index
+// does not contain all peers (i.e. peers stored before the index
+// was enabled and not yet migrated by garbage collection),
+// otherwise recent peers may be evicted instead of the oldest ones.
+func (ps *store) evictPeers(ctx context.Context, infoHashKey, peerCountKey string) (err error) {
+	if ps.maxPeers <= 0 {
+		return nil
+	}
+	timeKey := ps.PeerTimeKey(infoHashKey)
+	for attempt := 0; attempt < evictMaxAttempts; attempt++ {
+		err = ps.Watch(ctx, func(tx *redis.Tx) error {
+			n, err := tx.HLen(ctx, infoHashKey).Result()
+			if err = NoResultErr(err); err != nil || n <= ps.maxPeers {
+				return err
+			}
+			var indexed int64
+			if indexed, err = tx.ZCard(ctx, timeKey).Result(); err != nil || indexed < n {
+				return NoResultErr(err)
+			}
+			var peerIDs []string
+			if peerIDs, err = tx.ZRange(ctx, timeKey, 0, n-ps.maxPeers-1).Result(); err != nil || len(peerIDs) == 0 {
+				return NoResultErr(err)
+			}
+			// peers may be already expired by hash field TTL
+			var values []any
+			if values, err = tx.HMGet(ctx, infoHashKey, peerIDs...).Result(); err != nil {
+				return NoResultErr(err)
+			}
+			var existing int64
+			for _, v := range values {
+				if v != nil {
+					existing++
+				}
+			}
+			logger.Debug().
+				Str("infoHashKey", infoHashKey).
+				Int64("count", existing).
+				Msg("evicting oldest peers")
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.HDel(ctx, infoHashKey, peerIDs...)
+				p.ZRem(ctx, timeKey, toMembers(peerIDs)...)
+				if existing > 0 {
+					p.DecrBy(ctx, peerCountKey, existing)
+				}
+				if ps.peerIPIndex {
+					p.ZRem(ctx, ps.PeerIPKey(infoHashKey), toIPMembers(peerIDs)...)
+				}
+				if err := ps.delPeerIDs(ctx, p, infoHashKey, peerIDs...); err != nil {
+					return err
+				}
+				return ps.delPeerStats(ctx, p, infoHashKey, peerIDs...)
+			})
+			return err
+		}, infoHashKey, timeKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return NoResultErr(err)
+		}
+	}
+	logger.Debug().
+		Str("infoHashKey", infoHashKey).
+		Int("attempts", evictMaxAttempts).
+		Msg("swarm modified concurrently, eviction skipped")
+	return nil
 }
 
 func (ps *store) delPeer(ctx context.Context, infoHashKey, peerCountKey, peerID string) error {
@@ -390,6 +914,18 @@ func (ps *store) delPeer(ctx context.Context, infoHashKey, peerCountKey, peerID
 			err = ps.Decr(ctx, peerCountKey).Err()
 		}
 	}
+	if err == nil && ps.peerTimeIndex {
+		err = NoResultErr(ps.ZRem(ctx, ps.PeerTimeKey(infoHashKey), peerID).Err())
+	}
+	if err == nil && ps.peerIPIndex {
+		err = NoResultErr(ps.ZRem(ctx, ps.PeerIPKey(infoHashKey), ipIndexMember(peerID)).Err())
+	}
+	if err == nil {
+		err = ps.delPeerStats(ctx, ps.UniversalClient, infoHashKey, peerID)
+	}
+	if err == nil {
+		err = ps.delPeerIDs(ctx, ps.UniversalClient, infoHashKey, peerID)
+	}
 
 	return err
 }
@@ -405,19 +941,78 @@ func PackPeer(p bittorrent.Peer) string {
 }
 
 func (ps *store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return ps.putPeer(ctx, InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), CountSeederKey, PackPeer(peer))
+	infoHash := ih.RawString()
+	return ps.putPeer(ctx, infoHash, ps.InfoHashKey(infoHash, true, peer.Addr().Is6()), ps.CountSeederKey, PackPeer(peer))
 }
 
 func (ps *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return ps.delPeer(ctx, InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), CountSeederKey, PackPeer(peer))
+	return ps.delPeer(ctx, ps.InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), ps.CountSeederKey, PackPeer(peer))
 }
 
 func (ps *store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return ps.putPeer(ctx, InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), CountLeecherKey, PackPeer(peer))
+	infoHash := ih.RawString()
+	return ps.putPeer(ctx, infoHash, ps.InfoHashKey(infoHash, false, peer.Addr().Is6()), ps.CountLeecherKey, PackPeer(peer))
 }
 
 func (ps *store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return ps.delPeer(ctx, InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), CountLeecherKey, PackPeer(peer))
+	return ps.delPeer(ctx, ps.InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), ps.CountLeecherKey, PackPeer(peer))
+}
+
+func (ps *store) DeletePeers(ctx context.Context, ih bittorrent.InfoHash, peers ...bittorrent.Peer) error {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Int("count", len(peers)).
+		Msg("delete peers")
+	infoHash := ih.RawString()
+	// packed peers grouped by seeder/leecher and IPv4/IPv6 swarm keys
+	fields := make(map[string][]string, 4)
+	for _, p := range peers {
+		packed, v6 := PackPeer(p), p.Addr().Is6()
+		for _, seeder := range []bool{true, false} {
+			infoHashKey := ps.InfoHashKey(infoHash, seeder, v6)
+			fields[infoHashKey] = append(fields[infoHashKey], packed)
+		}
+	}
+	deleted := make(map[string]*redis.IntCmd, len(fields))
+	_, err := ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for infoHashKey, f := range fields {
+			deleted[infoHashKey] = p.HDel(ctx, infoHashKey, f...)
+			if ps.peerTimeIndex {
+				p.ZRem(ctx, ps.PeerTimeKey(infoHashKey), toMembers(f)...)
+			}
+			if ps.peerIPIndex {
+				p.ZRem(ctx, ps.PeerIPKey(infoHashKey), toIPMembers(f)...)
+			}
+			_ = ps.delPeerStats(ctx, p, infoHashKey, f...)
+			_ = ps.delPeerIDs(ctx, p, infoHashKey, f...)
+		}
+		return nil
+	})
+	if err = NoResultErr(err); err != nil {
+		return err
+	}
+	// counters are decremented only by number of fields actually removed
+	var seeders, leechers int64
+	for infoHashKey, cmd := range deleted {
+		if strings.HasPrefix(infoHashKey, ps.IH4SeederKey) || strings.HasPrefix(infoHashKey, ps.IH6SeederKey) {
+			seeders += cmd.Val()
+		} else {
+			leechers += cmd.Val()
+		}
+	}
+	if seeders+leechers == 0 {
+		return storage.ErrResourceDoesNotExist
+	}
+	_, err = ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		if seeders > 0 {
+			p.DecrBy(ctx, ps.CountSeederKey, seeders)
+		}
+		if leechers > 0 {
+			p.DecrBy(ctx, ps.CountLeecherKey, leechers)
+		}
+		return nil
+	})
+	return NoResultErr(err)
 }
 
 func (ps *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
@@ -427,30 +1022,77 @@ func (ps *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pe
 		Msg("graduate leecher")
 
 	infoHash, peerID, isV6 := ih.RawString(), PackPeer(peer), peer.Addr().Is6()
-	ihSeederKey, ihLeecherKey := InfoHashKey(infoHash, true, isV6), InfoHashKey(infoHash, false, isV6)
+	ihSeederKey, ihLeecherKey := ps.InfoHashKey(infoHash, true, isV6), ps.InfoHashKey(infoHash, false, isV6)
 
-	return ps.tx(ctx, func(tx redis.Pipeliner) error {
-		deleted, err := tx.HDel(ctx, ihLeecherKey, peerID).Uint64()
-		err = NoResultErr(err)
+	// leecher is deleted before transaction, because results
+	// of commands are not available inside it
+	deleted, err := ps.HDel(ctx, ihLeecherKey, peerID).Uint64()
+	if err = NoResultErr(err); err != nil {
+		return err
+	}
+	// statistics of leecher are moved to seeder
+	// if there are no statistics in announce
+	var leecherStats string
+	if ps.peerStats && deleted > 0 {
+		leecherStats, err = ps.HGet(ctx, ps.PeerStatsKey(ihLeecherKey), peerID).Result()
+		if err = NoResultErr(err); err != nil {
+			return err
+		}
+	}
+	now := ps.getClock()
+	err = ps.tx(ctx, func(tx redis.Pipeliner) (err error) {
+		if deleted > 0 {
+			err = tx.Decr(ctx, ps.CountLeecherKey).Err()
+		}
 		if err == nil {
-			if deleted > 0 {
-				err = tx.Decr(ctx, CountLeecherKey).Err()
-			}
+			err = tx.HSet(ctx, ihSeederKey, peerID, now).Err()
+		}
+		if err == nil {
+			err = ps.expirePeer(ctx, tx, ihSeederKey, peerID)
+		}
+		if err == nil {
+			err = ps.delPeerStats(ctx, tx, ihLeecherKey, peerID)
 		}
 		if err == nil {
-			err = tx.HSet(ctx, ihSeederKey, peerID, ps.getClock()).Err()
+			err = ps.putPeerStats(ctx, tx, ihSeederKey, peerID, leecherStats)
 		}
 		if err == nil {
-			err = tx.Incr(ctx, CountSeederKey).Err()
+			err = ps.delPeerIDs(ctx, tx, ihLeecherKey, peerID)
 		}
 		if err == nil {
-			err = tx.SAdd(ctx, IHKey, ihSeederKey).Err()
+			err = ps.putPeerID(ctx, tx, ihSeederKey, peerID)
+		}
+		if err == nil && ps.peerTimeIndex {
+			err = tx.ZRem(ctx, ps.PeerTimeKey(ihLeecherKey), peerID).Err()
+			if err == nil {
+				err = tx.ZAdd(ctx, ps.PeerTimeKey(ihSeederKey), redis.Z{Score: float64(now), Member: peerID}).Err()
+			}
+		}
+		if err == nil && ps.peerIPIndex {
+			member := ipIndexMember(peerID)
+			err = tx.ZRem(ctx, ps.PeerIPKey(ihLeecherKey), member).Err()
+			if err == nil {
+				err = tx.ZAdd(ctx, ps.PeerIPKey(ihSeederKey), redis.Z{Member: member}).Err()
+			}
 		}
 		if err == nil {
-			err = tx.HIncrBy(ctx, CountDownloadsKey, infoHash, 1).Err()
+			err = tx.Incr(ctx, ps.CountSeederKey).Err()
+		}
+		if err == nil {
+			err = tx.SAdd(ctx, ps.ihSetKey(ihSeederKey), ihSeederKey).Err()
+		}
+		if err == nil && (deleted > 0 || !ps.trackedDLOnly) {
+			err = tx.HIncrBy(ctx, ps.CountDownloadsKey, infoHash, 1).Err()
+		}
+		if err == nil && ps.emptySwarmTTL > 0 {
+			err = tx.ZRem(ctx, ps.EmptySwarmKey, infoHash).Err()
 		}
 		return err
 	})
+	if err == nil {
+		err = ps.evictPeers(ctx, ihSeederKey, ps.CountSeederKey)
+	}
+	return err
 }
 
 // peerMinimumLen is the least allowed length of string serialized Peer
@@ -491,6 +1133,7 @@ func (ps *Connection) parsePeersList(peersResult *redis.StringSliceCmd) (peers [
 			if p, err := UnpackPeer(peerID); err == nil {
 				peers = append(peers, p)
 			} else {
+				storage.PromMalformedPeersTotal.Inc()
 				logger.Error().Err(err).Str("peerID", peerID).Msg("unable to decode peer")
 			}
 		}
@@ -510,10 +1153,10 @@ func (ps *Connection) GetPeers(ctx context.Context, ih bittorrent.InfoHash, forS
 	infoHashKeys := make([]string, 1, 2)
 
 	if forSeeder {
-		infoHashKeys[0] = InfoHashKey(infoHash, false, isV6)
+		infoHashKeys[0] = ps.InfoHashKey(infoHash, false, isV6)
 	} else {
-		infoHashKeys[0] = InfoHashKey(infoHash, true, isV6)
-		infoHashKeys = append(infoHashKeys, InfoHashKey(infoHash, false, isV6))
+		infoHashKeys[0] = ps.InfoHashKey(infoHash, true, isV6)
+		infoHashKeys = append(infoHashKeys, ps.InfoHashKey(infoHash, false, isV6))
 	}
 
 	for _, infoHashKey := range infoHashKeys {
@@ -528,7 +1171,15 @@ func (ps *Connection) GetPeers(ctx context.Context, ih bittorrent.InfoHash, forS
 
 	if l := len(out); err == nil {
 		if l == 0 {
-			err = storage.ErrResourceDoesNotExist
+			var n int64
+			n, err = ps.Exists(ctx, ps.swarmKeys(infoHash)...).Result()
+			if err = NoResultErr(err); err == nil {
+				if n > 0 {
+					err = storage.ErrSwarmEmpty
+				} else {
+					err = storage.ErrResourceDoesNotExist
+				}
+			}
 		}
 	} else if l > 0 {
 		err = nil
@@ -558,23 +1209,23 @@ func (ps *Connection) ScrapeIH(ctx context.Context, ih bittorrent.InfoHash, coun
 	infoHash := ih.RawString()
 	var lc4, lc6, sc4, sc6, dc int64
 
-	lc4, err = countFn(ctx, InfoHashKey(infoHash, false, false)).Result()
+	lc4, err = countFn(ctx, ps.InfoHashKey(infoHash, false, false)).Result()
 	if err = NoResultErr(err); err != nil {
 		return
 	}
-	lc6, err = countFn(ctx, InfoHashKey(infoHash, false, true)).Result()
+	lc6, err = countFn(ctx, ps.InfoHashKey(infoHash, false, true)).Result()
 	if err = NoResultErr(err); err != nil {
 		return
 	}
-	sc4, err = countFn(ctx, InfoHashKey(infoHash, true, false)).Result()
+	sc4, err = countFn(ctx, ps.InfoHashKey(infoHash, true, false)).Result()
 	if err = NoResultErr(err); err != nil {
 		return
 	}
-	sc6, err = countFn(ctx, InfoHashKey(infoHash, true, true)).Result()
+	sc6, err = countFn(ctx, ps.InfoHashKey(infoHash, true, true)).Result()
 	if err = NoResultErr(err); err != nil {
 		return
 	}
-	dc, err = ps.HGet(ctx, CountDownloadsKey, infoHash).Int64()
+	dc, err = ps.HGet(ctx, ps.CountDownloadsKey, infoHash).Int64()
 	if err = NoResultErr(err); err != nil {
 		return
 	}
@@ -589,24 +1240,266 @@ func (ps *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint3
 	return ps.ScrapeIH(ctx, ih, ps.HLen)
 }
 
+func (ps *store) PeerExists(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (bool, error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Object("peer", peer).
+		Bool("seeder", seeder).
+		Msg("peer exists")
+	exists, err := ps.HExists(ctx, ps.InfoHashKey(ih.RawString(), seeder, peer.Addr().Is6()), PackPeer(peer)).Result()
+	return exists, NoResultErr(err)
+}
+
+// PeersExist checks all peers with one pipelined round trip
+func (ps *store) PeersExist(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer, seeder bool) ([]bool, error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Int("count", len(peers)).
+		Bool("seeder", seeder).
+		Msg("peers exist")
+	cmds := make([]*redis.BoolCmd, len(peers))
+	_, err := ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, peer := range peers {
+			cmds[i] = p.HExists(ctx, ps.InfoHashKey(ih.RawString(), seeder, peer.Addr().Is6()), PackPeer(peer))
+		}
+		return nil
+	})
+	if err = NoResultErr(err); err != nil {
+		return nil, err
+	}
+	res := make([]bool, len(peers))
+	for i, cmd := range cmds {
+		res[i] = cmd.Val()
+	}
+	return res, nil
+}
+
+// ipIndexMaxSuffix is the greatest possible tail of IP index member
+// after IP address (PeerID and port)
+var ipIndexMaxSuffix = strings.Repeat("\xff", bittorrent.PeerIDLen+2)
+
+// CountPeersByIP returns the number of seeders and leechers of info hash
+// with provided IP address. If peer_ip_index is set and index is consistent
+// with swarm hash, peers are counted by index, otherwise swarm hash is scanned.
+func (ps *store) CountPeersByIP(ctx context.Context, ih bittorrent.InfoHash, ip netip.Addr) (n uint32, err error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Stringer("ip", ip).
+		Msg("count peers by IP")
+	ip = ip.Unmap()
+	infoHash, rawIP := ih.RawString(), string(ip.AsSlice())
+	for _, seeder := range []bool{true, false} {
+		var cnt int64
+		if cnt, err = ps.countIP(ctx, ps.InfoHashKey(infoHash, seeder, ip.Is6()), rawIP); err != nil {
+			return 0, err
+		}
+		n += uint32(cnt)
+	}
+	return
+}
+
+// countIP returns the number of peers of infoHashKey with raw IP address
+func (ps *store) countIP(ctx context.Context, infoHashKey, rawIP string) (int64, error) {
+	if ps.peerIPIndex {
+		ipKey := ps.PeerIPKey(infoHashKey)
+		var hLen, zCard, cnt *redis.IntCmd
+		_, err := ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+			hLen, zCard = p.HLen(ctx, infoHashKey), p.ZCard(ctx, ipKey)
+			cnt = p.ZLexCount(ctx, ipKey, "["+rawIP, "["+rawIP+ipIndexMaxSuffix)
+			return nil
+		})
+		if err = NoResultErr(err); err != nil {
+			return 0, err
+		}
+		// index may be incomplete if swarm stored before it was enabled
+		if hLen.Val() == zCard.Val() {
+			return cnt.Val(), nil
+		}
+	}
+	var cursor uint64
+	var n int64
+	for {
+		kv, next, err := ps.HScan(ctx, infoHashKey, cursor, "", 0).Result()
+		if err = NoResultErr(err); err != nil {
+			return 0, err
+		}
+		// HSCAN returns field-value pairs
+		for i := 0; i < len(kv); i += 2 {
+			if len(kv[i]) == bittorrent.PeerIDLen+2+len(rawIP) && strings.HasSuffix(kv[i], rawIP) {
+				n++
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return n, nil
+		}
+	}
+}
+
+// PurgeSwarm deletes seeders and leechers hashes (and their time
+// and IP indexes) of info hash, removes them from info hashes set, deletes
+// download count (if Config.PurgeResetsDownloads set) and subtracts swarm
+// sizes from seeders and leechers counts in one transaction.
+// Swarm hashes are watched, so transaction is retried up to
+// purgeMaxAttempts times if swarm is modified concurrently.
+func (ps *store) PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash) error {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Msg("purge swarm")
+	infoHash := ih.RawString()
+	keys := ps.swarmKeys(infoHash)
+	for attempt := 0; attempt < purgeMaxAttempts; attempt++ {
+		// swarm hashes are watched, so counters are decremented
+		// by the number of peers actually deleted
+		err := ps.Watch(ctx, func(tx *redis.Tx) error {
+			var lengths [4]int64
+			for i, k := range keys {
+				n, err := tx.HLen(ctx, k).Result()
+				if err = NoResultErr(err); err != nil {
+					return err
+				}
+				lengths[i] = n
+			}
+			_, err := tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				for _, k := range keys {
+					p.Del(ctx, k)
+					p.Del(ctx, ps.PeerTimeKey(k))
+					p.Del(ctx, ps.PeerIPKey(k))
+					p.Del(ctx, ps.PeerStatsKey(k))
+					p.Del(ctx, ps.PeerIDKey(k))
+					p.SRem(ctx, ps.ihSetKey(k), k)
+				}
+				// keys order is the same as in swarmKeys
+				if n := lengths[0] + lengths[1]; n > 0 {
+					p.DecrBy(ctx, ps.CountSeederKey, n)
+				}
+				if n := lengths[2] + lengths[3]; n > 0 {
+					p.DecrBy(ctx, ps.CountLeecherKey, n)
+				}
+				if ps.purgeResetsDL {
+					p.HDel(ctx, ps.CountDownloadsKey, infoHash)
+					p.ZRem(ctx, ps.EmptySwarmKey, infoHash)
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return NoResultErr(err)
+		}
+	}
+	return errPurgeConflict
+}
+
+// UniqueInfoHashes converts provided info hash keys (see InfoHashKey)
+// into info hashes. Because each info hash may have up to four keys
+// (IPv4 and IPv6 seeders and leechers), info hash is returned only
+// for the first existing key in swarm keys order, so it is returned
+// once while iterating over all keys.
+func (ps *Connection) UniqueInfoHashes(ctx context.Context, infoHashKeys []string) (infoHashes []bittorrent.InfoHash, err error) {
+	type candidate struct {
+		infoHash     string
+		exists, prev *redis.IntCmd
+	}
+	candidates := make([]candidate, 0, len(infoHashKeys))
+	_, err = ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, infoHashKey := range infoHashKeys {
+			if len(infoHashKey) <= len(ps.IH4SeederKey) {
+				continue
+			}
+			c := candidate{infoHash: infoHashKey[len(ps.IH4SeederKey):]}
+			if l := len(c.infoHash); l != bittorrent.InfoHashV1Len && l != bittorrent.InfoHashV2Len {
+				continue
+			}
+			keys := ps.swarmKeys(c.infoHash)
+			i := slices.Index(keys, infoHashKey)
+			if i < 0 {
+				continue
+			}
+			// key may still be in info hash set after its swarm became empty
+			c.exists = p.Exists(ctx, infoHashKey)
+			if i > 0 {
+				c.prev = p.Exists(ctx, keys[:i]...)
+			}
+			candidates = append(candidates, c)
+		}
+		return nil
+	})
+	if err = NoResultErr(err); err != nil {
+		return
+	}
+	infoHashes = make([]bittorrent.InfoHash, 0, len(candidates))
+	for _, c := range candidates {
+		if c.exists.Val() > 0 && (c.prev == nil || c.prev.Val() == 0) {
+			infoHashes = append(infoHashes, bittorrent.InfoHash(c.infoHash))
+		}
+	}
+	return
+}
+
+// InfoHashes iterates over info hashes sets with SSCAN.
+// Cursor consists of info hashes set shard index and SSCAN cursor
+// separated by colon. Returned page size may differ from limit, because
+// limit is only passed to SSCAN as COUNT hint.
+func (ps *store) InfoHashes(ctx context.Context, cursor string, limit int) (infoHashes []bittorrent.InfoHash, nextCursor string, err error) {
+	logger.Trace().
+		Str("cursor", cursor).
+		Int("limit", limit).
+		Msg("info hashes")
+	setKeys := ps.ihSetKeys()
+	var shard int
+	var scanCursor uint64
+	if len(cursor) > 0 {
+		shardStr, scanStr, found := strings.Cut(cursor, ":")
+		if shard, err = strconv.Atoi(shardStr); err == nil && found {
+			scanCursor, err = strconv.ParseUint(scanStr, 10, 64)
+		}
+		if err != nil || !found || shard < 0 || shard >= len(setKeys) {
+			return nil, "", storage.ErrInvalidCursor
+		}
+	}
+	if limit <= 0 {
+		limit = storage.DefaultInfoHashesLimit
+	}
+	for shard < len(setKeys) && len(infoHashes) < limit {
+		var infoHashKeys []string
+		var page []bittorrent.InfoHash
+		infoHashKeys, scanCursor, err = ps.SScan(ctx, setKeys[shard], scanCursor, "", int64(limit-len(infoHashes))).Result()
+		if err = NoResultErr(err); err != nil {
+			return nil, "", err
+		}
+		if page, err = ps.UniqueInfoHashes(ctx, infoHashKeys); err != nil {
+			return nil, "", err
+		}
+		infoHashes = append(infoHashes, page...)
+		if scanCursor == 0 {
+			shard++
+		}
+	}
+	if shard < len(setKeys) {
+		nextCursor = strconv.Itoa(shard) + ":" + strconv.FormatUint(scanCursor, 10)
+	}
+	return
+}
+
 const argNumErrorMsg = "ERR wrong number of arguments"
 
 // Put - storage.DataStorage implementation
 func (ps *Connection) Put(ctx context.Context, storeCtx string, values ...storage.Entry) (err error) {
 	if l := len(values); l > 0 {
+		key, ttl := ps.PrefixKey+storeCtx, ps.dataTTL[storeCtx]
 		if l == 1 {
-			err = ps.HSet(ctx, PrefixKey+storeCtx, values[0].Key, values[0].Value).Err()
+			err = ps.hSet(ctx, key, ttl, values[0].Key, values[0].Value)
 		} else {
 			args := make([]any, 0, l*2)
 			for _, p := range values {
 				args = append(args, p.Key, p.Value)
 			}
-			err = ps.HSet(ctx, PrefixKey+storeCtx, args...).Err()
+			err = ps.hSet(ctx, key, ttl, args...)
 			if err != nil {
 				if strings.Contains(err.Error(), argNumErrorMsg) {
 					logger.Warn().Msg("This Redis version/implementation does not support variadic arguments for HSET")
 					for _, p := range values {
-						if err = ps.HSet(ctx, PrefixKey+storeCtx, p.Key, p.Value).Err(); err != nil {
+						if err = ps.hSet(ctx, key, ttl, p.Key, p.Value); err != nil {
 							break
 						}
 					}
@@ -617,15 +1510,28 @@ func (ps *Connection) Put(ctx context.Context, storeCtx string, values ...storag
 	return
 }
 
+// hSet stores fields into hash and refreshes its TTL if ttl is set
+func (ps *Connection) hSet(ctx context.Context, key string, ttl time.Duration, args ...any) error {
+	if ttl <= 0 {
+		return ps.HSet(ctx, key, args...).Err()
+	}
+	_, err := ps.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HSet(ctx, key, args...)
+		tx.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
 // Contains - storage.DataStorage implementation
 func (ps *Connection) Contains(ctx context.Context, storeCtx string, key string) (bool, error) {
-	exist, err := ps.HExists(ctx, PrefixKey+storeCtx, key).Result()
+	exist, err := ps.HExists(ctx, ps.PrefixKey+storeCtx, key).Result()
 	return exist, NoResultErr(err)
 }
 
 // Load - storage.DataStorage implementation
 func (ps *Connection) Load(ctx context.Context, storeCtx string, key string) (v []byte, err error) {
-	v, err = ps.HGet(ctx, PrefixKey+storeCtx, key).Bytes()
+	v, err = ps.HGet(ctx, ps.PrefixKey+storeCtx, key).Bytes()
 	if err != nil && errors.Is(err, redis.Nil) {
 		v, err = nil, nil
 	}
@@ -635,12 +1541,12 @@ func (ps *Connection) Load(ctx context.Context, storeCtx string, key string) (v
 // Delete - storage.DataStorage implementation
 func (ps *Connection) Delete(ctx context.Context, storeCtx string, keys ...string) (err error) {
 	if len(keys) > 0 {
-		err = NoResultErr(ps.HDel(ctx, PrefixKey+storeCtx, keys...).Err())
+		err = NoResultErr(ps.HDel(ctx, ps.PrefixKey+storeCtx, keys...).Err())
 		if err != nil {
 			if strings.Contains(err.Error(), argNumErrorMsg) {
 				logger.Warn().Msg("This Redis version/implementation does not support variadic arguments for HDEL")
 				for _, k := range keys {
-					if err = NoResultErr(ps.HDel(ctx, PrefixKey+storeCtx, k).Err()); err != nil {
+					if err = NoResultErr(ps.HDel(ctx, ps.PrefixKey+storeCtx, k).Err()); err != nil {
 						break
 					}
 				}
@@ -707,101 +1613,485 @@ func (ps *Connection) Ping(ctx context.Context) error {
 //     we'll attempt to clean it up the next time gc runs.
 func (ps *store) gc(cutoff time.Time) {
 	cutoffNanos := cutoff.UnixNano()
-	// list all infoHashKeys in the group
-	infoHashKeys, err := ps.SMembers(context.Background(), IHKey).Result()
-	err = NoResultErr(err)
-	if err == nil {
-		for _, infoHashKey := range infoHashKeys {
-			var cntKey string
-			var seeder bool
-			if seeder = strings.HasPrefix(infoHashKey, IH4SeederKey) || strings.HasPrefix(infoHashKey, IH6SeederKey); seeder {
-				cntKey = CountSeederKey
-			} else if strings.HasPrefix(infoHashKey, IH4LeecherKey) || strings.HasPrefix(infoHashKey, IH6LeecherKey) {
-				cntKey = CountLeecherKey
-			} else {
-				logger.Warn().Str("infoHashKey", infoHashKey).Msg("unexpected record found in info hash set")
-				continue
+	if ps.fieldTTL > 0 {
+		ps.reconcileSwarms(cutoffNanos)
+		return
+	}
+	if ps.gcMaxPerPass > 0 {
+		ps.gcChunk(cutoffNanos)
+		return
+	}
+	for _, ihSetKey := range ps.ihSetKeys() {
+		ps.gcSet(ihSetKey, cutoffNanos)
+	}
+}
+
+// gcSet deletes stale peers of info hashes stored in ihSetKey set
+// and removes empty info hash keys from it
+func (ps *store) gcSet(ihSetKey string, cutoffNanos int64) {
+	err := ps.scanSet(ihSetKey, func(infoHashKeys []string) {
+		ps.gcInfoHashes(ihSetKey, infoHashKeys, cutoffNanos)
+	})
+	if err != nil {
+		logger.Error().Err(err).
+			Str("hashSet", ihSetKey).
+			Msg("unable to fetch info hash peers")
+	}
+}
+
+// scanSet iterates members of set with SSCAN and calls fn for
+// every page of gcScanCount (approximately) members, so the whole
+// set is not loaded at once. Members may be repeated in different pages.
+func (ps *store) scanSet(setKey string, fn func(members []string)) error {
+	var cursor uint64
+	for {
+		members, next, err := ps.SScan(context.Background(), setKey, cursor, "", ps.gcScanCount).Result()
+		if err = NoResultErr(err); err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			fn(members)
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// gcChunk deletes stale peers of at most gcMaxPerPass info hashes
+// starting from position, where previous call stopped.
+// Sets of all shards are iterated in round-robin manner.
+func (ps *store) gcChunk(cutoffNanos int64) {
+	setKeys := ps.ihSetKeys()
+	budget := ps.gcMaxPerPass
+	// each set should be scanned at most once per pass
+	for scanned := 0; budget > 0 && scanned <= len(setKeys); {
+		ps.gcShard %= len(setKeys)
+		ihSetKey := setKeys[ps.gcShard]
+		infoHashKeys, cursor, err := ps.SScan(context.Background(), ihSetKey, ps.gcCursor, "", int64(budget)).Result()
+		if err = NoResultErr(err); err != nil {
+			logger.Error().Err(err).
+				Str("hashSet", ihSetKey).
+				Msg("unable to scan info hash set")
+			break
+		}
+		ps.gcInfoHashes(ihSetKey, infoHashKeys, cutoffNanos)
+		budget -= len(infoHashKeys)
+		ps.gcCursor = cursor
+		if cursor == 0 {
+			ps.gcShard++
+			scanned++
+		}
+	}
+}
+
+// gcInfoHash deletes stale peers of infoHashKey
+// and removes it from ihSetKey set if it is empty
+func (ps *store) gcInfoHash(ihSetKey, infoHashKey string, cutoffNanos int64) {
+	if _, err := ps.expireInfoHash(ihSetKey, infoHashKey, cutoffNanos); err != nil {
+		logger.Error().Err(err).
+			Str("infoHashKey", infoHashKey).
+			Msg("unable to clean info hash records")
+	}
+}
+
+// expireInfoHash deletes stale peers of infoHashKey, removes it
+// from ihSetKey set if it is empty and returns the number of deleted peers
+func (ps *store) expireInfoHash(ihSetKey, infoHashKey string, cutoffNanos int64) (removedPeerCount int64, err error) {
+	var cntKey string
+	var seeder bool
+	if seeder = strings.HasPrefix(infoHashKey, ps.IH4SeederKey) || strings.HasPrefix(infoHashKey, ps.IH6SeederKey); seeder {
+		cntKey = ps.CountSeederKey
+	} else if strings.HasPrefix(infoHashKey, ps.IH4LeecherKey) || strings.HasPrefix(infoHashKey, ps.IH6LeecherKey) {
+		cntKey = ps.CountLeecherKey
+	} else {
+		logger.Warn().Str("infoHashKey", infoHashKey).Msg("unexpected record found in info hash set")
+		return
+	}
+	var peersToRemove []string
+	var malformed int64
+	indexed := false
+	// malformed peers can be found only by full swarm scan
+	if ps.peerTimeIndex && !ps.gcMalformed {
+		indexed, peersToRemove, err = ps.indexedStalePeers(infoHashKey, cutoffNanos)
+	}
+	if err == nil && !indexed {
+		peersToRemove, malformed, err = ps.scanStalePeers(infoHashKey, cutoffNanos)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch info hash peers: %w", err)
+	}
+	if len(peersToRemove) > 0 {
+		removedPeerCount, err = ps.HDel(context.Background(), infoHashKey, peersToRemove...).Result()
+		if err = NoResultErr(err); err != nil {
+			if !strings.Contains(err.Error(), argNumErrorMsg) {
+				return 0, fmt.Errorf("unable to delete peers: %w", err)
 			}
-			// list all (peer, timeout) pairs for the ih
-			peerList, err := ps.HGetAll(context.Background(), infoHashKey).Result()
-			err = NoResultErr(err)
-			if err == nil {
-				peersToRemove := make([]string, 0)
-				for peerID, timeStamp := range peerList {
-					if mtime, err := strconv.ParseInt(timeStamp, 10, 64); err == nil {
-						if mtime <= cutoffNanos {
-							logger.Trace().Str("peerID", peerID).Msg("adding peer to remove list")
-							peersToRemove = append(peersToRemove, peerID)
-						}
-					} else {
-						logger.Error().Err(err).
-							Str("infoHashKey", infoHashKey).
-							Str("peerID", peerID).
-							Str("timestamp", timeStamp).
-							Msg("unable to decode peer timestamp")
-					}
-				}
-				if len(peersToRemove) > 0 {
-					removedPeerCount, err := ps.HDel(context.Background(), infoHashKey, peersToRemove...).Result()
-					err = NoResultErr(err)
-					if err != nil {
-						if strings.Contains(err.Error(), argNumErrorMsg) {
-							logger.Warn().Msg("This Redis version/implementation does not support variadic arguments for HDEL")
-							for _, k := range peersToRemove {
-								count, err := ps.HDel(context.Background(), infoHashKey, k).Result()
-								err = NoResultErr(err)
-								if err != nil {
-									logger.Error().Err(err).
-										Str("infoHashKey", infoHashKey).
-										Str("peerID", k).
-										Msg("unable to delete peer")
-								} else {
-									removedPeerCount += count
-								}
-							}
-						} else {
-							logger.Error().Err(err).
-								Str("infoHashKey", infoHashKey).
-								Strs("peerIDs", peersToRemove).
-								Msg("unable to delete peers")
-						}
-					}
-					if removedPeerCount > 0 { // DECR seeder/leecher counter
-						if err = ps.DecrBy(context.Background(), cntKey, removedPeerCount).Err(); err != nil {
-							logger.Error().Err(err).
-								Str("infoHashKey", infoHashKey).
-								Str("countKey", cntKey).
-								Msg("unable to decrement seeder/leecher peer count")
-						}
-					}
+			logger.Warn().Msg("This Redis version/implementation does not support variadic arguments for HDEL")
+			for _, k := range peersToRemove {
+				count, err := ps.HDel(context.Background(), infoHashKey, k).Result()
+				err = NoResultErr(err)
+				if err != nil {
+					logger.Error().Err(err).
+						Str("infoHashKey", infoHashKey).
+						Str("peerID", k).
+						Msg("unable to delete peer")
+				} else {
+					removedPeerCount += count
 				}
+			}
+		}
+		if removedPeerCount > 0 {
+			storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonMalformed).Add(float64(min(malformed, removedPeerCount)))
+			storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonExpired).Add(float64(max(removedPeerCount-malformed, 0)))
+		}
+		if removedPeerCount > 0 { // DECR seeder/leecher counter
+			if err = ps.DecrBy(context.Background(), cntKey, removedPeerCount).Err(); err != nil {
+				return removedPeerCount, fmt.Errorf("unable to decrement seeder/leecher peer count: %w", err)
+			}
+		}
+		if indexed {
+			if err = NoResultErr(ps.ZRem(context.Background(), ps.PeerTimeKey(infoHashKey), toMembers(peersToRemove)...).Err()); err != nil {
+				return removedPeerCount, fmt.Errorf("unable to delete peers from time index: %w", err)
+			}
+		}
+		if ps.peerIPIndex {
+			if err = NoResultErr(ps.ZRem(context.Background(), ps.PeerIPKey(infoHashKey), toIPMembers(peersToRemove)...).Err()); err != nil {
+				return removedPeerCount, fmt.Errorf("unable to delete peers from IP index: %w", err)
+			}
+		}
+		if err = ps.delPeerIDs(context.Background(), ps.UniversalClient, infoHashKey, peersToRemove...); err != nil {
+			return removedPeerCount, fmt.Errorf("unable to delete peers from ID index: %w", err)
+		}
+		if err = ps.delPeerStats(context.Background(), ps.UniversalClient, infoHashKey, peersToRemove...); err != nil {
+			return removedPeerCount, fmt.Errorf("unable to delete peers statistics: %w", err)
+		}
+	}
 
-				err = NoResultErr(ps.Watch(context.Background(), func(_ *redis.Tx) (err error) {
-					var infoHashCount uint64
-					infoHashCount, err = ps.HLen(context.Background(), infoHashKey).Uint64()
-					err = NoResultErr(err)
-					if err == nil && infoHashCount == 0 {
-						// Empty hashes are not shown among existing keys,
-						// in other words, it's removed automatically after `HDEL` the last field.
-						err = NoResultErr(ps.SRem(context.Background(), IHKey, infoHashKey).Err())
-					}
-					return err
-				}, infoHashKey))
+	_, err = ps.dropIfEmpty(ihSetKey, infoHashKey)
+	return removedPeerCount, err
+}
+
+// dropIfEmpty removes infoHashKey from ihSetKey set if there are
+// no peers in it and returns the number of peers in infoHashKey
+func (ps *store) dropIfEmpty(ihSetKey, infoHashKey string) (infoHashCount int64, err error) {
+	var emptied bool
+	err = NoResultErr(ps.Watch(context.Background(), func(_ *redis.Tx) (err error) {
+		infoHashCount, err = ps.HLen(context.Background(), infoHashKey).Result()
+		err = NoResultErr(err)
+		if err == nil && infoHashCount == 0 {
+			// Empty hashes are not shown among existing keys,
+			// in other words, it's removed automatically after `HDEL` the last field.
+			err = NoResultErr(ps.SRem(context.Background(), ihSetKey, infoHashKey).Err())
+			if err == nil && ps.peerStats {
+				// statistics of peers, which fields expired by TTL
+				err = NoResultErr(ps.Del(context.Background(), ps.PeerStatsKey(infoHashKey)).Err())
+			}
+			if err == nil && ps.peerIDIndex {
+				err = NoResultErr(ps.Del(context.Background(), ps.PeerIDKey(infoHashKey)).Err())
+			}
+			emptied = err == nil
+		}
+		return err
+	}, infoHashKey))
+	if err == nil && emptied {
+		storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonEmptySwarm).Inc()
+		if ps.emptySwarmTTL > 0 {
+			ps.markEmptySwarm(infoHashKey[len(ps.IH4SeederKey):])
+		}
+	}
+	return
+}
+
+// reconcileSwarms is GC of peers, which expire by hash fields TTL:
+// removes empty info hash keys from sets, deletes expired peers from
+// indexes and adjusts seeders and leechers counters to actual swarm sizes.
+// Counters are decremented by the difference between their values
+// fetched before the pass and sums of swarm sizes, so increments and
+// decrements made by announces during the pass are not lost.
+// Info hash sets are processed completely regardless of gcMaxPerPass,
+// counters are not updated if any info hash failed. Keys of processed
+// info hashes are held until the end of pass to skip SSCAN duplicates.
+func (ps *store) reconcileSwarms(cutoffNanos int64) {
+	var seeders, leechers int64
+	counters, err := ps.MGet(context.Background(), ps.CountSeederKey, ps.CountLeecherKey).Result()
+	if err = NoResultErr(err); err != nil {
+		logger.Error().Err(err).Msg("unable to fetch seeders and leechers counters")
+		return
+	}
+	failed := false
+	// SSCAN may return the same member several times,
+	// but every swarm must be counted once
+	counted := make(map[string]struct{})
+	for _, ihSetKey := range ps.ihSetKeys() {
+		err := ps.scanSet(ihSetKey, func(infoHashKeys []string) {
+			for _, infoHashKey := range infoHashKeys {
+				if _, found := counted[infoHashKey]; found {
+					continue
+				}
+				counted[infoHashKey] = struct{}{}
+				n, err := ps.reconcileInfoHash(ihSetKey, infoHashKey, cutoffNanos)
 				if err != nil {
 					logger.Error().Err(err).
 						Str("infoHashKey", infoHashKey).
 						Msg("unable to clean info hash records")
+					failed = true
+					continue
 				}
-			} else {
-				logger.Error().Err(err).
+				if strings.HasPrefix(infoHashKey, ps.IH4SeederKey) || strings.HasPrefix(infoHashKey, ps.IH6SeederKey) {
+					seeders += n
+				} else {
+					leechers += n
+				}
+			}
+		})
+		if err != nil {
+			logger.Error().Err(err).
+				Str("hashSet", ihSetKey).
+				Msg("unable to fetch info hash peers")
+			failed = true
+		}
+	}
+	if failed {
+		return
+	}
+	err = ps.tx(context.Background(), func(tx redis.Pipeliner) error {
+		for i, actual := range []struct {
+			key string
+			n   int64
+		}{{ps.CountSeederKey, seeders}, {ps.CountLeecherKey, leechers}} {
+			if delta := counterValue(counters[i]) - actual.n; delta != 0 {
+				tx.DecrBy(context.Background(), actual.key, delta)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to reconcile seeders and leechers counters")
+	}
+}
+
+// counterValue converts value of counter fetched by MGET
+// into integer, not existing or malformed counter is zero
+func counterValue(v any) (n int64) {
+	if s, isOk := v.(string); isOk {
+		n, _ = strconv.ParseInt(s, 10, 64)
+	}
+	return
+}
+
+// reconcileInfoHash deletes peers announced before cutoff from indexes
+// of infoHashKey, removes it from ihSetKey set if it is empty
+// and returns the number of peers in infoHashKey
+func (ps *store) reconcileInfoHash(ihSetKey, infoHashKey string, cutoffNanos int64) (int64, error) {
+	if ps.peerTimeIndex {
+		ctx, timeKey := context.Background(), ps.PeerTimeKey(infoHashKey)
+		stale, err := ps.ZRangeByScore(ctx, timeKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(cutoffNanos, 10),
+		}).Result()
+		if err = NoResultErr(err); err != nil {
+			return 0, fmt.Errorf("unable to fetch stale peers from time index: %w", err)
+		}
+		if len(stale) > 0 {
+			var n int64
+			if n, err = ps.ZRem(ctx, timeKey, toMembers(stale)...).Result(); NoResultErr(err) != nil {
+				return 0, fmt.Errorf("unable to delete peers from time index: %w", err)
+			}
+			// fields of these peers are already expired by redis
+			storage.PromGCReapedTotal.WithLabelValues(storage.GCReasonExpired).Add(float64(n))
+			if ps.peerIPIndex {
+				if err = NoResultErr(ps.ZRem(ctx, ps.PeerIPKey(infoHashKey), toIPMembers(stale)...).Err()); err != nil {
+					return 0, fmt.Errorf("unable to delete peers from IP index: %w", err)
+				}
+			}
+		}
+	}
+	return ps.dropIfEmpty(ihSetKey, infoHashKey)
+}
+
+// ExpireSwarm deletes peers of info hash announced not after cutoff
+func (ps *store) ExpireSwarm(_ context.Context, ih bittorrent.InfoHash, cutoff time.Time) (removed uint32, err error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Time("cutoff", cutoff).
+		Msg("expire swarm")
+	for _, infoHashKey := range ps.swarmKeys(ih.RawString()) {
+		var n int64
+		n, err = ps.expireInfoHash(ps.ihSetKey(infoHashKey), infoHashKey, cutoff.UnixNano())
+		removed += uint32(n)
+		if err != nil {
+			break
+		}
+	}
+	return
+}
+
+// scanStalePeers fetches all peers of infoHashKey and returns
+// ones announced before cutoffNanos (and malformed ones, if
+// gcMalformed set) with the number of malformed ones. If peerTimeIndex set, time index of swarm
+// is rebuilt from fetched data, so swarms stored before index
+// was enabled are migrated.
+func (ps *store) scanStalePeers(infoHashKey string, cutoffNanos int64) (_ []string, malformed int64, _ error) {
+	// list all (peer, timeout) pairs for the ih
+	peerList, err := ps.HGetAll(context.Background(), infoHashKey).Result()
+	if err = NoResultErr(err); err != nil {
+		return nil, 0, err
+	}
+	peersToRemove := make([]string, 0)
+	var alive []redis.Z
+	if ps.peerTimeIndex {
+		alive = make([]redis.Z, 0, len(peerList))
+	}
+	for peerID, timeStamp := range peerList {
+		if ps.gcMalformed {
+			// malformed peer will never be decoded, so it is useless
+			if _, err := UnpackPeer(peerID); err != nil {
+				storage.PromMalformedPeersTotal.Inc()
+				logger.Warn().Err(err).
 					Str("infoHashKey", infoHashKey).
-					Msg("unable to fetch info hash peers")
+					Str("peerID", peerID).
+					Msg("removing malformed peer")
+				peersToRemove = append(peersToRemove, peerID)
+				malformed++
+				continue
 			}
 		}
-	} else {
+		if mtime, err := strconv.ParseInt(timeStamp, 10, 64); err == nil {
+			if mtime <= cutoffNanos {
+				logger.Trace().Str("peerID", peerID).Msg("adding peer to remove list")
+				peersToRemove = append(peersToRemove, peerID)
+			} else if alive != nil {
+				alive = append(alive, redis.Z{Score: float64(mtime), Member: peerID})
+			}
+		} else {
+			logger.Error().Err(err).
+				Str("infoHashKey", infoHashKey).
+				Str("peerID", peerID).
+				Str("timestamp", timeStamp).
+				Msg("unable to decode peer timestamp")
+		}
+	}
+	if ps.peerTimeIndex {
+		timeKey := ps.PeerTimeKey(infoHashKey)
+		if err := ps.tx(context.Background(), func(tx redis.Pipeliner) error {
+			tx.Del(context.Background(), timeKey)
+			if len(alive) > 0 {
+				tx.ZAdd(context.Background(), timeKey, alive...)
+			}
+			return nil
+		}); err != nil {
+			logger.Error().Err(err).
+				Str("infoHashKey", infoHashKey).
+				Msg("unable to rebuild peers time index")
+		}
+	}
+	return peersToRemove, malformed, nil
+}
+
+// indexedStalePeers returns peers of infoHashKey announced before
+// cutoffNanos using time index. If index is not consistent with
+// swarm hash (i.e. swarm is stored before index was enabled),
+// indexed is false and swarm should be scanned entirely.
+func (ps *store) indexedStalePeers(infoHashKey string, cutoffNanos int64) (indexed bool, peersToRemove []string, err error) {
+	ctx, timeKey := context.Background(), ps.PeerTimeKey(infoHashKey)
+	var hLen, zCard *redis.IntCmd
+	if _, err = ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		hLen, zCard = p.HLen(ctx, infoHashKey), p.ZCard(ctx, timeKey)
+		return nil
+	}); err != nil {
+		return false, nil, NoResultErr(err)
+	}
+	if hLen.Val() != zCard.Val() {
+		return false, nil, nil
+	}
+	var stale []string
+	stale, err = ps.ZRangeByScore(ctx, timeKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoffNanos, 10),
+	}).Result()
+	if err = NoResultErr(err); err != nil || len(stale) == 0 {
+		return err == nil, nil, err
+	}
+	// swarm hash holds actual announce time, index may be outdated
+	// if peer re-announced while index was rebuilt
+	var timeStamps []any
+	if timeStamps, err = ps.HMGet(ctx, infoHashKey, stale...).Result(); err != nil {
+		return false, nil, NoResultErr(err)
+	}
+	peersToRemove = make([]string, 0, len(stale))
+	var actual []redis.Z
+	for i, ts := range timeStamps {
+		timeStamp, _ := ts.(string)
+		if mtime, err := strconv.ParseInt(timeStamp, 10, 64); err == nil && mtime > cutoffNanos {
+			actual = append(actual, redis.Z{Score: float64(mtime), Member: stale[i]})
+		} else {
+			// deleted or stale peer, or peer with corrupted timestamp
+			peersToRemove = append(peersToRemove, stale[i])
+		}
+	}
+	if len(actual) > 0 {
+		if err = NoResultErr(ps.ZAdd(ctx, timeKey, actual...).Err()); err != nil {
+			return false, nil, err
+		}
+	}
+	return true, peersToRemove, nil
+}
+
+// markEmptySwarm adds info hash into EmptySwarmKey set
+// if there are no peers in all its swarms.
+// Time of first detection is preserved.
+func (ps *store) markEmptySwarm(infoHash string) {
+	ctx := context.Background()
+	n, err := ps.Exists(ctx, ps.swarmKeys(infoHash)...).Result()
+	if err = NoResultErr(err); err == nil && n == 0 {
+		err = NoResultErr(ps.ZAddNX(ctx, ps.EmptySwarmKey, redis.Z{
+			Score:  float64(ps.getClock()),
+			Member: infoHash,
+		}).Err())
+	}
+	if err != nil {
 		logger.Error().Err(err).
-			Str("hashSet", IHKey).
-			Msg("unable to fetch info hash peers")
+			Hex("infoHash", []byte(infoHash)).
+			Msg("unable to mark swarm as empty")
+	}
+}
+
+// purgeEmptySwarms deletes download counts of info hashes,
+// which swarms are empty since cutoff time.
+// If swarm is not empty anymore, info hash just removed from EmptySwarmKey set.
+func (ps *store) purgeEmptySwarms(cutoff time.Time) {
+	ctx := context.Background()
+	infoHashes, err := ps.ZRangeByScore(ctx, ps.EmptySwarmKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff.UnixNano(), 10),
+	}).Result()
+	if err = NoResultErr(err); err != nil {
+		logger.Error().Err(err).Str("key", ps.EmptySwarmKey).Msg("unable to fetch empty swarms")
+		return
+	}
+	for _, infoHash := range infoHashes {
+		keys := ps.swarmKeys(infoHash)
+		err = NoResultErr(ps.Watch(ctx, func(tx *redis.Tx) error {
+			n, err := tx.Exists(ctx, keys...).Result()
+			if err = NoResultErr(err); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				if n == 0 {
+					logger.Trace().Hex("infoHash", []byte(infoHash)).Msg("purging empty swarm")
+					p.HDel(ctx, ps.CountDownloadsKey, infoHash)
+				}
+				p.ZRem(ctx, ps.EmptySwarmKey, infoHash)
+				return nil
+			})
+			return err
+		}, keys...))
+		if err != nil {
+			logger.Error().Err(err).
+				Hex("infoHash", []byte(infoHash)).
+				Msg("unable to purge empty swarm")
+		}
 	}
 }
 
@@ -809,7 +2099,7 @@ func (ps *store) Close() (err error) {
 	ps.onceCloser.Do(func() {
 		close(ps.closed)
 		ps.wg.Wait()
-		logger.Info().Msg("redis exiting. mochi does not clear data in redis when exiting. mochi keys have prefix " + PrefixKey)
+		logger.Info().Msg("redis exiting. mochi does not clear data in redis when exiting. mochi keys have prefix " + ps.PrefixKey)
 		err = ps.UniversalClient.Close()
 	})
 	return
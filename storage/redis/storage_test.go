@@ -1,10 +1,15 @@
 package redis
 
 import (
+	"context"
 	"fmt"
+	"net/netip"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
 	s "github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -28,4 +33,44 @@ func createNew() s.PeerStorage {
 
 func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
 
+func TestPeerStorage(t *testing.T) {
+	test.RunPeerStorageTests(t, func() s.PeerStorage {
+		ps := newMiniStore(t, 4)
+		ps.purgeResetsDL = true
+		return ps
+	})
+}
+
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
+
+func TestDeletePeerID(t *testing.T) {
+	ps := peerIDStore{newMiniStore(t, 1)}
+	ps.peerIDIndex = true
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	id := bittorrent.PeerID([]byte("bbbbbbbbbbbbbbbbbbbb"))
+	seeder := bittorrent.Peer{ID: id, AddrPort: netip.MustParseAddrPort("10.0.0.1:1")}
+	leecher := bittorrent.Peer{ID: id, AddrPort: netip.MustParseAddrPort("10.0.0.2:2")}
+	other := bittorrent.Peer{ID: bittorrent.PeerID([]byte("cccccccccccccccccccc")), AddrPort: netip.MustParseAddrPort("10.0.0.3:3")}
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder))
+	require.Nil(t, ps.PutLeecher(ctx, ih, leecher))
+	require.Nil(t, ps.PutLeecher(ctx, ih, other))
+
+	require.ErrorIs(t, ps.DeletePeerID(ctx, ih, id, true), s.ErrResourceDoesNotExist)
+	require.Nil(t, ps.DeletePeerID(ctx, ih, id, false))
+	l, sd, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), l)
+	require.Equal(t, uint32(0), sd)
+	require.ErrorIs(t, ps.DeletePeerID(ctx, ih, id, false), s.ErrResourceDoesNotExist)
+	require.Zero(t, ps.count(ps.CountSeederKey, false))
+	require.Equal(t, uint64(1), ps.count(ps.CountLeecherKey, false))
+	require.Equal(t, int64(1), ps.HLen(ctx, ps.PeerIDKey(ps.InfoHashKey(ih.RawString(), false, false))).Val())
+
+	// graduated peer is indexed as seeder
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, other))
+	require.Nil(t, ps.DeletePeerID(ctx, ih, other.ID, false))
+	require.Zero(t, ps.count(ps.CountSeederKey, false))
+	require.Zero(t, ps.count(ps.CountLeecherKey, false))
+	require.Zero(t, ps.Exists(ctx, ps.PeerIDKey(ps.InfoHashKey(ih.RawString(), false, false))).Val())
+}
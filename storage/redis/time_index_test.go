@@ -0,0 +1,216 @@
+package redis
+
+import (
+	"context"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// nanoseconds timestamp does not fit float64 mantissa
+const scoreDelta = float64(time.Microsecond)
+
+func timeIndexPeers(n int) []bittorrent.Peer {
+	peers := make([]bittorrent.Peer, n)
+	for i := range peers {
+		peers[i] = bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i + 1)},
+			AddrPort: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(1000+i)),
+		}
+	}
+	return peers
+}
+
+func TestPeerTimeIndexGC(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ps.peerTimeIndex, ps.peerIDIndex = true, true
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	key := InfoHashKey(ih.RawString(), true, false)
+	timeKey := PeerTimeKey(key)
+	require.Equal(t, "CHI_TS4_01234567890123456789", timeKey)
+
+	peers := timeIndexPeers(3)
+	for _, p := range peers {
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+	require.Equal(t, int64(3), ps.ZCard(ctx, timeKey).Val())
+
+	old := time.Now().Add(-time.Hour).UnixNano()
+	stale, reannounced := PackPeer(peers[0]), PackPeer(peers[1])
+	// stale peer
+	require.Nil(t, ps.HSet(ctx, key, stale, old).Err())
+	require.Nil(t, ps.ZAdd(ctx, timeKey, redis.Z{Score: float64(old), Member: stale}).Err())
+	// peer re-announced, but index is outdated
+	require.Nil(t, ps.ZAdd(ctx, timeKey, redis.Z{Score: float64(old), Member: reannounced}).Err())
+
+	ps.gc(time.Now().Add(-time.Minute))
+
+	exists, err := ps.HExists(ctx, key, stale).Result()
+	require.Nil(t, err)
+	require.False(t, exists)
+	require.Equal(t, int64(2), ps.ZCard(ctx, timeKey).Val())
+	require.Equal(t, uint64(2), ps.count(CountSeederKey, false))
+
+	score, err := ps.ZScore(ctx, timeKey, reannounced).Result()
+	require.Nil(t, err)
+	ts, err := ps.HGet(ctx, key, reannounced).Int64()
+	require.Nil(t, err)
+	require.InDelta(t, float64(ts), score, scoreDelta)
+
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, peers[1]))
+	require.Nil(t, peerIDStore{ps}.DeletePeerID(ctx, ih, peers[2].ID, false))
+	require.Equal(t, int64(0), ps.Exists(ctx, key, timeKey, ps.PeerIDKey(key)).Val())
+}
+
+func TestPeerTimeIndexMigration(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	key := InfoHashKey(ih.RawString(), false, false)
+	timeKey := PeerTimeKey(key)
+	for _, p := range timeIndexPeers(3) {
+		require.Nil(t, ps.PutLeecher(ctx, ih, p))
+	}
+	require.Equal(t, int64(0), ps.Exists(ctx, timeKey).Val())
+
+	ps.peerTimeIndex = true
+	ps.gc(time.Now().Add(-time.Hour))
+
+	peers, err := ps.HGetAll(ctx, key).Result()
+	require.Nil(t, err)
+	require.Len(t, peers, 3)
+	for peerID, ts := range peers {
+		score, err := ps.ZScore(ctx, timeKey, peerID).Result()
+		require.Nil(t, err)
+		mtime, err := strconv.ParseInt(ts, 10, 64)
+		require.Nil(t, err)
+		require.InDelta(t, float64(mtime), score, scoreDelta)
+	}
+
+	// migrated swarm is collected by index
+	ps.gc(time.Now().Add(time.Hour))
+	require.Equal(t, int64(0), ps.Exists(ctx, key, timeKey).Val())
+	require.Equal(t, uint64(0), ps.count(CountLeecherKey, false))
+}
+
+func TestMaxPeersPerSwarm(t *testing.T) {
+	cfg, err := Config{MaxPeersPerSwarm: 2}.Validate()
+	require.Nil(t, err)
+	require.True(t, cfg.PeerTimeIndex)
+
+	ps := newMiniStore(t, 1)
+	ps.peerTimeIndex, ps.maxPeers = true, 2
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	key := InfoHashKey(ih.RawString(), true, false)
+	timeKey := PeerTimeKey(key)
+	peers := timeIndexPeers(3)
+	for i, p := range peers[:2] {
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+		// make announce order deterministic
+		require.Nil(t, ps.ZAdd(ctx, timeKey, redis.Z{Score: float64(i + 1), Member: PackPeer(p)}).Err())
+	}
+
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peers[2]))
+	exists, err := ps.PeerExists(ctx, ih, peers[0], true)
+	require.Nil(t, err)
+	require.False(t, exists)
+	for _, p := range peers[1:] {
+		exists, err = ps.PeerExists(ctx, ih, p, true)
+		require.Nil(t, err)
+		require.True(t, exists)
+	}
+	require.Equal(t, int64(2), ps.ZCard(ctx, timeKey).Val())
+	require.Equal(t, uint64(2), ps.count(CountSeederKey, false))
+
+	require.Nil(t, ps.ZAdd(ctx, timeKey, redis.Z{Score: 3, Member: PackPeer(peers[2])}).Err())
+	// re-announce moves peer to the end of eviction queue
+	require.Nil(t, ps.PutSeeder(ctx, ih, peers[1]))
+	require.Nil(t, ps.PutSeeder(ctx, ih, peers[0]))
+	exists, err = ps.PeerExists(ctx, ih, peers[2], true)
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestMaxPeersPerSwarmMigration(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	key := InfoHashKey(ih.RawString(), true, false)
+	peers := timeIndexPeers(4)
+	for _, p := range peers[:3] {
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+
+	// peers stored before index was enabled are not evicted
+	ps.peerTimeIndex, ps.maxPeers = true, 2
+	require.Nil(t, ps.PutSeeder(ctx, ih, peers[3]))
+	require.Equal(t, int64(4), ps.HLen(ctx, key).Val())
+
+	// until index is rebuilt
+	ps.gc(time.Now().Add(-time.Hour))
+	require.Nil(t, ps.PutSeeder(ctx, ih, peers[3]))
+	require.Equal(t, int64(2), ps.HLen(ctx, key).Val())
+}
+
+func TestPurgeSwarmKeys(t *testing.T) {
+	ps := newMiniStore(t, 2)
+	ps.peerTimeIndex = true
+	ps.purgeResetsDL = true
+	ctx := context.Background()
+
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	other, _ := bittorrent.NewInfoHash([]byte("98765432109876543210"))
+	peers := timeIndexPeers(3)
+	require.Nil(t, ps.PutSeeder(ctx, ih, peers[0]))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peers[1]))
+	require.Nil(t, ps.PutSeeder(ctx, other, peers[2]))
+	require.Nil(t, ps.HIncrBy(ctx, CountDownloadsKey, ih.RawString(), 1).Err())
+
+	require.Nil(t, ps.PurgeSwarm(ctx, ih))
+	for _, k := range ps.swarmKeys(ih.RawString()) {
+		require.Zero(t, ps.Exists(ctx, k, PeerTimeKey(k)).Val(), k)
+		isMember, err := ps.SIsMember(ctx, ps.ihSetKey(k), k).Result()
+		require.Nil(t, err)
+		require.False(t, isMember, k)
+	}
+	require.False(t, ps.HExists(ctx, CountDownloadsKey, ih.RawString()).Val())
+	require.Equal(t, uint64(1), ps.count(CountSeederKey, false))
+	require.Zero(t, ps.count(CountLeecherKey, false))
+}
+
+func TestPurgeSwarmDownloads(t *testing.T) {
+	ps := newMiniStore(t, 1)
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash([]byte("01234567890123456789"))
+	peer := timeIndexPeers(1)[0]
+
+	for _, reset := range []bool{false, true} {
+		ps.purgeResetsDL = reset
+		require.Nil(t, ps.PutLeecher(ctx, ih, peer))
+		require.Nil(t, ps.GraduateLeecher(ctx, ih, peer))
+		_, _, before, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		require.NotZero(t, before)
+
+		require.Nil(t, ps.PurgeSwarm(ctx, ih))
+		_, _, after, err := ps.ScrapeSwarm(ctx, ih)
+		require.Nil(t, err)
+		if reset {
+			require.Zero(t, after)
+		} else {
+			require.Equal(t, before, after)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package redis
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSigned generates self-signed certificate for 127.0.0.1
+// and writes it and its key to PEM files in temporary directory
+func writeSelfSigned(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mochi test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return
+}
+
+func TestTLSConnect(t *testing.T) {
+	certFile, keyFile := writeSelfSigned(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.Nil(t, err)
+	mr, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	require.Nil(t, err)
+	t.Cleanup(mr.Close)
+
+	cfg := Config{
+		Addresses:      []string{mr.Addr()},
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		ConnectTimeout: time.Second,
+	}
+
+	cfg.TLS = TLSConfig{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}
+	ps, err := newStore(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.Close())
+
+	// CA file without certificates
+	cfg.TLS = TLSConfig{Enabled: true, CAFile: keyFile}
+	_, err = newStore(cfg)
+	require.NotNil(t, err)
+
+	cfg.TLS = TLSConfig{Enabled: true, CertFile: certFile}
+	_, err = cfg.Validate()
+	require.ErrorIs(t, err, errTLSCertKeyMismatch)
+
+	cfg.TLS = TLSConfig{Enabled: true, CertFile: certFile, KeyFile: filepath.Join(t.TempDir(), "missing.pem")}
+	_, err = cfg.Validate()
+	require.NotNil(t, err)
+
+	cfg.TLS = TLSConfig{Enabled: true, InsecureSkipVerify: true}
+	ps, err = newStore(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.Close())
+
+	// plaintext connection to TLS server fails
+	cfg.TLS = TLSConfig{}
+	_, err = newStore(cfg)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+type selectionSeedKey struct{}
+
+// WithSelectionSeed returns context with seed, which
+// PeerStorage may use to select peers in AnnouncePeers deterministically:
+// the same seed and the same swarm produce the same peers sample.
+// Storages, which do not support deterministic selection,
+// ignore this value and return random peers.
+func WithSelectionSeed(ctx context.Context, seed uint64) context.Context {
+	return context.WithValue(ctx, selectionSeedKey{}, seed)
+}
+
+// SelectionSeed returns seed set by WithSelectionSeed
+func SelectionSeed(ctx context.Context) (seed uint64, ok bool) {
+	seed, ok = ctx.Value(selectionSeedKey{}).(uint64)
+	return
+}
+
+// PeerRank returns the rank of peer for provided selection seed.
+// Deterministic selection should return peers with the lowest ranks,
+// so peers joined or left swarm affect sample only slightly.
+func PeerRank(seed uint64, p bittorrent.Peer) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seed)
+	_, _ = h.Write(b[:])
+	_, _ = h.Write(p.ID[:])
+	a, _ := p.AddrPort.MarshalBinary()
+	_, _ = h.Write(a)
+	return h.Sum64()
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// splitStorage is the PeerStorage, which delegates
+// peer operations to one backend and DataStorage operations
+// to another one.
+type splitStorage struct {
+	PeerStorage
+	data DataStorage
+}
+
+// NewSplitStorage creates PeerStorage, which uses peers to store
+// swarms and data for arbitrary data, provided by DataStorage
+// interface (i.e. for middleware).
+// Close of returned storage closes both backends.
+func NewSplitStorage(peers PeerStorage, data DataStorage) PeerStorage {
+	return exposeOptional(&splitStorage{PeerStorage: peers, data: data}, peers)
+}
+
+func (s *splitStorage) DeletePeerID(ctx context.Context, ih bittorrent.InfoHash, id bittorrent.PeerID, v6 bool) error {
+	return DeletePeerID(ctx, s.PeerStorage, ih, id, v6)
+}
+
+func (s *splitStorage) DeletePeers(ctx context.Context, ih bittorrent.InfoHash, peers ...bittorrent.Peer) error {
+	return DeletePeers(ctx, s.PeerStorage, ih, peers...)
+}
+
+func (s *splitStorage) ExpireSwarm(ctx context.Context, ih bittorrent.InfoHash, cutoff time.Time) (uint32, error) {
+	return ExpireSwarm(ctx, s.PeerStorage, ih, cutoff)
+}
+
+func (s *splitStorage) CountPeersByIP(ctx context.Context, ih bittorrent.InfoHash, ip netip.Addr) (uint32, error) {
+	return CountPeersByIP(ctx, s.PeerStorage, ih, ip)
+}
+
+func (s *splitStorage) PeerStats(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (PeerStats, error) {
+	return LoadPeerStats(ctx, s.PeerStorage, ih, peer)
+}
+
+func (s *splitStorage) PeerExists(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (bool, error) {
+	return PeerExists(ctx, s.PeerStorage, ih, peer, seeder)
+}
+
+func (s *splitStorage) PeersExist(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer, seeder bool) ([]bool, error) {
+	return PeersExist(ctx, s.PeerStorage, ih, peers, seeder)
+}
+
+func (s *splitStorage) PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash) error {
+	return PurgeSwarm(ctx, s.PeerStorage, ih)
+}
+
+func (s *splitStorage) InfoHashes(ctx context.Context, cursor string, limit int) ([]bittorrent.InfoHash, string, error) {
+	return InfoHashes(ctx, s.PeerStorage, cursor, limit)
+}
+
+func (s *splitStorage) Put(ctx context.Context, storeCtx string, values ...Entry) error {
+	return s.data.Put(ctx, storeCtx, values...)
+}
+
+func (s *splitStorage) Contains(ctx context.Context, storeCtx string, key string) (bool, error) {
+	return s.data.Contains(ctx, storeCtx, key)
+}
+
+func (s *splitStorage) Load(ctx context.Context, storeCtx string, key string) ([]byte, error) {
+	return s.data.Load(ctx, storeCtx, key)
+}
+
+func (s *splitStorage) Delete(ctx context.Context, storeCtx string, keys ...string) error {
+	return s.data.Delete(ctx, storeCtx, keys...)
+}
+
+func (s *splitStorage) Preservable() bool {
+	return s.data.Preservable()
+}
+
+// Ping checks both peer and data backends (if last supports ping)
+func (s *splitStorage) Ping(ctx context.Context) error {
+	err := s.PeerStorage.Ping(ctx)
+	if p, isOk := s.data.(interface{ Ping(context.Context) error }); isOk && err == nil {
+		err = p.Ping(ctx)
+	}
+	return err
+}
+
+func (s *splitStorage) Close() error {
+	return errors.Join(s.PeerStorage.Close(), s.data.Close())
+}
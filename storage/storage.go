@@ -4,8 +4,10 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"sync"
 	"time"
 
@@ -21,6 +23,8 @@ const (
 	DefaultGarbageCollectionInterval = time.Minute * 3
 	// DefaultPeerLifetime default peer lifetime
 	DefaultPeerLifetime = time.Minute * 30
+	// DefaultInfoHashesLimit default page size of InfoHashLister.InfoHashes
+	DefaultInfoHashesLimit = 1000
 )
 
 var (
@@ -38,6 +42,12 @@ type Config struct {
 	PeerLifetime time.Duration `cfg:"peer_lifetime"`
 	// PrometheusReportingInterval period of statistics data polling
 	PrometheusReportingInterval time.Duration `cfg:"prometheus_reporting_interval"`
+	// WriteBehindInterval period of buffered swarm updates flush,
+	// zero disables write-behind buffering
+	WriteBehindInterval time.Duration `cfg:"write_behind_interval"`
+	// WriteBehindSize maximum number of buffered swarm updates
+	// before forced flush
+	WriteBehindSize int `cfg:"write_behind_size"`
 }
 
 func (c Config) sanitizeGCConfig() (gcInterval, peerTTL time.Duration) {
@@ -91,6 +101,15 @@ type Driver func(conf.MapConfig) (PeerStorage, error)
 // does not exist.
 var ErrResourceDoesNotExist = bittorrent.ClientError("resource does not exist")
 
+// ErrSwarmEmpty is the error returned by the AnnouncePeers method of the
+// PeerStorage interface if the requested swarm is tracked,
+// but there are no peers, which could be returned.
+var ErrSwarmEmpty = bittorrent.ClientError("swarm is empty")
+
+// ErrInvalidCursor is the error returned by the InfoHashes method
+// of the InfoHashLister interface if provided cursor cannot be parsed.
+var ErrInvalidCursor = errors.New("invalid info hashes cursor")
+
 // DataStorage is the interface, used for implementing store for arbitrary data
 type DataStorage interface {
 	io.Closer
@@ -126,8 +145,9 @@ type DataStorage interface {
 //     durations involved should be configurable.
 //   - IPv4 and IPv6 swarms may be isolated from each other.
 //
-// Implementations can be tested against this interface using the tests in
-// storage_test.go and the benchmarks in storage_bench.go.
+// Implementations can be tested against this interface using the
+// test.RunPeerStorageTests conformance suite and the test.RunBenchmarks
+// benchmarks from storage/test package.
 type PeerStorage interface {
 	DataStorage
 	// PutSeeder adds a Seeder to the Swarm identified by the provided
@@ -137,8 +157,10 @@ type PeerStorage interface {
 	// DeleteSeeder removes a Seeder from the Swarm identified by the
 	// provided InfoHash.
 	//
-	// If the Swarm or Peer does not exist, this function returns
-	// ErrResourceDoesNotExist.
+	// If the Swarm does not exist or Peer is not stored as a Seeder
+	// of existing Swarm, this function returns ErrResourceDoesNotExist.
+	// Callers, which delete Peer regardless of its presence (i.e. on
+	// `stopped` event), should ignore this error.
 	DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error
 
 	// PutLeecher adds a Leecher to the Swarm identified by the provided
@@ -149,8 +171,10 @@ type PeerStorage interface {
 	// DeleteLeecher removes a Leecher from the Swarm identified by the
 	// provided InfoHash.
 	//
-	// If the Swarm or Peer does not exist, this function returns
-	// ErrResourceDoesNotExist.
+	// If the Swarm does not exist or Peer is not stored as a Leecher
+	// of existing Swarm, this function returns ErrResourceDoesNotExist.
+	// Callers, which delete Peer regardless of its presence (i.e. on
+	// `stopped` event), should ignore this error.
 	DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error
 
 	// GraduateLeecher promotes a Leecher to a Seeder in the Swarm
@@ -174,7 +198,8 @@ type PeerStorage interface {
 	// - if seeder is false, should ideally return more seeders than
 	//   leechers
 	//
-	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
+	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked
+	// and ErrSwarmEmpty if InfoHash is tracked, but there are no suitable peers.
 	AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error)
 
 	// ScrapeSwarm returns information required to answer a Scrape request
@@ -200,6 +225,266 @@ type GarbageCollector interface {
 	ScheduleGC(gcInterval, peerLifeTime time.Duration)
 }
 
+// PeerIDDeleter marks that this storage supports deletion of peers
+// by PeerID regardless of their address
+type PeerIDDeleter interface {
+	// DeletePeerID removes Seeders and Leechers with provided PeerID
+	// from the IPv4 or IPv6 Swarm identified by the provided InfoHash.
+	//
+	// If the Swarm or Peers do not exist, this function returns
+	// ErrResourceDoesNotExist.
+	DeletePeerID(ctx context.Context, ih bittorrent.InfoHash, id bittorrent.PeerID, v6 bool) error
+}
+
+// ErrDeletePeerIDNotSupported is returned by DeletePeerID if storage
+// does not implement PeerIDDeleter
+var ErrDeletePeerIDNotSupported = errors.New("storage does not support peers deletion by ID")
+
+// DeletePeerID removes Peers with provided PeerID from the Swarm.
+// If ps does not implement PeerIDDeleter, ErrDeletePeerIDNotSupported
+// is returned.
+func DeletePeerID(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, id bittorrent.PeerID, v6 bool) error {
+	if d, isOk := ps.(PeerIDDeleter); isOk {
+		return d.DeletePeerID(ctx, ih, id, v6)
+	}
+	return ErrDeletePeerIDNotSupported
+}
+
+// PeersDeleter marks that this storage supports deletion of
+// several peers with one call
+type PeersDeleter interface {
+	// DeletePeers removes provided Peers from both Seeders and Leechers
+	// of the Swarm identified by the provided InfoHash.
+	//
+	// If none of Peers exist, this function returns
+	// ErrResourceDoesNotExist.
+	DeletePeers(ctx context.Context, ih bittorrent.InfoHash, peers ...bittorrent.Peer) error
+}
+
+// DeletePeers removes provided Peers from both Seeders and Leechers
+// of the Swarm. If ps does not implement PeersDeleter, Peers are
+// deleted one by one with DeleteSeeder and DeleteLeecher.
+func DeletePeers(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, peers ...bittorrent.Peer) error {
+	if d, isOk := ps.(PeersDeleter); isOk {
+		return d.DeletePeers(ctx, ih, peers...)
+	}
+	deleted := false
+	for _, p := range peers {
+		for _, del := range []func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error{ps.DeleteSeeder, ps.DeleteLeecher} {
+			if err := del(ctx, ih, p); err == nil {
+				deleted = true
+			} else if !errors.Is(err, ErrResourceDoesNotExist) {
+				return err
+			}
+		}
+	}
+	if !deleted {
+		return ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+// SwarmExpirer marks that this storage supports deletion of stale
+// peers of one swarm without waiting for garbage collection
+type SwarmExpirer interface {
+	// ExpireSwarm removes Seeders and Leechers of the Swarm identified
+	// by the provided InfoHash, which announced not after cutoff,
+	// and returns the number of removed Peers.
+	ExpireSwarm(ctx context.Context, ih bittorrent.InfoHash, cutoff time.Time) (removed uint32, err error)
+}
+
+// ErrExpireNotSupported is returned by ExpireSwarm if storage
+// does not implement SwarmExpirer
+var ErrExpireNotSupported = errors.New("storage does not support swarm expiration")
+
+// ExpireSwarm removes Peers of the Swarm, which announced not after
+// cutoff. If ps does not implement SwarmExpirer, ErrExpireNotSupported
+// is returned.
+func ExpireSwarm(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, cutoff time.Time) (uint32, error) {
+	if e, isOk := ps.(SwarmExpirer); isOk {
+		return e.ExpireSwarm(ctx, ih, cutoff)
+	}
+	return 0, ErrExpireNotSupported
+}
+
+// PeerChecker marks that this storage is able to check
+// if Peer is stored in the Swarm
+type PeerChecker interface {
+	// PeerExists checks if Peer is stored as a Seeder (if seeder is true)
+	// or as a Leecher in the Swarm identified by the provided InfoHash.
+	// Swarm of the same address family as Peer is checked.
+	//
+	// InfoHash is checked as is: swarms of v2 info hash and of its
+	// truncated v1 form are different swarms, so caller should check
+	// both forms if hybrid torrent is expected.
+	PeerExists(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (bool, error)
+}
+
+// ErrPeerCheckNotSupported is returned by PeerExists if storage
+// does not implement PeerChecker
+var ErrPeerCheckNotSupported = errors.New("storage does not support peer existence check")
+
+// PeerExists checks if Peer is stored in the Swarm. If ps does not
+// implement PeerChecker, ErrPeerCheckNotSupported is returned.
+func PeerExists(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (bool, error) {
+	if c, isOk := ps.(PeerChecker); isOk {
+		return c.PeerExists(ctx, ih, peer, seeder)
+	}
+	return false, ErrPeerCheckNotSupported
+}
+
+// PeersChecker marks that this storage is able to check
+// if several Peers are stored in the Swarm with one call
+type PeersChecker interface {
+	// PeersExist is the same as PeerChecker.PeerExists, but checks
+	// all provided Peers. Result contains existence flag of each
+	// Peer in the same order as peers.
+	PeersExist(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer, seeder bool) ([]bool, error)
+}
+
+// PeersExist checks if Peers are stored in the Swarm. If ps does not
+// implement PeersChecker, Peers are checked one by one with PeerExists.
+func PeersExist(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, peers []bittorrent.Peer, seeder bool) ([]bool, error) {
+	if c, isOk := ps.(PeersChecker); isOk {
+		return c.PeersExist(ctx, ih, peers, seeder)
+	}
+	res := make([]bool, len(peers))
+	for i, p := range peers {
+		exists, err := PeerExists(ctx, ps, ih, p, seeder)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = exists
+	}
+	return res, nil
+}
+
+// SwarmPurger marks that this storage supports deletion
+// of whole Swarm
+type SwarmPurger interface {
+	// PurgeSwarm removes all Seeders and Leechers of both address families
+	// of the Swarm identified by the provided InfoHash, so it is not
+	// tracked anymore. Download count is removed too, if storage
+	// is configured to do it (i.e. redis `purge_resets_downloads`).
+	//
+	// InfoHash is purged as is (see PeerChecker).
+	// If the Swarm does not exist, no error is returned.
+	PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash) error
+}
+
+// ErrPurgeNotSupported is returned by PurgeSwarm if storage
+// does not implement SwarmPurger
+var ErrPurgeNotSupported = errors.New("storage does not support swarm purge")
+
+// PurgeSwarm removes all Peers of the Swarm. If ps does not
+// implement SwarmPurger, ErrPurgeNotSupported is returned.
+func PurgeSwarm(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash) error {
+	if p, isOk := ps.(SwarmPurger); isOk {
+		return p.PurgeSwarm(ctx, ih)
+	}
+	return ErrPurgeNotSupported
+}
+
+// InfoHashLister marks that this storage is able to list
+// tracked info hashes
+type InfoHashLister interface {
+	// InfoHashes returns page of at most limit (approximately for some storages)
+	// tracked info hashes, which starts after provided cursor,
+	// and cursor of the next page.
+	// Empty cursor means the first page, empty next cursor
+	// means that there are no more pages.
+	// If limit is not positive, DefaultInfoHashesLimit is used.
+	//
+	// Pagination is best-effort: info hashes added or removed while
+	// paging may be missed or returned more than once, but info hashes
+	// tracked during the whole iteration are returned at least once.
+	// Cursor is opaque and specific to the storage implementation.
+	InfoHashes(ctx context.Context, cursor string, limit int) (infoHashes []bittorrent.InfoHash, nextCursor string, err error)
+}
+
+// ErrListNotSupported is returned by InfoHashes if storage
+// does not implement InfoHashLister
+var ErrListNotSupported = errors.New("storage does not support info hashes listing")
+
+// InfoHashes returns page of tracked info hashes. If ps does not
+// implement InfoHashLister, ErrListNotSupported is returned.
+func InfoHashes(ctx context.Context, ps PeerStorage, cursor string, limit int) ([]bittorrent.InfoHash, string, error) {
+	if l, isOk := ps.(InfoHashLister); isOk {
+		return l.InfoHashes(ctx, cursor, limit)
+	}
+	return nil, "", ErrListNotSupported
+}
+
+// IPPeerCounter marks that this storage is able to count peers
+// of the Swarm with the same IP address without fetching whole Swarm
+type IPPeerCounter interface {
+	// CountPeersByIP returns the number of distinct Seeders and Leechers
+	// of the Swarm identified by the provided InfoHash, which have
+	// the provided IP address.
+	CountPeersByIP(ctx context.Context, ih bittorrent.InfoHash, ip netip.Addr) (uint32, error)
+}
+
+// ErrCountByIPNotSupported is returned by CountPeersByIP if storage
+// does not implement IPPeerCounter
+var ErrCountByIPNotSupported = errors.New("storage does not support counting peers by IP")
+
+// CountPeersByIP returns the number of Peers of the Swarm with the
+// provided IP address. If ps does not implement IPPeerCounter,
+// ErrCountByIPNotSupported is returned.
+func CountPeersByIP(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, ip netip.Addr) (uint32, error) {
+	if c, isOk := ps.(IPPeerCounter); isOk {
+		return c.CountPeersByIP(ctx, ih, ip)
+	}
+	return 0, ErrCountByIPNotSupported
+}
+
+// PeerStats holds transfer statistics of Peer
+// reported in its last announce
+type PeerStats struct {
+	Uploaded   uint64
+	Downloaded uint64
+	Left       uint64
+}
+
+type peerStatsKey struct{}
+
+// WithPeerStats returns context, which carries statistics of announcing
+// Peer, so storage, which implements PeerStatsStorage, is able to
+// store them within PutSeeder, PutLeecher and GraduateLeecher calls.
+func WithPeerStats(ctx context.Context, stats PeerStats) context.Context {
+	return context.WithValue(ctx, peerStatsKey{}, stats)
+}
+
+// PeerStatsFromContext returns statistics placed into context
+// with WithPeerStats
+func PeerStatsFromContext(ctx context.Context) (stats PeerStats, found bool) {
+	stats, found = ctx.Value(peerStatsKey{}).(PeerStats)
+	return
+}
+
+// PeerStatsStorage marks that this storage keeps transfer
+// statistics of Peers (see WithPeerStats)
+type PeerStatsStorage interface {
+	// PeerStats returns statistics of Peer in the Swarm identified
+	// by the provided InfoHash. Statistics of seeder are preferred
+	// over leecher's ones. If Peer or its statistics are not stored,
+	// zero PeerStats returned.
+	PeerStats(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (PeerStats, error)
+}
+
+// ErrPeerStatsNotSupported is returned by LoadPeerStats if storage
+// does not implement PeerStatsStorage
+var ErrPeerStatsNotSupported = errors.New("storage does not support peer statistics")
+
+// LoadPeerStats returns statistics of Peer in the Swarm. If ps does
+// not implement PeerStatsStorage, ErrPeerStatsNotSupported is returned.
+func LoadPeerStats(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, peer bittorrent.Peer) (PeerStats, error) {
+	if s, isOk := ps.(PeerStatsStorage); isOk {
+		return s.PeerStats(ctx, ih, peer)
+	}
+	return PeerStats{}, ErrPeerStatsNotSupported
+}
+
 // StatisticsCollector marks that this storage supports periodic
 // statistics collection
 type StatisticsCollector interface {
@@ -231,6 +516,26 @@ func RegisterDriver(name string, d Driver) {
 	drivers[name] = d
 }
 
+// NewDataStorage attempts to initialize a new storage instance from
+// the list of registered drivers, which will be used only as DataStorage,
+// so neither GC nor statistics collection are scheduled.
+func NewDataStorage(cfg conf.NamedMapConfig) (DataStorage, error) {
+	driversMU.RLock()
+	defer driversMU.RUnlock()
+	logger.Debug().Object("config", cfg).Msg("starting data storage")
+
+	b, ok := drivers[cfg.Name]
+	if !ok {
+		return nil, fmt.Errorf("storage with name '%s' does not exists", cfg.Name)
+	}
+
+	ds, err := b(cfg.Config)
+	if err == nil {
+		logger.Info().Str("name", cfg.Name).Msg("data storage started")
+	}
+	return ds, err
+}
+
 // NewStorage attempts to initialize a new PeerStorage instance from
 // the list of registered drivers.
 func NewStorage(cfg conf.NamedMapConfig) (ps PeerStorage, err error) {
@@ -283,6 +588,15 @@ func NewStorage(cfg conf.NamedMapConfig) (ps PeerStorage, err error) {
 			Msg("storage does not support statistics collection")
 	}
 
+	if c.WriteBehindInterval > 0 {
+		logger.Info().
+			Str("name", cfg.Name).
+			Dur("interval", c.WriteBehindInterval).
+			Int("size", c.WriteBehindSize).
+			Msg("enabling write-behind buffer")
+		ps = NewWriteBehindStorage(ps, c.WriteBehindInterval, c.WriteBehindSize)
+	}
+
 	logger.Info().Str("name", cfg.Name).Msg("storage started")
 
 	return
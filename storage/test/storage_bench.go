@@ -5,12 +5,14 @@ package test
 import (
 	"context"
 	cr "crypto/rand"
+	"errors"
 	"math/rand"
 	"net"
 	"net/netip"
 	"runtime"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/storage"
@@ -465,6 +467,89 @@ func (bh *benchHolder) ScrapeSwarm1kInfoHash(b *testing.B) {
 	})
 }
 
+// ignoreNotExist filters out errors, which are expected while several
+// goroutines concurrently modify the same swarm.
+func ignoreNotExist(err error) error {
+	if errors.Is(err, storage.ErrResourceDoesNotExist) || errors.Is(err, storage.ErrSwarmEmpty) {
+		return nil
+	}
+	return err
+}
+
+// MixedContention benchmarks concurrent PutLeecher, GraduateLeecher,
+// AnnouncePeers and DeleteSeeder methods of a storage.PeerStorage
+// executed against one swarm, so that all goroutines compete for the
+// same resources.
+//
+// MixedContention can run in parallel.
+func (bh *benchHolder) MixedContention(b *testing.B) {
+	bh.runBenchmark(b, true, putPeers, func(i int, ps storage.PeerStorage, bd *benchData) error {
+		ih, peer := bd.infoHashes[0], bd.peers[i%peersCount]
+		var err error
+		switch i % 4 {
+		case 0:
+			err = ps.PutLeecher(context.TODO(), ih, peer)
+		case 1:
+			err = ps.GraduateLeecher(context.TODO(), ih, peer)
+		case 2:
+			_, err = ps.AnnouncePeers(context.TODO(), ih, false, 50, peer.Addr().Is6())
+		default:
+			err = ps.DeleteSeeder(context.TODO(), ih, peer)
+		}
+		return ignoreNotExist(err)
+	})
+}
+
+// MixedReadHeavy benchmarks the workload of a typical tracker:
+// 90% of operations are AnnouncePeers and ScrapeSwarm and 10%
+// are PutSeeder for one of 1000 infoHashes.
+//
+// MixedReadHeavy can run in parallel.
+func (bh *benchHolder) MixedReadHeavy(b *testing.B) {
+	bh.runBenchmark(b, true, putPeers, func(i int, ps storage.PeerStorage, bd *benchData) error {
+		ih, peer := bd.infoHashes[i%ihCount], bd.peers[(i*3)%peersCount]
+		var err error
+		switch n := i % 10; {
+		case n == 0:
+			err = ps.PutSeeder(context.TODO(), ih, peer)
+		case n < 6:
+			_, err = ps.AnnouncePeers(context.TODO(), ih, n%2 == 0, 50, peer.Addr().Is6())
+		default:
+			_, _, _, err = ps.ScrapeSwarm(context.TODO(), ih)
+		}
+		return ignoreNotExist(err)
+	})
+}
+
+// MixedWithGC behaves like MixedReadHeavy, but storage.PeerStorage
+// garbage collection (if supported) runs every millisecond
+// and removes all peers which were not updated within this interval.
+//
+// MixedWithGC can run in parallel.
+func (bh *benchHolder) MixedWithGC(b *testing.B) {
+	scheduleGC := func(ps storage.PeerStorage, bd *benchData) error {
+		if gc, isOk := ps.(storage.GarbageCollector); isOk {
+			gc.ScheduleGC(time.Millisecond, time.Millisecond)
+		}
+		return putPeers(ps, bd)
+	}
+	bh.runBenchmark(b, true, scheduleGC, func(i int, ps storage.PeerStorage, bd *benchData) error {
+		ih, peer := bd.infoHashes[i%ihCount], bd.peers[(i*3)%peersCount]
+		var err error
+		switch n := i % 10; {
+		case n == 0:
+			err = ps.PutLeecher(context.TODO(), ih, peer)
+		case n == 1:
+			err = ps.GraduateLeecher(context.TODO(), ih, peer)
+		case n < 6:
+			_, err = ps.AnnouncePeers(context.TODO(), ih, n%2 == 0, 50, peer.Addr().Is6())
+		default:
+			_, _, _, err = ps.ScrapeSwarm(context.TODO(), ih)
+		}
+		return ignoreNotExist(err)
+	})
+}
+
 // RunBenchmarks starts series of benchmarks
 func RunBenchmarks(b *testing.B, newStorage benchStorageConstructor) {
 	bh := benchHolder{st: newStorage}
@@ -495,4 +580,7 @@ func RunBenchmarks(b *testing.B, newStorage benchStorageConstructor) {
 	b.Run("BenchmarkAnnounceSeeder1kInfoHash", bh.AnnounceSeeder1kInfoHash)
 	b.Run("BenchmarkScrapeSwarm", bh.ScrapeSwarm)
 	b.Run("BenchmarkScrapeSwarm1kInfoHash", bh.ScrapeSwarm1kInfoHash)
+	b.Run("BenchmarkMixedContention", bh.MixedContention)
+	b.Run("BenchmarkMixedReadHeavy", bh.MixedReadHeavy)
+	b.Run("BenchmarkMixedWithGC", bh.MixedWithGC)
 }
@@ -0,0 +1,383 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+type conformanceHolder struct {
+	st func() storage.PeerStorage
+}
+
+// run creates new storage.PeerStorage for the test and closes it after
+func (ch conformanceHolder) run(fn func(*testing.T, storage.PeerStorage)) func(*testing.T) {
+	return func(t *testing.T) {
+		ps := ch.st()
+		defer func() {
+			require.Nil(t, ps.Close())
+		}()
+		fn(t, ps)
+	}
+}
+
+func requireScrape(t *testing.T, ps storage.PeerStorage, ih bittorrent.InfoHash, leechers, seeders uint32) {
+	t.Helper()
+	l, s, _, err := ps.ScrapeSwarm(context.TODO(), ih)
+	require.Nil(t, err)
+	require.Equal(t, leechers, l, "leechers")
+	require.Equal(t, seeders, s, "seeders")
+}
+
+// missingResources checks that operations with not existing swarms or peers
+// return ErrResourceDoesNotExist and scrape of them returns zeroes.
+func missingResources(t *testing.T, ps storage.PeerStorage) {
+	for _, c := range testData {
+		require.ErrorIs(t, ps.DeleteLeecher(context.TODO(), c.ih, c.peer), storage.ErrResourceDoesNotExist)
+		require.ErrorIs(t, ps.DeleteSeeder(context.TODO(), c.ih, c.peer), storage.ErrResourceDoesNotExist)
+		_, err := ps.AnnouncePeers(context.TODO(), c.ih, false, 50, c.peer.Addr().Is6())
+		require.ErrorIs(t, err, storage.ErrResourceDoesNotExist)
+		requireScrape(t, ps, c.ih, 0, 0)
+
+		// swarm exists, but peer does not
+		require.Nil(t, ps.PutLeecher(context.TODO(), c.ih, c.peer))
+		other := bittorrent.Peer{ID: randPeerID(), AddrPort: c.peer.AddrPort}
+		require.ErrorIs(t, ps.DeleteLeecher(context.TODO(), c.ih, other), storage.ErrResourceDoesNotExist)
+		require.ErrorIs(t, ps.DeleteSeeder(context.TODO(), c.ih, c.peer), storage.ErrResourceDoesNotExist)
+	}
+}
+
+// putDeleteGraduate checks lifecycle of peer: leecher is visible for
+// seeders and leechers, graduated peer is visible as seeder only
+// and deleted peer is not visible at all.
+func putDeleteGraduate(t *testing.T, ps storage.PeerStorage) {
+	for _, c := range testData {
+		isV6 := c.peer.Addr().Is6()
+		require.Nil(t, ps.PutLeecher(context.TODO(), c.ih, c.peer))
+		requireScrape(t, ps, c.ih, 1, 0)
+		peers, err := ps.AnnouncePeers(context.TODO(), c.ih, true, 50, isV6)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c.peer))
+
+		require.Nil(t, ps.GraduateLeecher(context.TODO(), c.ih, c.peer))
+		requireScrape(t, ps, c.ih, 0, 1)
+		// seeder should not see other seeders
+		_, err = ps.AnnouncePeers(context.TODO(), c.ih, true, 50, isV6)
+		require.ErrorIs(t, err, storage.ErrSwarmEmpty)
+		peers, err = ps.AnnouncePeers(context.TODO(), c.ih, false, 50, isV6)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c.peer))
+		require.ErrorIs(t, ps.DeleteLeecher(context.TODO(), c.ih, c.peer), storage.ErrResourceDoesNotExist)
+
+		require.Nil(t, ps.DeleteSeeder(context.TODO(), c.ih, c.peer))
+		requireScrape(t, ps, c.ih, 0, 0)
+		// storage may either keep empty swarm or delete it
+		peers, err = ps.AnnouncePeers(context.TODO(), c.ih, false, 50, isV6)
+		require.True(t, errors.Is(err, storage.ErrSwarmEmpty) || errors.Is(err, storage.ErrResourceDoesNotExist))
+		require.False(t, containsPeer(peers, c.peer))
+
+		// graduation of unknown peer adds it as seeder
+		require.Nil(t, ps.GraduateLeecher(context.TODO(), c.ih, c.peer))
+		requireScrape(t, ps, c.ih, 0, 1)
+		require.Nil(t, ps.DeleteSeeder(context.TODO(), c.ih, c.peer))
+	}
+}
+
+// reAnnounceCounters checks that repeated announces of the same peer
+// do not change swarm counters.
+func reAnnounceCounters(t *testing.T, ps storage.PeerStorage) {
+	for _, c := range testData {
+		for i := 0; i < 3; i++ {
+			require.Nil(t, ps.PutLeecher(context.TODO(), c.ih, c.peer))
+		}
+		requireScrape(t, ps, c.ih, 1, 0)
+		for i := 0; i < 3; i++ {
+			require.Nil(t, ps.GraduateLeecher(context.TODO(), c.ih, c.peer))
+		}
+		requireScrape(t, ps, c.ih, 0, 1)
+		for i := 0; i < 3; i++ {
+			require.Nil(t, ps.PutSeeder(context.TODO(), c.ih, c.peer))
+		}
+		requireScrape(t, ps, c.ih, 0, 1)
+
+		// peers with the same ID but different endpoints are different peers
+		other := bittorrent.Peer{ID: c.peer.ID, AddrPort: netip.AddrPortFrom(c.peer.Addr(), c.peer.Port()+1)}
+		require.Nil(t, ps.PutLeecher(context.TODO(), c.ih, other))
+		require.Nil(t, ps.PutLeecher(context.TODO(), c.ih, other))
+		requireScrape(t, ps, c.ih, 1, 1)
+	}
+}
+
+// hybridSwarms checks that swarms of v2 info hash and of its v1 truncated
+// form are stored independently, so that middleware aggregating them
+// does not count peers twice.
+func hybridSwarms(t *testing.T, ps storage.PeerStorage) {
+	ih := randIH(true)
+	ihV1 := ih.TruncateV1()
+	peerV2 := bittorrent.Peer{ID: randPeerID(), AddrPort: netip.MustParseAddrPort("10.0.0.2:2")}
+	peerV1 := bittorrent.Peer{ID: randPeerID(), AddrPort: netip.MustParseAddrPort("10.0.0.1:1")}
+
+	require.Nil(t, ps.PutSeeder(context.TODO(), ih, peerV2))
+	require.Nil(t, ps.PutLeecher(context.TODO(), ihV1, peerV1))
+	requireScrape(t, ps, ih, 0, 1)
+	requireScrape(t, ps, ihV1, 1, 0)
+
+	peers, err := ps.AnnouncePeers(context.TODO(), ih, false, 50, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{peerV2}, peers)
+	peers, err = ps.AnnouncePeers(context.TODO(), ihV1, true, 50, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{peerV1}, peers)
+
+	require.Nil(t, ps.DeleteSeeder(context.TODO(), ih, peerV2))
+	requireScrape(t, ps, ih, 0, 0)
+	requireScrape(t, ps, ihV1, 1, 0)
+}
+
+// gcExpired checks that garbage collection removes peers,
+// which were not announced within peer lifetime.
+func gcExpired(t *testing.T, ps storage.PeerStorage) {
+	gc, isOk := ps.(storage.GarbageCollector)
+	if !isOk {
+		t.Skip("storage does not support garbage collection")
+	}
+	for _, c := range testData {
+		require.Nil(t, ps.PutLeecher(context.TODO(), c.ih, c.peer))
+		require.Nil(t, ps.PutSeeder(context.TODO(), c.ih, v4Peer))
+	}
+	gc.ScheduleGC(10*time.Millisecond, 10*time.Millisecond)
+	for _, c := range testData {
+		require.Eventually(t, func() bool {
+			l, s, _, err := ps.ScrapeSwarm(context.TODO(), c.ih)
+			return err == nil && l == 0 && s == 0
+		}, 3*time.Second, 10*time.Millisecond)
+		_, err := ps.AnnouncePeers(context.TODO(), c.ih, false, 50, c.peer.Addr().Is6())
+		require.Error(t, err)
+	}
+}
+
+// gcConcurrent checks invariants of garbage collection running in parallel
+// with other methods: peers, which are re-announced within peer lifetime,
+// are never removed, swarms emptied and re-populated during collection
+// stay usable, and stale peers are eventually removed.
+func gcConcurrent(t *testing.T, ps storage.PeerStorage) {
+	gc, isOk := ps.(storage.GarbageCollector)
+	if !isOk {
+		t.Skip("storage does not support garbage collection")
+	}
+	// cached clock used by storages has second precision,
+	// so lifetime should be noticeably longer
+	const lifetime, duration = 2 * time.Second, 2500 * time.Millisecond
+	stale := bittorrent.Peer{ID: randPeerID(), AddrPort: netip.MustParseAddrPort("10.0.0.3:3")}
+	for _, c := range testData {
+		require.Nil(t, ps.PutSeeder(context.TODO(), c.ih, stale))
+	}
+	gc.ScheduleGC(5*time.Millisecond, lifetime)
+
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(testData))
+	for _, c := range testData {
+		wg.Add(2)
+		// constantly re-announcing peer
+		go func(c hashPeer) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if err := ps.PutLeecher(context.TODO(), c.ih, c.peer); err != nil {
+					errs <- err
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(c)
+		// peer, which constantly appears and disappears
+		go func(c hashPeer) {
+			defer wg.Done()
+			peer := v4Peer
+			if c.peer.Addr().Is6() {
+				peer = v6Peer
+			}
+			for time.Now().Before(deadline) {
+				if err := ps.PutSeeder(context.TODO(), c.ih, peer); err != nil {
+					errs <- err
+					return
+				}
+				if err := ps.DeleteSeeder(context.TODO(), c.ih, peer); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	for _, c := range testData {
+		require.Eventually(t, func() bool {
+			l, s, _, err := ps.ScrapeSwarm(context.TODO(), c.ih)
+			return err == nil && l == 1 && s == 0
+		}, time.Second, 10*time.Millisecond)
+		peers, err := ps.AnnouncePeers(context.TODO(), c.ih, true, 50, c.peer.Addr().Is6())
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c.peer))
+	}
+}
+
+// peerExists checks that peer is found only in swarm and role
+// (seeder or leecher) it was stored with, and v2 info hash swarm
+// is checked independently of its truncated v1 form.
+func peerExists(t *testing.T, ps storage.PeerStorage) {
+	if !implements[storage.PeerChecker](ps) {
+		t.Skip("storage does not implement storage.PeerChecker")
+	}
+	requireExists := func(ih bittorrent.InfoHash, p bittorrent.Peer, seeder, expected bool) {
+		t.Helper()
+		exists, err := storage.PeerExists(context.TODO(), ps, ih, p, seeder)
+		require.Nil(t, err)
+		require.Equal(t, expected, exists)
+		batch, err := storage.PeersExist(context.TODO(), ps, ih, []bittorrent.Peer{v4Peer, p, v6Peer}, seeder)
+		require.Nil(t, err)
+		require.Equal(t, []bool{p == v4Peer && expected, expected, p == v6Peer && expected}, batch)
+	}
+	for _, c := range testData {
+		requireExists(c.ih, c.peer, false, false)
+		require.Nil(t, ps.PutLeecher(context.TODO(), c.ih, c.peer))
+		requireExists(c.ih, c.peer, false, true)
+		requireExists(c.ih, c.peer, true, false)
+		require.Nil(t, ps.GraduateLeecher(context.TODO(), c.ih, c.peer))
+		requireExists(c.ih, c.peer, true, true)
+		requireExists(c.ih, c.peer, false, false)
+
+		// another peer of the same and another address family
+		requireExists(c.ih, v4Peer, true, false)
+		requireExists(c.ih, v6Peer, true, false)
+		require.Nil(t, ps.DeleteSeeder(context.TODO(), c.ih, c.peer))
+		requireExists(c.ih, c.peer, true, false)
+	}
+
+	ih := randIH(true)
+	require.Nil(t, ps.PutSeeder(context.TODO(), ih, v6Peer))
+	requireExists(ih, v6Peer, true, true)
+	requireExists(ih.TruncateV1(), v6Peer, true, false)
+}
+
+// infoHashesPaging checks that paging through populated storage
+// returns every tracked info hash exactly once, even if info hash has
+// seeders and leechers in both IPv4 and IPv6 swarms.
+func infoHashesPaging(t *testing.T, ps storage.PeerStorage) {
+	if !implements[storage.InfoHashLister](ps) {
+		t.Skip("storage does not implement storage.InfoHashLister")
+	}
+	const count, limit = 25, 4
+	expected := make(map[bittorrent.InfoHash]bool, count)
+	for i := 0; i < count; i++ {
+		ih := randIH(i%2 == 0)
+		expected[ih] = true
+		require.Nil(t, ps.PutSeeder(context.TODO(), ih, v4Peer))
+		if i%3 == 0 {
+			require.Nil(t, ps.PutLeecher(context.TODO(), ih, v6Peer))
+		}
+		if i%5 == 0 {
+			require.Nil(t, ps.PutSeeder(context.TODO(), ih, v6Peer))
+		}
+	}
+
+	found := make(map[bittorrent.InfoHash]bool, count)
+	var cursor string
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, count, "too many pages")
+		infoHashes, next, err := storage.InfoHashes(context.TODO(), ps, cursor, limit)
+		require.Nil(t, err)
+		for _, ih := range infoHashes {
+			require.False(t, found[ih], "info hash returned twice")
+			found[ih] = true
+		}
+		if cursor = next; len(cursor) == 0 {
+			break
+		}
+	}
+	require.Equal(t, expected, found)
+
+	_, _, err := storage.InfoHashes(context.TODO(), ps, "!", limit)
+	require.ErrorIs(t, err, storage.ErrInvalidCursor)
+}
+
+// purgeSwarm checks that purged swarm is not tracked anymore in both
+// address families, other swarms are not affected, and purged info hash
+// may be announced again.
+func purgeSwarm(t *testing.T, ps storage.PeerStorage) {
+	for _, isOk := range []bool{
+		implements[storage.SwarmPurger](ps),
+		implements[storage.PeerChecker](ps),
+		implements[storage.InfoHashLister](ps),
+	} {
+		if !isOk {
+			t.Skip("storage does not implement storage.SwarmPurger, storage.PeerChecker or storage.InfoHashLister")
+		}
+	}
+	ih, other := randIH(false), randIH(true)
+	for _, p := range []bittorrent.Peer{v4Peer, v6Peer} {
+		leecher := bittorrent.Peer{ID: randPeerID(), AddrPort: netip.AddrPortFrom(p.Addr(), p.Port()+1)}
+		require.Nil(t, ps.PutLeecher(context.TODO(), ih, leecher))
+		require.Nil(t, ps.PutLeecher(context.TODO(), ih, p))
+		require.Nil(t, ps.GraduateLeecher(context.TODO(), ih, p))
+		require.Nil(t, ps.PutSeeder(context.TODO(), other, p))
+	}
+	requireScrape(t, ps, ih, 2, 2)
+
+	require.Nil(t, storage.PurgeSwarm(context.TODO(), ps, ih))
+	l, s, snatches, err := ps.ScrapeSwarm(context.TODO(), ih)
+	require.Nil(t, err)
+	require.Zero(t, l+s+snatches)
+	for _, p := range []bittorrent.Peer{v4Peer, v6Peer} {
+		_, err = ps.AnnouncePeers(context.TODO(), ih, false, 50, p.Addr().Is6())
+		require.True(t, errors.Is(err, storage.ErrSwarmEmpty) || errors.Is(err, storage.ErrResourceDoesNotExist))
+		exists, err := storage.PeerExists(context.TODO(), ps, ih, p, true)
+		require.Nil(t, err)
+		require.False(t, exists)
+	}
+	infoHashes, _, err := storage.InfoHashes(context.TODO(), ps, "", 0)
+	require.Nil(t, err)
+	require.NotContains(t, infoHashes, ih)
+	require.Contains(t, infoHashes, other)
+	requireScrape(t, ps, other, 0, 2)
+
+	// purge of not existing swarm is not an error
+	require.Nil(t, storage.PurgeSwarm(context.TODO(), ps, ih))
+	require.Nil(t, ps.PutLeecher(context.TODO(), ih, v4Peer))
+	requireScrape(t, ps, ih, 1, 0)
+}
+
+// implements checks if ps implements optional interface T
+func implements[T any](ps storage.PeerStorage) bool {
+	_, isOk := ps.(T)
+	return isOk
+}
+
+// RunPeerStorageTests checks that storage.PeerStorage implementation
+// conforms the contract of the interface.
+// Every test is executed with new instance of storage, so
+// newStorage must return empty storage each time.
+func RunPeerStorageTests(t *testing.T, newStorage func() storage.PeerStorage) {
+	ch := conformanceHolder{st: newStorage}
+	t.Run("MissingResources", ch.run(missingResources))
+	t.Run("PutDeleteGraduate", ch.run(putDeleteGraduate))
+	t.Run("ReAnnounceCounters", ch.run(reAnnounceCounters))
+	t.Run("HybridSwarms", ch.run(hybridSwarms))
+	t.Run("GCExpired", ch.run(gcExpired))
+	t.Run("GCConcurrent", ch.run(gcConcurrent))
+	t.Run("PeerExists", ch.run(peerExists))
+	t.Run("InfoHashesPaging", ch.run(infoHashesPaging))
+	t.Run("PurgeSwarm", ch.run(purgeSwarm))
+}
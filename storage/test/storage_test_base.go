@@ -73,7 +73,7 @@ func (th *testHolder) DeleteLeecher(t *testing.T) {
 func (th *testHolder) AnnouncePeers(t *testing.T) {
 	for _, c := range testData {
 		_, err := th.st.AnnouncePeers(context.TODO(), c.ih, false, 50, c.peer.Addr().Is6())
-		if errors.Is(err, storage.ErrResourceDoesNotExist) {
+		if errors.Is(err, storage.ErrResourceDoesNotExist) || errors.Is(err, storage.ErrSwarmEmpty) {
 			err = nil
 		}
 		require.Nil(t, err)
@@ -112,7 +112,7 @@ func (th *testHolder) LeecherPutAnnounceDeleteAnnounce(t *testing.T) {
 		require.Nil(t, err)
 
 		peers, err = th.st.AnnouncePeers(context.TODO(), c.ih, true, 50, isV6)
-		if errors.Is(err, storage.ErrResourceDoesNotExist) {
+		if errors.Is(err, storage.ErrResourceDoesNotExist) || errors.Is(err, storage.ErrSwarmEmpty) {
 			err = nil
 		}
 		require.Nil(t, err)
@@ -139,7 +139,7 @@ func (th *testHolder) SeederPutAnnounceDeleteAnnounce(t *testing.T) {
 		require.Nil(t, err)
 
 		peers, err = th.st.AnnouncePeers(context.TODO(), c.ih, false, 50, isV6)
-		if errors.Is(err, storage.ErrResourceDoesNotExist) {
+		if errors.Is(err, storage.ErrResourceDoesNotExist) || errors.Is(err, storage.ErrSwarmEmpty) {
 			err = nil
 		}
 		require.Nil(t, err)
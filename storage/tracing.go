@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/tracing"
+)
+
+// tracingStorage is the PeerStorage, which creates tracing span
+// for each peer operation of underlying storage.
+type tracingStorage struct {
+	PeerStorage
+}
+
+// NewTracingStorage wraps provided PeerStorage to trace peer operations.
+// Should be used only if tracing is enabled.
+func NewTracingStorage(ps PeerStorage) PeerStorage {
+	return exposeOptional(&tracingStorage{PeerStorage: ps}, ps)
+}
+
+func (s *tracingStorage) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.PutSeeder", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return s.PeerStorage.PutSeeder(ctx, ih, peer)
+}
+
+func (s *tracingStorage) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.DeleteSeeder", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return s.PeerStorage.DeleteSeeder(ctx, ih, peer)
+}
+
+func (s *tracingStorage) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.PutLeecher", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return s.PeerStorage.PutLeecher(ctx, ih, peer)
+}
+
+func (s *tracingStorage) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.DeleteLeecher", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return s.PeerStorage.DeleteLeecher(ctx, ih, peer)
+}
+
+func (s *tracingStorage) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.GraduateLeecher", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return s.PeerStorage.GraduateLeecher(ctx, ih, peer)
+}
+
+func (s *tracingStorage) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+	ctx, span := tracing.Start(ctx, "storage.AnnouncePeers", tracing.InfoHash(ih))
+	defer func() {
+		span.SetAttributes(tracing.AttrPeerCount.Int(len(peers)))
+		tracing.End(span, err)
+	}()
+	return s.PeerStorage.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+}
+
+func (s *tracingStorage) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
+	ctx, span := tracing.Start(ctx, "storage.ScrapeSwarm", tracing.InfoHash(ih))
+	defer func() {
+		span.SetAttributes(tracing.AttrPeerCount.Int64(int64(leechers) + int64(seeders)))
+		tracing.End(span, err)
+	}()
+	return s.PeerStorage.ScrapeSwarm(ctx, ih)
+}
+
+func (s *tracingStorage) PeerExists(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (exists bool, err error) {
+	ctx, span := tracing.Start(ctx, "storage.PeerExists", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return PeerExists(ctx, s.PeerStorage, ih, peer, seeder)
+}
+
+func (s *tracingStorage) PeersExist(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer, seeder bool) (exists []bool, err error) {
+	ctx, span := tracing.Start(ctx, "storage.PeersExist", tracing.InfoHash(ih))
+	defer func() {
+		span.SetAttributes(tracing.AttrPeerCount.Int(len(peers)))
+		tracing.End(span, err)
+	}()
+	return PeersExist(ctx, s.PeerStorage, ih, peers, seeder)
+}
+
+func (s *tracingStorage) DeletePeers(ctx context.Context, ih bittorrent.InfoHash, peers ...bittorrent.Peer) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.DeletePeers", tracing.InfoHash(ih))
+	defer func() {
+		span.SetAttributes(tracing.AttrPeerCount.Int(len(peers)))
+		tracing.End(span, err)
+	}()
+	return DeletePeers(ctx, s.PeerStorage, ih, peers...)
+}
+
+func (s *tracingStorage) ExpireSwarm(ctx context.Context, ih bittorrent.InfoHash, cutoff time.Time) (removed uint32, err error) {
+	ctx, span := tracing.Start(ctx, "storage.ExpireSwarm", tracing.InfoHash(ih))
+	defer func() {
+		span.SetAttributes(tracing.AttrPeerCount.Int64(int64(removed)))
+		tracing.End(span, err)
+	}()
+	return ExpireSwarm(ctx, s.PeerStorage, ih, cutoff)
+}
+
+func (s *tracingStorage) CountPeersByIP(ctx context.Context, ih bittorrent.InfoHash, ip netip.Addr) (n uint32, err error) {
+	ctx, span := tracing.Start(ctx, "storage.CountPeersByIP", tracing.InfoHash(ih))
+	defer func() {
+		span.SetAttributes(tracing.AttrPeerCount.Int64(int64(n)))
+		tracing.End(span, err)
+	}()
+	return CountPeersByIP(ctx, s.PeerStorage, ih, ip)
+}
+
+func (s *tracingStorage) PeerStats(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (stats PeerStats, err error) {
+	ctx, span := tracing.Start(ctx, "storage.PeerStats", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return LoadPeerStats(ctx, s.PeerStorage, ih, peer)
+}
+
+func (s *tracingStorage) PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.PurgeSwarm", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return PurgeSwarm(ctx, s.PeerStorage, ih)
+}
+
+func (s *tracingStorage) InfoHashes(ctx context.Context, cursor string, limit int) (infoHashes []bittorrent.InfoHash, nextCursor string, err error) {
+	ctx, span := tracing.Start(ctx, "storage.InfoHashes")
+	defer func() { tracing.End(span, err) }()
+	return InfoHashes(ctx, s.PeerStorage, cursor, limit)
+}
+
+func (s *tracingStorage) DeletePeerID(ctx context.Context, ih bittorrent.InfoHash, id bittorrent.PeerID, v6 bool) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.DeletePeerID", tracing.InfoHash(ih))
+	defer func() { tracing.End(span, err) }()
+	return DeletePeerID(ctx, s.PeerStorage, ih, id, v6)
+}
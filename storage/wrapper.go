@@ -0,0 +1,52 @@
+package storage
+
+// wrapper is the PeerStorage, which wraps another one (i.e. to trace or
+// buffer its operations) and implements all optional interfaces.
+// Methods of optional interfaces return appropriate error
+// (i.e. ErrPurgeNotSupported) if wrapped storage does not implement them.
+type wrapper interface {
+	wrapperBase
+	PeerChecker
+	PeerIDDeleter
+}
+
+// wrapperBase is the set of interfaces, which wrapper exposes
+// regardless of wrapped storage
+type wrapperBase interface {
+	PeerStorage
+	PeersDeleter
+	PeersChecker
+	SwarmExpirer
+	IPPeerCounter
+	PeerStatsStorage
+	SwarmPurger
+	InfoHashLister
+}
+
+// exposeOptional returns w, which implements PeerChecker and PeerIDDeleter
+// only if wrapped storage ps implements them, so support of these
+// interfaces may be detected with type assertion of returned storage.
+func exposeOptional(w wrapper, ps PeerStorage) PeerStorage {
+	_, isChecker := ps.(PeerChecker)
+	_, isDeleter := ps.(PeerIDDeleter)
+	switch {
+	case isChecker && isDeleter:
+		return struct {
+			wrapperBase
+			PeerChecker
+			PeerIDDeleter
+		}{w, w, w}
+	case isChecker:
+		return struct {
+			wrapperBase
+			PeerChecker
+		}{w, w}
+	case isDeleter:
+		return struct {
+			wrapperBase
+			PeerIDDeleter
+		}{w, w}
+	default:
+		return struct{ wrapperBase }{w}
+	}
+}
@@ -0,0 +1,470 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// DefaultWriteBehindSize default maximum number of pending swarm updates
+// in write-behind buffer before forced flush
+const DefaultWriteBehindSize = 10000
+
+// number of updates pending in all write-behind buffers
+var wbPending = expvar.NewInt("storage_write_behind_pending")
+
+type wbOp uint8
+
+const (
+	wbPutSeeder wbOp = iota
+	wbPutLeecher
+	wbGraduateLeecher
+	wbDeleteSeeder
+	wbDeleteLeecher
+	wbDeletePeer
+)
+
+type wbKey struct {
+	ih   bittorrent.InfoHash
+	peer bittorrent.Peer
+}
+
+// wbUpdate is pending operation with peer statistics
+// of announce (see WithPeerStats), if there were any
+type wbUpdate struct {
+	op       wbOp
+	stats    PeerStats
+	hasStats bool
+	// time of enqueue (unix nanoseconds)
+	at int64
+}
+
+func (op wbOp) isDelete() bool {
+	return op == wbDeleteSeeder || op == wbDeleteLeecher || op == wbDeletePeer
+}
+
+// writeBehindStorage is the PeerStorage, which buffers swarm updates
+// (puts and deletes) and flushes them to underlying storage
+// in background periodically or when buffer is full.
+// Updates of the same peer in the same swarm are applied in the order
+// they were made, but repeated updates of the same kind are coalesced:
+// only the last one is applied (subsequent deletes are merged).
+//
+// Reads (AnnouncePeers, ScrapeSwarm) are served directly by
+// underlying storage, so they may not reflect updates
+// made within the last flush interval. Checks of particular peers
+// (PeerExists, PeerStats, CountPeersByIP) and InfoHashes take
+// pending updates into account.
+type writeBehindStorage struct {
+	PeerStorage
+	mu      sync.Mutex
+	pending map[wbKey][]wbUpdate
+	size    int
+	// flushing holds updates, which are being applied by flush
+	flushing map[wbKey][]wbUpdate
+	// flushMu serializes flushes and operations,
+	// which must not interleave with them
+	flushMu sync.Mutex
+	maxSize int
+	flushCh chan struct{}
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+// NewWriteBehindStorage wraps provided PeerStorage with write-behind buffer,
+// which flushes swarm updates every interval or after maxSize
+// updates enqueued. Pending updates are flushed on Close.
+func NewWriteBehindStorage(ps PeerStorage, interval time.Duration, maxSize int) PeerStorage {
+	return exposeOptional(newWriteBehindStorage(ps, interval, maxSize), ps)
+}
+
+func newWriteBehindStorage(ps PeerStorage, interval time.Duration, maxSize int) *writeBehindStorage {
+	if maxSize <= 0 {
+		maxSize = DefaultWriteBehindSize
+	}
+	s := &writeBehindStorage{
+		PeerStorage: ps,
+		pending:     make(map[wbKey][]wbUpdate, maxSize),
+		maxSize:     maxSize,
+		flushCh:     make(chan struct{}, 1),
+		closed:      make(chan any),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.closed:
+				s.flush()
+				return
+			case <-t.C:
+				s.flush()
+			case <-s.flushCh:
+				s.flush()
+			}
+		}
+	}()
+	return s
+}
+
+func (s *writeBehindStorage) enqueue(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, op wbOp) {
+	k := wbKey{ih, peer}
+	u := wbUpdate{op: op, at: time.Now().UnixNano()}
+	u.stats, u.hasStats = PeerStatsFromContext(ctx)
+	s.mu.Lock()
+	updates := s.pending[k]
+	if l := len(updates) - 1; l >= 0 && (updates[l].op == op || updates[l].op.isDelete() && op.isDelete()) {
+		// deletion of seeder and leecher is deletion of peer
+		if updates[l].op != op {
+			u.op = wbDeletePeer
+		}
+		updates[l] = u
+	} else {
+		s.pending[k] = append(updates, u)
+		s.size++
+		wbPending.Add(1)
+	}
+	full := s.size >= s.maxSize
+	s.mu.Unlock()
+	if full {
+		select {
+		case s.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *writeBehindStorage) flush() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	pending, size := s.pending, s.size
+	s.pending, s.size = make(map[wbKey][]wbUpdate, s.maxSize), 0
+	s.flushing = pending
+	s.mu.Unlock()
+	wbPending.Add(-int64(size))
+
+	start := time.Now()
+	for k, updates := range pending {
+		for _, u := range updates {
+			s.apply(k, u)
+		}
+	}
+	s.mu.Lock()
+	s.flushing = nil
+	s.mu.Unlock()
+	logger.Debug().
+		Int("count", size).
+		Dur("timeTaken", time.Since(start)).
+		Msg("write-behind flush complete")
+}
+
+func (s *writeBehindStorage) apply(k wbKey, u wbUpdate) {
+	ctx := context.Background()
+	if u.hasStats {
+		ctx = WithPeerStats(ctx, u.stats)
+	}
+	var err error
+	switch u.op {
+	case wbPutSeeder:
+		err = s.PeerStorage.PutSeeder(ctx, k.ih, k.peer)
+	case wbPutLeecher:
+		err = s.PeerStorage.PutLeecher(ctx, k.ih, k.peer)
+	case wbGraduateLeecher:
+		err = s.PeerStorage.GraduateLeecher(ctx, k.ih, k.peer)
+	case wbDeleteSeeder:
+		err = s.PeerStorage.DeleteSeeder(ctx, k.ih, k.peer)
+	case wbDeleteLeecher:
+		err = s.PeerStorage.DeleteLeecher(ctx, k.ih, k.peer)
+	case wbDeletePeer:
+		err = DeletePeers(ctx, s.PeerStorage, k.ih, k.peer)
+	}
+	if err != nil && !errors.Is(err, ErrResourceDoesNotExist) {
+		logger.Error().Err(err).
+			Stringer("infoHash", k.ih).
+			Object("peer", k.peer).
+			Msg("unable to flush swarm update")
+	}
+}
+
+func (s *writeBehindStorage) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	s.enqueue(ctx, ih, peer, wbPutSeeder)
+	return nil
+}
+
+// DeleteSeeder enqueues seeder deletion, so it never
+// returns ErrResourceDoesNotExist
+func (s *writeBehindStorage) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	s.enqueue(ctx, ih, peer, wbDeleteSeeder)
+	return nil
+}
+
+func (s *writeBehindStorage) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	s.enqueue(ctx, ih, peer, wbPutLeecher)
+	return nil
+}
+
+// DeleteLeecher enqueues leecher deletion, so it never
+// returns ErrResourceDoesNotExist
+func (s *writeBehindStorage) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	s.enqueue(ctx, ih, peer, wbDeleteLeecher)
+	return nil
+}
+
+// DeletePeers enqueues deletion of each peer, so it never
+// returns ErrResourceDoesNotExist
+func (s *writeBehindStorage) DeletePeers(ctx context.Context, ih bittorrent.InfoHash, peers ...bittorrent.Peer) error {
+	for _, p := range peers {
+		s.enqueue(ctx, ih, p, wbDeletePeer)
+	}
+	return nil
+}
+
+func (s *writeBehindStorage) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	s.enqueue(ctx, ih, peer, wbGraduateLeecher)
+	return nil
+}
+
+// updates returns not applied updates of peer in swarm ih
+// in order they were made. Must be called with mu held.
+func (s *writeBehindStorage) updates(k wbKey) []wbUpdate {
+	if flushing := s.flushing[k]; len(flushing) > 0 {
+		return append(slices.Clip(flushing), s.pending[k]...)
+	}
+	return s.pending[k]
+}
+
+// pendingExists returns state of peer in swarm ih after
+// not applied updates, known is false if they do not change
+// state of seeder (if seeder is true) or leecher.
+func (s *writeBehindStorage) pendingExists(k wbKey, seeder bool) (exists, known bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.updates(k) {
+		switch u.op {
+		case wbPutSeeder, wbDeleteSeeder:
+			if seeder {
+				exists, known = u.op == wbPutSeeder, true
+			}
+		case wbPutLeecher, wbDeleteLeecher:
+			if !seeder {
+				exists, known = u.op == wbPutLeecher, true
+			}
+		case wbGraduateLeecher:
+			exists, known = seeder, true
+		case wbDeletePeer:
+			exists, known = false, true
+		}
+	}
+	return
+}
+
+// ExpireSwarm drops pending updates of the swarm made not after cutoff,
+// so they are not applied after expiration, and expires swarm
+// of underlying storage. Returned number of removed peers does not
+// include dropped updates.
+func (s *writeBehindStorage) ExpireSwarm(ctx context.Context, ih bittorrent.InfoHash, cutoff time.Time) (uint32, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	at := cutoff.UnixNano()
+	s.mu.Lock()
+	var dropped int
+	for k, updates := range s.pending {
+		if k.ih != ih {
+			continue
+		}
+		i := 0
+		for i < len(updates) && updates[i].at <= at {
+			i++
+		}
+		if i == len(updates) {
+			delete(s.pending, k)
+		} else if i > 0 {
+			s.pending[k] = updates[i:]
+		}
+		dropped += i
+	}
+	s.size -= dropped
+	s.mu.Unlock()
+	wbPending.Add(-int64(dropped))
+	return ExpireSwarm(ctx, s.PeerStorage, ih, cutoff)
+}
+
+// PeerStats returns statistics of the last pending update of peer,
+// if there is any, or statistics stored in underlying storage
+func (s *writeBehindStorage) PeerStats(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (PeerStats, error) {
+	var stats PeerStats
+	var found bool
+	s.mu.Lock()
+	for _, u := range s.updates(wbKey{ih, peer}) {
+		if u.op == wbDeletePeer {
+			stats, found = PeerStats{}, true
+		} else if !u.op.isDelete() && u.hasStats {
+			stats, found = u.stats, true
+		}
+	}
+	s.mu.Unlock()
+	if found {
+		return stats, nil
+	}
+	return LoadPeerStats(ctx, s.PeerStorage, ih, peer)
+}
+
+// drop removes pending updates of swarm ih, which satisfy match
+func (s *writeBehindStorage) drop(ih bittorrent.InfoHash, match func(bittorrent.Peer) bool) {
+	s.mu.Lock()
+	var dropped int
+	for k, updates := range s.pending {
+		if k.ih == ih && match(k.peer) {
+			delete(s.pending, k)
+			dropped += len(updates)
+		}
+	}
+	s.size -= dropped
+	s.mu.Unlock()
+	wbPending.Add(-int64(dropped))
+}
+
+// PurgeSwarm drops pending updates of the swarm, so they are not
+// applied after purge, and purges swarm of underlying storage
+func (s *writeBehindStorage) PurgeSwarm(ctx context.Context, ih bittorrent.InfoHash) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.drop(ih, func(bittorrent.Peer) bool { return true })
+	return PurgeSwarm(ctx, s.PeerStorage, ih)
+}
+
+// PeerExists checks peer in pending updates and,
+// if they do not change its state, in underlying storage
+func (s *writeBehindStorage) PeerExists(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (bool, error) {
+	if exists, known := s.pendingExists(wbKey{ih, peer}, seeder); known {
+		return exists, nil
+	}
+	return PeerExists(ctx, s.PeerStorage, ih, peer, seeder)
+}
+
+// PeersExist checks peers in pending updates and the rest of them
+// in underlying storage with one call
+func (s *writeBehindStorage) PeersExist(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer, seeder bool) ([]bool, error) {
+	res := make([]bool, len(peers))
+	var unknown []bittorrent.Peer
+	var unknownIdx []int
+	for i, p := range peers {
+		if exists, known := s.pendingExists(wbKey{ih, p}, seeder); known {
+			res[i] = exists
+		} else {
+			unknown, unknownIdx = append(unknown, p), append(unknownIdx, i)
+		}
+	}
+	if len(unknown) == 0 {
+		return res, nil
+	}
+	exists, err := PeersExist(ctx, s.PeerStorage, ih, unknown, seeder)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range exists {
+		res[unknownIdx[i]] = e
+	}
+	return res, nil
+}
+
+// InfoHashes lists info hashes of underlying storage, the first page
+// also contains swarms of pending puts, so swarms of the last announces
+// are listed (they may be listed again on the next pages).
+func (s *writeBehindStorage) InfoHashes(ctx context.Context, cursor string, limit int) ([]bittorrent.InfoHash, string, error) {
+	infoHashes, next, err := InfoHashes(ctx, s.PeerStorage, cursor, limit)
+	if err != nil || len(cursor) > 0 {
+		return infoHashes, next, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range []map[wbKey][]wbUpdate{s.flushing, s.pending} {
+		for k, updates := range m {
+			if !slices.ContainsFunc(updates, func(u wbUpdate) bool { return !u.op.isDelete() }) ||
+				slices.Contains(infoHashes, k.ih) {
+				continue
+			}
+			infoHashes = append(infoHashes, k.ih)
+		}
+	}
+	return infoHashes, next, err
+}
+
+// CountPeersByIP counts peers in underlying storage and
+// corrects result with pending updates of peers with the same IP
+func (s *writeBehindStorage) CountPeersByIP(ctx context.Context, ih bittorrent.InfoHash, ip netip.Addr) (uint32, error) {
+	n, err := CountPeersByIP(ctx, s.PeerStorage, ih, ip)
+	if err != nil {
+		return n, err
+	}
+	var keys []wbKey
+	s.mu.Lock()
+	for _, m := range []map[wbKey][]wbUpdate{s.flushing, s.pending} {
+		for k := range m {
+			if k.ih == ih && k.peer.Addr() == ip && !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	s.mu.Unlock()
+	count := int64(n)
+	for _, k := range keys {
+		// peer is counted by underlying storage if it is stored
+		// either as seeder or as leecher
+		var stored, exists bool
+		for _, seeder := range []bool{true, false} {
+			e, known := s.pendingExists(k, seeder)
+			se, err := PeerExists(ctx, s.PeerStorage, ih, k.peer, seeder)
+			if err != nil && !errors.Is(err, ErrPeerCheckNotSupported) {
+				return n, err
+			}
+			if !known {
+				e = se
+			}
+			stored, exists = stored || se, exists || e
+		}
+		if exists && !stored {
+			count++
+		} else if !exists && stored && count > 0 {
+			count--
+		}
+	}
+	return uint32(count), nil
+}
+
+// Close flushes pending updates and closes underlying storage
+func (s *writeBehindStorage) Close() (err error) {
+	s.onceCloser.Do(func() {
+		close(s.closed)
+		s.wg.Wait()
+		err = s.PeerStorage.Close()
+	})
+	return
+}
+
+// DeletePeerID drops pending updates of peers with provided id,
+// so they are not applied after deletion, and deletes peers
+// from underlying storage
+func (s *writeBehindStorage) DeletePeerID(ctx context.Context, ih bittorrent.InfoHash, id bittorrent.PeerID, v6 bool) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.drop(ih, func(p bittorrent.Peer) bool {
+		return p.ID == id && p.Addr().Is6() == v6
+	})
+	return DeletePeerID(ctx, s.PeerStorage, ih, id, v6)
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// recordingStorage records swarm updates applied to it
+type recordingStorage struct {
+	PeerStorage
+	mu     sync.Mutex
+	ops    []string
+	stats  []PeerStats
+	closed bool
+}
+
+func (r *recordingStorage) record(op string) error {
+	r.mu.Lock()
+	r.ops = append(r.ops, op)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recordingStorage) PutSeeder(context.Context, bittorrent.InfoHash, bittorrent.Peer) error {
+	return r.record("put seeder")
+}
+
+func (r *recordingStorage) PutLeecher(context.Context, bittorrent.InfoHash, bittorrent.Peer) error {
+	return r.record("put leecher")
+}
+
+func (r *recordingStorage) GraduateLeecher(ctx context.Context, _ bittorrent.InfoHash, _ bittorrent.Peer) error {
+	if stats, found := PeerStatsFromContext(ctx); found {
+		r.stats = append(r.stats, stats)
+	}
+	return r.record("graduate leecher")
+}
+
+func (r *recordingStorage) DeleteSeeder(context.Context, bittorrent.InfoHash, bittorrent.Peer) error {
+	_ = r.record("delete seeder")
+	return ErrResourceDoesNotExist
+}
+
+func (r *recordingStorage) DeleteLeecher(context.Context, bittorrent.InfoHash, bittorrent.Peer) error {
+	return r.record("delete leecher")
+}
+
+func (r *recordingStorage) PurgeSwarm(context.Context, bittorrent.InfoHash) error {
+	return r.record("purge")
+}
+
+// recordingIDStorage is the recordingStorage, which supports PeerIDDeleter
+type recordingIDStorage struct {
+	recordingStorage
+}
+
+func (r *recordingIDStorage) DeletePeerID(context.Context, bittorrent.InfoHash, bittorrent.PeerID, bool) error {
+	return r.record("delete peer id")
+}
+
+func (r *recordingStorage) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestWriteBehindCoalescing(t *testing.T) {
+	rs := &recordingStorage{}
+	s := newWriteBehindStorage(rs, time.Hour, 0)
+	defer s.Close()
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+
+	for _, tc := range []struct {
+		name    string
+		updates []func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error
+		applied []string
+	}{
+		{
+			name:    "repeated puts",
+			updates: []func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error{s.PutLeecher, s.PutLeecher, s.PutLeecher},
+			applied: []string{"put leecher"},
+		},
+		{
+			name:    "put and graduate",
+			updates: []func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error{s.PutLeecher, s.PutLeecher, s.GraduateLeecher},
+			applied: []string{"put leecher", "graduate leecher"},
+		},
+		{
+			name:    "delete and put",
+			updates: []func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error{s.DeleteLeecher, s.PutSeeder},
+			applied: []string{"delete leecher", "put seeder"},
+		},
+		{
+			name:    "merged deletes",
+			updates: []func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error{s.PutLeecher, s.DeleteSeeder, s.DeleteLeecher},
+			applied: []string{"put leecher", "delete seeder", "delete leecher"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rs.ops = nil
+			for _, u := range tc.updates {
+				require.Nil(t, u(ctx, ih, p))
+			}
+			require.Empty(t, rs.ops)
+			s.flush()
+			require.Equal(t, tc.applied, rs.ops)
+		})
+	}
+}
+
+func TestWriteBehindFlushOnSize(t *testing.T) {
+	rs := &recordingStorage{}
+	s := NewWriteBehindStorage(rs, time.Hour, 2)
+	defer s.Close()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	for i := byte(1); i <= 2; i++ {
+		require.Nil(t, s.PutSeeder(context.Background(), ih, bittorrent.Peer{
+			ID:       bittorrent.PeerID{i},
+			AddrPort: netip.MustParseAddrPort("10.0.0.1:1234"),
+		}))
+	}
+	require.Eventually(t, func() bool {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		return len(rs.ops) == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestWriteBehindFlushOnClose(t *testing.T) {
+	rs := &recordingStorage{}
+	s := NewWriteBehindStorage(rs, time.Hour, 0)
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	require.Nil(t, s.PutSeeder(context.Background(), ih, p))
+	require.Empty(t, rs.ops)
+
+	require.Nil(t, s.Close())
+	require.Equal(t, []string{"put seeder"}, rs.ops)
+	require.True(t, rs.closed)
+}
+
+func TestWriteBehindPeerStats(t *testing.T) {
+	rs := &recordingStorage{}
+	s := newWriteBehindStorage(rs, time.Hour, 0)
+	defer s.Close()
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+
+	require.Nil(t, s.PutLeecher(WithPeerStats(ctx, PeerStats{Left: 1}), ih, p))
+	require.Nil(t, s.GraduateLeecher(WithPeerStats(ctx, PeerStats{Uploaded: 2}), ih, p))
+	s.flush()
+	require.Equal(t, []PeerStats{{Uploaded: 2}}, rs.stats)
+}
+
+func TestWriteBehindPurgeSwarm(t *testing.T) {
+	rs := &recordingStorage{}
+	s := newWriteBehindStorage(rs, time.Hour, 0)
+	defer s.Close()
+	ctx := context.Background()
+	ih1, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	ih2, _ := bittorrent.NewInfoHashString("1123456789abcdef0123456789abcdef01234567")
+	p := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+
+	require.Nil(t, s.PutSeeder(ctx, ih1, p))
+	require.Nil(t, s.PutLeecher(ctx, ih2, p))
+	require.Nil(t, s.PurgeSwarm(ctx, ih1))
+	s.flush()
+	require.Equal(t, []string{"purge", "put leecher"}, rs.ops)
+}
+
+func TestWriteBehindDeletePeerID(t *testing.T) {
+	rs := &recordingIDStorage{}
+	s := newWriteBehindStorage(rs, time.Hour, 0)
+	defer s.Close()
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	p4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	p6 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("[::1]:1234")}
+
+	require.Nil(t, s.PutSeeder(ctx, ih, p4))
+	require.Nil(t, s.PutLeecher(ctx, ih, p6))
+	require.Nil(t, s.DeletePeerID(ctx, ih, p4.ID, false))
+	s.flush()
+	require.Equal(t, []string{"delete peer id", "put leecher"}, rs.ops)
+}
+
+func TestWriteBehindOptionalInterfaces(t *testing.T) {
+	for _, tc := range []struct {
+		ps        PeerStorage
+		checker   bool
+		idDeleter bool
+	}{
+		{&recordingStorage{}, false, false},
+		{&recordingIDStorage{}, false, true},
+		{&checkingStorage{}, true, false},
+	} {
+		s := NewWriteBehindStorage(tc.ps, time.Hour, 0)
+		_, isChecker := s.(PeerChecker)
+		_, isIDDeleter := s.(PeerIDDeleter)
+		require.Equal(t, tc.checker, isChecker)
+		require.Equal(t, tc.idDeleter, isIDDeleter)
+		_, isPurger := s.(SwarmPurger)
+		require.True(t, isPurger)
+		require.Nil(t, s.Close())
+	}
+}
+
+// checkingStorage is the recordingStorage, which supports PeerChecker
+// and IPPeerCounter, stored peers are ones with odd first byte of ID
+type checkingStorage struct {
+	recordingStorage
+}
+
+func (c *checkingStorage) PeerExists(_ context.Context, _ bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (bool, error) {
+	return seeder && peer.ID[0]%2 == 1, nil
+}
+
+func (c *checkingStorage) CountPeersByIP(context.Context, bittorrent.InfoHash, netip.Addr) (uint32, error) {
+	return 1, nil
+}
+
+func (c *checkingStorage) InfoHashes(_ context.Context, cursor string, _ int) ([]bittorrent.InfoHash, string, error) {
+	if len(cursor) > 0 {
+		return nil, "", nil
+	}
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	return []bittorrent.InfoHash{ih}, "next", nil
+}
+
+func TestWriteBehindPendingReads(t *testing.T) {
+	cs := &checkingStorage{}
+	s := newWriteBehindStorage(cs, time.Hour, 0)
+	defer s.Close()
+	ctx := context.Background()
+	ih1, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	ih2, _ := bittorrent.NewInfoHashString("1123456789abcdef0123456789abcdef01234567")
+	stored := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	added := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1235")}
+	ip := stored.Addr()
+
+	require.Nil(t, s.PutLeecher(WithPeerStats(ctx, PeerStats{Left: 1}), ih1, added))
+	exists, err := s.PeerExists(ctx, ih1, added, false)
+	require.Nil(t, err)
+	require.True(t, exists)
+	exists, err = s.PeerExists(ctx, ih1, added, true)
+	require.Nil(t, err)
+	require.False(t, exists)
+	exists, err = s.PeerExists(ctx, ih1, stored, true)
+	require.Nil(t, err)
+	require.True(t, exists)
+	stats, err := s.PeerStats(ctx, ih1, added)
+	require.Nil(t, err)
+	require.Equal(t, PeerStats{Left: 1}, stats)
+	n, err := s.CountPeersByIP(ctx, ih1, ip)
+	require.Nil(t, err)
+	require.EqualValues(t, 2, n)
+
+	require.Nil(t, s.DeleteSeeder(ctx, ih1, stored))
+	require.Nil(t, s.GraduateLeecher(ctx, ih1, added))
+	exists, err = s.PeerExists(ctx, ih1, stored, true)
+	require.Nil(t, err)
+	require.False(t, exists)
+	exists, err = s.PeerExists(ctx, ih1, added, true)
+	require.Nil(t, err)
+	require.True(t, exists)
+	n, err = s.CountPeersByIP(ctx, ih1, ip)
+	require.Nil(t, err)
+	require.EqualValues(t, 1, n)
+
+	require.Nil(t, s.PutSeeder(ctx, ih2, added))
+	infoHashes, next, err := s.InfoHashes(ctx, "", 0)
+	require.Nil(t, err)
+	require.Equal(t, "next", next)
+	require.ElementsMatch(t, []bittorrent.InfoHash{ih1, ih2}, infoHashes)
+	// nothing is flushed
+	require.Empty(t, cs.ops)
+}
+
+func TestWriteBehindExpireSwarm(t *testing.T) {
+	rs := &recordingStorage{}
+	s := newWriteBehindStorage(rs, time.Hour, 0)
+	defer s.Close()
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHashString("0123456789abcdef0123456789abcdef01234567")
+	p1 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")}
+	p2 := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("10.0.0.2:1234")}
+
+	require.Nil(t, s.PutSeeder(ctx, ih, p1))
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	require.Nil(t, s.PutLeecher(ctx, ih, p2))
+	_, err := s.ExpireSwarm(ctx, ih, cutoff)
+	require.ErrorIs(t, err, ErrExpireNotSupported)
+	s.flush()
+	require.Equal(t, []string{"put leecher"}, rs.ops)
+}